@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The merge radius when ?aggregateRadius is not given: in meters on
+// calibrated floors, in map pixels on others.
+const (
+	defaultAggregateMeters = 1
+	defaultAggregatePixels = 10
+)
+
+// aggregation merges measurements repeated at about the same spot, so a
+// desk sampled ten times counts as one point rather than outweighing its
+// surroundings in the interpolation.
+type aggregation struct {
+	Enabled bool
+	// Radius is how far measurements may be from the first of a merged
+	// point, in meters on calibrated floors and in map pixels on others;
+	// 0 uses the defaults.
+	Radius float64
+	// Window is how much later than the first a measurement may be taken
+	// and still be merged with it; 0 merges regardless of time.
+	Window time.Duration
+}
+
+// parseAggregation reads ?aggregate, ?aggregateRadius and ?aggregateWindow
+// (a duration such as 10m).
+func parseAggregation(query url.Values) (aggregation, error) {
+	var a aggregation
+	if value := query.Get("aggregate"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return a, fmt.Errorf("aggregate must be true or false")
+		}
+		a.Enabled = enabled
+	}
+	if value := query.Get("aggregateRadius"); value != "" {
+		radius, err := strconv.ParseFloat(value, 64)
+		if err != nil || radius <= 0 || math.IsInf(radius, 0) {
+			return a, fmt.Errorf("aggregateRadius must be a positive number")
+		}
+		a.Radius = radius
+	}
+	if value := query.Get("aggregateWindow"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window < 0 {
+			return a, fmt.Errorf("aggregateWindow must be a non-negative duration such as 10m")
+		}
+		a.Window = window
+	}
+	return a, nil
+}
+
+// pixels returns the merge radius in map pixels for a floor.
+func (a aggregation) pixels(metersPerPixel float64) float64 {
+	if metersPerPixel > 0 {
+		if a.Radius > 0 {
+			return a.Radius / metersPerPixel
+		}
+		return defaultAggregateMeters / metersPerPixel
+	}
+	if a.Radius > 0 {
+		return a.Radius
+	}
+	return defaultAggregatePixels
+}
+
+// MergedMeasurement is a point merged from repeated measurements. The
+// measurement is the first one, placed at the centroid of all, with the
+// median signal and metrics of those that were measured and the time of
+// the last.
+type MergedMeasurement struct {
+	Measurement
+	Samples int `json:"samples"`
+	Failed  int `json:"failed,omitempty"`
+	MinDbm  int `json:"minDbm"`
+	MaxDbm  int `json:"maxDbm"`
+	// Spread is MaxDbm - MinDbm.
+	Spread    int      `json:"spread"`
+	MemberIDs []string `json:"memberIds"`
+}
+
+type aggregateGroup struct {
+	anchorLat, anchorLng float64
+	first                time.Time
+	members              []Measurement
+}
+
+// aggregateMeasurements merges measurements of the same floor taken within
+// the radius and window of the first of a point, in the order of their
+// first measurement. With byBSSID, scan records of different BSSIDs are
+// never merged.
+func aggregateMeasurements(ms []Measurement, a aggregation, byBSSID bool) []MergedMeasurement {
+	sorted := slices.Clone(ms)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	type groupKey struct {
+		floor int
+		bssid string
+		cell  [2]int
+	}
+	radii := make(map[int]float64)
+	cells := make(map[groupKey][]*aggregateGroup)
+	var groups []*aggregateGroup
+	for _, m := range sorted {
+		radius, known := radii[m.Floor]
+		if !known {
+			mutex.Lock()
+			radius = a.pixels(floors[m.Floor].metersPerPixel())
+			mutex.Unlock()
+			radii[m.Floor] = radius
+		}
+
+		key := groupKey{floor: m.Floor}
+		if byBSSID && m.Type == "scan" {
+			key.bssid = m.BSSID
+		}
+		cellY, cellX := int(math.Floor(m.Lat/radius)), int(math.Floor(m.Lng/radius))
+
+		var nearest *aggregateGroup
+		nearestDistance := math.Inf(1)
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				key.cell = [2]int{cellY + dy, cellX + dx}
+				for _, g := range cells[key] {
+					if a.Window > 0 && m.Timestamp.Sub(g.first) > a.Window {
+						continue
+					}
+					distance := math.Hypot(m.Lat-g.anchorLat, m.Lng-g.anchorLng)
+					if distance <= radius && distance < nearestDistance {
+						nearest, nearestDistance = g, distance
+					}
+				}
+			}
+		}
+		if nearest == nil {
+			nearest = &aggregateGroup{anchorLat: m.Lat, anchorLng: m.Lng, first: m.Timestamp}
+			key.cell = [2]int{cellY, cellX}
+			cells[key] = append(cells[key], nearest)
+			groups = append(groups, nearest)
+		}
+		nearest.members = append(nearest.members, m)
+	}
+
+	merged := make([]MergedMeasurement, len(groups))
+	for i, g := range groups {
+		merged[i] = mergeMeasurements(g.members)
+	}
+	return merged
+}
+
+// mergeMeasurements merges the measurements of one point, sorted by time.
+func mergeMeasurements(members []Measurement) MergedMeasurement {
+	result := MergedMeasurement{Measurement: members[0], Samples: len(members)}
+	result.Timestamp = members[len(members)-1].Timestamp
+
+	var lat, lng float64
+	var dbms, accuracies, bitrates []float64
+	optional := make([][]float64, len(optionalMetricFields(&result.Measurement)))
+	for _, m := range members {
+		result.MemberIDs = append(result.MemberIDs, m.ID)
+		lat += m.Lat
+		lng += m.Lng
+		accuracies = append(accuracies, m.Accuracy)
+		bitrates = append(bitrates, m.TxBitrate)
+		if m.Dbm == failedSampleDbm {
+			result.Failed++
+		} else {
+			dbms = append(dbms, float64(m.Dbm))
+		}
+		for i, field := range optionalMetricFields(&m) {
+			if *field != nil {
+				optional[i] = append(optional[i], **field)
+			}
+		}
+	}
+	result.Lat = lat / float64(len(members))
+	result.Lng = lng / float64(len(members))
+	result.Accuracy = median(accuracies)
+	result.TxBitrate = median(bitrates)
+	for i, field := range optionalMetricFields(&result.Measurement) {
+		*field = nil
+		if len(optional[i]) > 0 {
+			value := median(optional[i])
+			*field = &value
+		}
+	}
+
+	if len(dbms) == 0 {
+		result.Dbm, result.MinDbm, result.MaxDbm = failedSampleDbm, failedSampleDbm, failedSampleDbm
+		return result
+	}
+	result.Dbm = int(math.Round(median(dbms)))
+	result.MinDbm, result.MaxDbm = int(dbms[0]), int(dbms[len(dbms)-1])
+	result.Spread = result.MaxDbm - result.MinDbm
+	return result
+}
+
+// optionalMetricFields are the optional metrics of a measurement.
+func optionalMetricFields(m *Measurement) []**float64 {
+	return []**float64{&m.LatencyMs, &m.ThroughputMbps, &m.UploadMbps, &m.LossPercent, &m.JitterMs, &m.NoiseDbm, &m.SNRDb, &m.BusyPercent, &m.Height}
+}
+
+// median sorts the values, of which there must be at least one, and
+// returns their median.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	return percentile(values, 50)
+}
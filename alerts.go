@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	alertsFile = "alerts.json"
+
+	// maxAlertCount is the longest run of matches a rule may wait for.
+	maxAlertCount = 100
+	// alertMaxAge keeps imported history from firing alerts.
+	alertMaxAge = time.Hour
+)
+
+var (
+	alertRules = make(map[string]AlertRule)
+	// alertStreaks counts the consecutive matches of each rule by probe.
+	alertStreaks = make(map[string]map[string]int)
+	alertsLock   sync.Mutex
+
+	allowPrivateWebhooks = flag.Bool("allow-private-webhooks", false, "allow alert webhooks to post to loopback and private network addresses")
+
+	// alertClient connects directly, so the address the dialer checks is
+	// that of the webhook.
+	alertClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: publicOnly(allowPrivateWebhooks, "-allow-private-webhooks"),
+			}).DialContext,
+		},
+	}
+)
+
+var alertOps = map[string]func(value, threshold float64) bool{
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+}
+
+// AlertRule fires its webhooks when new measurements match it, e.g.
+// "signal < -75 on floor 2", or with Failed, when sampling returned no
+// signal. With Count above 1 the rule waits for that many consecutive
+// matches of the same probe, a site's wireless interface; it fires once
+// per run of matches.
+type AlertRule struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Floor limits the rule to one floor, 0 for all.
+	Floor int `json:"floor,omitempty"`
+	// Interface limits the rule to one probe interface.
+	Interface string `json:"interface,omitempty"`
+	// Metric is compared with Op and Value, see metrics.go. Measurements
+	// without the metric do not match.
+	Metric string  `json:"metric,omitempty"`
+	Op     string  `json:"op,omitempty"`
+	Value  float64 `json:"value,omitempty"`
+	// Failed matches samplings that returned no signal instead.
+	Failed   bool           `json:"failed,omitempty"`
+	Count    int            `json:"count"`
+	Webhooks []AlertWebhook `json:"webhooks"`
+}
+
+// AlertWebhook is where a rule posts. Format json posts an AlertEvent,
+// slack a Slack (or Mattermost) message.
+type AlertWebhook struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+}
+
+// AlertEvent is the payload of json webhooks.
+type AlertEvent struct {
+	Rule        string      `json:"rule"`
+	RuleID      string      `json:"ruleId"`
+	FiredAt     time.Time   `json:"firedAt"`
+	Count       int         `json:"count"`
+	Measurement Measurement `json:"measurement"`
+	Text        string      `json:"text"`
+}
+
+func loadAlerts() error {
+	alertsLock.Lock()
+	defer alertsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(alertsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &alertRules)
+}
+
+func saveAlerts() error {
+	alertsLock.Lock()
+	defer alertsLock.Unlock()
+
+	data, err := json.MarshalIndent(alertRules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(alertsFile), data, 0644)
+}
+
+// matches reports whether a measurement meets the condition of the rule,
+// and whether the rule applies to it at all.
+func (rule AlertRule) matches(m Measurement) (match, applies bool) {
+	if (rule.Floor > 0 && m.Floor != rule.Floor) || (rule.Interface != "" && m.Interface != rule.Interface) {
+		return false, false
+	}
+	if rule.Failed {
+		return m.Dbm == failedSampleDbm, m.Type != "scan"
+	}
+	value, measured := metrics[rule.Metric].value(m)
+	if !measured {
+		return false, false
+	}
+	return alertOps[rule.Op](value, rule.Value), true
+}
+
+// describe explains why a measurement fired the rule.
+func (rule AlertRule) describe(m Measurement, count int) string {
+	var condition string
+	if rule.Failed {
+		condition = "sampling returned no signal"
+	} else {
+		metric := metrics[rule.Metric]
+		value, _ := metric.value(m)
+		condition = fmt.Sprintf("%s %s %s %s", metric.Name, metric.format(value), rule.Op, metric.format(rule.Value))
+	}
+
+	where := fmt.Sprintf("floor %d", m.Floor)
+	if m.Location != "" {
+		where = m.Location + " on " + where
+	}
+	text := fmt.Sprintf("Alert %q: %s at %s", rule.Name, condition, where)
+	if m.Interface != "" {
+		text += " (" + m.Interface + ")"
+	}
+	if count > 1 {
+		text += fmt.Sprintf(", %d times in a row", count)
+	}
+	return text
+}
+
+// checkAlerts runs the rules over new measurements and posts the alerts
+// that fire. Measurements older than alertMaxAge are skipped.
+func checkAlerts(records []Measurement) {
+	var fired []AlertEvent
+	var targets [][]AlertWebhook
+
+	alertsLock.Lock()
+	for _, m := range records {
+		if time.Since(m.Timestamp) > alertMaxAge {
+			continue
+		}
+		probe := measurementSite(m.ID) + "/" + m.Interface
+		for id, rule := range alertRules {
+			if rule.Disabled {
+				continue
+			}
+			match, applies := rule.matches(m)
+			if !applies {
+				continue
+			}
+			streaks := alertStreaks[id]
+			if streaks == nil {
+				streaks = make(map[string]int)
+				alertStreaks[id] = streaks
+			}
+			if !match {
+				delete(streaks, probe)
+				continue
+			}
+			streaks[probe]++
+			if streaks[probe] != rule.Count {
+				continue
+			}
+			fired = append(fired, AlertEvent{
+				Rule:        rule.Name,
+				RuleID:      id,
+				FiredAt:     time.Now(),
+				Count:       rule.Count,
+				Measurement: m,
+				Text:        rule.describe(m, rule.Count),
+			})
+			targets = append(targets, rule.Webhooks)
+		}
+	}
+	alertsLock.Unlock()
+
+	for i, event := range fired {
+		go postAlert(event, targets[i])
+	}
+}
+
+// postAlert sends an alert to the webhooks of its rule.
+func postAlert(event AlertEvent, webhooks []AlertWebhook) {
+	for _, webhook := range webhooks {
+		var payload interface{} = event
+		if webhook.Format == "slack" {
+			payload = map[string]string{"text": event.Text}
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("failed to encode alert %q: %v", event.Rule, err)
+			continue
+		}
+
+		resp, err := alertClient.Post(webhook.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("failed to post alert %q to %s: %v", event.Rule, webhook.URL, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("failed to post alert %q to %s: %s", event.Rule, webhook.URL, resp.Status)
+		}
+	}
+}
+
+func decodeAlertRule(w http.ResponseWriter, r *http.Request) (AlertRule, bool) {
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+
+	var err error
+	if rule.Name, err = cleanText("name", rule.Name, maxNameLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return rule, false
+	}
+	if rule.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return rule, false
+	}
+
+	if rule.Floor != 0 {
+		mutex.Lock()
+		_, floorExists := floors[rule.Floor]
+		mutex.Unlock()
+		if !floorExists {
+			http.Error(w, "floor not found", http.StatusBadRequest)
+			return rule, false
+		}
+	}
+
+	if rule.Failed {
+		rule.Metric, rule.Op, rule.Value = "", "", 0
+	} else {
+		if rule.Metric == "" {
+			rule.Metric = defaultMetric
+		}
+		if _, err := lookupMetric(rule.Metric); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return rule, false
+		}
+		if alertOps[rule.Op] == nil {
+			http.Error(w, "op must be <, <=, > or >=", http.StatusBadRequest)
+			return rule, false
+		}
+	}
+
+	if rule.Count == 0 {
+		rule.Count = 1
+	}
+	if rule.Count < 1 || rule.Count > maxAlertCount {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxAlertCount), http.StatusBadRequest)
+		return rule, false
+	}
+
+	if len(rule.Webhooks) == 0 {
+		http.Error(w, "at least one webhook is required", http.StatusBadRequest)
+		return rule, false
+	}
+	for i, webhook := range rule.Webhooks {
+		parsed, err := url.Parse(webhook.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			http.Error(w, fmt.Sprintf("webhook %d must be an http(s) URL", i), http.StatusBadRequest)
+			return rule, false
+		}
+		if !*allowPrivateWebhooks {
+			addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), parsed.Hostname())
+			if err == nil && slices.ContainsFunc(addrs, func(addr net.IPAddr) bool { return privateAddress(addr.IP) }) {
+				http.Error(w, fmt.Sprintf("webhook %d points to a private address (see -allow-private-webhooks)", i), http.StatusBadRequest)
+				return rule, false
+			}
+		}
+		if webhook.Format == "" {
+			rule.Webhooks[i].Format = "json"
+		} else if webhook.Format != "json" && webhook.Format != "slack" {
+			http.Error(w, fmt.Sprintf("webhook %d format must be json or slack", i), http.StatusBadRequest)
+			return rule, false
+		}
+	}
+
+	return rule, true
+}
+
+// redacted returns the rule with its webhooks cut down to their host, as
+// webhook URLs often carry the secret that lets anyone post to them.
+func (rule AlertRule) redacted() AlertRule {
+	webhooks := make([]AlertWebhook, len(rule.Webhooks))
+	for i, webhook := range rule.Webhooks {
+		webhooks[i] = AlertWebhook{Format: webhook.Format}
+		if parsed, err := url.Parse(webhook.URL); err == nil {
+			webhooks[i].URL = parsed.Scheme + "://" + parsed.Host
+		}
+	}
+	rule.Webhooks = webhooks
+	return rule
+}
+
+// alertsHandler lists (GET) or adds (POST) alert rules. Only editors see
+// the full webhook URLs.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		editor := requestAllows(r, roleEditor)
+		alertsLock.Lock()
+		list := []AlertRule{}
+		for _, rule := range alertRules {
+			if !editor {
+				rule = rule.redacted()
+			}
+			list = append(list, rule)
+		}
+		alertsLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		rule, ok := decodeAlertRule(w, r)
+		if !ok {
+			return
+		}
+		rule.ID = generateID()
+
+		alertsLock.Lock()
+		alertRules[rule.ID] = rule
+		alertsLock.Unlock()
+
+		if err := saveAlerts(); err != nil {
+			http.Error(w, "failed to save alert rules", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func alertHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	alertsLock.Lock()
+	rule, exists := alertRules[id]
+	alertsLock.Unlock()
+	if !exists {
+		http.Error(w, "alert rule not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !requestAllows(r, roleEditor) {
+			rule = rule.redacted()
+		}
+	case "PUT":
+		updated, ok := decodeAlertRule(w, r)
+		if !ok {
+			return
+		}
+		updated.ID = id
+		rule = updated
+
+		// A changed rule starts counting anew.
+		alertsLock.Lock()
+		alertRules[id] = rule
+		delete(alertStreaks, id)
+		alertsLock.Unlock()
+
+		if err := saveAlerts(); err != nil {
+			http.Error(w, "failed to save alert rules", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		alertsLock.Lock()
+		delete(alertRules, id)
+		delete(alertStreaks, id)
+		alertsLock.Unlock()
+
+		if err := saveAlerts(); err != nil {
+			http.Error(w, "failed to save alert rules", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// ControlPoint pairs a feature on the current floor map with the same
+// feature on its replacement, both in map pixels, x to the right and y
+// down.
+type ControlPoint struct {
+	From ScalePoint `json:"from"`
+	To   ScalePoint `json:"to"`
+}
+
+// affineFit maps pixels of one map to another:
+//
+//	x' = a*x + b*y + c
+//	y' = d*x + e*y + f
+type affineFit [6]float64
+
+func (t affineFit) apply(x, y float64) (float64, float64) {
+	return t[0]*x + t[1]*y + t[2], t[3]*x + t[4]*y + t[5]
+}
+
+func (t affineFit) determinant() float64 {
+	return t[0]*t[4] - t[1]*t[3]
+}
+
+// scale is the factor areas are scaled by, as a linear factor.
+func (t affineFit) scale() float64 {
+	return math.Sqrt(math.Abs(t.determinant()))
+}
+
+func (t affineFit) inverse() affineFit {
+	det := t.determinant()
+	a, b, d, e := t[4]/det, -t[1]/det, -t[3]/det, t[0]/det
+	return affineFit{a, b, -(a*t[2] + b*t[5]), d, e, -(d*t[2] + e*t[5])}
+}
+
+// fitAlignment fits the transform taking the From pixels of the points to
+// their To pixels. Two points fix translation, rotation and a uniform
+// scale, like the reference points of a calibration; three or more fit a
+// full affine transform by least squares, which also absorbs a map scanned
+// with different scales along its axes.
+func fitAlignment(points []ControlPoint) (affineFit, error) {
+	for _, p := range points {
+		for _, v := range []float64{p.From.X, p.From.Y, p.To.X, p.To.Y} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return affineFit{}, fmt.Errorf("control points must be finite")
+			}
+		}
+	}
+
+	if len(points) == 2 {
+		p1, p2 := points[0], points[1]
+		dx, dy := p2.From.X-p1.From.X, p2.From.Y-p1.From.Y
+		tx, ty := p2.To.X-p1.To.X, p2.To.Y-p1.To.Y
+		pixels := dx*dx + dy*dy
+		if pixels == 0 || (tx == 0 && ty == 0) {
+			return affineFit{}, fmt.Errorf("control points must be distinct on both maps")
+		}
+		// The rotation and scale as the complex quotient
+		// (tx + i*ty) / (dx + i*dy).
+		sr, si := (tx*dx+ty*dy)/pixels, (ty*dx-tx*dy)/pixels
+		return affineFit{
+			sr, -si, p1.To.X - (sr*p1.From.X - si*p1.From.Y),
+			si, sr, p1.To.Y - (si*p1.From.X + sr*p1.From.Y),
+		}, nil
+	}
+
+	// Normal equations of the least squares fit, shared by both rows.
+	var m [3][3]float64
+	var bx, by [3]float64
+	for _, p := range points {
+		row := [3]float64{p.From.X, p.From.Y, 1}
+		for i := range row {
+			for j := range row {
+				m[i][j] += row[i] * row[j]
+			}
+			bx[i] += row[i] * p.To.X
+			by[i] += row[i] * p.To.Y
+		}
+	}
+	x, okX := solve3(m, bx)
+	y, okY := solve3(m, by)
+	if !okX || !okY {
+		return affineFit{}, fmt.Errorf("control points must not lie on one line")
+	}
+	t := affineFit{x[0], x[1], x[2], y[0], y[1], y[2]}
+	if math.Abs(t.determinant()) < 1e-9 {
+		return affineFit{}, fmt.Errorf("control points map the floor onto a line")
+	}
+	return t, nil
+}
+
+// solve3 solves the 3x3 linear system by Cramer's rule.
+func solve3(m [3][3]float64, b [3]float64) ([3]float64, bool) {
+	det3 := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+	det := det3(m)
+	scale := 0.0
+	for _, row := range m {
+		for _, v := range row {
+			scale = max(scale, math.Abs(v))
+		}
+	}
+	if scale == 0 || math.Abs(det) < 1e-12*scale*scale*scale {
+		return [3]float64{}, false
+	}
+	var x [3]float64
+	for col := range x {
+		replaced := m
+		for row := range replaced {
+			replaced[row][col] = b[row]
+		}
+		x[col] = det3(replaced) / det
+	}
+	return x, true
+}
+
+// AlignmentResult reports the fit of the control points and what it moved.
+// Residuals are the distances, in pixels of the new map, between where the
+// fit puts each control point and where it was marked; a large one points
+// at a misplaced control point.
+type AlignmentResult struct {
+	Affine       affineFit `json:"affine"`
+	Residuals    []float64 `json:"residuals"`
+	RMSError     float64   `json:"rmsError"`
+	DryRun       bool      `json:"dryRun"`
+	Measurements int       `json:"measurements"`
+	Presets      int       `json:"presets"`
+	Zones        int       `json:"zones"`
+	Walls        int       `json:"walls"`
+	Floor        *Floor    `json:"floor,omitempty"`
+}
+
+// alignFloor moves everything placed on the floor by pixel position from
+// the old map, oldHeight pixels high, onto the new one: measurements,
+// presets, zones, walls and the daily aggregates, as well as the reference
+// points of the calibration and scale. Stored coordinates count lat up from
+// the bottom of the map, so the map heights are needed to go through
+// pixels. The changes are recorded in the audit log for actor.
+func alignFloor(actor string, floor Floor, t affineFit, oldHeight, newHeight int, result *AlignmentResult) error {
+	move := func(lat, lng float64) (float64, float64) {
+		x, y := t.apply(lng, float64(oldHeight)-lat)
+		return float64(newHeight) - y, x
+	}
+	moveVertex := func(v *Vertex) {
+		v.Lat, v.Lng = move(v.Lat, v.Lng)
+	}
+
+	// The floor shares its calibration and scale with the floors map, so
+	// they are changed as copies and only stored under mutex.
+	if floor.Calibration != nil {
+		c := *floor.Calibration
+		c.Points = slices.Clone(c.Points)
+		floor.Calibration = &c
+	}
+	if floor.Scale != nil {
+		s := *floor.Scale
+		s.Points = slices.Clone(s.Points)
+		floor.Scale = &s
+	}
+
+	if c := floor.Calibration; c != nil {
+		// Pixels of the new map go back to the old map before the old
+		// transform takes them to the ground.
+		inv := t.inverse()
+		a := c.Affine
+		c.Affine = [6]float64{
+			a[0]*inv[0] + a[1]*inv[3], a[0]*inv[1] + a[1]*inv[4], a[0]*inv[2] + a[1]*inv[5] + a[2],
+			a[3]*inv[0] + a[4]*inv[3], a[3]*inv[1] + a[4]*inv[4], a[3]*inv[2] + a[4]*inv[5] + a[5],
+		}
+		for i, p := range c.Points {
+			c.Points[i].X, c.Points[i].Y = t.apply(p.X, p.Y)
+		}
+	}
+	if s := floor.Scale; s != nil {
+		s.MetersPerPixel /= t.scale()
+		for i, p := range s.Points {
+			s.Points[i].X, s.Points[i].Y = t.apply(p.X, p.Y)
+		}
+	}
+
+	mutex.Lock()
+	var moved []Measurement
+	for i, m := range measurements {
+		if m.Floor == floor.ID {
+			measurements[i].Lat, measurements[i].Lng = move(m.Lat, m.Lng)
+			moved = append(moved, measurements[i])
+		}
+	}
+	if len(moved) > 0 {
+		updateRevision()
+	}
+	revision := dataRevision
+	floors[floor.ID] = floor
+	mutex.Unlock()
+	result.Measurements = len(moved)
+
+	if err := store.SaveFloor(floor); err != nil {
+		return fmt.Errorf("failed to save floor data")
+	}
+	for _, record := range moved {
+		if err := store.SaveMeasurement(record); err != nil {
+			return fmt.Errorf("failed to save measurement")
+		}
+	}
+
+	presetsLock.Lock()
+	for id, preset := range presets {
+		if preset.Floor == floor.ID {
+			preset.Lat, preset.Lng = move(preset.Lat, preset.Lng)
+			presets[id] = preset
+			result.Presets++
+		}
+	}
+	presetsLock.Unlock()
+	if result.Presets > 0 {
+		if err := savePresets(); err != nil {
+			return fmt.Errorf("failed to save presets")
+		}
+	}
+
+	zonesLock.Lock()
+	for id, zone := range zones {
+		if zone.Floor == floor.ID {
+			for i := range zone.Polygon {
+				moveVertex(&zone.Polygon[i])
+			}
+			zones[id] = zone
+			result.Zones++
+		}
+	}
+	zonesLock.Unlock()
+	if result.Zones > 0 {
+		if err := saveZones(); err != nil {
+			return fmt.Errorf("failed to save zones")
+		}
+	}
+
+	obstaclesLock.Lock()
+	layer, exists := obstacles[floor.ID]
+	if exists {
+		for _, walls := range [][]Wall{layer.Walls, layer.Proposed} {
+			for i := range walls {
+				moveVertex(&walls[i].From)
+				moveVertex(&walls[i].To)
+				walls[i].Thickness *= t.scale()
+			}
+		}
+		obstacles[floor.ID] = layer
+		result.Walls = len(layer.Walls)
+	}
+	obstaclesLock.Unlock()
+	if exists {
+		if err := saveObstacles(); err != nil {
+			return fmt.Errorf("failed to save obstacles")
+		}
+	}
+
+	aggregatesLock.Lock()
+	alignedAggregates := false
+	for i, a := range aggregates {
+		if a.Floor == floor.ID {
+			aggregates[i].Lat, aggregates[i].Lng = move(a.Lat, a.Lng)
+			alignedAggregates = true
+		}
+	}
+	aggregatesLock.Unlock()
+	if alignedAggregates {
+		if err := saveAggregates(); err != nil {
+			return fmt.Errorf("failed to save aggregates")
+		}
+	}
+
+	if len(moved) > 0 {
+		publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: moved}, 0)
+		auditMeasurements(actor, eventMeasurementsUpdated, "aligned to a new map", moved)
+	}
+	publishFloor(eventFloorUpdated, floor)
+	auditFloor(actor, eventFloorUpdated, "map aligned", floor.ID)
+	return nil
+}
+
+// alignHandler replaces the map of a floor with a re-scan at another
+// resolution or offset and carries the existing data over, instead of
+// leaving it misplaced. The multipart form holds the new map in "map" and
+// the control points in "points", a JSON array of ControlPoint, at least
+// two. With dryRun=true only the fit is reported, to check the points
+// before anything changes. The new map must be PNG, JPEG, GIF or WebP, so
+// its size can be read.
+func alignHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMapSize+1<<20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "failed to parse multipart form", http.StatusBadRequest)
+		return
+	}
+
+	var points []ControlPoint
+	if err := json.Unmarshal([]byte(r.FormValue("points")), &points); err != nil {
+		http.Error(w, "points must be a JSON array of {from: {x, y}, to: {x, y}}", http.StatusBadRequest)
+		return
+	}
+	if len(points) < 2 {
+		http.Error(w, "at least two control points are required", http.StatusBadRequest)
+		return
+	}
+	t, err := fitAlignment(points)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("map")
+	if err != nil {
+		http.Error(w, "failed to get map from form", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "failed to read map", http.StatusBadRequest)
+		return
+	}
+	contentType := detectMapType(data)
+	if contentType == "" {
+		http.Error(w, "unsupported map format, expected png, jpeg, gif or webp", http.StatusUnsupportedMediaType)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid %s image: %v", contentType, err), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.MapPath == "" {
+		http.Error(w, "floor has no map to align to, upload one instead", http.StatusConflict)
+		return
+	}
+	_, oldHeight, err := floorMapSize(floor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	result := AlignmentResult{Affine: t, DryRun: r.FormValue("dryRun") == "true"}
+	var squares float64
+	for _, p := range points {
+		x, y := t.apply(p.From.X, p.From.Y)
+		residual := math.Hypot(x-p.To.X, y-p.To.Y)
+		result.Residuals = append(result.Residuals, round1(residual))
+		squares += residual * residual
+	}
+	result.RMSError = round1(math.Sqrt(squares / float64(len(points))))
+
+	if !result.DryRun {
+		floor, err = saveFloorMap(floorID, mapExtensions[contentType], bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := alignFloor(auditActor(r), floor, t, oldHeight, config.Height, &result); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mutex.Lock()
+		floor = floors[floorID]
+		mutex.Unlock()
+		result.Floor = &floor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
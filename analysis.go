@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// CoverageAnalysis is the share of a floor (or zone) with signal at or above
+// the threshold, and the dead zones below it, largest first.
+type CoverageAnalysis struct {
+	Floor            int              `json:"floor"`
+	Revision         string           `json:"revision"`
+	Zone             string           `json:"zone,omitempty"`
+	Threshold        ThresholdProfile `json:"threshold"`
+	Coverage         float64          `json:"coverage"`
+	AreaPixels       float64          `json:"areaPixels"`
+	AreaSquareMeters float64          `json:"areaSquareMeters,omitempty"`
+	DeadZones        []SLARegion      `json:"deadZones"`
+	TotalDeadZones   int              `json:"totalDeadZones"`
+}
+
+// coverageAnalysisHandler interpolates the signal of a floor over the grid
+// and reports the covered share of its area and the dead zones. zone limits
+// the analysis to a saved zone; heatmap query parameters select the
+// measurements and the interpolation.
+func coverageAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules := []SLARule{{Threshold: strconv.Itoa(threshold.MinDbm), Zone: query.Get("zone")}}
+	if err := resolveSLARules(rules, floorID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		results, err := evaluateSLA(ctx, floor, filtered, params, rules)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "coverage analysis timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := results[0]
+		if err := result.evaluated(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CoverageAnalysis{
+			Floor:            floorID,
+			Revision:         revision,
+			Zone:             query.Get("zone"),
+			Threshold:        threshold,
+			Coverage:         result.Coverage,
+			AreaPixels:       result.AreaPixels,
+			AreaSquareMeters: result.AreaSquareMeters,
+			DeadZones:        result.FailingRegions,
+			TotalDeadZones:   result.TotalFailingRegions,
+		})
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// unheardDbm stands for the signal at a scanned point where no remaining
+// AP was heard, so the point counts as uncovered instead of dropping out of
+// the interpolation.
+const unheardDbm = -100
+
+// APRemovalCoverage is the coverage of a floor with or without the APs.
+type APRemovalCoverage struct {
+	Coverage       float64     `json:"coverage"`
+	Pass           bool        `json:"pass"`
+	DeadZones      []SLARegion `json:"deadZones"`
+	TotalDeadZones int         `json:"totalDeadZones"`
+}
+
+// APRemovalResult compares the predicted coverage of a floor before and
+// after the APs are taken out. Safe reports whether the coverage still
+// meets the requirement without them.
+type APRemovalResult struct {
+	Floor            int               `json:"floor"`
+	Revision         string            `json:"revision"`
+	BSSIDs           []string          `json:"bssids"`
+	SSID             string            `json:"ssid,omitempty"`
+	Zone             string            `json:"zone,omitempty"`
+	Threshold        ThresholdProfile  `json:"threshold"`
+	RequiredCoverage float64           `json:"requiredCoverage"`
+	Scans            int               `json:"scans"`
+	HeardAt          int               `json:"heardAt"`
+	UnheardAt        int               `json:"unheardAt"`
+	Before           APRemovalCoverage `json:"before"`
+	After            APRemovalCoverage `json:"after"`
+	CoverageLoss     float64           `json:"coverageLoss"`
+	Safe             bool              `json:"safe"`
+}
+
+// strongestScanSignals reduces the scan records to the strongest signal at
+// each scanned point, of the SSID when one is given, leaving out the
+// excluded BSSIDs. The points are returned as plain measurements so they
+// are interpolated like associated-link readings. heard counts the points
+// where an excluded AP was in range, and unheard those left without any AP.
+func strongestScanSignals(ms []Measurement, ssid string, excluded map[string]bool) (points []Measurement, heard, unheard int) {
+	index := make(map[string]int)
+	excludedHeard := make(map[string]bool)
+	for _, m := range ms {
+		if m.Type != "scan" || (ssid != "" && m.SSID != ssid) {
+			continue
+		}
+
+		i, seen := index[m.ScanID]
+		if !seen {
+			i = len(points)
+			index[m.ScanID] = i
+			points = append(points, m)
+			points[i].Type, points[i].Dbm = "location", failedSampleDbm
+		}
+
+		if excluded[strings.ToLower(m.BSSID)] {
+			excludedHeard[m.ScanID] = true
+			continue
+		}
+		if points[i].Dbm == failedSampleDbm || m.Dbm > points[i].Dbm {
+			points[i] = m
+			points[i].Type = "location"
+		}
+	}
+
+	for i := range points {
+		if excludedHeard[points[i].ScanID] {
+			heard++
+		}
+		if points[i].Dbm == failedSampleDbm {
+			points[i].Dbm = unheardDbm
+			unheard++
+		}
+	}
+	return points, heard, unheard
+}
+
+func removalCoverage(result SLARuleResult) APRemovalCoverage {
+	return APRemovalCoverage{
+		Coverage:       result.Coverage,
+		Pass:           result.Pass,
+		DeadZones:      result.FailingRegions,
+		TotalDeadZones: result.TotalFailingRegions,
+	}
+}
+
+// simulateAPRemoval interpolates the floor from the scans once with every
+// AP and once without the excluded ones, and evaluates both against rule.
+func simulateAPRemoval(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, rule SLARule, excluded map[string]bool) (APRemovalResult, error) {
+	ms = bandMeasurements(heightMeasurements(sessionMeasurements(ms, params.Session), params.Height), params.Band)
+
+	var result APRemovalResult
+	before, _, _ := strongestScanSignals(ms, params.SSID, nil)
+	after, heard, unheard := strongestScanSignals(ms, params.SSID, excluded)
+	if len(before) == 0 {
+		return result, fmt.Errorf("simulating an AP removal needs scan measurements on the floor")
+	}
+	if heard == 0 {
+		return result, fmt.Errorf("none of the APs was heard in the scans of this floor")
+	}
+
+	// The points already are one signal per scan, so the signal source
+	// filters must not apply again.
+	params.SSID, params.BSSID = "", ""
+
+	beforeResults, err := evaluateSLA(ctx, floor, before, params, []SLARule{rule})
+	if err != nil {
+		return result, err
+	}
+	if err := beforeResults[0].evaluated(); err != nil {
+		return result, err
+	}
+	afterResults, err := evaluateSLA(ctx, floor, after, params, []SLARule{rule})
+	if err != nil {
+		return result, err
+	}
+
+	result.Scans, result.HeardAt, result.UnheardAt = len(before), heard, unheard
+	result.RequiredCoverage = beforeResults[0].RequiredCoverage
+	result.Before = removalCoverage(beforeResults[0])
+	result.After = removalCoverage(afterResults[0])
+	result.CoverageLoss = math.Round((result.Before.Coverage-result.After.Coverage)*10) / 10
+	result.Safe = result.After.Pass
+	return result, nil
+}
+
+// apRemovalHandler predicts the coverage of a floor after the APs given as
+// ?bssid (repeatable) are decommissioned, from the scans taken on it: at
+// each scanned point the strongest remaining AP of ?ssid, or of any
+// network, takes over. threshold, coverage and zone set the requirement as
+// for /api/analysis/coverage; heatmap query parameters select the
+// measurements and the interpolation.
+func apRemovalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	excluded := make(map[string]bool)
+	var bssids []string
+	for _, bssid := range query["bssid"] {
+		bssid = strings.ToLower(strings.TrimSpace(bssid))
+		if bssid != "" && !excluded[bssid] {
+			excluded[bssid] = true
+			bssids = append(bssids, bssid)
+		}
+	}
+	if len(bssids) == 0 {
+		http.Error(w, "at least one bssid is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule := SLARule{Threshold: strconv.Itoa(threshold.MinDbm), Zone: query.Get("zone")}
+	if value := query.Get("coverage"); value != "" {
+		if rule.Coverage, err = strconv.ParseFloat(value, 64); err != nil {
+			http.Error(w, "invalid coverage", http.StatusBadRequest)
+			return
+		}
+	}
+	rules := []SLARule{rule}
+	if err := resolveSLARules(rules, floorID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The excluded APs are given by bssid, which as a heatmap parameter
+	// would select a single AP.
+	heatmapQuery := url.Values{}
+	for name, values := range query {
+		if name != "bssid" {
+			heatmapQuery[name] = values
+		}
+	}
+	params, err := parseHeatmapParams(heatmapQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		result, err := simulateAPRemoval(ctx, floor, filtered, params, rules[0], excluded)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "AP removal simulation timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result.Floor, result.Revision = floorID, revision
+		result.BSSIDs, result.SSID, result.Zone = bssids, params.SSID, rule.Zone
+		result.Threshold = threshold
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	apsFile = "aps.json"
+
+	// maxAPHistory is the number of polls kept per AP, a day at the default
+	// interval.
+	maxAPHistory = 288
+	// maxAPPolls bounds the APs polled at once.
+	maxAPPolls = 8
+	// apPairWindow is how far a measurement may be from a poll to be
+	// compared with it, beside the poll interval.
+	apPairWindow = 10 * time.Minute
+)
+
+var (
+	snmpInterval = flag.Duration("snmp-interval", 5*time.Minute, "how often the access points in /api/aps are polled over SNMP, 0 to poll only on request")
+	snmpTimeout  = flag.Duration("snmp-timeout", 5*time.Second, "timeout of an SNMP request to an access point")
+
+	accessPoints = make(map[string]AccessPoint)
+	apsLock      sync.Mutex
+)
+
+var oidPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)+$`)
+
+// APOIDs are the SNMP table columns an AP is polled for, one row per radio
+// or virtual AP. The rows of the columns are joined by their index; rows
+// without a BSSID are left out, as they cannot be matched with
+// measurements.
+type APOIDs struct {
+	BSSID   string `json:"bssid,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	// TxPower is the transmit power in dBm.
+	TxPower string `json:"txPower,omitempty"`
+	Clients string `json:"clients,omitempty"`
+	// ClientSignal is the signal the AP receives from its clients, in dBm.
+	ClientSignal string `json:"clientSignal,omitempty"`
+	Noise        string `json:"noise,omitempty"`
+}
+
+// apProfiles are the built-in OIDs. The IEEE 802.11 MIB only tells the
+// BSSIDs and the 2.4 GHz channel; tx power, client counts and client
+// signal are vendor specific and are given as OIDs.
+var apProfiles = map[string]APOIDs{
+	"ieee802dot11": {
+		BSSID:   "1.2.840.10036.2.1.1.1",
+		Channel: "1.2.840.10036.4.5.1.1",
+	},
+}
+
+// AccessPoint is an AP polled over SNMP for the telemetry of its radios,
+// which is compared with the client-side measurements of the same BSSIDs.
+type AccessPoint struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Host is the SNMP agent of the AP, host or host:port.
+	Host string `json:"host"`
+	// Community is kept when an update leaves it out and never returned.
+	Community string `json:"community,omitempty"`
+	// Version is the SNMP version, 2c or 1.
+	Version string `json:"version"`
+	// Profile names built-in OIDs from apProfiles; OIDs set override them.
+	Profile  string `json:"profile,omitempty"`
+	OIDs     APOIDs `json:"oids"`
+	Floor    int    `json:"floor,omitempty"`
+	Location string `json:"location,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+
+	PolledAt *time.Time `json:"polledAt,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	// Radios is the telemetry of the last successful poll.
+	Radios []APRadio `json:"radios,omitempty"`
+	// History holds the last maxAPHistory polls, oldest first. It is only
+	// returned on request.
+	History []APPoll `json:"history,omitempty"`
+}
+
+// APRadio is the telemetry of one radio or virtual AP, by BSSID.
+type APRadio struct {
+	Index        string   `json:"index"`
+	BSSID        string   `json:"bssid"`
+	Channel      int      `json:"channel,omitempty"`
+	TxPower      *float64 `json:"txPower,omitempty"`
+	Clients      *int     `json:"clients,omitempty"`
+	ClientSignal *float64 `json:"clientSignal,omitempty"`
+	Noise        *float64 `json:"noise,omitempty"`
+}
+
+// APPoll is the telemetry of a successful poll.
+type APPoll struct {
+	Time   time.Time `json:"time"`
+	Radios []APRadio `json:"radios"`
+}
+
+// public returns the AP without its community, and without its history
+// unless asked for.
+func (ap AccessPoint) public(history bool) AccessPoint {
+	ap.Community = ""
+	if !history {
+		ap.History = nil
+	}
+	return ap
+}
+
+// oids returns the OIDs of the profile with those set on the AP instead.
+func (ap AccessPoint) oids() APOIDs {
+	oids := apProfiles[ap.Profile]
+	for _, field := range []struct{ target, value *string }{
+		{&oids.BSSID, &ap.OIDs.BSSID},
+		{&oids.Channel, &ap.OIDs.Channel},
+		{&oids.TxPower, &ap.OIDs.TxPower},
+		{&oids.Clients, &ap.OIDs.Clients},
+		{&oids.ClientSignal, &ap.OIDs.ClientSignal},
+		{&oids.Noise, &ap.OIDs.Noise},
+	} {
+		if *field.value != "" {
+			*field.target = *field.value
+		}
+	}
+	return oids
+}
+
+// hasBSSID reports whether one of the radios of the last poll has the
+// BSSID.
+func (ap AccessPoint) hasBSSID(bssid string) bool {
+	for _, radio := range ap.Radios {
+		if strings.EqualFold(radio.BSSID, bssid) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAccessPoints() error {
+	apsLock.Lock()
+	defer apsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(apsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &accessPoints)
+}
+
+func saveAccessPoints() error {
+	apsLock.Lock()
+	defer apsLock.Unlock()
+
+	data, err := json.MarshalIndent(accessPoints, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file holds the SNMP communities.
+	return writeFileAtomic(projectFile(apsFile), data, 0600)
+}
+
+// snmpNumber reads an integer value, or a number sent as text.
+func snmpNumber(pdu gosnmp.SnmpPDU) (float64, bool) {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.Counter64, gosnmp.Uinteger32, gosnmp.TimeTicks:
+		return float64(gosnmp.ToBigInt(pdu.Value).Int64()), true
+	case gosnmp.OctetString:
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(pdu.Value.([]byte))), 64)
+		return value, err == nil
+	}
+	return 0, false
+}
+
+// snmpMAC reads a MAC address, sent as six octets or as text.
+func snmpMAC(pdu gosnmp.SnmpPDU) (string, bool) {
+	value, ok := pdu.Value.([]byte)
+	if pdu.Type != gosnmp.OctetString || !ok {
+		return "", false
+	}
+	if len(value) == 6 {
+		return net.HardwareAddr(value).String(), true
+	}
+	mac, err := net.ParseMAC(strings.TrimSpace(string(value)))
+	if err != nil || len(mac) != 6 {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+// pollAccessPoint walks the OIDs of an AP and returns its radios.
+func pollAccessPoint(ctx context.Context, ap AccessPoint) ([]APRadio, error) {
+	host, port := ap.Host, uint16(161)
+	if h, p, err := net.SplitHostPort(ap.Host); err == nil {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		host, port = h, uint16(parsed)
+	}
+
+	client := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Community: ap.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   *snmpTimeout,
+		Retries:   1,
+		Context:   ctx,
+	}
+	walk := client.BulkWalk
+	if ap.Version == "1" {
+		client.Version = gosnmp.Version1
+		walk = client.Walk
+	}
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	defer client.Conn.Close()
+
+	oids := ap.oids()
+	rows := make(map[string]*APRadio)
+	for _, column := range []struct {
+		name, oid string
+		set       func(radio *APRadio, pdu gosnmp.SnmpPDU)
+	}{
+		{"bssid", oids.BSSID, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			radio.BSSID, _ = snmpMAC(pdu)
+		}},
+		{"channel", oids.Channel, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			if value, ok := snmpNumber(pdu); ok {
+				radio.Channel = int(value)
+			}
+		}},
+		{"txPower", oids.TxPower, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			if value, ok := snmpNumber(pdu); ok {
+				radio.TxPower = &value
+			}
+		}},
+		{"clients", oids.Clients, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			if value, ok := snmpNumber(pdu); ok {
+				clients := int(value)
+				radio.Clients = &clients
+			}
+		}},
+		{"clientSignal", oids.ClientSignal, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			if value, ok := snmpNumber(pdu); ok {
+				radio.ClientSignal = &value
+			}
+		}},
+		{"noise", oids.Noise, func(radio *APRadio, pdu gosnmp.SnmpPDU) {
+			if value, ok := snmpNumber(pdu); ok {
+				radio.Noise = &value
+			}
+		}},
+	} {
+		if column.oid == "" {
+			continue
+		}
+		prefix := "." + column.oid + "."
+		err := walk(column.oid, func(pdu gosnmp.SnmpPDU) error {
+			index, found := strings.CutPrefix(pdu.Name, prefix)
+			if !found {
+				return nil
+			}
+			radio := rows[index]
+			if radio == nil {
+				radio = &APRadio{Index: index}
+				rows[index] = radio
+			}
+			column.set(radio, pdu)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walking %s (%s): %v", column.name, column.oid, err)
+		}
+	}
+
+	radios := []APRadio{}
+	for _, radio := range rows {
+		if radio.BSSID != "" {
+			radios = append(radios, *radio)
+		}
+	}
+	sort.Slice(radios, func(i, j int) bool { return radios[i].Index < radios[j].Index })
+	if len(radios) == 0 {
+		return nil, fmt.Errorf("no radio with a BSSID at %s", oids.BSSID)
+	}
+	return radios, nil
+}
+
+// pollAndRecord polls an AP and records the result, keeping the radios of
+// the last successful poll on failure.
+func pollAndRecord(ctx context.Context, id string) (AccessPoint, error) {
+	apsLock.Lock()
+	ap, exists := accessPoints[id]
+	apsLock.Unlock()
+	if !exists {
+		return ap, fmt.Errorf("access point not found")
+	}
+
+	radios, pollErr := pollAccessPoint(ctx, ap)
+	now := time.Now()
+
+	apsLock.Lock()
+	ap, exists = accessPoints[id]
+	if exists {
+		ap.PolledAt = &now
+		ap.Error = ""
+		if pollErr != nil {
+			ap.Error = pollErr.Error()
+		} else {
+			ap.Radios = radios
+			ap.History = append(ap.History, APPoll{Time: now, Radios: radios})
+			if len(ap.History) > maxAPHistory {
+				ap.History = ap.History[len(ap.History)-maxAPHistory:]
+			}
+		}
+		accessPoints[id] = ap
+	}
+	apsLock.Unlock()
+	if !exists {
+		return ap, fmt.Errorf("access point not found")
+	}
+
+	if err := saveAccessPoints(); err != nil {
+		log.Printf("failed to save access points: %v", err)
+	}
+	return ap, pollErr
+}
+
+// pollAccessPoints polls the enabled APs, a few at a time.
+func pollAccessPoints() {
+	apsLock.Lock()
+	var ids []string
+	for id, ap := range accessPoints {
+		if !ap.Disabled {
+			ids = append(ids, id)
+		}
+	}
+	apsLock.Unlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxAPPolls)
+	for _, id := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if ap, err := pollAndRecord(context.Background(), id); err != nil {
+				log.Printf("failed to poll access point %q: %v", ap.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// startSNMPPolling polls the APs every -snmp-interval.
+func startSNMPPolling() {
+	if *snmpInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(*snmpInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pollAccessPoints()
+		}
+	}()
+}
+
+func decodeAccessPoint(w http.ResponseWriter, r *http.Request) (AccessPoint, bool) {
+	var ap AccessPoint
+	if err := json.NewDecoder(r.Body).Decode(&ap); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ap, false
+	}
+
+	var err error
+	if ap.Name, err = cleanText("name", ap.Name, maxNameLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ap, false
+	}
+	if ap.Location, err = cleanText("location", ap.Location, maxNameLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ap, false
+	}
+	if ap.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return ap, false
+	}
+	ap.Host = strings.TrimSpace(ap.Host)
+	if ap.Host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return ap, false
+	}
+
+	if ap.Version == "" {
+		ap.Version = "2c"
+	}
+	if ap.Version != "2c" && ap.Version != "1" {
+		http.Error(w, "version must be 2c or 1", http.StatusBadRequest)
+		return ap, false
+	}
+	if _, exists := apProfiles[ap.Profile]; ap.Profile != "" && !exists {
+		http.Error(w, "unknown profile", http.StatusBadRequest)
+		return ap, false
+	}
+	for name, oid := range map[string]*string{
+		"bssid":        &ap.OIDs.BSSID,
+		"channel":      &ap.OIDs.Channel,
+		"txPower":      &ap.OIDs.TxPower,
+		"clients":      &ap.OIDs.Clients,
+		"clientSignal": &ap.OIDs.ClientSignal,
+		"noise":        &ap.OIDs.Noise,
+	} {
+		*oid = strings.TrimPrefix(strings.TrimSpace(*oid), ".")
+		if *oid != "" && !oidPattern.MatchString(*oid) {
+			http.Error(w, fmt.Sprintf("oids.%s must be a numeric OID", name), http.StatusBadRequest)
+			return ap, false
+		}
+	}
+	if ap.oids().BSSID == "" {
+		http.Error(w, "a profile or oids.bssid is required", http.StatusBadRequest)
+		return ap, false
+	}
+
+	if ap.Floor != 0 {
+		mutex.Lock()
+		_, floorExists := floors[ap.Floor]
+		mutex.Unlock()
+		if !floorExists {
+			http.Error(w, "floor not found", http.StatusBadRequest)
+			return ap, false
+		}
+	}
+
+	// Telemetry is only set by polling.
+	ap.PolledAt, ap.Error, ap.Radios, ap.History = nil, "", nil, nil
+	return ap, true
+}
+
+// accessPointsHandler lists the APs (GET), optionally of a floor or the one
+// with a BSSID, and adds one (POST).
+func accessPointsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		floor, err := strconv.Atoi(query.Get("floor"))
+		if err != nil {
+			floor = 0
+		}
+		bssid := query.Get("bssid")
+
+		apsLock.Lock()
+		list := []AccessPoint{}
+		for _, ap := range accessPoints {
+			if (floor <= 0 || ap.Floor == floor) && (bssid == "" || ap.hasBSSID(bssid)) {
+				list = append(list, ap.public(false))
+			}
+		}
+		apsLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		ap, ok := decodeAccessPoint(w, r)
+		if !ok {
+			return
+		}
+		ap.ID = generateID()
+
+		apsLock.Lock()
+		accessPoints[ap.ID] = ap
+		apsLock.Unlock()
+
+		if err := saveAccessPoints(); err != nil {
+			http.Error(w, "failed to save access points", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ap.public(false))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// accessPointHandler returns (GET, with ?history=true its past polls),
+// updates (PUT) or removes (DELETE) an AP.
+func accessPointHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	apsLock.Lock()
+	ap, exists := accessPoints[id]
+	apsLock.Unlock()
+	if !exists {
+		http.Error(w, "access point not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		history, _ := strconv.ParseBool(r.URL.Query().Get("history"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ap.public(history))
+	case "PUT":
+		updated, ok := decodeAccessPoint(w, r)
+		if !ok {
+			return
+		}
+		updated.ID = id
+		if updated.Community == "" {
+			updated.Community = ap.Community
+		}
+
+		apsLock.Lock()
+		if current, exists := accessPoints[id]; exists {
+			updated.PolledAt, updated.Error, updated.Radios, updated.History = current.PolledAt, current.Error, current.Radios, current.History
+		}
+		accessPoints[id] = updated
+		apsLock.Unlock()
+
+		if err := saveAccessPoints(); err != nil {
+			http.Error(w, "failed to save access points", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated.public(false))
+	case "DELETE":
+		apsLock.Lock()
+		delete(accessPoints, id)
+		apsLock.Unlock()
+
+		if err := saveAccessPoints(); err != nil {
+			http.Error(w, "failed to save access points", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// accessPointPollHandler polls an AP right away and returns it. A failed
+// poll is reported as a 502 with the AP, its error recorded.
+func accessPointPollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ap, err := pollAndRecord(r.Context(), r.PathValue("id"))
+	if err != nil && ap.ID == "" {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(ap.public(false))
+}
+
+// APRadioComparison sets what a radio reported over SNMP against what
+// clients measured from its BSSID. Asymmetry is the mean of the measured
+// signal minus the client signal the AP reported at the nearest poll: a
+// large positive value means clients hear the AP much better than it hears
+// them, as happens with a high AP tx power.
+type APRadioComparison struct {
+	APRadio
+	Measurements int          `json:"measurements"`
+	Measured     *MetricStats `json:"measured,omitempty"`
+	// MeasuredChannels are the channels the BSSID was measured on.
+	MeasuredChannels []int `json:"measuredChannels,omitempty"`
+	ChannelMismatch  bool  `json:"channelMismatch,omitempty"`
+	// Paired counts the measurements compared with a poll for Asymmetry.
+	Paired    int      `json:"paired"`
+	Asymmetry *float64 `json:"asymmetry,omitempty"`
+}
+
+// APComparison compares the radios of an AP with the measurements of their
+// BSSIDs since ?from, by default the oldest poll kept, until ?to.
+type APComparison struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	PolledAt *time.Time          `json:"polledAt,omitempty"`
+	From     *time.Time          `json:"from,omitempty"`
+	To       *time.Time          `json:"to,omitempty"`
+	Radios   []APRadioComparison `json:"radios"`
+}
+
+// nearestPoll returns the radio of the poll closest to t, when it is close
+// enough to compare.
+func nearestPoll(history []APPoll, bssid string, t time.Time) (APRadio, bool) {
+	window := max(2**snmpInterval, apPairWindow)
+	i := sort.Search(len(history), func(i int) bool { return !history[i].Time.Before(t) })
+	var best *APPoll
+	for _, candidate := range []int{i - 1, i} {
+		if candidate < 0 || candidate >= len(history) {
+			continue
+		}
+		poll := &history[candidate]
+		if best == nil || poll.Time.Sub(t).Abs() < best.Time.Sub(t).Abs() {
+			best = poll
+		}
+	}
+	if best == nil || best.Time.Sub(t).Abs() > window {
+		return APRadio{}, false
+	}
+	for _, radio := range best.Radios {
+		if strings.EqualFold(radio.BSSID, bssid) {
+			return radio, true
+		}
+	}
+	return APRadio{}, false
+}
+
+func compareAccessPoint(ap AccessPoint, ms []Measurement, from, to time.Time) APComparison {
+	result := APComparison{ID: ap.ID, Name: ap.Name, PolledAt: ap.PolledAt, Radios: []APRadioComparison{}}
+	if from.IsZero() && len(ap.History) > 0 {
+		from = ap.History[0].Time
+	}
+	if !from.IsZero() {
+		result.From = &from
+	}
+	if !to.IsZero() {
+		result.To = &to
+	}
+
+	for _, radio := range ap.Radios {
+		comparison := APRadioComparison{APRadio: radio}
+		var values []float64
+		var differences float64
+		channels := make(map[int]bool)
+		for _, m := range ms {
+			if !strings.EqualFold(m.BSSID, radio.BSSID) || m.Dbm == failedSampleDbm ||
+				(!from.IsZero() && m.Timestamp.Before(from)) || (!to.IsZero() && m.Timestamp.After(to)) {
+				continue
+			}
+			values = append(values, float64(m.Dbm))
+			if m.Channel > 0 {
+				channels[m.Channel] = true
+			}
+			if polled, ok := nearestPoll(ap.History, radio.BSSID, m.Timestamp); ok && polled.ClientSignal != nil {
+				differences += float64(m.Dbm) - *polled.ClientSignal
+				comparison.Paired++
+			}
+		}
+
+		comparison.Measurements = len(values)
+		if len(values) > 0 {
+			stats := metricStats(values)
+			comparison.Measured = &stats
+		}
+		for channel := range channels {
+			comparison.MeasuredChannels = append(comparison.MeasuredChannels, channel)
+		}
+		sort.Ints(comparison.MeasuredChannels)
+		comparison.ChannelMismatch = radio.Channel > 0 && len(channels) > 0 && !channels[radio.Channel]
+		if comparison.Paired > 0 {
+			asymmetry := round1(differences / float64(comparison.Paired))
+			comparison.Asymmetry = &asymmetry
+		}
+		result.Radios = append(result.Radios, comparison)
+	}
+	return result
+}
+
+// accessPointCompareHandler compares the telemetry of an AP with the
+// client-side measurements of its BSSIDs, see APComparison.
+func accessPointCompareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	apsLock.Lock()
+	ap, exists := accessPoints[r.PathValue("id")]
+	apsLock.Unlock()
+	if !exists {
+		http.Error(w, "access point not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	var from, to time.Time
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	mutex.Lock()
+	var ms []Measurement
+	for _, m := range measurements {
+		if m.BSSID != "" && m.approved() && ap.hasBSSID(m.BSSID) {
+			ms = append(ms, m)
+		}
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compareAccessPoint(ap, ms, from, to))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const attachmentsDir = "attachments"
+
+func saveAttachment(measurementID, name string, data []byte) error {
+	dir := filepath.Join(projectFile(attachmentsDir), measurementID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, name), data, 0644)
+}
+
+func deleteAttachments(measurementID string) error {
+	return os.RemoveAll(filepath.Join(projectFile(attachmentsDir), measurementID))
+}
+
+func serveAttachment(w http.ResponseWriter, r *http.Request, name, contentType string) {
+	id := r.PathValue("id")
+
+	mutex.Lock()
+	found := false
+	for _, m := range measurements {
+		if m.ID == id {
+			found = true
+			break
+		}
+	}
+	mutex.Unlock()
+
+	if !found {
+		http.Error(w, "measurement not found", http.StatusNotFound)
+		return
+	}
+
+	filePath := filepath.Join(projectFile(attachmentsDir), filepath.Base(id), name)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		http.Error(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	http.ServeFile(w, r, filePath)
+}
+
+func rawDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serveAttachment(w, r, "raw.txt", "text/plain; charset=utf-8")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditFile is the audit log, one JSON entry per line. Entries are only
+// ever appended, so the file keeps what was changed even when the
+// measurements themselves are gone.
+const auditFile = "audit.jsonl"
+
+// Actions of the audit log besides the measurement and floor events of
+// ws.go.
+const auditMeasurementsImported = "measurements.imported"
+
+// AuditEntry records one change of the data: who made it, what it did,
+// and the floors and measurements it touched. Actor is "key:" and the name
+// of the API key of the request, "client:" and the client address for
+// requests without a key, "probe:" and the interface of a probe, "site:"
+// and the ID of a federated site, or "retention" for pruning.
+type AuditEntry struct {
+	Seq       int64     `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Floors    []int     `json:"floors,omitempty"`
+	IDs       []string  `json:"ids,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// The audit log is read from its file when it is listed rather than kept
+// in memory, as it grows without bound; only the last sequence number is.
+var (
+	auditSeq     int64
+	auditLogLock sync.Mutex
+)
+
+func loadAuditLog() error {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	auditSeq = 0
+	return scanAuditLog(func(entry AuditEntry) {
+		auditSeq = entry.Seq
+	}, func(line int, err error) {
+		// A crash may have cut off the last line.
+		log.Printf("skipped line %d of the audit log: %v", line, err)
+	})
+}
+
+// scanAuditLog calls fn with every entry of the audit log, oldest first,
+// and skipped with the lines that are not entries. auditLogLock must be
+// held.
+func scanAuditLog(fn func(entry AuditEntry), skipped func(line int, err error)) error {
+	file, err := os.Open(projectFile(auditFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			if skipped != nil {
+				skipped(line, err)
+			}
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// auditActor names who made a request: the API key by its name, or the
+// client address when the request has no valid key.
+func auditActor(r *http.Request) string {
+	if entry, exists := lookupKey(requestKey(r)); exists {
+		return "key:" + entry.Name
+	}
+	return "client:" + requestInitiator(r)
+}
+
+// probeActor names a probe by the interface of its readings.
+func probeActor(records []Measurement) string {
+	if len(records) > 0 && records[0].Interface != "" {
+		return "probe:" + records[0].Interface
+	}
+	return "probe"
+}
+
+// recordAudit appends an entry to the audit log. A log that cannot be
+// written does not undo the change; the failure is logged instead.
+func recordAudit(actor, action, detail string, floors []int, ids []string) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	auditSeq++
+	entry := AuditEntry{
+		Seq:       auditSeq,
+		Timestamp: time.Now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		Floors:    floors,
+		IDs:       ids,
+		Detail:    detail,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("failed to encode audit entry: %v", err)
+		return
+	}
+	file, err := os.OpenFile(projectFile(auditFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("failed to open the audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("failed to write the audit log: %v", err)
+	}
+}
+
+// auditMeasurements records a change of measurements with their IDs and
+// floors. Nothing is recorded for no measurements.
+func auditMeasurements(actor, action, detail string, ms []Measurement) {
+	if len(ms) == 0 {
+		return
+	}
+	ids := make([]string, len(ms))
+	var floors []int
+	for i, m := range ms {
+		ids[i] = m.ID
+		if !slices.Contains(floors, m.Floor) {
+			floors = append(floors, m.Floor)
+		}
+	}
+	slices.Sort(floors)
+	recordAudit(actor, action, detail, floors, ids)
+}
+
+// auditFloor records a change of a floor.
+func auditFloor(actor, action, detail string, floorID int) {
+	recordAudit(actor, action, detail, []int{floorID}, nil)
+}
+
+// auditFilter selects entries of the audit log.
+type auditFilter struct {
+	Actor    string
+	Actions  map[string]bool
+	Floor    int
+	ID       string
+	From, To time.Time
+}
+
+func (f auditFilter) matches(entry AuditEntry) bool {
+	switch {
+	case f.Actor != "" && entry.Actor != f.Actor && !strings.HasPrefix(entry.Actor, f.Actor+":"):
+		return false
+	case f.Actions != nil && !f.Actions[entry.Action]:
+		return false
+	case f.Floor != 0 && !slices.Contains(entry.Floors, f.Floor):
+		return false
+	case f.ID != "" && !slices.Contains(entry.IDs, f.ID):
+		return false
+	case !f.From.IsZero() && entry.Timestamp.Before(f.From):
+		return false
+	case !f.To.IsZero() && entry.Timestamp.After(f.To):
+		return false
+	}
+	return true
+}
+
+// auditHandler lists the audit log, newest first. ?actor matches an actor
+// or, as key, client, probe or site, every actor of that kind; ?action is
+// a comma-separated list of actions; ?floor and ?id select the entries
+// touching a floor or measurement; ?from and ?to (RFC 3339) bound the
+// time; ?limit and ?offset page the result, whose total is reported in
+// X-Total-Count. The log needs the -admin-token.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{Actor: query.Get("actor"), ID: query.Get("id")}
+	if value := query.Get("action"); value != "" {
+		filter.Actions = make(map[string]bool)
+		for _, action := range strings.Split(value, ",") {
+			filter.Actions[strings.TrimSpace(action)] = true
+		}
+	}
+	if value := query.Get("floor"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil || floor <= 0 {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+		filter.Floor = floor
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	var limit, offset int
+	for name, target := range map[string]*int{"limit": &limit, "offset": &offset} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, fmt.Sprintf("%s must be a non-negative integer", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	// Only the newest offset+limit matches are kept while reading.
+	keep := 0
+	if limit > 0 && offset < math.MaxInt/2-limit {
+		keep = offset + limit
+	}
+	var matches []AuditEntry
+	total := 0
+	auditLogLock.Lock()
+	err := scanAuditLog(func(entry AuditEntry) {
+		if !filter.matches(entry) {
+			return
+		}
+		total++
+		matches = append(matches, entry)
+		if keep > 0 && len(matches) >= 2*keep {
+			matches = append(matches[:0], matches[len(matches)-keep:]...)
+		}
+	}, nil)
+	auditLogLock.Unlock()
+	if err != nil {
+		http.Error(w, "failed to read the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	slices.Reverse(matches)
+	entries := matches[min(offset, len(matches)):]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(entries)
+}
+
+// auditEdit records an edit of a measurement with the fields it changed,
+// under both floors when it was moved to another.
+func auditEdit(actor string, before, after Measurement) {
+	var changed []string
+	for _, field := range []struct {
+		name    string
+		changed bool
+	}{
+		{"lat", before.Lat != after.Lat},
+		{"lng", before.Lng != after.Lng},
+		{"floor", before.Floor != after.Floor},
+		{"location", before.Location != after.Location},
+		{"type", before.Type != after.Type},
+		{"height", !reflect.DeepEqual(before.Height, after.Height)},
+	} {
+		if field.changed {
+			changed = append(changed, field.name)
+		}
+	}
+
+	floors := []int{before.Floor}
+	if after.Floor != before.Floor {
+		floors = append(floors, after.Floor)
+	}
+	recordAudit(actor, eventMeasurementsUpdated, strings.Join(changed, ", "), floors, []string{after.ID})
+}
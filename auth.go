@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Roles of API keys: viewers may read, editors may also change data and
+// reviewers may also approve or reject measurements, see review.go.
+const (
+	roleViewer   = "viewer"
+	roleEditor   = "editor"
+	roleReviewer = "reviewer"
+)
+
+// roleRanks orders the roles; a role may do all that the lower ones may.
+var roleRanks = map[string]int{roleViewer: 1, roleEditor: 2, roleReviewer: 3}
+
+func roleAllows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+var (
+	apiKeysFile = flag.String("api-keys", envOrDefault("HEATGEN_API_KEYS", ""), "JSON file of API keys, created with the apikey command; without it the API is open (env HEATGEN_API_KEYS)")
+	readAccess  = flag.String("read-access", envOrDefault("HEATGEN_READ_ACCESS", "open"), "who may read when API keys are configured: open or viewer (env HEATGEN_READ_ACCESS)")
+)
+
+// APIKey is an entry of the -api-keys file. Only the SHA-256 hash of the
+// key is stored.
+type APIKey struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	apiKeys     map[string]APIKey
+	apiKeysLock sync.Mutex
+)
+
+// ownTokenPaths authenticate with the federation token themselves.
+var ownTokenPaths = map[string]bool{
+	"/api/federation/snapshot": true,
+	"/api/federation/push":     true,
+}
+
+// readOnlyPosts compute from the data without changing it, so viewers may
+// post to them.
+var readOnlyPosts = map[string]bool{
+	"/api/estimate":    true,
+	"/api/interpolate": true,
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func readAPIKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// loadAPIKeys reads the -api-keys file. A file without keys leaves the API
+// open.
+func loadAPIKeys() error {
+	if *readAccess != "open" && *readAccess != roleViewer {
+		return fmt.Errorf("-read-access must be open or viewer")
+	}
+	if *apiKeysFile == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(*apiKeysFile); err != nil {
+		return fmt.Errorf("%v, create keys with the apikey command", err)
+	}
+	keys, err := readAPIKeys(*apiKeysFile)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]APIKey, len(keys))
+	for _, key := range keys {
+		if _, known := roleRanks[key.Role]; !known {
+			return fmt.Errorf("API key %q has unknown role %q", key.Name, key.Role)
+		}
+		if _, err := hex.DecodeString(key.SHA256); err != nil || len(key.SHA256) != 2*sha256.Size {
+			return fmt.Errorf("API key %q has an invalid sha256", key.Name)
+		}
+		loaded[strings.ToLower(key.SHA256)] = key
+	}
+
+	apiKeysLock.Lock()
+	apiKeys = loaded
+	apiKeysLock.Unlock()
+	return nil
+}
+
+// requestRole returns the role of the key the request presents, as a
+// bearer token, an X-API-Key header, or for GET requests, which browsers
+// make for images and WebSockets without headers, an apiKey parameter. The
+// -admin-token counts as a reviewer key.
+func requestRole(r *http.Request) (string, bool) {
+	return keyRole(requestKey(r))
+}
+
+func requestKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		key = bearer
+	}
+	if key == "" && r.Method == "GET" {
+		key = r.URL.Query().Get("apiKey")
+	}
+	return key
+}
+
+// keyRole returns the role of an API key.
+func keyRole(key string) (string, bool) {
+	entry, exists := lookupKey(key)
+	return entry.Role, exists
+}
+
+func lookupKey(key string) (APIKey, bool) {
+	if key == "" {
+		return APIKey{}, false
+	}
+
+	if *adminToken != "" && subtle.ConstantTimeCompare([]byte(key), []byte(*adminToken)) == 1 {
+		return APIKey{Name: "admin", Role: roleReviewer}, true
+	}
+
+	apiKeysLock.Lock()
+	entry, exists := apiKeys[hashAPIKey(key)]
+	apiKeysLock.Unlock()
+	return entry, exists
+}
+
+// requestUser names who made a request: the name of its API key, or
+// without one, the client address.
+func requestUser(r *http.Request) string {
+	if entry, exists := lookupKey(requestKey(r)); exists {
+		return entry.Name
+	}
+	return requestInitiator(r)
+}
+
+// requestAllows reports whether the request may do what the role may,
+// which any request may while no API keys are configured.
+func requestAllows(r *http.Request, required string) bool {
+	apiKeysLock.Lock()
+	enabled := len(apiKeys) > 0
+	apiKeysLock.Unlock()
+	if !enabled {
+		return true
+	}
+	role, valid := requestRole(r)
+	return valid && roleAllows(role, required)
+}
+
+// readRequest reports whether a request only reads data.
+func readRequest(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || (r.Method == "POST" && (readOnlyPosts[r.URL.Path] || strings.HasSuffix(r.URL.Path, "/sla")))
+}
+
+// requiredRole is the role a request needs: reads need a viewer key only
+// with -read-access viewer, reviews a reviewer key and other changes an
+// editor key.
+func requiredRole(r *http.Request) string {
+	if r.URL.Path == "/api/review" && r.Method != "GET" && r.Method != "HEAD" {
+		return roleReviewer
+	}
+	if !readRequest(r) {
+		return roleEditor
+	}
+	if *readAccess == roleViewer {
+		return roleViewer
+	}
+	return ""
+}
+
+// authMiddleware enforces the roles of the API keys once any are
+// configured. The health check, the federation endpoints and the shared
+// views, which check their own token, and the web UI, which holds no data
+// itself, are exempt.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKeysLock.Lock()
+		enabled := len(apiKeys) > 0
+		apiKeysLock.Unlock()
+		if !enabled || r.URL.Path == "/readyz" || ownTokenPaths[r.URL.Path] || embedPath(r.URL.Path) || uiPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required := requiredRole(r)
+		if required == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		role, valid := requestRole(r)
+		if !valid {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		if !roleAllows(role, required) {
+			message := "an editor API key is required"
+			if required == roleReviewer {
+				message = "a reviewer API key is required"
+			}
+			http.Error(w, message, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authConfig tells clients whether they need a key, and for what.
+func authConfig() map[string]interface{} {
+	apiKeysLock.Lock()
+	enabled := len(apiKeys) > 0
+	apiKeysLock.Unlock()
+	return map[string]interface{}{"enabled": enabled, "readAccess": *readAccess}
+}
+
+// runAPIKey creates an API key, adds its hash to the keys file and prints
+// the key, which is not stored anywhere else.
+func runAPIKey(args []string) error {
+	fs := flag.NewFlagSet("apikey", flag.ExitOnError)
+	file := fs.String("file", envOrDefault("HEATGEN_API_KEYS", "apikeys.json"), "API keys file, as given to -api-keys")
+	name := fs.String("name", "", "name of the key, e.g. who or what uses it")
+	role := fs.String("role", roleViewer, "role of the key: viewer, editor or reviewer")
+	fs.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	if _, known := roleRanks[*role]; !known {
+		return fmt.Errorf("-role must be viewer, editor or reviewer")
+	}
+
+	keys, err := readAPIKeys(*file)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Name == *name {
+			return fmt.Errorf("a key named %q already exists", *name)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(secret)
+	keys = append(keys, APIKey{Name: *name, Role: *role, SHA256: hashAPIKey(key)})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*file, data, 0600); err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
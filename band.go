@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// frequencyToChannel maps a 20 MHz channel center frequency in MHz to its
+// IEEE channel number, returning 0 for frequencies outside known bands.
+func frequencyToChannel(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq <= 2472:
+		return (freq - 2407) / 5
+	case freq >= 5160 && freq <= 5885:
+		return (freq - 5000) / 5
+	case freq == 5935:
+		return 2
+	case freq >= 5955 && freq <= 7115:
+		return (freq - 5950) / 5
+	}
+	return 0
+}
+
+// channelToFrequency is the inverse of frequencyToChannel. Channel numbers
+// are ambiguous between 6 GHz and the other bands, so band selects 6 GHz
+// when it is "6"; otherwise 2.4 or 5 GHz is assumed.
+func channelToFrequency(channel int, band string) int {
+	switch {
+	case band == "6" && channel == 2:
+		return 5935
+	case band == "6" && channel >= 1 && channel <= 233:
+		return 5950 + channel*5
+	case channel == 14:
+		return 2484
+	case channel >= 1 && channel <= 13:
+		return 2407 + channel*5
+	case channel >= 32 && channel <= 177:
+		return 5000 + channel*5
+	}
+	return 0
+}
+
+// bandForFrequency returns the band label ("2.4", "5" or "6") of a frequency
+// in MHz, or an empty string when it is not a Wi-Fi band.
+func bandForFrequency(freq int) string {
+	switch {
+	case freq >= 2400 && freq < 2500:
+		return "2.4"
+	case freq >= 5150 && freq < 5925:
+		return "5"
+	case freq >= 5925 && freq <= 7125:
+		return "6"
+	}
+	return ""
+}
+
+// bandChannels lists the 20 MHz channel center frequencies of each band.
+func bandChannels() map[string][]int {
+	channels := make(map[string][]int)
+	for freq := 2412; freq <= 2472; freq += 5 {
+		channels["2.4"] = append(channels["2.4"], freq)
+	}
+	channels["2.4"] = append(channels["2.4"], 2484)
+	for freq := 5180; freq <= 5885; freq += 20 {
+		channels["5"] = append(channels["5"], freq)
+	}
+	for freq := 5955; freq <= 7115; freq += 20 {
+		channels["6"] = append(channels["6"], freq)
+	}
+	return channels
+}
+
+// bandWidths lists the channel widths in MHz a band can carry, widest first.
+func bandWidths(band string) []int {
+	switch band {
+	case "2.4":
+		return []int{40, 20}
+	case "5":
+		return []int{160, 80, 40, 20}
+	case "6":
+		return []int{320, 160, 80, 40, 20}
+	}
+	return nil
+}
+
+// channelBlock returns the frequency range of the width-MHz channel that a
+// 20 MHz channel centered on freq belongs to.
+func channelBlock(freq, width int) (int, int) {
+	base := 0
+	switch bandForFrequency(freq) {
+	case "2.4":
+		return freq - 10, freq - 10 + width
+	case "5":
+		base = 5170
+		if freq >= 5735 {
+			base = 5735
+		}
+	case "6":
+		// Channel 1 is centered on 5955 MHz.
+		base = 5945
+	}
+
+	start := base + (freq-10-base)/width*width
+	return start, start + width
+}
+
+// signalFilter selects measurements by the band and SSID they were taken
+// on, so 2.4 and 5 GHz readings of a dual-band survey are not mixed.
+// Measurements without a frequency only match when no band is asked for.
+type signalFilter struct {
+	Band string
+	SSID string
+}
+
+// parseSignalFilter reads ?band (2.4, 5 or 6) and ?ssid.
+func parseSignalFilter(query url.Values) (signalFilter, error) {
+	f := signalFilter{Band: query.Get("band"), SSID: query.Get("ssid")}
+	if f.Band != "" && f.Band != "2.4" && f.Band != "5" && f.Band != "6" {
+		return f, fmt.Errorf("band must be 2.4, 5 or 6")
+	}
+	return f, nil
+}
+
+func (f signalFilter) match(m Measurement) bool {
+	return (f.Band == "" || bandForFrequency(m.Freq) == f.Band) && (f.SSID == "" || m.SSID == f.SSID)
+}
+
+// filters adds the filter to export metadata.
+func (f signalFilter) filters(filters map[string]string) {
+	if f.Band != "" {
+		filters["band"] = f.Band
+	}
+	if f.SSID != "" {
+		filters["ssid"] = f.SSID
+	}
+}
+
+// bandMeasurements returns the measurements taken on the band.
+func bandMeasurements(ms []Measurement, band string) []Measurement {
+	if band == "" {
+		return ms
+	}
+
+	var selected []Measurement
+	for _, m := range ms {
+		if bandForFrequency(m.Freq) == band {
+			selected = append(selected, m)
+		}
+	}
+	return selected
+}
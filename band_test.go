@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSignalFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    signalFilter
+		wantErr bool
+	}{
+		{query: "", want: signalFilter{}},
+		{query: "band=2.4", want: signalFilter{Band: "2.4"}},
+		{query: "band=5&ssid=Office", want: signalFilter{Band: "5", SSID: "Office"}},
+		{query: "band=6", want: signalFilter{Band: "6"}},
+		{query: "band=60", wantErr: true},
+		{query: "band=2.4GHz", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		got, err := parseSignalFilter(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %#v, want an error", test.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: parsed %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestChannelBlock(t *testing.T) {
+	tests := []struct {
+		freq, width int
+		start, end  int
+	}{
+		{2437, 20, 2427, 2447},
+		{5180, 20, 5170, 5190},
+		{5180, 80, 5170, 5250},
+		{5720, 80, 5650, 5730},
+		{5745, 80, 5735, 5815},
+		{5955, 20, 5945, 5965},
+		{6415, 20, 6405, 6425},
+		{7115, 20, 7105, 7125},
+		{5975, 40, 5945, 5985},
+		{6015, 80, 5945, 6025},
+		{6035, 80, 6025, 6105},
+		{6115, 160, 6105, 6265},
+		{6255, 160, 6105, 6265},
+		{5955, 320, 5945, 6265},
+		{6435, 320, 6265, 6585},
+	}
+	for _, test := range tests {
+		start, end := channelBlock(test.freq, test.width)
+		if start != test.start || end != test.end {
+			t.Errorf("%d MHz at %d MHz: block %d-%d, want %d-%d", test.freq, test.width, start, end, test.start, test.end)
+		}
+		if start > test.freq-10 || end < test.freq+10 {
+			t.Errorf("%d MHz at %d MHz: block %d-%d does not contain the channel", test.freq, test.width, start, end)
+		}
+	}
+}
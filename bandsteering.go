@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// defaultSteeringMargin is how much stronger, in dB, the 2.4 GHz signal
+// may be before clients that pick the strongest signal stay on 2.4 GHz.
+const defaultSteeringMargin = 15
+
+// Band steering statuses of a scanned point, from fine to worst.
+const (
+	steeringOK         = "ok"
+	steeringImbalanced = "imbalanced"
+	steeringWeakHigh   = "weak-high-band"
+	steeringOnly24     = "2.4-only"
+)
+
+// BandSteeringPoint compares the strongest 2.4 GHz AP of an SSID at a
+// scanned point with its strongest 5 or 6 GHz AP. Imbalance is how much
+// stronger the 2.4 GHz signal is.
+type BandSteeringPoint struct {
+	ScanID    string  `json:"scanId"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Location  string  `json:"location,omitempty"`
+	SSID      string  `json:"ssid"`
+	Dbm24     int     `json:"dbm24"`
+	BSSID24   string  `json:"bssid24"`
+	DbmHigh   *int    `json:"dbmHigh,omitempty"`
+	BandHigh  string  `json:"bandHigh,omitempty"`
+	BSSIDHigh string  `json:"bssidHigh,omitempty"`
+	Imbalance *int    `json:"imbalance,omitempty"`
+	Status    string  `json:"status"`
+}
+
+// BandSteeringSummary counts the points of an SSID by status. StickyShare
+// is the percentage of points where clients are likely to stay on 2.4 GHz.
+type BandSteeringSummary struct {
+	SSID         string  `json:"ssid"`
+	Points       int     `json:"points"`
+	OK           int     `json:"ok"`
+	Imbalanced   int     `json:"imbalanced"`
+	WeakHighBand int     `json:"weakHighBand"`
+	Only24       int     `json:"only24"`
+	StickyShare  float64 `json:"stickyShare"`
+}
+
+// BandSteeringReport is the band steering diagnosis of a floor.
+type BandSteeringReport struct {
+	Floor     int                   `json:"floor"`
+	Revision  string                `json:"revision"`
+	Threshold ThresholdProfile      `json:"threshold"`
+	Margin    int                   `json:"margin"`
+	SSIDs     []BandSteeringSummary `json:"ssids"`
+	Points    []BandSteeringPoint   `json:"points"`
+}
+
+var steeringSeverity = map[string]int{steeringOK: 0, steeringImbalanced: 1, steeringWeakHigh: 2, steeringOnly24: 3}
+
+// steeringStatus rates a point. Only points with a usable 2.4 GHz signal
+// can hold clients on it: there the high band is missing, too weak for the
+// threshold, or at least margin dB weaker.
+func steeringStatus(p BandSteeringPoint, threshold ThresholdProfile, margin int) string {
+	switch {
+	case !threshold.passes(p.Dbm24):
+		return steeringOK
+	case p.DbmHigh == nil:
+		return steeringOnly24
+	case !threshold.passes(*p.DbmHigh):
+		return steeringWeakHigh
+	case *p.Imbalance >= margin:
+		return steeringImbalanced
+	}
+	return steeringOK
+}
+
+// bandSteeringPoints pairs the strongest 2.4 GHz and 5 or 6 GHz records of
+// each SSID in each scan. Only SSIDs heard on both bands somewhere in ms
+// are reported, and only points where they were heard on 2.4 GHz.
+func bandSteeringPoints(ms []Measurement, ssid string, threshold ThresholdProfile, margin int) []BandSteeringPoint {
+	type key struct{ scan, ssid string }
+	low := make(map[key]Measurement)
+	high := make(map[key]Measurement)
+	var order []key
+	dualBand := make(map[string][2]bool)
+	for _, m := range ms {
+		if m.Type != "scan" || m.SSID == "" || m.Dbm == failedSampleDbm || (ssid != "" && m.SSID != ssid) {
+			continue
+		}
+		k := key{m.ScanID, m.SSID}
+		bands := dualBand[m.SSID]
+		switch bandForFrequency(m.Freq) {
+		case "2.4":
+			if best, seen := low[k]; !seen || m.Dbm > best.Dbm {
+				if !seen {
+					order = append(order, k)
+				}
+				low[k] = m
+			}
+			bands[0] = true
+		case "5", "6":
+			if best, seen := high[k]; !seen || m.Dbm > best.Dbm {
+				high[k] = m
+			}
+			bands[1] = true
+		}
+		dualBand[m.SSID] = bands
+	}
+
+	var points []BandSteeringPoint
+	for _, k := range order {
+		if bands := dualBand[k.ssid]; !bands[0] || !bands[1] {
+			continue
+		}
+		m := low[k]
+		p := BandSteeringPoint{
+			ScanID: k.scan, Lat: m.Lat, Lng: m.Lng, Location: m.Location,
+			SSID: k.ssid, Dbm24: m.Dbm, BSSID24: m.BSSID,
+		}
+		if h, heard := high[k]; heard {
+			imbalance := m.Dbm - h.Dbm
+			p.DbmHigh, p.BandHigh, p.BSSIDHigh, p.Imbalance = &h.Dbm, bandForFrequency(h.Freq), h.BSSID, &imbalance
+		}
+		p.Status = steeringStatus(p, threshold, margin)
+		points = append(points, p)
+	}
+	return points
+}
+
+// summarizeBandSteering counts the points of each SSID by status.
+func summarizeBandSteering(points []BandSteeringPoint) []BandSteeringSummary {
+	bySSID := make(map[string]*BandSteeringSummary)
+	var summaries []*BandSteeringSummary
+	for _, p := range points {
+		s, exists := bySSID[p.SSID]
+		if !exists {
+			s = &BandSteeringSummary{SSID: p.SSID}
+			bySSID[p.SSID] = s
+			summaries = append(summaries, s)
+		}
+		s.Points++
+		switch p.Status {
+		case steeringOK:
+			s.OK++
+		case steeringImbalanced:
+			s.Imbalanced++
+		case steeringWeakHigh:
+			s.WeakHighBand++
+		case steeringOnly24:
+			s.Only24++
+		}
+	}
+
+	result := make([]BandSteeringSummary, 0, len(summaries))
+	for _, s := range summaries {
+		s.StickyShare = round1(float64(s.Points-s.OK) / float64(s.Points) * 100)
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].StickyShare != result[j].StickyShare {
+			return result[i].StickyShare > result[j].StickyShare
+		}
+		return result[i].SSID < result[j].SSID
+	})
+	return result
+}
+
+// bandSteeringHandler reports, for each scanned point of ?floor, how the
+// 2.4 GHz signal of every dual-band SSID compares with its 5 or 6 GHz
+// signal, worst points first, to find where clients will stick to the slow
+// band. A point is flagged when its 2.4 GHz signal meets ?threshold and the
+// high band is not heard there, misses the threshold, or is ?margin dB
+// (15 by default) or more weaker. ssid, session, minHeight and maxHeight
+// select the scans.
+func bandSteeringHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	margin := defaultSteeringMargin
+	if value := query.Get("margin"); value != "" {
+		if margin, err = strconv.Atoi(value); err != nil || margin < 0 {
+			http.Error(w, "margin must be a non-negative number of dB", http.StatusBadRequest)
+			return
+		}
+	}
+	height, err := parseHeightRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session := query.Get("session")
+
+	mutex.Lock()
+	_, exists := floors[floorID]
+	var scans []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID && m.approved() && m.Type == "scan" && m.source() == sourceWiFi && inSession(m, session) && height.match(m) {
+			scans = append(scans, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	points := bandSteeringPoints(scans, query.Get("ssid"), threshold, margin)
+	sort.SliceStable(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if steeringSeverity[a.Status] != steeringSeverity[b.Status] {
+			return steeringSeverity[a.Status] > steeringSeverity[b.Status]
+		}
+		if a.Imbalance != nil && b.Imbalance != nil {
+			return *a.Imbalance > *b.Imbalance
+		}
+		return false
+	})
+	if points == nil {
+		points = []BandSteeringPoint{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BandSteeringReport{
+		Floor:     floorID,
+		Revision:  revision,
+		Threshold: threshold,
+		Margin:    margin,
+		SSIDs:     summarizeBandSteering(points),
+		Points:    points,
+	})
+}
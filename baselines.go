@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const baselinesFile = "baselines.json"
+
+// BaselineHistogram counts the signal readings, by dBm, of the pruned
+// measurements of one week at a named location or in a zone. Histograms
+// add up, so the weekly median stays exact however the readings of a week
+// are split between pruned and raw data.
+type BaselineHistogram struct {
+	Week     string      `json:"week"`
+	Floor    int         `json:"floor"`
+	Location string      `json:"location,omitempty"`
+	Zone     string      `json:"zone,omitempty"`
+	Dbm      map[int]int `json:"dbm"`
+}
+
+// WeeklyBaseline is the median signal of a location or zone over the week
+// starting on Monday Week, in UTC. Pruned is how many of the readings only
+// remain in the stored histograms.
+type WeeklyBaseline struct {
+	Week      string `json:"week"`
+	Floor     int    `json:"floor"`
+	Location  string `json:"location,omitempty"`
+	Zone      string `json:"zone,omitempty"`
+	Readings  int    `json:"readings"`
+	Pruned    int    `json:"pruned"`
+	MedianDbm int    `json:"medianDbm"`
+}
+
+type baselineKey struct {
+	week           string
+	floor          int
+	location, zone string
+}
+
+var (
+	baselineHistograms []BaselineHistogram
+	baselinesLock      sync.Mutex
+)
+
+func loadBaselines() error {
+	baselinesLock.Lock()
+	defer baselinesLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(baselinesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &baselineHistograms)
+}
+
+func saveBaselines() error {
+	baselinesLock.Lock()
+	defer baselinesLock.Unlock()
+
+	data, err := json.MarshalIndent(baselineHistograms, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(baselinesFile), data, 0644)
+}
+
+// weekStart is the start of the UTC week, from Monday, t falls in.
+func weekStart(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// baselineReading reports whether m is a reading of the usual signal at
+// its spot. Scans read every AP in range and spectral measurements the
+// band, neither comparable to it.
+func baselineReading(m Measurement) bool {
+	return m.Type != "scan" && m.Type != "spectral" && m.Dbm != failedSampleDbm
+}
+
+// baselineKeys are the baselines m counts towards: its location, when it
+// is named, and the zones it lies in.
+func baselineKeys(m Measurement, zonesByFloor map[int][]Zone) []baselineKey {
+	week := weekStart(m.Timestamp).Format(time.DateOnly)
+	var keys []baselineKey
+	if m.Location != "" {
+		keys = append(keys, baselineKey{week: week, floor: m.Floor, location: m.Location})
+	}
+	for _, zone := range zonesByFloor[m.Floor] {
+		if polygonContains(zone.Polygon, m.Lat, m.Lng) {
+			keys = append(keys, baselineKey{week: week, floor: m.Floor, zone: zone.ID})
+		}
+	}
+	return keys
+}
+
+func zonesByFloor() map[int][]Zone {
+	byFloor := make(map[int][]Zone)
+	for _, zone := range floorZones(0) {
+		byFloor[zone.Floor] = append(byFloor[zone.Floor], zone)
+	}
+	return byFloor
+}
+
+// countBaselineReadings adds the readings of ms to the histograms.
+func countBaselineReadings(histograms map[baselineKey]map[int]int, ms []Measurement) {
+	byFloor := zonesByFloor()
+	for _, m := range ms {
+		if !baselineReading(m) {
+			continue
+		}
+		for _, key := range baselineKeys(m, byFloor) {
+			if histograms[key] == nil {
+				histograms[key] = make(map[int]int)
+			}
+			histograms[key][m.Dbm]++
+		}
+	}
+}
+
+// recordBaselines keeps the readings of measurements about to be pruned in
+// the stored histograms.
+func recordBaselines(pruned []Measurement) error {
+	added := make(map[baselineKey]map[int]int)
+	countBaselineReadings(added, pruned)
+	if len(added) == 0 {
+		return nil
+	}
+
+	baselinesLock.Lock()
+	for i, h := range baselineHistograms {
+		key := baselineKey{h.Week, h.Floor, h.Location, h.Zone}
+		for dbm, count := range added[key] {
+			baselineHistograms[i].Dbm[dbm] += count
+		}
+		delete(added, key)
+	}
+	for key, counts := range added {
+		baselineHistograms = append(baselineHistograms, BaselineHistogram{
+			Week: key.week, Floor: key.floor, Location: key.location, Zone: key.zone, Dbm: counts,
+		})
+	}
+	sort.SliceStable(baselineHistograms, func(i, j int) bool { return baselineHistograms[i].Week < baselineHistograms[j].Week })
+	baselinesLock.Unlock()
+
+	return saveBaselines()
+}
+
+// histogramMedian is the median of the counted values, rounded as by
+// calculateMedian, and their number.
+func histogramMedian(counts map[int]int) (int, int) {
+	values := make([]int, 0, len(counts))
+	n := 0
+	for value, count := range counts {
+		values = append(values, value)
+		n += count
+	}
+	sort.Ints(values)
+
+	// nth returns the i-th smallest value, from 0.
+	nth := func(i int) int {
+		for _, value := range values {
+			if i < counts[value] {
+				return value
+			}
+			i -= counts[value]
+		}
+		return 0
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	if n%2 == 1 {
+		return nth(n / 2), n
+	}
+	return (nth(n/2-1) + nth(n/2)) / 2, n
+}
+
+// weeklyBaselines returns the baselines match selects, from the stored
+// histograms together with the readings still in the raw data, oldest
+// week first.
+func weeklyBaselines(match func(floor int, location, zone string) bool) []WeeklyBaseline {
+	mutex.Lock()
+	ms := append([]Measurement(nil), measurements...)
+	mutex.Unlock()
+
+	raw := make(map[baselineKey]map[int]int)
+	countBaselineReadings(raw, ms)
+
+	pruned := make(map[baselineKey]map[int]int)
+	baselinesLock.Lock()
+	for _, h := range baselineHistograms {
+		pruned[baselineKey{h.Week, h.Floor, h.Location, h.Zone}] = h.Dbm
+	}
+	baselinesLock.Unlock()
+
+	keys := make(map[baselineKey]bool)
+	for key := range raw {
+		keys[key] = true
+	}
+	for key := range pruned {
+		keys[key] = true
+	}
+
+	result := []WeeklyBaseline{}
+	for key := range keys {
+		if !match(key.floor, key.location, key.zone) {
+			continue
+		}
+		counts := make(map[int]int)
+		prunedReadings := 0
+		for dbm, count := range pruned[key] {
+			counts[dbm] += count
+			prunedReadings += count
+		}
+		for dbm, count := range raw[key] {
+			counts[dbm] += count
+		}
+		median, n := histogramMedian(counts)
+		result = append(result, WeeklyBaseline{
+			Week: key.week, Floor: key.floor, Location: key.location, Zone: key.zone,
+			Readings: n, Pruned: prunedReadings, MedianDbm: median,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Week != b.Week {
+			return a.Week < b.Week
+		}
+		if a.Floor != b.Floor {
+			return a.Floor < b.Floor
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		return a.Zone < b.Zone
+	})
+	return result
+}
+
+// baselinesHandler lists the weekly baselines of ?location or ?zone, or of
+// all locations and zones of ?floor, for the weeks from the one of ?from to
+// the one of ?to (YYYY-MM-DD). They include measurements pruned by the
+// retention, so trends reach back beyond it.
+func baselinesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID := 0
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, name := range []string{"from", "to"} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected YYYY-MM-DD", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	location, zone := query.Get("location"), query.Get("zone")
+	if location != "" && zone != "" {
+		http.Error(w, "give location or zone, not both", http.StatusBadRequest)
+		return
+	}
+	from, to := query.Get("from"), query.Get("to")
+	if from != "" {
+		start, _ := time.Parse(time.DateOnly, from)
+		from = weekStart(start).Format(time.DateOnly)
+	}
+
+	baselines := weeklyBaselines(func(floor int, l, z string) bool {
+		return (floorID == 0 || floor == floorID) &&
+			(location == "" || l == location) && (zone == "" || z == zone)
+	})
+	selected := baselines[:0]
+	for _, b := range baselines {
+		if (from == "" || b.Week >= from) && (to == "" || b.Week <= to) {
+			selected = append(selected, b)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selected)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// deleteFilter selects the measurements removed by a batch delete. All
+// given criteria must match.
+type deleteFilter struct {
+	Floor    int
+	Session  string
+	Location string
+	Before   time.Time
+	After    time.Time
+	IDs      map[string]bool
+}
+
+func (f deleteFilter) empty() bool {
+	return f.Floor == 0 && f.Session == "" && f.Location == "" &&
+		f.Before.IsZero() && f.After.IsZero() && f.IDs == nil
+}
+
+func (f deleteFilter) matches(m Measurement) bool {
+	return (f.Floor == 0 || m.Floor == f.Floor) &&
+		(f.Session == "" || m.SessionID == f.Session) &&
+		(f.Location == "" || m.Location == f.Location) &&
+		(f.Before.IsZero() || m.Timestamp.Before(f.Before)) &&
+		(f.After.IsZero() || m.Timestamp.After(f.After)) &&
+		(f.IDs == nil || f.IDs[m.ID])
+}
+
+// BatchDeleteResult reports what a batch delete removed, or would remove in
+// a dry run. NotFound lists requested IDs that did not exist.
+type BatchDeleteResult struct {
+	DryRun   bool     `json:"dryRun"`
+	Deleted  int      `json:"deleted"`
+	NotFound []string `json:"notFound,omitempty"`
+}
+
+// deleteMeasurementsWhere removes every measurement match accepts, together
+// with its attachments, and returns the removed IDs. The deletion is
+// recorded in the audit log for actor, with detail telling why.
+func deleteMeasurementsWhere(actor, detail string, match func(Measurement) bool) ([]string, error) {
+	mutex.Lock()
+	var ids []string
+	var deleted []Measurement
+	kept := measurements[:0]
+	for _, m := range measurements {
+		if match(m) {
+			ids = append(ids, m.ID)
+			deleted = append(deleted, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	measurements = kept
+	if len(ids) > 0 {
+		updateRevision()
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	publishDeleted(ids, revision)
+	auditMeasurements(actor, eventMeasurementsDeleted, detail, deleted)
+
+	for _, id := range ids {
+		if err := store.DeleteMeasurement(id); err != nil {
+			return nil, err
+		}
+		if err := deleteAttachments(id); err != nil {
+			log.Printf("failed to delete attachments of %s: %v", id, err)
+		}
+	}
+
+	return ids, nil
+}
+
+// parseDeleteFilter reads the query filters and the optional
+// {"ids": [...]} body.
+func parseDeleteFilter(r *http.Request) (deleteFilter, error) {
+	filter, err := parseFilterQuery(r.URL.Query())
+	if err != nil {
+		return filter, err
+	}
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return filter, err
+	}
+	if err := filter.setIDs(body.IDs); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// parseFilterQuery reads the query filters: floor, session, location,
+// before and after.
+func parseFilterQuery(query url.Values) (deleteFilter, error) {
+	filter := deleteFilter{
+		Session:  query.Get("session"),
+		Location: query.Get("location"),
+	}
+
+	if value := query.Get("floor"); value != "" {
+		floor, err := strconv.Atoi(value)
+		if err != nil || floor <= 0 {
+			return filter, fmt.Errorf("invalid floor")
+		}
+		filter.Floor = floor
+	}
+
+	for name, target := range map[string]*time.Time{"before": &filter.Before, "after": &filter.After} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+			}
+			*target = parsed
+		}
+	}
+
+	return filter, nil
+}
+
+// setIDs limits the filter to a list of IDs; nil leaves it unlimited.
+func (f *deleteFilter) setIDs(ids []string) error {
+	if ids == nil {
+		return nil
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("ids must not be empty")
+	}
+	f.IDs = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		f.IDs[id] = true
+	}
+	return nil
+}
+
+// notFound returns the IDs of the filter that are not measurements.
+func (f deleteFilter) notFound() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	found := make(map[string]bool)
+	for _, m := range measurements {
+		if f.IDs[m.ID] {
+			found[m.ID] = true
+		}
+	}
+	var missing []string
+	for id := range f.IDs {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// batchDeleteHandler removes the measurements matching the query filters
+// and the optional ID list, e.g. to clean up a botched survey. A request
+// without any filter is refused rather than deleting everything; with
+// ?dryRun=true nothing is removed.
+func batchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseDeleteFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.empty() {
+		http.Error(w, "at least one filter or a list of ids is required", http.StatusBadRequest)
+		return
+	}
+
+	result := BatchDeleteResult{DryRun: r.URL.Query().Get("dryRun") == "true"}
+
+	result.NotFound = filter.notFound()
+	if result.DryRun {
+		mutex.Lock()
+		for _, m := range measurements {
+			if filter.matches(m) {
+				result.Deleted++
+			}
+		}
+		mutex.Unlock()
+	}
+
+	if !result.DryRun {
+		ids, err := deleteMeasurementsWhere(auditActor(r), "batch delete", filter.matches)
+		if err != nil {
+			http.Error(w, "failed to delete measurements", http.StatusInternalServerError)
+			return
+		}
+		result.Deleted = len(ids)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const bleScanTimeout = 30 * time.Second
+
+var bleAdapter = flag.String("ble-adapter", envOrDefault("HEATGEN_BLE_ADAPTER", "hci0"), "Bluetooth adapter scanned for BLE measurements (env HEATGEN_BLE_ADAPTER)")
+
+var bleDeviceRe = regexp.MustCompile(`dev_found: ([0-9A-Fa-f:]{17}) type LE \S+ rssi (-?\d+)`)
+
+// bleDevice is a BLE device heard in a discovery.
+type bleDevice struct {
+	Address string
+	Name    string
+	RSSI    []int
+}
+
+// bleScan discovers the BLE devices around with btmgmt of BlueZ, which
+// reports every advertisement it hears with its RSSI.
+func bleScan(ctx context.Context, adapter string) ([]bleDevice, error) {
+	ctx, cancel := context.WithTimeout(ctx, bleScanTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "btmgmt", "--index", adapter, "find", "-l").CombinedOutput()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("btmgmt of BlueZ not found")
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			// Discovery went on past the timeout; what was heard counts.
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		default:
+			return nil, fmt.Errorf("BLE scan failed: %s", strings.TrimSpace(string(output)))
+		}
+	}
+	return parseBLEScan(string(output)), nil
+}
+
+// parseBLEScan reads the devices of btmgmt find, whose advertisement
+// details, such as the name, follow the dev_found line of a device.
+func parseBLEScan(output string) []bleDevice {
+	var devices []bleDevice
+	index := make(map[string]int)
+	current := -1
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := bleDeviceRe.FindStringSubmatch(line); match != nil {
+			address := strings.ToLower(match[1])
+			rssi, _ := strconv.Atoi(match[2])
+			i, seen := index[address]
+			if !seen {
+				i = len(devices)
+				index[address] = i
+				devices = append(devices, bleDevice{Address: address})
+			}
+			// 127 is an RSSI the controller could not measure.
+			if rssi != 127 {
+				devices[i].RSSI = append(devices[i].RSSI, rssi)
+			}
+			current = i
+			continue
+		}
+		if name, found := strings.CutPrefix(line, "name "); found && current >= 0 {
+			devices[current].Name = name
+		}
+	}
+	return devices
+}
+
+// bleSource scans for BLE devices, such as beacons, with the -ble-adapter
+// and records one measurement per device like a Wi-Fi scan.
+type bleSource struct{}
+
+func (bleSource) Prepare(req *MeasurementRequest) error {
+	if req.Type != "location" && req.Type != "scan" {
+		return fmt.Errorf("ble measurements must be of type scan")
+	}
+	if req.Interface != "" && req.Interface != *bleAdapter {
+		return fmt.Errorf("ble measurements scan with the adapter of -ble-adapter")
+	}
+	// The handler defaults the type to location.
+	req.Type = "scan"
+	req.Interface = *bleAdapter
+	return checkWiFiOnly(*req)
+}
+
+func (bleSource) Measure(ctx context.Context, req MeasurementRequest, progress func(taken int)) ([]Measurement, error) {
+	devices, err := bleScan(ctx, req.Interface)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	scanID := newMeasurementID()
+	now := time.Now()
+	lat, lng := req.coordinates()
+	records := make([]Measurement, 0, len(devices))
+	for _, device := range devices {
+		if len(device.RSSI) == 0 {
+			continue
+		}
+		records = append(records, Measurement{
+			ID:        newMeasurementID(),
+			Timestamp: now,
+			Dbm:       calculateMedian(device.RSSI),
+			Lat:       lat,
+			Lng:       lng,
+			Floor:     req.Floor,
+			Location:  req.Location,
+			Type:      "scan",
+			Accuracy:  req.Accuracy,
+			Height:    req.Height,
+			PresetID:  req.PresetID,
+			SessionID: req.SessionID,
+			Interface: req.Interface,
+			Class:     req.Class,
+			SSID:      device.Name,
+			BSSID:     device.Address,
+			ScanID:    scanID,
+			Source:    sourceBLE,
+		})
+	}
+
+	if err := addMeasurements(req.actor, records...); err != nil {
+		return records, err
+	}
+	return records, nil
+}
+
+func (bleSource) Check() []HealthCheck {
+	check := HealthCheck{Name: "ble scanner", OK: true}
+	if _, err := exec.LookPath("btmgmt"); err != nil {
+		check.OK, check.Detail = false, "btmgmt not found"
+		check.Hint = "install BlueZ to take BLE measurements"
+	}
+	return []HealthCheck{check}
+}
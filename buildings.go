@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+const buildingsFile = "buildings.json"
+
+var (
+	buildings     = make(map[string]Building)
+	buildingsLock sync.Mutex
+)
+
+// Building groups the floors of one building of a campus. Floors without a
+// building are listed on their own.
+type Building struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	// Order sorts the building list; buildings of equal order are sorted
+	// by name.
+	Order int `json:"order"`
+}
+
+func loadBuildings() error {
+	buildingsLock.Lock()
+	defer buildingsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(buildingsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &buildings)
+}
+
+func saveBuildings() error {
+	buildingsLock.Lock()
+	defer buildingsLock.Unlock()
+
+	data, err := json.MarshalIndent(buildings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(buildingsFile), data, 0644)
+}
+
+func getBuilding(id string) (Building, bool) {
+	buildingsLock.Lock()
+	defer buildingsLock.Unlock()
+
+	building, exists := buildings[id]
+	return building, exists
+}
+
+// buildingFloors returns the IDs of the floors in the ?building of a
+// query, or nil when the query has no building filter.
+func buildingFloors(query url.Values) (map[int]bool, error) {
+	id := query.Get("building")
+	if id == "" {
+		return nil, nil
+	}
+	if _, exists := getBuilding(id); !exists {
+		return nil, fmt.Errorf("building not found")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ids := make(map[int]bool)
+	for _, floor := range floors {
+		if floor.Building == id {
+			ids[floor.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+func decodeBuilding(w http.ResponseWriter, r *http.Request) (Building, bool) {
+	var building Building
+	if err := json.NewDecoder(r.Body).Decode(&building); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return building, false
+	}
+
+	var err error
+	if building.Name, err = cleanText("name", building.Name, maxNameLength, false); err == nil {
+		building.Address, err = cleanText("address", building.Address, maxLocationLength, false)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return building, false
+	}
+	if building.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return building, false
+	}
+
+	return building, true
+}
+
+func buildingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		buildingsLock.Lock()
+		list := make([]Building, 0, len(buildings))
+		for _, building := range buildings {
+			list = append(list, building)
+		}
+		buildingsLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Order != list[j].Order {
+				return list[i].Order < list[j].Order
+			}
+			return list[i].Name < list[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		building, ok := decodeBuilding(w, r)
+		if !ok {
+			return
+		}
+		building.ID = generateID()
+
+		buildingsLock.Lock()
+		buildings[building.ID] = building
+		buildingsLock.Unlock()
+
+		if err := saveBuildings(); err != nil {
+			http.Error(w, "failed to save buildings", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(building)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// buildingHandler reads, replaces or deletes a building. A building that
+// still has floors is only deleted with ?floors=detach, which leaves its
+// floors without a building.
+func buildingHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	building, exists := getBuilding(id)
+	if !exists {
+		http.Error(w, "building not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		updated, ok := decodeBuilding(w, r)
+		if !ok {
+			return
+		}
+		updated.ID = id
+		building = updated
+
+		buildingsLock.Lock()
+		buildings[id] = building
+		buildingsLock.Unlock()
+
+		if err := saveBuildings(); err != nil {
+			http.Error(w, "failed to save buildings", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		detach := r.URL.Query().Get("floors")
+		if detach != "" && detach != "detach" {
+			http.Error(w, "floors must be detach", http.StatusBadRequest)
+			return
+		}
+
+		mutex.Lock()
+		var attached []Floor
+		for _, floor := range floors {
+			if floor.Building == id {
+				attached = append(attached, floor)
+			}
+		}
+		if len(attached) > 0 && detach == "" {
+			mutex.Unlock()
+			http.Error(w, fmt.Sprintf("building has %d floors, delete them or pass floors=detach", len(attached)), http.StatusConflict)
+			return
+		}
+		for i := range attached {
+			attached[i].Building = ""
+			floors[attached[i].ID] = attached[i]
+		}
+		mutex.Unlock()
+
+		for _, floor := range attached {
+			if err := store.SaveFloor(floor); err != nil {
+				http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+				return
+			}
+			auditFloor(auditActor(r), eventFloorUpdated, "detached from deleted building "+id, floor.ID)
+		}
+
+		buildingsLock.Lock()
+		delete(buildings, id)
+		buildingsLock.Unlock()
+
+		if err := saveBuildings(); err != nil {
+			http.Error(w, "failed to save buildings", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"status": "deleted", "detachedFloors": len(attached)})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(building)
+}
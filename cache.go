@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var analyticsCacheSize = flag.Int("analytics-cache", 256, "number of analytics responses kept in memory, 0 to disable the cache")
+
+// cachedResponse is a successful analytics response and the revision of
+// the data it was computed from.
+type cachedResponse struct {
+	revision    string
+	contentType string
+	body        []byte
+	lastUsed    time.Time
+}
+
+// AnalyticsCacheStats is reported by the admin cache endpoint, together
+// with the interpolated heatmaps kept for images and tiles.
+type AnalyticsCacheStats struct {
+	Entries  int               `json:"entries"`
+	Capacity int               `json:"capacity"`
+	Hits     int64             `json:"hits"`
+	Misses   int64             `json:"misses"`
+	Heatmaps HeatmapCacheStats `json:"heatmaps"`
+}
+
+var (
+	analyticsCache     = make(map[string]*cachedResponse)
+	analyticsCacheLock sync.Mutex
+	analyticsHits      int64
+	analyticsMisses    int64
+)
+
+// analyticsRevision identifies everything analytics responses are computed
+// from: the measurements, the floors with their calibration and scale, the
+// zones, the map files, which can be replaced under the same path, and the
+// server settings that requests leave to their defaults.
+func analyticsRevision() string {
+	h := fnv.New64a()
+
+	settingsData, _ := json.Marshal(effectiveSettings())
+	h.Write(settingsData)
+
+	mutex.Lock()
+	h.Write([]byte(dataRevision))
+	floorData, _ := json.Marshal(floors)
+	var mapPaths []string
+	for _, floor := range floors {
+		if floor.MapPath != "" {
+			mapPaths = append(mapPaths, uploadFile(floor.MapPath))
+		}
+	}
+	mutex.Unlock()
+	h.Write(floorData)
+
+	zonesLock.Lock()
+	zoneData, _ := json.Marshal(zones)
+	zonesLock.Unlock()
+	h.Write(zoneData)
+
+	sort.Strings(mapPaths)
+	for _, path := range mapPaths {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// cacheRecorder keeps a copy of the response for the cache.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body = append(rec.body, data...)
+	return rec.ResponseWriter.Write(data)
+}
+
+// withAnalyticsCache answers repeated GET requests from memory until the
+// data they depend on changes, so dashboards polling the statistics do not
+// interpolate the floor again on every poll. Requests are keyed by path and
+// query; only successful responses are kept, and the least recently used
+// entry is dropped when the cache is full. X-Cache tells hits from misses.
+func withAnalyticsCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || *analyticsCacheSize <= 0 {
+			next(w, r)
+			return
+		}
+
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		revision := analyticsRevision()
+
+		analyticsCacheLock.Lock()
+		entry, exists := analyticsCache[key]
+		if exists && entry.revision == revision {
+			entry.lastUsed = time.Now()
+			analyticsHits++
+			analyticsCacheLock.Unlock()
+
+			w.Header().Set("Content-Type", entry.contentType)
+			w.Header().Set("X-Cache", "hit")
+			w.Write(entry.body)
+			return
+		}
+		if exists {
+			delete(analyticsCache, key)
+		}
+		analyticsMisses++
+		analyticsCacheLock.Unlock()
+
+		w.Header().Set("X-Cache", "miss")
+		rec := &cacheRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status != http.StatusOK {
+			return
+		}
+
+		analyticsCacheLock.Lock()
+		defer analyticsCacheLock.Unlock()
+
+		for len(analyticsCache) >= *analyticsCacheSize {
+			var oldest string
+			for k, e := range analyticsCache {
+				if oldest == "" || e.lastUsed.Before(analyticsCache[oldest].lastUsed) {
+					oldest = k
+				}
+			}
+			delete(analyticsCache, oldest)
+		}
+		analyticsCache[key] = &cachedResponse{
+			revision:    revision,
+			contentType: w.Header().Get("Content-Type"),
+			body:        rec.body,
+			lastUsed:    time.Now(),
+		}
+	}
+}
+
+// analyticsCacheHandler reports the cache statistics (GET) or empties the
+// cache and the heatmap cache (DELETE).
+func analyticsCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		analyticsCacheLock.Lock()
+		stats := AnalyticsCacheStats{
+			Entries:  len(analyticsCache),
+			Capacity: *analyticsCacheSize,
+			Hits:     analyticsHits,
+			Misses:   analyticsMisses,
+		}
+		analyticsCacheLock.Unlock()
+		stats.Heatmaps = heatmapCacheStats()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	case "DELETE":
+		analyticsCacheLock.Lock()
+		analyticsCache = make(map[string]*cachedResponse)
+		analyticsCacheLock.Unlock()
+		clearHeatmapGrids()
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
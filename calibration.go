@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+)
+
+const earthRadiusMeters = 6371000
+
+// Calibration maps floor map pixels (x to the right, y down) to geographic
+// coordinates with an affine transform:
+//
+//	lng = a*x + b*y + c
+//	lat = d*x + e*y + f
+//
+// It is either given directly or derived from two reference points, which
+// are then kept in Points. Reference points may give their ground position
+// as easting and northing in CRS, or the project's CRS, instead of WGS 84.
+type Calibration struct {
+	Affine [6]float64       `json:"affine"`
+	Points []TransformPoint `json:"points,omitempty"`
+	CRS    string           `json:"crs,omitempty"`
+	// MetersPerPixel is reported for information and ignored on input.
+	MetersPerPixel float64 `json:"metersPerPixel,omitempty"`
+}
+
+type TransformPoint struct {
+	X        float64  `json:"x"`
+	Y        float64  `json:"y"`
+	Lat      float64  `json:"lat"`
+	Lng      float64  `json:"lng"`
+	Easting  *float64 `json:"easting,omitempty"`
+	Northing *float64 `json:"northing,omitempty"`
+}
+
+// projectPoints fills in the WGS 84 position of reference points given in
+// a projected CRS.
+func (c *Calibration) projectPoints() error {
+	projected := 0
+	for _, p := range c.Points {
+		if p.Easting != nil || p.Northing != nil {
+			if p.Easting == nil || p.Northing == nil {
+				return fmt.Errorf("reference points need both easting and northing")
+			}
+			projected++
+		}
+	}
+	if projected == 0 {
+		c.CRS = ""
+		return nil
+	}
+	if projected != len(c.Points) {
+		return fmt.Errorf("give all reference points in WGS 84 or all in easting and northing")
+	}
+
+	crs, err := projectCRS(c.CRS)
+	if err != nil {
+		return err
+	}
+	c.CRS = crs.Code
+	for i, p := range c.Points {
+		c.Points[i].Lat, c.Points[i].Lng = crs.toWGS84(*p.Easting, *p.Northing)
+	}
+	return nil
+}
+
+func (c *Calibration) determinant() float64 {
+	return c.Affine[0]*c.Affine[4] - c.Affine[1]*c.Affine[3]
+}
+
+func (c *Calibration) toGeo(x, y float64) (float64, float64) {
+	a := c.Affine
+	return a[3]*x + a[4]*y + a[5], a[0]*x + a[1]*y + a[2]
+}
+
+func (c *Calibration) toPixel(lat, lng float64) (float64, float64) {
+	a := c.Affine
+	det := c.determinant()
+	dx, dy := lng-a[2], lat-a[5]
+	return (a[4]*dx - a[1]*dy) / det, (a[0]*dy - a[3]*dx) / det
+}
+
+// metersPerPixel returns the ground distance covered by one map pixel,
+// averaged over both axes. Degrees are converted with an equirectangular
+// approximation, which is accurate at building scale.
+func (c *Calibration) metersPerPixel() float64 {
+	lat, _ := c.toGeo(0, 0)
+	scale := math.Pi / 180 * earthRadiusMeters
+	cosLat := math.Cos(lat * math.Pi / 180)
+
+	a := c.Affine
+	x := math.Hypot(a[0]*scale*cosLat, a[3]*scale)
+	y := math.Hypot(a[1]*scale*cosLat, a[4]*scale)
+	return (x + y) / 2
+}
+
+// fromReferencePoints derives the transform from two map pixels with known
+// geographic positions. Two points fix translation, rotation and a uniform
+// scale; maps stretched differently along the axes need a full affine
+// transform.
+func (c *Calibration) fromReferencePoints() error {
+	p1, p2 := c.Points[0], c.Points[1]
+	for _, v := range []float64{p1.X, p1.Y, p1.Lat, p1.Lng, p2.X, p2.Y, p2.Lat, p2.Lng} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("reference points must be finite")
+		}
+	}
+
+	// Work in meters east and north of the first point, with the pixel
+	// y axis flipped to point north.
+	k := math.Pi / 180 * earthRadiusMeters
+	kLng := k * math.Cos(p1.Lat*math.Pi/180)
+	dx, dy := p2.X-p1.X, -(p2.Y - p1.Y)
+	east, north := (p2.Lng-p1.Lng)*kLng, (p2.Lat-p1.Lat)*k
+
+	pixels := dx*dx + dy*dy
+	if pixels == 0 || (east == 0 && north == 0) {
+		return fmt.Errorf("reference points must be distinct on the map and on the ground")
+	}
+
+	// The rotation and scale taking pixel offsets to meter offsets, as the
+	// complex quotient (east + i*north) / (dx + i*dy).
+	sr, si := (east*dx+north*dy)/pixels, (north*dx-east*dy)/pixels
+
+	c.Affine = [6]float64{
+		sr / kLng, si / kLng, p1.Lng - (sr*p1.X+si*p1.Y)/kLng,
+		si / k, -sr / k, p1.Lat - (si*p1.X-sr*p1.Y)/k,
+	}
+	return nil
+}
+
+func validateCalibration(c *Calibration) error {
+	for _, v := range c.Affine {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("affine coefficients must be finite")
+		}
+	}
+	if math.Abs(c.determinant()) < 1e-15 {
+		return fmt.Errorf("affine transform is not invertible")
+	}
+	return nil
+}
+
+func calibrationHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	var calibration *Calibration
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		calibration = &Calibration{}
+		if err := json.NewDecoder(r.Body).Decode(calibration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		calibration.MetersPerPixel = 0
+		switch len(calibration.Points) {
+		case 0:
+			calibration.CRS = ""
+		case 2:
+			if err := calibration.projectPoints(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := calibration.fromReferencePoints(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "give either an affine transform or two reference points", http.StatusBadRequest)
+			return
+		}
+		if err := validateCalibration(calibration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	if exists && r.Method != "GET" {
+		floor.Calibration = calibration
+		floors[floorID] = floor
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != "GET" {
+		if err := store.SaveFloor(floor); err != nil {
+			http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+			return
+		}
+		publishFloor(eventFloorUpdated, floor)
+		detail := "calibrated"
+		if calibration == nil {
+			detail = "calibration removed"
+		}
+		auditFloor(auditActor(r), eventFloorUpdated, detail, floorID)
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if floor.Calibration == nil {
+		http.Error(w, "floor is not calibrated", http.StatusNotFound)
+		return
+	}
+
+	response := *floor.Calibration
+	response.MetersPerPixel = response.metersPerPixel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// transformHandler converts a batch of points between floor map pixels and
+// geographic coordinates, depending on the "to" query parameter.
+func transformHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	to := r.URL.Query().Get("to")
+	if to != "geo" && to != "pixel" {
+		http.Error(w, "to must be geo or pixel", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Points []TransformPoint `json:"points"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.Calibration == nil {
+		http.Error(w, "floor is not calibrated", http.StatusConflict)
+		return
+	}
+
+	for i, p := range req.Points {
+		if to == "geo" {
+			req.Points[i].Lat, req.Points[i].Lng = floor.Calibration.toGeo(p.X, p.Y)
+		} else {
+			req.Points[i].X, req.Points[i].Y = floor.Calibration.toPixel(p.Lat, p.Lng)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+// floorMapSize returns the pixel size of a floor map, reading it without
+// decoding the whole image for maps stored before it was recorded.
+func floorMapSize(floor Floor) (int, int, error) {
+	if floor.MapWidth > 0 && floor.MapHeight > 0 {
+		return floor.MapWidth, floor.MapHeight, nil
+	}
+
+	file, err := os.Open(uploadFile(floor.MapPath))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read the map of floor %d: %v", floor.ID, err)
+	}
+	return config.Width, config.Height, nil
+}
+
+// geoTransforms returns for every floor of the measurements a function
+// converting stored floor coordinates to geographic ones. It fails when a
+// floor lacks the calibration or map this needs.
+func geoTransforms(ms []Measurement) (map[int]func(lat, lng float64) (float64, float64), error) {
+	transforms := make(map[int]func(lat, lng float64) (float64, float64))
+	for _, m := range ms {
+		if _, done := transforms[m.Floor]; done {
+			continue
+		}
+
+		mutex.Lock()
+		floor, exists := floors[m.Floor]
+		mutex.Unlock()
+
+		if !exists || floor.Calibration == nil || floor.MapPath == "" {
+			return nil, fmt.Errorf("floor %d has no calibrated map", m.Floor)
+		}
+		_, height, err := floorMapSize(floor)
+		if err != nil {
+			return nil, err
+		}
+
+		calibration := floor.Calibration
+		transforms[m.Floor] = func(lat, lng float64) (float64, float64) {
+			return calibration.toGeo(lng, float64(height)-lat)
+		}
+	}
+	return transforms, nil
+}
+
+// floorTransform returns a function converting geographic coordinates to
+// stored floor coordinates of the floor, the inverse of geoTransforms.
+func floorTransform(floorID int) (func(lat, lng float64) (float64, float64), error) {
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists || floor.Calibration == nil || floor.MapPath == "" {
+		return nil, fmt.Errorf("floor %d has no calibrated map", floorID)
+	}
+	_, height, err := floorMapSize(floor)
+	if err != nil {
+		return nil, err
+	}
+
+	calibration := floor.Calibration
+	return func(lat, lng float64) (float64, float64) {
+		x, y := calibration.toPixel(lat, lng)
+		return float64(height) - y, x
+	}, nil
+}
+
+// allFloorsCalibrated reports whether geographic coordinates can be
+// exported for the measurements.
+func allFloorsCalibrated(ms []Measurement) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, m := range ms {
+		if floor, exists := floors[m.Floor]; !exists || floor.Calibration == nil || floor.MapPath == "" {
+			return false
+		}
+	}
+	return true
+}
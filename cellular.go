@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const atCommandTimeout = 5 * time.Second
+
+var modemDevice = flag.String("modem", envOrDefault("HEATGEN_MODEM", "any"), "modem read for cellular measurements: a ModemManager modem (index, D-Bus path or any) or the tty of its AT command port, e.g. /dev/ttyUSB2 (env HEATGEN_MODEM)")
+
+// CellularInfo is the serving cell of a cellular measurement.
+type CellularInfo struct {
+	// Technology is lte or 5g.
+	Technology string   `json:"technology"`
+	Operator   string   `json:"operator,omitempty"`
+	RSRQ       *float64 `json:"rsrq,omitempty"`
+}
+
+// cellularReading is one sample of the serving cell.
+type cellularReading struct {
+	Technology string
+	Operator   string
+	RSRP       float64
+	RSRQ       *float64
+	SINR       *float64
+}
+
+// errNoCellularSignal is returned when the modem reports no LTE or 5G
+// signal, which is stored as a failed sample like an unassociated Wi-Fi
+// link.
+var errNoCellularSignal = errors.New("no LTE or 5G signal")
+
+// readCellular samples the serving cell of the modem, through its AT
+// command port when the device is a tty and ModemManager otherwise.
+func readCellular(ctx context.Context, device string) (cellularReading, error) {
+	if strings.HasPrefix(device, "/dev/") {
+		return readATPort(ctx, device)
+	}
+	return readModemManager(ctx, device)
+}
+
+// modemSignalSetup enables the signal polling of ModemManager modems,
+// which report no signal quality until it is.
+var modemSignalSetup sync.Map
+
+func readModemManager(ctx context.Context, modem string) (cellularReading, error) {
+	if _, done := modemSignalSetup.LoadOrStore(modem, true); !done {
+		if output, err := exec.CommandContext(ctx, "mmcli", "-m", modem, "--signal-setup=1").CombinedOutput(); err != nil {
+			modemSignalSetup.Delete(modem)
+			return cellularReading{}, mmcliError(err, output)
+		}
+	}
+
+	output, err := exec.CommandContext(ctx, "mmcli", "-m", modem, "--signal-get", "-K").CombinedOutput()
+	if err != nil {
+		return cellularReading{}, mmcliError(err, output)
+	}
+	reading, err := parseModemManagerSignal(string(output))
+	if err != nil {
+		return reading, err
+	}
+
+	if output, err := exec.CommandContext(ctx, "mmcli", "-m", modem, "-K").Output(); err == nil {
+		reading.Operator = mmcliValues(string(output))["modem.3gpp.operator-name"]
+	}
+	return reading, nil
+}
+
+func mmcliError(err error, output []byte) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("mmcli of ModemManager not found, install it or give -modem the tty of an AT command port")
+	}
+	return fmt.Errorf("mmcli failed: %s", strings.TrimSpace(string(output)))
+}
+
+// mmcliValues reads the "key : value" lines of mmcli -K, leaving out the
+// values ModemManager does not know ("--").
+func mmcliValues(output string) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if value != "" && value != "--" {
+			values[strings.TrimSpace(key)] = value
+		}
+	}
+	return values
+}
+
+// parseModemManagerSignal reads the 5G signal of mmcli --signal-get, or
+// the LTE one when there is none, as on LTE anchors without an NR leg.
+func parseModemManagerSignal(output string) (cellularReading, error) {
+	values := mmcliValues(output)
+	for _, technology := range []string{"5g", "lte"} {
+		prefix := "modem.signal." + technology + "."
+		rsrp, err := strconv.ParseFloat(values[prefix+"rsrp"], 64)
+		if err != nil {
+			continue
+		}
+		reading := cellularReading{Technology: technology, RSRP: rsrp}
+		if rsrq, err := strconv.ParseFloat(values[prefix+"rsrq"], 64); err == nil {
+			reading.RSRQ = &rsrq
+		}
+		if snr, err := strconv.ParseFloat(values[prefix+"snr"], 64); err == nil {
+			reading.SINR = &snr
+		}
+		return reading, nil
+	}
+	return cellularReading{}, errNoCellularSignal
+}
+
+// readATPort samples the serving cell with the standard AT commands of
+// 3GPP TS 27.007: +CESQ for the signal and +COPS? for the operator.
+func readATPort(ctx context.Context, tty string) (cellularReading, error) {
+	port, err := os.OpenFile(tty, os.O_RDWR|syscallNoCTTY, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cellularReading{}, fmt.Errorf("AT command port %s not found", tty)
+		}
+		return cellularReading{}, err
+	}
+	defer port.Close()
+	if err := setRawTTY(port); err != nil {
+		return cellularReading{}, fmt.Errorf("failed to set up %s: %v", tty, err)
+	}
+
+	lines := bufio.NewScanner(port)
+	response, err := atCommand(ctx, port, lines, "AT+CESQ")
+	if err != nil {
+		return cellularReading{}, err
+	}
+	reading, err := parseCESQ(response)
+	if err != nil {
+		return reading, err
+	}
+	if response, err := atCommand(ctx, port, lines, "AT+COPS?"); err == nil {
+		reading.Operator = parseCOPS(response)
+	}
+	return reading, nil
+}
+
+// atCommand sends a command and returns the lines of its response up to
+// OK, or the error the modem answered with.
+func atCommand(ctx context.Context, port *os.File, lines *bufio.Scanner, command string) ([]string, error) {
+	deadline := time.Now().Add(atCommandTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	port.SetDeadline(deadline)
+
+	if _, err := port.WriteString(command + "\r"); err != nil {
+		return nil, err
+	}
+	var response []string
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		switch {
+		case line == "" || line == command:
+			// Blank lines and the echo of the command.
+		case line == "OK":
+			return response, nil
+		case line == "ERROR" || strings.HasPrefix(line, "+CME ERROR"):
+			return nil, fmt.Errorf("%s failed: %s", command, line)
+		default:
+			response = append(response, line)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", command, err)
+	}
+	return nil, fmt.Errorf("%s failed: the port closed", command)
+}
+
+// parseCESQ converts the indices of
+// +CESQ: rxlev,ber,rscp,ecno,rsrq,rsrp[,ss_rsrq,ss_rsrp,ss_sinr], the last
+// three reported by modems with 5G, into dB and dBm. 255 is unknown.
+func parseCESQ(response []string) (cellularReading, error) {
+	for _, line := range response {
+		rest, found := strings.CutPrefix(line, "+CESQ:")
+		if !found {
+			continue
+		}
+		var indices []int
+		for _, field := range strings.Split(rest, ",") {
+			index, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return cellularReading{}, fmt.Errorf("invalid +CESQ response %q", line)
+			}
+			indices = append(indices, index)
+		}
+		known := func(i, maxIndex int) bool {
+			return i < len(indices) && indices[i] >= 0 && indices[i] <= maxIndex
+		}
+		value := func(i int, offset, step float64) *float64 {
+			v := offset + float64(indices[i])*step
+			return &v
+		}
+
+		switch {
+		case known(7, 127):
+			reading := cellularReading{Technology: "5g", RSRP: *value(7, -157, 1)}
+			if known(6, 127) {
+				reading.RSRQ = value(6, -43.5, 0.5)
+			}
+			if known(8, 127) {
+				reading.SINR = value(8, -23.5, 0.5)
+			}
+			return reading, nil
+		case known(5, 97):
+			reading := cellularReading{Technology: "lte", RSRP: *value(5, -141, 1)}
+			if known(4, 34) {
+				reading.RSRQ = value(4, -20, 0.5)
+			}
+			return reading, nil
+		}
+		return cellularReading{}, errNoCellularSignal
+	}
+	return cellularReading{}, fmt.Errorf("no +CESQ response")
+}
+
+// parseCOPS reads the operator of +COPS: mode,format,"operator",act.
+func parseCOPS(response []string) string {
+	for _, line := range response {
+		if rest, found := strings.CutPrefix(line, "+COPS:"); found {
+			fields := strings.Split(rest, ",")
+			if len(fields) >= 3 {
+				return strings.Trim(strings.TrimSpace(fields[2]), `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// cellularSource samples the serving cell of the -modem, storing RSRP as
+// the signal of the measurement.
+type cellularSource struct{}
+
+func (cellularSource) Prepare(req *MeasurementRequest) error {
+	if req.Type != "location" {
+		return fmt.Errorf("cellular measurements must be of type location")
+	}
+	if req.Interface != "" && req.Interface != *modemDevice {
+		return fmt.Errorf("cellular measurements read the modem of -modem")
+	}
+	req.Interface = *modemDevice
+	return checkWiFiOnly(*req)
+}
+
+func (cellularSource) Measure(ctx context.Context, req MeasurementRequest, progress func(taken int)) ([]Measurement, error) {
+	discard := req.discarded()
+	var rsrps []int
+	var rsrqs, sinrs []float64
+	var last cellularReading
+	for i := 0; i < discard+req.Samples; i++ {
+		reading, err := readCellular(ctx, req.Interface)
+		if err != nil && !errors.Is(err, errNoCellularSignal) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if i >= discard {
+			if err != nil {
+				rsrps = append(rsrps, failedSampleDbm)
+			} else {
+				rsrps = append(rsrps, int(math.Round(reading.RSRP)))
+				if reading.RSRQ != nil {
+					rsrqs = append(rsrqs, *reading.RSRQ)
+				}
+				if reading.SINR != nil {
+					sinrs = append(sinrs, *reading.SINR)
+				}
+				last = reading
+			}
+		}
+		progress(i + 1)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(req.Interval) * time.Millisecond):
+		}
+	}
+
+	if len(rsrps) == 0 {
+		return nil, fmt.Errorf("no samples were taken, all were discarded")
+	}
+	lat, lng := req.coordinates()
+	record := Measurement{
+		ID:        newMeasurementID(),
+		Timestamp: time.Now(),
+		Dbm:       calculateMedian(rsrps),
+		Lat:       lat,
+		Lng:       lng,
+		Floor:     req.Floor,
+		Location:  req.Location,
+		Type:      req.Type,
+		Accuracy:  req.Accuracy,
+		Height:    req.Height,
+		PresetID:  req.PresetID,
+		SessionID: req.SessionID,
+		Interface: req.Interface,
+		Class:     req.Class,
+		Discarded: discard,
+		Source:    sourceCellular,
+	}
+	if last.Technology != "" {
+		record.Cellular = &CellularInfo{Technology: last.Technology, Operator: last.Operator}
+		if len(rsrqs) > 0 {
+			rsrq := median(rsrqs)
+			record.Cellular.RSRQ = &rsrq
+		}
+		if len(sinrs) > 0 {
+			sinr := median(sinrs)
+			record.SNRDb = &sinr
+		}
+	}
+
+	records := []Measurement{record}
+	err := addMeasurements(req.actor, records...)
+	return records, err
+}
+
+func (cellularSource) Check() []HealthCheck {
+	check := HealthCheck{Name: "cellular modem", OK: true}
+	if strings.HasPrefix(*modemDevice, "/dev/") {
+		if _, err := os.Stat(*modemDevice); err != nil {
+			check.OK, check.Detail = false, err.Error()
+			check.Hint = "plug in the modem or point -modem at its AT command port"
+		}
+	} else if _, err := exec.LookPath("mmcli"); err != nil {
+		check.OK, check.Detail = false, "mmcli not found"
+		check.Hint = "install ModemManager or point -modem at the AT command port of the modem"
+	}
+	return []HealthCheck{check}
+}
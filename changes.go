@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChangesWait = 30 * time.Second
+	maxChangesWait     = 60 * time.Second
+)
+
+var changesBuffer = flag.Int("changes-buffer", 1000, "number of measurement and floor events kept for /api/changes; clients further behind are told to reload")
+
+// change is an event of the changes feed. floor is the floor it was
+// published for, 0 for all.
+type change struct {
+	seq   uint64
+	floor int
+	event Event
+}
+
+var (
+	changes    []change
+	changesSeq uint64
+	// changesEpoch tells cursors of an earlier run of the server apart,
+	// since the feed starts over with it.
+	changesEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+	// changesNotify is closed, and replaced, when a change is recorded.
+	changesNotify = make(chan struct{})
+	// changesDone is closed at shutdown to answer the waiting requests.
+	changesDone = make(chan struct{})
+	changesLock sync.Mutex
+)
+
+// ChangesResponse is a page of the changes feed. Cursor is passed as
+// ?since to get the changes after it. Reset means changes were missed, as
+// the cursor is too old or from before the server restarted, and the
+// client has to reload the measurements and floors.
+type ChangesResponse struct {
+	Cursor  string  `json:"cursor"`
+	Reset   bool    `json:"reset,omitempty"`
+	Changes []Event `json:"changes"`
+}
+
+// recordChange adds a published measurement or floor event to the feed.
+func recordChange(event Event, floor int) {
+	changesLock.Lock()
+	defer changesLock.Unlock()
+
+	changesSeq++
+	changes = append(changes, change{seq: changesSeq, floor: floor, event: event})
+	if excess := len(changes) - *changesBuffer; excess > 0 {
+		changes = changes[excess:]
+	}
+	close(changesNotify)
+	changesNotify = make(chan struct{})
+}
+
+// stopChanges answers the requests waiting for changes, so shutdown does
+// not wait for them.
+func stopChanges() {
+	changesLock.Lock()
+	defer changesLock.Unlock()
+	select {
+	case <-changesDone:
+	default:
+		close(changesDone)
+	}
+}
+
+func changesCursor(seq uint64) string {
+	return changesEpoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// changesSince returns the changes after the cursor since for floor, 0 for
+// all floors. Callers hold changesLock.
+func changesSince(since string, floor int) ChangesResponse {
+	response := ChangesResponse{Cursor: changesCursor(changesSeq), Changes: []Event{}}
+	if since == "" {
+		return response
+	}
+
+	epoch, value, _ := strings.Cut(since, "-")
+	seq, err := strconv.ParseUint(value, 10, 64)
+	oldest := changesSeq - uint64(len(changes))
+	if err != nil || epoch != changesEpoch || seq < oldest || seq > changesSeq {
+		response.Reset = true
+		return response
+	}
+	for _, c := range changes[seq-oldest:] {
+		if floor == 0 || c.floor == 0 || c.floor == floor {
+			response.Changes = append(response.Changes, c.event)
+		}
+	}
+	return response
+}
+
+// changesHandler is the long-polling alternative to /api/ws for clients
+// that cannot keep a WebSocket open. It returns the measurement and floor
+// events after the cursor ?since, waiting up to ?wait seconds (30 by
+// default, at most 60) for one when there are none. Without since it
+// returns the current cursor right away, to be taken before loading the
+// data. ?floor limits added measurements to one floor, as for /api/ws.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var floor int
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floor, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+	wait := defaultChangesWait
+	if value := query.Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "wait must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxChangesWait)
+	}
+	since := query.Get("since")
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	changesLock.Lock()
+	response := changesSince(since, floor)
+	for waiting := since != "" && wait > 0; waiting && !response.Reset && len(response.Changes) == 0; {
+		notify := changesNotify
+		changesLock.Unlock()
+		select {
+		case <-notify:
+		case <-timeout.C:
+			waiting = false
+		case <-changesDone:
+			waiting = false
+		case <-r.Context().Done():
+			return
+		}
+		changesLock.Lock()
+		response = changesSince(since, floor)
+	}
+	changesLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultClusterRadius = 60
+
+// Cluster aggregates the measurements falling into one grid cell. Single
+// measurements keep their ID so clients can render them as regular markers.
+type Cluster struct {
+	Lat    float64 `json:"lat"`
+	Lng    float64 `json:"lng"`
+	Count  int     `json:"count"`
+	ID     string  `json:"id,omitempty"`
+	AvgDbm float64 `json:"avgDbm"`
+	MinDbm int     `json:"minDbm"`
+	MaxDbm int     `json:"maxDbm"`
+	Failed int     `json:"failed,omitempty"`
+}
+
+type clusterCell struct {
+	Cluster
+	sumDbm float64
+}
+
+// clusterMeasurements groups measurements on a grid whose cells are radius
+// screen pixels wide at the given Leaflet zoom level. Clusters are placed
+// at the centroid of their members.
+func clusterMeasurements(ms []Measurement, zoom, radius float64) []Cluster {
+	cellSize := radius / math.Pow(2, zoom)
+
+	cells := make(map[[2]int]*clusterCell)
+	var keys [][2]int
+	for _, m := range ms {
+		key := [2]int{int(math.Floor(m.Lat / cellSize)), int(math.Floor(m.Lng / cellSize))}
+		cell, exists := cells[key]
+		if !exists {
+			cell = &clusterCell{Cluster: Cluster{MinDbm: math.MaxInt, MaxDbm: math.MinInt}}
+			cells[key] = cell
+			keys = append(keys, key)
+		}
+
+		cell.Count++
+		cell.Lat += m.Lat
+		cell.Lng += m.Lng
+		cell.ID = m.ID
+		if m.Dbm == failedSampleDbm {
+			cell.Failed++
+			continue
+		}
+		cell.sumDbm += float64(m.Dbm)
+		cell.MinDbm = min(cell.MinDbm, m.Dbm)
+		cell.MaxDbm = max(cell.MaxDbm, m.Dbm)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	clusters := make([]Cluster, 0, len(keys))
+	for _, key := range keys {
+		cell := cells[key]
+		c := cell.Cluster
+		c.Lat /= float64(c.Count)
+		c.Lng /= float64(c.Count)
+		if c.Count > 1 {
+			c.ID = ""
+		}
+		if valid := c.Count - c.Failed; valid > 0 {
+			c.AvgDbm = math.Round(cell.sumDbm/float64(valid)*10) / 10
+		} else {
+			c.AvgDbm, c.MinDbm, c.MaxDbm = failedSampleDbm, failedSampleDbm, failedSampleDbm
+		}
+		clusters = append(clusters, c)
+	}
+
+	return clusters
+}
+
+// parseBBox parses "minLat,minLng,maxLat,maxLng".
+func parseBBox(value string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return bbox, fmt.Errorf("bbox must be minLat,minLng,maxLat,maxLng")
+	}
+	for i, part := range parts {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox, fmt.Errorf("bbox must be minLat,minLng,maxLat,maxLng")
+		}
+		bbox[i] = parsed
+	}
+	return bbox, nil
+}
+
+// clustersHandler returns the measurements of a floor aggregated for the
+// given zoom level, optionally limited to a bounding box.
+func clustersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	zoom, err := strconv.ParseFloat(query.Get("zoom"), 64)
+	if err != nil || zoom < -10 || zoom > 10 {
+		http.Error(w, "zoom must be between -10 and 10", http.StatusBadRequest)
+		return
+	}
+
+	radius := float64(defaultClusterRadius)
+	if value := query.Get("radius"); value != "" {
+		radius, err = strconv.ParseFloat(value, 64)
+		if err != nil || radius < 1 || radius > 500 {
+			http.Error(w, "radius must be between 1 and 500 pixels", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var bbox *[4]float64
+	if value := query.Get("bbox"); value != "" {
+		parsed, err := parseBBox(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bbox = &parsed
+	}
+
+	mutex.Lock()
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor != floorID {
+			continue
+		}
+		if bbox != nil && (m.Lat < bbox[0] || m.Lng < bbox[1] || m.Lat > bbox[2] || m.Lng > bbox[3]) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clusterMeasurements(filtered, zoom, radius))
+}
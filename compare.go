@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultCompareTolerance = 3
+	defaultCompareRange     = 20
+)
+
+// compareSide selects the measurements of one side of a comparison: a
+// session, a time range, or both.
+type compareSide struct {
+	Session string    `json:"session,omitempty"`
+	From    time.Time `json:"from,omitzero"`
+	To      time.Time `json:"to,omitzero"`
+}
+
+func (s compareSide) matches(m Measurement) bool {
+	if !inSession(m, s.Session) {
+		return false
+	}
+	if !s.From.IsZero() && m.Timestamp.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && m.Timestamp.After(s.To) {
+		return false
+	}
+	return true
+}
+
+// parseCompareSide reads "<prefix>" as a session ID and "<prefix>From" and
+// "<prefix>To" as RFC 3339 times, of which at least one must be given.
+func parseCompareSide(query url.Values, prefix string) (compareSide, error) {
+	side, err := readCompareSide(query, prefix)
+	if err != nil {
+		return side, err
+	}
+	if side.Session == "" && side.From.IsZero() && side.To.IsZero() {
+		return side, fmt.Errorf("%s needs a session ID or a time range (%sFrom, %sTo)", prefix, prefix, prefix)
+	}
+	return side, nil
+}
+
+// readCompareSide reads the side like parseCompareSide, which may also be
+// empty and select every measurement.
+func readCompareSide(query url.Values, prefix string) (compareSide, error) {
+	side := compareSide{Session: query.Get(prefix)}
+
+	for name, target := range map[string]*time.Time{prefix + "From": &side.From, prefix + "To": &side.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return side, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+			}
+			*target = parsed
+		}
+	}
+
+	if side.Session != "" {
+		if _, exists := getSession(side.Session); !exists {
+			return side, fmt.Errorf("session %q not found", side.Session)
+		}
+	}
+
+	return side, nil
+}
+
+// CompareSummary aggregates the per-cell deltas (after minus before) of the
+// cells inside the floor. Changes within the tolerance count as unchanged.
+type CompareSummary struct {
+	Cells     int     `json:"cells"`
+	MeanDelta float64 `json:"meanDelta"`
+	MinDelta  float64 `json:"minDelta"`
+	MaxDelta  float64 `json:"maxDelta"`
+	Improved  float64 `json:"improved"`
+	Degraded  float64 `json:"degraded"`
+	Unchanged float64 `json:"unchanged"`
+}
+
+type CompareResult struct {
+	Floor     int            `json:"floor"`
+	Before    compareSide    `json:"before"`
+	After     compareSide    `json:"after"`
+	Tolerance float64        `json:"tolerance"`
+	Summary   CompareSummary `json:"summary"`
+	Cols      int            `json:"cols"`
+	Rows      int            `json:"rows"`
+	Step      int            `json:"step"`
+	// Deltas holds one value per grid node, row by row from the top-left
+	// corner of the floor map, in dB.
+	Deltas []float64 `json:"deltas"`
+}
+
+// compareGrids interpolates both sides over the same grid and returns the
+// grid of the after side with its values replaced by the deltas.
+func compareGrids(ctx context.Context, bounds image.Rectangle, before, after []Measurement, params HeatmapParams) (*signalGrid, error) {
+	beforeGrid, err := interpolateGrid(ctx, bounds, before, params)
+	if err != nil {
+		return nil, err
+	}
+	afterGrid, err := interpolateGrid(ctx, bounds, after, params)
+	if err != nil {
+		return nil, err
+	}
+	if beforeGrid.Values == nil || afterGrid.Values == nil {
+		return nil, fmt.Errorf("both sides need measurements on the floor")
+	}
+
+	deltas := make([]float64, len(afterGrid.Values))
+	for i := range deltas {
+		deltas[i] = afterGrid.Values[i] - beforeGrid.Values[i]
+	}
+	afterGrid.Values = deltas
+
+	return afterGrid, nil
+}
+
+func summarizeDeltas(grid *signalGrid, tolerance float64) CompareSummary {
+	summary := CompareSummary{MinDelta: math.Inf(1), MaxDelta: math.Inf(-1)}
+	var improved, degraded int
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Cols; col++ {
+			if col*grid.Step >= grid.Bounds.Dx() || row*grid.Step >= grid.Bounds.Dy() {
+				continue
+			}
+			delta := grid.Values[row*grid.Cols+col]
+			summary.Cells++
+			summary.MeanDelta += delta
+			summary.MinDelta = math.Min(summary.MinDelta, delta)
+			summary.MaxDelta = math.Max(summary.MaxDelta, delta)
+			switch {
+			case delta > tolerance:
+				improved++
+			case delta < -tolerance:
+				degraded++
+			}
+		}
+	}
+
+	percent := func(n int) float64 {
+		return math.Round(float64(n)/float64(summary.Cells)*1000) / 10
+	}
+	summary.MeanDelta = math.Round(summary.MeanDelta/float64(summary.Cells)*10) / 10
+	summary.MinDelta = math.Round(summary.MinDelta*10) / 10
+	summary.MaxDelta = math.Round(summary.MaxDelta*10) / 10
+	summary.Improved = percent(improved)
+	summary.Degraded = percent(degraded)
+	summary.Unchanged = math.Round((100-summary.Improved-summary.Degraded)*10) / 10
+
+	return summary
+}
+
+// deltaColor maps a delta to a diverging scale: red where the signal got
+// worse, white where it is unchanged and blue where it improved, saturating
+// at ±limit dB.
+func deltaColor(delta, limit, tolerance float64) color.RGBA {
+	if math.Abs(delta) <= tolerance {
+		return color.RGBA{255, 255, 255, 255}
+	}
+
+	t := math.Min(1, math.Abs(delta)/limit)
+	fade := uint8(255 * (1 - t))
+	if delta < 0 {
+		return color.RGBA{255, fade, fade, 255}
+	}
+	return color.RGBA{fade, fade, 255, 255}
+}
+
+func renderDeltaHeatmap(background image.Image, grid *signalGrid, params HeatmapParams, limit, tolerance float64) image.Image {
+	bounds := grid.Bounds
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, image.White, image.Point{}, draw.Src)
+	if background != nil {
+		draw.Draw(canvas, bounds, background, background.Bounds().Min, draw.Over)
+	}
+
+	overlay := image.NewRGBA(bounds)
+	alpha := uint8(params.Opacity * 255)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := deltaColor(grid.at(grid.Values, x, y), limit, tolerance)
+			overlay.SetRGBA(x, y, color.RGBA{
+				R: uint8(uint16(c.R) * uint16(alpha) / 255),
+				G: uint8(uint16(c.G) * uint16(alpha) / 255),
+				B: uint8(uint16(c.B) * uint16(alpha) / 255),
+				A: alpha,
+			})
+		}
+	}
+	draw.Draw(canvas, bounds, overlay, image.Point{}, draw.Over)
+
+	return canvas
+}
+
+// compareHandler compares the signal of a floor between two surveys. The
+// sides are given as sessions (before, after) and/or time ranges
+// (beforeFrom, beforeTo, afterFrom, afterTo). format=png renders the delta
+// heatmap instead of returning JSON; range sets the dB at which its colors
+// saturate. Heatmap query parameters control the interpolation.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	before, err := parseCompareSide(query, "before")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, err := parseCompareSide(query, "after")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "png" {
+		http.Error(w, "format must be json or png", http.StatusBadRequest)
+		return
+	}
+
+	tolerance, limit := float64(defaultCompareTolerance), float64(defaultCompareRange)
+	for name, target := range map[string]*float64{"tolerance": &tolerance, "range": &limit} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed < 0 {
+				http.Error(w, "invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if limit <= tolerance {
+		http.Error(w, "range must be larger than tolerance", http.StatusBadRequest)
+		return
+	}
+
+	// The sides replace the session filter of the heatmap parameters.
+	query.Del("session")
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var beforeMs, afterMs []Measurement
+	for _, m := range measurements {
+		if m.Floor != floorID {
+			continue
+		}
+		if before.matches(m) {
+			beforeMs = append(beforeMs, m)
+		}
+		if after.matches(m) {
+			afterMs = append(afterMs, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		bounds, background, err := floorBounds(floor, append(beforeMs, afterMs...))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		grid, err := compareGrids(ctx, bounds, beforeMs, afterMs, params)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "comparison timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if format == "png" {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, renderDeltaHeatmap(background, grid, params, limit, tolerance)); err != nil {
+				http.Error(w, "failed to encode heatmap", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(buf.Bytes())
+			return
+		}
+
+		result := CompareResult{
+			Floor:     floorID,
+			Before:    before,
+			After:     after,
+			Tolerance: tolerance,
+			Summary:   summarizeDeltas(grid, tolerance),
+			Cols:      grid.Cols,
+			Rows:      grid.Rows,
+			Step:      grid.Step,
+			Deltas:    make([]float64, len(grid.Values)),
+		}
+		for i, delta := range grid.Values {
+			result.Deltas[i] = math.Round(delta*10) / 10
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
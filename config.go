@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultConfigFile = "heatgen.toml"
+
+var configFile = flag.String("config", envOrDefault("HEATGEN_CONFIG", ""), "TOML file of settings named like the flags, e.g. listen = \":8080\"; heatgen.toml is read when it exists. Flags and HEATGEN_* environment variables override it (env HEATGEN_CONFIG)")
+
+var (
+	listenAddr  = flag.String("listen", envOrDefault("HEATGEN_LISTEN", ":8080"), "address the server listens on (env HEATGEN_LISTEN)")
+	baseURL     = flag.String("base-url", envOrDefault("HEATGEN_BASE_URL", "http://localhost:8080"), "URL the server is reached at; floor map paths stored with it as a prefix are served from the uploads directory (env HEATGEN_BASE_URL)")
+	corsOrigins = flag.String("cors-origins", envOrDefault("HEATGEN_CORS_ORIGINS", "*"), "comma-separated origins allowed to call the API from a browser, * for any (env HEATGEN_CORS_ORIGINS)")
+)
+
+var flagEnvRe = regexp.MustCompile(`\(env (HEATGEN_\w+)\)`)
+
+// flagEnv is the environment variable that sets a flag: the one its usage
+// names, or HEATGEN_ followed by the flag name in upper case.
+func flagEnv(f *flag.Flag) string {
+	if match := flagEnvRe.FindStringSubmatch(f.Usage); match != nil {
+		return match[1]
+	}
+	return "HEATGEN_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+}
+
+// loadConfig applies the settings of the config file and the environment
+// to the flags not given on the command line, so flags override the
+// environment, which overrides the file.
+func loadConfig() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	path := *configFile
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	settings := make(map[string]string)
+	if path != "" {
+		var err error
+		if settings, err = readConfigFile(path); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for name := range settings {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		value, source := settings[f.Name], path
+		if env, set := os.LookupEnv(flagEnv(f)); set && env != "" {
+			value, source = env, flagEnv(f)
+		} else if _, set := settings[f.Name]; !set {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: invalid %s %q: %v", source, f.Name, value, setErr)
+		}
+	})
+	return err
+}
+
+// readConfigFile reads the flat subset of TOML the config file is written
+// in: one key = value per line, where values are strings, numbers, booleans
+// or arrays of strings, joined with commas. Keys may use underscores for
+// the dashes of the flag names.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported, settings are top-level keys", line)
+		}
+
+		key, raw, found := strings.Cut(text, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key = value", line)
+		}
+		key = strings.ReplaceAll(strings.Trim(strings.TrimSpace(key), `"`), "_", "-")
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, duplicate := settings[key]; duplicate {
+			return nil, fmt.Errorf("line %d: %s is set twice", line, key)
+		}
+		settings[key] = value
+	}
+	return settings, scanner.Err()
+}
+
+// parseConfigValue reads a TOML value, dropping a trailing comment.
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, "["):
+		end := strings.LastIndex(raw, "]")
+		if end < 0 || !isConfigComment(raw[end+1:]) {
+			return "", fmt.Errorf("arrays must be written on one line")
+		}
+		var items []string
+		for rest := strings.TrimSpace(raw[1:end]); rest != ""; {
+			item, tail, err := cutConfigString(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimSpace(tail)
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'"):
+		value, tail, err := cutConfigString(raw)
+		if err != nil {
+			return "", err
+		}
+		if !isConfigComment(tail) {
+			return "", fmt.Errorf("unexpected %q after the string", strings.TrimSpace(tail))
+		}
+		return value, nil
+	default:
+		value, _, _ := strings.Cut(raw, "#")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", fmt.Errorf("missing value")
+		}
+		return strings.ReplaceAll(value, "_", ""), nil
+	}
+}
+
+// cutConfigString reads the quoted string raw starts with and returns it
+// with the text after it.
+func cutConfigString(raw string) (string, string, error) {
+	quote := raw[0]
+	if quote != '"' && quote != '\'' {
+		return "", "", fmt.Errorf("expected a quoted string")
+	}
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case raw[i] == '\\' && quote == '"':
+			i++
+		case raw[i] == quote:
+			if quote == '\'' {
+				return raw[1:i], raw[i+1:], nil
+			}
+			value, err := strconv.Unquote(raw[:i+1])
+			return value, raw[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+func isConfigComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// allowedOrigin is the Access-Control-Allow-Origin answering a request from
+// origin, or "" when -cors-origins does not allow it.
+func allowedOrigin(origin string) string {
+	for _, allowed := range strings.Split(*corsOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
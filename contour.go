@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultContourLevels are the signal levels commonly required of a
+// network: excellent, good, voice and data.
+var defaultContourLevels = []float64{-50, -60, -67, -75}
+
+const (
+	maxContourLevels = 20
+	// contourLabelPoints is the shortest isoline, in points, that gets a
+	// label, so small islands do not clutter the drawing.
+	contourLabelPoints = 12
+)
+
+// contourLevelsParam reads ?levels as a comma-separated list. Without it
+// the signal metric uses defaultContourLevels and other metrics four
+// levels spread evenly over the scale.
+func contourLevelsParam(query url.Values, params HeatmapParams) ([]float64, error) {
+	value := query.Get("levels")
+	if value == "" {
+		if params.Metric.Name == defaultMetric {
+			return defaultContourLevels, nil
+		}
+		levels := make([]float64, 4)
+		for i := range levels {
+			levels[i] = params.Min + (params.Max-params.Min)*float64(i+1)/5
+		}
+		return levels, nil
+	}
+
+	var levels []float64
+	for _, field := range strings.Split(value, ",") {
+		level, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || math.IsNaN(level) || math.IsInf(level, 0) {
+			return nil, fmt.Errorf("invalid level %q", field)
+		}
+		levels = append(levels, level)
+	}
+	if len(levels) > maxContourLevels {
+		return nil, fmt.Errorf("at most %d levels are allowed", maxContourLevels)
+	}
+	return levels, nil
+}
+
+// contourPoint is a point of an isoline in image pixels.
+type contourPoint struct{ X, Y float64 }
+
+// Cell edges of marching squares, clockwise from the top.
+const (
+	edgeTop = iota
+	edgeRight
+	edgeBottom
+	edgeLeft
+)
+
+// contourSegments lists, per corner case, the pairs of cell edges the
+// isoline crosses. Corners at or above the level set the bits top-left 8,
+// top-right 4, bottom-right 2 and bottom-left 1. The saddles 5 and 10 are
+// listed for a center below the level and swapped otherwise.
+var contourSegments = [16][][2]int{
+	1:  {{edgeLeft, edgeBottom}},
+	2:  {{edgeBottom, edgeRight}},
+	3:  {{edgeLeft, edgeRight}},
+	4:  {{edgeTop, edgeRight}},
+	5:  {{edgeLeft, edgeBottom}, {edgeTop, edgeRight}},
+	6:  {{edgeTop, edgeBottom}},
+	7:  {{edgeLeft, edgeTop}},
+	8:  {{edgeLeft, edgeTop}},
+	9:  {{edgeTop, edgeBottom}},
+	10: {{edgeLeft, edgeTop}, {edgeBottom, edgeRight}},
+	11: {{edgeTop, edgeRight}},
+	12: {{edgeLeft, edgeRight}},
+	13: {{edgeBottom, edgeRight}},
+	14: {{edgeLeft, edgeBottom}},
+}
+
+// traceIsolines runs marching squares over the grid and joins the
+// segments into polylines. Every crossing lies on one grid edge, which
+// identifies it, so segments are chained through their shared edges.
+// Lines ending at the grid border stay open; the others are closed.
+func traceIsolines(grid *signalGrid, level float64) [][]contourPoint {
+	cols, values := grid.Cols, grid.Values
+	step := float64(grid.Step)
+
+	// Horizontal edges right of node n are 2n, vertical edges below it
+	// 2n+1.
+	crossing := func(key int) contourPoint {
+		node := key / 2
+		col, row := node%cols, node/cols
+		next := node + 1
+		if key%2 == 1 {
+			next = node + cols
+		}
+		t := (level - values[node]) / (values[next] - values[node])
+		if key%2 == 0 {
+			return contourPoint{(float64(col) + t) * step, float64(row) * step}
+		}
+		return contourPoint{float64(col) * step, (float64(row) + t) * step}
+	}
+
+	links := make(map[int][]int)
+	for row := 0; row < grid.Rows-1; row++ {
+		for col := 0; col < cols-1; col++ {
+			n := row*cols + col
+			tl, tr, br, bl := values[n], values[n+1], values[n+cols+1], values[n+cols]
+			index := 0
+			for bit, v := range []float64{bl, br, tr, tl} {
+				if v >= level {
+					index |= 1 << bit
+				}
+			}
+
+			segments := contourSegments[index]
+			if (index == 5 || index == 10) && (tl+tr+br+bl)/4 >= level {
+				segments = contourSegments[15-index]
+			}
+
+			edges := [4]int{edgeTop: 2 * n, edgeRight: 2*(n+1) + 1, edgeBottom: 2 * (n + cols), edgeLeft: 2*n + 1}
+			for _, s := range segments {
+				a, b := edges[s[0]], edges[s[1]]
+				links[a] = append(links[a], b)
+				links[b] = append(links[b], a)
+			}
+		}
+	}
+
+	// Open lines start at an end, closed ones anywhere; keys are sorted so
+	// the output is stable.
+	keys := make([]int, 0, len(links))
+	for key := range links {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return len(links[keys[i]]) == 1 && len(links[keys[j]]) != 1
+	})
+
+	visited := make(map[int]bool)
+	var lines [][]contourPoint
+	for _, start := range keys {
+		if visited[start] {
+			continue
+		}
+		line := []contourPoint{crossing(start)}
+		visited[start] = true
+		for current := start; ; {
+			next := -1
+			for _, candidate := range links[current] {
+				if !visited[candidate] {
+					next = candidate
+					break
+				}
+			}
+			if next < 0 {
+				if len(links[current]) == 2 && slices.Contains(links[current], start) && len(line) > 2 {
+					line = append(line, line[0])
+				}
+				break
+			}
+			visited[next] = true
+			line = append(line, crossing(next))
+			current = next
+		}
+		if len(line) > 1 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// renderContours draws the isolines of each level over the floor map as
+// SVG. The map is embedded, so the file stands on its own when printed or
+// saved.
+func renderContours(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, levels []float64) ([]byte, error) {
+	bounds, _, err := floorBounds(floor, ms)
+	if err != nil {
+		return nil, err
+	}
+	grid, err := interpolateGrid(ctx, bounds, ms, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		bounds.Dx(), bounds.Dy(), bounds.Dx(), bounds.Dy())
+
+	if floor.MapPath != "" {
+		data, err := os.ReadFile(uploadFile(floor.MapPath))
+		if err != nil {
+			return nil, err
+		}
+		contentType := mapContentTypes[strings.ToLower(filepath.Ext(floor.MapPath))]
+		fmt.Fprintf(&buf, `<image width="%d" height="%d" href="data:%s;base64,%s"/>`+"\n",
+			bounds.Dx(), bounds.Dy(), contentType, base64.StdEncoding.EncodeToString(data))
+	}
+
+	buf.WriteString(`<g fill="none" stroke-width="2" stroke-linejoin="round" font-family="sans-serif" font-size="12">` + "\n")
+	if grid.Values != nil {
+		for _, level := range levels {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			c := params.colorFor(level)
+			stroke := fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+			label := html.EscapeString(params.Metric.format(level))
+			fmt.Fprintf(&buf, `<g class="isoline" data-level="%g" stroke="%s">`+"\n", level, stroke)
+			for _, line := range traceIsolines(grid, level) {
+				buf.WriteString(`<path d="`)
+				for i, p := range line {
+					command := "L"
+					if i == 0 {
+						command = "M"
+					}
+					fmt.Fprintf(&buf, "%s%.1f %.1f", command, p.X, p.Y)
+				}
+				buf.WriteString(`"/>` + "\n")
+
+				if len(line) >= contourLabelPoints {
+					p := line[len(line)/2]
+					fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" fill="%s" stroke="white" stroke-width="3" paint-order="stroke">%s</text>`+"\n",
+						p.X, p.Y, stroke, label)
+				}
+			}
+			buf.WriteString("</g>\n")
+		}
+	}
+	buf.WriteString("</g>\n</svg>\n")
+
+	return buf.Bytes(), nil
+}
+
+// writeContours renders the isolines through the bounded render pool and
+// responds with the SVG document.
+func writeContours(w http.ResponseWriter, r *http.Request, floor Floor, ms []Measurement, params HeatmapParams, levels []float64) {
+	withRenderSlot(w, r, func(ctx context.Context) {
+		data, err := renderContours(ctx, floor, ms, params, levels)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "contour rendering timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(data)
+	})
+}
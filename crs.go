@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CRS is a coordinate reference system whose coordinates can be converted
+// to WGS 84. Coordinates are given as easting and northing; for geographic
+// systems these are the longitude and latitude in degrees.
+type CRS struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	Projected bool   `json:"projected"`
+
+	toWGS84 func(easting, northing float64) (lat, lng float64)
+}
+
+type ellipsoid struct {
+	a, f float64
+}
+
+var (
+	wgs84Ellipsoid   = ellipsoid{a: 6378137, f: 1 / 298.257223563}
+	bessel1841       = ellipsoid{a: 6377397.155, f: 1 / 299.1528128}
+	webMercatorScale = wgs84Ellipsoid.a
+)
+
+func (e ellipsoid) eccentricitySquared() float64 {
+	return e.f * (2 - e.f)
+}
+
+// fixedCRS are the systems with a single definition; UTM zones are
+// generated by lookupCRS.
+var fixedCRS = map[int]CRS{
+	4326: {Name: "WGS 84", toWGS84: func(easting, northing float64) (float64, float64) {
+		return northing, easting
+	}},
+	3857: {Name: "WGS 84 / Pseudo-Mercator", Projected: true, toWGS84: func(easting, northing float64) (float64, float64) {
+		lat := math.Atan(math.Sinh(northing/webMercatorScale)) * 180 / math.Pi
+		return lat, easting / webMercatorScale * 180 / math.Pi
+	}},
+	5514: {Name: "S-JTSK / Krovak East North", Projected: true, toWGS84: krovakToWGS84},
+}
+
+// lookupCRS accepts EPSG codes as "EPSG:32633" or "32633". Besides the
+// fixed systems it knows the WGS 84 UTM zones (326xx north, 327xx south)
+// and the ETRS89 UTM zones of Europe (25828 to 25838), which are taken as
+// WGS 84: the two differ by well under a meter at building scale.
+func lookupCRS(code string) (CRS, error) {
+	number, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(code)), "EPSG:"))
+	if err != nil {
+		return CRS{}, fmt.Errorf("crs must be an EPSG code such as EPSG:32633")
+	}
+
+	crs, ok := fixedCRS[number]
+	switch {
+	case ok:
+	case number > 32600 && number <= 32660:
+		crs = utmCRS("WGS 84", number-32600, false)
+	case number > 32700 && number <= 32760:
+		crs = utmCRS("WGS 84", number-32700, true)
+	case number >= 25828 && number <= 25838:
+		crs = utmCRS("ETRS89", number-25800, false)
+	default:
+		return CRS{}, fmt.Errorf("unsupported crs EPSG:%d, see /api/crs", number)
+	}
+	crs.Code = fmt.Sprintf("EPSG:%d", number)
+	return crs, nil
+}
+
+func utmCRS(datum string, zone int, south bool) CRS {
+	hemisphere, falseNorthing := "N", 0.0
+	if south {
+		hemisphere, falseNorthing = "S", 10000000
+	}
+	centralMeridian := float64(zone*6 - 183)
+
+	return CRS{
+		Name:      fmt.Sprintf("%s / UTM zone %d%s", datum, zone, hemisphere),
+		Projected: true,
+		toWGS84: func(easting, northing float64) (float64, float64) {
+			return transverseMercatorInverse(wgs84Ellipsoid, centralMeridian, 0.9996, easting-500000, northing-falseNorthing)
+		},
+	}
+}
+
+// transverseMercatorInverse converts transverse Mercator coordinates,
+// relative to the false origin, to geographic ones with Krüger's series,
+// which is accurate to well below a millimeter within a UTM zone.
+func transverseMercatorInverse(e ellipsoid, centralMeridian, k0, x, y float64) (float64, float64) {
+	n := e.f / (2 - e.f)
+	n2, n3 := n*n, n*n*n
+	a := e.a / (1 + n) * (1 + n2/4 + n2*n2/64)
+
+	beta := [3]float64{n/2 - 2*n2/3 + 37*n3/96, n2/48 + n3/15, 17 * n3 / 480}
+	delta := [3]float64{2*n - 2*n2/3 - 2*n3, 7*n2/3 - 8*n3/5, 56 * n3 / 15}
+
+	xi, eta := y/(k0*a), x/(k0*a)
+	xi1, eta1 := xi, eta
+	for j := 1; j <= 3; j++ {
+		k := float64(2 * j)
+		xi1 -= beta[j-1] * math.Sin(k*xi) * math.Cosh(k*eta)
+		eta1 -= beta[j-1] * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+
+	chi := math.Asin(math.Sin(xi1) / math.Cosh(eta1))
+	lat := chi
+	for j := 1; j <= 3; j++ {
+		lat += delta[j-1] * math.Sin(float64(2*j)*chi)
+	}
+	lng := centralMeridian*math.Pi/180 + math.Atan2(math.Sinh(eta1), math.Cos(xi1))
+
+	return lat * 180 / math.Pi, lng * 180 / math.Pi
+}
+
+// Krovak projection of S-JTSK (EPSG method 9819), with the longitude of
+// origin counted from Greenwich.
+const (
+	krovakLatC       = 49.5
+	krovakLngO       = 24.0 + 50.0/60
+	krovakAlphaC     = 30.28813975277778
+	krovakLatP       = 78.5
+	krovakScaleP     = 0.9999
+	krovakIterations = 10
+)
+
+// sjtskToWGS84 is the position vector transformation from S-JTSK to
+// WGS 84 (translations in meters, rotations in arc seconds, scale in ppm),
+// accurate to about a meter.
+var sjtskToWGS84 = [7]float64{570.8, 85.7, 462.8, 4.998, 1.587, 5.261, 3.56}
+
+// krovakInverse converts Krovak East North coordinates (EPSG:5514, where
+// both values are negative in the Czech Republic and Slovakia) to latitude
+// and longitude on the Bessel ellipsoid.
+func krovakInverse(easting, northing float64) (float64, float64) {
+	const rad = math.Pi / 180
+	e2 := bessel1841.eccentricitySquared()
+	e := math.Sqrt(e2)
+	latC, alphaC, latP := krovakLatC*rad, krovakAlphaC*rad, krovakLatP*rad
+
+	sinC := math.Sin(latC)
+	a := bessel1841.a * math.Sqrt(1-e2) / (1 - e2*sinC*sinC)
+	b := math.Sqrt(1 + e2*math.Pow(math.Cos(latC), 4)/(1-e2))
+	gamma0 := math.Asin(sinC / b)
+	t0 := math.Tan(math.Pi/4+gamma0/2) * math.Pow((1+e*sinC)/(1-e*sinC), e*b/2) / math.Pow(math.Tan(math.Pi/4+latC/2), b)
+	n := math.Sin(latP)
+	r0 := krovakScaleP * a / math.Tan(latP)
+
+	// The south-orientated axes of the original Krovak projection.
+	southing, westing := -northing, -easting
+	r := math.Hypot(southing, westing)
+	theta := math.Atan2(westing, southing)
+	d := theta / math.Sin(latP)
+	t := 2 * (math.Atan(math.Pow(r0/r, 1/n)*math.Tan(math.Pi/4+latP/2)) - math.Pi/4)
+	u := math.Asin(math.Cos(alphaC)*math.Sin(t) - math.Sin(alphaC)*math.Cos(t)*math.Cos(d))
+	v := math.Asin(math.Cos(t) * math.Sin(d) / math.Cos(u))
+
+	lat := u
+	for i := 0; i < krovakIterations; i++ {
+		sinLat := math.Sin(lat)
+		lat = 2 * (math.Atan(math.Pow(t0, -1/b)*math.Pow(math.Tan(u/2+math.Pi/4), 1/b)*math.Pow((1+e*sinLat)/(1-e*sinLat), e/2)) - math.Pi/4)
+	}
+	lng := krovakLngO*rad - v/b
+
+	return lat / rad, lng / rad
+}
+
+func krovakToWGS84(easting, northing float64) (float64, float64) {
+	lat, lng := krovakInverse(easting, northing)
+	x, y, z := geodeticToECEF(bessel1841, lat, lng)
+	x, y, z = helmertTransform(sjtskToWGS84, x, y, z)
+	return ecefToGeodetic(wgs84Ellipsoid, x, y, z)
+}
+
+func geodeticToECEF(e ellipsoid, lat, lng float64) (float64, float64, float64) {
+	const rad = math.Pi / 180
+	e2 := e.eccentricitySquared()
+	sinLat, cosLat := math.Sin(lat*rad), math.Cos(lat*rad)
+	nu := e.a / math.Sqrt(1-e2*sinLat*sinLat)
+	return nu * cosLat * math.Cos(lng*rad), nu * cosLat * math.Sin(lng*rad), nu * (1 - e2) * sinLat
+}
+
+func ecefToGeodetic(e ellipsoid, x, y, z float64) (float64, float64) {
+	const rad = math.Pi / 180
+	e2 := e.eccentricitySquared()
+	p := math.Hypot(x, y)
+
+	lat := math.Atan2(z, p*(1-e2))
+	for i := 0; i < 10; i++ {
+		sinLat := math.Sin(lat)
+		nu := e.a / math.Sqrt(1-e2*sinLat*sinLat)
+		lat = math.Atan2(z+e2*nu*sinLat, p)
+	}
+	return lat / rad, math.Atan2(y, x) / rad
+}
+
+// helmertTransform applies a seven-parameter position vector
+// transformation to geocentric coordinates.
+func helmertTransform(p [7]float64, x, y, z float64) (float64, float64, float64) {
+	const arcSecond = math.Pi / 648000
+	rx, ry, rz := p[3]*arcSecond, p[4]*arcSecond, p[5]*arcSecond
+	s := 1 + p[6]*1e-6
+	return p[0] + s*(x-rz*y+ry*z),
+		p[1] + s*(rz*x+y-rx*z),
+		p[2] + s*(-ry*x+rx*y+z)
+}
+
+// crsHandler lists the supported coordinate reference systems.
+func crsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var codes []int
+	for code := range fixedCRS {
+		codes = append(codes, code)
+	}
+	for zone := 1; zone <= 60; zone++ {
+		codes = append(codes, 32600+zone, 32700+zone)
+	}
+	for code := 25828; code <= 25838; code++ {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	list := make([]CRS, 0, len(codes))
+	for _, code := range codes {
+		crs, _ := lookupCRS(strconv.Itoa(code))
+		list = append(list, crs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Data classes keep the readings of continuous probes apart from the
+// points collected by hand in surveys. Survey measurements store no class.
+const (
+	classSurvey     = "survey"
+	classMonitoring = "monitoring"
+	// classAll selects both classes in queries.
+	classAll = "all"
+)
+
+func (m Measurement) class() string {
+	if m.Class == "" {
+		return classSurvey
+	}
+	return m.Class
+}
+
+// measurementClass checks the class given for new measurements and
+// returns the one to store, fallback when none is given.
+func measurementClass(class, fallback string) (string, error) {
+	if class == "" {
+		class = fallback
+	}
+	switch class {
+	case classSurvey:
+		return "", nil
+	case classMonitoring:
+		return classMonitoring, nil
+	}
+	return "", fmt.Errorf("class must be survey or monitoring")
+}
+
+// parseClass reads ?class of queries. Listings and heatmaps show survey
+// data unless monitoring or all is asked for, so probe readings do not
+// drown the survey points.
+func parseClass(query url.Values) (string, error) {
+	switch class := query.Get("class"); class {
+	case "":
+		return classSurvey, nil
+	case classSurvey, classMonitoring, classAll:
+		return class, nil
+	}
+	return "", fmt.Errorf("class must be survey, monitoring or all")
+}
+
+// inClass reports whether a measurement is of the class; the empty class,
+// like all, matches every measurement.
+func inClass(m Measurement, class string) bool {
+	return class == "" || class == classAll || m.class() == class
+}
+
+// classMeasurements returns the measurements of a class.
+func classMeasurements(ms []Measurement, class string) []Measurement {
+	if class == "" || class == classAll {
+		return ms
+	}
+	var result []Measurement
+	for _, m := range ms {
+		if inClass(m, class) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (a DailyAggregate) class() string {
+	if a.Class == "" {
+		return classSurvey
+	}
+	return a.Class
+}
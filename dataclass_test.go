@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseClass(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "", want: classSurvey},
+		{query: "class=survey", want: classSurvey},
+		{query: "class=monitoring", want: classMonitoring},
+		{query: "class=all", want: classAll},
+		{query: "class=probe", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		got, err := parseClass(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %#v, want an error", test.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: parsed %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dfsEventsFile = "dfs_events.json"
+
+var (
+	dfsMonitor      = flag.Bool("dfs-monitor", false, "log DFS radar events and channel moves of the associated AP")
+	dfsPollInterval = flag.Duration("dfs-poll", 5*time.Second, "how often the DFS monitor polls the link")
+
+	dfsEvents     []DFSEvent
+	dfsEventsLock sync.Mutex
+)
+
+type DFSEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Kind      string    `json:"kind"`
+	BSSID     string    `json:"bssid,omitempty"`
+	FromFreq  int       `json:"fromFreq,omitempty"`
+	ToFreq    int       `json:"toFreq,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Floor     int       `json:"floor"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Location  string    `json:"location"`
+}
+
+var iwEventFreqRe = regexp.MustCompile(`freq (\d+)`)
+
+func loadDFSEvents() error {
+	dfsEventsLock.Lock()
+	defer dfsEventsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(dfsEventsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &dfsEvents)
+}
+
+func recordDFSEvent(event DFSEvent) {
+	event.Timestamp = time.Now()
+
+	// The surveyor is assumed to still be at the most recent measurement.
+	mutex.Lock()
+	if len(measurements) > 0 {
+		last := measurements[len(measurements)-1]
+		event.Floor, event.Lat, event.Lng, event.Location = last.Floor, last.Lat, last.Lng, last.Location
+	}
+	mutex.Unlock()
+
+	dfsEventsLock.Lock()
+	defer dfsEventsLock.Unlock()
+
+	dfsEvents = append(dfsEvents, event)
+	log.Printf("DFS event: %s %s %d -> %d %s", event.Kind, event.BSSID, event.FromFreq, event.ToFreq, event.Detail)
+
+	data, err := json.MarshalIndent(dfsEvents, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(projectFile(dfsEventsFile), data, 0644); err != nil {
+		log.Printf("failed to save DFS events: %v", err)
+	}
+}
+
+// startDFSMonitor watches nl80211 events for radar detections and channel
+// switch announcements, and polls the link to catch APs that silently move
+// to another channel.
+func startDFSMonitor(interfaceName string) {
+	go watchIwEvents(interfaceName)
+	go pollLinkChannel(interfaceName)
+}
+
+func watchIwEvents(interfaceName string) {
+	for {
+		cmd := exec.Command("iw", "event", "-t")
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			log.Printf("DFS monitor: failed to start iw event: %v", err)
+			return
+		}
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.Contains(line, interfaceName) && !strings.Contains(line, "phy #") {
+				continue
+			}
+
+			var kind string
+			switch {
+			case strings.Contains(line, "radar event"):
+				kind = "radar"
+			case strings.Contains(line, "ch_switch"):
+				kind = "channel-switch"
+			default:
+				continue
+			}
+
+			event := DFSEvent{Kind: kind, Detail: strings.TrimSpace(line)}
+			if match := iwEventFreqRe.FindStringSubmatch(line); match != nil {
+				event.ToFreq, _ = strconv.Atoi(match[1])
+			}
+			recordDFSEvent(event)
+		}
+
+		cmd.Wait()
+		time.Sleep(time.Second)
+	}
+}
+
+func pollLinkChannel(interfaceName string) {
+	var last LinkInfo
+	for range time.Tick(*dfsPollInterval) {
+		link, _, err := getWifiSignalDbm(interfaceName)
+		if err != nil || link.BSSID == "" {
+			continue
+		}
+
+		if link.BSSID == last.BSSID && link.Freq != last.Freq && last.Freq != 0 {
+			recordDFSEvent(DFSEvent{
+				Kind:     "bssid-move",
+				BSSID:    link.BSSID,
+				FromFreq: last.Freq,
+				ToFreq:   link.Freq,
+			})
+		}
+		last = link
+	}
+}
+
+func dfsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	floor, err := strconv.Atoi(r.URL.Query().Get("floor"))
+	if err != nil {
+		floor = 0
+	}
+
+	dfsEventsLock.Lock()
+	defer dfsEventsLock.Unlock()
+
+	filtered := []DFSEvent{}
+	for _, event := range dfsEvents {
+		if floor > 0 && event.Floor != floor {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(filtered)
+}
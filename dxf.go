@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DXF layers of the export. Contours get a layer per level, named by
+// dxfContourLayer.
+const (
+	dxfFrameLayer  = "HEATGEN_FRAME"
+	dxfPointsLayer = "HEATGEN_POINTS"
+	dxfAPLayer     = "HEATGEN_APS"
+)
+
+// dxfColors are the AutoCAD Color Index entries levels are matched to, as
+// the R12 format has no true colors.
+var dxfColors = map[int]color.RGBA{
+	1:  {255, 0, 0, 255},
+	2:  {255, 255, 0, 255},
+	3:  {0, 255, 0, 255},
+	4:  {0, 255, 255, 255},
+	5:  {0, 0, 255, 255},
+	6:  {255, 0, 255, 255},
+	30: {255, 127, 0, 255},
+}
+
+// dxfColor returns the color index closest to c.
+func dxfColor(c color.RGBA) int {
+	best, bestDistance := 7, math.Inf(1)
+	for index, candidate := range dxfColors {
+		dr, dg, db := float64(c.R)-float64(candidate.R), float64(c.G)-float64(candidate.G), float64(c.B)-float64(candidate.B)
+		if distance := dr*dr + dg*dg + db*db; distance < bestDistance || (distance == bestDistance && index < best) {
+			best, bestDistance = index, distance
+		}
+	}
+	return best
+}
+
+func dxfContourLayer(level float64) string {
+	return "HEATGEN_CONTOUR_" + strconv.FormatFloat(level, 'f', -1, 64)
+}
+
+// apMarker is the estimated position of an access point.
+type apMarker struct {
+	BSSID, SSID string
+	Lat, Lng    float64
+	Dbm         int
+}
+
+// estimateAPPositions places each BSSID heard in ms at the centroid of its
+// three strongest readings, weighted by received power. Without a survey
+// of the AP positions this is where the AP most likely is, close enough to
+// mark it on a drawing.
+func estimateAPPositions(ms []Measurement) []apMarker {
+	readings := make(map[string][]Measurement)
+	for _, m := range ms {
+		if m.BSSID != "" && m.Dbm != failedSampleDbm {
+			bssid := strings.ToLower(m.BSSID)
+			readings[bssid] = append(readings[bssid], m)
+		}
+	}
+
+	markers := make([]apMarker, 0, len(readings))
+	for bssid, rs := range readings {
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Dbm > rs[j].Dbm })
+		rs = rs[:min(3, len(rs))]
+
+		var lat, lng, total float64
+		for _, m := range rs {
+			weight := math.Pow(10, float64(m.Dbm)/10)
+			lat, lng, total = lat+m.Lat*weight, lng+m.Lng*weight, total+weight
+		}
+		markers = append(markers, apMarker{BSSID: bssid, SSID: rs[0].SSID, Lat: lat / total, Lng: lng / total, Dbm: rs[0].Dbm})
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i].BSSID < markers[j].BSSID })
+	return markers
+}
+
+// dxfWriter writes the group code and value pairs of an ASCII DXF file.
+type dxfWriter struct {
+	w *bufio.Writer
+}
+
+func (d dxfWriter) pair(code int, value string) {
+	fmt.Fprintf(d.w, "%d\n%s\n", code, value)
+}
+
+func (d dxfWriter) float(code int, value float64) {
+	d.pair(code, strconv.FormatFloat(value, 'f', 3, 64))
+}
+
+func (d dxfWriter) point(x, y float64) {
+	d.float(10, x)
+	d.float(20, y)
+	d.float(30, 0)
+}
+
+func (d dxfWriter) text(layer string, x, y, height float64, value string) {
+	d.pair(0, "TEXT")
+	d.pair(8, layer)
+	d.point(x, y)
+	d.float(40, height)
+	d.pair(1, value)
+}
+
+func (d dxfWriter) polyline(layer string, closed bool, xs, ys []float64) {
+	d.pair(0, "POLYLINE")
+	d.pair(8, layer)
+	d.pair(66, "1")
+	d.point(0, 0)
+	if closed {
+		d.pair(70, "1")
+	} else {
+		d.pair(70, "0")
+	}
+	for i := range xs {
+		d.pair(0, "VERTEX")
+		d.pair(8, layer)
+		d.point(xs[i], ys[i])
+	}
+	d.pair(0, "SEQEND")
+	d.pair(8, layer)
+}
+
+// dxfLayer is a layer of the export with its color index.
+type dxfLayer struct {
+	Name  string
+	Color int
+}
+
+// writeFloorDXF writes the measurement points, the isolines of the levels
+// and the estimated AP positions of a floor as an AutoCAD R12 DXF drawing
+// on separate layers. The origin is the bottom-left corner of the floor
+// plan; one unit is a meter on floors with a scale and a map pixel on
+// others, so the plan inserted at the origin at that size lines up.
+func writeFloorDXF(ctx context.Context, w io.Writer, floor Floor, ms []Measurement, params HeatmapParams, levels []float64) error {
+	bounds, _, err := floorBounds(floor, ms)
+	if err != nil {
+		return err
+	}
+	grid, err := interpolateGrid(ctx, bounds, ms, params)
+	if err != nil {
+		return err
+	}
+
+	unit, units := 1.0, "map pixels"
+	if metersPerPixel := floor.metersPerPixel(); metersPerPixel > 0 {
+		unit, units = metersPerPixel, "meters"
+	}
+	textHeight := 10 * unit
+	height := float64(bounds.Dy())
+
+	layers := []dxfLayer{{dxfFrameLayer, 8}, {dxfPointsLayer, 7}, {dxfAPLayer, 5}}
+	for _, level := range levels {
+		layers = append(layers, dxfLayer{dxfContourLayer(level), dxfColor(params.colorFor(level))})
+	}
+
+	d := dxfWriter{bufio.NewWriter(w)}
+	d.pair(999, fmt.Sprintf("HeatGen export of floor %d (%s), units: %s", floor.ID, floor.Name, units))
+	d.pair(0, "SECTION")
+	d.pair(2, "HEADER")
+	d.pair(9, "$ACADVER")
+	d.pair(1, "AC1009")
+	d.pair(9, "$EXTMIN")
+	d.point(0, 0)
+	d.pair(9, "$EXTMAX")
+	d.point(float64(bounds.Dx())*unit, height*unit)
+	d.pair(0, "ENDSEC")
+
+	d.pair(0, "SECTION")
+	d.pair(2, "TABLES")
+	d.pair(0, "TABLE")
+	d.pair(2, "LTYPE")
+	d.pair(70, "1")
+	d.pair(0, "LTYPE")
+	d.pair(2, "CONTINUOUS")
+	d.pair(70, "0")
+	d.pair(3, "Solid line")
+	d.pair(72, "65")
+	d.pair(73, "0")
+	d.float(40, 0)
+	d.pair(0, "ENDTAB")
+	d.pair(0, "TABLE")
+	d.pair(2, "LAYER")
+	d.pair(70, strconv.Itoa(len(layers)))
+	for _, layer := range layers {
+		d.pair(0, "LAYER")
+		d.pair(2, layer.Name)
+		d.pair(70, "0")
+		d.pair(62, strconv.Itoa(layer.Color))
+		d.pair(6, "CONTINUOUS")
+	}
+	d.pair(0, "ENDTAB")
+	d.pair(0, "ENDSEC")
+
+	d.pair(0, "SECTION")
+	d.pair(2, "ENTITIES")
+
+	width := float64(bounds.Dx()) * unit
+	d.polyline(dxfFrameLayer, true, []float64{0, width, width, 0}, []float64{0, 0, height * unit, height * unit})
+
+	for _, m := range params.selectMeasurements(ms) {
+		value, ok := params.Metric.value(m)
+		if !ok {
+			continue
+		}
+		x, y := m.Lng*unit, m.Lat*unit
+		d.pair(0, "POINT")
+		d.pair(8, dxfPointsLayer)
+		d.point(x, y)
+		d.text(dxfPointsLayer, x+textHeight/2, y+textHeight/2, textHeight, params.Metric.format(value))
+	}
+
+	if grid.Values != nil {
+		for _, level := range levels {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			layer := dxfContourLayer(level)
+			for _, line := range traceIsolines(grid, level) {
+				xs, ys := make([]float64, len(line)), make([]float64, len(line))
+				for i, p := range line {
+					xs[i], ys[i] = p.X*unit, (height-p.Y)*unit
+				}
+				d.polyline(layer, false, xs, ys)
+			}
+		}
+	}
+
+	aps := sessionMeasurements(ms, params.Session)
+	aps = bandMeasurements(heightMeasurements(aps, params.Height), params.Band)
+	for _, ap := range estimateAPPositions(aps) {
+		if params.SSID != "" && ap.SSID != params.SSID {
+			continue
+		}
+		x, y := ap.Lng*unit, ap.Lat*unit
+		d.pair(0, "CIRCLE")
+		d.pair(8, dxfAPLayer)
+		d.point(x, y)
+		d.float(40, textHeight)
+		label := ap.BSSID
+		if ap.SSID != "" {
+			label = ap.SSID + " " + ap.BSSID
+		}
+		d.text(dxfAPLayer, x+textHeight*1.5, y-textHeight/2, textHeight, label)
+	}
+
+	d.pair(0, "ENDSEC")
+	d.pair(0, "EOF")
+	return d.w.Flush()
+}
+
+// floorDXFHandler exports the floor as a DXF drawing for CAD, see
+// writeFloorDXF. Heatmap query parameters select the measurements and the
+// interpolation, and ?levels the isolines as for the SVG contours.
+func floorDXFHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params, err := parseHeatmapParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	levels, err := contourLevelsParam(r.URL.Query(), params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		var buf strings.Builder
+		if err := writeFloorDXF(ctx, &buf, floor, filtered, params, levels); err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "DXF export timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/vnd.dxf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=floor_%d.dxf", floorID))
+		io.WriteString(w, buf.String())
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// maxEstimatePoints bounds the batch size of POST /api/estimate and
+// POST /api/interpolate.
+const maxEstimatePoints = 1000
+
+// Confidence in an interpolated value falls off with the distance to the
+// nearest measurement, to 1/e at this range: in meters on floors with a
+// scale, in pixels on others.
+const (
+	confidenceRangeMeters = 5
+	confidenceRangePixels = 50
+)
+
+// Estimate is the interpolated signal at one point of a floor. Variance and
+// StdDev are only set by methods that provide them, such as kriging.
+type Estimate struct {
+	Lat             float64  `json:"lat"`
+	Lng             float64  `json:"lng"`
+	Dbm             float64  `json:"dbm"`
+	Variance        *float64 `json:"variance,omitempty"`
+	StdDev          *float64 `json:"stdDev,omitempty"`
+	NearestDistance float64  `json:"nearestDistance"`
+	NearestMeters   *float64 `json:"nearestMeters,omitempty"`
+}
+
+// surface is the interpolation of one metric over a floor.
+type surface struct {
+	floor        Floor
+	points       []heatmapPoint
+	interpolator Interpolator
+}
+
+// fitSurface interpolates the measurements of a floor that params select.
+func fitSurface(floorID int, params HeatmapParams) (surface, error) {
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		return surface{}, errFloorNotFound
+	}
+
+	points := heatmapPoints(params.selectMeasurements(filtered), 0, params)
+	interpolator, err := newInterpolator(params.Method, points, params)
+	if err != nil {
+		return surface{}, err
+	}
+	return surface{floor: floor, points: points, interpolator: interpolator}, nil
+}
+
+// estimateAt interpolates at floor coordinates lat/lng. Dbm holds the value
+// of whichever metric the points carry.
+func estimateAt(interpolator Interpolator, points []heatmapPoint, metersPerPixel, lat, lng float64) Estimate {
+	// Points use y = -lat: interpolation only depends on distances, so the
+	// map height that heatmaps flip around is not needed.
+	x, y := lng, -lat
+	value, variance := interpolator.Estimate(x, y)
+
+	estimate := Estimate{Lat: lat, Lng: lng, Dbm: math.Round(value*10) / 10, NearestDistance: math.Inf(1)}
+	if !math.IsNaN(variance) {
+		variance = math.Round(variance*100) / 100
+		stdDev := math.Round(math.Sqrt(variance)*100) / 100
+		estimate.Variance, estimate.StdDev = &variance, &stdDev
+	}
+
+	for _, p := range points {
+		estimate.NearestDistance = math.Min(estimate.NearestDistance, math.Hypot(p.X-x, p.Y-y))
+	}
+	estimate.NearestDistance = math.Round(estimate.NearestDistance*10) / 10
+	if metersPerPixel > 0 {
+		meters := math.Round(estimate.NearestDistance*metersPerPixel*10) / 10
+		estimate.NearestMeters = &meters
+	}
+
+	return estimate
+}
+
+// estimateHandler returns the interpolated signal at arbitrary floor
+// coordinates without rendering a heatmap. GET takes a single lat/lng, POST
+// a batch as {"points": [{"lat": .., "lng": ..}]}. Heatmap query parameters
+// select the measurements and the interpolation method.
+func estimateHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var targets []Vertex
+	switch r.Method {
+	case "GET":
+		lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+		lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+		if latErr != nil || lngErr != nil {
+			http.Error(w, "lat and lng are required", http.StatusBadRequest)
+			return
+		}
+		targets = []Vertex{{Lat: lat, Lng: lng}}
+	case "POST":
+		var req struct {
+			Points []Vertex `json:"points"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Points) == 0 || len(req.Points) > maxEstimatePoints {
+			http.Error(w, fmt.Sprintf("between 1 and %d points are required", maxEstimatePoints), http.StatusBadRequest)
+			return
+		}
+		targets = req.Points
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	surface, err := fitSurface(floorID, params)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errFloorNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	interpolator, points := surface.interpolator, surface.points
+	metersPerPixel := surface.floor.metersPerPixel()
+
+	estimates := make([]Estimate, 0, len(targets))
+	for _, target := range targets {
+		estimates = append(estimates, estimateAt(interpolator, points, metersPerPixel, target.Lat, target.Lng))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"floor":    floorID,
+			"method":   params.Method,
+			"points":   len(points),
+			"estimate": estimates[0],
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"floor":     floorID,
+		"method":    params.Method,
+		"points":    len(points),
+		"estimates": estimates,
+	})
+}
+
+// InterpolatedValue is the value of any metric at one point of a floor.
+// Confidence runs from 1 at a measurement towards 0 far from any.
+type InterpolatedValue struct {
+	Lat             float64  `json:"lat"`
+	Lng             float64  `json:"lng"`
+	Value           float64  `json:"value"`
+	StdDev          *float64 `json:"stdDev,omitempty"`
+	Confidence      float64  `json:"confidence"`
+	NearestDistance float64  `json:"nearestDistance"`
+	NearestMeters   *float64 `json:"nearestMeters,omitempty"`
+}
+
+func interpolatedValue(estimate Estimate) InterpolatedValue {
+	confidence := math.Exp(-estimate.NearestDistance / confidenceRangePixels)
+	if estimate.NearestMeters != nil {
+		confidence = math.Exp(-*estimate.NearestMeters / confidenceRangeMeters)
+	}
+	return InterpolatedValue{
+		Lat:             estimate.Lat,
+		Lng:             estimate.Lng,
+		Value:           estimate.Dbm,
+		StdDev:          estimate.StdDev,
+		Confidence:      math.Round(confidence*100) / 100,
+		NearestDistance: estimate.NearestDistance,
+		NearestMeters:   estimate.NearestMeters,
+	}
+}
+
+// interpolateHandler returns the fitted surface of any metric at a batch of
+// floor coordinates, posted as {"points": [{"lat": .., "lng": ..}]}, so
+// external tools can query it instead of reading rendered heatmaps. The
+// floor and the heatmap query parameters are given as for /api/estimate.
+func interpolateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Points []Vertex `json:"points"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Points) == 0 || len(req.Points) > maxEstimatePoints {
+		http.Error(w, fmt.Sprintf("between 1 and %d points are required", maxEstimatePoints), http.StatusBadRequest)
+		return
+	}
+
+	surface, err := fitSurface(floorID, params)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errFloorNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	metersPerPixel := surface.floor.metersPerPixel()
+
+	values := make([]InterpolatedValue, 0, len(req.Points))
+	for _, target := range req.Points {
+		estimate := estimateAt(surface.interpolator, surface.points, metersPerPixel, target.Lat, target.Lng)
+		values = append(values, interpolatedValue(estimate))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"floor":  floorID,
+		"metric": params.Metric.Name,
+		"unit":   params.Metric.Unit,
+		"method": params.Method,
+		"points": len(surface.points),
+		"values": values,
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// version is reported in export metadata; release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// ExportMetadata describes how an export was produced. It is written as a
+// comment block at the top of CSV files and into manifest.json.
+type ExportMetadata struct {
+	ExportedAt    time.Time         `json:"exportedAt"`
+	Filters       map[string]string `json:"filters"`
+	ServerVersion string            `json:"serverVersion"`
+	DataRevision  string            `json:"dataRevision"`
+	SiteID        string            `json:"siteId,omitempty"`
+}
+
+// ExportManifest lists the files of a multi-file export.
+type ExportManifest struct {
+	ExportMetadata
+	Files []ExportFile `json:"files"`
+}
+
+type ExportFile struct {
+	Name   string `json:"name"`
+	Floor  int    `json:"floor"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+var csvHeader = []string{"id", "timestamp", "dbm", "lat", "lng", "floor", "location", "type", "accuracy", "ssid", "bssid", "freq", "channel", "tx_bitrate", "site", "latency_ms", "throughput_mbps", "upload_mbps", "loss_pct", "height_m", "jitter_ms", "noise_dbm", "snr_db", "busy_pct", "attributes", "source", "class"}
+
+// exportFilename names an export after its floor and the export date, e.g.
+// wifi_floor2_2024-06-01.csv. floor 0 stands for all floors.
+func exportFilename(floor int, date time.Time, ext string) string {
+	scope := "all"
+	if floor > 0 {
+		scope = fmt.Sprintf("floor%d", floor)
+	}
+	return fmt.Sprintf("wifi_%s_%s.%s", scope, date.Format("2006-01-02"), ext)
+}
+
+func writeMeasurementsCSV(w io.Writer, ms []Measurement, meta *ExportMetadata, style timeStyle) error {
+	if meta != nil {
+		filters, _ := json.Marshal(meta.Filters)
+		fmt.Fprintf(w, "# export_time: %s\n", style.format(meta.ExportedAt, time.RFC3339))
+		fmt.Fprintf(w, "# filters: %s\n", filters)
+		fmt.Fprintf(w, "# server_version: %s\n", meta.ServerVersion)
+		fmt.Fprintf(w, "# data_revision: %s\n", meta.DataRevision)
+		if meta.SiteID != "" {
+			fmt.Fprintf(w, "# site_id: %s\n", meta.SiteID)
+		}
+	}
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(csvHeader)
+
+	for _, m := range ms {
+		csvWriter.Write([]string{
+			m.ID,
+			style.format(m.Timestamp, time.RFC3339),
+			strconv.Itoa(m.Dbm),
+			strconv.FormatFloat(m.Lat, 'f', 6, 64),
+			strconv.FormatFloat(m.Lng, 'f', 6, 64),
+			strconv.Itoa(m.Floor),
+			csvText(m.Location),
+			csvText(m.Type),
+			strconv.FormatFloat(m.Accuracy, 'f', -1, 64),
+			csvText(m.SSID),
+			m.BSSID,
+			strconv.Itoa(m.Freq),
+			strconv.Itoa(m.Channel),
+			strconv.FormatFloat(m.TxBitrate, 'f', -1, 64),
+			measurementSite(m.ID),
+			formatOptional(m.LatencyMs),
+			formatOptional(m.ThroughputMbps),
+			formatOptional(m.UploadMbps),
+			formatOptional(m.LossPercent),
+			formatOptional(m.Height),
+			formatOptional(m.JitterMs),
+			formatOptional(m.NoiseDbm),
+			formatOptional(m.SNRDb),
+			formatOptional(m.BusyPercent),
+			formatAttributes(m.Attributes),
+			m.source(),
+			m.class(),
+		})
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// formatAttributes writes the attributes as a JSON object, empty when
+// there are none.
+func formatAttributes(attributes map[string]string) string {
+	if len(attributes) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(attributes)
+	return csvText(string(data))
+}
+
+// formatOptional writes an optional metric, empty when it was not measured.
+func formatOptional(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// exportHandler exports measurements as CSV. With ?split=floor it returns a
+// zip archive with one CSV per floor and a manifest.json; ?format=xlsx
+// returns a workbook with a sheet per floor, see writeMeasurementsXLSX.
+// Only approved measurements are exported unless ?review lists other
+// review states. Every source is exported unless ?source picks one; the
+// source column tells Wi-Fi dBm from cellular RSRP and BLE RSSI. The
+// metadata comment block can be left out with ?metadata=false, also from
+// the CSVs of a split export, whose manifest keeps it. ?tz and ?timeFormat write the CSV timestamps as local
+// times for the recipients, see parseTimeStyle; such files cannot be
+// imported again.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	floor, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		floor = 0
+	}
+
+	session := query.Get("session")
+	split := query.Get("split")
+	if split != "" && split != "floor" {
+		http.Error(w, "split must be floor", http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "geojson" && format != "kml" && format != "kmz" && format != "xlsx" {
+		http.Error(w, "format must be csv, geojson, kml, kmz or xlsx", http.StatusBadRequest)
+		return
+	}
+	if format != "csv" && split != "" {
+		http.Error(w, "split is only supported for csv", http.StatusBadRequest)
+		return
+	}
+	coordinates := query.Get("coordinates")
+	if coordinates != "" && coordinates != geoJSONCoordinatesGeo && coordinates != geoJSONCoordinatesFloor {
+		http.Error(w, "coordinates must be geo or floor", http.StatusBadRequest)
+		return
+	}
+	buildingFloorIDs, err := buildingFloors(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	height, err := parseHeightRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signal, err := parseSignalFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	style, err := parseTimeStyle(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review, err := parseReviewStates(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if review == nil {
+		review = map[string]bool{reviewApproved: true}
+	}
+	source := sourceAll
+	if query.Get("source") != "" {
+		if source, err = parseSource(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	var filtered []Measurement
+	for _, m := range measurements {
+		if (floor <= 0 || m.Floor == floor) && inSession(m, session) && (buildingFloorIDs == nil || buildingFloorIDs[m.Floor]) && height.match(m) && signal.match(m) && review[m.reviewState()] && inSource(m, source) {
+			filtered = append(filtered, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	runHooks(hookExport, filtered)
+
+	meta := &ExportMetadata{
+		ExportedAt:    time.Now(),
+		Filters:       make(map[string]string),
+		ServerVersion: version,
+		DataRevision:  revision,
+		SiteID:        *siteID,
+	}
+	if floor > 0 {
+		meta.Filters["floor"] = strconv.Itoa(floor)
+	}
+	if session != "" {
+		meta.Filters["session"] = session
+	}
+	if building := query.Get("building"); building != "" {
+		meta.Filters["building"] = building
+	}
+	height.filters(meta.Filters)
+	signal.filters(meta.Filters)
+	style.filters(meta.Filters)
+	if split != "" {
+		meta.Filters["split"] = split
+	}
+	if value := query.Get("review"); value != "" {
+		meta.Filters["review"] = value
+	}
+	if source != sourceAll {
+		meta.Filters["source"] = source
+	}
+
+	withMetadata := query.Get("metadata") != "false"
+	if split == "floor" {
+		writeSplitExport(w, filtered, meta, withMetadata, style)
+		return
+	}
+
+	if !withMetadata {
+		meta = nil
+	}
+
+	if format == "kml" || format == "kmz" {
+		// Google Earth needs geographic coordinates.
+		transforms, err := geoTransforms(filtered)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v, calibrate it to export %s", err, format), http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		if format == "kmz" {
+			err = writeKMZ(&buf, filtered, transforms)
+		} else {
+			var doc kmlDocument
+			if doc, err = buildKML(filtered, transforms, nil); err == nil {
+				err = writeKML(&buf, doc)
+			}
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to write export: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		contentType := "application/vnd.google-earth.kml+xml"
+		if format == "kmz" {
+			contentType = "application/vnd.google-earth.kmz"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename="+exportFilename(floor, time.Now(), format))
+		w.Write(buf.Bytes())
+		return
+	}
+
+	if format == "xlsx" {
+		var buf bytes.Buffer
+		if err := writeMeasurementsXLSX(&buf, filtered, meta, style); err != nil {
+			http.Error(w, fmt.Sprintf("failed to write export: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", "attachment; filename="+exportFilename(floor, time.Now(), "xlsx"))
+		w.Write(buf.Bytes())
+		return
+	}
+
+	if format == "geojson" {
+		// Without an explicit choice, coordinates are geographic when
+		// every exported floor allows it.
+		if coordinates == "" {
+			coordinates = geoJSONCoordinatesFloor
+			if allFloorsCalibrated(filtered) {
+				coordinates = geoJSONCoordinatesGeo
+			}
+		}
+		var transforms map[int]func(lat, lng float64) (float64, float64)
+		if coordinates == geoJSONCoordinatesGeo {
+			if transforms, err = geoTransforms(filtered); err != nil {
+				http.Error(w, fmt.Sprintf("%v, export with coordinates=floor", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Header().Set("Content-Disposition", "attachment; filename="+exportFilename(floor, time.Now(), "geojson"))
+		writeMeasurementsGeoJSON(w, filtered, meta, transforms)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename="+exportFilename(floor, time.Now(), "csv"))
+	writeMeasurementsCSV(w, filtered, meta, style)
+}
+
+// writeSplitExport writes a zip archive with a CSV per floor, with the
+// metadata comment block if withMetadata, and a manifest.json.
+func writeSplitExport(w http.ResponseWriter, ms []Measurement, meta *ExportMetadata, withMetadata bool, style timeStyle) {
+	byFloor := make(map[int][]Measurement)
+	for _, m := range ms {
+		byFloor[m.Floor] = append(byFloor[m.Floor], m)
+	}
+	floorIDs := make([]int, 0, len(byFloor))
+	for id := range byFloor {
+		floorIDs = append(floorIDs, id)
+	}
+	sort.Ints(floorIDs)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	manifest := ExportManifest{ExportMetadata: *meta}
+	csvMeta := meta
+	if !withMetadata {
+		csvMeta = nil
+	}
+
+	for _, id := range floorIDs {
+		var data bytes.Buffer
+		if err := writeMeasurementsCSV(&data, byFloor[id], csvMeta, style); err != nil {
+			http.Error(w, "failed to write export", http.StatusInternalServerError)
+			return
+		}
+
+		name := exportFilename(id, meta.ExportedAt, "csv")
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: meta.ExportedAt})
+		if err == nil {
+			_, err = file.Write(data.Bytes())
+		}
+		if err != nil {
+			http.Error(w, "failed to write export", http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(data.Bytes())
+		manifest.Files = append(manifest.Files, ExportFile{
+			Name:   name,
+			Floor:  id,
+			Rows:   len(byFloor[id]),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+
+	manifestData, _ := json.MarshalIndent(manifest, "", "  ")
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: meta.ExportedAt})
+	if err == nil {
+		_, err = file.Write(manifestData)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		http.Error(w, "failed to write export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+exportFilename(0, meta.ExportedAt, "zip"))
+	w.Write(buf.Bytes())
+}
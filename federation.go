@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	federationFile = "federation.json"
+	// maxSnapshotSize bounds a pushed or pulled snapshot, map images
+	// included.
+	maxSnapshotSize = 200 << 20
+)
+
+var (
+	federationToken    = flag.String("federation-token", envOrDefault("HEATGEN_FEDERATION_TOKEN", ""), "shared secret of the federation, required to accept pushes and sent with pulls and pushes (env HEATGEN_FEDERATION_TOKEN)")
+	federationPush     = flag.String("federation-push", envOrDefault("HEATGEN_FEDERATION_PUSH", ""), "URL of a central server this site pushes its floors and measurements to; requires -site-id (env HEATGEN_FEDERATION_PUSH)")
+	federationInterval = flag.Duration("federation-interval", 5*time.Minute, "how often registered sites are pulled and this site is pushed, 0 to only sync on request")
+	allowPrivateSites  = flag.Bool("allow-private-federation", false, "allow federated sites to be pulled from loopback and private network addresses")
+
+	federatedSites []*FederatedSite
+	federationLock sync.Mutex
+	// federationSyncLock serializes applying snapshots, which allocate
+	// floor IDs and replace measurements.
+	federationSyncLock sync.Mutex
+
+	// federationClient pushes to -federation-push, which the operator set.
+	federationClient = &http.Client{Timeout: 2 * time.Minute}
+	// siteClient pulls the sites registered through the API. It connects
+	// directly, so the address the dialer checks is that of the site.
+	siteClient = &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 30 * time.Second,
+				Control: publicOnly(allowPrivateSites, "-allow-private-federation"),
+			}).DialContext,
+		},
+	}
+)
+
+// FederatedSite is a site server whose floors and measurements this
+// central server mirrors. Each site floor becomes a local floor named after
+// the site; its measurements keep their IDs, which carry the site ID.
+type FederatedSite struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// URL is pulled every -federation-interval. Sites without one push.
+	URL string `json:"url,omitempty"`
+	// Trusted sites are sent -federation-token with pulls. Only an admin
+	// can trust a site, since the token also allows pushing to this
+	// server and its peers.
+	Trusted bool `json:"trusted,omitempty"`
+	// Floors maps the site's floor IDs to the local floors mirroring them.
+	Floors map[int]int `json:"floors"`
+	// Maps holds the site's map path of every floor whose image was copied,
+	// so unchanged images are not transferred again.
+	Maps         map[int]string `json:"maps"`
+	Revision     string         `json:"revision,omitempty"`
+	Measurements int            `json:"measurements"`
+	LastSync     *time.Time     `json:"lastSync,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// SiteSnapshot is the data a site hands to the central server. Maps holds
+// floor map images by site floor ID and is only filled on request.
+type SiteSnapshot struct {
+	SiteID       string         `json:"siteId"`
+	Revision     string         `json:"revision"`
+	Floors       []Floor        `json:"floors"`
+	Measurements []Measurement  `json:"measurements"`
+	Maps         map[int][]byte `json:"maps,omitempty"`
+}
+
+// SyncResult reports what applying a snapshot changed. MissingMaps lists
+// site floors whose map image is needed.
+type SyncResult struct {
+	Floors      int   `json:"floors"`
+	Added       int   `json:"added"`
+	Updated     int   `json:"updated"`
+	Deleted     int   `json:"deleted"`
+	Skipped     int   `json:"skipped"`
+	MissingMaps []int `json:"missingMaps,omitempty"`
+	Unchanged   bool  `json:"unchanged,omitempty"`
+}
+
+func loadFederation() error {
+	federationLock.Lock()
+	defer federationLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(federationFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &federatedSites)
+}
+
+func saveFederation() error {
+	federationLock.Lock()
+	defer federationLock.Unlock()
+
+	data, err := json.MarshalIndent(federatedSites, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(federationFile), data, 0644)
+}
+
+func findFederatedSite(id string) *FederatedSite {
+	federationLock.Lock()
+	defer federationLock.Unlock()
+
+	for _, site := range federatedSites {
+		if site.ID == id {
+			return site
+		}
+	}
+	return nil
+}
+
+// validFederationToken checks the bearer token of a federation request.
+// Without -federation-token every request is accepted, like the rest of
+// the API.
+func validFederationToken(r *http.Request) bool {
+	if *federationToken == "" {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(*federationToken)) == 1
+}
+
+func setFederationToken(req *http.Request) {
+	if *federationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*federationToken)
+	}
+}
+
+// buildSnapshot collects this site's own floors and measurements. Floors
+// mirrored from other sites are left out, so federation is one level deep
+// and never loops.
+func buildSnapshot(maps []int) SiteSnapshot {
+	snapshot := SiteSnapshot{SiteID: *siteID, Floors: []Floor{}, Measurements: []Measurement{}}
+
+	mutex.Lock()
+	own := make(map[int]bool)
+	for _, floor := range floors {
+		if floor.Site == "" {
+			snapshot.Floors = append(snapshot.Floors, floor)
+			own[floor.ID] = true
+		}
+	}
+	for _, m := range measurements {
+		if own[m.Floor] {
+			snapshot.Measurements = append(snapshot.Measurements, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	sort.Slice(snapshot.Floors, func(i, j int) bool {
+		return snapshot.Floors[i].ID < snapshot.Floors[j].ID
+	})
+
+	// The data revision only covers measurements, so the floors are hashed
+	// in to notice renames and new maps.
+	h := fnv.New64a()
+	h.Write([]byte(revision))
+	floorData, _ := json.Marshal(snapshot.Floors)
+	h.Write(floorData)
+	snapshot.Revision = fmt.Sprintf("%016x", h.Sum64())
+
+	for _, id := range maps {
+		for _, floor := range snapshot.Floors {
+			if floor.ID != id || floor.MapPath == "" {
+				continue
+			}
+			data, err := os.ReadFile(uploadFile(floor.MapPath))
+			if err != nil {
+				log.Printf("failed to read the map of floor %d: %v", id, err)
+				continue
+			}
+			if snapshot.Maps == nil {
+				snapshot.Maps = make(map[int][]byte)
+			}
+			snapshot.Maps[id] = data
+		}
+	}
+
+	return snapshot
+}
+
+// mirrorFloor returns the local copy of a site floor. The map path is
+// kept from the current copy, the caller replaces it when the image
+// changed.
+func mirrorFloor(site *FederatedSite, remote Floor, localID int) Floor {
+	local := remote
+	local.ID = localID
+	local.Name = site.Name + " / " + remote.Name
+	local.Site = site.ID
+	local.MapPath = ""
+	// Building IDs are local to each server.
+	local.Building = ""
+
+	mutex.Lock()
+	if current, exists := floors[localID]; exists {
+		local.MapPath = current.MapPath
+	}
+	mutex.Unlock()
+
+	return local
+}
+
+// allocateFloor reserves a new local floor ID for a site floor.
+func allocateFloor(site *FederatedSite, remote Floor) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	id := 1
+	for existing := range floors {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	floors[id] = Floor{ID: id, Name: site.Name + " / " + remote.Name, Site: site.ID}
+	return id
+}
+
+// saveMirroredMap stores the map image of a site floor in uploads and
+// returns its path.
+func saveMirroredMap(site *FederatedSite, remote Floor, data []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(remote.MapPath))
+	if _, ok := mapContentTypes[ext]; !ok {
+		return "", fmt.Errorf("unsupported map type %q", ext)
+	}
+
+	name := fmt.Sprintf("site_%s_floor_%d%s", site.ID, remote.ID, ext)
+	if err := os.WriteFile(filepath.Join(projectUploads(), name), data, 0644); err != nil {
+		return "", err
+	}
+	return uploadURL(name), nil
+}
+
+// applySnapshot mirrors a site's snapshot: its floors are created or
+// updated, and the measurements on them are replaced by the snapshot's, so
+// edits and deletions on the site carry over. Floors the site removed are
+// kept but emptied.
+func applySnapshot(site *FederatedSite, snapshot SiteSnapshot) (SyncResult, error) {
+	federationSyncLock.Lock()
+	defer federationSyncLock.Unlock()
+
+	var result SyncResult
+	actor := "site:" + site.ID
+
+	federationLock.Lock()
+	floorMap := make(map[int]int, len(site.Floors))
+	for remote, local := range site.Floors {
+		floorMap[remote] = local
+	}
+	mapPaths := make(map[int]string, len(site.Maps))
+	for remote, path := range site.Maps {
+		mapPaths[remote] = path
+	}
+	federationLock.Unlock()
+
+	for _, remote := range snapshot.Floors {
+		localID, mirrored := floorMap[remote.ID]
+		if !mirrored {
+			localID = allocateFloor(site, remote)
+			floorMap[remote.ID] = localID
+		}
+
+		local := mirrorFloor(site, remote, localID)
+		switch {
+		case remote.MapPath == "":
+			local.MapPath = ""
+			delete(mapPaths, remote.ID)
+		case mapPaths[remote.ID] == remote.MapPath:
+		case snapshot.Maps[remote.ID] != nil:
+			path, err := saveMirroredMap(site, remote, snapshot.Maps[remote.ID])
+			if err != nil {
+				log.Printf("failed to save the map of floor %d of site %s: %v", remote.ID, site.ID, err)
+				break
+			}
+			local.MapPath = path
+			mapPaths[remote.ID] = remote.MapPath
+		default:
+			result.MissingMaps = append(result.MissingMaps, remote.ID)
+		}
+
+		mutex.Lock()
+		changed := !reflect.DeepEqual(floors[localID], local)
+		floors[localID] = local
+		mutex.Unlock()
+
+		if changed {
+			if err := store.SaveFloor(local); err != nil {
+				return result, fmt.Errorf("failed to save floor data: %v", err)
+			}
+			if mirrored {
+				publishFloor(eventFloorUpdated, local)
+				auditFloor(actor, eventFloorUpdated, "synced", localID)
+			} else {
+				publishFloor(eventFloorCreated, local)
+				auditFloor(actor, eventFloorCreated, "synced", localID)
+			}
+		}
+		result.Floors++
+	}
+
+	siteFloors := make(map[int]bool)
+	for _, local := range floorMap {
+		siteFloors[local] = true
+	}
+
+	// Records from before the site had a site ID are namespaced here, the
+	// same way every time, so later edits still match them. Records of
+	// other sites, e.g. imported ones, are mirrored from their own site.
+	incoming := make(map[string]Measurement, len(snapshot.Measurements))
+	var order []string
+	for _, m := range snapshot.Measurements {
+		local, exists := floorMap[m.Floor]
+		if measurementSite(m.ID) == "" {
+			m.ID = site.ID + siteSeparator + m.ID
+		}
+		if !exists || measurementSite(m.ID) != site.ID {
+			result.Skipped++
+			continue
+		}
+		m.Floor = local
+		incoming[m.ID] = m
+		order = append(order, m.ID)
+	}
+
+	var added, updated, removed []Measurement
+	var deleted []string
+	mutex.Lock()
+	kept := measurements[:0]
+	for _, m := range measurements {
+		if record, exists := incoming[m.ID]; exists {
+			if !reflect.DeepEqual(m, record) {
+				m = record
+				updated = append(updated, record)
+			}
+			delete(incoming, m.ID)
+		} else if siteFloors[m.Floor] {
+			deleted = append(deleted, m.ID)
+			removed = append(removed, m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	measurements = kept
+	for _, id := range order {
+		if record, exists := incoming[id]; exists {
+			measurements = append(measurements, record)
+			added = append(added, record)
+			delete(incoming, id)
+		}
+	}
+	if len(added)+len(updated)+len(deleted) > 0 {
+		updateRevision()
+	}
+	revision := dataRevision
+	count := 0
+	for _, m := range measurements {
+		if siteFloors[m.Floor] {
+			count++
+		}
+	}
+	mutex.Unlock()
+
+	for _, record := range append(added, updated...) {
+		if err := store.SaveMeasurement(record); err != nil {
+			return result, fmt.Errorf("failed to save measurement: %v", err)
+		}
+	}
+	for _, id := range deleted {
+		if err := store.DeleteMeasurement(id); err != nil {
+			return result, fmt.Errorf("failed to delete measurement: %v", err)
+		}
+	}
+
+	publishAdded(added, revision)
+	mirrorToInflux(added)
+	if len(updated) > 0 {
+		publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: updated}, 0)
+	}
+	publishDeleted(deleted, revision)
+	auditMeasurements(actor, eventMeasurementsAdded, "synced", added)
+	auditMeasurements(actor, eventMeasurementsUpdated, "synced", updated)
+	auditMeasurements(actor, eventMeasurementsDeleted, "synced", removed)
+
+	result.Added, result.Updated, result.Deleted = len(added), len(updated), len(deleted)
+
+	now := time.Now()
+	federationLock.Lock()
+	site.Floors, site.Maps = floorMap, mapPaths
+	site.Measurements = count
+	site.LastSync = &now
+	site.Error = ""
+	// A snapshot with missing maps is fetched again on the next sync.
+	if len(result.MissingMaps) == 0 {
+		site.Revision = snapshot.Revision
+	}
+	federationLock.Unlock()
+
+	if err := saveFederation(); err != nil {
+		log.Printf("failed to save federation sites: %v", err)
+	}
+
+	return result, nil
+}
+
+// fetchSnapshot requests the snapshot of a site, with the images of the
+// given floors. It returns nil when the site has not changed since
+// revision.
+func fetchSnapshot(site *FederatedSite, revision string, maps []int) (*SiteSnapshot, error) {
+	federationLock.Lock()
+	target, trusted := strings.TrimSuffix(site.URL, "/")+"/api/federation/snapshot", site.Trusted
+	federationLock.Unlock()
+	if len(maps) > 0 {
+		ids := make([]string, len(maps))
+		for i, id := range maps {
+			ids[i] = strconv.Itoa(id)
+		}
+		target += "?maps=" + strings.Join(ids, ",")
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if trusted {
+		setFederationToken(req)
+	}
+	if revision != "" {
+		req.Header.Set("If-None-Match", `"`+revision+`"`)
+	}
+
+	resp, err := siteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("site answered %s", resp.Status)
+	}
+
+	var snapshot SiteSnapshot
+	body := &io.LimitedReader{R: resp.Body, N: maxSnapshotSize + 1}
+	if err := json.NewDecoder(body).Decode(&snapshot); err != nil {
+		if body.N == 0 {
+			return nil, fmt.Errorf("snapshot is larger than %d MB", maxSnapshotSize>>20)
+		}
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	if snapshot.SiteID != site.ID {
+		return nil, fmt.Errorf("site reports ID %q, expected %q", snapshot.SiteID, site.ID)
+	}
+	return &snapshot, nil
+}
+
+// pullSite fetches and applies the snapshot of a site with a URL, then the
+// map images it lacks.
+func pullSite(site *FederatedSite) (SyncResult, error) {
+	federationLock.Lock()
+	revision := site.Revision
+	federationLock.Unlock()
+
+	result, err := func() (SyncResult, error) {
+		snapshot, err := fetchSnapshot(site, revision, nil)
+		if err != nil {
+			return SyncResult{}, err
+		}
+		if snapshot == nil {
+			return SyncResult{Unchanged: true}, nil
+		}
+		result, err := applySnapshot(site, *snapshot)
+		if err != nil || len(result.MissingMaps) == 0 {
+			return result, err
+		}
+
+		withMaps, err := fetchSnapshot(site, "", result.MissingMaps)
+		if err != nil {
+			return result, err
+		}
+		return applySnapshot(site, *withMaps)
+	}()
+
+	now := time.Now()
+	federationLock.Lock()
+	site.Error = ""
+	if err != nil {
+		site.Error = err.Error()
+	}
+	site.LastSync = &now
+	federationLock.Unlock()
+
+	if err := saveFederation(); err != nil {
+		log.Printf("failed to save federation sites: %v", err)
+	}
+
+	return result, err
+}
+
+func pullSites() {
+	federationLock.Lock()
+	var pulled []*FederatedSite
+	for _, site := range federatedSites {
+		if site.URL != "" {
+			pulled = append(pulled, site)
+		}
+	}
+	federationLock.Unlock()
+
+	for _, site := range pulled {
+		if _, err := pullSite(site); err != nil {
+			log.Printf("failed to pull site %s: %v", site.ID, err)
+		}
+	}
+}
+
+func postSnapshot(snapshot SiteSnapshot) (SyncResult, error) {
+	var result SyncResult
+
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return result, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*federationPush, "/")+"/api/federation/push", bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setFederationToken(req)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("central server answered %s", resp.Status)
+	}
+
+	return result, json.NewDecoder(resp.Body).Decode(&result)
+}
+
+// pushSite sends this site's snapshot to the central server unless it is
+// unchanged since the last push, followed by the map images the central
+// server asks for. It returns the revision pushed.
+func pushSite(lastRevision string) (string, error) {
+	snapshot := buildSnapshot(nil)
+	if snapshot.Revision == lastRevision {
+		return lastRevision, nil
+	}
+
+	result, err := postSnapshot(snapshot)
+	if err != nil {
+		return lastRevision, err
+	}
+	if len(result.MissingMaps) > 0 {
+		if _, err := postSnapshot(buildSnapshot(result.MissingMaps)); err != nil {
+			return lastRevision, err
+		}
+	}
+
+	return snapshot.Revision, nil
+}
+
+// startFederation runs the periodic pulls of registered sites and, with
+// -federation-push, the pushes of this site.
+func startFederation() {
+	if *federationPush != "" {
+		if *siteID == "" {
+			log.Fatal("-federation-push requires -site-id")
+		}
+		go func() {
+			var revision string
+			for {
+				var err error
+				if revision, err = pushSite(revision); err != nil {
+					log.Printf("failed to push to the central server: %v", err)
+				}
+				if *federationInterval <= 0 {
+					return
+				}
+				time.Sleep(*federationInterval)
+			}
+		}()
+	}
+
+	if *federationInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*federationInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				pullSites()
+			}
+		}()
+	}
+}
+
+// federationSnapshotHandler serves this site's snapshot to the central
+// server. ?maps lists the floors whose images to include.
+func federationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !validFederationToken(r) {
+		http.Error(w, "invalid federation token", http.StatusUnauthorized)
+		return
+	}
+	if *siteID == "" {
+		http.Error(w, "this server has no site ID, set -site-id", http.StatusConflict)
+		return
+	}
+
+	var maps []int
+	if value := r.URL.Query().Get("maps"); value != "" {
+		for _, part := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(part)
+			if err != nil {
+				http.Error(w, "invalid maps", http.StatusBadRequest)
+				return
+			}
+			maps = append(maps, id)
+		}
+	}
+
+	snapshot := buildSnapshot(maps)
+	etag := `"` + snapshot.Revision + `"`
+	w.Header().Set("ETag", etag)
+	if len(maps) == 0 && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// federationPushHandler applies a snapshot pushed by a site. Unknown sites
+// are registered on their first push, so pushes require a shared token.
+func federationPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if *federationToken == "" {
+		http.Error(w, "federation pushes are disabled, set -federation-token", http.StatusForbidden)
+		return
+	}
+	if !validFederationToken(r) {
+		http.Error(w, "invalid federation token", http.StatusUnauthorized)
+		return
+	}
+
+	var snapshot SiteSnapshot
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSnapshotSize)).Decode(&snapshot); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !siteIDRe.MatchString(snapshot.SiteID) {
+		http.Error(w, "invalid site ID", http.StatusBadRequest)
+		return
+	}
+	if snapshot.SiteID == *siteID {
+		http.Error(w, "a site cannot push to itself", http.StatusConflict)
+		return
+	}
+
+	site := findFederatedSite(snapshot.SiteID)
+	if site == nil {
+		federationLock.Lock()
+		site = &FederatedSite{ID: snapshot.SiteID, Name: snapshot.SiteID, Floors: map[int]int{}, Maps: map[int]string{}}
+		federatedSites = append(federatedSites, site)
+		federationLock.Unlock()
+		log.Printf("registered federated site %s on its first push", site.ID)
+	}
+
+	result, err := applySnapshot(site, snapshot)
+	if err != nil {
+		federationLock.Lock()
+		site.Error = err.Error()
+		federationLock.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// federationSitesHandler lists the federated sites, or registers a site to
+// be pulled, which takes the admin token.
+func federationSitesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		federationLock.Lock()
+		data, err := json.Marshal(federatedSites)
+		federationLock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if string(data) == "null" {
+			data = []byte("[]")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+
+	case "POST":
+		if !requireAdmin(w, r) {
+			return
+		}
+		var req struct {
+			ID      string `json:"id"`
+			Name    string `json:"name"`
+			URL     string `json:"url"`
+			Trusted bool   `json:"trusted"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !siteIDRe.MatchString(req.ID) {
+			http.Error(w, "id must be 1-32 letters, digits or dashes", http.StatusBadRequest)
+			return
+		}
+		if req.ID == *siteID {
+			http.Error(w, "id is the ID of this server", http.StatusBadRequest)
+			return
+		}
+		if req.URL != "" {
+			parsed, err := url.Parse(req.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+				return
+			}
+			if !*allowPrivateSites {
+				addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), parsed.Hostname())
+				if err == nil && slices.ContainsFunc(addrs, func(addr net.IPAddr) bool { return privateAddress(addr.IP) }) {
+					http.Error(w, "url points to a private address (see -allow-private-federation)", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if req.Trusted && !trustableSites(w) {
+			return
+		}
+		if req.Name == "" {
+			req.Name = req.ID
+		}
+
+		site := &FederatedSite{ID: req.ID, Name: req.Name, URL: req.URL, Trusted: req.Trusted, Floors: map[int]int{}, Maps: map[int]string{}}
+		federationLock.Lock()
+		for _, existing := range federatedSites {
+			if existing.ID == req.ID {
+				federationLock.Unlock()
+				http.Error(w, "site already registered", http.StatusConflict)
+				return
+			}
+		}
+		federatedSites = append(federatedSites, site)
+		data, _ := json.Marshal(site)
+		federationLock.Unlock()
+
+		if err := saveFederation(); err != nil {
+			http.Error(w, "failed to save federation sites", http.StatusInternalServerError)
+			return
+		}
+		if site.URL != "" {
+			go func() {
+				if _, err := pullSite(site); err != nil {
+					log.Printf("failed to pull site %s: %v", site.ID, err)
+				}
+			}()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trustableSites answers the request itself when sites cannot be trusted:
+// without -admin-token, anyone could trust a site and have the federation
+// token sent to it.
+func trustableSites(w http.ResponseWriter) bool {
+	if *adminToken == "" {
+		http.Error(w, "trusting a site requires -admin-token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// federationSiteHandler changes whether a site is trusted (PATCH), or
+// unregisters it together with its mirrored floors, maps and measurements
+// (DELETE). Both take the admin token.
+func federationSiteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PATCH" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if r.Method == "PATCH" {
+		var req struct {
+			Trusted bool `json:"trusted"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Trusted && !trustableSites(w) {
+			return
+		}
+		site := findFederatedSite(id)
+		if site == nil {
+			http.Error(w, "site not found", http.StatusNotFound)
+			return
+		}
+		federationLock.Lock()
+		site.Trusted = req.Trusted
+		data, _ := json.Marshal(site)
+		federationLock.Unlock()
+
+		if err := saveFederation(); err != nil {
+			http.Error(w, "failed to save federation sites", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	federationLock.Lock()
+	var site *FederatedSite
+	for i, existing := range federatedSites {
+		if existing.ID == id {
+			site = existing
+			federatedSites = append(federatedSites[:i], federatedSites[i+1:]...)
+			break
+		}
+	}
+	federationLock.Unlock()
+
+	if site == nil {
+		http.Error(w, "site not found", http.StatusNotFound)
+		return
+	}
+
+	federationSyncLock.Lock()
+	defer federationSyncLock.Unlock()
+
+	siteFloors := make(map[int]bool)
+	for _, local := range site.Floors {
+		siteFloors[local] = true
+	}
+	actor := auditActor(r)
+	deleted, err := deleteMeasurementsWhere(actor, "site "+id+" unregistered", func(m Measurement) bool {
+		return siteFloors[m.Floor]
+	})
+	if err != nil {
+		http.Error(w, "failed to delete measurements", http.StatusInternalServerError)
+		return
+	}
+
+	for local := range siteFloors {
+		mutex.Lock()
+		floor := floors[local]
+		delete(floors, local)
+		mutex.Unlock()
+
+		if err := store.DeleteFloor(local); err != nil {
+			http.Error(w, "failed to delete floor data", http.StatusInternalServerError)
+			return
+		}
+		publishFloor(eventFloorDeleted, floor)
+		auditFloor(actor, eventFloorDeleted, "site "+id+" unregistered", local)
+		if floor.MapPath != "" {
+			os.Remove(uploadFile(floor.MapPath))
+		}
+	}
+
+	if err := saveFederation(); err != nil {
+		http.Error(w, "failed to save federation sites", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"floors": len(siteFloors), "measurements": len(deleted)})
+}
+
+// federationSyncHandler pulls a site right away. It takes the admin
+// token.
+func federationSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	site := findFederatedSite(r.PathValue("id"))
+	if site == nil {
+		http.Error(w, "site not found", http.StatusNotFound)
+		return
+	}
+	if site.URL == "" {
+		http.Error(w, "site has no URL, it pushes its data", http.StatusConflict)
+		return
+	}
+
+	result, err := pullSite(site)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
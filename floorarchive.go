@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxFloorArchiveSize   = 200 << 20
+	maxFloorArchiveFloors = 200
+)
+
+var levelDigits = regexp.MustCompile(`\d+`)
+
+// archivedFloor is a floor plan read from an archive, before its floor is
+// created.
+type archivedFloor struct {
+	Name  string
+	Level int
+	Ext   string
+	Data  []byte
+}
+
+// parseFloorLevel reads the level from the first number in a file name:
+// "L03" and "Level 3" are level 3. The number is negative when it starts
+// the name or follows a space or underscore with a minus sign, as in "-1"
+// or "Level -1", or when it follows "B" or "basement", as in "B1".
+func parseFloorLevel(name string) (int, bool) {
+	loc := levelDigits.FindStringIndex(name)
+	if loc == nil {
+		return 0, false
+	}
+	level, err := strconv.Atoi(name[loc[0]:loc[1]])
+	if err != nil {
+		return 0, false
+	}
+
+	before := name[:loc[0]]
+	if rest, found := strings.CutSuffix(before, "-"); found && (rest == "" || strings.HasSuffix(rest, " ") || strings.HasSuffix(rest, "_")) {
+		return -level, true
+	}
+	prefix := strings.ToLower(strings.TrimRight(before, " _-"))
+	for _, basement := range []string{"basement", "b"} {
+		if rest, found := strings.CutSuffix(prefix, basement); found {
+			if rest == "" || !isLetter(rest[len(rest)-1]) {
+				return -level, true
+			}
+		}
+	}
+	return level, true
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// readFloorArchive reads the floor plans of a zip archive, one image per
+// floor named by its level, sorted from the lowest level up. Files other
+// than images, and the metadata macOS adds to archives, are ignored.
+func readFloorArchive(data []byte) ([]archivedFloor, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip archive: %v", err)
+	}
+
+	var plans []archivedFloor
+	levels := make(map[int]string)
+	for _, entry := range archive.File {
+		base := path.Base(entry.Name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(base))
+		if _, ok := mapContentTypes[ext]; !ok {
+			continue
+		}
+		if len(plans) == maxFloorArchiveFloors {
+			return nil, fmt.Errorf("the archive has more than %d floor plans", maxFloorArchiveFloors)
+		}
+
+		name, err := cleanText("name", strings.TrimSuffix(base, path.Ext(base)), maxNameLength, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		level, ok := parseFloorLevel(name)
+		if !ok {
+			return nil, fmt.Errorf("%s: the file name must contain the level, e.g. L03.png", entry.Name)
+		}
+		if other, exists := levels[level]; exists {
+			return nil, fmt.Errorf("%s and %s are both level %d", other, entry.Name, level)
+		}
+		levels[level] = entry.Name
+
+		file, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		image, err := io.ReadAll(io.LimitReader(file, maxMapSize+1))
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+		if len(image) > maxMapSize {
+			return nil, fmt.Errorf("%s: map is larger than %d MB", entry.Name, maxMapSize>>20)
+		}
+		contentType := detectMapType(image)
+		if contentType == "" {
+			return nil, fmt.Errorf("%s: unsupported map format, expected png, jpeg, gif or webp", entry.Name)
+		}
+		if err := validateMapImage(contentType, image); err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name, err)
+		}
+
+		plans = append(plans, archivedFloor{Name: name, Level: level, Ext: mapExtensions[contentType], Data: image})
+	}
+
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("the archive contains no floor plan images")
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Level < plans[j].Level })
+	return plans, nil
+}
+
+// floorArchiveHandler creates a floor for every plan in a zip archive,
+// uploaded as the request body or in the multipart field "archive", and
+// stores the plans as their maps. Floors are named after the files and
+// ordered by the level in their names; ?building adds them to a building.
+// Nothing is created unless every plan is valid.
+func floorArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	building := r.URL.Query().Get("building")
+	if building != "" {
+		if _, exists := getBuilding(building); !exists {
+			http.Error(w, "building not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFloorArchiveSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("archive")
+		if err != nil {
+			http.Error(w, "failed to get archive from form", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	plans, err := readFloorArchive(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	nextID := 1
+	for id := range floors {
+		nextID = max(nextID, id+1)
+	}
+	created := make([]Floor, len(plans))
+	for i, plan := range plans {
+		created[i] = Floor{ID: nextID + i, Name: plan.Name, Order: plan.Level, Building: building}
+		floors[created[i].ID] = created[i]
+	}
+	mutex.Unlock()
+
+	for i, plan := range plans {
+		floor, err := saveFloorMap(created[i].ID, plan.Ext, bytes.NewReader(plan.Data))
+		if err != nil {
+			removeFloors(created)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		created[i] = floor
+	}
+	actor := auditActor(r)
+	for _, floor := range created {
+		publishFloor(eventFloorCreated, floor)
+		auditFloor(actor, eventFloorCreated, "imported from a floor plan archive", floor.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// removeFloors takes back floors created by a failed bulk creation.
+func removeFloors(created []Floor) {
+	mutex.Lock()
+	for _, floor := range created {
+		delete(floors, floor.ID)
+	}
+	mutex.Unlock()
+	for _, floor := range created {
+		store.DeleteFloor(floor.ID)
+	}
+}
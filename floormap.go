@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	// maxMapPixels bounds floor maps, which are decoded whole for
+	// thumbnails and rendering, and shown whole by the frontend.
+	maxMapPixels = 64 << 20
+	// mapThumbSize is the longest side of floor map thumbnails in pixels.
+	mapThumbSize     = 400
+	pdfRenderTimeout = time.Minute
+)
+
+var (
+	pdftoppmPath = flag.String("pdftoppm", envOrDefault("HEATGEN_PDFTOPPM", "pdftoppm"), "pdftoppm of poppler-utils, used to render the first page of PDF floor plans (env HEATGEN_PDFTOPPM)")
+	pdfMapSize   = flag.Int("pdf-map-size", 4000, "longest side in pixels PDF floor plans are rendered at")
+	avifdecPath  = flag.String("avifdec", envOrDefault("HEATGEN_AVIFDEC", "avifdec"), "avifdec of libavif, used to convert AVIF floor maps to PNG (env HEATGEN_AVIFDEC)")
+)
+
+// errPDFUnsupported is returned for PDF floor plans when pdftoppm is not
+// available.
+var errPDFUnsupported = errors.New("PDF floor plans need pdftoppm from poppler-utils, see -pdftoppm")
+
+// errAVIFUnsupported is returned for AVIF floor maps when avifdec is not
+// available.
+var errAVIFUnsupported = errors.New("AVIF floor maps need avifdec from libavif, see -avifdec")
+
+var errUnsupportedMap = errors.New("unsupported map format, expected png, jpeg, gif, webp, avif or pdf")
+
+// mapErrorStatus is the HTTP status for a floor map that was refused.
+func mapErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errPDFUnsupported), errors.Is(err, errAVIFUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, errUnsupportedMap):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
+
+// isPDF reports whether data is a PDF document.
+func isPDF(data []byte) bool {
+	return http.DetectContentType(data) == "application/pdf"
+}
+
+// renderPDFMap renders the first page of a PDF floor plan as a PNG with
+// its longest side at -pdf-map-size.
+func renderPDFMap(ctx context.Context, data []byte) ([]byte, error) {
+	if *pdfMapSize <= 0 || *pdfMapSize*(*pdfMapSize) > maxMapPixels {
+		return nil, fmt.Errorf("-pdf-map-size must be between 1 and %d", int(math.Sqrt(maxMapPixels)))
+	}
+
+	dir, err := os.MkdirTemp("", "heatgen-pdf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "plan.pdf")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pdfRenderTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, *pdftoppmPath, "-png", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(*pdfMapSize), input, filepath.Join(dir, "page"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, errPDFUnsupported
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("rendering the PDF took longer than %s", pdfRenderTimeout)
+		}
+		return nil, fmt.Errorf("invalid PDF: %s", bytes.TrimSpace(output))
+	}
+
+	return os.ReadFile(filepath.Join(dir, "page.png"))
+}
+
+// isAVIF reports whether data is an AVIF image: an ISO media file whose
+// major or a compatible brand is avif or avis.
+func isAVIF(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		return false
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		// Bytes 12 to 16 are the minor version, not a brand.
+		if i == 12 {
+			continue
+		}
+		if brand := string(data[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// convertAVIFMap converts an AVIF floor map to PNG. The standard library
+// and golang.org/x/image have no AVIF decoder, so maps are converted once
+// on upload, like PDF floor plans, and stored as PNG.
+func convertAVIFMap(ctx context.Context, data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "heatgen-avif-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input, converted := filepath.Join(dir, "map.avif"), filepath.Join(dir, "map.png")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pdfRenderTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, *avifdecPath, input, converted)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return nil, errAVIFUnsupported
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("converting the AVIF map took longer than %s", pdfRenderTimeout)
+		}
+		return nil, fmt.Errorf("invalid AVIF: %s", bytes.TrimSpace(output))
+	}
+
+	return os.ReadFile(converted)
+}
+
+// mapImageSize reads the pixel size of a floor map from its header.
+func mapImageSize(contentType string, data []byte) (int, int, error) {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		return config.Width, config.Height, err
+	case "image/webp":
+		config, err := webp.DecodeConfig(bytes.NewReader(data))
+		return config.Width, config.Height, err
+	}
+	return 0, 0, fmt.Errorf("unsupported map format %q", contentType)
+}
+
+// decodeMap decodes a floor map.
+func decodeMap(contentType string, data []byte) (image.Image, error) {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		img, _, err := image.Decode(bytes.NewReader(data))
+		return img, err
+	case "image/webp":
+		return webp.Decode(bytes.NewReader(data))
+	}
+	return nil, fmt.Errorf("%s maps cannot be decoded", contentType)
+}
+
+func mapThumbnailFile(floorID int) string {
+	return filepath.Join(projectUploads(), fmt.Sprintf("floor_%d_thumb.png", floorID))
+}
+
+// writeMapThumbnail scales a floor map down to mapThumbSize and stores it
+// as the floor's thumbnail.
+func writeMapThumbnail(floorID int, data []byte) error {
+	img, err := decodeMap(detectMapType(data), data)
+	if err != nil {
+		return err
+	}
+
+	b := img.Bounds()
+	scale := min(1, float64(mapThumbSize)/float64(max(b.Dx(), b.Dy())))
+	thumb := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, thumb); err != nil {
+		return err
+	}
+	return writeFileAtomic(mapThumbnailFile(floorID), buf.Bytes(), 0644)
+}
+
+// floorThumbnailHandler serves a small copy of the floor map for floor
+// lists and previews. Thumbnails of maps stored before they were made, or
+// replaced since, are made on the first request.
+func floorThumbnailHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.MapPath == "" {
+		http.Error(w, "floor has no map", http.StatusNotFound)
+		return
+	}
+
+	mapInfo, err := os.Stat(uploadFile(floor.MapPath))
+	if err != nil {
+		http.Error(w, "floor map not found", http.StatusNotFound)
+		return
+	}
+	thumbFile := mapThumbnailFile(floorID)
+	if thumbInfo, err := os.Stat(thumbFile); err != nil || thumbInfo.ModTime().Before(mapInfo.ModTime()) {
+		data, err := os.ReadFile(uploadFile(floor.MapPath))
+		if err != nil {
+			http.Error(w, "failed to read floor map", http.StatusInternalServerError)
+			return
+		}
+		if err := writeMapThumbnail(floorID, data); err != nil {
+			http.Error(w, fmt.Sprintf("no thumbnail: %v", err), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, thumbFile)
+}
+
+// fillMapSizes sets the map size of floors stored before it was recorded.
+// It is not saved; the floor keeps it once it is next changed.
+func fillMapSizes(floorMap map[int]Floor) {
+	for id, floor := range floorMap {
+		if floor.MapPath == "" || floor.MapWidth > 0 {
+			continue
+		}
+		data, err := os.ReadFile(uploadFile(floor.MapPath))
+		if err != nil {
+			continue
+		}
+		width, height, err := mapImageSize(detectMapType(data), data)
+		if err != nil {
+			log.Printf("failed to read the size of the map of floor %d: %v", id, err)
+			continue
+		}
+		floor.MapWidth, floor.MapHeight = width, height
+		floorMap[id] = floor
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ftyp builds the ftyp box an ISO media file starts with.
+func ftyp(major string, compatible ...string) []byte {
+	box := []byte("\x00\x00\x00\x00ftyp" + major + "\x00\x00\x00\x00")
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	box[3] = byte(len(box))
+	return append(box, "\x00\x00\x00\x08mdat"...)
+}
+
+func TestIsAVIF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"avif", ftyp("avif", "mif1", "miaf"), true},
+		{"sequence", ftyp("avis", "msf1"), true},
+		{"compatible brand", ftyp("mif1", "avif"), true},
+		{"heic", ftyp("heic", "mif1", "heic"), false},
+		{"mp4", ftyp("isom", "iso2", "mp41"), false},
+		{"brand as minor version", []byte("\x00\x00\x00\x10ftypmif1avif"), false},
+		{"box larger than data", []byte("\x00\x00\x01\x00ftypavif\x00\x00\x00\x00"), false},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), false},
+		{"short", []byte("ftypavif"), false},
+	}
+
+	for _, test := range tests {
+		if got := isAVIF(test.data); got != test.want {
+			t.Errorf("%s: isAVIF is %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadMapUploadAVIF(t *testing.T) {
+	dir := t.TempDir()
+	var plan bytes.Buffer
+	if err := png.Encode(&plan, image.NewGray(image.Rect(0, 0, 30, 20))); err != nil {
+		t.Fatal(err)
+	}
+	planFile := filepath.Join(dir, "plan.png")
+	if err := os.WriteFile(planFile, plan.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The stub stands in for avifdec, writing the plan as the output.
+	stub := filepath.Join(dir, "avifdec")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\ncp '"+planFile+"' \"$2\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := *avifdecPath
+	t.Cleanup(func() { *avifdecPath = old })
+
+	*avifdecPath = stub
+	data, ext, err := readMapUpload(context.Background(), ftyp("avif", "mif1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != ".png" || !bytes.Equal(data, plan.Bytes()) {
+		t.Errorf("stored %d bytes as %s, want the converted PNG", len(data), ext)
+	}
+
+	*avifdecPath = filepath.Join(dir, "missing")
+	if _, _, err := readMapUpload(context.Background(), ftyp("avif", "mif1")); !errors.Is(err, errAVIFUnsupported) {
+		t.Errorf("got %v without avifdec, want %v", err, errAVIFUnsupported)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// GeoJSON coordinates are WGS 84 longitude and latitude on calibrated
+// floors. Floors without a calibration can only be exported in floor
+// coordinates: the map pixel column and the height above the bottom edge,
+// as the frontend stores them.
+const (
+	geoJSONCoordinatesGeo   = "geo"
+	geoJSONCoordinatesFloor = "floor"
+)
+
+type geoJSONGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+// geoJSONCollection is a FeatureCollection. CoordinateSystem and Metadata
+// are foreign members, which GeoJSON readers ignore; "coordinates" itself
+// is reserved for geometries.
+type geoJSONCollection struct {
+	Type             string           `json:"type"`
+	CoordinateSystem string           `json:"coordinateSystem"`
+	Metadata         *ExportMetadata  `json:"metadata,omitempty"`
+	Features         []geoJSONFeature `json:"features"`
+}
+
+// writeMeasurementsGeoJSON writes the measurements as a FeatureCollection of
+// points, in geographic coordinates when transforms are given and in floor
+// coordinates otherwise. Failed samples have a null dbm.
+func writeMeasurementsGeoJSON(w io.Writer, ms []Measurement, meta *ExportMetadata, transforms map[int]func(lat, lng float64) (float64, float64)) error {
+	coordinates := geoJSONCoordinatesFloor
+	if transforms != nil {
+		coordinates = geoJSONCoordinatesGeo
+	}
+
+	collection := geoJSONCollection{
+		Type:             "FeatureCollection",
+		CoordinateSystem: coordinates,
+		Metadata:         meta,
+		Features:         make([]geoJSONFeature, 0, len(ms)),
+	}
+	for _, m := range ms {
+		lat, lng := m.Lat, m.Lng
+		if transforms != nil {
+			lat, lng = transforms[m.Floor](m.Lat, m.Lng)
+		}
+
+		properties := map[string]any{
+			"dbm":       m.Dbm,
+			"floor":     m.Floor,
+			"timestamp": m.Timestamp.Format(time.RFC3339),
+			"type":      m.Type,
+			"source":    m.source(),
+			"class":     m.class(),
+		}
+		if m.Dbm == failedSampleDbm {
+			properties["dbm"] = nil
+		}
+		for name, value := range map[string]string{"location": m.Location, "ssid": m.SSID, "bssid": m.BSSID, "session": m.SessionID, "site": measurementSite(m.ID)} {
+			if value != "" {
+				properties[name] = value
+			}
+		}
+		if m.Channel != 0 {
+			properties["channel"] = m.Channel
+		}
+		if len(m.Attributes) > 0 {
+			properties["attributes"] = m.Attributes
+		}
+		for name, value := range map[string]*float64{"latencyMs": m.LatencyMs, "jitterMs": m.JitterMs, "throughputMbps": m.ThroughputMbps, "uploadMbps": m.UploadMbps, "lossPercent": m.LossPercent, "height": m.Height, "noiseDbm": m.NoiseDbm, "snrDb": m.SNRDb, "busyPercent": m.BusyPercent} {
+			if value != nil {
+				properties[name] = *value
+			}
+		}
+
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         m.ID,
+			Geometry:   geoJSONGeometry{Type: "Point", Coordinates: [2]float64{lng, lat}},
+			Properties: properties,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(collection)
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	heatmapGridCacheSize = flag.Int("tile-cache", 16, "number of interpolated heatmaps kept in memory for heatmap images and tiles")
+	heatmapRenderCacheMB = flag.Int("tile-cache-mb", 256, "memory in MiB the tiles, overlays and images rendered from cached heatmaps may take")
+)
+
+const (
+	// maxGridUpdates bounds how many times a grid is updated in place
+	// before it is interpolated from scratch again, which also discards
+	// the rounding the running sums accumulate.
+	maxGridUpdates = 64
+	// Rendered tiles, overlays and images kept per heatmap.
+	maxCachedTiles    = 1024
+	maxCachedOverlays = 2
+	maxCachedImages   = 4
+)
+
+// heatmapRequest is the heatmap of a floor with the points it is
+// interpolated from, which is cheap to work out before any interpolation.
+type heatmapRequest struct {
+	floor         Floor
+	params        HeatmapParams
+	width, height int
+	points        []heatmapPoint
+	// key names the heatmap of the floor and parameters, floorKey the
+	// floor with its map and size, pointsKey the points.
+	key       string
+	floorKey  string
+	pointsKey uint64
+}
+
+// heatmapBounds returns the pixel size of the heatmap of a floor: that of
+// its map, or one large enough for every measurement when it has none.
+func heatmapBounds(floor Floor, ms []Measurement) (int, int, error) {
+	if floor.MapPath != "" {
+		return floorMapSize(floor)
+	}
+	width, height := canvasSize(ms)
+	return width, height, nil
+}
+
+func newHeatmapRequest(floor Floor, ms []Measurement, params HeatmapParams, width, height int) heatmapRequest {
+	req := heatmapRequest{floor: floor, params: params, width: width, height: height}
+	req.points = heatmapPoints(params.selectMeasurements(ms), height, params)
+	req.key = strconv.Itoa(floor.ID) + "?" + params.gridKey()
+
+	h := fnv.New64a()
+	floorData, _ := json.Marshal(floor)
+	h.Write(floorData)
+	if floor.MapPath != "" {
+		if info, err := os.Stat(uploadFile(floor.MapPath)); err == nil {
+			fmt.Fprintf(h, "%d %d", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	fmt.Fprintf(h, "%dx%d", width, height)
+	req.floorKey = fmt.Sprintf("%016x", h.Sum64())
+
+	h = fnv.New64a()
+	for _, p := range req.points {
+		fmt.Fprintf(h, "%g %g %g %g;", p.X, p.Y, p.Value, p.Weight)
+	}
+	req.pointsKey = h.Sum64()
+	return req
+}
+
+// etag identifies the heatmap rendered with the parameters, so browsers
+// revalidate it only when its own floor or points change.
+func (req heatmapRequest) etag(variant string) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s %s %016x %s %s", req.key, req.floorKey, req.pointsKey, req.params.renderKey(), variant)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// gridKey identifies the parameters the interpolated grid depends on.
+func (p HeatmapParams) gridKey() string {
+	height := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%s|%d|%g|%s|%t|%s|%s|%s|%s|%s|%s|%s-%s|%t,%g,%s|%t",
+		p.Method, p.Grid, p.Power, p.Metric.Name, p.Accuracy, p.SSID, p.BSSID, p.Band,
+		p.Session, p.Class, p.Source, height(p.Height.Min), height(p.Height.Max),
+		p.Aggregate.Enabled, p.Aggregate.Radius, p.Aggregate.Window, p.MaskDistance > 0)
+}
+
+// renderKey identifies the parameters that only color the grid.
+func (p HeatmapParams) renderKey() string {
+	return fmt.Sprintf("%g|%s|%g|%g|%g|%s|%t", p.Opacity, p.Scale, p.Min, p.Max, p.MaskDistance, p.MaskStyle, p.Legend)
+}
+
+// heatmapGrid is the interpolated heatmap of a floor, kept with what has
+// been rendered from it. ready is closed once the grid is computed or has
+// failed.
+type heatmapGrid struct {
+	floorKey  string
+	pointsKey uint64
+	ready     chan struct{}
+	err       error
+	lastUsed  time.Time
+	// updates counts the updates in place since the last full
+	// interpolation.
+	updates int
+
+	floor         Floor
+	width, height int
+	grid          *signalGrid
+	// sampling and mask are kept to update the grid and the distances of
+	// the mask when points change; sampling is nil for interpolators that
+	// cannot update a grid.
+	sampling  GridSampling
+	mask      *nearestSampling
+	distances []float64
+
+	lock     sync.Mutex
+	tiles    map[string]*cachedTile
+	overlays map[string]*cachedOverlay
+	images   map[string][]byte
+	// rendered is the size in bytes of the tiles, overlays and images.
+	rendered int
+}
+
+// cachedTile is an encoded tile with its place, which tells whether a
+// change of the grid reaches it.
+type cachedTile struct {
+	zoom, x, y int
+	data       []byte
+}
+
+// cachedOverlay is the colored heatmap of renderHeatmap, repainted where
+// the grid changes.
+type cachedOverlay struct {
+	params HeatmapParams
+	img    *image.RGBA
+}
+
+// HeatmapCacheStats reports the interpolated heatmaps in memory, with the
+// bytes rendered from them: requests answered from the cache, grids updated for changed measurements and
+// grids interpolated from scratch.
+type HeatmapCacheStats struct {
+	Entries  int   `json:"entries"`
+	Capacity int   `json:"capacity"`
+	Bytes    int   `json:"bytes"`
+	Hits     int64 `json:"hits"`
+	Updates  int64 `json:"updates"`
+	Computes int64 `json:"computes"`
+}
+
+var (
+	heatmapGrids     = make(map[string]*heatmapGrid)
+	heatmapGridsLock sync.Mutex
+	heatmapGridStats HeatmapCacheStats
+)
+
+// cachedHeatmapGrid returns the interpolated heatmap of the request. A
+// heatmap whose floor and points are unchanged is served from memory; one
+// whose points changed a little since is updated from the cached grid when
+// the interpolator supports it, recomputing only what the added and
+// removed points reach. Concurrent requests for the same heatmap wait for
+// the first one to finish.
+func cachedHeatmapGrid(ctx context.Context, req heatmapRequest) (*heatmapGrid, error) {
+	heatmapGridsLock.Lock()
+	entry, exists := heatmapGrids[req.key]
+	if exists && entry.floorKey == req.floorKey && entry.pointsKey == req.pointsKey {
+		entry.lastUsed = time.Now()
+		heatmapGridStats.Hits++
+		heatmapGridsLock.Unlock()
+
+		select {
+		case <-entry.ready:
+			// The request computing the grid may have been cancelled, as
+			// Leaflet does with tiles panned away; another one then takes
+			// over.
+			if errors.Is(entry.err, context.Canceled) || errors.Is(entry.err, context.DeadlineExceeded) {
+				if ctx.Err() == nil {
+					return cachedHeatmapGrid(ctx, req)
+				}
+			}
+			return entry, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var base *heatmapGrid
+	if exists && entry.updatable(req) {
+		base = entry
+	}
+	if !exists {
+		for len(heatmapGrids) >= max(*heatmapGridCacheSize, 1) {
+			var oldest string
+			for k, e := range heatmapGrids {
+				if oldest == "" || e.lastUsed.Before(heatmapGrids[oldest].lastUsed) {
+					oldest = k
+				}
+			}
+			delete(heatmapGrids, oldest)
+		}
+	}
+	entry = &heatmapGrid{
+		floorKey:  req.floorKey,
+		pointsKey: req.pointsKey,
+		ready:     make(chan struct{}),
+		lastUsed:  time.Now(),
+		floor:     req.floor,
+		width:     req.width,
+		height:    req.height,
+		tiles:     make(map[string]*cachedTile),
+		overlays:  make(map[string]*cachedOverlay),
+		images:    make(map[string][]byte),
+	}
+	heatmapGrids[req.key] = entry
+	heatmapGridsLock.Unlock()
+
+	if base != nil {
+		entry.err = entry.update(ctx, base, req)
+	} else {
+		entry.err = entry.compute(ctx, req)
+	}
+
+	heatmapGridsLock.Lock()
+	switch {
+	case entry.err != nil:
+		if heatmapGrids[req.key] == entry {
+			delete(heatmapGrids, req.key)
+			if base != nil {
+				heatmapGrids[req.key] = base
+			}
+		}
+	case base != nil:
+		heatmapGridStats.Updates++
+	default:
+		heatmapGridStats.Computes++
+	}
+	heatmapGridsLock.Unlock()
+
+	close(entry.ready)
+	return entry, entry.err
+}
+
+// updatable reports whether the request can be answered by updating the
+// grid rather than interpolating from scratch, which pays off while the
+// points changed are few.
+func (g *heatmapGrid) updatable(req heatmapRequest) bool {
+	select {
+	case <-g.ready:
+	default:
+		return false
+	}
+	if g.err != nil || g.sampling == nil || g.floorKey != req.floorKey || g.updates >= maxGridUpdates {
+		return false
+	}
+	if len(req.points) == 0 {
+		return false
+	}
+	added, removed := diffPoints(g.grid.Points, req.points)
+	return len(added)+len(removed) <= len(g.grid.Points)/4
+}
+
+// diffPoints returns the points of next missing from previous and those of
+// previous missing from next, counting repeated points.
+func diffPoints(previous, next []heatmapPoint) (added, removed []heatmapPoint) {
+	counts := make(map[heatmapPoint]int, len(previous))
+	for _, p := range previous {
+		counts[p]++
+	}
+	for _, p := range next {
+		if counts[p] > 0 {
+			counts[p]--
+			continue
+		}
+		added = append(added, p)
+	}
+	for _, p := range previous {
+		if counts[p] > 0 {
+			counts[p]--
+			removed = append(removed, p)
+		}
+	}
+	return added, removed
+}
+
+func (g *heatmapGrid) newSignalGrid(req heatmapRequest) *signalGrid {
+	return &signalGrid{
+		Bounds: image.Rect(0, 0, req.width, req.height),
+		Cols:   req.width/req.params.Grid + 2,
+		Rows:   req.height/req.params.Grid + 2,
+		Step:   req.params.Grid,
+		Points: req.points,
+	}
+}
+
+// compute interpolates the grid from scratch.
+func (g *heatmapGrid) compute(ctx context.Context, req heatmapRequest) error {
+	g.grid = g.newSignalGrid(req)
+	if len(req.points) == 0 {
+		return nil
+	}
+
+	interpolator, err := newInterpolator(req.params.Method, req.points, req.params)
+	if err != nil {
+		return err
+	}
+	if incremental, ok := interpolator.(IncrementalInterpolator); ok {
+		g.sampling, err = incremental.SampleIncremental(ctx, g.grid.Cols, g.grid.Rows, g.grid.Step)
+		if err != nil {
+			return err
+		}
+		g.grid.Values = g.sampling.Values()
+	} else {
+		g.grid.Values, err = sampleGrid(ctx, interpolator, g.grid.Cols, g.grid.Rows, g.grid.Step)
+		if err != nil {
+			return err
+		}
+	}
+
+	if req.params.MaskDistance == 0 {
+		return nil
+	}
+	// The nearest method samples the distances anyway, unless it weighs them.
+	if nearest, ok := g.sampling.(*nearestSampling); ok && !req.params.Accuracy {
+		g.mask = nearest
+	} else if g.mask, err = sampleNearest(ctx, req.points, g.grid.Cols, g.grid.Rows, g.grid.Step, false); err != nil {
+		return err
+	}
+	g.distances = g.mask.distances
+	return nil
+}
+
+// update brings the grid of base up to date with the points of the request
+// and carries over the tiles and overlays the changed nodes do not reach.
+func (g *heatmapGrid) update(ctx context.Context, base *heatmapGrid, req heatmapRequest) error {
+	added, removed := diffPoints(base.grid.Points, req.points)
+
+	sampling, dirty, err := base.sampling.Update(ctx, added, removed)
+	if err != nil {
+		return err
+	}
+	g.updates = base.updates + 1
+	g.sampling = sampling
+	g.grid = g.newSignalGrid(req)
+	g.grid.Values = sampling.Values()
+
+	if base.mask != nil {
+		if nearest, ok := sampling.(*nearestSampling); ok && !req.params.Accuracy {
+			g.mask = nearest
+		} else {
+			mask, maskDirty, err := base.mask.Update(ctx, added, removed)
+			if err != nil {
+				return err
+			}
+			g.mask = mask.(*nearestSampling)
+			for n := range dirty {
+				dirty[n] = dirty[n] || maskDirty[n]
+			}
+		}
+		g.distances = g.mask.distances
+	}
+
+	base.lock.Lock()
+	defer base.lock.Unlock()
+	for key, tile := range base.tiles {
+		span := tileSize / math.Exp2(float64(tile.zoom))
+		left, top := float64(tile.x)*span, float64(g.height)+float64(tile.y)*span
+		if !g.regionDirty(dirty, left, top, left+span, top+span) {
+			g.tiles[key] = tile
+			g.rendered += len(tile.data)
+		}
+	}
+	for key, overlay := range base.overlays {
+		img := image.NewRGBA(overlay.img.Bounds())
+		copy(img.Pix, overlay.img.Pix)
+		for row := 0; row < g.grid.Rows-1; row++ {
+			for col := 0; col < g.grid.Cols-1; col++ {
+				x, y := float64(col*g.grid.Step), float64(row*g.grid.Step)
+				if g.regionDirty(dirty, x, y, x+1, y+1) {
+					g.paint(img, overlay.params, image.Rect(col*g.grid.Step, row*g.grid.Step, (col+1)*g.grid.Step, (row+1)*g.grid.Step))
+				}
+			}
+		}
+		g.overlays[key] = &cachedOverlay{params: overlay.params, img: img}
+		g.rendered += len(img.Pix)
+	}
+	return nil
+}
+
+// regionDirty reports whether any pixel in [x0, x1) x [y0, y1) is
+// interpolated from a node marked in dirty.
+func (g *heatmapGrid) regionDirty(dirty []bool, x0, y0, x1, y1 float64) bool {
+	step := float64(g.grid.Step)
+	colFrom, colTo := max(int(math.Floor(x0/step)), 0), min(int(math.Ceil(x1/step)), g.grid.Cols-1)
+	rowFrom, rowTo := max(int(math.Floor(y0/step)), 0), min(int(math.Ceil(y1/step)), g.grid.Rows-1)
+	for row := rowFrom; row <= rowTo; row++ {
+		for col := colFrom; col <= colTo; col++ {
+			if dirty[row*g.grid.Cols+col] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maskPixels converts the mask distance of the parameters to pixels.
+func (g *heatmapGrid) maskPixels(params HeatmapParams) float64 {
+	return params.MaskDistance / g.floor.metersPerPixel()
+}
+
+// paint colors the pixels of r in the overlay of renderHeatmap.
+func (g *heatmapGrid) paint(overlay *image.RGBA, params HeatmapParams, r image.Rectangle) {
+	r = r.Intersect(overlay.Bounds())
+	alpha := uint8(params.Opacity * 255)
+	var maskPixels float64
+	if g.distances != nil {
+		maskPixels = g.maskPixels(params)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			a := alpha
+			if g.distances != nil {
+				a = uint8(float64(alpha) * params.maskFactor(x, y, g.grid.at(g.distances, x, y), maskPixels))
+			}
+
+			c := params.colorFor(g.grid.at(g.grid.Values, x, y))
+			overlay.SetRGBA(x, y, color.RGBA{
+				R: uint8(uint16(c.R) * uint16(a) / 255),
+				G: uint8(uint16(c.G) * uint16(a) / 255),
+				B: uint8(uint16(c.B) * uint16(a) / 255),
+				A: a,
+			})
+		}
+	}
+}
+
+// overlay returns the colored heatmap for the parameters, painting it on
+// first use. It must not be modified.
+func (g *heatmapGrid) overlay(params HeatmapParams) *image.RGBA {
+	key := params.renderKey()
+
+	g.lock.Lock()
+	cached, exists := g.overlays[key]
+	g.lock.Unlock()
+	if exists {
+		return cached.img
+	}
+
+	img := image.NewRGBA(g.grid.Bounds)
+	g.paint(img, params, img.Bounds())
+
+	g.lock.Lock()
+	if len(g.overlays) >= maxCachedOverlays {
+		for _, overlay := range g.overlays {
+			g.rendered -= len(overlay.img.Pix)
+		}
+		clear(g.overlays)
+	}
+	g.overlays[key] = &cachedOverlay{params: params, img: img}
+	g.rendered += len(img.Pix)
+	g.lock.Unlock()
+	trimHeatmapGrids(g)
+	return img
+}
+
+// cachedImage returns the encoded image stored under key, computing it
+// with encode on first use.
+func (g *heatmapGrid) cachedImage(key string, encode func() ([]byte, error)) ([]byte, error) {
+	g.lock.Lock()
+	data, exists := g.images[key]
+	g.lock.Unlock()
+	if exists {
+		return data, nil
+	}
+
+	data, err := encode()
+	if err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	if len(g.images) >= maxCachedImages {
+		for _, old := range g.images {
+			g.rendered -= len(old)
+		}
+		clear(g.images)
+	}
+	g.images[key] = data
+	g.rendered += len(data)
+	g.lock.Unlock()
+	trimHeatmapGrids(g)
+	return data, nil
+}
+
+// trimHeatmapGrids drops what was rendered from the least recently used
+// heatmaps until all of it fits in -tile-cache-mb, and from current, the
+// heatmap just rendered from, when it does not fit by itself. The grids
+// stay, as they are bounded by -tile-cache.
+func trimHeatmapGrids(current *heatmapGrid) {
+	limit := *heatmapRenderCacheMB << 20
+
+	heatmapGridsLock.Lock()
+	defer heatmapGridsLock.Unlock()
+
+	total := 0
+	sizes := make(map[*heatmapGrid]int, len(heatmapGrids))
+	for _, entry := range heatmapGrids {
+		// Grids being computed or updated are not rendered from yet.
+		select {
+		case <-entry.ready:
+		default:
+			continue
+		}
+		entry.lock.Lock()
+		sizes[entry] = entry.rendered
+		entry.lock.Unlock()
+		total += sizes[entry]
+	}
+	for total > limit {
+		var oldest *heatmapGrid
+		for entry, size := range sizes {
+			if entry != current && size > 0 && (oldest == nil || entry.lastUsed.Before(oldest.lastUsed)) {
+				oldest = entry
+			}
+		}
+		if oldest == nil {
+			oldest = current
+		}
+
+		oldest.lock.Lock()
+		total -= oldest.rendered
+		clear(oldest.tiles)
+		clear(oldest.overlays)
+		clear(oldest.images)
+		oldest.rendered = 0
+		oldest.lock.Unlock()
+		if oldest == current {
+			return
+		}
+		delete(sizes, oldest)
+	}
+}
+
+// heatmapCacheStats reports the cache for the admin cache endpoint.
+func heatmapCacheStats() HeatmapCacheStats {
+	heatmapGridsLock.Lock()
+	defer heatmapGridsLock.Unlock()
+
+	stats := heatmapGridStats
+	stats.Entries = len(heatmapGrids)
+	stats.Capacity = max(*heatmapGridCacheSize, 1)
+	for _, entry := range heatmapGrids {
+		select {
+		case <-entry.ready:
+		default:
+			continue
+		}
+		entry.lock.Lock()
+		stats.Bytes += entry.rendered
+		entry.lock.Unlock()
+	}
+	return stats
+}
+
+func clearHeatmapGrids() {
+	heatmapGridsLock.Lock()
+	heatmapGrids = make(map[string]*heatmapGrid)
+	heatmapGridsLock.Unlock()
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"HeatGen/heatgenpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var grpcListen = flag.String("grpc-listen", envOrDefault("HEATGEN_GRPC_LISTEN", ""), "address to serve the gRPC API on, e.g. :9090; empty to disable (env HEATGEN_GRPC_LISTEN)")
+
+// grpcEditorMethods change data and need an editor key, like the HTTP
+// requests other than GET.
+var grpcEditorMethods = map[string]bool{
+	heatgenpb.HeatGen_AddMeasurements_FullMethodName:   true,
+	heatgenpb.HeatGen_DeleteMeasurement_FullMethodName: true,
+	heatgenpb.HeatGen_CreateSession_FullMethodName:     true,
+}
+
+var (
+	grpcServer *grpc.Server
+	// grpcStopping is closed at shutdown to end the sample streams, which
+	// would otherwise keep it waiting.
+	grpcStopping = make(chan struct{})
+)
+
+// heatGenService implements heatgenpb.HeatGenServer on the data of the
+// HTTP API, see heatgenpb/heatgen.proto.
+type heatGenService struct {
+	heatgenpb.UnimplementedHeatGenServer
+}
+
+func optionalProto(v *float64) *float64 {
+	if v == nil {
+		return nil
+	}
+	copied := *v
+	return &copied
+}
+
+func measurementProto(m Measurement) *heatgenpb.Measurement {
+	return &heatgenpb.Measurement{
+		Id:             m.ID,
+		Timestamp:      timestamppb.New(m.Timestamp),
+		Dbm:            int32(m.Dbm),
+		Lat:            m.Lat,
+		Lng:            m.Lng,
+		Floor:          int32(m.Floor),
+		Location:       m.Location,
+		Type:           m.Type,
+		Accuracy:       m.Accuracy,
+		PresetId:       m.PresetID,
+		SessionId:      m.SessionID,
+		Ssid:           m.SSID,
+		Bssid:          m.BSSID,
+		Freq:           int32(m.Freq),
+		Channel:        int32(m.Channel),
+		TxBitrate:      m.TxBitrate,
+		Roamed:         m.Roamed,
+		Security:       m.Security,
+		ScanId:         m.ScanID,
+		TrackId:        m.TrackID,
+		Dfs:            m.DFS,
+		Interface:      m.Interface,
+		HasRaw:         m.HasRaw,
+		HasPcap:        m.HasPcap,
+		HasPhoto:       m.HasPhoto,
+		LatencyMs:      optionalProto(m.LatencyMs),
+		ThroughputMbps: optionalProto(m.ThroughputMbps),
+		LossPercent:    optionalProto(m.LossPercent),
+		JitterMs:       optionalProto(m.JitterMs),
+		NoiseDbm:       optionalProto(m.NoiseDbm),
+		SnrDb:          optionalProto(m.SNRDb),
+		BusyPercent:    optionalProto(m.BusyPercent),
+		Height:         optionalProto(m.Height),
+		Attributes:     m.Attributes,
+		Class:          m.class(),
+	}
+}
+
+func measurementsProto(ms []Measurement) []*heatgenpb.Measurement {
+	list := make([]*heatgenpb.Measurement, len(ms))
+	for i, m := range ms {
+		list[i] = measurementProto(m)
+	}
+	return list
+}
+
+func floorProto(f Floor) *heatgenpb.Floor {
+	floor := &heatgenpb.Floor{
+		Id:       int32(f.ID),
+		Name:     f.Name,
+		MapPath:  f.MapPath,
+		Order:    int32(f.Order),
+		Site:     f.Site,
+		Building: f.Building,
+	}
+	if f.Scale != nil {
+		floor.MetersPerPixel = f.Scale.MetersPerPixel
+	}
+	return floor
+}
+
+func sessionProto(s Session) *heatgenpb.Session {
+	return &heatgenpb.Session{
+		Id:           s.ID,
+		Name:         s.Name,
+		Description:  s.Description,
+		CreatedAt:    timestamppb.New(s.CreatedAt),
+		Measurements: int32(s.Measurements),
+	}
+}
+
+func (heatGenService) ListMeasurements(_ context.Context, req *heatgenpb.ListMeasurementsRequest) (*heatgenpb.ListMeasurementsResponse, error) {
+	options := listOptions{
+		Location: strings.ToLower(req.Location),
+		Class:    req.Class,
+		Limit:    int(req.Limit),
+		Offset:   int(req.Offset),
+	}
+	switch options.Class {
+	case "":
+		options.Class = classSurvey
+	case classSurvey, classMonitoring, classAll:
+	default:
+		return nil, status.Error(codes.InvalidArgument, "class must be survey, monitoring or all")
+	}
+	if req.From != nil {
+		options.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		options.To = req.To.AsTime()
+	}
+	if len(req.Types) > 0 {
+		options.Types = make(map[string]bool)
+		for _, t := range req.Types {
+			options.Types[t] = true
+		}
+	}
+	if req.Sort != "" {
+		options.Sort, options.Descending = strings.CutPrefix(req.Sort, "-")
+		if _, known := measurementSorts[options.Sort]; !known {
+			return nil, status.Error(codes.InvalidArgument, "sort must be one of timestamp, dbm, floor, location or id, prefixed with - for descending order")
+		}
+	}
+	if options.Limit < 0 || options.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit and offset must not be negative")
+	}
+
+	mutex.Lock()
+	var filtered []Measurement
+	for _, m := range measurements {
+		if (req.Floor <= 0 || m.Floor == int(req.Floor)) && inSession(m, req.SessionId) && options.match(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	return &heatgenpb.ListMeasurementsResponse{
+		Measurements: measurementsProto(options.page(filtered)),
+		Total:        int32(len(filtered)),
+	}, nil
+}
+
+func (heatGenService) GetMeasurement(_ context.Context, req *heatgenpb.GetMeasurementRequest) (*heatgenpb.Measurement, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, m := range measurements {
+		if m.ID == req.Id {
+			return measurementProto(m), nil
+		}
+	}
+	return nil, status.Error(codes.NotFound, "measurement not found")
+}
+
+func (heatGenService) AddMeasurements(ctx context.Context, req *heatgenpb.AddMeasurementsRequest) (*heatgenpb.AddMeasurementsResponse, error) {
+	if len(req.Readings) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "readings are required")
+	}
+
+	records := make([]Measurement, 0, len(req.Readings))
+	for i, r := range req.Readings {
+		reading := MQTTReading{
+			MeasurementRequest: MeasurementRequest{
+				Lat:       &r.Lat,
+				Lng:       &r.Lng,
+				Floor:     int(r.Floor),
+				Location:  r.Location,
+				Type:      r.Type,
+				Accuracy:  r.Accuracy,
+				Height:    r.Height,
+				PresetID:  r.PresetId,
+				SessionID: r.SessionId,
+				Interface: r.Interface,
+			},
+			SSID:    r.Ssid,
+			BSSID:   r.Bssid,
+			Freq:    int(r.Freq),
+			Channel: int(r.Channel),
+		}
+		if r.Dbm != nil {
+			dbm := int(*r.Dbm)
+			reading.Dbm = &dbm
+		}
+		if r.Timestamp != nil {
+			timestamp := r.Timestamp.AsTime()
+			reading.Timestamp = &timestamp
+		}
+		m, err := readingMeasurement("", reading)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "reading %d: %v", i, err)
+		}
+		records = append(records, m)
+	}
+
+	actor := probeActor(records)
+	if key, exists := lookupKey(grpcKey(ctx)); exists {
+		actor = "key:" + key.Name
+	}
+	if err := addMeasurements(actor, records...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &heatgenpb.AddMeasurementsResponse{Measurements: measurementsProto(records)}, nil
+}
+
+func (heatGenService) DeleteMeasurement(ctx context.Context, req *heatgenpb.DeleteMeasurementRequest) (*heatgenpb.DeleteMeasurementResponse, error) {
+	found, err := deleteMeasurement(grpcActor(ctx), req.Id)
+	if !found {
+		return nil, status.Error(codes.NotFound, "measurement not found")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &heatgenpb.DeleteMeasurementResponse{}, nil
+}
+
+func (heatGenService) ListFloors(_ context.Context, req *heatgenpb.ListFloorsRequest) (*heatgenpb.ListFloorsResponse, error) {
+	if req.Building != "" {
+		if _, exists := getBuilding(req.Building); !exists {
+			return nil, status.Error(codes.NotFound, "building not found")
+		}
+	}
+
+	var list []*heatgenpb.Floor
+	for _, floor := range sortedFloors(req.Building) {
+		list = append(list, floorProto(floor))
+	}
+	return &heatgenpb.ListFloorsResponse{Floors: list}, nil
+}
+
+func (heatGenService) GetFloor(_ context.Context, req *heatgenpb.GetFloorRequest) (*heatgenpb.Floor, error) {
+	mutex.Lock()
+	floor, exists := floors[int(req.Id)]
+	mutex.Unlock()
+	if !exists {
+		return nil, status.Error(codes.NotFound, "floor not found")
+	}
+	return floorProto(floor), nil
+}
+
+func (heatGenService) ListSessions(context.Context, *heatgenpb.ListSessionsRequest) (*heatgenpb.ListSessionsResponse, error) {
+	var list []*heatgenpb.Session
+	for _, session := range sortedSessions() {
+		list = append(list, sessionProto(session))
+	}
+	return &heatgenpb.ListSessionsResponse{Sessions: list}, nil
+}
+
+func (heatGenService) GetSession(_ context.Context, req *heatgenpb.GetSessionRequest) (*heatgenpb.Session, error) {
+	session, exists := getSession(req.Id)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	list := []Session{session}
+	countSessionMeasurements(list)
+	return sessionProto(list[0]), nil
+}
+
+func (heatGenService) CreateSession(_ context.Context, req *heatgenpb.CreateSessionRequest) (*heatgenpb.Session, error) {
+	session := Session{Name: req.Name, Description: req.Description}
+	if err := cleanSession(&session); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	session, err := createSession(session)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return sessionProto(session), nil
+}
+
+func (heatGenService) StreamSamples(req *heatgenpb.StreamSamplesRequest, stream heatgenpb.HeatGen_StreamSamplesServer) error {
+	iface := req.Interface
+	if iface == "" {
+		iface = *wifiInterface
+	} else if !validInterface(iface) {
+		return status.Errorf(codes.InvalidArgument, "unknown wireless interface %q", iface)
+	}
+	interval := int(req.IntervalMs)
+	if interval == 0 {
+		interval = defaultStreamInterval
+	}
+	if interval < 100 || interval > 10000 {
+		return status.Error(codes.InvalidArgument, "interval must be between 100 and 10000 ms")
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		info, _, err := getWifiSignalDbm(iface)
+		signal := info.Signal
+		if err != nil {
+			signal = failedSampleDbm
+		}
+		sample := &heatgenpb.Sample{
+			Timestamp: timestamppb.Now(),
+			Dbm:       int32(signal),
+			Bssid:     info.BSSID,
+			Freq:      int32(info.Freq),
+		}
+		if err := stream.Send(sample); err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-grpcStopping:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-ticker.C:
+		}
+	}
+}
+
+// grpcAuthorize holds the calls to the roles of the API keys as
+// authMiddleware holds the HTTP requests. The key is sent as
+// "authorization: Bearer <key>" or "x-api-key" metadata.
+func grpcAuthorize(ctx context.Context, method string) error {
+	apiKeysLock.Lock()
+	enabled := len(apiKeys) > 0
+	apiKeysLock.Unlock()
+	if !enabled {
+		return nil
+	}
+
+	required := roleEditor
+	if !grpcEditorMethods[method] {
+		required = ""
+		if *readAccess == roleViewer {
+			required = roleViewer
+		}
+	}
+	if required == "" {
+		return nil
+	}
+
+	role, valid := keyRole(grpcKey(ctx))
+	if !valid {
+		return status.Error(codes.Unauthenticated, "a valid API key is required")
+	}
+	if !roleAllows(role, required) {
+		return status.Error(codes.PermissionDenied, "an editor API key is required")
+	}
+	return nil
+}
+
+// grpcKey returns the API key of a call, sent as "authorization: Bearer
+// <key>" or "x-api-key" metadata.
+func grpcKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key string
+	if values := md.Get("x-api-key"); len(values) > 0 {
+		key = values[0]
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		if bearer, found := strings.CutPrefix(values[0], "Bearer "); found {
+			key = bearer
+		}
+	}
+	return key
+}
+
+// grpcActor names who made a call for the audit log, as auditActor does
+// for HTTP requests.
+func grpcActor(ctx context.Context) string {
+	if key, exists := lookupKey(grpcKey(ctx)); exists {
+		return "key:" + key.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return "client:" + host
+		}
+		return "client:" + p.Addr.String()
+	}
+	return "client"
+}
+
+// grpcWritable refuses changes in read-only mode as readOnlyMiddleware
+// does, letting through the measurement changes -read-only-queue holds.
+func grpcWritable(method string) error {
+	reason := readOnly()
+	if reason == "" || !grpcEditorMethods[method] {
+		return nil
+	}
+	if method == heatgenpb.HeatGen_CreateSession_FullMethodName || checkWritable() != nil {
+		return status.Error(codes.Unavailable, errReadOnly{reason}.Error())
+	}
+	return nil
+}
+
+// startGRPC serves the gRPC API on -grpc-listen, when it is set.
+func startGRPC() {
+	if *grpcListen == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", *grpcListen)
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to listen for gRPC: %v", err))
+	}
+
+	grpcServer = grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			if err := grpcWritable(info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorize(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	heatgenpb.RegisterHeatGenServer(grpcServer, heatGenService{})
+	// Reflection lets grpcurl and similar tools list and call the API
+	// without the proto file.
+	reflection.Register(grpcServer)
+
+	log.Printf("gRPC API listening on %s...", *grpcListen)
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+}
+
+// stopGRPC ends the sample streams and waits for the calls in flight until
+// ctx is done, when the rest are cancelled.
+func stopGRPC(ctx context.Context) {
+	if grpcServer == nil {
+		return
+	}
+	close(grpcStopping)
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const capNetAdmin = 12
+
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+// checkSignalBackend probes everything the platform signal reader relies
+// on and explains how to fix whatever is missing.
+func checkSignalBackend(interfaceName string) []HealthCheck {
+	return signalReader.Check(interfaceName)
+}
+
+func hasCapability(capability uint) bool {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err == nil && caps&(1<<capability) != 0
+		}
+	}
+
+	return false
+}
+
+func logBackendHealth(interfaceName string) {
+	for _, check := range checkSignalBackend(interfaceName) {
+		if check.OK {
+			continue
+		}
+		log.Printf("signal backend check %q failed: %s (%s)", check.Name, check.Detail, check.Hint)
+	}
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := append(checkSignalBackend(*wifiInterface), positionProvider.Check()...)
+	checks = append(checks, sourceChecks()...)
+	checks = append(checks, influxCheck()...)
+	checks = append(checks, storageCheck())
+
+	ready := true
+	for _, check := range checks {
+		if check.Critical && !check.OK {
+			ready = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ready":    ready,
+		"readOnly": readOnly() != "",
+		"checks":   checks,
+	})
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultCanvasSize = 1000
+	failedSampleDbm   = -999
+)
+
+// HeatmapParams controls how a heatmap is interpolated and colored.
+type HeatmapParams struct {
+	Opacity float64
+	Scale   string
+	Grid    int
+	Power   float64
+	// Metric is the quantity shown; Min and Max are the ends of the color
+	// scale in its unit.
+	Metric   Metric
+	Min      float64
+	Max      float64
+	Accuracy bool
+	Method   string
+	// SSID and BSSID pick the scanned network shown, Band the band of
+	// the readings.
+	SSID  string
+	BSSID string
+	Band  string
+	// MaskDistance dims the heatmap further than this many meters from
+	// the nearest measurement; 0 disables the mask. MaskStyle is "fade"
+	// or "hatch".
+	MaskDistance float64
+	MaskStyle    string
+	// Session limits the heatmap to one survey session.
+	Session string
+	// Height limits the heatmap to measurements taken at these antenna
+	// heights.
+	Height heightRange
+	// Legend draws the color scale with its unit below the heatmap.
+	Legend bool
+	// Class is the data class shown, survey by default.
+	Class string
+	// Source is the radio shown, Wi-Fi by default.
+	Source string
+	// Aggregate merges measurements repeated at a spot before they are
+	// interpolated.
+	Aggregate aggregation
+}
+
+// colorScales map a normalized value in [0, 1] (bad to good) to
+// a color by linear interpolation between evenly spaced stops.
+var colorScales = map[string][]color.RGBA{
+	"default":   {{255, 0, 0, 255}, {255, 165, 0, 255}, {255, 255, 0, 255}, {124, 252, 0, 255}, {0, 255, 0, 255}},
+	"viridis":   {{68, 1, 84, 255}, {59, 82, 139, 255}, {33, 145, 140, 255}, {94, 201, 98, 255}, {253, 231, 37, 255}},
+	"grayscale": {{0, 0, 0, 255}, {255, 255, 255, 255}},
+}
+
+func parseHeatmapParams(query url.Values) (HeatmapParams, error) {
+	settings := effectiveSettings()
+	params := HeatmapParams{
+		Opacity:   0.6,
+		Scale:     settings.Palette,
+		Grid:      10,
+		Power:     2,
+		Method:    settings.Interpolation,
+		MaskStyle: "fade",
+	}
+
+	name := defaultMetric
+	if value := query.Get("metric"); value != "" {
+		name = value
+	}
+	metric, err := lookupMetric(name)
+	if err != nil {
+		return params, err
+	}
+	if name == scoreMetricName {
+		weights, err := scoreWeightsParam(query)
+		if err != nil {
+			return params, err
+		}
+		metric = scoreMetric(weights)
+	}
+	params.Metric, params.Min, params.Max = metric, metric.Min, metric.Max
+
+	floats := map[string]*float64{
+		"opacity": &params.Opacity,
+		"power":   &params.Power,
+		"min":     &params.Min,
+		"max":     &params.Max,
+		"mask":    &params.MaskDistance,
+	}
+	for name, target := range floats {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+				return params, fmt.Errorf("invalid %s", name)
+			}
+			*target = parsed
+		}
+	}
+
+	if value := query.Get("grid"); value != "" {
+		grid, err := strconv.Atoi(value)
+		if err != nil || grid < 1 || grid > 200 {
+			return params, fmt.Errorf("grid must be between 1 and 200 pixels")
+		}
+		params.Grid = grid
+	}
+	if value := query.Get("scale"); value != "" {
+		if _, ok := colorScales[value]; !ok {
+			return params, fmt.Errorf("unknown color scale %q", value)
+		}
+		params.Scale = value
+	}
+	params.Accuracy = query.Get("accuracy") == "true"
+	params.SSID = query.Get("ssid")
+	params.BSSID = query.Get("bssid")
+	signal, err := parseSignalFilter(query)
+	if err != nil {
+		return params, err
+	}
+	params.Band = signal.Band
+	params.Session = query.Get("session")
+	if params.Class, err = parseClass(query); err != nil {
+		return params, err
+	}
+	if params.Source, err = parseSource(query); err != nil {
+		return params, err
+	}
+	if params.Height, err = parseHeightRange(query); err != nil {
+		return params, err
+	}
+	if params.Aggregate, err = parseAggregation(query); err != nil {
+		return params, err
+	}
+	params.Legend = query.Get("legend") == "true"
+	if value := query.Get("method"); value != "" {
+		params.Method = value
+	}
+	if !validInterpolationMethod(params.Method) {
+		return params, fmt.Errorf("unknown interpolation method %q", params.Method)
+	}
+
+	if value := query.Get("maskStyle"); value != "" {
+		if value != "fade" && value != "hatch" {
+			return params, fmt.Errorf("maskStyle must be fade or hatch")
+		}
+		params.MaskStyle = value
+	}
+	if params.MaskDistance < 0 {
+		return params, fmt.Errorf("mask must not be negative")
+	}
+
+	if params.Opacity < 0 || params.Opacity > 1 {
+		return params, fmt.Errorf("opacity must be between 0 and 1")
+	}
+	if params.Min >= params.Max {
+		return params, fmt.Errorf("min must be lower than max")
+	}
+
+	return params, nil
+}
+
+// selectMeasurements picks the measurements the parameters ask for: the
+// approved ones of the class, source, session, height range and band, with
+// one signal source per point, merged into one per spot when asked to
+// aggregate.
+func (p HeatmapParams) selectMeasurements(ms []Measurement) []Measurement {
+	ms = sourceMeasurements(classMeasurements(approvedMeasurements(ms), p.Class), p.Source)
+	ms = bandMeasurements(heightMeasurements(sessionMeasurements(ms, p.Session), p.Height), p.Band)
+	ms = selectSignalSource(ms, p.SSID, p.BSSID)
+	if !p.Aggregate.Enabled {
+		return ms
+	}
+	merged := aggregateMeasurements(ms, p.Aggregate, false)
+	ms = make([]Measurement, len(merged))
+	for i, m := range merged {
+		ms[i] = m.Measurement
+	}
+	return ms
+}
+
+// colorFor colors a value of the metric, inverting the scale for metrics
+// where lower is better.
+func (p HeatmapParams) colorFor(value float64) color.RGBA {
+	stops := colorScales[p.Scale]
+	t := (value - p.Min) / (p.Max - p.Min)
+	if !p.Metric.HigherIsBetter {
+		t = 1 - t
+	}
+	t = math.Max(0, math.Min(1, t)) * float64(len(stops)-1)
+
+	i := int(t)
+	if i >= len(stops)-1 {
+		return stops[len(stops)-1]
+	}
+	f := t - float64(i)
+	a, b := stops[i], stops[i+1]
+	return color.RGBA{
+		R: uint8(float64(a.R) + f*(float64(b.R)-float64(a.R))),
+		G: uint8(float64(a.G) + f*(float64(b.G)-float64(a.G))),
+		B: uint8(float64(a.B) + f*(float64(b.B)-float64(a.B))),
+		A: 255,
+	}
+}
+
+// loadFloorMap decodes the uploaded map of a floor, returning nil when the
+// floor has no map.
+func loadFloorMap(floor Floor) (image.Image, error) {
+	if floor.MapPath == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(uploadFile(floor.MapPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode floor map: %v", err)
+	}
+
+	return img, nil
+}
+
+// heatmapPoint is a measurement in image pixel coordinates. Measurements are
+// stored in Leaflet CRS.Simple coordinates, where lat grows upwards from the
+// bottom edge of the floor map and lng is the pixel column.
+type heatmapPoint struct {
+	X, Y   float64
+	Value  float64
+	Weight float64
+}
+
+// heatmapPoints converts the measurements that have a value for the metric
+// of the parameters.
+func heatmapPoints(ms []Measurement, height int, params HeatmapParams) []heatmapPoint {
+	var points []heatmapPoint
+	for _, m := range ms {
+		value, ok := params.Metric.value(m)
+		if !ok {
+			continue
+		}
+
+		weight := 1.0
+		if params.Accuracy && m.Accuracy > 0 {
+			weight = 1 / (1 + m.Accuracy)
+		}
+
+		points = append(points, heatmapPoint{
+			X:      m.Lng,
+			Y:      float64(height) - m.Lat,
+			Value:  value,
+			Weight: weight,
+		})
+	}
+	return points
+}
+
+// canvasSize returns the size of the heatmap when the floor has no map,
+// large enough to contain every measurement.
+func canvasSize(ms []Measurement) (int, int) {
+	width, height := defaultCanvasSize, defaultCanvasSize
+	for _, m := range ms {
+		width = max(width, int(math.Ceil(m.Lng)))
+		height = max(height, int(math.Ceil(m.Lat)))
+	}
+	return width, height
+}
+
+// idw estimates the value at (x, y) by inverse distance weighting.
+func idw(points []heatmapPoint, x, y, power float64) float64 {
+	var sum, weights float64
+	for _, p := range points {
+		d := math.Hypot(p.X-x, p.Y-y)
+		if d < 1e-9 {
+			return p.Value
+		}
+		w := p.Weight / math.Pow(d, power)
+		sum += w * p.Value
+		weights += w
+	}
+	return sum / weights
+}
+
+// Extrapolated regions are faded to this fraction of the heatmap opacity,
+// over a transition band of maskTransition times the mask distance.
+const (
+	maskFadedOpacity = 0.25
+	maskTransition   = 0.25
+	maskHatchSpacing = 8
+)
+
+var errMaskUncalibrated = fmt.Errorf("the distance mask needs a calibrated or scaled floor")
+
+// maskFactor scales the overlay opacity of pixel (x, y), which lies distance
+// pixels from the nearest measurement. Beyond the limit the heatmap is
+// either faded or only drawn on diagonal hatch lines.
+func (p HeatmapParams) maskFactor(x, y int, distance, limit float64) float64 {
+	if distance <= limit {
+		return 1
+	}
+
+	if p.MaskStyle == "hatch" {
+		if (x+y)%maskHatchSpacing < 2 {
+			return 1
+		}
+		return 0
+	}
+
+	t := math.Min(1, (distance-limit)/(limit*maskTransition))
+	return 1 - t*(1-maskFadedOpacity)
+}
+
+// signalGrid holds interpolated values at grid nodes spaced Step pixels
+// apart, row by row, covering Bounds.
+type signalGrid struct {
+	Bounds     image.Rectangle
+	Cols, Rows int
+	Step       int
+	Values     []float64
+	Points     []heatmapPoint
+}
+
+// at returns the bilinearly interpolated grid value at pixel (x, y).
+func (g *signalGrid) at(values []float64, x, y int) float64 {
+	gx := float64(x) / float64(g.Step)
+	gy := float64(y) / float64(g.Step)
+	col, row := int(gx), int(gy)
+	fx, fy := gx-float64(col), gy-float64(row)
+
+	top := values[row*g.Cols+col]*(1-fx) + values[row*g.Cols+col+1]*fx
+	bottom := values[(row+1)*g.Cols+col]*(1-fx) + values[(row+1)*g.Cols+col+1]*fx
+	return top*(1-fy) + bottom*fy
+}
+
+// floorBounds returns the pixel area of a floor together with its decoded
+// map, which is nil for floors without one.
+func floorBounds(floor Floor, ms []Measurement) (image.Rectangle, image.Image, error) {
+	background, err := loadFloorMap(floor)
+	if err != nil {
+		return image.Rectangle{}, nil, err
+	}
+
+	if background != nil {
+		return image.Rect(0, 0, background.Bounds().Dx(), background.Bounds().Dy()), background, nil
+	}
+
+	width, height := canvasSize(ms)
+	return image.Rect(0, 0, width, height), nil, nil
+}
+
+// interpolateGrid selects the measurements the parameters ask for and
+// interpolates them over the grid. Values is nil when no usable point is
+// left.
+func interpolateGrid(ctx context.Context, bounds image.Rectangle, ms []Measurement, params HeatmapParams) (*signalGrid, error) {
+	g := &signalGrid{
+		Bounds: bounds,
+		Cols:   bounds.Dx()/params.Grid + 2,
+		Rows:   bounds.Dy()/params.Grid + 2,
+		Step:   params.Grid,
+	}
+
+	g.Points = heatmapPoints(params.selectMeasurements(ms), bounds.Dy(), params)
+	if len(g.Points) == 0 {
+		return g, nil
+	}
+
+	interpolator, err := newInterpolator(params.Method, g.Points, params)
+	if err != nil {
+		return nil, err
+	}
+
+	g.Values, err = sampleGrid(ctx, interpolator, g.Cols, g.Rows, g.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// renderHeatmap interpolates the measurements over a grid and composites the
+// colored result over the floor map. The grid and its coloring come from
+// the heatmap cache, which recomputes only what changed measurements reach.
+func renderHeatmap(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams) (image.Image, error) {
+	bounds, background, err := floorBounds(floor, ms)
+	if err != nil {
+		return nil, err
+	}
+	if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+		return nil, errMaskUncalibrated
+	}
+
+	grid, err := cachedHeatmapGrid(ctx, newHeatmapRequest(floor, ms, params, bounds.Dx(), bounds.Dy()))
+	if err != nil {
+		return nil, err
+	}
+	return grid.compose(background, params), nil
+}
+
+// compose draws the colored heatmap over the floor map, or over white for
+// floors without one.
+func (g *heatmapGrid) compose(background image.Image, params HeatmapParams) *image.RGBA {
+	bounds := g.grid.Bounds
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, image.White, image.Point{}, draw.Src)
+	if background != nil {
+		draw.Draw(canvas, bounds, background, background.Bounds().Min, draw.Over)
+	}
+	if g.grid.Values == nil {
+		return canvas
+	}
+
+	draw.Draw(canvas, bounds, g.overlay(params), image.Point{}, draw.Over)
+
+	if params.Legend {
+		drawLegend(canvas, params)
+	}
+
+	return canvas
+}
+
+// imageEncoder encodes rendered heatmaps and tiles in one format.
+type imageEncoder struct {
+	contentType string
+	encode      func(io.Writer, image.Image) error
+}
+
+// imageEncoders are the formats heatmaps and tiles are served in. WebP is
+// lossless like PNG and smaller, by about a third for tiles.
+var imageEncoders = map[string]imageEncoder{
+	"png":  {"image/png", png.Encode},
+	"webp": {"image/webp", encodeWebP},
+}
+
+// writeHeatmap renders through the bounded render pool and responds with
+// the image in format, png or webp. The encoded image is kept with the
+// cached heatmap, whose revision it carries as ETag.
+func writeHeatmap(w http.ResponseWriter, r *http.Request, floor Floor, ms []Measurement, params HeatmapParams, format string) {
+	encoder := imageEncoders[format]
+	if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+		http.Error(w, errMaskUncalibrated.Error(), http.StatusBadRequest)
+		return
+	}
+	width, height, err := heatmapBounds(floor, ms)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := newHeatmapRequest(floor, ms, params, width, height)
+
+	etag := req.etag(format)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		grid, err := cachedHeatmapGrid(ctx, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "heatmap rendering timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data, err := grid.cachedImage(format+":"+params.renderKey(), func() ([]byte, error) {
+			background, err := loadFloorMap(floor)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			if err := encoder.encode(&buf, grid.compose(background, params)); err != nil {
+				return nil, fmt.Errorf("failed to encode heatmap")
+			}
+			return buf.Bytes(), nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", encoder.contentType)
+		w.Write(data)
+	})
+}
+
+func heatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	floorID, err := strconv.Atoi(r.URL.Query().Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if building := r.URL.Query().Get("building"); building != "" && floor.Building != building {
+		http.Error(w, "floor not found in building", http.StatusNotFound)
+		return
+	}
+	if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+		http.Error(w, errMaskUncalibrated.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+		writeHeatmap(w, r, floor, filtered, params, "png")
+	case "png", "webp":
+		writeHeatmap(w, r, floor, filtered, params, format)
+	case "svg":
+		levels, err := contourLevelsParam(r.URL.Query(), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		withAnalyticsCache(func(w http.ResponseWriter, r *http.Request) {
+			writeContours(w, r, floor, filtered, params, levels)
+		})(w, r)
+	default:
+		http.Error(w, "format must be png, webp or svg", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseHeatmapParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{query: ""},
+		{query: "opacity=0.3&power=3&min=-90&max=-40&mask=5&grid=20"},
+		{query: "method=nearest&scale=viridis&maskStyle=hatch"},
+		{query: "min=NaN", wantErr: true},
+		{query: "max=NaN", wantErr: true},
+		{query: "min=-Inf", wantErr: true},
+		{query: "max=+Inf", wantErr: true},
+		{query: "opacity=NaN", wantErr: true},
+		{query: "power=Inf", wantErr: true},
+		{query: "mask=NaN", wantErr: true},
+		{query: "mask=Inf", wantErr: true},
+		{query: "opacity=1.5", wantErr: true},
+		{query: "mask=-1", wantErr: true},
+		{query: "min=-40&max=-90", wantErr: true},
+		{query: "grid=0", wantErr: true},
+		{query: "scale=rainbow", wantErr: true},
+		{query: "method=spline", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		params, err := parseHeatmapParams(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %+v, want an error", test.query, params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		}
+	}
+}
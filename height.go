@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// maxMeasurementHeight bounds the antenna height above the floor, in
+// meters; anything higher is taken for a typo.
+const maxMeasurementHeight = 20.0
+
+// heightRange selects measurements by the height of the antenna above the
+// floor, e.g. desk height against ceiling mounts. Either end may be open.
+// Measurements without a recorded height only match when both are.
+type heightRange struct {
+	Min, Max *float64
+}
+
+// parseHeightRange reads ?minHeight and ?maxHeight, in meters.
+func parseHeightRange(query url.Values) (heightRange, error) {
+	var h heightRange
+	for name, target := range map[string]**float64{"minHeight": &h.Min, "maxHeight": &h.Max} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+			return h, fmt.Errorf("invalid %s", name)
+		}
+		*target = &parsed
+	}
+	if h.Min != nil && h.Max != nil && *h.Min > *h.Max {
+		return h, fmt.Errorf("minHeight must not exceed maxHeight")
+	}
+	return h, nil
+}
+
+func (h heightRange) empty() bool {
+	return h.Min == nil && h.Max == nil
+}
+
+func (h heightRange) match(m Measurement) bool {
+	if h.empty() {
+		return true
+	}
+	if m.Height == nil {
+		return false
+	}
+	return (h.Min == nil || *m.Height >= *h.Min) && (h.Max == nil || *m.Height <= *h.Max)
+}
+
+// filters adds the range to export metadata.
+func (h heightRange) filters(filters map[string]string) {
+	if h.Min != nil {
+		filters["minHeight"] = strconv.FormatFloat(*h.Min, 'f', -1, 64)
+	}
+	if h.Max != nil {
+		filters["maxHeight"] = strconv.FormatFloat(*h.Max, 'f', -1, 64)
+	}
+}
+
+// heightMeasurements returns the measurements within the range.
+func heightMeasurements(ms []Measurement, h heightRange) []Measurement {
+	if h.empty() {
+		return ms
+	}
+
+	var selected []Measurement
+	for _, m := range ms {
+		if h.match(m) {
+			selected = append(selected, m)
+		}
+	}
+	return selected
+}
+
+// validateHeight checks an optional antenna height given with a
+// measurement.
+func validateHeight(height *float64) error {
+	if height != nil && !(*height >= 0 && *height <= maxMeasurementHeight) {
+		return fmt.Errorf("height must be between 0 and %g meters", maxMeasurementHeight)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseHeightRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		min, max float64
+		wantErr  bool
+	}{
+		{query: "", min: -1, max: -1},
+		{query: "minHeight=0.5", min: 0.5, max: -1},
+		{query: "maxHeight=2", min: -1, max: 2},
+		{query: "minHeight=1&maxHeight=1", min: 1, max: 1},
+		{query: "minHeight=2&maxHeight=1", wantErr: true},
+		{query: "minHeight=NaN", wantErr: true},
+		{query: "maxHeight=Inf", wantErr: true},
+		{query: "maxHeight=high", wantErr: true},
+	}
+
+	// -1 stands for an open end.
+	end := func(v *float64) float64 {
+		if v == nil {
+			return -1
+		}
+		return *v
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		h, err := parseHeightRange(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %v to %v, want an error", test.query, end(h.Min), end(h.Max))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if end(h.Min) != test.min || end(h.Max) != test.max {
+			t.Errorf("%q: parsed %v to %v, want %v to %v", test.query, end(h.Min), end(h.Max), test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hooksFile = "hooks.json"
+
+// Hook events: ingest runs before new measurements are stored, export
+// before measurements are written to an export.
+const (
+	hookIngest = "ingest"
+	hookExport = "export"
+)
+
+const (
+	defaultHookTimeout = 10
+	maxAttributes      = 32
+	maxAttributeLength = 256
+)
+
+// Hook is a program run on measurement events, configured in hooks.json,
+// so sites can enrich records, e.g. with room numbers from a facilities
+// database, without changing the server.
+//
+// The program gets the event as JSON on stdin:
+//
+//	{"event": "ingest", "project": "default", "measurements": [...]}
+//
+// and answers on stdout with changes to apply, by measurement ID:
+//
+//	{"measurements": [{"id": "abc", "location": "Room 2.14", "attributes": {"room": "2.14"}}]}
+//
+// Only location and attributes can be changed; attributes are merged into
+// the existing ones. A hook that fails or times out is logged and the
+// measurements pass unchanged.
+type Hook struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Events  []string `json:"events"`
+	// Timeout is in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type hookRequest struct {
+	Event        string        `json:"event"`
+	Project      string        `json:"project"`
+	Measurements []Measurement `json:"measurements"`
+}
+
+type hookPatch struct {
+	ID         string            `json:"id"`
+	Location   *string           `json:"location"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type hookResponse struct {
+	Measurements []hookPatch `json:"measurements"`
+}
+
+var (
+	hooks     []Hook
+	hooksLock sync.Mutex
+)
+
+func loadHooks() error {
+	data, err := os.ReadFile(hooksFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var loaded []Hook
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	for _, hook := range loaded {
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("hook %q has no command", hook.Name)
+		}
+		for _, event := range hook.Events {
+			if event != hookIngest && event != hookExport {
+				return fmt.Errorf("hook %q has unknown event %q", hook.Name, event)
+			}
+		}
+	}
+
+	hooksLock.Lock()
+	hooks = loaded
+	hooksLock.Unlock()
+	return nil
+}
+
+// runHooks passes the measurements through every hook of the event in
+// turn and applies their changes to ms in place.
+func runHooks(event string, ms []Measurement) {
+	if len(ms) == 0 {
+		return
+	}
+
+	hooksLock.Lock()
+	var selected []Hook
+	for _, hook := range hooks {
+		if slices.Contains(hook.Events, event) {
+			selected = append(selected, hook)
+		}
+	}
+	hooksLock.Unlock()
+
+	for _, hook := range selected {
+		patches, err := hook.run(event, ms)
+		if err != nil {
+			log.Printf("%s hook %q failed: %v", event, hook.Name, err)
+			continue
+		}
+		if err := applyHookPatches(ms, patches); err != nil {
+			log.Printf("%s hook %q: %v", event, hook.Name, err)
+		}
+	}
+}
+
+func (h Hook) run(event string, ms []Measurement) ([]hookPatch, error) {
+	input, err := json.Marshal(hookRequest{Event: event, Project: *project, Measurements: ms})
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %d s", timeout)
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response hookResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return response.Measurements, nil
+}
+
+// applyHookPatches checks all changes before applying any, so a bad
+// answer leaves the measurements as they were.
+func applyHookPatches(ms []Measurement, patches []hookPatch) error {
+	index := make(map[string]int, len(ms))
+	for i, m := range ms {
+		index[m.ID] = i
+	}
+
+	updated := make(map[int]Measurement)
+	for _, patch := range patches {
+		i, exists := index[patch.ID]
+		if !exists {
+			return fmt.Errorf("unknown measurement %q", patch.ID)
+		}
+		m, seen := updated[i]
+		if !seen {
+			m = ms[i]
+		}
+
+		if patch.Location != nil {
+			location, err := cleanText("location", *patch.Location, maxLocationLength, false)
+			if err != nil {
+				return err
+			}
+			m.Location = location
+		}
+		if len(patch.Attributes) > 0 {
+			merged := make(map[string]string, len(m.Attributes)+len(patch.Attributes))
+			for k, v := range m.Attributes {
+				merged[k] = v
+			}
+			for k, v := range patch.Attributes {
+				merged[k] = v
+			}
+			if err := validateAttributes(merged); err != nil {
+				return fmt.Errorf("measurement %s: %v", m.ID, err)
+			}
+			m.Attributes = merged
+		}
+		updated[i] = m
+	}
+
+	for i, m := range updated {
+		ms[i] = m
+	}
+	return nil
+}
+
+// validateAttributes checks the free-form attributes of a measurement.
+func validateAttributes(attributes map[string]string) error {
+	if len(attributes) > maxAttributes {
+		return fmt.Errorf("at most %d attributes are allowed", maxAttributes)
+	}
+	for k, v := range attributes {
+		if k == "" || len(k) > maxAttributeLength || len(v) > maxAttributeLength {
+			return fmt.Errorf("attribute names must be 1-%d and values up to %d bytes", maxAttributeLength, maxAttributeLength)
+		}
+	}
+	return nil
+}
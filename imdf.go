@@ -0,0 +1,564 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/vector"
+)
+
+const (
+	defaultImportPixelsPerMeter = 10
+	// maxImportedMapSize bounds the longer side of a drawn floor map; the
+	// resolution is lowered for large buildings.
+	maxImportedMapSize = 6000
+	importMapMargin    = 20
+)
+
+// geoFeature is a GeoJSON feature; the properties are those of IMDF where
+// it has them.
+type geoFeature struct {
+	ID       interface{} `json:"id"`
+	Geometry *struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []geoFeature `json:"features"`
+}
+
+// polygons returns the polygons of a Polygon or MultiPolygon feature as
+// rings of [lng, lat] positions, nil for other geometries.
+func (f geoFeature) polygons() ([][][][2]float64, error) {
+	if f.Geometry == nil {
+		return nil, nil
+	}
+	switch f.Geometry.Type {
+	case "Polygon":
+		var polygon [][][2]float64
+		if err := json.Unmarshal(f.Geometry.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		return [][][][2]float64{polygon}, nil
+	case "MultiPolygon":
+		var polygons [][][][2]float64
+		err := json.Unmarshal(f.Geometry.Coordinates, &polygons)
+		return polygons, err
+	}
+	return nil, nil
+}
+
+func (f geoFeature) id() string {
+	switch id := f.ID.(type) {
+	case string:
+		return id
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	}
+	return ""
+}
+
+// text reads a property that is either a string or, as IMDF labels are, an
+// object of translations, preferring the language.
+func (f geoFeature) text(name, language string) string {
+	raw := f.Properties[name]
+	var plain string
+	if json.Unmarshal(raw, &plain) == nil {
+		return plain
+	}
+	var labels map[string]string
+	if json.Unmarshal(raw, &labels) != nil || len(labels) == 0 {
+		return ""
+	}
+	for _, preferred := range []string{language, "en"} {
+		if label, exists := labels[preferred]; exists {
+			return label
+		}
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return labels[keys[0]]
+}
+
+func (f geoFeature) number(name string) (float64, bool) {
+	var value float64
+	return value, json.Unmarshal(f.Properties[name], &value) == nil
+}
+
+func (f geoFeature) strings(name string) []string {
+	var values []string
+	json.Unmarshal(f.Properties[name], &values)
+	return values
+}
+
+// importedLevel is a floor read from IMDF or GeoJSON, before its floor is
+// created.
+type importedLevel struct {
+	ID        string
+	Name      string
+	Ordinal   int
+	Building  string
+	Footprint [][][][2]float64
+	Units     []importedUnit
+}
+
+// importedUnit is a room or other unit of a level. Named units become
+// zones.
+type importedUnit struct {
+	Name     string
+	Category string
+	Polygons [][][][2]float64
+}
+
+// readIMDF reads the levels of an IMDF archive with their units, and the
+// names of its buildings by ID.
+func readIMDF(data []byte, language string) ([]importedLevel, map[string]string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid archive: %v", err)
+	}
+
+	collections := make(map[string]geoFeatureCollection)
+	for _, file := range archive.File {
+		name := path.Base(file.Name)
+		if !strings.HasSuffix(name, ".geojson") || strings.HasPrefix(name, "._") {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		var collection geoFeatureCollection
+		err = json.NewDecoder(reader).Decode(&collection)
+		reader.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		collections[strings.TrimSuffix(name, ".geojson")] = collection
+	}
+	if _, exists := collections["level"]; !exists {
+		return nil, nil, fmt.Errorf("archive has no level.geojson")
+	}
+
+	buildingNames := make(map[string]string)
+	for _, feature := range collections["building"].Features {
+		buildingNames[feature.id()] = feature.text("name", language)
+	}
+
+	var levels []importedLevel
+	index := make(map[string]int)
+	for _, feature := range collections["level"].Features {
+		footprint, err := feature.polygons()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid geometry of level %s: %v", feature.id(), err)
+		}
+		if footprint == nil {
+			continue
+		}
+		ordinal, _ := feature.number("ordinal")
+		level := importedLevel{
+			ID:        feature.id(),
+			Name:      feature.text("name", language),
+			Ordinal:   int(ordinal),
+			Footprint: footprint,
+		}
+		if level.Name == "" {
+			level.Name = feature.text("short_name", language)
+		}
+		if buildingIDs := feature.strings("building_ids"); len(buildingIDs) > 0 {
+			level.Building = buildingIDs[0]
+		}
+		index[level.ID] = len(levels)
+		levels = append(levels, level)
+	}
+
+	for _, feature := range collections["unit"].Features {
+		var levelID string
+		json.Unmarshal(feature.Properties["level_id"], &levelID)
+		i, exists := index[levelID]
+		if !exists {
+			continue
+		}
+		polygons, err := feature.polygons()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid geometry of unit %s: %v", feature.id(), err)
+		}
+		var category string
+		json.Unmarshal(feature.Properties["category"], &category)
+		levels[i].Units = append(levels[i].Units, importedUnit{
+			Name:     feature.text("name", language),
+			Category: category,
+			Polygons: polygons,
+		})
+	}
+
+	return levels, buildingNames, nil
+}
+
+// readGeoJSONFloors reads a FeatureCollection of floor footprints: every
+// Polygon or MultiPolygon feature is a floor, named by its name property
+// and ordered by ordinal or level.
+func readGeoJSONFloors(data []byte, language string) ([]importedLevel, error) {
+	var collection geoFeatureCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("GeoJSON must be a FeatureCollection")
+	}
+
+	var levels []importedLevel
+	for i, feature := range collection.Features {
+		footprint, err := feature.polygons()
+		if err != nil {
+			return nil, fmt.Errorf("invalid geometry of feature %d: %v", i, err)
+		}
+		if footprint == nil {
+			continue
+		}
+		level := importedLevel{ID: feature.id(), Name: feature.text("name", language), Footprint: footprint}
+		for _, property := range []string{"ordinal", "level"} {
+			if ordinal, ok := feature.number(property); ok {
+				level.Ordinal = int(ordinal)
+				break
+			}
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// importProjection places the levels on maps of the same extent, north up,
+// so a position is at the same pixel on every floor of the import.
+type importProjection struct {
+	minLng, maxLat     float64
+	pixelsPerDegreeLng float64
+	pixelsPerDegreeLat float64
+	width, height      int
+}
+
+func newImportProjection(levels []importedLevel, pixelsPerMeter float64) (importProjection, error) {
+	minLng, minLat, maxLng, maxLat := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, level := range levels {
+		for _, polygon := range level.Footprint {
+			for _, ring := range polygon {
+				for _, position := range ring {
+					lng, lat := position[0], position[1]
+					if lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+						return importProjection{}, fmt.Errorf("coordinates must be WGS 84 longitude and latitude")
+					}
+					minLng, maxLng = min(minLng, lng), max(maxLng, lng)
+					minLat, maxLat = min(minLat, lat), max(maxLat, lat)
+				}
+			}
+		}
+	}
+	if minLng >= maxLng || minLat >= maxLat {
+		return importProjection{}, fmt.Errorf("the footprints have no area")
+	}
+
+	metersPerDegree := math.Pi / 180 * earthRadiusMeters
+	cosLat := math.Cos((minLat + maxLat) / 2 * math.Pi / 180)
+	widthMeters := (maxLng - minLng) * metersPerDegree * cosLat
+	heightMeters := (maxLat - minLat) * metersPerDegree
+	pixelsPerMeter = min(pixelsPerMeter, (maxImportedMapSize-2*importMapMargin)/max(widthMeters, heightMeters))
+
+	return importProjection{
+		minLng:             minLng,
+		maxLat:             maxLat,
+		pixelsPerDegreeLng: metersPerDegree * cosLat * pixelsPerMeter,
+		pixelsPerDegreeLat: metersPerDegree * pixelsPerMeter,
+		width:              int(math.Ceil(widthMeters*pixelsPerMeter)) + 2*importMapMargin,
+		height:             int(math.Ceil(heightMeters*pixelsPerMeter)) + 2*importMapMargin,
+	}, nil
+}
+
+func (p importProjection) toPixel(position [2]float64) (float64, float64) {
+	return importMapMargin + (position[0]-p.minLng)*p.pixelsPerDegreeLng,
+		importMapMargin + (p.maxLat-position[1])*p.pixelsPerDegreeLat
+}
+
+// calibration is the transform of the drawn maps back to geographic
+// coordinates.
+func (p importProjection) calibration() *Calibration {
+	c := &Calibration{Affine: [6]float64{
+		1 / p.pixelsPerDegreeLng, 0, p.minLng - importMapMargin/p.pixelsPerDegreeLng,
+		0, -1 / p.pixelsPerDegreeLat, p.maxLat + importMapMargin/p.pixelsPerDegreeLat,
+	}}
+	c.MetersPerPixel = c.metersPerPixel()
+	return c
+}
+
+var (
+	importBackground = color.RGBA{240, 240, 240, 255}
+	importFloor      = color.RGBA{255, 255, 255, 255}
+	importUnit       = color.RGBA{228, 234, 242, 255}
+	importUnitEdge   = color.RGBA{110, 110, 110, 255}
+	importFloorEdge  = color.RGBA{0, 0, 0, 255}
+)
+
+// drawLevel draws the footprint of a level with its units as a floor map.
+func (p importProjection) drawLevel(level importedLevel) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, p.width, p.height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{importBackground}, image.Point{}, draw.Src)
+
+	fill := func(polygons [][][][2]float64, c color.RGBA) {
+		rasterizer := vector.NewRasterizer(p.width, p.height)
+		for _, polygon := range polygons {
+			for _, ring := range polygon {
+				for i, position := range ring {
+					x, y := p.toPixel(position)
+					if i == 0 {
+						rasterizer.MoveTo(float32(x), float32(y))
+					} else {
+						rasterizer.LineTo(float32(x), float32(y))
+					}
+				}
+				rasterizer.ClosePath()
+			}
+		}
+		rasterizer.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{})
+	}
+	outline := func(polygons [][][][2]float64, c color.RGBA) {
+		for _, polygon := range polygons {
+			for _, ring := range polygon {
+				for i := 1; i < len(ring); i++ {
+					x0, y0 := p.toPixel(ring[i-1])
+					x1, y1 := p.toPixel(ring[i])
+					drawLine(img, int(math.Round(x0)), int(math.Round(y0)), int(math.Round(x1)), int(math.Round(y1)), c)
+				}
+			}
+		}
+	}
+
+	fill(level.Footprint, importFloor)
+	for _, unit := range level.Units {
+		fill(unit.Polygons, importUnit)
+	}
+	for _, unit := range level.Units {
+		outline(unit.Polygons, importUnitEdge)
+	}
+	outline(level.Footprint, importFloorEdge)
+	return img
+}
+
+// unitZones returns a zone for every named unit of a level, outlined by the
+// outer ring of its largest polygon, in the coordinates of the floor.
+func (p importProjection) unitZones(level importedLevel, floorID int) []Zone {
+	var result []Zone
+	for _, unit := range level.Units {
+		name, err := cleanText("name", unit.Name, maxNameLength, false)
+		if err != nil || name == "" {
+			continue
+		}
+		var best []Vertex
+		for _, polygon := range unit.Polygons {
+			if len(polygon) == 0 || len(polygon[0]) < 3 {
+				continue
+			}
+			var vertices []Vertex
+			ring := polygon[0]
+			// GeoJSON rings repeat the first position at the end.
+			if ring[0] == ring[len(ring)-1] {
+				ring = ring[:len(ring)-1]
+			}
+			for _, position := range ring {
+				x, y := p.toPixel(position)
+				vertices = append(vertices, Vertex{Lat: float64(p.height) - y, Lng: x})
+			}
+			if len(vertices) >= 3 && (best == nil || polygonArea(vertices) > polygonArea(best)) {
+				best = vertices
+			}
+		}
+		if best != nil {
+			result = append(result, Zone{ID: generateID(), Floor: floorID, Name: name, Kind: unit.Category, Polygon: best})
+		}
+	}
+	return result
+}
+
+// floorImportHandler creates floors from indoor maps: an IMDF archive, or a
+// GeoJSON FeatureCollection of floor footprints, sent as the body or as the
+// form field "file". Each level gets a drawn map, north up at
+// ?pixelsPerMeter (10 by default), calibrated to its geographic position.
+// Named IMDF units become zones, and IMDF buildings are created unless the
+// floors are put into ?building.
+func floorImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	building := query.Get("building")
+	if building != "" {
+		if _, exists := getBuilding(building); !exists {
+			http.Error(w, "building not found", http.StatusBadRequest)
+			return
+		}
+	}
+	pixelsPerMeter := float64(defaultImportPixelsPerMeter)
+	if value := query.Get("pixelsPerMeter"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || parsed > 100 {
+			http.Error(w, "pixelsPerMeter must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		pixelsPerMeter = parsed
+	}
+	language := query.Get("language")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFloorArchiveSize)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "failed to get file from form", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var levels []importedLevel
+	var buildingNames map[string]string
+	if bytes.HasPrefix(data, []byte("PK")) {
+		levels, buildingNames, err = readIMDF(data, language)
+	} else {
+		levels, err = readGeoJSONFloors(data, language)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(levels) == 0 {
+		http.Error(w, "no floor footprints found", http.StatusBadRequest)
+		return
+	}
+	if len(levels) > maxFloorArchiveFloors {
+		http.Error(w, fmt.Sprintf("at most %d floors can be imported at once", maxFloorArchiveFloors), http.StatusBadRequest)
+		return
+	}
+	sort.SliceStable(levels, func(i, j int) bool { return levels[i].Ordinal < levels[j].Ordinal })
+
+	projection, err := newImportProjection(levels, pixelsPerMeter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Every IMDF building the levels are in becomes a building, unless
+	// the floors go into the given one.
+	buildingIDs := make(map[string]string)
+	if building == "" {
+		buildingsLock.Lock()
+		for _, level := range levels {
+			if _, done := buildingIDs[level.Building]; done || level.Building == "" {
+				continue
+			}
+			name := buildingNames[level.Building]
+			if name, err = cleanText("name", name, maxNameLength, false); err != nil || name == "" {
+				name = "Imported building"
+			}
+			created := Building{ID: generateID(), Name: name}
+			buildings[created.ID] = created
+			buildingIDs[level.Building] = created.ID
+		}
+		buildingsLock.Unlock()
+		if len(buildingIDs) > 0 {
+			if err := saveBuildings(); err != nil {
+				http.Error(w, "failed to save buildings", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	calibration := projection.calibration()
+	mutex.Lock()
+	nextID := 1
+	for id := range floors {
+		nextID = max(nextID, id+1)
+	}
+	created := make([]Floor, len(levels))
+	for i, level := range levels {
+		name, err := cleanText("name", level.Name, maxNameLength, false)
+		if err != nil || name == "" {
+			name = fmt.Sprintf("Level %d", level.Ordinal)
+		}
+		floorBuilding := building
+		if floorBuilding == "" {
+			floorBuilding = buildingIDs[level.Building]
+		}
+		floorCalibration := *calibration
+		created[i] = Floor{ID: nextID + i, Name: name, Order: level.Ordinal, Building: floorBuilding, Calibration: &floorCalibration}
+		floors[created[i].ID] = created[i]
+	}
+	mutex.Unlock()
+
+	var importedZones []Zone
+	for i, level := range levels {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, projection.drawLevel(level)); err != nil {
+			removeFloors(created)
+			http.Error(w, "failed to encode floor map", http.StatusInternalServerError)
+			return
+		}
+		floor, err := saveFloorMap(created[i].ID, ".png", &buf)
+		if err != nil {
+			removeFloors(created)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		created[i] = floor
+		importedZones = append(importedZones, projection.unitZones(level, floor.ID)...)
+	}
+
+	if len(importedZones) > 0 {
+		zonesLock.Lock()
+		for _, zone := range importedZones {
+			zones[zone.ID] = zone
+		}
+		zonesLock.Unlock()
+		if err := saveZones(); err != nil {
+			http.Error(w, "failed to save zones", http.StatusInternalServerError)
+			return
+		}
+	}
+	actor := auditActor(r)
+	for _, floor := range created {
+		publishFloor(eventFloorCreated, floor)
+		auditFloor(actor, eventFloorCreated, "imported from IMDF", floor.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"floors": created,
+		"zones":  len(importedZones),
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxImportSize = 50 << 20
+	// maxImportErrors caps the row errors reported back.
+	maxImportErrors = 100
+)
+
+type ImportError struct {
+	// File is set for rows from a zip archive.
+	File  string `json:"file,omitempty"`
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// ImportResult reports what an import inserted, or would insert in a dry
+// run.
+type ImportResult struct {
+	DryRun     bool          `json:"dryRun"`
+	Inserted   int           `json:"inserted"`
+	Duplicates int           `json:"duplicates"`
+	Invalid    int           `json:"invalid"`
+	Floors     map[int]int   `json:"floors"`
+	Errors     []ImportError `json:"errors,omitempty"`
+}
+
+// importRow is a parsed record, or the reason it could not be parsed.
+// Projected rows were positioned by easting and northing in a reference
+// system instead of floor coordinates.
+type importRow struct {
+	File        string
+	Row         int
+	Measurement Measurement
+	Err         error
+
+	Projected         bool
+	Easting, Northing float64
+}
+
+// parseImportCSV reads the layout written by writeMeasurementsCSV. Columns
+// are matched by header name, so their order does not matter, and comment
+// lines such as the export metadata are skipped. Instead of lat and lng,
+// rows may be positioned with easting and northing columns, as written by
+// surveying equipment.
+func parseImportCSV(r io.Reader, file string) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%sfailed to read the CSV header: %v", filePrefix(file), err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"timestamp", "dbm", "floor"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%sthe CSV has no %s column", filePrefix(file), name)
+		}
+	}
+	_, hasLat := columns["lat"]
+	_, hasLng := columns["lng"]
+	_, hasEasting := columns["easting"]
+	_, hasNorthing := columns["northing"]
+	if !(hasLat && hasLng) && !(hasEasting && hasNorthing) {
+		return nil, fmt.Errorf("%sthe CSV needs lat and lng or easting and northing columns", filePrefix(file))
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			rows = append(rows, importRow{File: file, Row: line, Err: err})
+			continue
+		}
+
+		rows = append(rows, parseCSVRecord(record, columns, file, line))
+	}
+}
+
+func filePrefix(file string) string {
+	if file == "" {
+		return ""
+	}
+	return file + ": "
+}
+
+func parseCSVRecord(record []string, columns map[string]int, file string, line int) importRow {
+	row := importRow{File: file, Row: line}
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	number := func(name string) float64 {
+		value := field(name)
+		if value == "" || row.Err != nil {
+			return 0
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			row.Err = fmt.Errorf("invalid %s %q", name, value)
+		}
+		return parsed
+	}
+	optional := func(name string) *float64 {
+		if field(name) == "" {
+			return nil
+		}
+		value := number(name)
+		return &value
+	}
+
+	m := Measurement{
+		ID:        field("id"),
+		Location:  csvUntext(field("location")),
+		Type:      csvUntext(field("type")),
+		SSID:      csvUntext(field("ssid")),
+		BSSID:     field("bssid"),
+		Source:    field("source"),
+		Class:     field("class"),
+		Dbm:       int(number("dbm")),
+		Lat:       number("lat"),
+		Lng:       number("lng"),
+		Floor:     int(number("floor")),
+		Accuracy:  number("accuracy"),
+		Freq:      int(number("freq")),
+		Channel:   int(number("channel")),
+		TxBitrate: number("tx_bitrate"),
+
+		LatencyMs:      optional("latency_ms"),
+		ThroughputMbps: optional("throughput_mbps"),
+		UploadMbps:     optional("upload_mbps"),
+		LossPercent:    optional("loss_pct"),
+		Height:         optional("height_m"),
+		JitterMs:       optional("jitter_ms"),
+		NoiseDbm:       optional("noise_dbm"),
+		SNRDb:          optional("snr_db"),
+		BusyPercent:    optional("busy_pct"),
+	}
+	if field("easting") != "" || field("northing") != "" {
+		row.Projected = true
+		row.Easting, row.Northing = number("easting"), number("northing")
+		if field("easting") == "" || field("northing") == "" {
+			row.Err = fmt.Errorf("easting and northing must both be given")
+		}
+	}
+	if value := field("attributes"); value != "" && row.Err == nil {
+		if err := json.Unmarshal([]byte(value), &m.Attributes); err != nil {
+			row.Err = fmt.Errorf("invalid attributes: %v", err)
+		}
+	}
+	if row.Err != nil {
+		return row
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, field("timestamp"))
+	if err != nil {
+		row.Err = fmt.Errorf("invalid timestamp %q", field("timestamp"))
+		return row
+	}
+	m.Timestamp = timestamp
+
+	row.Measurement = m
+	return row
+}
+
+// parseImportJSON reads an array of measurements as returned by
+// /api/measurements.
+func parseImportJSON(data []byte) ([]importRow, error) {
+	var list []Measurement
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	rows := make([]importRow, len(list))
+	for i, m := range list {
+		rows[i] = importRow{Row: i + 1, Measurement: m}
+	}
+	return rows, nil
+}
+
+// parseImportZip reads every CSV of an archive, as produced by
+// /api/export?split=floor.
+func parseImportZip(data []byte) ([]importRow, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid zip archive: %v", err)
+	}
+
+	var rows []importRow
+	for _, entry := range archive.File {
+		if path.Ext(entry.Name) != ".csv" {
+			continue
+		}
+		file, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseImportCSV(io.LimitReader(file, maxImportSize), entry.Name)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, parsed...)
+	}
+	return rows, nil
+}
+
+// validateImported checks a record as addMeasurementHandler would check a
+// request, and fills in the defaults of fields the source left out.
+func validateImported(m *Measurement) error {
+	if m.Timestamp.IsZero() {
+		return fmt.Errorf("timestamp is required")
+	}
+	for _, v := range []float64{m.Lat, m.Lng, m.Accuracy, m.TxBitrate} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("coordinates and numbers must be finite")
+		}
+	}
+	if m.Accuracy < 0 {
+		return fmt.Errorf("accuracy must not be negative")
+	}
+	var err error
+	if m.Location, err = cleanText("location", m.Location, maxLocationLength, false); err != nil {
+		return err
+	}
+	for name, value := range map[string]*float64{"latency": m.LatencyMs, "jitter": m.JitterMs, "throughput": m.ThroughputMbps, "upload": m.UploadMbps, "loss": m.LossPercent} {
+		if value != nil && (!(*value >= 0) || math.IsInf(*value, 0)) {
+			return fmt.Errorf("%s must be a finite, non-negative number", name)
+		}
+	}
+	if m.LossPercent != nil && *m.LossPercent > 100 {
+		return fmt.Errorf("loss must not exceed 100%%")
+	}
+	if m.BusyPercent != nil && !(*m.BusyPercent >= 0 && *m.BusyPercent <= 100) {
+		return fmt.Errorf("busy must be between 0 and 100%%")
+	}
+	for name, value := range map[string]*float64{"noise": m.NoiseDbm, "snr": m.SNRDb} {
+		if value != nil && (math.IsNaN(*value) || math.IsInf(*value, 0)) {
+			return fmt.Errorf("%s must be finite", name)
+		}
+	}
+	if err := validateHeight(m.Height); err != nil {
+		return err
+	}
+	if err := validateAttributes(m.Attributes); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	_, exists := floors[m.Floor]
+	mutex.Unlock()
+	if !exists {
+		return fmt.Errorf("floor %d not found", m.Floor)
+	}
+
+	if m.SessionID != "" {
+		if _, exists := getSession(m.SessionID); !exists {
+			return fmt.Errorf("session %q not found", m.SessionID)
+		}
+	}
+
+	if m.ID == "" {
+		m.ID = newMeasurementID()
+	}
+	if m.Type == "" {
+		m.Type = "location"
+	}
+	if m.Source, err = measurementSource(m.Source); err != nil {
+		return err
+	}
+	if m.Dbm != failedSampleDbm && (m.Dbm > 0 || m.Dbm < minSourceDbm(m.Source)) {
+		return fmt.Errorf("signal %d dBm is out of range", m.Dbm)
+	}
+	if m.Class, err = measurementClass(m.Class, classSurvey); err != nil {
+		return err
+	}
+	m.BSSID = strings.ToLower(m.BSSID)
+	return nil
+}
+
+// importHandler loads measurements from a CSV export, a zip of per-floor
+// CSVs or a JSON array. Records whose ID already exists are skipped and
+// invalid rows are reported; with ?dryRun=true nothing is stored. Rows
+// given in easting and northing are converted from ?crs, or the project's
+// CRS, onto their calibrated floor.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var rows []importRow
+	contentType := r.Header.Get("Content-Type")
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case strings.HasPrefix(contentType, "application/zip") || bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		rows, err = parseImportZip(data)
+	case strings.HasPrefix(contentType, "application/json") || bytes.HasPrefix(trimmed, []byte("[")):
+		rows, err = parseImportJSON(trimmed)
+	default:
+		rows, err = parseImportCSV(bytes.NewReader(data), "")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]bool)
+	mutex.Lock()
+	for _, m := range measurements {
+		seen[m.ID] = true
+	}
+	mutex.Unlock()
+
+	var crs *CRS
+	for _, row := range rows {
+		if row.Projected {
+			resolved, err := projectCRS(r.URL.Query().Get("crs"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			crs = &resolved
+			break
+		}
+	}
+	transforms := make(map[int]func(lat, lng float64) (float64, float64))
+
+	result := ImportResult{DryRun: dryRun, Floors: make(map[int]int)}
+	var records []Measurement
+	for _, row := range rows {
+		if row.Err == nil && row.Projected {
+			row.Err = placeProjected(&row, *crs, transforms)
+		}
+		if row.Err == nil {
+			row.Err = validateImported(&row.Measurement)
+		}
+		if row.Err != nil {
+			result.Invalid++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, ImportError{File: row.File, Row: row.Row, Error: row.Err.Error()})
+			}
+			continue
+		}
+
+		if seen[row.Measurement.ID] {
+			result.Duplicates++
+			continue
+		}
+		seen[row.Measurement.ID] = true
+
+		records = append(records, row.Measurement)
+		result.Floors[row.Measurement.Floor]++
+	}
+	result.Inserted = len(records)
+
+	if !dryRun && len(records) > 0 {
+		if err := insertMeasurements(auditActor(r), auditMeasurementsImported, records); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// placeProjected converts the easting and northing of a row to floor
+// coordinates through WGS 84 and the calibration of its floor. transforms
+// caches the floor transforms across rows.
+func placeProjected(row *importRow, crs CRS, transforms map[int]func(lat, lng float64) (float64, float64)) error {
+	m := &row.Measurement
+	toFloor, ok := transforms[m.Floor]
+	if !ok {
+		var err error
+		if toFloor, err = floorTransform(m.Floor); err != nil {
+			return err
+		}
+		transforms[m.Floor] = toFloor
+	}
+
+	lat, lng := crs.toWGS84(row.Easting, row.Northing)
+	m.Lat, m.Lng = toFloor(lat, lng)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		// rows are the expected rows, by Dbm, or "error" for a row that
+		// must fail.
+		rows    []string
+		wantErr bool
+	}{
+		{
+			name: "minimal",
+			csv:  "timestamp,dbm,floor,lat,lng\n2025-04-02T14:33:13Z,-55,2,100.5,723.5\n",
+			rows: []string{"-55"},
+		},
+		{
+			name: "reordered with metadata comments",
+			csv:  "# exported by heatgen\nlng,floor,dbm,lat,timestamp\n# note\n723.5,2,-61,100.5,2025-04-02T14:33:13Z\n",
+			rows: []string{"-61"},
+		},
+		{
+			name: "projected",
+			csv:  "timestamp,dbm,floor,easting,northing\n2025-04-02T14:33:13Z,-70,1,500000,5500000\n",
+			rows: []string{"-70"},
+		},
+		{
+			name: "invalid rows are reported, not fatal",
+			csv: "timestamp,dbm,floor,lat,lng\n" +
+				"2025-04-02T14:33:13Z,loud,2,1,1\n" +
+				"yesterday,-60,2,1,1\n" +
+				"2025-04-02T14:33:13Z,-60,2,1,1\n",
+			rows: []string{"error", "error", "-60"},
+		},
+		{
+			name: "half projected",
+			csv:  "timestamp,dbm,floor,easting,northing\n2025-04-02T14:33:13Z,-70,1,500000,\n",
+			rows: []string{"error"},
+		},
+		{
+			name: "invalid attributes",
+			csv:  "timestamp,dbm,floor,lat,lng,attributes\n2025-04-02T14:33:13Z,-70,1,1,1,{oops\n",
+			rows: []string{"error"},
+		},
+		{
+			name:    "no floor column",
+			csv:     "timestamp,dbm,lat,lng\n2025-04-02T14:33:13Z,-55,100.5,723.5\n",
+			wantErr: true,
+		},
+		{
+			name:    "no position",
+			csv:     "timestamp,dbm,floor,lat\n2025-04-02T14:33:13Z,-55,2,100.5\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			csv:     "",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := parseImportCSV(strings.NewReader(test.csv), "")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %d rows, want an error", len(rows))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, row := range rows {
+				if row.Err != nil {
+					got = append(got, "error")
+				} else {
+					got = append(got, strconv.Itoa(row.Measurement.Dbm))
+				}
+			}
+			if !reflect.DeepEqual(got, test.rows) {
+				t.Errorf("rows %v, want %v", got, test.rows)
+			}
+		})
+	}
+}
+
+// TestCSVRoundTrip checks that an export imports back to the same
+// measurements, free text that looks like a formula included.
+func TestCSVRoundTrip(t *testing.T) {
+	latency, upload, height := 12.5, 0.0, 1.2
+	exported := []Measurement{
+		{
+			ID: "a1", Timestamp: time.Date(2025, 4, 2, 14, 33, 13, 0, time.UTC), Dbm: -55,
+			Lat: 100.5, Lng: 723.25, Floor: 2, Location: "=HYPERLINK(\"x\")", Type: "location",
+			SSID: "-Office", BSSID: "aa:bb:cc:dd:ee:ff", Freq: 5180, Channel: 36, TxBitrate: 866.7,
+			LatencyMs: &latency, UploadMbps: &upload, Height: &height,
+			Attributes: map[string]string{"room": "101"},
+		},
+		{
+			ID: "b2", Timestamp: time.Date(2025, 4, 2, 15, 0, 0, 0, time.UTC), Dbm: -110,
+			Lat: 1, Lng: 2, Floor: 3, Location: "\tLobby", Type: "scan", Accuracy: 2.5,
+			Source: sourceCellular, Class: classMonitoring,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeMeasurementsCSV(&buf, exported, nil, timeStyle{}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parseImportCSV(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(exported) {
+		t.Fatalf("imported %d rows, want %d", len(rows), len(exported))
+	}
+	for i, row := range rows {
+		if row.Err != nil {
+			t.Fatalf("row %d: %v", row.Row, row.Err)
+		}
+		got, want := row.Measurement, exported[i]
+		got.Timestamp, want.Timestamp = got.Timestamp.UTC(), want.Timestamp.UTC()
+		// The export names the default source and class, which the
+		// import stores as empty, like validateImported.
+		if got.Source, err = measurementSource(got.Source); err != nil {
+			t.Fatal(err)
+		}
+		if got.Class, err = measurementClass(got.Class, classSurvey); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("row %d imported as\n%+v\nwant\n%+v", row.Row, got, want)
+		}
+	}
+}
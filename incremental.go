@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"math"
+)
+
+// IncrementalInterpolator is implemented by interpolators that can bring
+// a sampled grid up to date when points are added or removed, visiting
+// only what the change affects instead of estimating every node from
+// every point again. The heatmap cache uses it when measurements change.
+type IncrementalInterpolator interface {
+	Interpolator
+	// SampleIncremental samples the grid like sampleGrid.
+	SampleIncremental(ctx context.Context, cols, rows, step int) (GridSampling, error)
+}
+
+// GridSampling is a grid sampled by an IncrementalInterpolator.
+type GridSampling interface {
+	// Values are the node values, row by row. They must not be modified.
+	Values() []float64
+	// Update returns the sampling of the points with added added and
+	// removed removed, leaving the receiver as it was, and which nodes
+	// changed.
+	Update(ctx context.Context, added, removed []heatmapPoint) (GridSampling, []bool, error)
+}
+
+// removePoints returns points without one occurrence of each of removed.
+func removePoints(points, removed []heatmapPoint) []heatmapPoint {
+	drop := make(map[heatmapPoint]int, len(removed))
+	for _, p := range removed {
+		drop[p]++
+	}
+	kept := make([]heatmapPoint, 0, len(points))
+	for _, p := range points {
+		if drop[p] > 0 {
+			drop[p]--
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// dominantShare is the share of the weights of a node above which removing
+// a point sums the node again from scratch: subtracting the term would
+// cancel most of the sums, and the rounding of the points left with it.
+const dominantShare = 0.5
+
+// idwSampling keeps the weighted sums of every node, so a changed point
+// costs one term per node rather than the whole sum.
+type idwSampling struct {
+	cols, rows, step int
+	power            float64
+	points           []heatmapPoint
+	num, den         []float64
+	// hits counts the points lying on each node, whose value is then that
+	// of such a point, as in idw.
+	hits   []int
+	values []float64
+}
+
+func (i idwInterpolator) SampleIncremental(ctx context.Context, cols, rows, step int) (GridSampling, error) {
+	s := &idwSampling{
+		cols: cols, rows: rows, step: step, power: i.power, points: i.points,
+		num: make([]float64, cols*rows), den: make([]float64, cols*rows),
+		hits: make([]int, cols*rows), values: make([]float64, cols*rows),
+	}
+	if err := s.add(ctx, i.points, 1, nil, nil); err != nil {
+		return nil, err
+	}
+	s.resolve(nil)
+	return s, nil
+}
+
+// add adds the terms of points to every node, or subtracts them with sign
+// -1, marking the nodes in touched, and in dominated those where a
+// subtracted term made up most of the weights.
+func (s *idwSampling) add(ctx context.Context, points []heatmapPoint, sign float64, touched, dominated []bool) error {
+	for row := 0; row < s.rows; row++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for col := 0; col < s.cols; col++ {
+			n := row*s.cols + col
+			x, y := float64(col*s.step), float64(row*s.step)
+			for _, p := range points {
+				d := math.Hypot(p.X-x, p.Y-y)
+				if d < 1e-9 {
+					s.hits[n] += int(sign)
+					continue
+				}
+				w := p.Weight / math.Pow(d, s.power)
+				if dominated != nil && w > dominantShare*s.den[n] {
+					dominated[n] = true
+				}
+				s.num[n] += sign * w * p.Value
+				s.den[n] += sign * w
+			}
+			if touched != nil {
+				touched[n] = true
+			}
+		}
+	}
+	return nil
+}
+
+// resolve computes the values of the nodes in touched, every node when it
+// is nil, returning which of them changed.
+func (s *idwSampling) resolve(touched []bool) []bool {
+	dirty := make([]bool, len(s.values))
+	for n := range s.values {
+		if touched != nil && !touched[n] {
+			continue
+		}
+		value := s.num[n] / s.den[n]
+		if s.hits[n] > 0 {
+			value = idw(s.points, float64(n%s.cols*s.step), float64(n/s.cols*s.step), s.power)
+		}
+		dirty[n] = value != s.values[n]
+		s.values[n] = value
+	}
+	return dirty
+}
+
+func (s *idwSampling) Values() []float64 {
+	return s.values
+}
+
+func (s *idwSampling) Update(ctx context.Context, added, removed []heatmapPoint) (GridSampling, []bool, error) {
+	next := *s
+	next.points = append(removePoints(s.points, removed), added...)
+	next.num = append([]float64(nil), s.num...)
+	next.den = append([]float64(nil), s.den...)
+	next.hits = append([]int(nil), s.hits...)
+	next.values = append([]float64(nil), s.values...)
+
+	touched, dominated := make([]bool, len(s.values)), make([]bool, len(s.values))
+	if err := next.add(ctx, removed, -1, touched, dominated); err != nil {
+		return nil, nil, err
+	}
+	if err := next.add(ctx, added, 1, touched, nil); err != nil {
+		return nil, nil, err
+	}
+	for n := range dominated {
+		if dominated[n] {
+			next.sum(n)
+		}
+	}
+	return &next, next.resolve(touched), nil
+}
+
+// sum sums the terms of every point at node n from scratch.
+func (s *idwSampling) sum(n int) {
+	x, y := float64(n%s.cols*s.step), float64(n/s.cols*s.step)
+	s.num[n], s.den[n], s.hits[n] = 0, 0, 0
+	for _, p := range s.points {
+		d := math.Hypot(p.X-x, p.Y-y)
+		if d < 1e-9 {
+			s.hits[n]++
+			continue
+		}
+		w := p.Weight / math.Pow(d, s.power)
+		s.num[n] += w * p.Value
+		s.den[n] += w
+	}
+}
+
+// nearestSampling keeps the distance from every node to its nearest point,
+// which a new point only changes where it is nearer and a removed point
+// only where it was the nearest. The heatmap mask uses the distances.
+type nearestSampling struct {
+	cols, rows, step int
+	points           []heatmapPoint
+	values           []float64
+	distances        []float64
+	// weighted divides the distances by the weights of the points, as the
+	// nearest method does; the mask takes plain distances.
+	weighted bool
+}
+
+func (i nearestInterpolator) SampleIncremental(ctx context.Context, cols, rows, step int) (GridSampling, error) {
+	return sampleNearest(ctx, i.points, cols, rows, step, true)
+}
+
+func sampleNearest(ctx context.Context, points []heatmapPoint, cols, rows, step int, weighted bool) (*nearestSampling, error) {
+	s := &nearestSampling{
+		cols: cols, rows: rows, step: step, points: points, weighted: weighted,
+		values: make([]float64, cols*rows), distances: make([]float64, cols*rows),
+	}
+	for row := 0; row < rows; row++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for col := 0; col < cols; col++ {
+			s.nearest(row*cols + col)
+		}
+	}
+	return s, nil
+}
+
+// nearest finds the nearest point of node n among all points.
+func (s *nearestSampling) nearest(n int) {
+	x, y := float64(n%s.cols*s.step), float64(n/s.cols*s.step)
+	s.values[n], s.distances[n] = 0, math.Inf(1)
+	for _, p := range s.points {
+		s.consider(n, p, s.distance(p, x, y))
+	}
+}
+
+// distance is the distance from p to (x, y) the sampling compares.
+func (s *nearestSampling) distance(p heatmapPoint, x, y float64) float64 {
+	if s.weighted {
+		return weightedDistance(p, x, y)
+	}
+	return math.Hypot(p.X-x, p.Y-y)
+}
+
+// consider makes p the nearest point of node n if it is nearer than the
+// current one. Of equally near points the lowest value wins, so the result
+// does not depend on the order the points came in.
+func (s *nearestSampling) consider(n int, p heatmapPoint, d float64) {
+	if d < s.distances[n] || d == s.distances[n] && p.Value < s.values[n] {
+		s.values[n], s.distances[n] = p.Value, d
+	}
+}
+
+func (s *nearestSampling) Values() []float64 {
+	return s.values
+}
+
+func (s *nearestSampling) Update(ctx context.Context, added, removed []heatmapPoint) (GridSampling, []bool, error) {
+	next := *s
+	next.points = append(removePoints(s.points, removed), added...)
+	next.values = append([]float64(nil), s.values...)
+	next.distances = append([]float64(nil), s.distances...)
+
+	dirty := make([]bool, len(s.values))
+	for row := 0; row < s.rows; row++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		for col := 0; col < s.cols; col++ {
+			n := row*s.cols + col
+			x, y := float64(col*s.step), float64(row*s.step)
+			lost := false
+			for _, p := range removed {
+				if s.distance(p, x, y) == s.distances[n] && p.Value == s.values[n] {
+					lost = true
+					break
+				}
+			}
+			if lost {
+				next.nearest(n)
+			} else {
+				for _, p := range added {
+					next.consider(n, p, s.distance(p, x, y))
+				}
+			}
+			dirty[n] = next.values[n] != s.values[n] || next.distances[n] != s.distances[n]
+		}
+	}
+	return &next, dirty, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// The incremental tests sample a grid of 11 by 9 nodes, 10 pixels apart.
+const updateCols, updateRows, updateStep = 11, 9, 10
+
+func randomPoints(random *rand.Rand, n int, weighted bool) []heatmapPoint {
+	points := make([]heatmapPoint, n)
+	for i := range points {
+		points[i] = heatmapPoint{
+			X:      random.Float64() * updateCols * updateStep,
+			Y:      random.Float64() * updateRows * updateStep,
+			Value:  -90 + random.Float64()*60,
+			Weight: 1,
+		}
+		if weighted {
+			points[i].Weight = 1 / (1 + random.Float64()*5)
+		}
+	}
+	return points
+}
+
+// TestIncrementalUpdate checks that updating a sampled grid gives what
+// sampling the changed points from scratch gives, and reports every node
+// that changed.
+func TestIncrementalUpdate(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	base := randomPoints(random, 30, false)
+	weighted := randomPoints(random, 30, true)
+	extra := randomPoints(random, 5, false)
+
+	// dominant lies next to node (2, 3) with an outlying value, so its
+	// term is most of that node's weights.
+	dominant := heatmapPoint{X: 20.000001, Y: 30, Value: -20, Weight: 1}
+	onNode := heatmapPoint{X: 50, Y: 40, Value: -45, Weight: 1}
+
+	tests := []struct {
+		name           string
+		points         []heatmapPoint
+		added, removed []heatmapPoint
+	}{
+		{name: "add", points: base, added: extra},
+		{name: "remove", points: base, removed: base[:4]},
+		{name: "add and remove", points: base, added: extra, removed: base[10:13]},
+		{name: "remove dominant", points: append(base[:len(base):len(base)], dominant), removed: []heatmapPoint{dominant}},
+		{name: "add on node", points: base, added: []heatmapPoint{onNode}},
+		{name: "remove on node", points: append(base[:len(base):len(base)], onNode), removed: []heatmapPoint{onNode}},
+		{name: "duplicate", points: append(base[:len(base):len(base)], base[0]), removed: base[:1]},
+		{name: "weighted", points: weighted, added: extra, removed: weighted[:3]},
+	}
+
+	interpolators := []struct {
+		name string
+		new  func(points []heatmapPoint) IncrementalInterpolator
+		// tolerance is the relative difference allowed, for the
+		// rounding of subtracted sums.
+		tolerance float64
+	}{
+		{"idw", func(points []heatmapPoint) IncrementalInterpolator {
+			return idwInterpolator{points: points, power: 2}
+		}, 1e-9},
+		{"nearest", func(points []heatmapPoint) IncrementalInterpolator {
+			return nearestInterpolator{points: points}
+		}, 0},
+	}
+
+	ctx := context.Background()
+	for _, interpolator := range interpolators {
+		for _, test := range tests {
+			t.Run(interpolator.name+"/"+test.name, func(t *testing.T) {
+				sampling, err := interpolator.new(test.points).SampleIncremental(ctx, updateCols, updateRows, updateStep)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before := append([]float64(nil), sampling.Values()...)
+
+				updated, dirty, err := sampling.Update(ctx, test.added, test.removed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				after := append(removePoints(test.points, test.removed), test.added...)
+				want, err := interpolator.new(after).SampleIncremental(ctx, updateCols, updateRows, updateStep)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for n, value := range updated.Values() {
+					expected := want.Values()[n]
+					if math.Abs(value-expected) > interpolator.tolerance*math.Abs(expected) {
+						t.Errorf("node %d is %v, sampled from scratch %v", n, value, expected)
+					}
+					if value != before[n] && !dirty[n] {
+						t.Errorf("node %d changed from %v to %v but is not dirty", n, before[n], value)
+					}
+				}
+				for n, value := range sampling.Values() {
+					if value != before[n] {
+						t.Fatalf("the update changed node %d of the original sampling", n)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// influxBatchSize is the most lines sent in one write.
+	influxBatchSize = 5000
+	// influxMaxPending bounds the lines held while the endpoint is down;
+	// the oldest are dropped beyond it.
+	influxMaxPending = 100000
+	influxInterval   = 5 * time.Second
+)
+
+var (
+	influxURL         = flag.String("influx-url", envOrDefault("HEATGEN_INFLUX_URL", ""), "line protocol write endpoint every stored measurement is mirrored to, e.g. http://influxdb:8086/api/v2/write?org=net&bucket=wifi (env HEATGEN_INFLUX_URL)")
+	influxToken       = flag.String("influx-token", envOrDefault("HEATGEN_INFLUX_TOKEN", ""), "token sent to -influx-url as Authorization: Token (env HEATGEN_INFLUX_TOKEN)")
+	influxMeasurement = flag.String("influx-measurement", envOrDefault("HEATGEN_INFLUX_MEASUREMENT", "heatgen"), "measurement name of the mirrored points (env HEATGEN_INFLUX_MEASUREMENT)")
+
+	influxClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+var (
+	influxPending []string
+	// influxFirst is the sequence number of the first pending line, which
+	// grows as lines are sent or dropped.
+	influxFirst int
+	// influxError is the last write error, "" after a successful write.
+	influxError   string
+	influxDropped int
+	influxLock    sync.Mutex
+
+	influxWake    = make(chan struct{}, 1)
+	influxStop    = make(chan struct{})
+	influxStopped = make(chan struct{})
+)
+
+var (
+	influxTagEscaper    = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+)
+
+// influxLine writes a measurement as a line of the InfluxDB line protocol,
+// tagged with the floor, location, network and probe. Failed samples carry
+// failed=true instead of a dbm field.
+func influxLine(m Measurement, floorName string) string {
+	var b strings.Builder
+	b.WriteString(influxTagEscaper.Replace(*influxMeasurement))
+
+	tags := [][2]string{
+		{"floor", strconv.Itoa(m.Floor)},
+		{"floor_name", floorName},
+		{"location", m.Location},
+		{"type", m.Type},
+		{"class", m.class()},
+		{"ssid", m.SSID},
+		{"bssid", m.BSSID},
+		{"probe", m.Interface},
+		{"site", measurementSite(m.ID)},
+		{"session", m.SessionID},
+	}
+	for _, tag := range tags {
+		// Empty tag values are not allowed.
+		if tag[1] != "" {
+			b.WriteString("," + tag[0] + "=" + influxTagEscaper.Replace(tag[1]))
+		}
+	}
+
+	fields := []string{
+		`id="` + influxStringEscaper.Replace(m.ID) + `"`,
+		"lat=" + strconv.FormatFloat(m.Lat, 'f', -1, 64),
+		"lng=" + strconv.FormatFloat(m.Lng, 'f', -1, 64),
+	}
+	if m.Dbm == failedSampleDbm {
+		fields = append(fields, "failed=true")
+	} else {
+		fields = append(fields, "dbm="+strconv.Itoa(m.Dbm)+"i", "failed=false")
+	}
+	if m.Freq > 0 {
+		fields = append(fields, "freq="+strconv.Itoa(m.Freq)+"i")
+	}
+	if m.Channel > 0 {
+		fields = append(fields, "channel="+strconv.Itoa(m.Channel)+"i")
+	}
+	if m.TxBitrate > 0 {
+		fields = append(fields, "tx_bitrate="+strconv.FormatFloat(m.TxBitrate, 'f', -1, 64))
+	}
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{
+		{"latency_ms", m.LatencyMs},
+		{"jitter_ms", m.JitterMs},
+		{"loss_percent", m.LossPercent},
+		{"throughput_mbps", m.ThroughputMbps},
+		{"upload_mbps", m.UploadMbps},
+		{"noise_dbm", m.NoiseDbm},
+		{"snr_db", m.SNRDb},
+		{"busy_percent", m.BusyPercent},
+		{"height", m.Height},
+	} {
+		if field.value != nil {
+			fields = append(fields, field.name+"="+strconv.FormatFloat(*field.value, 'f', -1, 64))
+		}
+	}
+
+	b.WriteString(" " + strings.Join(fields, ","))
+	b.WriteString(" " + strconv.FormatInt(m.Timestamp.UnixNano(), 10))
+	return b.String()
+}
+
+// mirrorToInflux queues new measurements for -influx-url.
+func mirrorToInflux(records []Measurement) {
+	if *influxURL == "" || len(records) == 0 {
+		return
+	}
+
+	mutex.Lock()
+	lines := make([]string, len(records))
+	for i, m := range records {
+		lines[i] = influxLine(m, floors[m.Floor].Name)
+	}
+	mutex.Unlock()
+
+	influxLock.Lock()
+	influxPending = append(influxPending, lines...)
+	if excess := len(influxPending) - influxMaxPending; excess > 0 {
+		influxPending = influxPending[excess:]
+		influxFirst += excess
+		influxDropped += excess
+	}
+	full := len(influxPending) >= influxBatchSize
+	influxLock.Unlock()
+
+	if full {
+		select {
+		case influxWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeInflux sends the pending lines in batches. Lines of a failed write
+// stay queued for the next attempt.
+func writeInflux(ctx context.Context) {
+	for {
+		influxLock.Lock()
+		batch := influxPending[:min(len(influxPending), influxBatchSize)]
+		end := influxFirst + len(batch)
+		dropped := influxDropped
+		influxDropped = 0
+		influxLock.Unlock()
+		if dropped > 0 {
+			log.Printf("dropped %d measurements queued for InfluxDB while it was unreachable", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		err := postInflux(ctx, strings.Join(batch, "\n")+"\n")
+
+		influxLock.Lock()
+		if err == nil {
+			// Lines dropped meanwhile shift the queue; only what is left
+			// of the batch is removed.
+			if sent := end - influxFirst; sent > 0 {
+				influxPending = influxPending[sent:]
+				influxFirst = end
+			}
+			influxError = ""
+		} else {
+			if influxError == "" {
+				log.Printf("failed to write measurements to InfluxDB: %v", err)
+			}
+			influxError = err.Error()
+		}
+		influxLock.Unlock()
+		if err != nil || len(batch) < influxBatchSize {
+			return
+		}
+	}
+}
+
+func postInflux(ctx context.Context, body string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", *influxURL, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if *influxToken != "" {
+		req.Header.Set("Authorization", "Token "+*influxToken)
+	}
+
+	resp, err := influxClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// startInflux writes the queued measurements to -influx-url every few
+// seconds, or as soon as a batch is full.
+func startInflux() {
+	if *influxURL == "" {
+		close(influxStopped)
+		return
+	}
+	if !strings.HasPrefix(*influxURL, "http://") && !strings.HasPrefix(*influxURL, "https://") {
+		log.Fatal("-influx-url must be an http(s) URL")
+	}
+
+	go func() {
+		defer close(influxStopped)
+		ticker := time.NewTicker(influxInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-influxWake:
+			case <-influxStop:
+				return
+			}
+			writeInflux(context.Background())
+		}
+	}()
+}
+
+// stopInflux writes what is still queued, until ctx ends.
+func stopInflux(ctx context.Context) {
+	if *influxURL == "" {
+		return
+	}
+	close(influxStop)
+	<-influxStopped
+	writeInflux(ctx)
+
+	influxLock.Lock()
+	left := len(influxPending)
+	influxLock.Unlock()
+	if left > 0 {
+		log.Printf("%d measurements were not written to InfluxDB", left)
+	}
+}
+
+// influxCheck reports for /readyz whether the last write succeeded. The
+// sink is not critical: measurements are stored regardless.
+func influxCheck() []HealthCheck {
+	if *influxURL == "" {
+		return nil
+	}
+	influxLock.Lock()
+	defer influxLock.Unlock()
+
+	check := HealthCheck{Name: "influx sink", OK: influxError == ""}
+	if !check.OK {
+		check.Detail = fmt.Sprintf("%s; %d measurements queued", influxError, len(influxPending))
+		check.Hint = "check -influx-url and -influx-token"
+	}
+	return []HealthCheck{check}
+}
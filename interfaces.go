@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var wifiInterface = flag.String("iface", envOrDefault("HEATGEN_INTERFACE", defaultInterfaceName), "default wireless interface (env HEATGEN_INTERFACE)")
+
+// WirelessInterface is one interface listed by `iw dev`.
+type WirelessInterface struct {
+	Name    string `json:"name"`
+	Phy     string `json:"phy"`
+	Addr    string `json:"addr,omitempty"`
+	Type    string `json:"type,omitempty"`
+	SSID    string `json:"ssid,omitempty"`
+	Freq    int    `json:"freq,omitempty"`
+	Channel int    `json:"channel,omitempty"`
+	Default bool   `json:"default"`
+}
+
+var iwChannelRe = regexp.MustCompile(`^channel \d+ \((\d+) MHz\)`)
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// listWirelessInterfaces enumerates the interfaces known to nl80211.
+func listWirelessInterfaces() ([]WirelessInterface, error) {
+	output, err := exec.Command("iw", "dev").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iw dev: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return parseIwDev(string(output)), nil
+}
+
+func parseIwDev(output string) []WirelessInterface {
+	var interfaces []WirelessInterface
+	var phy string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "phy#") {
+			phy = "phy" + strings.TrimPrefix(line, "phy#")
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "Interface "); ok {
+			interfaces = append(interfaces, WirelessInterface{
+				Name:    name,
+				Phy:     phy,
+				Default: name == *wifiInterface,
+			})
+			continue
+		}
+		if len(interfaces) == 0 {
+			continue
+		}
+
+		current := &interfaces[len(interfaces)-1]
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "addr":
+			current.Addr = value
+		case "ssid":
+			current.SSID = value
+		case "type":
+			current.Type = value
+		case "channel":
+			if match := iwChannelRe.FindStringSubmatch(line); match != nil {
+				current.Freq, _ = strconv.Atoi(match[1])
+				current.Channel = frequencyToChannel(current.Freq)
+			}
+		}
+	}
+
+	return interfaces
+}
+
+// validInterface reports whether name is an existing wireless interface.
+func validInterface(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return false
+	}
+	return signalReader.ValidInterface(name)
+}
+
+// interfaceParam returns the interface named by the request's "interface"
+// query parameter, or the default one.
+func interfaceParam(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("interface")
+	if name == "" {
+		return *wifiInterface, nil
+	}
+	if !validInterface(name) {
+		return "", fmt.Errorf("unknown wireless interface %q", name)
+	}
+	return name, nil
+}
+
+func interfacesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	interfaces, err := listWirelessInterfaces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(interfaces)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const krigingNeighbors = 24
+
+var defaultInterpolation = flag.String("interpolation", "idw", "default interpolation method (see /api/interpolators)")
+
+// Interpolator estimates the signal at arbitrary pixel coordinates from a
+// fitted set of points. The variance is NaN for methods that don't provide
+// one.
+type Interpolator interface {
+	Estimate(x, y float64) (value, variance float64)
+}
+
+// GridInterpolator is implemented by interpolators that are cheaper to
+// evaluate over the whole sample grid at once, such as batched models. The
+// grid holds cols*rows values, row by row, spaced step pixels apart.
+type GridInterpolator interface {
+	Interpolator
+	EstimateGrid(ctx context.Context, cols, rows, step int) ([]float64, error)
+}
+
+// InterpolatorFactory fits an interpolator to the points of one heatmap.
+type InterpolatorFactory func(points []heatmapPoint, params HeatmapParams) (Interpolator, error)
+
+var (
+	interpolators     = make(map[string]InterpolatorFactory)
+	interpolatorsLock sync.RWMutex
+)
+
+// registerInterpolator makes an interpolation method selectable by name.
+// Additional methods register themselves from an init function in their own
+// file, without touching the renderer.
+func registerInterpolator(name string, factory InterpolatorFactory) {
+	interpolatorsLock.Lock()
+	defer interpolatorsLock.Unlock()
+
+	if _, exists := interpolators[name]; exists {
+		panic(fmt.Sprintf("interpolation method %q registered twice", name))
+	}
+	interpolators[name] = factory
+}
+
+func init() {
+	registerInterpolator("idw", func(points []heatmapPoint, params HeatmapParams) (Interpolator, error) {
+		return idwInterpolator{points: points, power: params.Power}, nil
+	})
+	registerInterpolator("nearest", func(points []heatmapPoint, params HeatmapParams) (Interpolator, error) {
+		return nearestInterpolator{points: points}, nil
+	})
+	registerInterpolator("kriging", func(points []heatmapPoint, params HeatmapParams) (Interpolator, error) {
+		return newKrigingInterpolator(points), nil
+	})
+}
+
+// interpolationMethods returns the registered method names in order.
+func interpolationMethods() []string {
+	interpolatorsLock.RLock()
+	defer interpolatorsLock.RUnlock()
+
+	methods := make([]string, 0, len(interpolators))
+	for name := range interpolators {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func validInterpolationMethod(method string) bool {
+	interpolatorsLock.RLock()
+	defer interpolatorsLock.RUnlock()
+
+	_, ok := interpolators[method]
+	return ok
+}
+
+func newInterpolator(method string, points []heatmapPoint, params HeatmapParams) (Interpolator, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no points to interpolate")
+	}
+
+	interpolatorsLock.RLock()
+	factory, ok := interpolators[method]
+	interpolatorsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown interpolation method %q", method)
+	}
+
+	return factory(points, params)
+}
+
+// sampleGrid evaluates the interpolator at every grid node.
+func sampleGrid(ctx context.Context, interpolator Interpolator, cols, rows, step int) ([]float64, error) {
+	if gi, ok := interpolator.(GridInterpolator); ok {
+		grid, err := gi.EstimateGrid(ctx, cols, rows, step)
+		if err != nil {
+			return nil, err
+		}
+		if len(grid) != cols*rows {
+			return nil, fmt.Errorf("interpolator returned %d grid values, want %d", len(grid), cols*rows)
+		}
+		return grid, nil
+	}
+
+	grid := make([]float64, cols*rows)
+	for row := 0; row < rows; row++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for col := 0; col < cols; col++ {
+			grid[row*cols+col], _ = interpolator.Estimate(float64(col*step), float64(row*step))
+		}
+	}
+	return grid, nil
+}
+
+func interpolatorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": effectiveSettings().Interpolation,
+		"methods": interpolationMethods(),
+	})
+}
+
+type idwInterpolator struct {
+	points []heatmapPoint
+	power  float64
+}
+
+func (i idwInterpolator) Estimate(x, y float64) (float64, float64) {
+	return idw(i.points, x, y, i.power), math.NaN()
+}
+
+type nearestInterpolator struct {
+	points []heatmapPoint
+}
+
+// Estimate takes the value of the nearest point, the lowest of equally near
+// ones like the grid of SampleIncremental. Distances are divided by the
+// weight of the point, so a less accurate point reaches less far.
+func (i nearestInterpolator) Estimate(x, y float64) (float64, float64) {
+	best, bestDist := 0, math.Inf(1)
+	for j, p := range i.points {
+		d := weightedDistance(p, x, y)
+		if d < bestDist || d == bestDist && p.Value < i.points[best].Value {
+			best, bestDist = j, d
+		}
+	}
+	return i.points[best].Value, math.NaN()
+}
+
+// krigingInterpolator implements ordinary kriging with an exponential
+// variogram fitted to the data, solved locally over the nearest points.
+type krigingInterpolator struct {
+	points []heatmapPoint
+	nugget float64
+	sill   float64
+	rng    float64
+}
+
+func newKrigingInterpolator(points []heatmapPoint) *krigingInterpolator {
+	k := &krigingInterpolator{points: points}
+
+	var mean, maxDist float64
+	for _, p := range points {
+		mean += p.Value
+	}
+	mean /= float64(len(points))
+	for _, p := range points {
+		k.sill += (p.Value - mean) * (p.Value - mean)
+	}
+	k.sill /= float64(len(points))
+	if k.sill == 0 {
+		k.sill = 1
+	}
+
+	// Empirical semivariogram over distance bins, subsampling pairs for
+	// large surveys.
+	const bins = 15
+	step := max(1, len(points)/300)
+	for i := 0; i < len(points); i += step {
+		for j := i + 1; j < len(points); j += step {
+			maxDist = math.Max(maxDist, math.Hypot(points[i].X-points[j].X, points[i].Y-points[j].Y))
+		}
+	}
+	if maxDist == 0 {
+		k.rng = 1
+		return k
+	}
+
+	binWidth := maxDist / 2 / bins
+	var gamma, counts [bins]float64
+	for i := 0; i < len(points); i += step {
+		for j := i + 1; j < len(points); j += step {
+			d := math.Hypot(points[i].X-points[j].X, points[i].Y-points[j].Y)
+			bin := int(d / binWidth)
+			if bin >= bins {
+				continue
+			}
+			diff := points[i].Value - points[j].Value
+			gamma[bin] += diff * diff / 2
+			counts[bin]++
+		}
+	}
+
+	for i := range gamma {
+		if counts[i] > 0 {
+			gamma[i] /= counts[i]
+		}
+	}
+	if counts[0] > 0 {
+		k.nugget = math.Min(gamma[0], k.sill/2)
+	}
+
+	bestErr, bestRange := math.Inf(1), maxDist
+	for r := binWidth; r <= maxDist; r += binWidth / 2 {
+		k.rng = r
+		var sqErr float64
+		for i := range gamma {
+			if counts[i] == 0 {
+				continue
+			}
+			diff := k.variogram((float64(i)+0.5)*binWidth) - gamma[i]
+			sqErr += counts[i] * diff * diff
+		}
+		if sqErr < bestErr {
+			bestErr, bestRange = sqErr, r
+		}
+	}
+	k.rng = bestRange
+
+	return k
+}
+
+func (k *krigingInterpolator) variogram(h float64) float64 {
+	if h == 0 {
+		return 0
+	}
+	return k.nugget + (k.sill-k.nugget)*(1-math.Exp(-3*h/k.rng))
+}
+
+// weightedDistance is the distance from p to (x, y) divided by the weight
+// of p.
+func weightedDistance(p heatmapPoint, x, y float64) float64 {
+	return math.Hypot(p.X-x, p.Y-y) / p.Weight
+}
+
+// krigingNeighbor is a point with its distance from the estimated position.
+type krigingNeighbor struct {
+	point    heatmapPoint
+	distance float64
+}
+
+// neighborHeap is a max-heap of neighbors by distance, so the farthest of
+// the nearest points found so far is the one to replace.
+type neighborHeap []krigingNeighbor
+
+func (h neighborHeap) Len() int           { return len(h) }
+func (h neighborHeap) Less(i, j int) bool { return h[i].distance > h[j].distance }
+func (h neighborHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *neighborHeap) Push(x any)        { *h = append(*h, x.(krigingNeighbor)) }
+func (h *neighborHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// nearestNeighbors returns the krigingNeighbors points nearest to (x, y),
+// nearest first.
+func (k *krigingInterpolator) nearestNeighbors(x, y float64) []heatmapPoint {
+	h := make(neighborHeap, 0, krigingNeighbors)
+	for _, p := range k.points {
+		d := math.Hypot(p.X-x, p.Y-y)
+		if len(h) < krigingNeighbors {
+			heap.Push(&h, krigingNeighbor{p, d})
+		} else if d < h[0].distance {
+			h[0] = krigingNeighbor{p, d}
+			heap.Fix(&h, 0)
+		}
+	}
+
+	neighbors := make([]heatmapPoint, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		neighbors[i] = heap.Pop(&h).(krigingNeighbor).point
+	}
+	return neighbors
+}
+
+// Estimate treats a point of weight below one as a measurement with error:
+// its error variance, the sill times one minus the weight, is added to its
+// own covariance, so the estimate no longer has to pass through it.
+func (k *krigingInterpolator) Estimate(x, y float64) (float64, float64) {
+	neighbors := k.nearestNeighbors(x, y)
+
+	n := len(neighbors)
+	if neighbors[0].Weight == 1 && math.Hypot(neighbors[0].X-x, neighbors[0].Y-y) < 1e-9 {
+		return neighbors[0].Value, 0
+	}
+
+	// Ordinary kriging system with a Lagrange multiplier enforcing that the
+	// weights sum to one.
+	a := make([][]float64, n+1)
+	target := make([]float64, n)
+	for i := range a {
+		a[i] = make([]float64, n+2)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			a[i][j] = k.variogram(math.Hypot(neighbors[i].X-neighbors[j].X, neighbors[i].Y-neighbors[j].Y))
+		}
+		a[i][i] = -k.sill * (1 - neighbors[i].Weight)
+		a[i][n] = 1
+		a[n][i] = 1
+		target[i] = k.variogram(math.Hypot(neighbors[i].X-x, neighbors[i].Y-y))
+		a[i][n+1] = target[i]
+	}
+	a[n][n+1] = 1
+
+	weights, ok := solveLinear(a)
+	if !ok {
+		return idw(neighbors, x, y, 2), math.NaN()
+	}
+
+	var value, variance float64
+	for i := 0; i < n; i++ {
+		value += weights[i] * neighbors[i].Value
+		variance += weights[i] * target[i]
+	}
+	variance += weights[n]
+
+	return value, math.Max(variance, 0)
+}
+
+// solveLinear solves the augmented system a by Gaussian elimination with
+// partial pivoting. The matrix is modified in place.
+func solveLinear(a [][]float64) ([]float64, bool) {
+	n := len(a)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for row := col + 1; row < n; row++ {
+			factor := a[row][col] / a[col][col]
+			for c := col; c <= n; c++ {
+				a[row][c] -= factor * a[col][c]
+			}
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := a[row][n]
+		for c := row + 1; c < n; c++ {
+			sum -= a[row][c] * x[c]
+		}
+		x[row] = sum / a[row][row]
+	}
+
+	return x, true
+}
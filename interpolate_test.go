@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestNearestWeights checks that the nearest method lets a more accurate
+// point reach further, alike in Estimate and in the sampled grid.
+func TestNearestWeights(t *testing.T) {
+	points := []heatmapPoint{
+		{X: 0, Y: 0, Value: -40, Weight: 1},
+		{X: 100, Y: 0, Value: -80, Weight: 1.0 / 3},
+	}
+	interpolator := nearestInterpolator{points: points}
+
+	tests := []struct {
+		x    float64
+		want float64
+	}{
+		{0, -40},
+		{50, -40},
+		{74, -40},
+		{76, -80},
+		{100, -80},
+	}
+	for _, test := range tests {
+		if got, _ := interpolator.Estimate(test.x, 0); got != test.want {
+			t.Errorf("estimate at %v is %v, want %v", test.x, got, test.want)
+		}
+	}
+
+	sampling, err := interpolator.SampleIncremental(context.Background(), updateCols, 1, updateStep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for col, value := range sampling.Values() {
+		if want, _ := interpolator.Estimate(float64(col*updateStep), 0); value != want {
+			t.Errorf("node %d is %v, estimated %v", col, value, want)
+		}
+	}
+}
+
+// TestKrigingNeighbors checks that the heap picks the same neighbours as
+// sorting every point by distance would.
+func TestKrigingNeighbors(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	for _, n := range []int{1, krigingNeighbors - 1, krigingNeighbors, 200} {
+		k := newKrigingInterpolator(randomPoints(random, n, false))
+		x, y := random.Float64()*100, random.Float64()*80
+
+		neighbors := k.nearestNeighbors(x, y)
+		if want := min(n, krigingNeighbors); len(neighbors) != want {
+			t.Fatalf("%d points: %d neighbours, want %d", n, len(neighbors), want)
+		}
+		last := 0.0
+		for _, p := range neighbors {
+			d := math.Hypot(p.X-x, p.Y-y)
+			if d < last {
+				t.Fatalf("%d points: neighbours are not nearest first", n)
+			}
+			last = d
+		}
+		farther := 0
+		for _, p := range k.points {
+			if math.Hypot(p.X-x, p.Y-y) > last {
+				farther++
+			}
+		}
+		if farther != n-len(neighbors) {
+			t.Errorf("%d points: a point nearer than the farthest neighbour was left out", n)
+		}
+	}
+}
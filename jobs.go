@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jobRetention is how long finished jobs stay available for polling.
+const jobRetention = time.Hour
+
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Job tracks a measurement being sampled in the background. Scan jobs
+// report their per-BSS records in Measurements.
+type Job struct {
+	ID           string        `json:"id"`
+	Status       string        `json:"status"`
+	Taken        int           `json:"taken"`
+	Samples      int           `json:"samples"`
+	Measurement  *Measurement  `json:"measurement,omitempty"`
+	Measurements []Measurement `json:"measurements,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+var (
+	jobs     = make(map[string]*Job)
+	jobsLock sync.Mutex
+
+	// runningJobs counts the jobs still sampling, which shutdown waits for.
+	runningJobs sync.WaitGroup
+)
+
+// snapshot returns a copy of the job that is safe to encode without holding
+// jobsLock.
+func (j *Job) snapshot() Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	return *j
+}
+
+// startMeasurementJob samples req in the background and records it in the
+// task history. retryOf names the task being retried, if any.
+func startMeasurementJob(req MeasurementRequest, initiator, retryOf string) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        generateID(),
+		Status:    jobRunning,
+		Samples:   req.Samples + req.discarded(),
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	}
+	if req.Type == "spectral" || req.Type == "scan" {
+		job.Samples = 0
+	}
+
+	jobsLock.Lock()
+	for id, j := range jobs {
+		if j.FinishedAt != nil && time.Since(*j.FinishedAt) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+	jobs[job.ID] = job
+	jobsLock.Unlock()
+
+	kind := taskMeasurement
+	if req.Type == "scan" {
+		kind = taskScan
+	}
+	task := startTask(kind, initiator, req)
+	tasksLock.Lock()
+	task.JobID, task.RetryOf = job.ID, retryOf
+	tasksLock.Unlock()
+
+	runningJobs.Add(1)
+	go func() {
+		defer runningJobs.Done()
+		defer cancel()
+
+		var record Measurement
+		records, err := signalSources[req.source()].Measure(ctx, req, func(taken int) {
+			jobsLock.Lock()
+			job.Taken = taken
+			jobsLock.Unlock()
+			publishJob(job)
+		})
+		if err == nil && req.Type != "scan" {
+			record = records[0]
+		}
+
+		// Deferred calls run in reverse, so the job is published once
+		// jobsLock is released.
+		defer publishJob(job)
+		jobsLock.Lock()
+		defer jobsLock.Unlock()
+
+		now := time.Now()
+		job.FinishedAt = &now
+		switch {
+		case errors.Is(err, context.Canceled):
+			job.Status = jobCancelled
+		case err != nil:
+			job.Status = jobFailed
+			job.Error = err.Error()
+		case req.Type == "scan":
+			job.Status = jobDone
+			job.Measurements = records
+		default:
+			job.Status = jobDone
+			job.Measurement = &record
+		}
+
+		summary := map[string]string{"floor": strconv.Itoa(req.Floor), "interface": req.Interface}
+		switch {
+		case req.Type == "scan":
+			summary["measurements"] = strconv.Itoa(len(records))
+		case job.Measurement != nil:
+			summary["measurement"] = record.ID
+		}
+		task.finish(job.Status, err, summary)
+	}()
+
+	return job
+}
+
+// cancelRunningJobs cancels every job that is still sampling.
+func cancelRunningJobs() {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	for _, job := range jobs {
+		if job.Status == jobRunning {
+			job.cancel()
+		}
+	}
+}
+
+// jobHandler reports the status of a measurement job on GET and cancels it
+// on DELETE.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	jobsLock.Lock()
+	job, exists := jobs[r.PathValue("id")]
+	jobsLock.Unlock()
+
+	if !exists {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		job.cancel()
+	case "OPTIONS":
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.snapshot())
+}
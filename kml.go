@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kmlPlacemarkIcon is the round marker shipped with Google Earth, tinted
+// per placemark.
+const kmlPlacemarkIcon = "http://maps.google.com/mapfiles/kml/shapes/shaded_dot.png"
+
+type kmlDocument struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	XmlnsGx  string   `xml:"xmlns:gx,attr"`
+	Document struct {
+		Name    string      `xml:"name"`
+		Folders []kmlFolder `xml:"Folder"`
+	} `xml:"Document"`
+}
+
+type kmlFolder struct {
+	Name       string            `xml:"name"`
+	Overlay    *kmlGroundOverlay `xml:"GroundOverlay,omitempty"`
+	Placemarks []kmlPlacemark    `xml:"Placemark"`
+}
+
+// kmlGroundOverlay places the floor map by its four corners, which also
+// fits rotated and skewed calibrations.
+type kmlGroundOverlay struct {
+	Name string `xml:"name"`
+	Icon struct {
+		Href string `xml:"href"`
+	} `xml:"Icon"`
+	Corners string `xml:"gx:LatLonQuad>coordinates"`
+}
+
+type kmlPlacemark struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"name"`
+	Description string `xml:"description,omitempty"`
+	TimeStamp   string `xml:"TimeStamp>when"`
+	Style       struct {
+		Color string  `xml:"IconStyle>color"`
+		Scale float64 `xml:"IconStyle>scale"`
+		Icon  string  `xml:"IconStyle>Icon>href"`
+	} `xml:"Style"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+// kmlColor writes a color in the aabbggrr order of KML.
+func kmlColor(c color.RGBA) string {
+	return fmt.Sprintf("ff%02x%02x%02x", c.B, c.G, c.R)
+}
+
+func kmlCoordinate(lat, lng float64) string {
+	return strconv.FormatFloat(lng, 'f', 7, 64) + "," + strconv.FormatFloat(lat, 'f', 7, 64) + ",0"
+}
+
+// buildKML lays out the measurements as placemarks colored on the default
+// signal scale, one folder per floor. overlays maps floor IDs to the path
+// of their map inside a KMZ; floors listed get a ground overlay.
+func buildKML(ms []Measurement, transforms map[int]func(lat, lng float64) (float64, float64), overlays map[int]string) (kmlDocument, error) {
+	var doc kmlDocument
+	doc.Xmlns = "http://www.opengis.net/kml/2.2"
+	doc.XmlnsGx = "http://www.google.com/kml/ext/2.2"
+	doc.Document.Name = "Wi-Fi survey"
+	if *siteID != "" {
+		doc.Document.Name += " " + *siteID
+	}
+
+	signal := metrics[defaultMetric]
+	scale := HeatmapParams{Scale: "default", Metric: signal, Min: signal.Min, Max: signal.Max}
+
+	byFloor := make(map[int][]Measurement)
+	for _, m := range ms {
+		byFloor[m.Floor] = append(byFloor[m.Floor], m)
+	}
+	floorIDs := make([]int, 0, len(byFloor))
+	for id := range byFloor {
+		floorIDs = append(floorIDs, id)
+	}
+	sort.Ints(floorIDs)
+
+	for _, id := range floorIDs {
+		mutex.Lock()
+		floor := floors[id]
+		mutex.Unlock()
+
+		folder := kmlFolder{Name: floor.Name}
+		if folder.Name == "" {
+			folder.Name = fmt.Sprintf("Floor %d", id)
+		}
+
+		if href, ok := overlays[id]; ok {
+			width, height, err := floorMapSize(floor)
+			if err != nil {
+				return doc, err
+			}
+			// Lower left, lower right, upper right and upper left, with
+			// pixel y growing downwards.
+			var corners []string
+			for _, p := range [][2]float64{{0, float64(height)}, {float64(width), float64(height)}, {float64(width), 0}, {0, 0}} {
+				lat, lng := floor.Calibration.toGeo(p[0], p[1])
+				corners = append(corners, kmlCoordinate(lat, lng))
+			}
+			overlay := &kmlGroundOverlay{Name: folder.Name + " map", Corners: strings.Join(corners, " ")}
+			overlay.Icon.Href = href
+			folder.Overlay = overlay
+		}
+
+		for _, m := range byFloor[id] {
+			lat, lng := transforms[id](m.Lat, m.Lng)
+
+			p := kmlPlacemark{
+				ID:          m.ID,
+				Name:        m.Location,
+				TimeStamp:   m.Timestamp.Format(time.RFC3339),
+				Coordinates: kmlCoordinate(lat, lng),
+			}
+			signalText := "failed"
+			fill := failedMarker
+			if m.Dbm != failedSampleDbm {
+				signalText = fmt.Sprintf("%d dBm", m.Dbm)
+				fill = scale.colorFor(float64(m.Dbm))
+			}
+			if p.Name == "" {
+				p.Name = signalText
+			}
+			p.Description = signalText
+			if m.SSID != "" {
+				p.Description += " on " + m.SSID
+			}
+			p.Style.Color, p.Style.Scale, p.Style.Icon = kmlColor(fill), 0.8, kmlPlacemarkIcon
+
+			p.Data = append(p.Data, kmlData{"dbm", strconv.Itoa(m.Dbm)})
+			for _, d := range []kmlData{{"ssid", m.SSID}, {"bssid", m.BSSID}, {"type", m.Type}, {"session", m.SessionID}} {
+				if d.Value != "" {
+					p.Data = append(p.Data, d)
+				}
+			}
+
+			folder.Placemarks = append(folder.Placemarks, p)
+		}
+
+		doc.Document.Folders = append(doc.Document.Folders, folder)
+	}
+
+	return doc, nil
+}
+
+func writeKML(w io.Writer, doc kmlDocument) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// writeKMZ bundles the KML as doc.kml with the maps of the floors as ground
+// overlays. Google Earth opens the first .kml file of the archive, so
+// doc.kml goes first.
+func writeKMZ(w io.Writer, ms []Measurement, transforms map[int]func(lat, lng float64) (float64, float64)) error {
+	overlays := make(map[int]string)
+	mapFiles := make(map[string]string)
+	mutex.Lock()
+	for id := range transforms {
+		floor := floors[id]
+		name := fmt.Sprintf("files/floor_%d%s", id, strings.ToLower(filepath.Ext(floor.MapPath)))
+		overlays[id] = name
+		mapFiles[name] = uploadFile(floor.MapPath)
+	}
+	mutex.Unlock()
+
+	doc, err := buildKML(ms, transforms, overlays)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeKML(&buf, doc); err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	file, err := archive.Create("doc.kml")
+	if err == nil {
+		_, err = file.Write(buf.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+
+	for name, path := range mapFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		file, err := archive.Create(name)
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
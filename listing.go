@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// measurementSorts are the fields GET /api/measurements can sort by.
+var measurementSorts = map[string]func(a, b Measurement) int{
+	"timestamp": func(a, b Measurement) int { return a.Timestamp.Compare(b.Timestamp) },
+	"dbm":       func(a, b Measurement) int { return cmp.Compare(a.Dbm, b.Dbm) },
+	"floor":     func(a, b Measurement) int { return cmp.Compare(a.Floor, b.Floor) },
+	"location":  func(a, b Measurement) int { return strings.Compare(a.Location, b.Location) },
+	"id":        func(a, b Measurement) int { return strings.Compare(a.ID, b.ID) },
+}
+
+// listOptions are the filters, order and page of the measurement listing
+// beyond the floor, session, building, height, band and SSID filters it
+// shares with the export.
+type listOptions struct {
+	From, To time.Time
+	Types    map[string]bool
+	// Location matches locations containing it, ignoring case.
+	Location string
+	// BBox is minLat, minLng, maxLat, maxLng in floor coordinates.
+	BBox *[4]float64
+	// Review limits the listing to measurements in these review states.
+	Review map[string]bool
+	// Class is the data class listed, survey by default.
+	Class string
+	// Source is the radio listed, Wi-Fi by default.
+	Source string
+
+	Sort       string
+	Descending bool
+	Limit      int
+	Offset     int
+}
+
+// parseListOptions reads ?from and ?to (RFC 3339), ?type (comma-separated),
+// ?location, ?bbox, ?review (comma-separated), ?class, ?source, ?sort (a field, prefixed with - for descending order),
+// ?limit and ?offset.
+func parseListOptions(query url.Values) (listOptions, error) {
+	var o listOptions
+	for name, target := range map[string]*time.Time{"from": &o.From, "to": &o.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+			}
+			*target = parsed
+		}
+	}
+
+	if value := query.Get("type"); value != "" {
+		o.Types = make(map[string]bool)
+		for _, t := range strings.Split(value, ",") {
+			o.Types[strings.TrimSpace(t)] = true
+		}
+	}
+	o.Location = strings.ToLower(query.Get("location"))
+
+	if value := query.Get("bbox"); value != "" {
+		parts := strings.Split(value, ",")
+		if len(parts) != 4 {
+			return o, fmt.Errorf("bbox must be minLat,minLng,maxLat,maxLng")
+		}
+		var bbox [4]float64
+		for i, part := range parts {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return o, fmt.Errorf("bbox must be minLat,minLng,maxLat,maxLng")
+			}
+			bbox[i] = parsed
+		}
+		if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+			return o, fmt.Errorf("bbox minimum must not exceed its maximum")
+		}
+		o.BBox = &bbox
+	}
+
+	var err error
+	if o.Class, err = parseClass(query); err != nil {
+		return o, err
+	}
+	if o.Source, err = parseSource(query); err != nil {
+		return o, err
+	}
+
+	if o.Review, err = parseReviewStates(query); err != nil {
+		return o, err
+	}
+
+	if value := query.Get("sort"); value != "" {
+		o.Sort, o.Descending = strings.CutPrefix(value, "-")
+		if _, known := measurementSorts[o.Sort]; !known {
+			return o, fmt.Errorf("sort must be one of timestamp, dbm, floor, location or id, prefixed with - for descending order")
+		}
+	}
+
+	for name, target := range map[string]*int{"limit": &o.Limit, "offset": &o.Offset} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return o, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*target = parsed
+		}
+	}
+	return o, nil
+}
+
+func (o listOptions) match(m Measurement) bool {
+	if (!o.From.IsZero() && m.Timestamp.Before(o.From)) || (!o.To.IsZero() && m.Timestamp.After(o.To)) {
+		return false
+	}
+	if o.Types != nil && !o.Types[m.Type] {
+		return false
+	}
+	if o.Location != "" && !strings.Contains(strings.ToLower(m.Location), o.Location) {
+		return false
+	}
+	if b := o.BBox; b != nil && (m.Lat < b[0] || m.Lng < b[1] || m.Lat > b[2] || m.Lng > b[3]) {
+		return false
+	}
+	if o.Review != nil && !o.Review[m.reviewState()] {
+		return false
+	}
+	if !inClass(m, o.Class) || !inSource(m, o.Source) {
+		return false
+	}
+	return true
+}
+
+// page sorts the matching measurements and cuts out the requested page.
+func (o listOptions) page(ms []Measurement) []Measurement {
+	return pageItems(o, ms, func(m Measurement) Measurement { return m })
+}
+
+// pageItems pages items listed in place of measurements, such as merged
+// ones, sorting them by their measurement.
+func pageItems[T any](o listOptions, items []T, measurement func(T) Measurement) []T {
+	if o.Sort != "" {
+		compare := measurementSorts[o.Sort]
+		slices.SortStableFunc(items, func(a, b T) int {
+			if o.Descending {
+				return compare(measurement(b), measurement(a))
+			}
+			return compare(measurement(a), measurement(b))
+		})
+	}
+
+	if o.Offset >= len(items) {
+		return []T{}
+	}
+	items = items[o.Offset:]
+	if o.Limit > 0 && o.Limit < len(items) {
+		items = items[:o.Limit]
+	}
+	return items
+}
@@ -1,31 +1,38 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-const baseURL = "http://localhost:8080"
-
 var (
 	measurements []Measurement
 	floors       = make(map[int]Floor)
 	mutex        sync.Mutex
 	floorsLock   sync.RWMutex
+
+	// dataRevision identifies the current measurement data set and changes
+	// whenever measurements are saved.
+	dataRevision string
 )
 
 const (
@@ -33,51 +40,214 @@ const (
 	floorsFile       = "floors.json"
 )
 
+var mapContentTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
 type Measurement struct {
-	ID        string    `json:"id"`
-	Timestamp time.Time `json:"timestamp"`
-	Dbm       int       `json:"dbm"`
-	Lat       float64   `json:"lat"`
-	Lng       float64   `json:"lng"`
-	Floor     int       `json:"floor"`
-	Location  string    `json:"location"`
-	Type      string    `json:"type"`
+	ID        string        `json:"id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Dbm       int           `json:"dbm"`
+	Lat       float64       `json:"lat"`
+	Lng       float64       `json:"lng"`
+	Floor     int           `json:"floor"`
+	Location  string        `json:"location"`
+	Type      string        `json:"type"`
+	Accuracy  float64       `json:"accuracy,omitempty"`
+	PresetID  string        `json:"presetId,omitempty"`
+	SessionID string        `json:"sessionId,omitempty"`
+	SSID      string        `json:"ssid,omitempty"`
+	BSSID     string        `json:"bssid,omitempty"`
+	Freq      int           `json:"freq,omitempty"`
+	Channel   int           `json:"channel,omitempty"`
+	TxBitrate float64       `json:"txBitrate,omitempty"`
+	Roamed    bool          `json:"roamed,omitempty"`
+	Security  string        `json:"security,omitempty"`
+	ScanID    string        `json:"scanId,omitempty"`
+	TrackID   string        `json:"trackId,omitempty"`
+	DFS       bool          `json:"dfs,omitempty"`
+	Interface string        `json:"interface,omitempty"`
+	HasRaw    bool          `json:"hasRaw,omitempty"`
+	HasPcap   bool          `json:"hasPcap,omitempty"`
+	HasPhoto  bool          `json:"hasPhoto,omitempty"`
+	Spectrum  []SpectrumBin `json:"spectrum,omitempty"`
+	// Discarded is the number of warm-up samples thrown away before the
+	// signal was sampled.
+	Discarded int `json:"discarded,omitempty"`
+	// PMF is whether a scanned AP requires protected management frames:
+	// required, capable or none. SecurityFindings flag it as rogue or as
+	// duplicating an SSID, see posture.go.
+	PMF              string   `json:"pmf,omitempty"`
+	SecurityFindings []string `json:"securityFindings,omitempty"`
+	// Optional metrics beside the signal, see metrics.go.
+	LatencyMs      *float64 `json:"latencyMs,omitempty"`
+	ThroughputMbps *float64 `json:"throughputMbps,omitempty"`
+	UploadMbps     *float64 `json:"uploadMbps,omitempty"`
+	LossPercent    *float64 `json:"lossPercent,omitempty"`
+	JitterMs       *float64 `json:"jitterMs,omitempty"`
+	// Noise floor and busy time of the channel, from the channel survey.
+	NoiseDbm    *float64 `json:"noiseDbm,omitempty"`
+	SNRDb       *float64 `json:"snrDb,omitempty"`
+	BusyPercent *float64 `json:"busyPercent,omitempty"`
+	// Height is the height of the antenna above the floor in meters, when
+	// it was recorded.
+	Height *float64 `json:"height,omitempty"`
+	// Attributes are free-form details added by hooks, see hooks.go.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Review is the review state of measurements taken with -review, see
+	// review.go.
+	Review *Review `json:"review,omitempty"`
+	// Class is monitoring for the readings of continuous probes and empty
+	// for survey points, see dataclass.go.
+	Class string `json:"class,omitempty"`
+	// Source is cellular or ble for measurements of other radios than
+	// Wi-Fi, see sources.go. BLE scans store the address of each device in
+	// BSSID and its name in SSID; cellular measurements store the RSRP as
+	// Dbm, the SINR as SNRDb and the serving cell in Cellular.
+	Source   string        `json:"source,omitempty"`
+	Cellular *CellularInfo `json:"cellular,omitempty"`
 }
 
 type MeasurementRequest struct {
-	Lat      float64 `json:"lat"`
-	Lng      float64 `json:"lng"`
-	Floor    int     `json:"floor"`
-	Location string  `json:"location"`
-	Type     string  `json:"type"`
-	Samples  int     `json:"samples"`
-	Interval int     `json:"interval"`
+	// Lat and Lng are taken from the position provider when both are left
+	// out and it is not manual.
+	Lat       *float64 `json:"lat"`
+	Lng       *float64 `json:"lng"`
+	Floor     int      `json:"floor"`
+	Location  string   `json:"location"`
+	Type      string   `json:"type"`
+	Accuracy  float64  `json:"accuracy"`
+	Height    *float64 `json:"height"`
+	PresetID  string   `json:"presetId"`
+	SessionID string   `json:"sessionId"`
+	Samples   int      `json:"samples"`
+	Interval  int      `json:"interval"`
+	Profile   string   `json:"profile"`
+	// Discard is the number of warm-up samples thrown away before the
+	// samples; the profile's when left out.
+	Discard   *int   `json:"discard"`
+	KeepRaw   bool   `json:"keepRaw"`
+	Pcap      int    `json:"pcap"`
+	Interface string `json:"interface"`
+	// Pings is the number of echo requests sent to PingHost while
+	// sampling, for latency, jitter and loss.
+	Pings    int    `json:"pings"`
+	PingHost string `json:"pingHost"`
+	// Throughput is the throughput test run after sampling, iperf3 or
+	// http.
+	Throughput string `json:"throughput"`
+	// CurrentPosition takes the floor, position and accuracy from the
+	// position provider instead of the request.
+	CurrentPosition bool `json:"currentPosition"`
+	// Class is survey or monitoring; measurements taken through the HTTP
+	// API default to survey, MQTT readings to monitoring.
+	Class string `json:"class"`
+	// Source is the radio measured: wifi, the default, cellular or ble.
+	Source string `json:"source"`
+
+	// actor is who asked for the measurement, for the audit log.
+	actor string
 }
 
 type Floor struct {
 	ID      int    `json:"id"`
 	Name    string `json:"name"`
 	MapPath string `json:"mapPath"`
+	// MapWidth and MapHeight are the pixel size of the map.
+	MapWidth    int          `json:"mapWidth,omitempty"`
+	MapHeight   int          `json:"mapHeight,omitempty"`
+	Calibration *Calibration `json:"calibration,omitempty"`
+	Scale       *FloorScale  `json:"scale,omitempty"`
+	// Order sorts the floor list; floors of equal order are sorted by ID.
+	Order int `json:"order"`
+	// Site is set on floors mirrored from a federated site.
+	Site string `json:"site,omitempty"`
+	// Building is the ID of the building the floor belongs to, if any.
+	Building string `json:"building,omitempty"`
 }
 
 func main() {
-	if err := os.MkdirAll("uploads", 0755); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		if err := runRender(os.Args[2:]); err != nil {
+			log.Fatal("Render failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := runAPIKey(os.Args[2:]); err != nil {
+			log.Fatal("Creating the API key failed: ", err)
+		}
+		return
+	}
+
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatal("Failed to load the configuration: ", err)
+	}
+	if err := validateSiteID(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateProject(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAPIKeys(); err != nil {
+		log.Fatal("Failed to load API keys: ", err)
+	}
+	signalReader = newSignalReader()
+	provider, err := newPositionProvider()
+	if err != nil {
+		log.Fatal("Failed to set up the position provider: ", err)
+	}
+	positionProvider = provider
+
+	if err := migrateFlatLayout(); err != nil {
+		log.Fatal("Failed to migrate data into the project directory: ", err)
+	}
+	if err := os.MkdirAll(projectUploads(), 0755); err != nil {
 		log.Fatal("Failed to create uploads directory:", err)
 	}
 
 	if err := loadData(); err != nil {
 		log.Fatal("Failed to load data:", err)
 	}
+	if err := migrateMapPaths(); err != nil {
+		log.Fatal("Failed to migrate floor maps: ", err)
+	}
+
+	logBackendHealth(*wifiInterface)
 
-	if len(floors) == 0 {
-		saveFloors()
+	if *dfsMonitor {
+		startDFSMonitor(*wifiInterface)
 	}
 
+	startFederation()
+	startUsageFlush()
+	startTasksFlush()
+	startStoreFlush()
+	startStorageCheck()
+	startPruning()
+	startMQTT()
+	startGRPC()
+	startInflux()
+	startSNMPPolling()
+	startQualityReports()
+
 	corsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Add("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, X-Total-Count")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -91,81 +261,259 @@ func main() {
 	router := http.NewServeMux()
 	router.HandleFunc("/api/measurements", getMeasurementsHandler)
 	router.HandleFunc("/api/add", addMeasurementHandler)
-	router.HandleFunc("/api/export", exportHandler)
+	router.HandleFunc("/api/jobs/{id}", jobHandler)
+	router.HandleFunc("/api/export", withTask(taskExport, exportHandler))
 	router.HandleFunc("/api/delete/", deleteMeasurementHandler)
+	router.HandleFunc("/api/measurements/{id}", updateMeasurementHandler)
+	router.HandleFunc("/api/measurements/{id}/raw", rawDumpHandler)
+	router.HandleFunc("/api/measurements/{id}/pcap", pcapHandler)
+	router.HandleFunc("/api/measurements/{id}/photo", photoHandler)
+	router.HandleFunc("/api/measurements/{id}/photo/thumb", photoThumbHandler)
+	router.HandleFunc("/api/review", reviewHandler)
 	router.HandleFunc("/api/floors", floorsHandler)
 	router.HandleFunc("/api/floors/add", addFloorHandler)
+	router.HandleFunc("/api/floors/bulk", floorArchiveHandler)
+	router.HandleFunc("/api/floors/import", floorImportHandler)
 	router.HandleFunc("/api/floors/upload-map/", uploadMapHandler)
+	router.HandleFunc("/api/floors/", floorRouteHandler)
+	router.HandleFunc("/api/buildings", buildingsHandler)
+	router.HandleFunc("/api/buildings/{id}", buildingHandler)
+	router.HandleFunc("/api/project", projectHandler)
+	router.HandleFunc("/api/crs", crsHandler)
+	router.HandleFunc("/api/presets", presetsHandler)
+	router.HandleFunc("/api/presets/{id}", presetHandler)
+	router.HandleFunc("/api/sessions", sessionsHandler)
+	router.HandleFunc("/api/sessions/{id}", sessionHandler)
+	router.HandleFunc("/api/zones", zonesHandler)
+	router.HandleFunc("/api/stats", withAnalyticsCache(statsHandler))
+	router.HandleFunc("/api/timeseries", withAnalyticsCache(timeSeriesHandler))
+	router.HandleFunc("/api/zones/stats", withAnalyticsCache(zoneStatsHandler))
+	router.HandleFunc("/api/zones/{id}", zoneHandler)
+	router.HandleFunc("/api/snapshots", snapshotsHandler)
+	router.HandleFunc("/api/snapshots/{id}", snapshotHandler)
+	router.HandleFunc("/api/snapshots/{id}/image", snapshotImageHandler)
+	router.HandleFunc("/api/heatmap", withTask(taskRender, heatmapHandler))
+	router.HandleFunc("/api/report", withTask(taskRender, reportHandler))
+	router.HandleFunc("/api/tiles/{floor}/{z}/{x}/{y}", tileHandler)
+	router.HandleFunc("/api/metrics", metricsHandler)
+	router.HandleFunc("/api/quality", qualityHandler)
+	router.HandleFunc("/api/analysis/coverage", withAnalyticsCache(coverageAnalysisHandler))
+	router.HandleFunc("/api/analysis/ap-removal", withAnalyticsCache(apRemovalHandler))
+	router.HandleFunc("/api/analysis/band-steering", withAnalyticsCache(bandSteeringHandler))
+	router.HandleFunc("/api/analysis/rogues", withAnalyticsCache(roguesHandler))
+	router.HandleFunc("/api/tickets", ticketsHandler)
+	router.HandleFunc("/api/analysis/placement", placementHandler)
+	router.HandleFunc("/api/pathloss", pathLossModelsHandler)
+	router.HandleFunc("/api/pathloss/{id}", pathLossModelHandler)
+	router.HandleFunc("/api/pathloss/{id}/samples", pathLossSamplesHandler)
+	router.HandleFunc("/api/ingest/prometheus", prometheusIngestHandler)
+	router.HandleFunc("/api/position", positionHandler)
+	router.HandleFunc("/api/track", trackHandler)
+	router.HandleFunc("/api/track/start", trackStartHandler)
+	router.HandleFunc("/api/track/position", trackPositionHandler)
+	router.HandleFunc("/api/track/stop", trackStopHandler)
+	router.HandleFunc("/api/ws", wsHandler)
+	router.HandleFunc("/api/changes", changesHandler)
+	router.HandleFunc("/api/import", withTask(taskImport, importHandler))
+	router.HandleFunc("/api/prune", pruneHandler)
+	router.HandleFunc("/api/aggregates", aggregatesHandler)
+	router.HandleFunc("/api/baselines", baselinesHandler)
+	router.HandleFunc("/api/tasks", tasksHandler)
+	router.HandleFunc("/api/tasks/{id}", taskHandler)
+	router.HandleFunc("/api/tasks/{id}/retry", taskRetryHandler)
+	router.HandleFunc("/api/federation/snapshot", federationSnapshotHandler)
+	router.HandleFunc("/api/federation/push", federationPushHandler)
+	router.HandleFunc("/api/federation/sites", federationSitesHandler)
+	router.HandleFunc("/api/federation/sites/{id}", federationSiteHandler)
+	router.HandleFunc("/api/federation/sites/{id}/sync", federationSyncHandler)
+	router.HandleFunc("/api/compare", withAnalyticsCache(compareHandler))
+	router.HandleFunc("/api/compare/image", withTask(taskRender, sideBySideHandler))
+	router.HandleFunc("/api/estimate", estimateHandler)
+	router.HandleFunc("/api/interpolate", interpolateHandler)
+	router.HandleFunc("/api/clusters", clustersHandler)
+	router.HandleFunc("/api/config", configHandler)
+	router.HandleFunc("/api/thresholds", thresholdsHandler)
+	router.HandleFunc("/api/interpolators", interpolatorsHandler)
+	router.HandleFunc("/api/interfaces", interfacesHandler)
+	router.HandleFunc("/api/wifi/status", wifiStatusHandler)
+	router.HandleFunc("/api/wifi/stream", wifiStreamHandler)
+	router.HandleFunc("/api/regulatory", regulatoryHandler)
+	router.HandleFunc("/api/dfs-events", dfsEventsHandler)
+	router.HandleFunc("/api/admin/usage", usageHandler)
+	router.HandleFunc("/api/audit", auditHandler)
+	router.HandleFunc("/api/admin/cache", analyticsCacheHandler)
+	router.HandleFunc("/api/alerts", alertsHandler)
+	router.HandleFunc("/api/alerts/{id}", alertHandler)
+	router.HandleFunc("/api/aps", accessPointsHandler)
+	router.HandleFunc("/api/aps/{id}", accessPointHandler)
+	router.HandleFunc("/api/aps/{id}/poll", accessPointPollHandler)
+	router.HandleFunc("/api/aps/{id}/compare", accessPointCompareHandler)
+	router.HandleFunc("/api/shares", sharesHandler)
+	router.HandleFunc("/api/shares/{id}", shareHandler)
+	router.HandleFunc("/embed/{floor}", embedHandler)
+	router.HandleFunc("/embed/{floor}/heatmap.png", embedHeatmapHandler)
+	router.HandleFunc("/api/settings", settingsHandler)
+	router.HandleFunc("/api/openapi.json", openAPIHandler)
+	router.HandleFunc("/readyz", readyzHandler)
 	router.HandleFunc("/uploads/", serveFileHandler)
+	if *serveUI {
+		router.Handle("/", uiHandler())
+	}
+
+	server := &http.Server{
+		Addr:    *listenAddr,
+		Handler: securityHeadersMiddleware(corsMiddleware(problemMiddleware(authMiddleware(readOnlyMiddleware(validationMiddleware(usageMiddleware(router))))))),
+	}
 
-	log.Println("Server running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", corsMiddleware(router)))
+	// A second signal during shutdown kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		stop()
+		shutdown(server)
+		close(stopped)
+	}()
+
+	log.Printf("Server listening on %s...", *listenAddr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Server stopped")
 }
 
 func loadData() error {
-	if err := loadMeasurements(); err != nil {
+	var err error
+	if store, err = openStore(); err != nil {
+		return fmt.Errorf("failed to open store: %v", err)
+	}
+	store = guardedStore{store}
+
+	loadedMeasurements, err := store.LoadMeasurements()
+	if err != nil {
 		return fmt.Errorf("Failed to load measurements: %v", err)
 	}
 
-	if err := loadFloors(); err != nil {
+	loadedFloors, err := store.LoadFloors()
+	if err != nil {
 		return fmt.Errorf("failed to load floors: %v", err)
 	}
 
-	return nil
-}
+	fillMapSizes(loadedFloors)
 
-func loadMeasurements() error {
 	mutex.Lock()
-	defer mutex.Unlock()
+	measurements, floors = loadedMeasurements, loadedFloors
+	updateRevision()
+	mutex.Unlock()
 
-	data, err := os.ReadFile(measurementsFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+	if err := loadDFSEvents(); err != nil {
+		return fmt.Errorf("failed to load DFS events: %v", err)
 	}
 
-	return json.Unmarshal(data, &measurements)
-}
+	if err := loadSnapshots(); err != nil {
+		return fmt.Errorf("failed to load snapshots: %v", err)
+	}
 
-func loadFloors() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := loadPresets(); err != nil {
+		return fmt.Errorf("failed to load presets: %v", err)
+	}
 
-	data, err := os.ReadFile(floorsFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
+	if err := loadAlerts(); err != nil {
+		return fmt.Errorf("failed to load alert rules: %v", err)
 	}
 
-	return json.Unmarshal(data, &floors)
-}
+	if err := loadShares(); err != nil {
+		return fmt.Errorf("failed to load shares: %v", err)
+	}
 
-func saveMeasurements() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := loadAccessPoints(); err != nil {
+		return fmt.Errorf("failed to load access points: %v", err)
+	}
 
-	data, err := json.MarshalIndent(measurements, "", "  ")
-	if err != nil {
-		return err
+	if err := loadBuildings(); err != nil {
+		return fmt.Errorf("failed to load buildings: %v", err)
 	}
 
-	return os.WriteFile(measurementsFile, data, 0644)
-}
+	if err := loadProjectSettings(); err != nil {
+		return fmt.Errorf("failed to load project settings: %v", err)
+	}
 
-func saveFloors() error {
-	mutex.Lock()
-	defer mutex.Unlock()
+	if err := loadHooks(); err != nil {
+		return fmt.Errorf("failed to load hooks: %v", err)
+	}
 
-	data, err := json.MarshalIndent(floors, "", "  ")
-	if err != nil {
-		return err
+	if err := loadUsage(); err != nil {
+		return fmt.Errorf("failed to load usage statistics: %v", err)
 	}
 
-	return os.WriteFile(floorsFile, data, 0644)
+	if err := loadAuditLog(); err != nil {
+		return fmt.Errorf("failed to load the audit log: %v", err)
+	}
+
+	if err := loadSessions(); err != nil {
+		return fmt.Errorf("failed to load sessions: %v", err)
+	}
+
+	if err := loadAggregates(); err != nil {
+		return fmt.Errorf("failed to load daily aggregates: %v", err)
+	}
+
+	if err := loadBaselines(); err != nil {
+		return fmt.Errorf("failed to load baselines: %v", err)
+	}
+
+	if err := loadZones(); err != nil {
+		return fmt.Errorf("failed to load zones: %v", err)
+	}
+
+	if err := loadObstacles(); err != nil {
+		return fmt.Errorf("failed to load obstacles: %v", err)
+	}
+
+	if err := loadPathLossModels(); err != nil {
+		return fmt.Errorf("failed to load path loss models: %v", err)
+	}
+
+	if err := loadTasks(); err != nil {
+		return fmt.Errorf("failed to load tasks: %v", err)
+	}
+
+	if err := loadFederation(); err != nil {
+		return fmt.Errorf("failed to load federation sites: %v", err)
+	}
+
+	if err := loadSamplingProfiles(); err != nil {
+		return fmt.Errorf("failed to load sampling profiles: %v", err)
+	}
+
+	if _, ok := samplingProfiles[*defaultProfile]; !ok {
+		return fmt.Errorf("unknown default sampling profile %q", *defaultProfile)
+	}
+	applyDefaultSampling()
+
+	if err := loadThresholdProfiles(); err != nil {
+		return fmt.Errorf("failed to load threshold profiles: %v", err)
+	}
+
+	if _, ok := thresholdProfiles[*defaultThreshold]; !ok {
+		return fmt.Errorf("unknown default threshold profile %q", *defaultThreshold)
+	}
+
+	if err := loadServerSettings(); err != nil {
+		return fmt.Errorf("failed to load settings: %v", err)
+	}
+
+	return nil
+}
+
+// updateRevision recomputes dataRevision from the measurements. Callers
+// must hold mutex.
+func updateRevision() {
+	data, _ := json.Marshal(measurements)
+	h := fnv.New64a()
+	h.Write(data)
+	dataRevision = fmt.Sprintf("%016x", h.Sum64())
 }
 
 func serveFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -180,14 +528,8 @@ func serveFileHandler(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		urlParts := strings.Split(floor.MapPath, baseURL)
-		if len(urlParts) < 2 {
-			continue
-		}
-		floorFilePath := urlParts[1]
-
-		if floorFilePath == requestedPath {
-			filePath = strings.TrimPrefix(floorFilePath, "/")
+		if strings.TrimPrefix(floor.MapPath, *baseURL) == requestedPath {
+			filePath = uploadFile(floor.MapPath)
 			break
 		}
 	}
@@ -202,17 +544,11 @@ func serveFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ext := filepath.Ext(filePath)
-	switch ext {
-	case ".png":
-		w.Header().Set("Content-Type", "image/png")
-	case ".jpg", ".jpeg":
-		w.Header().Set("Content-Type", "image/jpeg")
-	case ".gif":
-		w.Header().Set("Content-Type", "image/gif")
-	default:
-		w.Header().Set("Content-Type", "application/octet-stream")
+	contentType, ok := mapContentTypes[strings.ToLower(filepath.Ext(filePath))]
+	if !ok {
+		contentType = "application/octet-stream"
 	}
+	w.Header().Set("Content-Type", contentType)
 
 	http.ServeFile(w, r, filePath)
 }
@@ -223,78 +559,227 @@ func uploadMapHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	floorID, err := strconv.Atoi(filepath.Base(r.URL.Path))
+	if err != nil {
+		http.Error(w, "invalid floor ID", http.StatusBadRequest)
+		return
+	}
+
+	uploadFloorMap(w, r, floorID)
+}
+
+// uploadFloorMap stores the map uploaded in the multipart field "map".
+func uploadFloorMap(w http.ResponseWriter, r *http.Request, floorID int) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMapSize+1<<20)
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		http.Error(w, "failed to parse multipart form", http.StatusBadRequest)
 		return
 	}
 
-	floorID, err := strconv.Atoi(filepath.Base(r.URL.Path))
+	file, _, err := r.FormFile("map")
 	if err != nil {
-		http.Error(w, "invalid floor ID", http.StatusBadRequest)
+		http.Error(w, "filed to get file from form", http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
 
-	file, header, err := r.FormFile("map")
+	data, err := io.ReadAll(io.LimitReader(file, maxMapSize+1))
 	if err != nil {
-		http.Error(w, "filed to get file from form", http.StatusBadRequest)
+		http.Error(w, "failed to read file", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxMapSize {
+		http.Error(w, fmt.Sprintf("map is larger than %d MB", maxMapSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, ext, err := readMapUpload(r.Context(), data)
+	if err != nil {
+		http.Error(w, err.Error(), mapErrorStatus(err))
 		return
 	}
-	defer file.Close()
 
-	if err := os.MkdirAll("uploads", os.ModePerm); err != nil {
-		http.Error(w, "failed to create uploads directory", http.StatusInternalServerError)
+	floor, err := saveFloorMap(floorID, ext, bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, errFloorNotFound) {
+			http.Error(w, "floor not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	publishFloor(eventFloorUpdated, floor)
+	auditFloor(auditActor(r), eventFloorUpdated, "map uploaded", floor.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"path":      floor.MapPath,
+		"width":     floor.MapWidth,
+		"height":    floor.MapHeight,
+		"thumbnail": fmt.Sprintf("/api/floors/%d/thumbnail", floor.ID),
+	})
+}
+
+var errFloorNotFound = errors.New("floor not found")
+
+// saveFloorMap stores a map image for the floor under uploads/ and points
+// the floor at it.
+func saveFloorMap(floorID int, ext string, src io.Reader) (Floor, error) {
+	// A map of no floor would be left behind in the uploads.
+	mutex.Lock()
+	_, exists := floors[floorID]
+	mutex.Unlock()
+	if !exists {
+		return Floor{}, errFloorNotFound
+	}
+
+	if err := os.MkdirAll(projectUploads(), os.ModePerm); err != nil {
+		return Floor{}, fmt.Errorf("failed to create uploads directory")
+	}
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return Floor{}, fmt.Errorf("failed to read file content")
+	}
+	width, height, err := mapImageSize(detectMapType(data), data)
+	if err != nil {
+		log.Printf("failed to read the size of the map of floor %d: %v", floorID, err)
+	}
 
-	ext := filepath.Ext(header.Filename)
 	newFilename := fmt.Sprintf("floor_%d_map%s", floorID, ext)
-	filePath := filepath.Join("uploads", newFilename)
+	filePath := filepath.Join(projectUploads(), newFilename)
 
 	out, err := os.Create(filePath)
 	if err != nil {
-		http.Error(w, "failed to create file on server", http.StatusInternalServerError)
-		return
+		return Floor{}, fmt.Errorf("failed to create file on server")
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "failed to save file content", http.StatusInternalServerError)
-		return
+	if _, err := out.Write(data); err != nil {
+		return Floor{}, fmt.Errorf("failed to save file content")
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	os.Remove(mapThumbnailFile(floorID))
+	if err := writeMapThumbnail(floorID, data); err != nil {
+		log.Printf("no thumbnail for the map of floor %d: %v", floorID, err)
+	}
 
-	if floor, exists := floors[floorID]; exists {
-		floor.MapPath = fmt.Sprintf("/uploads/%s", newFilename)
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	if exists {
+		floor.MapPath = uploadURL(newFilename)
+		floor.MapWidth, floor.MapHeight = width, height
 		floors[floorID] = floor
-		if err := saveFloors(); err != nil {
-			http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+	}
+	mutex.Unlock()
+
+	// The floor was deleted meanwhile.
+	if !exists {
+		os.Remove(filePath)
+		os.Remove(mapThumbnailFile(floorID))
+		return Floor{}, errFloorNotFound
+	}
+
+	if err := store.SaveFloor(floor); err != nil {
+		return Floor{}, fmt.Errorf("failed to save floor data")
+	}
+
+	return floor, nil
+}
+
+func floorsHandler(w http.ResponseWriter, r *http.Request) {
+	building := r.URL.Query().Get("building")
+	if building != "" {
+		if _, exists := getBuilding(building); !exists {
+			http.Error(w, "building not found", http.StatusNotFound)
 			return
 		}
-	} else {
-		http.Error(w, "floor not found", http.StatusNotFound)
-		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "success",
-		"path":   floors[floorID].MapPath,
-	})
+	json.NewEncoder(w).Encode(sortedFloors(building))
 }
 
-func floorsHandler(w http.ResponseWriter, r *http.Request) {
+// sortedFloors lists the floors of the building, or all floors for "", in
+// the order of the floor list.
+func sortedFloors(building string) []Floor {
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	var floorList []Floor
 	for _, floor := range floors {
-		floorList = append(floorList, floor)
+		if building == "" || floor.Building == building {
+			floorList = append(floorList, floor)
+		}
 	}
+	sort.Slice(floorList, func(i, j int) bool {
+		if floorList[i].Order != floorList[j].Order {
+			return floorList[i].Order < floorList[j].Order
+		}
+		return floorList[i].ID < floorList[j].ID
+	})
+	return floorList
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(floorList)
+// floorRouteHandler dispatches /api/floors/{id}/{action} requests.
+func floorRouteHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/floors/"), "/"), "/")
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	floorID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "invalid floor ID", http.StatusBadRequest)
+		return
+	}
+
+	if len(parts) == 1 {
+		floorHandler(w, r, floorID)
+		return
+	}
+
+	switch parts[1] {
+	case "calibration":
+		calibrationHandler(w, r, floorID)
+	case "transform":
+		transformHandler(w, r, floorID)
+	case "export.png":
+		withTask(taskExport, func(w http.ResponseWriter, r *http.Request) {
+			floorExportHandler(w, r, floorID)
+		})(w, r)
+	case "export.dxf":
+		withTask(taskExport, func(w http.ResponseWriter, r *http.Request) {
+			floorDXFHandler(w, r, floorID)
+		})(w, r)
+	case "export.esx", "export.netspot":
+		withTask(taskExport, func(w http.ResponseWriter, r *http.Request) {
+			surveyExportHandler(w, r, floorID, strings.TrimPrefix(parts[1], "export."))
+		})(w, r)
+	case "sla":
+		withAnalyticsCache(func(w http.ResponseWriter, r *http.Request) {
+			slaHandler(w, r, floorID)
+		})(w, r)
+	case "map":
+		floorMapHandler(w, r, floorID)
+	case "thumbnail":
+		floorThumbnailHandler(w, r, floorID)
+	case "align":
+		alignHandler(w, r, floorID)
+	case "reposition":
+		repositionHandler(w, r, floorID)
+	case "scale":
+		scaleHandler(w, r, floorID)
+	case "obstacles":
+		obstaclesHandler(w, r, floorID)
+	case "heatmap.mbtiles":
+		withTask(taskRender, func(w http.ResponseWriter, r *http.Request) {
+			floorMBTilesHandler(w, r, floorID)
+		})(w, r)
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 func addFloorHandler(w http.ResponseWriter, r *http.Request) {
@@ -304,33 +789,295 @@ func addFloorHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Name string `json:"name"`
+		Name     string `json:"name"`
+		Building string `json:"building"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var err error
+	if req.Name, err = cleanText("name", req.Name, maxNameLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Building != "" {
+		if _, exists := getBuilding(req.Building); !exists {
+			http.Error(w, "building not found", http.StatusBadRequest)
+			return
+		}
+	}
 
 	mutex.Lock()
-	defer mutex.Unlock()
-
-	newID := 1
-	for id := range floors {
+	newID, order := 1, 0
+	for id, existing := range floors {
 		if id >= newID {
 			newID = id + 1
 		}
+		order = max(order, existing.Order)
 	}
 
-	floors[newID] = Floor{
-		ID:   newID,
-		Name: req.Name,
+	// The new floor sorts last.
+	floor := Floor{
+		ID:       newID,
+		Name:     req.Name,
+		Order:    order,
+		Building: req.Building,
+	}
+	floors[newID] = floor
+	mutex.Unlock()
+
+	if err := store.SaveFloor(floor); err != nil {
+		http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+		return
 	}
-	saveFloors()
+	publishFloor(eventFloorCreated, floor)
+	auditFloor(auditActor(r), eventFloorCreated, "", floor.ID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(floors[newID])
+	json.NewEncoder(w).Encode(floor)
+}
+
+// FloorUpdate renames or reorders a floor. Fields left out keep their
+// value.
+type FloorUpdate struct {
+	Name  *string `json:"name"`
+	Order *int    `json:"order"`
+	// Building moves the floor to another building, "" to none.
+	Building *string `json:"building"`
+}
+
+// floorHandler returns, updates or deletes a floor. Deleting a floor with
+// measurements requires ?measurements=delete to delete them too, or
+// ?measurements=reassign&to={id} to move them to another floor.
+func floorHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(floor)
+		return
+	case "PUT", "DELETE":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if floor.Site != "" {
+		http.Error(w, fmt.Sprintf("floor is mirrored from site %s", floor.Site), http.StatusConflict)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		deleteFloorHandler(w, r, floorID)
+		return
+	}
+
+	var update FloorUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Name != nil {
+		name, err := cleanText("name", *update.Name, maxNameLength, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name == "" {
+			http.Error(w, "name must not be empty", http.StatusBadRequest)
+			return
+		}
+		update.Name = &name
+	}
+	if update.Building != nil && *update.Building != "" {
+		if _, exists := getBuilding(*update.Building); !exists {
+			http.Error(w, "building not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	floor, exists = floors[floorID]
+	if exists {
+		if update.Name != nil {
+			floor.Name = *update.Name
+		}
+		if update.Order != nil {
+			floor.Order = *update.Order
+		}
+		if update.Building != nil {
+			floor.Building = *update.Building
+		}
+		floors[floorID] = floor
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	if err := store.SaveFloor(floor); err != nil {
+		http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+		return
+	}
+	publishFloor(eventFloorUpdated, floor)
+	auditFloor(auditActor(r), eventFloorUpdated, "", floor.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(floor)
+}
+
+func deleteFloorHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	query := r.URL.Query()
+	policy := query.Get("measurements")
+
+	target := 0
+	switch policy {
+	case "", "delete":
+	case "reassign":
+		var err error
+		if target, err = strconv.Atoi(query.Get("to")); err != nil {
+			http.Error(w, "reassign needs the floor ID to move measurements to", http.StatusBadRequest)
+			return
+		}
+		mutex.Lock()
+		targetFloor, exists := floors[target]
+		mutex.Unlock()
+		if !exists || target == floorID {
+			http.Error(w, "target floor not found", http.StatusBadRequest)
+			return
+		}
+		if targetFloor.Site != "" {
+			http.Error(w, fmt.Sprintf("floor %d is mirrored from site %s", target, targetFloor.Site), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "measurements must be delete or reassign", http.StatusBadRequest)
+		return
+	}
+
+	// The floor is removed first, so no measurement can be added to it
+	// while its measurements are handled.
+	mutex.Lock()
+	floor := floors[floorID]
+	count := 0
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			count++
+		}
+	}
+	if count > 0 && policy == "" {
+		mutex.Unlock()
+		http.Error(w, fmt.Sprintf("floor has %d measurements, pass measurements=delete or measurements=reassign&to={id}", count), http.StatusConflict)
+		return
+	}
+	delete(floors, floorID)
+	mapFile := uploadFile(floor.MapPath)
+	mapShared := false
+	for _, other := range floors {
+		if uploadFile(other.MapPath) == mapFile {
+			mapShared = true
+		}
+	}
+
+	var moved []Measurement
+	if policy == "reassign" {
+		for i, m := range measurements {
+			if m.Floor == floorID {
+				measurements[i].Floor = target
+				moved = append(moved, measurements[i])
+			}
+		}
+		if len(moved) > 0 {
+			updateRevision()
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if err := store.DeleteFloor(floorID); err != nil {
+		http.Error(w, "failed to delete floor data", http.StatusInternalServerError)
+		return
+	}
+	publishFloor(eventFloorDeleted, floor)
+	actor := auditActor(r)
+	auditFloor(actor, eventFloorDeleted, "", floorID)
+
+	if policy == "delete" {
+		detail := fmt.Sprintf("floor %d deleted", floorID)
+		if _, err := deleteMeasurementsWhere(actor, detail, func(m Measurement) bool { return m.Floor == floorID }); err != nil {
+			http.Error(w, "failed to delete measurements", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, record := range moved {
+		if err := store.SaveMeasurement(record); err != nil {
+			http.Error(w, "failed to save measurement", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(moved) > 0 {
+		publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: moved}, 0)
+		auditMeasurements(actor, eventMeasurementsUpdated, fmt.Sprintf("moved from deleted floor %d", floorID), moved)
+	}
+
+	if mapFile != "" && !mapShared {
+		if err := os.Remove(mapFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to delete the map of floor %d: %v", floorID, err)
+		}
+	}
+	if err := os.Remove(mapThumbnailFile(floorID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to delete the map thumbnail of floor %d: %v", floorID, err)
+	}
+	if err := deleteFloorData(floorID); err != nil {
+		log.Printf("failed to delete the zones, presets or obstacles of floor %d: %v", floorID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "measurements": count, "policy": policy})
+}
+
+// deleteFloorData removes the zones, presets and obstacles drawn on a
+// deleted floor; their coordinates mean nothing on another floor.
+func deleteFloorData(floorID int) error {
+	zonesLock.Lock()
+	for id, zone := range zones {
+		if zone.Floor == floorID {
+			delete(zones, id)
+		}
+	}
+	zonesLock.Unlock()
+	if err := saveZones(); err != nil {
+		return err
+	}
+
+	presetsLock.Lock()
+	for id, preset := range presets {
+		if preset.Floor == floorID {
+			delete(presets, id)
+		}
+	}
+	presetsLock.Unlock()
+	if err := savePresets(); err != nil {
+		return err
+	}
+
+	obstaclesLock.Lock()
+	delete(obstacles, floorID)
+	obstaclesLock.Unlock()
+	return saveObstacles()
 }
 
 func deleteMeasurementHandler(w http.ResponseWriter, r *http.Request) {
@@ -345,54 +1092,228 @@ func deleteMeasurementHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	found, err := deleteMeasurement(auditActor(r), id)
+	if !found {
+		http.Error(w, "Measurement not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+}
+
+// deleteMeasurement deletes a measurement and its attachments on behalf of
+// actor. It returns false when the measurement does not exist.
+func deleteMeasurement(actor, id string) (bool, error) {
 	mutex.Lock()
-	found := false
+	var deleted []Measurement
 	for i, m := range measurements {
 		if m.ID == id {
+			deleted = []Measurement{m}
 			measurements = append(measurements[:i], measurements[i+1:]...)
-			found = true
 			break
 		}
 	}
+	found := deleted != nil
+	if found {
+		updateRevision()
+	}
+	revision := dataRevision
 	mutex.Unlock()
 
 	if !found {
-		http.Error(w, "Measurement not found", http.StatusNotFound)
+		return false, nil
+	}
+
+	// The measurement is gone from memory, and with it from every
+	// response, even if the store fails to follow.
+	publishDeleted([]string{id}, revision)
+	auditMeasurements(actor, eventMeasurementsDeleted, "", deleted)
+	if err := store.DeleteMeasurement(id); err != nil {
+		return true, fmt.Errorf("failed to delete measurement")
+	}
+
+	if err := deleteAttachments(id); err != nil {
+		log.Printf("failed to delete attachments of %s: %v", id, err)
+	}
+	return true, nil
+}
+
+// MeasurementUpdate lists the fields of a measurement that can be edited.
+// Fields left out keep their value.
+type MeasurementUpdate struct {
+	Lat      *float64 `json:"lat"`
+	Lng      *float64 `json:"lng"`
+	Floor    *int     `json:"floor"`
+	Location *string  `json:"location"`
+	Type     *string  `json:"type"`
+	Height   *float64 `json:"height"`
+}
+
+// editableTypes are the types a measurement can be changed to; the others
+// describe how a record was collected.
+var editableTypes = map[string]bool{"location": true, "accesspoint": true}
+
+// updateMeasurementHandler corrects the position, floor, label or type of
+// a measurement, e.g. after a mis-click on the map.
+func updateMeasurementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := saveMeasurements(); err != nil {
+	var update MeasurementUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, v := range []*float64{update.Lat, update.Lng} {
+		if v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0)) {
+			http.Error(w, "coordinates must be finite", http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Location != nil {
+		location, err := cleanText("location", *update.Location, maxLocationLength, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		update.Location = &location
+	}
+	if err := validateHeight(update.Height); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	id := r.PathValue("id")
+
+	mutex.Lock()
+	index := -1
+	for i, m := range measurements {
+		if m.ID == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		mutex.Unlock()
+		http.Error(w, "measurement not found", http.StatusNotFound)
+		return
+	}
+	if update.Floor != nil {
+		if _, exists := floors[*update.Floor]; !exists {
+			mutex.Unlock()
+			http.Error(w, "floor not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	record := measurements[index]
+	if update.Type != nil && *update.Type != record.Type && !editableTypes[*update.Type] {
+		mutex.Unlock()
+		http.Error(w, "type must be location or accesspoint", http.StatusBadRequest)
+		return
+	}
+
+	if update.Lat != nil {
+		record.Lat = *update.Lat
+	}
+	if update.Lng != nil {
+		record.Lng = *update.Lng
+	}
+	if update.Floor != nil {
+		record.Floor = *update.Floor
+	}
+	if update.Location != nil {
+		record.Location = *update.Location
+	}
+	if update.Type != nil {
+		record.Type = *update.Type
+	}
+	if update.Height != nil {
+		record.Height = update.Height
+	}
+	reopenReview(&record)
+	previous := measurements[index]
+	measurements[index] = record
+	updateRevision()
+	revision := dataRevision
+	mutex.Unlock()
+
+	if err := store.SaveMeasurement(record); err != nil {
+		http.Error(w, "failed to save measurement", http.StatusInternalServerError)
+		return
+	}
+	publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: []Measurement{record}}, 0)
+	auditEdit(auditActor(r), previous, record)
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	json.NewEncoder(w).Encode(record)
 }
 
 func getMeasurementsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		batchDeleteHandler(w, r)
+		return
+	}
+
 	floorStr := r.URL.Query().Get("floor")
 	floor, err := strconv.Atoi(floorStr)
 	if err != nil {
 		floor = 0
 	}
+	session := r.URL.Query().Get("session")
+	buildingFloorIDs, err := buildingFloors(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	height, err := parseHeightRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signal, err := parseSignalFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aggregate, err := parseAggregation(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	mutex.Lock()
-	defer mutex.Unlock()
-
+	// The page is sorted and encoded outside the lock, on a copy.
 	var filtered []Measurement
-	if floor > 0 {
-		for _, m := range measurements {
-			if m.Floor == floor {
-				filtered = append(filtered, m)
-			}
+	for _, m := range measurements {
+		if (floor <= 0 || m.Floor == floor) && inSession(m, session) && (buildingFloorIDs == nil || buildingFloorIDs[m.Floor]) && height.match(m) && signal.match(m) && options.match(m) {
+			filtered = append(filtered, m)
 		}
-	} else {
-		filtered = measurements
 	}
+	mutex.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(filtered)
+	if aggregate.Enabled {
+		merged := aggregateMeasurements(filtered, aggregate, true)
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(merged)))
+		json.NewEncoder(w).Encode(pageItems(options, merged, func(m MergedMeasurement) Measurement { return m.Measurement }))
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(filtered)))
+	json.NewEncoder(w).Encode(options.page(filtered))
 }
 
 func addMeasurementHandler(w http.ResponseWriter, r *http.Request) {
@@ -410,108 +1331,312 @@ func addMeasurementHandler(w http.ResponseWriter, r *http.Request) {
 	if req.Type == "" {
 		req.Type = "location"
 	}
-	if req.Samples <= 0 {
-		req.Samples = 5
+	if req.PresetID != "" {
+		preset, exists := getPreset(req.PresetID)
+		if !exists {
+			http.Error(w, "preset not found", http.StatusBadRequest)
+			return
+		}
+		req.setCoordinates(preset.Lat, preset.Lng)
+		req.Floor, req.Location = preset.Floor, preset.Name
+	}
+	// A request without coordinates is placed at the current fix, unless
+	// positions are manual and it is at 0,0 as it always was.
+	located := req.Lat != nil || req.Lng != nil
+	if req.CurrentPosition || (!located && *positionProviderName != positionManual) {
+		position, err := positionProvider.Position()
+		if errors.Is(err, errNoPositionProvider) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if !req.CurrentPosition && req.Floor != 0 && req.Floor != position.Floor {
+			http.Error(w, fmt.Sprintf("the current position is on floor %d, not %d; give lat and lng", position.Floor, req.Floor), http.StatusBadRequest)
+			return
+		}
+		req.setCoordinates(position.Lat, position.Lng)
+		req.Floor = position.Floor
+		if req.CurrentPosition || req.Accuracy == 0 {
+			req.Accuracy = position.Accuracy
+		}
+	}
+	var err error
+	if req.Location, err = cleanText("location", req.Location, maxLocationLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Class, err = measurementClass(req.Class, classSurvey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	if req.Interval <= 0 {
-		req.Interval = 500
+
+	if req.SessionID != "" {
+		if _, exists := getSession(req.SessionID); !exists {
+			http.Error(w, "session not found", http.StatusBadRequest)
+			return
+		}
 	}
 
+	if req.Source, err = measurementSource(req.Source); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := signalSources[req.source()].Prepare(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Accuracy < 0 {
+		http.Error(w, "accuracy must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateHeight(req.Height); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applySamplingDefaults(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Pcap > 0 && *monitorInterface == "" {
+		http.Error(w, "pcap capture requires a monitor interface (-monitor-iface)", http.StatusBadRequest)
+		return
+	}
+	if req.Type == "scan" && (req.Pcap > 0 || req.KeepRaw) {
+		http.Error(w, "pcap and raw dumps are not supported for scans", http.StatusBadRequest)
+		return
+	}
+	if req.Pcap > maxPcapSeconds {
+		req.Pcap = maxPcapSeconds
+	}
+	if err := applyPingDefaults(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyThroughputDefaults(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.actor = auditActor(r)
+	job := startMeasurementJob(req, requestInitiator(r), "")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// takeMeasurement samples the interface as described by req and saves the
+// resulting measurement. progress is called after every sample. When ctx is
+// cancelled sampling stops and nothing is saved.
+func takeMeasurement(ctx context.Context, req MeasurementRequest, progress func(taken int)) (Measurement, error) {
+	id := newMeasurementID()
+
+	var pcapErr error
+	var pcapDone sync.WaitGroup
+	if req.Pcap > 0 {
+		pcapDone.Add(1)
+		go func() {
+			defer pcapDone.Done()
+			pcapErr = capturePcap(ctx, id, req.Pcap)
+		}()
+	}
+
+	// Pings run alongside the samples, over the same link.
+	var rtts []float64
+	var pingErr error
+	var pingDone sync.WaitGroup
+	if req.Pings > 0 {
+		pingDone.Add(1)
+		go func() {
+			defer pingDone.Done()
+			rtts, pingErr = runPings(ctx, req.PingHost, req.Pings)
+		}()
+	}
+
+	var spectrum []SpectrumBin
 	var signalMeasurements []int
-	for i := 0; i < req.Samples; i++ {
-		signal, err := getWifiSignalDbm("wlp0s20f3")
+	var link LinkInfo
+	var roamed bool
+	var rawDump strings.Builder
+	var survey surveyRecorder
+	discard := req.discarded()
+	if req.Type == "spectral" {
+		discard = 0
+	}
+	for i := 0; i < discard+req.Samples && req.Type != "spectral"; i++ {
+		info, output, err := getWifiSignalDbm(req.Interface)
+		warmUp := i < discard
+
+		if req.KeepRaw {
+			if warmUp {
+				fmt.Fprintf(&rawDump, "# warm-up sample %d at %s, discarded\n", i+1, time.Now().Format(time.RFC3339Nano))
+			} else {
+				fmt.Fprintf(&rawDump, "# sample %d at %s\n", i+1-discard, time.Now().Format(time.RFC3339Nano))
+			}
+			rawDump.WriteString(output)
+			if err != nil {
+				fmt.Fprintf(&rawDump, "# error: %v\n", err)
+			}
+		}
 
-		if err != nil {
-			signal = -999
+		if !warmUp {
+			survey.sample(req.Interface)
+			signal := info.Signal
+			if err != nil {
+				signal = -999
+			} else {
+				if link.BSSID != "" && info.BSSID != link.BSSID {
+					roamed = true
+				}
+				link = info
+			}
+			signalMeasurements = append(signalMeasurements, signal)
 		}
+		progress(i + 1)
+
+		select {
+		case <-ctx.Done():
+			pcapDone.Wait()
+			pingDone.Wait()
+			deleteAttachments(id)
+			return Measurement{}, ctx.Err()
+		case <-time.After(time.Duration(req.Interval) * time.Millisecond):
+		}
+	}
 
-		signalMeasurements = append(signalMeasurements, signal)
-		time.Sleep(time.Duration(req.Interval) * time.Millisecond)
+	// The throughput test saturates the link, so it waits for the pings.
+	var throughput throughputResult
+	var throughputErr error
+	if req.Throughput != "" {
+		pingDone.Wait()
+		throughput, throughputErr = runThroughput(ctx, req.Throughput)
 	}
 
+	if len(signalMeasurements) == 0 && req.Type != "spectral" {
+		pcapDone.Wait()
+		pingDone.Wait()
+		deleteAttachments(id)
+		return Measurement{}, fmt.Errorf("no samples were taken, all were discarded")
+	}
 	finalDbm := calculateMedian(signalMeasurements)
 
+	if req.Type == "spectral" {
+		var err error
+		spectrum, err = spectralScan(req.Interface)
+		if err != nil {
+			pcapDone.Wait()
+			deleteAttachments(id)
+			return Measurement{}, err
+		}
+		finalDbm = peakSpectrumDbm(spectrum)
+	}
+
+	lat, lng := req.coordinates()
 	record := Measurement{
-		ID:        generateID(),
+		ID:        id,
 		Timestamp: time.Now(),
 		Dbm:       finalDbm,
-		Lat:       req.Lat,
-		Lng:       req.Lng,
+		Lat:       lat,
+		Lng:       lng,
 		Floor:     req.Floor,
 		Location:  req.Location,
 		Type:      req.Type,
+		Accuracy:  req.Accuracy,
+		Height:    req.Height,
+		PresetID:  req.PresetID,
+		SessionID: req.SessionID,
+		Interface: req.Interface,
+		Class:     req.Class,
+		SSID:      link.SSID,
+		BSSID:     link.BSSID,
+		Freq:      link.Freq,
+		Channel:   link.Channel,
+		TxBitrate: link.TxBitrate,
+		Roamed:    roamed,
+		Spectrum:  spectrum,
+		Discarded: discard,
 	}
+	survey.apply(&record)
 
-	mutex.Lock()
-	measurements = append(measurements, record)
-	mutex.Unlock()
-
-	if err := saveMeasurements(); err != nil {
-		return
+	if req.KeepRaw {
+		if err := saveAttachment(record.ID, "raw.txt", []byte(rawDump.String())); err != nil {
+			log.Printf("failed to store raw dump of %s: %v", record.ID, err)
+		} else {
+			record.HasRaw = true
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(record)
-}
-
-func exportHandler(w http.ResponseWriter, r *http.Request) {
-	floorStr := r.URL.Query().Get("floor")
-	floor, err := strconv.Atoi(floorStr)
-	if err != nil {
-		floor = 0
+	pcapDone.Wait()
+	pingDone.Wait()
+	if err := ctx.Err(); err != nil {
+		deleteAttachments(id)
+		return Measurement{}, err
 	}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	var filtered []Measurement
-	if floor > 0 {
-		for _, m := range measurements {
-			if m.Floor == floor {
-				filtered = append(filtered, m)
-			}
+	if req.Pings > 0 {
+		if pingErr != nil {
+			log.Printf("pings for %s failed: %v", record.ID, pingErr)
+		} else {
+			record.LatencyMs, record.JitterMs, record.LossPercent = pingStats(rtts, req.Pings)
+		}
+	}
+	if req.Throughput != "" {
+		if throughputErr != nil {
+			log.Printf("throughput test for %s failed: %v", record.ID, throughputErr)
+		} else {
+			record.ThroughputMbps, record.UploadMbps = throughput.Download, throughput.Upload
+		}
+	}
+	if req.Pcap > 0 {
+		if pcapErr != nil {
+			log.Printf("pcap capture for %s failed: %v", record.ID, pcapErr)
+		} else {
+			record.HasPcap = true
 		}
-	} else {
-		filtered = measurements
 	}
 
-	w.Header().Set("Content-Type", "text/csv")
-	w.Header().Set("Content-Disposition", "attachment; filename=wifi_measurements.csv")
-
-	csvWriter := csv.NewWriter(w)
-	defer csvWriter.Flush()
-
-	csvWriter.Write([]string{"id", "timestamp", "dbm", "lat", "lng", "floor", "location", "type"})
+	records := []Measurement{record}
+	err := addMeasurements(req.actor, records...)
+	return records[0], err
+}
 
-	for _, m := range filtered {
-		csvWriter.Write([]string{
-			m.ID,
-			m.Timestamp.Format(time.RFC3339),
-			strconv.Itoa(m.Dbm),
-			strconv.FormatFloat(m.Lat, 'f', 6, 64),
-			strconv.FormatFloat(m.Lng, 'f', 6, 64),
-			strconv.Itoa(m.Floor),
-			m.Location,
-			m.Type,
-		})
-	}
+// addMeasurements appends new records to the data set on behalf of actor
+// and persists them. The ingest hooks run first and enrich the records in
+// place, so callers passing a slice see the stored version.
+func addMeasurements(actor string, records ...Measurement) error {
+	return insertMeasurements(actor, eventMeasurementsAdded, records)
 }
 
-func getWifiSignalDbm(interfaceName string) (int, error) {
-	cmd := exec.Command("iw", "dev", interfaceName, "link")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, err
+// insertMeasurements adds the records like addMeasurements, recording them
+// in the audit log under action.
+func insertMeasurements(actor, action string, records []Measurement) error {
+	if err := checkWritable(); err != nil {
+		return err
 	}
+	runHooks(hookIngest, records)
+	holdForReview(records)
+
+	mutex.Lock()
+	measurements = append(measurements, records...)
+	updateRevision()
+	revision := dataRevision
+	mutex.Unlock()
 
-	re := regexp.MustCompile(`signal:\s*(-?\d+)\s*dBm`)
-	match := re.FindStringSubmatch(string(output))
-	if len(match) < 2 {
-		return 0, fmt.Errorf("signal not found")
+	publishAdded(records, revision)
+	auditMeasurements(actor, action, "", records)
+	checkAlerts(records)
+
+	for _, record := range records {
+		if err := store.SaveMeasurement(record); err != nil {
+			return fmt.Errorf("failed to save measurement: %v", err)
+		}
 	}
+	mirrorToInflux(records)
 
-	return strconv.Atoi(match[1])
+	return nil
 }
 
 func generateID() string {
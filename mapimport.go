@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxMapSize      = 20 << 20
+	mapFetchTimeout = 30 * time.Second
+)
+
+var allowPrivateMapURLs = flag.Bool("allow-private-map-urls", false, "allow floor maps to be imported from loopback and private network addresses")
+
+// mapExtensions maps the image types accepted for floor maps to the file
+// extension they are stored with.
+var mapExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// mapHTTPClient connects directly rather than through a proxy from the
+// environment, so the address the dialer checks is that of the server the
+// map is fetched from.
+var mapHTTPClient = &http.Client{
+	Timeout: mapFetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly(allowPrivateMapURLs, "-allow-private-map-urls"),
+		}).DialContext,
+	},
+}
+
+// privateAddress reports whether ip is a loopback, private, link-local or
+// unspecified address, one in the network the server runs in.
+func privateAddress(ip net.IP) bool {
+	return ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// publicOnly returns a dialer Control function refusing connections to
+// private addresses unless allowed is set by the named flag, so requests
+// the server makes for its users cannot be used to probe the network it
+// runs in. It runs for every dial, redirects included.
+func publicOnly(allowed *bool, flagName string) func(network, address string, _ syscall.RawConn) error {
+	return func(network, address string, _ syscall.RawConn) error {
+		if *allowed {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if privateAddress(net.ParseIP(host)) {
+			return fmt.Errorf("address %s is not allowed (see %s)", host, flagName)
+		}
+		return nil
+	}
+}
+
+// fetchMapImage downloads a floor map and checks that it is an image of a
+// supported type, rendering PDF floor plans. It returns the image data and the extension to store it
+// with.
+func fetchMapImage(ctx context.Context, source string) ([]byte, string, error) {
+	u, err := url.Parse(source)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", fmt.Errorf("url must be an absolute http or https URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := mapHTTPClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch map: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to fetch map: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMapSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch map: %v", err)
+	}
+	if len(data) > maxMapSize {
+		return nil, "", fmt.Errorf("map is larger than %d MB", maxMapSize>>20)
+	}
+
+	if isPDF(data) || isAVIF(data) {
+		return readMapUpload(ctx, data)
+	}
+	contentType := detectMapType(data)
+	if contentType == "" {
+		contentType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	ext, ok := mapExtensions[contentType]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported map format %q, expected png, jpeg, gif, webp, avif or pdf", contentType)
+	}
+
+	if err := validateMapImage(contentType, data); err != nil {
+		return nil, "", err
+	}
+
+	return data, ext, nil
+}
+
+// readMapUpload checks an uploaded floor map by its content, whatever its
+// name says, renders PDF floor plans and converts AVIF maps to PNG. It
+// returns the image data and the extension to store it with.
+func readMapUpload(ctx context.Context, data []byte) ([]byte, string, error) {
+	var err error
+	switch {
+	case isPDF(data):
+		data, err = renderPDFMap(ctx, data)
+	case isAVIF(data):
+		data, err = convertAVIFMap(ctx, data)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := detectMapType(data)
+	if contentType == "" {
+		return nil, "", errUnsupportedMap
+	}
+	if err := validateMapImage(contentType, data); err != nil {
+		return nil, "", err
+	}
+	return data, mapExtensions[contentType], nil
+}
+
+// detectMapType sniffs the image type from its content, returning "" when
+// it is not recognised.
+func detectMapType(data []byte) string {
+	contentType := http.DetectContentType(data)
+	if _, ok := mapExtensions[contentType]; ok {
+		return contentType
+	}
+	return ""
+}
+
+// validateMapImage reads the image header of a floor map, rejecting
+// truncated or mislabelled files and maps too large to be shown.
+func validateMapImage(contentType string, data []byte) error {
+	width, height, err := mapImageSize(contentType, data)
+	if err != nil {
+		return fmt.Errorf("invalid %s image: %v", contentType, err)
+	}
+	if width*height > maxMapPixels {
+		return fmt.Errorf("map of %dx%d pixels is too large, at most %d megapixels are supported", width, height, maxMapPixels>>20)
+	}
+	return nil
+}
+
+// floorMapHandler sets the map of a floor, either from a multipart upload
+// (field "map") or by fetching {"url": "..."} on the server.
+func floorMapHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		uploadFloorMap(w, r, floorID)
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	_, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	data, ext, err := fetchMapImage(r.Context(), req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), mapErrorStatus(err))
+		return
+	}
+
+	floor, err := saveFloorMap(floorID, ext, bytes.NewReader(data))
+	if err != nil {
+		if errors.Is(err, errFloorNotFound) {
+			http.Error(w, "floor not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	publishFloor(eventFloorUpdated, floor)
+	auditFloor(auditActor(r), eventFloorUpdated, "map imported from "+req.URL, floor.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"path":   floor.MapPath,
+		"source": req.URL,
+	})
+}
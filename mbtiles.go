@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	tileSize = 256
+	// maxTileZoom is about 2 cm per pixel at the equator.
+	maxTileZoom = 22
+	// maxTiles bounds the size of an MBTiles export.
+	maxTiles = 20000
+	// tileZoomLevels is the default number of zoom levels exported.
+	tileZoomLevels = 5
+)
+
+// mbTile is one PNG tile addressed in XYZ (slippy map) order.
+type mbTile struct {
+	Zoom, X, Y int
+	Data       []byte
+}
+
+// writeMBTiles writes the tiles and metadata to a new MBTiles database. It
+// is set when the binary is built with -tags sqlite.
+var writeMBTiles func(path string, metadata map[string]string, tiles []mbTile) error
+
+// tileCoords returns the fractional XYZ tile coordinates of a position in
+// Web Mercator.
+func tileCoords(lat, lng float64, zoom int) (float64, float64) {
+	n := math.Exp2(float64(zoom))
+	latRad := lat * math.Pi / 180
+	x := (lng + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return x, y
+}
+
+// tilePosition is the inverse of tileCoords.
+func tilePosition(x, y float64, zoom int) (float64, float64) {
+	n := math.Exp2(float64(zoom))
+	lng := x/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+	return lat, lng
+}
+
+// geoBounds returns the south-west and north-east corners enclosing the
+// image bounds once georeferenced.
+func geoBounds(c *Calibration, bounds image.Rectangle) (south, west, north, east float64) {
+	south, west, north, east = 90, 180, -90, -180
+	for _, corner := range []image.Point{bounds.Min, {bounds.Max.X, bounds.Min.Y}, bounds.Max, {bounds.Min.X, bounds.Max.Y}} {
+		lat, lng := c.toGeo(float64(corner.X), float64(corner.Y))
+		south, north = math.Min(south, lat), math.Max(north, lat)
+		west, east = math.Min(west, lng), math.Max(east, lng)
+	}
+	return
+}
+
+// nativeZoom is the lowest zoom level at which a tile pixel is no larger
+// than a pixel of the floor map.
+func nativeZoom(c *Calibration, lat float64) int {
+	// Ground resolution of zoom level 0 at the equator, in meters per pixel.
+	const zoom0 = 2 * math.Pi * 6378137 / tileSize
+	zoom := int(math.Ceil(math.Log2(zoom0 * math.Cos(lat*math.Pi/180) / c.metersPerPixel())))
+	return max(0, min(maxTileZoom, zoom))
+}
+
+// renderTiles reprojects the georeferenced image into Web Mercator tiles
+// for the zoom levels from minZoom to maxZoom. Tiles the image does not
+// cover are left out.
+func renderTiles(ctx context.Context, img image.Image, c *Calibration, minZoom, maxZoom int) ([]mbTile, error) {
+	bounds := img.Bounds()
+	south, west, north, east := geoBounds(c, bounds)
+
+	var tiles []mbTile
+	for zoom := minZoom; zoom <= maxZoom; zoom++ {
+		minX, minY := tileCoords(north, west, zoom)
+		maxX, maxY := tileCoords(south, east, zoom)
+
+		for ty := int(minY); ty <= int(maxY); ty++ {
+			for tx := int(minX); tx <= int(maxX); tx++ {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+
+				tile := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+				empty := true
+				for py := 0; py < tileSize; py++ {
+					for px := 0; px < tileSize; px++ {
+						lat, lng := tilePosition(float64(tx)+(float64(px)+0.5)/tileSize, float64(ty)+(float64(py)+0.5)/tileSize, zoom)
+						x, y := c.toPixel(lat, lng)
+						point := image.Pt(int(math.Floor(x)), int(math.Floor(y)))
+						if !point.In(bounds) {
+							continue
+						}
+						tile.Set(px, py, img.At(point.X, point.Y))
+						empty = false
+					}
+				}
+				if empty {
+					continue
+				}
+
+				if len(tiles) == maxTiles {
+					return nil, fmt.Errorf("export exceeds %d tiles, lower maxzoom", maxTiles)
+				}
+
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, tile); err != nil {
+					return nil, err
+				}
+				tiles = append(tiles, mbTile{Zoom: zoom, X: tx, Y: ty, Data: buf.Bytes()})
+			}
+		}
+	}
+
+	return tiles, nil
+}
+
+// floorMBTilesHandler serves the heatmap of a calibrated floor as an MBTiles
+// file for offline map viewers. The heatmap query parameters apply; minzoom
+// and maxzoom default to the levels around the floor map's resolution.
+func floorMBTilesHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if writeMBTiles == nil {
+		http.Error(w, "MBTiles export requires a build with -tags sqlite", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A legend would be cut into the tiles of one corner.
+	params.Legend = false
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.Calibration == nil {
+		http.Error(w, "MBTiles export needs a calibrated floor", http.StatusBadRequest)
+		return
+	}
+
+	originLat, _ := floor.Calibration.toGeo(0, 0)
+	maxZoom := nativeZoom(floor.Calibration, originLat)
+	minZoom := max(0, maxZoom-tileZoomLevels+1)
+	for name, target := range map[string]*int{"minzoom": &minZoom, "maxzoom": &maxZoom} {
+		if value := query.Get(name); value != "" {
+			zoom, err := strconv.Atoi(value)
+			if err != nil || zoom < 0 || zoom > maxTileZoom {
+				http.Error(w, fmt.Sprintf("%s must be between 0 and %d", name, maxTileZoom), http.StatusBadRequest)
+				return
+			}
+			*target = zoom
+		}
+	}
+	if minZoom > maxZoom {
+		http.Error(w, "minzoom must not exceed maxzoom", http.StatusBadRequest)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		img, err := renderHeatmap(ctx, floor, filtered, params)
+		if err == nil && img.Bounds().Empty() {
+			err = fmt.Errorf("floor has no map to tile")
+		}
+		var tiles []mbTile
+		if err == nil {
+			tiles, err = renderTiles(ctx, img, floor.Calibration, minZoom, maxZoom)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "MBTiles export timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		south, west, north, east := geoBounds(floor.Calibration, img.Bounds())
+		centerLat, centerLng := (south+north)/2, (west+east)/2
+		metadata := map[string]string{
+			"name":        floor.Name,
+			"description": fmt.Sprintf("WiFi heatmap of %s from %d measurements", floor.Name, len(filtered)),
+			"type":        "overlay",
+			"version":     "1.1",
+			"format":      "png",
+			"minzoom":     strconv.Itoa(minZoom),
+			"maxzoom":     strconv.Itoa(maxZoom),
+			"bounds":      fmt.Sprintf("%f,%f,%f,%f", west, south, east, north),
+			"center":      fmt.Sprintf("%f,%f,%d", centerLng, centerLat, maxZoom),
+		}
+
+		file, err := os.CreateTemp("", "heatgen-*.mbtiles")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		path := file.Name()
+		file.Close()
+		defer os.Remove(path)
+
+		if err := writeMBTiles(path, metadata, tiles); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		file, err = os.Open(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", "application/vnd.mbtiles")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", exportFilename(floorID, time.Now(), "mbtiles")))
+		io.Copy(w, file)
+	})
+}
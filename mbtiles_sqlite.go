@@ -0,0 +1,49 @@
+//go:build sqlite
+
+package main
+
+func init() {
+	writeMBTiles = writeMBTilesFile
+}
+
+var mbtilesSchema = []string{
+	"CREATE TABLE metadata (name TEXT, value TEXT)",
+	"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+	"CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)",
+}
+
+// writeMBTilesFile stores the tiles in an MBTiles 1.1 database at path. Rows
+// are numbered bottom-up (TMS) as the format requires.
+func writeMBTilesFile(path string, metadata map[string]string, tiles []mbTile) error {
+	db, err := openSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, stmt := range mbtilesSchema {
+		if err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	if err := db.Exec("BEGIN"); err != nil {
+		return err
+	}
+	for name, value := range metadata {
+		if err := db.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	for _, tile := range tiles {
+		row := 1<<tile.Zoom - 1 - tile.Y
+		if err := db.Exec("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+			tile.Zoom, tile.X, row, sqliteBlob(tile.Data)); err != nil {
+			db.Exec("ROLLBACK")
+			return err
+		}
+	}
+
+	return db.Exec("COMMIT")
+}
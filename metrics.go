@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Metric is a quantity a heatmap can be rendered for. Min and Max are the
+// default ends of its color scale; for metrics where lower is better the
+// scale runs the other way, so strong colors always mean good.
+type Metric struct {
+	Name           string  `json:"name"`
+	Unit           string  `json:"unit"`
+	Description    string  `json:"description"`
+	Min            float64 `json:"min"`
+	Max            float64 `json:"max"`
+	HigherIsBetter bool    `json:"higherIsBetter"`
+
+	// value returns the metric of a measurement, false when it was not
+	// measured.
+	value func(m Measurement) (float64, bool)
+}
+
+const defaultMetric = "signal"
+
+var metrics = map[string]Metric{
+	"signal": {
+		Name:           "signal",
+		Unit:           "dBm",
+		Description:    "Received signal strength",
+		Min:            -90,
+		Max:            -30,
+		HigherIsBetter: true,
+		value: func(m Measurement) (float64, bool) {
+			return float64(m.Dbm), m.Dbm != failedSampleDbm
+		},
+	},
+	"snr": {
+		Name:           "snr",
+		Unit:           "dB",
+		Description:    "Signal to noise ratio",
+		Min:            0,
+		Max:            50,
+		HigherIsBetter: true,
+		value:          optionalMetric(func(m Measurement) *float64 { return m.SNRDb }),
+	},
+	"noise": {
+		Name:        "noise",
+		Unit:        "dBm",
+		Description: "Noise floor of the channel",
+		Min:         -100,
+		Max:         -70,
+		value:       optionalMetric(func(m Measurement) *float64 { return m.NoiseDbm }),
+	},
+	"busy": {
+		Name:        "busy",
+		Unit:        "%",
+		Description: "Channel utilization",
+		Min:         0,
+		Max:         100,
+		value:       optionalMetric(func(m Measurement) *float64 { return m.BusyPercent }),
+	},
+	"rsrq": {
+		Name:           "rsrq",
+		Unit:           "dB",
+		Description:    "Reference signal received quality of cellular measurements",
+		Min:            -20,
+		Max:            -3,
+		HigherIsBetter: true,
+		value: optionalMetric(func(m Measurement) *float64 {
+			if m.Cellular == nil {
+				return nil
+			}
+			return m.Cellular.RSRQ
+		}),
+	},
+	"latency": {
+		Name:        "latency",
+		Unit:        "ms",
+		Description: "Round trip time",
+		Min:         0,
+		Max:         200,
+		value:       optionalMetric(func(m Measurement) *float64 { return m.LatencyMs }),
+	},
+	"jitter": {
+		Name:        "jitter",
+		Unit:        "ms",
+		Description: "Variation of the round trip time",
+		Min:         0,
+		Max:         30,
+		value:       optionalMetric(func(m Measurement) *float64 { return m.JitterMs }),
+	},
+	"throughput": {
+		Name:           "throughput",
+		Unit:           "Mbps",
+		Description:    "Measured download throughput",
+		Min:            0,
+		Max:            300,
+		HigherIsBetter: true,
+		value:          optionalMetric(func(m Measurement) *float64 { return m.ThroughputMbps }),
+	},
+	"upload": {
+		Name:           "upload",
+		Unit:           "Mbps",
+		Description:    "Measured upload throughput",
+		Min:            0,
+		Max:            300,
+		HigherIsBetter: true,
+		value:          optionalMetric(func(m Measurement) *float64 { return m.UploadMbps }),
+	},
+	"loss": {
+		Name:        "loss",
+		Unit:        "%",
+		Description: "Packet loss",
+		Min:         0,
+		Max:         10,
+		value:       optionalMetric(func(m Measurement) *float64 { return m.LossPercent }),
+	},
+}
+
+func optionalMetric(field func(Measurement) *float64) func(Measurement) (float64, bool) {
+	return func(m Measurement) (float64, bool) {
+		if v := field(m); v != nil {
+			return *v, true
+		}
+		return 0, false
+	}
+}
+
+func lookupMetric(name string) (Metric, error) {
+	metric, exists := metrics[name]
+	if !exists {
+		return Metric{}, fmt.Errorf("unknown metric %q", name)
+	}
+	return metric, nil
+}
+
+// errSignalOnly is returned by analyses built on dBm thresholds.
+var errSignalOnly = fmt.Errorf("only the signal metric is supported here")
+
+// format writes a value of the metric with its unit, e.g. for legends.
+func (m Metric) format(value float64) string {
+	if m.Unit == "%" {
+		return fmt.Sprintf("%g%%", value)
+	}
+	return fmt.Sprintf("%g %s", value, m.Unit)
+}
+
+// metricsHandler lists the metrics heatmaps can be rendered for.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		list = append(list, metric)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
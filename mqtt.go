@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttDedupWindow is how long the keys of timestamped readings are kept to
+// drop the copies a broker redelivers.
+const mqttDedupWindow = 10 * time.Minute
+
+var (
+	mqttBroker   = flag.String("mqtt-broker", envOrDefault("HEATGEN_MQTT_BROKER", ""), "MQTT broker to ingest sensor readings from, e.g. tcp://broker:1883 or ssl://broker:8883; empty to disable (env HEATGEN_MQTT_BROKER)")
+	mqttTopic    = flag.String("mqtt-topic", envOrDefault("HEATGEN_MQTT_TOPIC", "heatgen/measurements/#"), "topic filter the sensors publish their readings on (env HEATGEN_MQTT_TOPIC)")
+	mqttClientID = flag.String("mqtt-client-id", envOrDefault("HEATGEN_MQTT_CLIENT_ID", "heatgen"), "client ID of the subscription; the broker keeps QoS 1 readings for it while the server is down (env HEATGEN_MQTT_CLIENT_ID)")
+	mqttUsername = flag.String("mqtt-username", envOrDefault("HEATGEN_MQTT_USERNAME", ""), "user name for the MQTT broker (env HEATGEN_MQTT_USERNAME)")
+	mqttPassword = flag.String("mqtt-password", envOrDefault("HEATGEN_MQTT_PASSWORD", ""), "password for the MQTT broker (env HEATGEN_MQTT_PASSWORD)")
+	mqttQoS      = flag.Int("mqtt-qos", 1, "QoS of the subscription, 0 or 1")
+)
+
+// MQTTReading is the payload a sensor publishes: where it was taken, as in
+// a MeasurementRequest, and what it read. A message holds one reading or
+// an array of them. Interface names the sensor and defaults to the topic.
+// Timestamp defaults to the time the message arrives.
+type MQTTReading struct {
+	MeasurementRequest
+	Dbm       *int       `json:"dbm"`
+	Timestamp *time.Time `json:"timestamp"`
+	SSID      string     `json:"ssid"`
+	BSSID     string     `json:"bssid"`
+	Freq      int        `json:"freq"`
+	Channel   int        `json:"channel"`
+}
+
+var (
+	mqttClient mqtt.Client
+
+	// mqttSeen holds the keys of the timestamped readings of the last
+	// mqttDedupWindow, with the time they arrived.
+	mqttSeen     = make(map[string]time.Time)
+	mqttSeenLock sync.Mutex
+)
+
+// readingMeasurement validates a reading and turns it into a measurement.
+func readingMeasurement(topic string, reading MQTTReading) (Measurement, error) {
+	req := reading.MeasurementRequest
+	if reading.Dbm == nil {
+		return Measurement{}, fmt.Errorf("dbm is required")
+	}
+	if *reading.Dbm > 0 || *reading.Dbm < -120 {
+		return Measurement{}, fmt.Errorf("signal %d dBm is out of range", *reading.Dbm)
+	}
+	if req.Type == "" {
+		req.Type = "location"
+	}
+	if !editableTypes[req.Type] {
+		return Measurement{}, fmt.Errorf("type must be location or accesspoint")
+	}
+	if req.PresetID != "" {
+		preset, exists := getPreset(req.PresetID)
+		if !exists {
+			return Measurement{}, fmt.Errorf("preset %q not found", req.PresetID)
+		}
+		req.setCoordinates(preset.Lat, preset.Lng)
+		req.Floor, req.Location = preset.Floor, preset.Name
+	}
+	lat, lng := req.coordinates()
+	if math.IsNaN(lat) || math.IsInf(lat, 0) || math.IsNaN(lng) || math.IsInf(lng, 0) {
+		return Measurement{}, fmt.Errorf("coordinates must be finite")
+	}
+
+	mutex.Lock()
+	_, exists := floors[req.Floor]
+	mutex.Unlock()
+	if !exists {
+		return Measurement{}, fmt.Errorf("floor %d not found", req.Floor)
+	}
+
+	location, err := cleanText("location", req.Location, maxLocationLength, false)
+	if err != nil {
+		return Measurement{}, err
+	}
+	if req.SessionID != "" {
+		if _, exists := getSession(req.SessionID); !exists {
+			return Measurement{}, fmt.Errorf("session %q not found", req.SessionID)
+		}
+	}
+	if req.Accuracy < 0 {
+		return Measurement{}, fmt.Errorf("accuracy must not be negative")
+	}
+	if err := validateHeight(req.Height); err != nil {
+		return Measurement{}, err
+	}
+	class, err := measurementClass(req.Class, classMonitoring)
+	if err != nil {
+		return Measurement{}, err
+	}
+
+	m := Measurement{
+		ID:        newMeasurementID(),
+		Timestamp: time.Now(),
+		Dbm:       *reading.Dbm,
+		Lat:       lat,
+		Lng:       lng,
+		Floor:     req.Floor,
+		Location:  location,
+		Type:      req.Type,
+		Accuracy:  req.Accuracy,
+		PresetID:  req.PresetID,
+		SessionID: req.SessionID,
+		SSID:      reading.SSID,
+		BSSID:     strings.ToLower(reading.BSSID),
+		Freq:      reading.Freq,
+		Channel:   reading.Channel,
+		Interface: req.Interface,
+		Height:    req.Height,
+		Class:     class,
+	}
+	if m.Interface == "" {
+		m.Interface = topic
+	}
+	if m.Channel == 0 && m.Freq != 0 {
+		m.Channel = frequencyToChannel(m.Freq)
+	}
+	if reading.Timestamp != nil {
+		m.Timestamp = *reading.Timestamp
+	}
+	return m, nil
+}
+
+// mqttDuplicate reports whether a timestamped reading of the sensor has
+// already been stored, remembering it otherwise.
+func mqttDuplicate(m Measurement) bool {
+	key := fmt.Sprintf("%s/%d/%g/%g/%s/%d", m.Interface, m.Floor, m.Lat, m.Lng, m.BSSID, m.Timestamp.UnixMilli())
+
+	mqttSeenLock.Lock()
+	defer mqttSeenLock.Unlock()
+
+	now := time.Now()
+	for seen, at := range mqttSeen {
+		if now.Sub(at) > mqttDedupWindow {
+			delete(mqttSeen, seen)
+		}
+	}
+	if _, seen := mqttSeen[key]; seen {
+		return true
+	}
+	mqttSeen[key] = now
+	return false
+}
+
+// ingestMQTTMessage stores the readings of a message. Invalid readings are
+// logged and skipped; the rest of the message is stored.
+func ingestMQTTMessage(topic string, payload []byte) {
+	var readings []MQTTReading
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &readings); err != nil {
+			log.Printf("mqtt: invalid message on %s: %v", topic, err)
+			return
+		}
+	} else {
+		var reading MQTTReading
+		if err := json.Unmarshal(trimmed, &reading); err != nil {
+			log.Printf("mqtt: invalid message on %s: %v", topic, err)
+			return
+		}
+		readings = append(readings, reading)
+	}
+
+	var records []Measurement
+	for _, reading := range readings {
+		m, err := readingMeasurement(topic, reading)
+		if err != nil {
+			log.Printf("mqtt: skipped a reading on %s: %v", topic, err)
+			continue
+		}
+		if reading.Timestamp != nil && mqttDuplicate(m) {
+			continue
+		}
+		records = append(records, m)
+	}
+
+	if len(records) > 0 {
+		if err := addMeasurements(probeActor(records), records...); err != nil {
+			log.Printf("mqtt: %v", err)
+		}
+	}
+}
+
+// startMQTT subscribes to -mqtt-topic on -mqtt-broker, when one is set.
+// The client reconnects, and subscribes again, on its own.
+func startMQTT() {
+	if *mqttBroker == "" {
+		return
+	}
+	if *mqttQoS != 0 && *mqttQoS != 1 {
+		log.Fatal("-mqtt-qos must be 0 or 1")
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(*mqttBroker).
+		SetClientID(*mqttClientID).
+		SetUsername(*mqttUsername).
+		SetPassword(*mqttPassword).
+		SetCleanSession(false).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("mqtt: lost the connection to %s: %v", *mqttBroker, err)
+		}).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			token := client.Subscribe(*mqttTopic, byte(*mqttQoS), func(_ mqtt.Client, message mqtt.Message) {
+				ingestMQTTMessage(message.Topic(), message.Payload())
+			})
+			if token.Wait() && token.Error() != nil {
+				log.Printf("mqtt: failed to subscribe to %s: %v", *mqttTopic, token.Error())
+				return
+			}
+			log.Printf("mqtt: subscribed to %s on %s", *mqttTopic, *mqttBroker)
+		})
+
+	mqttClient = mqtt.NewClient(options)
+	mqttClient.Connect()
+}
+
+// stopMQTT disconnects from the broker, letting the message in hand be
+// stored.
+func stopMQTT() {
+	if mqttClient != nil {
+		mqttClient.Disconnect(1000)
+	}
+}
@@ -0,0 +1,197 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nl80211Reader reads the link straight from the kernel over generic
+// netlink, which avoids starting iw for every sample and does not depend on
+// its output format.
+type nl80211Reader struct {
+	conn   *genetlink.Conn
+	family genetlink.Family
+}
+
+func newNL80211Reader() (*nl80211Reader, error) {
+	conn, err := genetlink.Dial(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := conn.GetFamily(unix.NL80211_GENL_NAME)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &nl80211Reader{conn: conn, family: family}, nil
+}
+
+// ReadLink combines the interface's SSID and frequency with the station
+// entry of the associated AP. The returned output mimics `iw dev <iface>
+// link` so raw samples look the same with either backend.
+func (n *nl80211Reader) ReadLink(interfaceName string) (LinkInfo, string, error) {
+	var info LinkInfo
+
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return info, "", err
+	}
+
+	msgs, err := n.execute(unix.NL80211_CMD_GET_INTERFACE, 0, iface.Index)
+	if err != nil {
+		return info, "", fmt.Errorf("nl80211 get interface: %v", err)
+	}
+	for _, msg := range msgs {
+		if err := parseNL80211Interface(msg.Data, &info); err != nil {
+			return info, "", err
+		}
+	}
+
+	msgs, err = n.execute(unix.NL80211_CMD_GET_STATION, netlink.Dump, iface.Index)
+	if err != nil {
+		return info, "", fmt.Errorf("nl80211 get station: %v", err)
+	}
+	if len(msgs) == 0 {
+		return LinkInfo{}, "Not connected.", fmt.Errorf("signal not found")
+	}
+	if err := parseNL80211Station(msgs[0].Data, &info); err != nil {
+		return info, "", err
+	}
+
+	info.Connected = true
+	info.Channel = frequencyToChannel(info.Freq)
+	info.Band = bandForFrequency(info.Freq)
+
+	return info, formatLinkInfo(info, interfaceName), nil
+}
+
+func (n *nl80211Reader) execute(command uint8, flags netlink.HeaderFlags, ifindex int) ([]genetlink.Message, error) {
+	encoder := netlink.NewAttributeEncoder()
+	encoder.Uint32(unix.NL80211_ATTR_IFINDEX, uint32(ifindex))
+	data, err := encoder.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return n.conn.Execute(genetlink.Message{
+		Header: genetlink.Header{Command: command, Version: n.family.Version},
+		Data:   data,
+	}, n.family.ID, netlink.Request|flags)
+}
+
+func (n *nl80211Reader) ValidInterface(name string) bool {
+	return isWirelessInterface(name)
+}
+
+func (n *nl80211Reader) Check(interfaceName string) []HealthCheck {
+	checks := []HealthCheck{{
+		Name:     "nl80211",
+		OK:       true,
+		Critical: true,
+		Detail:   fmt.Sprintf("generic netlink family %d", n.family.ID),
+	}}
+
+	ifaceCheck := wirelessInterfaceCheck(interfaceName)
+	checks = append(checks, ifaceCheck)
+
+	if ifaceCheck.OK {
+		checks = append(checks, linkCheck(interfaceName))
+	}
+
+	return append(checks, scanPermissionCheck())
+}
+
+func parseNL80211Interface(data []byte, info *LinkInfo) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NL80211_ATTR_SSID:
+			info.SSID = string(ad.Bytes())
+		case unix.NL80211_ATTR_WIPHY_FREQ:
+			info.Freq = int(ad.Uint32())
+		}
+	}
+
+	return ad.Err()
+}
+
+func parseNL80211Station(data []byte, info *LinkInfo) error {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return err
+	}
+
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NL80211_ATTR_MAC:
+			info.BSSID = net.HardwareAddr(ad.Bytes()).String()
+		case unix.NL80211_ATTR_STA_INFO:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case unix.NL80211_STA_INFO_SIGNAL:
+						info.Signal = int(int8(nad.Uint8()))
+					case unix.NL80211_STA_INFO_TX_BITRATE:
+						nad.Nested(func(rad *netlink.AttributeDecoder) error {
+							info.TxBitrate = parseNL80211Bitrate(rad)
+							return nil
+						})
+					case unix.NL80211_STA_INFO_RX_BITRATE:
+						nad.Nested(func(rad *netlink.AttributeDecoder) error {
+							info.RxBitrate = parseNL80211Bitrate(rad)
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	return ad.Err()
+}
+
+// parseNL80211Bitrate returns the rate in MBit/s. The kernel reports it in
+// units of 100 kbit/s, preferring the 32-bit attribute for fast links.
+func parseNL80211Bitrate(ad *netlink.AttributeDecoder) float64 {
+	var rate float64
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NL80211_RATE_INFO_BITRATE32:
+			rate = float64(ad.Uint32()) / 10
+		case unix.NL80211_RATE_INFO_BITRATE:
+			if rate == 0 {
+				rate = float64(ad.Uint16()) / 10
+			}
+		}
+	}
+	return rate
+}
+
+func formatLinkInfo(info LinkInfo, interfaceName string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Connected to %s (on %s)\n", info.BSSID, interfaceName)
+	fmt.Fprintf(&b, "\tSSID: %s\n", info.SSID)
+	fmt.Fprintf(&b, "\tfreq: %d\n", info.Freq)
+	fmt.Fprintf(&b, "\tsignal: %d dBm\n", info.Signal)
+	if info.RxBitrate > 0 {
+		fmt.Fprintf(&b, "\trx bitrate: %.1f MBit/s\n", info.RxBitrate)
+	}
+	if info.TxBitrate > 0 {
+		fmt.Fprintf(&b, "\ttx bitrate: %.1f MBit/s\n", info.TxBitrate)
+	}
+	return b.String()
+}
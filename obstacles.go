@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	obstaclesFile = "obstacles.json"
+
+	// wallGapPixels bridges breaks in a wall line, e.g. from antialiasing,
+	// that are too narrow to be doors.
+	wallGapPixels = 2
+	// wallAlignPixels is how far apart runs on neighbouring lines may be to
+	// still belong to the same wall.
+	wallAlignPixels = 3
+	// minWallFraction is the default shortest wall, relative to the longer
+	// side of the map; text and furniture are shorter.
+	minWallFraction = 0.01
+	minWallPixels   = 10
+	// wallAspect is how many times longer than thick a dark band must be to
+	// be a wall rather than a filled area.
+	wallAspect        = 4
+	maxDetectedWalls  = 2000
+	concreteThickness = 0.2
+)
+
+// wallMaterials lists the typical 2.4 GHz attenuation of a wall in dB.
+var wallMaterials = map[string]float64{
+	"drywall":  3,
+	"glass":    4,
+	"wood":     4,
+	"brick":    8,
+	"concrete": 12,
+	"metal":    25,
+}
+
+// Wall is an obstacle between two points in floor coordinates. Thickness
+// is in floor map pixels.
+type Wall struct {
+	From        Vertex  `json:"from"`
+	To          Vertex  `json:"to"`
+	Thickness   float64 `json:"thickness,omitempty"`
+	Material    string  `json:"material,omitempty"`
+	Attenuation float64 `json:"attenuation"`
+	Detected    bool    `json:"detected,omitempty"`
+}
+
+// ObstacleLayer holds the walls of a floor. Proposed are walls detected on
+// the floor map awaiting review; they take effect once the list, edited or
+// not, is stored with PUT.
+type ObstacleLayer struct {
+	Floor     int       `json:"floor"`
+	Walls     []Wall    `json:"walls"`
+	Proposed  []Wall    `json:"proposed,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var (
+	obstacles     = make(map[int]ObstacleLayer)
+	obstaclesLock sync.Mutex
+)
+
+func loadObstacles() error {
+	obstaclesLock.Lock()
+	defer obstaclesLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(obstaclesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &obstacles)
+}
+
+func saveObstacles() error {
+	obstaclesLock.Lock()
+	defer obstaclesLock.Unlock()
+
+	data, err := json.MarshalIndent(obstacles, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(obstaclesFile), data, 0644)
+}
+
+func getObstacles(floorID int) ObstacleLayer {
+	obstaclesLock.Lock()
+	defer obstaclesLock.Unlock()
+
+	layer, exists := obstacles[floorID]
+	if !exists {
+		layer = ObstacleLayer{Floor: floorID, Walls: []Wall{}}
+	}
+	return layer
+}
+
+// wallBand is a dark band of pixels: runs from start to end on the lines
+// first to last. Lines are rows for horizontal walls and columns for
+// vertical ones.
+type wallBand struct {
+	start, end  int
+	first, last int
+}
+
+func (b wallBand) length() int    { return b.end - b.start }
+func (b wallBand) thickness() int { return b.last - b.first + 1 }
+
+// wallBands finds the bands of an n×m mask, scanning n lines of m pixels.
+// Runs shorter than minLength are ignored, and runs on neighbouring lines
+// that overlap are merged into one band.
+func wallBands(ctx context.Context, n, m int, at func(line, i int) bool, minLength int) ([]wallBand, error) {
+	var open, closed []wallBand
+	for line := 0; line < n; line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var next []wallBand
+		for i := 0; i < m; {
+			if !at(line, i) {
+				i++
+				continue
+			}
+			start, end := i, i
+			for i < m {
+				if at(line, i) {
+					end = i + 1
+				} else if i-end >= wallGapPixels {
+					break
+				}
+				i++
+			}
+			if end-start < minLength {
+				continue
+			}
+
+			// A run continues every band of the previous line it overlaps
+			// or nearly touches, which follows slightly skewed walls in
+			// photographed plans as well as thick ones.
+			band := wallBand{start: start, end: end, first: line, last: line}
+			kept := open[:0]
+			for _, prev := range open {
+				if prev.start-end <= wallAlignPixels && start-prev.end <= wallAlignPixels {
+					band = wallBand{start: min(band.start, prev.start), end: max(band.end, prev.end), first: min(band.first, prev.first), last: line}
+				} else {
+					kept = append(kept, prev)
+				}
+			}
+			open = kept
+			next = append(next, band)
+		}
+
+		closed = append(closed, open...)
+		open = next
+	}
+
+	return append(closed, open...), nil
+}
+
+// detectWalls proposes the walls of a floor plan by thresholding dark
+// pixels and extracting long, thin horizontal and vertical bands. Diagonal
+// and curved walls are not found and have to be traced by hand. The
+// material is guessed from the thickness when the floor has a scale.
+func detectWalls(ctx context.Context, img image.Image, threshold uint32, minLength int, metersPerPixel float64) ([]Wall, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	mask := wallMask(img, threshold)
+
+	rows, err := wallBands(ctx, height, width, func(y, x int) bool { return mask[y*width+x] }, minLength)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := wallBands(ctx, width, height, func(x, y int) bool { return mask[y*width+x] }, minLength)
+	if err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		band       wallBand
+		horizontal bool
+	}
+	var bands []found
+	for _, band := range rows {
+		bands = append(bands, found{band, true})
+	}
+	for _, band := range columns {
+		bands = append(bands, found{band, false})
+	}
+	sort.SliceStable(bands, func(i, j int) bool {
+		return bands[i].band.length() > bands[j].band.length()
+	})
+
+	walls := []Wall{}
+	for _, f := range bands {
+		band := f.band
+		if band.length() < wallAspect*band.thickness() {
+			continue
+		}
+
+		// Convert pixel positions to floor coordinates, lat counted from
+		// the bottom edge.
+		middle := float64(band.first+band.last+1) / 2
+		from, to := Vertex{Lat: float64(height) - middle, Lng: float64(band.start)}, Vertex{Lat: float64(height) - middle, Lng: float64(band.end)}
+		if !f.horizontal {
+			from, to = Vertex{Lat: float64(height - band.start), Lng: middle}, Vertex{Lat: float64(height - band.end), Lng: middle}
+		}
+
+		material := "brick"
+		if metersPerPixel > 0 {
+			material = "drywall"
+			if float64(band.thickness())*metersPerPixel >= concreteThickness {
+				material = "concrete"
+			}
+		}
+
+		walls = append(walls, Wall{
+			From:        from,
+			To:          to,
+			Thickness:   float64(band.thickness()),
+			Material:    material,
+			Attenuation: wallMaterials[material],
+			Detected:    true,
+		})
+		if len(walls) == maxDetectedWalls {
+			break
+		}
+	}
+
+	return walls, nil
+}
+
+// validateWall checks a wall sent by the client and fills in the
+// attenuation of a known material.
+func validateWall(wall *Wall) error {
+	for _, v := range []float64{wall.From.Lat, wall.From.Lng, wall.To.Lat, wall.To.Lng, wall.Thickness, wall.Attenuation} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("coordinates and numbers must be finite")
+		}
+	}
+	if wall.From == wall.To {
+		return fmt.Errorf("a wall needs two distinct points")
+	}
+	if wall.Thickness < 0 || wall.Attenuation < 0 {
+		return fmt.Errorf("thickness and attenuation must not be negative")
+	}
+	if wall.Material != "" {
+		attenuation, known := wallMaterials[wall.Material]
+		if !known {
+			return fmt.Errorf("unknown material %q", wall.Material)
+		}
+		if wall.Attenuation == 0 {
+			wall.Attenuation = attenuation
+		}
+	}
+	return nil
+}
+
+// obstaclesHandler manages the wall layer of a floor. POST detects walls
+// on the floor map and stores them as a proposal; PUT replaces the walls,
+// e.g. with the reviewed proposal, and clears it.
+func obstaclesHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	layer := getObstacles(floorID)
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(layer)
+		return
+
+	case "POST":
+		query := r.URL.Query()
+		threshold := uint32(wallLuminance)
+		if value := query.Get("threshold"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > 255 {
+				http.Error(w, "threshold must be a luminance from 1 to 255", http.StatusBadRequest)
+				return
+			}
+			threshold = uint32(parsed)
+		}
+		minLength := 0
+		if value := query.Get("minLength"); value != "" {
+			var err error
+			if minLength, err = strconv.Atoi(value); err != nil || minLength < 2 {
+				http.Error(w, "minLength must be at least 2 pixels", http.StatusBadRequest)
+				return
+			}
+		}
+
+		img, err := loadFloorMap(floor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if img == nil {
+			http.Error(w, "floor has no map", http.StatusUnprocessableEntity)
+			return
+		}
+		if minLength == 0 {
+			size := img.Bounds().Size()
+			minLength = max(minWallPixels, int(float64(max(size.X, size.Y))*minWallFraction))
+		}
+
+		var walls []Wall
+		var detectErr error
+		ran := false
+		withRenderSlot(w, r, func(ctx context.Context) {
+			ran = true
+			walls, detectErr = detectWalls(ctx, img, threshold, minLength, floor.metersPerPixel())
+		})
+		if !ran {
+			// withRenderSlot has already answered.
+			return
+		}
+		if detectErr != nil {
+			http.Error(w, detectErr.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		layer.Proposed = walls
+
+	case "PUT":
+		var req struct {
+			Walls []Wall `json:"walls"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i := range req.Walls {
+			if err := validateWall(&req.Walls[i]); err != nil {
+				http.Error(w, fmt.Sprintf("wall %d: %v", i+1, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Walls == nil {
+			req.Walls = []Wall{}
+		}
+		layer.Walls = req.Walls
+		layer.Proposed = nil
+
+	case "DELETE":
+		obstaclesLock.Lock()
+		delete(obstacles, floorID)
+		obstaclesLock.Unlock()
+
+		if err := saveObstacles(); err != nil {
+			http.Error(w, "failed to save obstacles", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	layer.UpdatedAt = time.Now()
+	obstaclesLock.Lock()
+	obstacles[floorID] = layer
+	obstaclesLock.Unlock()
+
+	if err := saveObstacles(); err != nil {
+		http.Error(w, "failed to save obstacles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(layer)
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxValidatedBody bounds the JSON bodies the validation reads, unless the
+// operation allows more; larger ones are refused before they reach the
+// handler.
+const maxValidatedBody = 10 << 20
+
+// apiOperation documents one method of a route for the OpenAPI document.
+// Request and Response are values of the Go types the handler decodes and
+// encodes, from which the schemas are derived, so the document follows
+// the code. Paths name floor IDs {floor}, which are integers.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Query   []string
+	// Request is the JSON body, validated before the handler runs. Body
+	// lists the media types of other bodies, such as uploads.
+	Request any
+	Body    []string
+	// MaxBody is the size limit of the handler when it takes Request
+	// bodies larger than maxValidatedBody.
+	MaxBody int64
+	// Response is the JSON response; Content is the media type of other
+	// responses, such as images.
+	Response any
+	Content  string
+	// Status is the status of success, 200 when 0.
+	Status int
+}
+
+// Query parameters shared by several endpoints.
+var (
+	heatmapQuery = []string{"metric", "weights", "min", "max", "opacity", "scale", "grid", "power", "accuracy", "method",
+		"ssid", "bssid", "band", "mask", "maskStyle", "session", "class", "source", "minHeight", "maxHeight", "legend",
+		"aggregate", "aggregateRadius", "aggregateWindow"}
+	signalQuery  = []string{"band", "ssid", "minHeight", "maxHeight"}
+	listQuery    = []string{"from", "to", "type", "location", "bbox", "review", "class", "source", "sort", "limit", "offset"}
+	filterQuery  = []string{"session", "location", "before", "after", "dryRun"}
+	timeQuery    = []string{"tz", "timeFormat"}
+	deletedReply = map[string]any{}
+)
+
+// queryOf joins query parameter lists.
+func queryOf(lists ...[]string) []string {
+	var names []string
+	for _, list := range lists {
+		names = append(names, list...)
+	}
+	return names
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/api/measurements", Tag: "measurements", Summary: "List measurements, merged per spot with aggregate=true",
+		Query: queryOf([]string{"floor", "session", "building"}, signalQuery, listQuery, []string{"aggregate", "aggregateRadius", "aggregateWindow"}), Response: []MergedMeasurement{}},
+	{Method: "DELETE", Path: "/api/measurements", Tag: "measurements", Summary: "Delete the measurements matching the filters or IDs",
+		Query: queryOf([]string{"floor"}, filterQuery), Request: struct {
+			IDs []string `json:"ids"`
+		}{}, Response: BatchDeleteResult{}},
+	{Method: "POST", Path: "/api/add", Tag: "measurements", Summary: "Take a measurement in the background", Request: MeasurementRequest{}, Response: Job{}, Status: http.StatusAccepted},
+	{Method: "GET", Path: "/api/jobs/{id}", Tag: "measurements", Summary: "Get a measurement job", Response: Job{}},
+	{Method: "DELETE", Path: "/api/jobs/{id}", Tag: "measurements", Summary: "Cancel a measurement job", Response: Job{}},
+	{Method: "PUT", Path: "/api/measurements/{id}", Tag: "measurements", Summary: "Update a measurement", Request: MeasurementUpdate{}, Response: Measurement{}},
+	{Method: "DELETE", Path: "/api/delete/{id}", Tag: "measurements", Summary: "Delete a measurement", Response: deletedReply},
+	{Method: "GET", Path: "/api/measurements/{id}/raw", Tag: "measurements", Summary: "Get the raw tool output of a measurement", Content: "text/plain"},
+	{Method: "GET", Path: "/api/measurements/{id}/pcap", Tag: "measurements", Summary: "Get the packet capture of a measurement", Content: "application/vnd.tcpdump.pcap"},
+	{Method: "GET", Path: "/api/measurements/{id}/photo", Tag: "measurements", Summary: "Get the photo of a measurement", Content: "image/jpeg"},
+	{Method: "PUT", Path: "/api/measurements/{id}/photo", Tag: "measurements", Summary: "Attach a photo to a measurement", Body: []string{"image/jpeg", "image/png", "image/webp"}, Response: Measurement{}},
+	{Method: "DELETE", Path: "/api/measurements/{id}/photo", Tag: "measurements", Summary: "Remove the photo of a measurement", Response: Measurement{}},
+	{Method: "GET", Path: "/api/measurements/{id}/photo/thumb", Tag: "measurements", Summary: "Get the photo thumbnail of a measurement", Content: "image/jpeg"},
+	{Method: "GET", Path: "/api/review", Tag: "measurements", Summary: "Count measurements per review state", Query: []string{"floor", "session"}, Response: map[string]any{}},
+	{Method: "POST", Path: "/api/review", Tag: "measurements", Summary: "Approve or reject measurements", Request: ReviewRequest{}, Response: ReviewResult{}},
+	{Method: "GET", Path: "/api/export", Tag: "measurements", Summary: "Export measurements as CSV, GeoJSON, KML or an XLSX workbook",
+		Query: queryOf([]string{"floor", "session", "building", "format", "coordinates", "metadata", "split", "review", "source"}, signalQuery, timeQuery), Content: "text/csv"},
+	{Method: "POST", Path: "/api/import", Tag: "measurements", Summary: "Import measurements from CSV, a zip of CSVs or JSON",
+		Query: []string{"crs", "dryRun"}, Body: []string{"text/csv", "application/zip", "application/json"}, Response: ImportResult{}},
+	{Method: "POST", Path: "/api/prune", Tag: "measurements", Summary: "Fold old measurements into daily aggregates", Query: []string{"days", "monitoringDays", "dryRun"}, Response: PruneResult{}},
+	{Method: "GET", Path: "/api/aggregates", Tag: "measurements", Summary: "List daily aggregates of pruned measurements", Query: []string{"floor", "location", "from", "to", "class"}, Response: []DailyAggregate{}},
+	{Method: "POST", Path: "/api/ingest/prometheus", Tag: "measurements", Summary: "Ingest Prometheus remote write or exposition samples",
+		Body: []string{"application/x-protobuf", "text/plain"}, Response: PrometheusIngestResult{}},
+
+	{Method: "GET", Path: "/api/floors", Tag: "floors", Summary: "List floors", Query: []string{"building"}, Response: []Floor{}},
+	{Method: "POST", Path: "/api/floors/add", Tag: "floors", Summary: "Add a floor", Request: struct {
+		Name     string `json:"name"`
+		Building string `json:"building"`
+	}{}, Response: Floor{}},
+	{Method: "POST", Path: "/api/floors/bulk", Tag: "floors", Summary: "Add floors from a zip of maps", Query: []string{"building"}, Body: []string{"application/zip"}, Response: []Floor{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/api/floors/import", Tag: "floors", Summary: "Import floors and zones from IMDF or GeoJSON",
+		Query: []string{"building", "language", "pixelsPerMeter"}, Body: []string{"application/zip", "application/geo+json"}, Response: map[string]any{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/api/floors/upload-map/{floor}", Tag: "floors", Summary: "Upload the map of a floor", Body: []string{"multipart/form-data"}, Response: map[string]any{}},
+	{Method: "GET", Path: "/api/floors/{floor}", Tag: "floors", Summary: "Get a floor", Response: Floor{}},
+	{Method: "PUT", Path: "/api/floors/{floor}", Tag: "floors", Summary: "Update a floor", Request: FloorUpdate{}, Response: Floor{}},
+	{Method: "DELETE", Path: "/api/floors/{floor}", Tag: "floors", Summary: "Delete a floor, deleting or reassigning its measurements", Query: []string{"measurements", "to"}, Response: map[string]any{}},
+	{Method: "POST", Path: "/api/floors/{floor}/map", Tag: "floors", Summary: "Fetch the map of a floor from a URL", Request: struct {
+		URL string `json:"url"`
+	}{}, Response: map[string]any{}},
+	{Method: "GET", Path: "/api/floors/{floor}/thumbnail", Tag: "floors", Summary: "Get the map thumbnail of a floor", Content: "image/png"},
+	{Method: "POST", Path: "/api/floors/{floor}/align", Tag: "floors", Summary: "Replace the map of a floor and carry its data over", Body: []string{"multipart/form-data"}, Response: AlignmentResult{}},
+	{Method: "POST", Path: "/api/floors/{floor}/reposition", Tag: "floors", Summary: "Move misplaced measurements of a floor", Query: filterQuery, Request: RepositionRequest{}, Response: RepositionResult{}},
+	{Method: "GET", Path: "/api/floors/{floor}/calibration", Tag: "floors", Summary: "Get the geographic calibration of a floor", Response: Calibration{}},
+	{Method: "PUT", Path: "/api/floors/{floor}/calibration", Tag: "floors", Summary: "Calibrate a floor", Request: Calibration{}, Response: Calibration{}},
+	{Method: "DELETE", Path: "/api/floors/{floor}/calibration", Tag: "floors", Summary: "Remove the calibration of a floor"},
+	{Method: "POST", Path: "/api/floors/{floor}/transform", Tag: "floors", Summary: "Convert points between map pixels and geographic coordinates", Query: []string{"to"}, Request: struct {
+		Points []TransformPoint `json:"points"`
+	}{}, Response: struct {
+		Points []TransformPoint `json:"points"`
+	}{}},
+	{Method: "GET", Path: "/api/floors/{floor}/scale", Tag: "floors", Summary: "Get the scale of a floor", Response: FloorScale{}},
+	{Method: "PUT", Path: "/api/floors/{floor}/scale", Tag: "floors", Summary: "Set the scale of a floor", Query: []string{"doorWidth"}, Request: ScaleRequest{}, Response: FloorScale{}},
+	{Method: "DELETE", Path: "/api/floors/{floor}/scale", Tag: "floors", Summary: "Remove the scale of a floor"},
+	{Method: "GET", Path: "/api/floors/{floor}/obstacles", Tag: "floors", Summary: "Get the walls of a floor", Response: ObstacleLayer{}},
+	{Method: "POST", Path: "/api/floors/{floor}/obstacles", Tag: "floors", Summary: "Detect walls on the floor map as a proposal", Query: []string{"threshold", "minLength"}, Response: ObstacleLayer{}},
+	{Method: "PUT", Path: "/api/floors/{floor}/obstacles", Tag: "floors", Summary: "Replace the walls of a floor", Request: struct {
+		Walls []Wall `json:"walls"`
+	}{}, Response: ObstacleLayer{}},
+	{Method: "DELETE", Path: "/api/floors/{floor}/obstacles", Tag: "floors", Summary: "Remove the walls of a floor"},
+	{Method: "GET", Path: "/api/floors/{floor}/sla", Tag: "floors", Summary: "Check a coverage SLA rule", Query: queryOf([]string{"threshold", "coverage"}, heatmapQuery), Response: SLAResult{}},
+	{Method: "POST", Path: "/api/floors/{floor}/sla", Tag: "floors", Summary: "Check several coverage SLA rules", Query: heatmapQuery, Request: struct {
+		Rules []SLARule `json:"rules"`
+	}{}, Response: SLAResult{}},
+	{Method: "GET", Path: "/api/floors/{floor}/export.png", Tag: "floors", Summary: "Export the floor map with its measurements", Query: []string{"threshold"}, Content: "image/png"},
+	{Method: "GET", Path: "/api/floors/{floor}/export.dxf", Tag: "floors", Summary: "Export the floor as DXF for CAD", Query: heatmapQuery, Content: "application/dxf"},
+	{Method: "GET", Path: "/api/floors/{floor}/export.esx", Tag: "floors", Summary: "Export a survey for Ekahau", Query: []string{"session"}, Content: "application/zip"},
+	{Method: "GET", Path: "/api/floors/{floor}/export.netspot", Tag: "floors", Summary: "Export a survey for NetSpot", Query: []string{"session"}, Content: "application/zip"},
+	{Method: "GET", Path: "/api/floors/{floor}/heatmap.mbtiles", Tag: "floors", Summary: "Export the heatmap as MBTiles", Query: heatmapQuery, Content: "application/vnd.sqlite3"},
+
+	{Method: "GET", Path: "/api/buildings", Tag: "buildings", Summary: "List buildings", Response: []Building{}},
+	{Method: "POST", Path: "/api/buildings", Tag: "buildings", Summary: "Add a building", Request: Building{}, Response: Building{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/buildings/{id}", Tag: "buildings", Summary: "Get a building", Response: Building{}},
+	{Method: "PUT", Path: "/api/buildings/{id}", Tag: "buildings", Summary: "Update a building", Request: Building{}, Response: Building{}},
+	{Method: "DELETE", Path: "/api/buildings/{id}", Tag: "buildings", Summary: "Delete a building", Query: []string{"floors"}, Response: map[string]any{}},
+	{Method: "GET", Path: "/api/project", Tag: "project", Summary: "Get the project settings", Response: ProjectSettings{}},
+	{Method: "PUT", Path: "/api/project", Tag: "project", Summary: "Update the project settings", Request: ProjectSettings{}, Response: ProjectSettings{}},
+	{Method: "GET", Path: "/api/settings", Tag: "project", Summary: "Get the server settings and the values in effect", Response: SettingsView{}},
+	{Method: "PUT", Path: "/api/settings", Tag: "project", Summary: "Replace the server settings, applied at once", Request: ServerSettings{}, Response: SettingsView{}},
+	{Method: "GET", Path: "/api/crs", Tag: "project", Summary: "List the supported coordinate reference systems", Response: []CRS{}},
+
+	{Method: "GET", Path: "/api/presets", Tag: "presets", Summary: "List measurement presets", Query: []string{"floor"}, Response: []Preset{}},
+	{Method: "POST", Path: "/api/presets", Tag: "presets", Summary: "Add a preset", Request: Preset{}, Response: Preset{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/presets/{id}", Tag: "presets", Summary: "Get a preset", Response: Preset{}},
+	{Method: "PUT", Path: "/api/presets/{id}", Tag: "presets", Summary: "Update a preset", Request: Preset{}, Response: Preset{}},
+	{Method: "DELETE", Path: "/api/presets/{id}", Tag: "presets", Summary: "Delete a preset", Response: deletedReply},
+	{Method: "GET", Path: "/api/sessions", Tag: "sessions", Summary: "List survey sessions", Response: []Session{}},
+	{Method: "POST", Path: "/api/sessions", Tag: "sessions", Summary: "Start a survey session", Request: Session{}, Response: Session{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/sessions/{id}", Tag: "sessions", Summary: "Get a session", Response: Session{}},
+	{Method: "PUT", Path: "/api/sessions/{id}", Tag: "sessions", Summary: "Update a session", Request: Session{}, Response: Session{}},
+	{Method: "DELETE", Path: "/api/sessions/{id}", Tag: "sessions", Summary: "Delete a session and its measurements", Response: map[string]any{}},
+	{Method: "GET", Path: "/api/zones", Tag: "zones", Summary: "List zones", Query: []string{"floor"}, Response: []Zone{}},
+	{Method: "POST", Path: "/api/zones", Tag: "zones", Summary: "Add a zone", Request: Zone{}, Response: Zone{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/zones/stats", Tag: "zones", Summary: "Get signal statistics per zone", Query: queryOf([]string{"floor"}, heatmapQuery), Response: []ZoneStats{}},
+	{Method: "GET", Path: "/api/zones/{id}", Tag: "zones", Summary: "Get a zone", Response: Zone{}},
+	{Method: "PUT", Path: "/api/zones/{id}", Tag: "zones", Summary: "Update a zone", Request: Zone{}, Response: Zone{}},
+	{Method: "DELETE", Path: "/api/zones/{id}", Tag: "zones", Summary: "Delete a zone", Response: deletedReply},
+
+	{Method: "GET", Path: "/api/heatmap", Tag: "heatmaps", Summary: "Render the heatmap of a floor", Query: queryOf([]string{"floor", "building", "format", "levels"}, heatmapQuery), Content: "image/png"},
+	{Method: "GET", Path: "/api/tiles/{floor}/{z}/{x}/{y}", Tag: "heatmaps", Summary: "Render a heatmap tile, {y} ending in .png or .webp", Query: heatmapQuery, Content: "image/png"},
+	{Method: "GET", Path: "/api/report", Tag: "heatmaps", Summary: "Render a PDF survey report", Query: queryOf([]string{"floor", "session"}, heatmapQuery, timeQuery), Content: "application/pdf"},
+	{Method: "GET", Path: "/api/compare", Tag: "heatmaps", Summary: "Compare two sets of measurements", Query: queryOf([]string{"floor", "format"}, heatmapQuery), Response: CompareResult{}},
+	{Method: "GET", Path: "/api/compare/image", Tag: "heatmaps", Summary: "Render two heatmaps side by side", Query: queryOf([]string{"title"}, heatmapQuery), Content: "image/png"},
+	{Method: "GET", Path: "/api/snapshots", Tag: "heatmaps", Summary: "List heatmap snapshots", Response: []Snapshot{}},
+	{Method: "POST", Path: "/api/snapshots", Tag: "heatmaps", Summary: "Save a heatmap snapshot", Request: struct {
+		Name   string            `json:"name"`
+		Floor  int               `json:"floor"`
+		Params map[string]string `json:"params"`
+	}{}, Response: Snapshot{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/snapshots/{id}", Tag: "heatmaps", Summary: "Get a snapshot", Response: Snapshot{}},
+	{Method: "DELETE", Path: "/api/snapshots/{id}", Tag: "heatmaps", Summary: "Delete a snapshot", Response: deletedReply},
+	{Method: "GET", Path: "/api/snapshots/{id}/image", Tag: "heatmaps", Summary: "Render a snapshot", Content: "image/png"},
+	{Method: "GET", Path: "/api/metrics", Tag: "heatmaps", Summary: "List the metrics heatmaps can show", Response: []Metric{}},
+	{Method: "GET", Path: "/api/thresholds", Tag: "heatmaps", Summary: "List the signal threshold profiles", Response: map[string]any{}},
+	{Method: "GET", Path: "/api/interpolators", Tag: "heatmaps", Summary: "List the interpolation methods", Response: map[string]any{}},
+	{Method: "GET", Path: "/api/estimate", Tag: "heatmaps", Summary: "Estimate the signal at a point", Query: queryOf([]string{"floor", "lat", "lng"}, heatmapQuery), Response: map[string]any{}},
+	{Method: "POST", Path: "/api/estimate", Tag: "heatmaps", Summary: "Estimate the signal at several points", Query: queryOf([]string{"floor"}, heatmapQuery), Request: struct {
+		Points []Vertex `json:"points"`
+	}{}, Response: map[string]any{}},
+	{Method: "POST", Path: "/api/interpolate", Tag: "heatmaps", Summary: "Interpolate values at several points", Query: queryOf([]string{"floor"}, heatmapQuery), Request: struct {
+		Points []Vertex `json:"points"`
+	}{}, Response: map[string]any{}},
+	{Method: "GET", Path: "/api/clusters", Tag: "heatmaps", Summary: "Cluster measurements for a map zoom level", Query: []string{"floor", "zoom", "radius", "bbox"}, Response: []Cluster{}},
+
+	{Method: "GET", Path: "/api/stats", Tag: "analysis", Summary: "Get signal statistics", Query: queryOf([]string{"floor", "session", "metric", "groupBy", "bucket", "scans"}, signalQuery), Response: map[string]any{}},
+	{Method: "GET", Path: "/api/timeseries", Tag: "analysis", Summary: "Get a metric over time", Query: []string{"floor", "session", "location", "lat", "lng", "radius", "metric", "bucket", "band", "ssid"}, Response: map[string]any{}},
+	{Method: "GET", Path: "/api/baselines", Tag: "analysis", Summary: "Get weekly signal baselines", Query: []string{"floor", "location", "zone", "from", "to"}, Response: []WeeklyBaseline{}},
+	{Method: "GET", Path: "/api/quality", Tag: "analysis", Summary: "Get the data quality report of a day", Query: []string{"date"}, Response: QualityReport{}},
+	{Method: "GET", Path: "/api/analysis/coverage", Tag: "analysis", Summary: "Find dead zones", Query: queryOf([]string{"floor", "zone", "threshold"}, heatmapQuery), Response: CoverageAnalysis{}},
+	{Method: "GET", Path: "/api/analysis/ap-removal", Tag: "analysis", Summary: "Simulate removing an AP", Query: queryOf([]string{"floor", "zone", "coverage", "threshold"}, heatmapQuery), Response: APRemovalResult{}},
+	{Method: "GET", Path: "/api/analysis/band-steering", Tag: "analysis", Summary: "Find points where clients should prefer 5 GHz", Query: []string{"floor", "session", "ssid", "margin", "minHeight", "maxHeight"}, Response: BandSteeringReport{}},
+	{Method: "GET", Path: "/api/analysis/rogues", Tag: "analysis", Summary: "List rogue and duplicate-SSID APs", Query: []string{"floor", "session", "ssid", "finding"}, Response: []RogueAP{}},
+	{Method: "GET", Path: "/api/analysis/placement", Tag: "analysis", Summary: "Suggest AP placements", Query: queryOf([]string{"floor", "zone", "count", "threshold"}, heatmapQuery), Response: PlacementResult{}},
+	{Method: "GET", Path: "/api/tickets", Tag: "analysis", Summary: "Build tickets for weak spots", Query: queryOf([]string{"floor", "format", "jiraProject", "limit", "threshold"}, heatmapQuery), Response: map[string]any{}},
+	{Method: "POST", Path: "/api/tickets", Tag: "analysis", Summary: "Send tickets for weak spots to the ticket webhooks", Query: queryOf([]string{"floor", "format", "jiraProject", "limit", "threshold"}, heatmapQuery), Response: map[string]any{}},
+
+	{Method: "GET", Path: "/api/pathloss", Tag: "pathloss", Summary: "List path loss models", Response: []PathLossModel{}},
+	{Method: "POST", Path: "/api/pathloss", Tag: "pathloss", Summary: "Add a path loss model", Request: struct {
+		Name      string `json:"name"`
+		BSSID     string `json:"bssid"`
+		Interface string `json:"interface"`
+	}{}, Response: PathLossModel{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/pathloss/{id}", Tag: "pathloss", Summary: "Get a path loss model", Response: PathLossModel{}},
+	{Method: "DELETE", Path: "/api/pathloss/{id}", Tag: "pathloss", Summary: "Delete a path loss model"},
+	{Method: "POST", Path: "/api/pathloss/{id}/samples", Tag: "pathloss", Summary: "Add a calibration sample to a model", Request: CalibrationSampleRequest{}, Response: PathLossModel{}},
+	{Method: "DELETE", Path: "/api/pathloss/{id}/samples", Tag: "pathloss", Summary: "Remove the calibration samples of a model", Response: PathLossModel{}},
+
+	{Method: "GET", Path: "/api/position", Tag: "tracking", Summary: "Get the current position", Response: Position{}},
+	{Method: "GET", Path: "/api/track", Tag: "tracking", Summary: "Get the active track", Response: Track{}},
+	{Method: "POST", Path: "/api/track/start", Tag: "tracking", Summary: "Start sampling along a walk", Request: TrackRequest{}, Response: Track{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/api/track/position", Tag: "tracking", Summary: "Add waypoints to the active track", Body: []string{"application/x-ndjson"}, Response: map[string]int{}},
+	{Method: "POST", Path: "/api/track/stop", Tag: "tracking", Summary: "Stop the active track", Response: TrackResult{}},
+	{Method: "GET", Path: "/api/ws", Tag: "tracking", Summary: "Subscribe to measurement and floor events over a WebSocket", Query: []string{"floor"}, Response: Event{}},
+	{Method: "GET", Path: "/api/changes", Tag: "tracking", Summary: "Long-poll measurement and floor events", Query: []string{"since", "wait", "floor"}, Response: ChangesResponse{}},
+
+	{Method: "GET", Path: "/api/tasks", Tag: "tasks", Summary: "List the task history", Query: []string{"kind", "status", "limit"}, Response: []Task{}},
+	{Method: "GET", Path: "/api/tasks/{id}", Tag: "tasks", Summary: "Get a task", Response: Task{}},
+	{Method: "POST", Path: "/api/tasks/{id}/retry", Tag: "tasks", Summary: "Retry a measurement task", Response: Job{}, Status: http.StatusAccepted},
+
+	{Method: "GET", Path: "/api/federation/snapshot", Tag: "federation", Summary: "Get the snapshot of this site", Query: []string{"maps"}, Response: SiteSnapshot{}},
+	{Method: "POST", Path: "/api/federation/push", Tag: "federation", Summary: "Apply the snapshot pushed by a site", Request: SiteSnapshot{}, MaxBody: maxSnapshotSize, Response: SyncResult{}},
+	{Method: "GET", Path: "/api/federation/sites", Tag: "federation", Summary: "List federated sites", Response: []FederatedSite{}},
+	{Method: "POST", Path: "/api/federation/sites", Tag: "federation", Summary: "Add a federated site", Request: struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		URL     string `json:"url"`
+		Trusted bool   `json:"trusted"`
+	}{}, Response: FederatedSite{}, Status: http.StatusCreated},
+	{Method: "PATCH", Path: "/api/federation/sites/{id}", Tag: "federation", Summary: "Trust or distrust a federated site", Request: struct {
+		Trusted bool `json:"trusted"`
+	}{}, Response: FederatedSite{}},
+	{Method: "DELETE", Path: "/api/federation/sites/{id}", Tag: "federation", Summary: "Remove a federated site and its data", Response: map[string]int{}},
+	{Method: "POST", Path: "/api/federation/sites/{id}/sync", Tag: "federation", Summary: "Pull the snapshot of a site", Response: SyncResult{}},
+
+	{Method: "GET", Path: "/api/config", Tag: "system", Summary: "Get the sampling configuration", Response: map[string]any{}},
+	{Method: "GET", Path: "/api/interfaces", Tag: "system", Summary: "List the wireless interfaces", Response: []WirelessInterface{}},
+	{Method: "GET", Path: "/api/wifi/status", Tag: "system", Summary: "Get the current link of an interface", Query: []string{"interface"}, Response: LinkInfo{}},
+	{Method: "GET", Path: "/api/wifi/stream", Tag: "system", Summary: "Stream the link of an interface", Query: []string{"interface", "interval"}, Content: "text/event-stream"},
+	{Method: "GET", Path: "/api/regulatory", Tag: "system", Summary: "Get the regulatory domain", Response: RegDomain{}},
+	{Method: "GET", Path: "/api/dfs-events", Tag: "system", Summary: "List radar detections", Query: []string{"floor"}, Response: []DFSEvent{}},
+	{Method: "GET", Path: "/api/admin/usage", Tag: "system", Summary: "Get API usage statistics", Response: UsageStats{}},
+	{Method: "DELETE", Path: "/api/admin/usage", Tag: "system", Summary: "Reset API usage statistics"},
+	{Method: "GET", Path: "/api/audit", Tag: "system", Summary: "List the audit log of data changes",
+		Query: []string{"actor", "action", "floor", "id", "from", "to", "limit", "offset"}, Response: []AuditEntry{}},
+	{Method: "GET", Path: "/api/admin/cache", Tag: "system", Summary: "Get analytics and heatmap cache statistics", Response: AnalyticsCacheStats{}},
+	{Method: "DELETE", Path: "/api/admin/cache", Tag: "system", Summary: "Clear the analytics and heatmap caches"},
+	{Method: "GET", Path: "/api/openapi.json", Tag: "system", Summary: "Get this document", Response: map[string]any{}},
+	{Method: "GET", Path: "/readyz", Tag: "system", Summary: "Check readiness", Response: map[string]any{}},
+
+	{Method: "GET", Path: "/api/alerts", Tag: "alerts", Summary: "List alert rules", Response: []AlertRule{}},
+	{Method: "POST", Path: "/api/alerts", Tag: "alerts", Summary: "Add an alert rule", Request: AlertRule{}, Response: AlertRule{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/alerts/{id}", Tag: "alerts", Summary: "Get an alert rule", Response: AlertRule{}},
+	{Method: "PUT", Path: "/api/alerts/{id}", Tag: "alerts", Summary: "Update an alert rule", Request: AlertRule{}, Response: AlertRule{}},
+	{Method: "DELETE", Path: "/api/alerts/{id}", Tag: "alerts", Summary: "Delete an alert rule", Response: deletedReply},
+	{Method: "GET", Path: "/api/aps", Tag: "aps", Summary: "List access points", Query: []string{"floor", "bssid"}, Response: []AccessPoint{}},
+	{Method: "POST", Path: "/api/aps", Tag: "aps", Summary: "Add an access point", Request: AccessPoint{}, Response: AccessPoint{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/aps/{id}", Tag: "aps", Summary: "Get an access point", Query: []string{"history"}, Response: AccessPoint{}},
+	{Method: "PUT", Path: "/api/aps/{id}", Tag: "aps", Summary: "Update an access point", Request: AccessPoint{}, Response: AccessPoint{}},
+	{Method: "DELETE", Path: "/api/aps/{id}", Tag: "aps", Summary: "Delete an access point", Response: deletedReply},
+	{Method: "POST", Path: "/api/aps/{id}/poll", Tag: "aps", Summary: "Poll an access point over SNMP", Response: AccessPoint{}},
+	{Method: "GET", Path: "/api/aps/{id}/compare", Tag: "aps", Summary: "Compare what an AP reports with the survey", Query: []string{"from", "to"}, Response: APComparison{}},
+	{Method: "GET", Path: "/api/shares", Tag: "shares", Summary: "List shared heatmaps", Response: []Share{}},
+	{Method: "POST", Path: "/api/shares", Tag: "shares", Summary: "Share a heatmap", Query: queryOf([]string{"floor"}, heatmapQuery), Request: Share{}, Response: struct {
+		Share
+		Token    string `json:"token"`
+		EmbedURL string `json:"embedUrl"`
+	}{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/shares/{id}", Tag: "shares", Summary: "Get a share", Response: Share{}},
+	{Method: "DELETE", Path: "/api/shares/{id}", Tag: "shares", Summary: "Revoke a share", Response: deletedReply},
+	{Method: "GET", Path: "/embed/{floor}", Tag: "shares", Summary: "Show a shared heatmap", Query: []string{"token"}, Content: "text/html"},
+	{Method: "GET", Path: "/embed/{floor}/heatmap.png", Tag: "shares", Summary: "Render a shared heatmap", Query: []string{"token"}, Content: "image/png"},
+}
+
+// openAPIDocument builds the OpenAPI 3.0 document of apiOperations.
+func openAPIDocument() map[string]any {
+	schemas := schemaBuilder{components: make(map[string]any)}
+	paths := make(map[string]any)
+	for _, op := range apiOperations {
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[op.Path] = item
+		}
+
+		var parameters []any
+		for _, segment := range strings.Split(op.Path, "/") {
+			if name, found := strings.CutPrefix(segment, "{"); found {
+				name = strings.TrimSuffix(name, "}")
+				schema := map[string]any{"type": "string"}
+				if name == "floor" || name == "x" || name == "y" || name == "z" {
+					schema = map[string]any{"type": "integer"}
+				}
+				parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": schema})
+			}
+		}
+		for _, name := range op.Query {
+			parameters = append(parameters, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case op.Response != nil:
+			response["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.schema(reflect.TypeOf(op.Response))}}
+		case op.Content != "":
+			response["content"] = map[string]any{op.Content: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		}
+		operation := map[string]any{
+			"operationId": operationID(op),
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses": map[string]any{
+				strconv.Itoa(status): response,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"application/problem+json": map[string]any{"schema": schemas.schema(reflect.TypeOf(Problem{}))}},
+				},
+			},
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		content := make(map[string]any)
+		if op.Request != nil {
+			content["application/json"] = map[string]any{"schema": schemas.schema(reflect.TypeOf(op.Request))}
+		}
+		for _, mediaType := range op.Body {
+			content[mediaType] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+		}
+		if len(content) > 0 {
+			operation["requestBody"] = map[string]any{"content": content}
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "HeatGen API",
+			"version":     "1",
+			"description": "Wi-Fi site surveys and heatmaps. Errors are problem details (RFC 7807) for clients accepting JSON.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []any{map[string]any{"bearer": []string{}}, map[string]any{"apiKey": []string{}}},
+	}
+}
+
+// operationID names an operation for generated clients, e.g. getFloorsScale
+// for GET /api/floors/{floor}/scale.
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, segment := range strings.Split(op.Path, "/") {
+		if segment == "" || segment == "api" || strings.HasPrefix(segment, "{") {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '.' || r == '_' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+// schemaBuilder derives JSON schemas from Go types as encoding/json
+// encodes them. Named structs become components.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b schemaBuilder) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		schema := map[string]any{"type": "array", "items": b.schema(t.Elem())}
+		if t.Kind() == reflect.Array {
+			schema["minItems"], schema["maxItems"] = t.Len(), t.Len()
+		}
+		return schema
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, done := b.components[t.Name()]; !done {
+			// Registered first, for types that refer to themselves.
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.object(t)
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+func (b schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for _, field := range jsonFields(t) {
+		properties[field.name] = b.schema(field.Type)
+	}
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// jsonField is a struct field as encoding/json encodes it.
+type jsonField struct {
+	reflect.StructField
+	name string
+}
+
+// jsonFields lists the encoded fields of a struct, those of embedded
+// structs included.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		embedded := field.Type
+		if embedded.Kind() == reflect.Pointer {
+			embedded = embedded.Elem()
+		}
+		if field.Anonymous && name == "" && embedded.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(embedded)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{field, name})
+	}
+	return fields
+}
+
+// openAPIHandler serves the OpenAPI document of the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument())
+}
+
+// Problem is an error response as problem details of RFC 7807.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Errors lists what is wrong with each field of a request body.
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a problem with one field of a request body, located by a
+// JSON pointer such as /points/0/lat.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string, errs []FieldError) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail, Errors: errs})
+}
+
+// wantsJSON reports whether the client accepts JSON, which generated
+// clients do while the frontend and scripts take plain text errors.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") || strings.Contains(accept, "application/problem+json")
+}
+
+// problemWriter turns the plain text errors of http.Error into problem
+// details, passing flushing and hijacking through for the streaming and
+// WebSocket endpoints.
+type problemWriter struct {
+	http.ResponseWriter
+	status int
+	detail bytes.Buffer
+}
+
+func (pw *problemWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(pw.Header().Get("Content-Type"), "text/plain") {
+		pw.status = status
+		return
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *problemWriter) Write(data []byte) (int, error) {
+	if pw.status != 0 {
+		return pw.detail.Write(data)
+	}
+	return pw.ResponseWriter.Write(data)
+}
+
+func (pw *problemWriter) Flush() {
+	if flusher, ok := pw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (pw *problemWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := pw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// problemMiddleware answers the errors of clients accepting JSON with
+// problem details.
+func problemMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsJSON(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &problemWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if pw.status != 0 {
+			writeProblem(w, pw.status, strings.TrimSpace(pw.detail.String()), nil)
+		}
+	})
+}
+
+// findOperation returns the documented operation of a request, nil when
+// there is none.
+func findOperation(method, path string) *apiOperation {
+	segments := strings.Split(path, "/")
+	for i, op := range apiOperations {
+		if op.Method != method {
+			continue
+		}
+		pattern := strings.Split(op.Path, "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		match := true
+		for j, segment := range pattern {
+			if !strings.HasPrefix(segment, "{") && segment != segments[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return &apiOperations[i]
+		}
+	}
+	return nil
+}
+
+// validationMiddleware checks JSON request bodies against the schema of
+// their operation and refuses malformed ones with problem details listing
+// every field that is wrong, instead of the first decoding error. Empty
+// bodies are left to the handlers, some of which accept them.
+func validationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := findOperation(r.Method, r.URL.Path)
+		if op == nil || op.Request == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The handlers decode JSON whatever the Content-Type says, unless
+		// the operation documents another body.
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); slices.Contains(op.Body, mediaType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit := int64(maxValidatedBody)
+		if op.MaxBody > 0 {
+			limit = op.MaxBody
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeProblem(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("the request body exceeds %d bytes", limit), nil)
+				return
+			}
+			writeProblem(w, http.StatusBadRequest, "failed to read the request body", nil)
+			return
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if errs := validateJSON(data, reflect.TypeOf(op.Request)); len(errs) > 0 {
+				writeProblem(w, http.StatusBadRequest, "the request body does not match the API, see /api/openapi.json", errs)
+				return
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateJSON checks a JSON document against the Go type it is decoded
+// into. Unknown fields are ignored, as the decoding does.
+func validateJSON(data []byte, t reflect.Type) []FieldError {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return []FieldError{{Field: "", Message: fmt.Sprintf("invalid JSON at byte %d: %v", syntaxErr.Offset, err)}}
+		}
+		return []FieldError{{Field: "", Message: "invalid JSON: " + err.Error()}}
+	}
+	var errs []FieldError
+	validateValue(value, t, "", &errs)
+	return errs
+}
+
+func validateValue(value any, t reflect.Type, pointer string, errs *[]FieldError) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// null decodes into anything, leaving it as it is.
+	if value == nil || t.Kind() == reflect.Interface || t == reflect.TypeOf(json.RawMessage{}) {
+		return
+	}
+	fail := func(message string) {
+		*errs = append(*errs, FieldError{Field: pointer, Message: message})
+	}
+
+	if t == timeType {
+		s, ok := value.(string)
+		if _, err := time.Parse(time.RFC3339, s); !ok || err != nil {
+			fail("must be an RFC 3339 time")
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			fail("must be true or false")
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			fail("must be a string")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if i, err := n.Int64(); !ok || err != nil || reflect.New(t).Elem().OverflowInt(i) {
+			fail("must be an integer")
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(json.Number)
+		if u, err := strconv.ParseUint(n.String(), 10, 64); !ok || err != nil || reflect.New(t).Elem().OverflowUint(u) {
+			fail("must be a non-negative integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		n, ok := value.(json.Number)
+		if _, err := n.Float64(); !ok || err != nil {
+			fail("must be a number")
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			if _, ok := value.(string); !ok {
+				fail("must be a base64 string")
+			}
+			return
+		}
+		items, ok := value.([]any)
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if t.Kind() == reflect.Array && len(items) > t.Len() {
+			fail(fmt.Sprintf("must have at most %d items", t.Len()))
+		}
+		for i, item := range items {
+			validateValue(item, t.Elem(), pointer+"/"+strconv.Itoa(i), errs)
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]any)
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			validateValue(object[key], t.Elem(), pointer+"/"+escapePointer(key), errs)
+		}
+	case reflect.Struct:
+		object, ok := value.(map[string]any)
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, field := range jsonFields(t) {
+			item, found := object[field.name]
+			if !found {
+				// Keys match fields regardless of case, as when decoding.
+				for key, v := range object {
+					if strings.EqualFold(key, field.name) {
+						item, found = v, true
+						break
+					}
+				}
+			}
+			if found {
+				validateValue(item, field.Type, pointer+"/"+escapePointer(field.name), errs)
+			}
+		}
+	}
+}
+
+// escapePointer escapes a key for a JSON pointer (RFC 6901).
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
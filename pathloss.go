@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pathLossFile = "pathloss.json"
+
+	defaultCalibrationSamples  = 5
+	maxCalibrationSamples      = 20
+	defaultCalibrationInterval = 500
+)
+
+// PathLossModel is a log-distance path loss model fitted to signal
+// readings taken at known distances from one access point, for one kind
+// of environment such as an open office or a concrete corridor:
+//
+//	dbm = TxPower - 10 * Exponent * log10(distance)
+//
+// TxPower is the signal at 1 m. The model is fitted once readings exist at
+// two or more distances.
+type PathLossModel struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	BSSID     string              `json:"bssid,omitempty"`
+	Interface string              `json:"interface,omitempty"`
+	Samples   []CalibrationSample `json:"samples"`
+	Fitted    bool                `json:"fitted"`
+	TxPower   float64             `json:"txPower,omitempty"`
+	Exponent  float64             `json:"exponent,omitempty"`
+	// StdDev is the spread of the readings around the fit in dB.
+	StdDev    float64   `json:"stdDev,omitempty"`
+	RSquared  float64   `json:"rSquared,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CalibrationSample is the signal read at a distance in meters from the
+// access point.
+type CalibrationSample struct {
+	Distance  float64   `json:"distance"`
+	Dbm       float64   `json:"dbm"`
+	Readings  int       `json:"readings,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type CalibrationSampleRequest struct {
+	Distance float64 `json:"distance"`
+	// Dbm enters a reading taken elsewhere; without it the signal is
+	// read now, Samples times every Interval milliseconds.
+	Dbm      *float64 `json:"dbm"`
+	Samples  int      `json:"samples"`
+	Interval int      `json:"interval"`
+}
+
+var (
+	pathLossModels = make(map[string]PathLossModel)
+	pathLossLock   sync.Mutex
+)
+
+func loadPathLossModels() error {
+	pathLossLock.Lock()
+	defer pathLossLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(pathLossFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &pathLossModels)
+}
+
+func savePathLossModels() error {
+	pathLossLock.Lock()
+	defer pathLossLock.Unlock()
+
+	data, err := json.MarshalIndent(pathLossModels, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(pathLossFile), data, 0644)
+}
+
+func getPathLossModel(id string) (PathLossModel, bool) {
+	pathLossLock.Lock()
+	defer pathLossLock.Unlock()
+
+	model, exists := pathLossModels[id]
+	return model, exists
+}
+
+// fit runs a least squares regression of the readings against
+// -10*log10(distance), whose intercept is TxPower and slope the exponent.
+func (m *PathLossModel) fit() {
+	m.Fitted, m.TxPower, m.Exponent, m.StdDev, m.RSquared = false, 0, 0, 0, 0
+
+	distances := make(map[float64]bool)
+	var sumX, sumY float64
+	for _, s := range m.Samples {
+		distances[s.Distance] = true
+		sumX += -10 * math.Log10(s.Distance)
+		sumY += s.Dbm
+	}
+	if len(distances) < 2 {
+		return
+	}
+
+	n := float64(len(m.Samples))
+	meanX, meanY := sumX/n, sumY/n
+	var sxx, sxy, syy float64
+	for _, s := range m.Samples {
+		dx, dy := -10*math.Log10(s.Distance)-meanX, s.Dbm-meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+
+	exponent := sxy / sxx
+	txPower := meanY - exponent*meanX
+
+	var residuals float64
+	for _, s := range m.Samples {
+		predicted := txPower - 10*exponent*math.Log10(s.Distance)
+		residuals += (s.Dbm - predicted) * (s.Dbm - predicted)
+	}
+
+	m.Fitted = true
+	m.TxPower = math.Round(txPower*10) / 10
+	m.Exponent = math.Round(exponent*100) / 100
+	m.StdDev = math.Round(math.Sqrt(residuals/n)*10) / 10
+	if syy > 0 {
+		m.RSquared = math.Round((1-residuals/syy)*1000) / 1000
+	}
+}
+
+// pathLossParams returns the txPower and exponent of a request: those of
+// the ?model calibration when given, overridden by explicit txPower and
+// exponent parameters, and the defaults otherwise.
+func pathLossParams(query url.Values) (float64, float64, error) {
+	txPower, exponent := float64(defaultAPTxPower), float64(defaultAPExponent)
+	if id := query.Get("model"); id != "" {
+		model, exists := getPathLossModel(id)
+		if !exists {
+			return 0, 0, fmt.Errorf("path loss model not found")
+		}
+		if !model.Fitted {
+			return 0, 0, fmt.Errorf("path loss model %q needs readings at two or more distances", model.Name)
+		}
+		txPower, exponent = model.TxPower, model.Exponent
+	}
+
+	for name, target := range map[string]*float64{"txPower": &txPower, "exponent": &exponent} {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid %s", name)
+			}
+			*target = parsed
+		}
+	}
+	if exponent < 1 || exponent > 6 {
+		return 0, 0, fmt.Errorf("exponent must be between 1 and 6")
+	}
+	return txPower, exponent, nil
+}
+
+// readCalibrationSignal reads the signal of the model's access point and
+// returns the median of the successful readings.
+func readCalibrationSignal(model *PathLossModel, samples, interval int) (float64, int, error) {
+	var readings []int
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(interval) * time.Millisecond)
+		}
+		info, _, err := getWifiSignalDbm(model.Interface)
+		if err != nil || !info.Connected {
+			continue
+		}
+		bssid := strings.ToLower(info.BSSID)
+		if model.BSSID == "" {
+			model.BSSID = bssid
+		}
+		if bssid != model.BSSID {
+			return 0, 0, fmt.Errorf("connected to %s instead of the calibrated access point %s", bssid, model.BSSID)
+		}
+		readings = append(readings, info.Signal)
+	}
+
+	if len(readings) == 0 {
+		return 0, 0, fmt.Errorf("no signal could be read on %s", model.Interface)
+	}
+	return float64(calculateMedian(readings)), len(readings), nil
+}
+
+// pathLossModelsHandler lists the path loss models or starts a new
+// calibration. The access point is the one given as bssid, or else the
+// one the interface is connected to at the first reading.
+func pathLossModelsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		pathLossLock.Lock()
+		list := make([]PathLossModel, 0, len(pathLossModels))
+		for _, model := range pathLossModels {
+			list = append(list, model)
+		}
+		pathLossLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		var req struct {
+			Name      string `json:"name"`
+			BSSID     string `json:"bssid"`
+			Interface string `json:"interface"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if req.Name, err = cleanText("name", req.Name, maxNameLength, false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		if req.Interface == "" {
+			req.Interface = *wifiInterface
+		} else if !validInterface(req.Interface) {
+			http.Error(w, fmt.Sprintf("unknown wireless interface %q", req.Interface), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		model := PathLossModel{
+			ID:        generateID(),
+			Name:      req.Name,
+			BSSID:     strings.ToLower(req.BSSID),
+			Interface: req.Interface,
+			Samples:   []CalibrationSample{},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		pathLossLock.Lock()
+		pathLossModels[model.ID] = model
+		pathLossLock.Unlock()
+
+		if err := savePathLossModels(); err != nil {
+			http.Error(w, "failed to save path loss models", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(model)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func pathLossModelHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case "GET":
+		model, exists := getPathLossModel(id)
+		if !exists {
+			http.Error(w, "path loss model not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(model)
+	case "DELETE":
+		pathLossLock.Lock()
+		_, exists := pathLossModels[id]
+		delete(pathLossModels, id)
+		pathLossLock.Unlock()
+
+		if !exists {
+			http.Error(w, "path loss model not found", http.StatusNotFound)
+			return
+		}
+		if err := savePathLossModels(); err != nil {
+			http.Error(w, "failed to save path loss models", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pathLossSamplesHandler adds a reading at a known distance and refits the
+// model (POST), or discards all readings (DELETE).
+func pathLossSamplesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	model, exists := getPathLossModel(r.PathValue("id"))
+	if !exists {
+		http.Error(w, "path loss model not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		model.Samples = []CalibrationSample{}
+	} else {
+		var req CalibrationSampleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !(req.Distance > 0) || math.IsInf(req.Distance, 0) {
+			http.Error(w, "distance must be a positive number of meters", http.StatusBadRequest)
+			return
+		}
+
+		sample := CalibrationSample{Distance: req.Distance, Timestamp: time.Now()}
+		if req.Dbm != nil {
+			if *req.Dbm > 0 || *req.Dbm < -120 {
+				http.Error(w, "dbm must be between -120 and 0", http.StatusBadRequest)
+				return
+			}
+			sample.Dbm = *req.Dbm
+		} else {
+			if req.Samples == 0 {
+				req.Samples = defaultCalibrationSamples
+			}
+			if req.Interval == 0 {
+				req.Interval = defaultCalibrationInterval
+			}
+			if req.Samples < 1 || req.Samples > maxCalibrationSamples || req.Interval < 0 {
+				http.Error(w, fmt.Sprintf("samples must be between 1 and %d", maxCalibrationSamples), http.StatusBadRequest)
+				return
+			}
+
+			var err error
+			if sample.Dbm, sample.Readings, err = readCalibrationSignal(&model, req.Samples, req.Interval); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		model.Samples = append(model.Samples, sample)
+	}
+
+	model.fit()
+	model.UpdatedAt = time.Now()
+
+	pathLossLock.Lock()
+	_, exists = pathLossModels[model.ID]
+	if exists {
+		pathLossModels[model.ID] = model
+	}
+	pathLossLock.Unlock()
+
+	if !exists {
+		http.Error(w, "path loss model not found", http.StatusNotFound)
+		return
+	}
+	if err := savePathLossModels(); err != nil {
+		http.Error(w, "failed to save path loss models", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const maxPcapSeconds = 60
+
+var monitorInterface = flag.String("monitor-iface", "", "monitor-mode interface used for per-measurement pcap captures")
+
+// capturePcap records seconds worth of frames from the monitor interface
+// into the attachments directory of the given measurement, stopping early
+// when ctx is cancelled.
+func capturePcap(ctx context.Context, measurementID string, seconds int) error {
+	if *monitorInterface == "" {
+		return fmt.Errorf("no monitor interface configured")
+	}
+
+	dir := filepath.Join(projectFile(attachmentsDir), measurementID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "tcpdump", "-i", *monitorInterface, "-U", "-w", filepath.Join(dir, "capture.pcap"))
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 2 * time.Second
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tcpdump: %v: %s", err, output)
+	}
+
+	return nil
+}
+
+func pcapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pcap", filepath.Base(r.PathValue("id"))))
+	serveAttachment(w, r, "capture.pcap", "application/vnd.tcpdump.pcap")
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// reportAreaMeters is the cell size of the best and worst areas on
+	// calibrated floors; uncalibrated floors use reportAreaPixels.
+	reportAreaMeters = 5
+	reportAreaPixels = 100
+	reportAreaCount  = 5
+	reportDeadZones  = 5
+
+	reportPageWidth   = 190
+	reportImageHeight = 130
+	// reportTimeLayout writes report times unless ?timeFormat is given.
+	reportTimeLayout = "2006-01-02 15:04"
+)
+
+// reportArea is a cell of the best or worst areas, with the locations of
+// its measurements.
+type reportArea struct {
+	Cluster
+	Locations []string
+}
+
+// reportFloor is the content of a floor's section of the report.
+type reportFloor struct {
+	Floor    Floor
+	Samples  []Measurement
+	Heatmap  bytes.Buffer
+	Coverage SLARuleResult
+	Zones    []ZoneStats
+	Best     []reportArea
+	Worst    []reportArea
+}
+
+// pdfText prepares text for the core PDF fonts, which only cover
+// Windows-1252: characters outside it lose their diacritics (č becomes c)
+// before the translation, so Czech labels stay readable.
+func pdfText(translate func(string) string) func(string) string {
+	return func(s string) string {
+		folded := make([]rune, 0, len(s))
+		for _, r := range s {
+			if r >= 0x100 {
+				if base, _ := utf8.DecodeRuneInString(norm.NFD.String(string(r))); base < 0x100 {
+					r = base
+				}
+			}
+			folded = append(folded, r)
+		}
+		return translate(string(folded))
+	}
+}
+
+// reportAreas groups the measurements into square cells and returns the
+// cells with the strongest and the weakest mean signal. Cells with only
+// failed samples count as the weakest.
+func reportAreas(floor Floor, ms []Measurement) (best, worst []reportArea) {
+	cellSize := float64(reportAreaPixels)
+	if mpp := floor.metersPerPixel(); mpp > 0 {
+		cellSize = reportAreaMeters / mpp
+	}
+
+	locations := make(map[[2]int][]string)
+	for _, m := range ms {
+		if m.Location == "" {
+			continue
+		}
+		key := [2]int{int(math.Floor(m.Lat / cellSize)), int(math.Floor(m.Lng / cellSize))}
+		if !slices.Contains(locations[key], m.Location) {
+			locations[key] = append(locations[key], m.Location)
+		}
+	}
+
+	var areas []reportArea
+	for _, c := range clusterMeasurements(ms, 0, cellSize) {
+		key := [2]int{int(math.Floor(c.Lat / cellSize)), int(math.Floor(c.Lng / cellSize))}
+		areas = append(areas, reportArea{Cluster: c, Locations: locations[key]})
+	}
+
+	valid := func(a reportArea) bool { return a.Count > a.Failed }
+	sort.SliceStable(areas, func(i, j int) bool {
+		if valid(areas[i]) != valid(areas[j]) {
+			return valid(areas[i])
+		}
+		return areas[i].AvgDbm > areas[j].AvgDbm
+	})
+
+	for _, a := range areas {
+		if len(best) == reportAreaCount || !valid(a) {
+			break
+		}
+		best = append(best, a)
+	}
+	for i := len(areas) - 1; i >= 0 && len(worst) < reportAreaCount; i-- {
+		worst = append(worst, areas[i])
+	}
+	return best, worst
+}
+
+// buildReportFloor renders the heatmap of a floor and evaluates its
+// coverage, zones and areas.
+func buildReportFloor(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, threshold ThresholdProfile, score Metric) (*reportFloor, error) {
+	section := &reportFloor{
+		Floor:   floor,
+		Samples: params.selectMeasurements(ms),
+	}
+
+	img, err := renderHeatmap(ctx, floor, ms, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := png.Encode(&section.Heatmap, img); err != nil {
+		return nil, err
+	}
+
+	rules := []SLARule{{Threshold: strconv.Itoa(threshold.MinDbm)}}
+	coverage, err := evaluateSLA(ctx, floor, ms, params, rules)
+	if err != nil {
+		return nil, err
+	}
+	section.Coverage = coverage[0]
+
+	if section.Zones, err = computeZoneStats(ctx, floor, ms, params, threshold, score); err != nil {
+		return nil, err
+	}
+
+	section.Best, section.Worst = reportAreas(floor, section.Samples)
+	return section, nil
+}
+
+// writeReportPDF lays out the report: a title block, then per floor the
+// heatmap, the coverage statistics, the zones, the best and worst areas
+// and the table of measurements.
+func writeReportPDF(w *bytes.Buffer, title string, sections []*reportFloor, threshold ThresholdProfile, params HeatmapParams, style timeStyle) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(title, true)
+	pdf.SetCreator("HeatGen", true)
+	pdf.SetAutoPageBreak(true, 15)
+	text := pdfText(pdf.UnicodeTranslatorFromDescriptor(""))
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(0, 5, text(fmt.Sprintf("%s - page %d", title, pdf.PageNo())), "", 0, "C", false, 0, "")
+	})
+
+	heading := func(s string) {
+		pdf.Ln(3)
+		pdf.SetFont("Helvetica", "B", 12)
+		pdf.CellFormat(0, 7, text(s), "", 1, "", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+	}
+	row := func(widths []float64, cells []string, header bool) {
+		style := ""
+		if header {
+			style = "B"
+		}
+		pdf.SetFont("Helvetica", style, 9)
+		for i, cell := range cells {
+			// Long cells are cut to fit instead of wrapping, which keeps
+			// every row one line high.
+			cell = text(cell)
+			for len(cell) > 1 && pdf.GetStringWidth(cell) > widths[i]-2 {
+				cell = cell[:len(cell)-2] + "."
+			}
+			pdf.CellFormat(widths[i], 6, cell, "1", 0, "", header, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	pdf.SetFillColor(230, 230, 230)
+
+	for i, section := range sections {
+		pdf.AddPage()
+		if i == 0 {
+			pdf.SetFont("Helvetica", "B", 16)
+			pdf.CellFormat(0, 10, text(title), "", 1, "", false, 0, "")
+			pdf.SetFont("Helvetica", "", 9)
+			pdf.CellFormat(0, 5, text(fmt.Sprintf("Generated %s, threshold %s (%d dBm)",
+				style.format(time.Now(), reportTimeLayout), threshold.Name, threshold.MinDbm)), "", 1, "", false, 0, "")
+			if params.SSID != "" || params.BSSID != "" {
+				pdf.CellFormat(0, 5, text(fmt.Sprintf("Network: %s %s", params.SSID, params.BSSID)), "", 1, "", false, 0, "")
+			}
+		}
+
+		floor := section.Floor
+		name := floor.Name
+		if name == "" {
+			name = fmt.Sprintf("Floor %d", floor.ID)
+		}
+		heading(name)
+
+		imageName := fmt.Sprintf("floor_%d", floor.ID)
+		info := pdf.RegisterImageOptionsReader(imageName, gofpdf.ImageOptions{ImageType: "PNG"}, &section.Heatmap)
+		if info != nil {
+			width, height := float64(reportPageWidth), float64(reportPageWidth)*info.Height()/info.Width()
+			if height > reportImageHeight {
+				width, height = width*reportImageHeight/height, reportImageHeight
+			}
+			pdf.ImageOptions(imageName, pdf.GetX(), pdf.GetY(), width, height, true, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+		}
+
+		heading("Coverage")
+		var values []int
+		failed := 0
+		for _, m := range section.Samples {
+			if m.Dbm == failedSampleDbm {
+				failed++
+				continue
+			}
+			values = append(values, m.Dbm)
+		}
+		lines := []string{fmt.Sprintf("Measurements: %d (%d failed)", len(section.Samples), failed)}
+		if len(values) > 0 {
+			minDbm, maxDbm, sum := values[0], values[0], 0
+			for _, v := range values {
+				minDbm, maxDbm, sum = min(minDbm, v), max(maxDbm, v), sum+v
+			}
+			lines = append(lines, fmt.Sprintf("Signal: min %d dBm, mean %.1f dBm, median %d dBm, max %d dBm",
+				minDbm, float64(sum)/float64(len(values)), calculateMedian(values), maxDbm))
+		}
+		area := fmt.Sprintf("%.0f px", section.Coverage.AreaPixels)
+		if section.Coverage.AreaSquareMeters > 0 {
+			area = fmt.Sprintf("%.1f m2", section.Coverage.AreaSquareMeters)
+		}
+		lines = append(lines,
+			fmt.Sprintf("Area at or above %d dBm: %.1f %% of %s", threshold.MinDbm, section.Coverage.Coverage, area),
+			fmt.Sprintf("Dead zones: %d", section.Coverage.TotalFailingRegions))
+		for _, line := range lines {
+			pdf.CellFormat(0, 5, text(line), "", 1, "", false, 0, "")
+		}
+
+		if regions := section.Coverage.FailingRegions; len(regions) > 0 {
+			widths := []float64{40, 50, 50, 50}
+			pdf.Ln(2)
+			row(widths, []string{"Position (x, y)", "Area", "Mean", "Worst"}, true)
+			for _, region := range regions[:min(len(regions), reportDeadZones)] {
+				size := fmt.Sprintf("%.0f px", region.AreaPixels)
+				if region.AreaSquareMeters > 0 {
+					size = fmt.Sprintf("%.1f m2", region.AreaSquareMeters)
+				}
+				row(widths, []string{fmt.Sprintf("%.0f, %.0f", region.Lng, region.Lat), size,
+					fmt.Sprintf("%.1f dBm", region.MeanDbm), fmt.Sprintf("%.1f dBm", region.WorstDbm)}, false)
+			}
+		}
+
+		if len(section.Zones) > 0 {
+			heading("Zones")
+			widths := []float64{60, 30, 30, 25, 25, 20}
+			row(widths, []string{"Zone", "Coverage", "Required", "Mean", "Score", "Result"}, true)
+			for _, zone := range section.Zones {
+				mean, score, result := "-", "-", "fail"
+				if zone.MeanDbm != nil {
+					mean = fmt.Sprintf("%.1f dBm", *zone.MeanDbm)
+				}
+				if zone.Score != nil {
+					score = fmt.Sprintf("%.1f", *zone.Score)
+				}
+				if zone.Pass {
+					result = "pass"
+				} else if zone.Unevaluated {
+					result = "n/a"
+				}
+				row(widths, []string{zone.Zone.Name, fmt.Sprintf("%.1f %%", zone.Coverage),
+					fmt.Sprintf("%.0f %% >= %d dBm", zone.RequiredCoverage, zone.Threshold), mean, score, result}, false)
+			}
+		}
+
+		for _, list := range []struct {
+			title string
+			areas []reportArea
+		}{{"Best areas", section.Best}, {"Worst areas", section.Worst}} {
+			if len(list.areas) == 0 {
+				continue
+			}
+			heading(list.title)
+			widths := []float64{30, 85, 25, 25, 25}
+			row(widths, []string{"Position (x, y)", "Locations", "Points", "Mean", "Min"}, true)
+			for _, a := range list.areas {
+				mean, minDbm := "no signal", "-"
+				if a.Count > a.Failed {
+					mean, minDbm = fmt.Sprintf("%.1f dBm", a.AvgDbm), fmt.Sprintf("%d dBm", a.MinDbm)
+				}
+				row(widths, []string{fmt.Sprintf("%.0f, %.0f", a.Lng, a.Lat), strings.Join(a.Locations, ", "),
+					strconv.Itoa(a.Count), mean, minDbm}, false)
+			}
+		}
+
+		heading("Measurements")
+		widths := []float64{60, 22, 48, 20, 40}
+		row(widths, []string{"Location", "Signal", "SSID", "Channel", "Time"}, true)
+		for _, m := range section.Samples {
+			signal, channel := "failed", ""
+			if m.Dbm != failedSampleDbm {
+				signal = fmt.Sprintf("%d dBm", m.Dbm)
+			}
+			if m.Channel != 0 {
+				channel = strconv.Itoa(m.Channel)
+			}
+			row(widths, []string{m.Location, signal, m.SSID, channel, style.format(m.Timestamp, reportTimeLayout)}, false)
+		}
+	}
+
+	return pdf.Output(w)
+}
+
+// reportHandler produces a PDF survey report of one floor, or with only a
+// session of every floor the session measured. Heatmap query parameters
+// select the measurements and the interpolation; threshold sets the
+// coverage requirement. ?tz and ?timeFormat set how times are written, see
+// parseTimeStyle.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if query.Has("floor") && err != nil {
+		http.Error(w, "invalid floor", http.StatusBadRequest)
+		return
+	}
+	sessionID := query.Get("session")
+	if !query.Has("floor") && sessionID == "" {
+		http.Error(w, "floor or session is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	weights, err := scoreWeightsParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+	params.Legend = true
+	style, err := parseTimeStyle(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	title := "Wi-Fi survey report"
+	if sessionID != "" {
+		session, exists := getSession(sessionID)
+		if !exists {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		title += ": " + session.Name
+	}
+
+	mutex.Lock()
+	byFloor := make(map[int][]Measurement)
+	for _, m := range measurements {
+		if (query.Has("floor") && m.Floor != floorID) || !m.approved() {
+			continue
+		}
+		byFloor[m.Floor] = append(byFloor[m.Floor], m)
+	}
+	var selected []Floor
+	if query.Has("floor") {
+		if floor, exists := floors[floorID]; exists {
+			selected = append(selected, floor)
+		}
+	} else {
+		for id, ms := range byFloor {
+			if floor, exists := floors[id]; exists && len(sessionMeasurements(ms, sessionID)) > 0 {
+				selected = append(selected, floor)
+			}
+		}
+	}
+	mutex.Unlock()
+
+	if query.Has("floor") && len(selected) == 0 {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if len(selected) == 0 {
+		http.Error(w, "session has no measurements", http.StatusBadRequest)
+		return
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].ID < selected[j].ID })
+	if *siteID != "" {
+		title += " (" + *siteID + ")"
+	}
+
+	for _, floor := range selected {
+		if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+			http.Error(w, errMaskUncalibrated.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		var sections []*reportFloor
+		for _, floor := range selected {
+			section, err := buildReportFloor(ctx, floor, byFloor[floor.ID], params, threshold, scoreMetric(weights))
+			if err != nil {
+				if ctx.Err() != nil {
+					http.Error(w, "report generation timed out", http.StatusServiceUnavailable)
+					return
+				}
+				http.Error(w, fmt.Sprintf("failed to build report: %v", err), http.StatusInternalServerError)
+				return
+			}
+			sections = append(sections, section)
+		}
+
+		var buf bytes.Buffer
+		if err := writeReportPDF(&buf, title, sections, threshold, params, style); err != nil {
+			http.Error(w, fmt.Sprintf("failed to write report: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		filename := "report.pdf"
+		if query.Has("floor") {
+			filename = fmt.Sprintf("report_floor_%d.pdf", floorID)
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+const (
+	maxPhotoSize = 20 << 20
+	// maxPhotoPixels keeps decoding for the thumbnail within memory; phone
+	// cameras stay below it.
+	maxPhotoPixels = 64 << 20
+	// photoThumbSize is the longest side of photo thumbnails in pixels.
+	photoThumbSize = 320
+	photoThumbName = "thumb.jpg"
+)
+
+// photoExtensions maps the image types accepted for photos to the file
+// extension they are stored with. Phones upload JPEG; PNG and WebP cover
+// screenshots and converted files.
+var photoExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// photoFile is the stored photo of a measurement, "" when it has none.
+func photoFile(measurementID string) string {
+	dir := filepath.Join(projectFile(attachmentsDir), filepath.Base(measurementID))
+	for _, ext := range photoExtensions {
+		if path := filepath.Join(dir, "photo"+ext); fileExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 (upright) when it
+// has none. Phones store pictures as the sensor took them and only tag
+// how to turn them.
+func jpegOrientation(data []byte) int {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || i+2+size > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation finds the orientation tag in the first IFD of the EXIF
+// TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + e*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+		}
+	}
+	return 1
+}
+
+// orientImage turns src upright as the EXIF orientation asks.
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // turned left, to be turned right
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // turned right, to be turned left
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, src.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// photoThumbnail scales the photo down to photoThumbSize, upright, as a
+// JPEG.
+func photoThumbnail(contentType string, data []byte) ([]byte, error) {
+	var config image.Config
+	var img image.Image
+	var err error
+	if contentType == "image/webp" {
+		if config, err = webp.DecodeConfig(bytes.NewReader(data)); err == nil && config.Width*config.Height <= maxPhotoPixels {
+			img, err = webp.Decode(bytes.NewReader(data))
+		}
+	} else if config, _, err = image.DecodeConfig(bytes.NewReader(data)); err == nil && config.Width*config.Height <= maxPhotoPixels {
+		img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err == nil && img == nil {
+		return nil, fmt.Errorf("photo of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s image: %v", contentType, err)
+	}
+
+	b := img.Bounds()
+	scale := min(1, float64(photoThumbSize)/float64(max(b.Dx(), b.Dy())))
+	thumb := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(b.Dx())*scale)), max(1, int(float64(b.Dy())*scale))))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+
+	orientation := 1
+	if contentType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orientImage(thumb, orientation), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setHasPhoto records on the measurement whether it has a photo, and in the
+// audit log for actor. It returns false when the measurement does not
+// exist.
+func setHasPhoto(actor, id string, hasPhoto bool) (Measurement, bool, error) {
+	mutex.Lock()
+	index := -1
+	for i, m := range measurements {
+		if m.ID == id {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		mutex.Unlock()
+		return Measurement{}, false, nil
+	}
+	measurements[index].HasPhoto = hasPhoto
+	record := measurements[index]
+	updateRevision()
+	revision := dataRevision
+	mutex.Unlock()
+
+	if err := store.SaveMeasurement(record); err != nil {
+		return record, true, fmt.Errorf("failed to save measurement")
+	}
+	publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: []Measurement{record}}, 0)
+	detail := "photo removed"
+	if hasPhoto {
+		detail = "photo attached"
+	}
+	auditMeasurements(actor, eventMeasurementsUpdated, detail, []Measurement{record})
+	return record, true, nil
+}
+
+// photoHandler serves the photo of the spot a measurement was taken at.
+// POST or PUT attaches one, replacing the previous, from the multipart
+// field "photo", and answers with the measurement; DELETE removes it. A
+// thumbnail is kept beside the photo, see photoThumbHandler.
+func photoHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case "GET":
+		path := photoFile(id)
+		if path == "" {
+			http.Error(w, "photo not found", http.StatusNotFound)
+			return
+		}
+		serveAttachment(w, r, filepath.Base(path), mapContentTypes[filepath.Ext(path)])
+	case "POST", "PUT":
+		uploadPhoto(w, r, id)
+	case "DELETE":
+		path := photoFile(id)
+		if path == "" {
+			http.Error(w, "photo not found", http.StatusNotFound)
+			return
+		}
+		_, exists, err := setHasPhoto(auditActor(r), id, false)
+		if !exists {
+			http.Error(w, "measurement not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		os.Remove(path)
+		os.Remove(filepath.Join(filepath.Dir(path), photoThumbName))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadPhoto(w http.ResponseWriter, r *http.Request, id string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotoSize+1<<20)
+	file, _, err := r.FormFile("photo")
+	if err != nil {
+		http.Error(w, "failed to get photo from form", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxPhotoSize+1))
+	if err != nil {
+		http.Error(w, "failed to read photo", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxPhotoSize {
+		http.Error(w, "photo too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := photoExtensions[contentType]
+	if !ok {
+		http.Error(w, "unsupported photo format, expected jpeg, png or webp", http.StatusUnsupportedMediaType)
+		return
+	}
+	thumb, err := photoThumbnail(contentType, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	found := false
+	for _, m := range measurements {
+		if m.ID == id {
+			found = true
+			break
+		}
+	}
+	mutex.Unlock()
+	if !found {
+		http.Error(w, "measurement not found", http.StatusNotFound)
+		return
+	}
+
+	if previous := photoFile(id); previous != "" {
+		os.Remove(previous)
+	}
+	if err := saveAttachment(id, "photo"+ext, data); err != nil {
+		http.Error(w, "failed to store photo", http.StatusInternalServerError)
+		return
+	}
+	if err := saveAttachment(id, photoThumbName, thumb); err != nil {
+		http.Error(w, "failed to store photo", http.StatusInternalServerError)
+		return
+	}
+	record, _, err := setHasPhoto(auditActor(r), id, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(record)
+}
+
+// photoThumbHandler serves the thumbnail of a measurement's photo.
+func photoThumbHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serveAttachment(w, r, photoThumbName, "image/jpeg")
+}
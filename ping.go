@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	maxPings = 100
+	// pingWait is how long a reply to the last echo request is waited for.
+	pingWait = 2 * time.Second
+)
+
+var pingHost = flag.String("ping-host", envOrDefault("HEATGEN_PING_HOST", ""), "host pinged by measurements that ask for pings and name no host, e.g. the gateway (env HEATGEN_PING_HOST)")
+
+var (
+	pingHostRe  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.:-]{0,252}$`)
+	pingReplyRe = regexp.MustCompile(`time[=<]\s*([0-9.]+)\s*ms`)
+)
+
+// applyPingDefaults checks the pings a measurement asks for and fills in
+// the default host.
+func applyPingDefaults(req *MeasurementRequest) error {
+	if req.Pings == 0 {
+		return nil
+	}
+	if req.Pings < 0 || req.Pings > maxPings {
+		return fmt.Errorf("pings must be between 0 and %d", maxPings)
+	}
+	if req.Type == "scan" || req.Type == "spectral" {
+		return fmt.Errorf("pings are not supported for %s measurements", req.Type)
+	}
+	if req.PingHost == "" {
+		req.PingHost = *pingHost
+	}
+	if req.PingHost == "" {
+		return fmt.Errorf("pings need a host, set pingHost or -ping-host")
+	}
+	if !pingHostRe.MatchString(req.PingHost) {
+		return fmt.Errorf("invalid ping host %q", req.PingHost)
+	}
+	return nil
+}
+
+// pingCommand builds the system ping invocation, whose options differ per
+// platform. Raw ICMP sockets would need privileges the server usually
+// lacks, while ping is installed setuid or with the capability.
+func pingCommand(ctx context.Context, host string, count int) *exec.Cmd {
+	n := strconv.Itoa(count)
+	switch runtime.GOOS {
+	case "windows":
+		return exec.CommandContext(ctx, "ping", "-n", n, "-w", strconv.Itoa(int(pingWait.Milliseconds())), host)
+	case "darwin":
+		return exec.CommandContext(ctx, "ping", "-c", n, "-i", "0.2", "-W", strconv.Itoa(int(pingWait.Milliseconds())), host)
+	default:
+		return exec.CommandContext(ctx, "ping", "-c", n, "-i", "0.2", "-W", strconv.Itoa(int(pingWait.Seconds())), host)
+	}
+}
+
+// runPings sends count echo requests to host and returns the round trip
+// times of the replies in milliseconds, in the order they arrived.
+func runPings(ctx context.Context, host string, count int) ([]float64, error) {
+	output, err := pingCommand(ctx, host, count).CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var rtts []float64
+	for _, match := range pingReplyRe.FindAllSubmatch(output, -1) {
+		if rtt, err := strconv.ParseFloat(string(match[1]), 64); err == nil {
+			rtts = append(rtts, rtt)
+		}
+	}
+
+	// ping exits with 1 when replies were lost, which is a result here;
+	// other failures, such as an unknown host, are not.
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, fmt.Errorf("ping: %v: %s", err, output)
+	}
+	return rtts, nil
+}
+
+// pingStats summarizes the replies to count echo requests as the median
+// latency, the jitter, i.e. the mean difference between consecutive round
+// trip times, and the loss. Latency needs one reply and jitter two.
+func pingStats(rtts []float64, count int) (latency, jitter, loss *float64) {
+	lost := 100 * float64(count-len(rtts)) / float64(count)
+	loss = &lost
+
+	if len(rtts) > 0 {
+		sorted := append([]float64(nil), rtts...)
+		sort.Float64s(sorted)
+		median := sorted[len(sorted)/2]
+		if len(sorted)%2 == 0 {
+			median = (sorted[len(sorted)/2-1] + median) / 2
+		}
+		latency = &median
+	}
+
+	if len(rtts) > 1 {
+		var sum float64
+		for i := 1; i < len(rtts); i++ {
+			sum += math.Abs(rtts[i] - rtts[i-1])
+		}
+		mean := sum / float64(len(rtts)-1)
+		jitter = &mean
+	}
+
+	return latency, jitter, loss
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultAPTxPower  = -40
+	defaultAPExponent = 3
+	maxAPSuggestions  = 5
+	// maxPlacementCandidates bounds the candidate positions per axis.
+	maxPlacementCandidates = 60
+)
+
+// APPlacement is a suggested position for an additional access point with
+// the coverage expected once it is installed.
+type APPlacement struct {
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Coverage float64 `json:"coverage"`
+	Gain     float64 `json:"gain"`
+}
+
+type PlacementResult struct {
+	Floor          int              `json:"floor"`
+	Zone           string           `json:"zone,omitempty"`
+	Threshold      ThresholdProfile `json:"threshold"`
+	TxPower        float64          `json:"txPower"`
+	Exponent       float64          `json:"exponent"`
+	RadiusMeters   float64          `json:"radiusMeters"`
+	CoverageBefore float64          `json:"coverageBefore"`
+	Placements     []APPlacement    `json:"placements"`
+}
+
+// coverageRadius returns the distance in meters up to which the log-distance
+// path loss model, with txPower dBm at 1 m, predicts at least threshold
+// dBm.
+func coverageRadius(txPower, exponent float64, threshold int) float64 {
+	return math.Pow(10, (txPower-float64(threshold))/(10*exponent))
+}
+
+// suggestPlacements places count access points one after another, each at
+// the candidate position that brings the most uncovered grid cells above
+// the threshold. A new AP is assumed to cover a disc of radius pixels;
+// walls are not modelled.
+func suggestPlacements(ctx context.Context, grid *signalGrid, region []Vertex, threshold int, radius float64, count int) (float64, []APPlacement, error) {
+	height := grid.Bounds.Dy()
+
+	// covered is nil for cells outside the analysed area.
+	covered := make([]*bool, len(grid.Values))
+	var total, passing int
+	for row := 0; row < grid.Rows; row++ {
+		for col := 0; col < grid.Cols; col++ {
+			x, y := col*grid.Step, row*grid.Step
+			if x >= grid.Bounds.Dx() || y >= height {
+				continue
+			}
+			if len(region) > 0 && !polygonContains(region, float64(height-y), float64(x)) {
+				continue
+			}
+			ok := grid.Values[row*grid.Cols+col] >= float64(threshold)
+			covered[row*grid.Cols+col] = &ok
+			total++
+			if ok {
+				passing++
+			}
+		}
+	}
+	if total == 0 {
+		return 0, nil, fmt.Errorf("the area to cover contains no grid cells")
+	}
+
+	percent := func(n int) float64 {
+		return math.Round(float64(n)/float64(total)*1000) / 10
+	}
+	before := percent(passing)
+
+	stride := max(1, max(grid.Cols, grid.Rows)/maxPlacementCandidates)
+	reach := int(math.Ceil(radius / float64(grid.Step)))
+
+	var placements []APPlacement
+	for len(placements) < count && passing < total {
+		bestGain, bestRow, bestCol := 0, -1, -1
+		for row := 0; row < grid.Rows; row += stride {
+			if err := ctx.Err(); err != nil {
+				return 0, nil, err
+			}
+			for col := 0; col < grid.Cols; col += stride {
+				if covered[row*grid.Cols+col] == nil {
+					continue
+				}
+
+				gain := 0
+				for r := max(0, row-reach); r <= min(grid.Rows-1, row+reach); r++ {
+					for c := max(0, col-reach); c <= min(grid.Cols-1, col+reach); c++ {
+						cell := covered[r*grid.Cols+c]
+						if cell == nil || *cell {
+							continue
+						}
+						if math.Hypot(float64(r-row), float64(c-col))*float64(grid.Step) <= radius {
+							gain++
+						}
+					}
+				}
+				if gain > bestGain {
+					bestGain, bestRow, bestCol = gain, row, col
+				}
+			}
+		}
+		if bestGain == 0 {
+			break
+		}
+
+		for r := max(0, bestRow-reach); r <= min(grid.Rows-1, bestRow+reach); r++ {
+			for c := max(0, bestCol-reach); c <= min(grid.Cols-1, bestCol+reach); c++ {
+				cell := covered[r*grid.Cols+c]
+				if cell != nil && !*cell && math.Hypot(float64(r-bestRow), float64(c-bestCol))*float64(grid.Step) <= radius {
+					*cell = true
+				}
+			}
+		}
+		passing += bestGain
+
+		placements = append(placements, APPlacement{
+			Lat:      float64(height - bestRow*grid.Step),
+			Lng:      float64(bestCol * grid.Step),
+			Coverage: percent(passing),
+			Gain:     percent(bestGain),
+		})
+	}
+
+	return before, placements, nil
+}
+
+// placementHandler suggests where to add access points on a floor so that
+// most of its area (or of a zone) reaches the threshold. count sets the
+// number of APs; model selects a calibrated path loss model, and txPower
+// (dBm at 1 m) and exponent tune it. Distances need a calibrated or scaled
+// floor.
+func placementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count := 1
+	if value := query.Get("count"); value != "" {
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 || count > maxAPSuggestions {
+			http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxAPSuggestions), http.StatusBadRequest)
+			return
+		}
+	}
+
+	txPower, exponent, err := pathLossParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if txPower <= float64(threshold.MinDbm) {
+		http.Error(w, "txPower must be above the threshold", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules := []SLARule{{Threshold: strconv.Itoa(threshold.MinDbm), Zone: query.Get("zone")}}
+	if err := resolveSLARules(rules, floorID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.metersPerPixel() == 0 {
+		http.Error(w, "AP placement needs a calibrated or scaled floor", http.StatusBadRequest)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		bounds, _, err := floorBounds(floor, filtered)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		grid, err := interpolateGrid(ctx, bounds, filtered, params)
+		if err == nil && grid.Values == nil {
+			err = fmt.Errorf("floor has no measurements to evaluate")
+		}
+
+		radiusMeters := coverageRadius(txPower, exponent, threshold.MinDbm)
+		var before float64
+		var placements []APPlacement
+		if err == nil {
+			radius := radiusMeters / floor.metersPerPixel()
+			before, placements, err = suggestPlacements(ctx, grid, rules[0].Region, threshold.MinDbm, radius, count)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "AP placement timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(PlacementResult{
+			Floor:          floorID,
+			Zone:           query.Get("zone"),
+			Threshold:      threshold,
+			TxPower:        txPower,
+			Exponent:       exponent,
+			RadiusMeters:   math.Round(radiusMeters*10) / 10,
+			CoverageBefore: before,
+			Placements:     append([]APPlacement{}, placements...),
+		})
+	})
+}
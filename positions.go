@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	positionManual = "manual"
+	positionGPSD   = "gpsd"
+	positionNMEA   = "nmea"
+	positionRTLS   = "rtls"
+
+	defaultGPSDAddress = "localhost:2947"
+	// positionReconnectDelay is how long streaming providers wait before
+	// connecting again after losing their source.
+	positionReconnectDelay = 5 * time.Second
+	// nmeaUERE converts the HDOP of NMEA fixes to meters, the error of a
+	// typical consumer receiver.
+	nmeaUERE = 5.0
+)
+
+var (
+	positionProviderName = flag.String("position-provider", envOrDefault("HEATGEN_POSITION_PROVIDER", positionManual), "where positions come from for measurements without lat and lng and for tracks asking for the current one: manual (clients give them), gpsd, nmea or rtls (env HEATGEN_POSITION_PROVIDER)")
+	positionSource       = flag.String("position-source", envOrDefault("HEATGEN_POSITION_SOURCE", ""), "source of the position provider: the gpsd address (localhost:2947), the NMEA serial device or tcp://host:port, or the URL of the RTLS position (env HEATGEN_POSITION_SOURCE)")
+	positionFloor        = flag.Int("position-floor", 0, "floor the positions are placed on when the provider does not tell; GPS positions need its map calibrated")
+	positionMaxAge       = flag.Duration("position-max-age", 5*time.Second, "how old a position may be and still be used")
+)
+
+// errNoPositionProvider is returned by the manual provider: the client
+// gives the positions.
+var errNoPositionProvider = errors.New("no position provider is configured (-position-provider)")
+
+// Position is where the collector is, in floor coordinates like those of
+// measurements. Accuracy is the estimated error in meters.
+type Position struct {
+	Floor     int       `json:"floor"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Accuracy  float64   `json:"accuracy,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Provider  string    `json:"provider"`
+}
+
+// PositionProvider locates the collector, so surveys in buildings with
+// positioning infrastructure need no clicks on the map. Like SignalReader
+// it is chosen on the command line.
+type PositionProvider interface {
+	// Position returns the current position of the collector, or an
+	// error when there is no recent one.
+	Position() (Position, error)
+	// Check probes the provider for /readyz.
+	Check() []HealthCheck
+}
+
+// positionProvider is set by main once the flags are parsed.
+var positionProvider PositionProvider
+
+func newPositionProvider() (PositionProvider, error) {
+	switch *positionProviderName {
+	case positionManual:
+		return manualPositions{}, nil
+	case positionGPSD:
+		address := *positionSource
+		if address == "" {
+			address = defaultGPSDAddress
+		}
+		return startFixStream(positionGPSD, address, func() (io.ReadCloser, error) {
+			return dialGPSD(address)
+		}, readGPSD), nil
+	case positionNMEA:
+		if *positionSource == "" {
+			return nil, fmt.Errorf("-position-source must name the NMEA device or tcp://host:port")
+		}
+		source := *positionSource
+		return startFixStream(positionNMEA, source, func() (io.ReadCloser, error) {
+			if address, found := strings.CutPrefix(source, "tcp://"); found {
+				return net.DialTimeout("tcp", address, 10*time.Second)
+			}
+			return os.Open(source)
+		}, readNMEA), nil
+	case positionRTLS:
+		if !strings.HasPrefix(*positionSource, "http://") && !strings.HasPrefix(*positionSource, "https://") {
+			return nil, fmt.Errorf("-position-source must be the http(s) URL of the RTLS position")
+		}
+		return rtlsPositions{url: *positionSource, client: &http.Client{Timeout: 2 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("-position-provider must be manual, gpsd, nmea or rtls")
+}
+
+// manualPositions leaves positions to the client, as clicks on the map or
+// waypoints of a track.
+type manualPositions struct{}
+
+func (manualPositions) Position() (Position, error) {
+	return Position{}, errNoPositionProvider
+}
+
+func (manualPositions) Check() []HealthCheck {
+	return nil
+}
+
+// geoPosition places a WGS 84 fix on -position-floor through the
+// calibration of its map.
+func geoPosition(provider string, lat, lng, accuracy float64, at time.Time) (Position, error) {
+	toFloor, err := floorTransform(*positionFloor)
+	if err != nil {
+		return Position{}, fmt.Errorf("%v; set -position-floor to a floor with a calibrated map", err)
+	}
+	floorLat, floorLng := toFloor(lat, lng)
+
+	// Accuracy stays in meters; only the position is converted.
+	return Position{
+		Floor:     *positionFloor,
+		Lat:       floorLat,
+		Lng:       floorLng,
+		Accuracy:  accuracy,
+		Timestamp: at,
+		Provider:  provider,
+	}, nil
+}
+
+// geoFix is a WGS 84 position read from a GPS source.
+type geoFix struct {
+	lat, lng, accuracy float64
+	at                 time.Time
+}
+
+// fixStream keeps the latest fix of a provider that streams them, gpsd or
+// NMEA, reading in the background and connecting again when the source
+// goes away.
+type fixStream struct {
+	name, source string
+
+	lock sync.Mutex
+	fix  *geoFix
+	// err is why the source could not be read, nil while it is.
+	err error
+}
+
+func startFixStream(name, source string, connect func() (io.ReadCloser, error), read func(io.Reader, func(geoFix)) error) *fixStream {
+	s := &fixStream{name: name, source: source}
+	go func() {
+		for {
+			conn, err := connect()
+			if err == nil {
+				s.setErr(nil)
+				err = read(conn, s.setFix)
+				conn.Close()
+			}
+			if err == nil {
+				err = io.EOF
+			}
+			s.setErr(err)
+			log.Printf("position provider %s: %s: %v", name, source, err)
+			time.Sleep(positionReconnectDelay)
+		}
+	}()
+	return s
+}
+
+func (s *fixStream) setFix(fix geoFix) {
+	s.lock.Lock()
+	s.fix = &fix
+	s.lock.Unlock()
+}
+
+func (s *fixStream) setErr(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+}
+
+func (s *fixStream) latest() (geoFix, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.fix == nil || time.Since(s.fix.at) > *positionMaxAge {
+		if s.err != nil {
+			return geoFix{}, fmt.Errorf("no recent %s fix: %v", s.name, s.err)
+		}
+		return geoFix{}, fmt.Errorf("no recent %s fix", s.name)
+	}
+	return *s.fix, nil
+}
+
+func (s *fixStream) Position() (Position, error) {
+	fix, err := s.latest()
+	if err != nil {
+		return Position{}, err
+	}
+	return geoPosition(s.name, fix.lat, fix.lng, fix.accuracy, fix.at)
+}
+
+func (s *fixStream) Check() []HealthCheck {
+	check := HealthCheck{Name: "position fix", OK: true}
+	if _, err := s.Position(); err != nil {
+		check.OK = false
+		check.Detail = err.Error()
+		check.Hint = fmt.Sprintf("check that %s is reachable at %s and has a fix", s.name, s.source)
+	}
+	return []HealthCheck{check}
+}
+
+func dialGPSD(address string) (io.ReadCloser, error) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, `?WATCH={"enable":true,"json":true};`+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readGPSD reads the TPV reports of gpsd's JSON protocol. Reports without
+// a 2D or 3D fix are skipped.
+func readGPSD(r io.Reader, fix func(geoFix)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var report struct {
+			Class string    `json:"class"`
+			Mode  int       `json:"mode"`
+			Time  time.Time `json:"time"`
+			Lat   *float64  `json:"lat"`
+			Lon   *float64  `json:"lon"`
+			Eph   float64   `json:"eph"`
+			Epx   float64   `json:"epx"`
+			Epy   float64   `json:"epy"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &report) != nil || report.Class != "TPV" || report.Mode < 2 || report.Lat == nil || report.Lon == nil {
+			continue
+		}
+		accuracy := report.Eph
+		if accuracy == 0 {
+			accuracy = math.Max(report.Epx, report.Epy)
+		}
+		at := report.Time
+		if at.IsZero() {
+			at = time.Now()
+		}
+		fix(geoFix{lat: *report.Lat, lng: *report.Lon, accuracy: accuracy, at: at})
+	}
+	return scanner.Err()
+}
+
+// readNMEA reads the GGA and RMC sentences of a GPS receiver. They carry
+// only the time of day, so fixes are stamped when they arrive.
+func readNMEA(r io.Reader, fix func(geoFix)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields, ok := nmeaFields(scanner.Text())
+		if !ok || len(fields[0]) < 5 {
+			continue
+		}
+
+		var latField, lngField int
+		accuracy := 0.0
+		switch fields[0][2:] {
+		case "GGA":
+			// $--GGA,time,lat,N,lon,E,quality,satellites,hdop,...
+			if len(fields) < 9 || fields[6] == "" || fields[6] == "0" {
+				continue
+			}
+			latField, lngField = 2, 4
+			if hdop, err := strconv.ParseFloat(fields[8], 64); err == nil {
+				accuracy = hdop * nmeaUERE
+			}
+		case "RMC":
+			// $--RMC,time,status,lat,N,lon,E,...
+			if len(fields) < 7 || fields[2] != "A" {
+				continue
+			}
+			latField, lngField = 3, 5
+		default:
+			continue
+		}
+
+		lat, latOK := nmeaCoordinate(fields[latField], fields[latField+1], "N", "S")
+		lng, lngOK := nmeaCoordinate(fields[lngField], fields[lngField+1], "E", "W")
+		if latOK && lngOK {
+			fix(geoFix{lat: lat, lng: lng, accuracy: accuracy, at: time.Now()})
+		}
+	}
+	return scanner.Err()
+}
+
+// nmeaFields splits a sentence into its fields, the first being the talker
+// and type, after checking its checksum when it has one.
+func nmeaFields(sentence string) ([]string, bool) {
+	sentence = strings.TrimSpace(sentence)
+	body, found := strings.CutPrefix(sentence, "$")
+	if !found {
+		return nil, false
+	}
+	if data, checksum, found := strings.Cut(body, "*"); found {
+		want, err := strconv.ParseUint(checksum, 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		var sum byte
+		for i := 0; i < len(data); i++ {
+			sum ^= data[i]
+		}
+		if byte(want) != sum {
+			return nil, false
+		}
+		body = data
+	}
+	return strings.Split(body, ","), true
+}
+
+// nmeaCoordinate converts (d)ddmm.mmmm and its hemisphere to degrees.
+func nmeaCoordinate(value, hemisphere, positive, negative string) (float64, bool) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || (hemisphere != positive && hemisphere != negative) {
+		return 0, false
+	}
+	degrees := math.Floor(v / 100)
+	degrees += (v - degrees*100) / 60
+	if hemisphere == negative {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+// rtlsPositions asks an indoor positioning system, UWB or BLE, for the
+// position of the collector's tag. The URL answers with JSON
+//
+//	{"x": 12.3, "y": 4.5, "floor": 2, "accuracy": 0.3, "timestamp": "..."}
+//
+// in meters from the bottom left corner of the floor map, x to the right
+// and y up; most systems can be set up with their origin there. floor,
+// accuracy and timestamp are optional. The floor needs a scale or a
+// calibration to convert meters to map pixels.
+type rtlsPositions struct {
+	url    string
+	client *http.Client
+}
+
+func (p rtlsPositions) Position() (Position, error) {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return Position{}, fmt.Errorf("failed to ask the RTLS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Position{}, fmt.Errorf("the RTLS answered %s", resp.Status)
+	}
+
+	var reading struct {
+		X         *float64  `json:"x"`
+		Y         *float64  `json:"y"`
+		Floor     int       `json:"floor"`
+		Accuracy  float64   `json:"accuracy"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reading); err != nil {
+		return Position{}, fmt.Errorf("invalid RTLS position: %v", err)
+	}
+	if reading.X == nil || reading.Y == nil {
+		return Position{}, fmt.Errorf("the RTLS position has no x and y")
+	}
+	if reading.Timestamp.IsZero() {
+		reading.Timestamp = time.Now()
+	} else if time.Since(reading.Timestamp) > *positionMaxAge {
+		return Position{}, fmt.Errorf("the RTLS position is from %s, too old", reading.Timestamp.Format(time.RFC3339))
+	}
+	if reading.Floor == 0 {
+		reading.Floor = *positionFloor
+	}
+
+	mutex.Lock()
+	floor, exists := floors[reading.Floor]
+	mutex.Unlock()
+	if !exists {
+		return Position{}, fmt.Errorf("floor %d of the RTLS position not found; set -position-floor", reading.Floor)
+	}
+	metersPerPixel := 0.0
+	if floor.Scale != nil {
+		metersPerPixel = floor.Scale.MetersPerPixel
+	} else if floor.Calibration != nil {
+		metersPerPixel = floor.Calibration.metersPerPixel()
+	}
+	if metersPerPixel <= 0 {
+		return Position{}, fmt.Errorf("floor %d has no scale to place RTLS positions", reading.Floor)
+	}
+
+	return Position{
+		Floor:     reading.Floor,
+		Lat:       *reading.Y / metersPerPixel,
+		Lng:       *reading.X / metersPerPixel,
+		Accuracy:  reading.Accuracy,
+		Timestamp: reading.Timestamp,
+		Provider:  positionRTLS,
+	}, nil
+}
+
+func (p rtlsPositions) Check() []HealthCheck {
+	check := HealthCheck{Name: "position fix", OK: true}
+	if _, err := p.Position(); err != nil {
+		check.OK = false
+		check.Detail = err.Error()
+		check.Hint = "check that the RTLS is reachable and locates the collector's tag"
+	}
+	return []HealthCheck{check}
+}
+
+// coordinates returns the position of the request; coordinates left out
+// are 0.
+func (req MeasurementRequest) coordinates() (lat, lng float64) {
+	if req.Lat != nil {
+		lat = *req.Lat
+	}
+	if req.Lng != nil {
+		lng = *req.Lng
+	}
+	return lat, lng
+}
+
+func (req *MeasurementRequest) setCoordinates(lat, lng float64) {
+	req.Lat, req.Lng = &lat, &lng
+}
+
+// positionHandler returns the current position of the collector from the
+// position provider.
+func positionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	position, err := positionProvider.Position()
+	if errors.Is(err, errNoPositionProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(position)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security findings of a scanned AP.
+const (
+	// findingRogue is an AP broadcasting a trusted SSID from an unknown
+	// BSSID.
+	findingRogue = "rogue"
+	// findingDuplicateSSID is an AP broadcasting an SSID heard at the same
+	// point with another kind of security, as an evil twin or a
+	// misconfigured AP does.
+	findingDuplicateSSID = "duplicate-ssid"
+)
+
+var bssidPrefixPattern = regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){0,5}$`)
+
+// knownAPs returns the trusted SSIDs of the project and the BSSIDs and
+// BSSID prefixes of its APs: those of the project settings and those the
+// polled access points reported.
+func knownAPs() (map[string]bool, []string) {
+	projectSettingsLock.Lock()
+	trusted := make(map[string]bool, len(projectSettings.TrustedSSIDs))
+	for _, ssid := range projectSettings.TrustedSSIDs {
+		trusted[ssid] = true
+	}
+	known := append([]string(nil), projectSettings.KnownBSSIDs...)
+	projectSettingsLock.Unlock()
+
+	apsLock.Lock()
+	for _, ap := range accessPoints {
+		for _, radio := range ap.Radios {
+			if radio.BSSID != "" {
+				known = append(known, strings.ToLower(radio.BSSID))
+			}
+		}
+	}
+	apsLock.Unlock()
+	return trusted, known
+}
+
+// securityKind groups the security types of scanSecurity that legitimately
+// share an SSID, as WPA3-only 6 GHz radios share it with WPA2/WPA3
+// transition mode on the other bands.
+func securityKind(security string) string {
+	switch security {
+	case "Open", "OWE":
+		return "open"
+	case "WPA", "WPA2", "WPA2/WPA3", "WPA3":
+		return "personal"
+	}
+	return security
+}
+
+func knownBSSID(bssid string, known []string) bool {
+	bssid = strings.ToLower(bssid)
+	for _, prefix := range known {
+		if strings.HasPrefix(bssid, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// assessScanSecurity sets the security findings of the records of one
+// scan. Rogue APs are only looked for once the project has trusted SSIDs
+// and known BSSIDs, since otherwise every AP of a trusted SSID would be
+// one. An SSID heard with different kinds of security is flagged on the
+// APs using other than its most common kind, or on all of them when no
+// kind is the most common.
+func assessScanSecurity(records []Measurement) {
+	trusted, known := knownAPs()
+	checkRogues := len(trusted) > 0 && len(known) > 0
+
+	securities := make(map[string]map[string]int)
+	for _, m := range records {
+		if m.SSID == "" {
+			continue
+		}
+		if securities[m.SSID] == nil {
+			securities[m.SSID] = make(map[string]int)
+		}
+		securities[m.SSID][securityKind(m.Security)]++
+	}
+
+	for i, m := range records {
+		var findings []string
+		if checkRogues && trusted[m.SSID] && !knownBSSID(m.BSSID, known) {
+			findings = append(findings, findingRogue)
+		}
+		if counts := securities[m.SSID]; len(counts) > 1 {
+			most, tied := 0, false
+			for _, count := range counts {
+				switch {
+				case count > most:
+					most, tied = count, false
+				case count == most:
+					tied = true
+				}
+			}
+			if tied || counts[securityKind(m.Security)] < most {
+				findings = append(findings, findingDuplicateSSID)
+			}
+		}
+		records[i].SecurityFindings = findings
+	}
+}
+
+// RogueSighting is a point where a flagged AP was heard.
+type RogueSighting struct {
+	MeasurementID string    `json:"measurementId"`
+	ScanID        string    `json:"scanId"`
+	Floor         int       `json:"floor"`
+	Lat           float64   `json:"lat"`
+	Lng           float64   `json:"lng"`
+	Location      string    `json:"location,omitempty"`
+	Dbm           int       `json:"dbm"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// RogueAP is an AP flagged in scans, with everywhere it was heard,
+// strongest first.
+type RogueAP struct {
+	BSSID     string          `json:"bssid"`
+	SSID      string          `json:"ssid"`
+	Security  string          `json:"security,omitempty"`
+	PMF       string          `json:"pmf,omitempty"`
+	Channel   int             `json:"channel,omitempty"`
+	Findings  []string        `json:"findings"`
+	Strongest int             `json:"strongest"`
+	FirstSeen time.Time       `json:"firstSeen"`
+	LastSeen  time.Time       `json:"lastSeen"`
+	Sightings []RogueSighting `json:"sightings"`
+}
+
+// roguesHandler lists the APs scans flagged as rogue or as duplicating an
+// SSID, and where they were heard, strongest APs first. floor, session,
+// ssid and ?finding (rogue or duplicate-ssid) select the scans.
+func roguesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID := 0
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+	finding := query.Get("finding")
+	if finding != "" && finding != findingRogue && finding != findingDuplicateSSID {
+		http.Error(w, "finding must be rogue or duplicate-ssid", http.StatusBadRequest)
+		return
+	}
+	session, ssid := query.Get("session"), query.Get("ssid")
+
+	byBSSID := make(map[string]*RogueAP)
+	mutex.Lock()
+	for _, m := range measurements {
+		if len(m.SecurityFindings) == 0 || !m.approved() || (floorID != 0 && m.Floor != floorID) || !inSession(m, session) || (ssid != "" && m.SSID != ssid) {
+			continue
+		}
+		if finding != "" && !slices.Contains(m.SecurityFindings, finding) {
+			continue
+		}
+
+		ap, exists := byBSSID[m.BSSID]
+		if !exists {
+			ap = &RogueAP{BSSID: m.BSSID, SSID: m.SSID, Strongest: m.Dbm, FirstSeen: m.Timestamp, LastSeen: m.Timestamp}
+			byBSSID[m.BSSID] = ap
+		}
+		// The latest scan tells how the AP is set up now.
+		if !m.Timestamp.Before(ap.LastSeen) {
+			ap.SSID, ap.Security, ap.PMF, ap.Channel, ap.LastSeen = m.SSID, m.Security, m.PMF, m.Channel, m.Timestamp
+		}
+		if m.Timestamp.Before(ap.FirstSeen) {
+			ap.FirstSeen = m.Timestamp
+		}
+		ap.Strongest = max(ap.Strongest, m.Dbm)
+		for _, f := range m.SecurityFindings {
+			if !slices.Contains(ap.Findings, f) {
+				ap.Findings = append(ap.Findings, f)
+			}
+		}
+		ap.Sightings = append(ap.Sightings, RogueSighting{
+			MeasurementID: m.ID, ScanID: m.ScanID, Floor: m.Floor, Lat: m.Lat, Lng: m.Lng,
+			Location: m.Location, Dbm: m.Dbm, Timestamp: m.Timestamp,
+		})
+	}
+	mutex.Unlock()
+
+	rogues := make([]RogueAP, 0, len(byBSSID))
+	for _, ap := range byBSSID {
+		sort.Strings(ap.Findings)
+		sort.SliceStable(ap.Sightings, func(i, j int) bool { return ap.Sightings[i].Dbm > ap.Sightings[j].Dbm })
+		rogues = append(rogues, *ap)
+	}
+	sort.Slice(rogues, func(i, j int) bool {
+		if rogues[i].Strongest != rogues[j].Strongest {
+			return rogues[i].Strongest > rogues[j].Strongest
+		}
+		return rogues[i].BSSID < rogues[j].BSSID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rogues)
+}
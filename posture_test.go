@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRoguesSkipsPendingScans checks that a rogue AP found in a scan held
+// for review is only reported once the scan is approved.
+func TestRoguesSkipsPendingScans(t *testing.T) {
+	dir := t.TempDir()
+	oldDir, oldReview, oldStore := *projectsDir, *reviewMeasurements, store
+	projectSettingsLock.Lock()
+	oldSettings := projectSettings
+	projectSettingsLock.Unlock()
+	mutex.Lock()
+	oldMeasurements := measurements
+	measurements = nil
+	mutex.Unlock()
+	t.Cleanup(func() {
+		*projectsDir, *reviewMeasurements, store = oldDir, oldReview, oldStore
+		projectSettingsLock.Lock()
+		projectSettings = oldSettings
+		projectSettingsLock.Unlock()
+		mutex.Lock()
+		measurements = oldMeasurements
+		mutex.Unlock()
+	})
+	*projectsDir = filepath.Join(dir, "projects")
+	if err := os.MkdirAll(projectDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	*reviewMeasurements = true
+	store = &memoryStore{measurements: make(map[string]Measurement)}
+	projectSettingsLock.Lock()
+	projectSettings.TrustedSSIDs = []string{"Office"}
+	projectSettings.KnownBSSIDs = []string{"00:11:22"}
+	projectSettingsLock.Unlock()
+
+	records := []Measurement{
+		{ID: "known", Timestamp: time.Now(), Dbm: -50, Floor: 1, Type: "scan", SSID: "Office", BSSID: "00:11:22:33:44:55", Security: "WPA2", ScanID: "s"},
+		{ID: "rogue", Timestamp: time.Now(), Dbm: -60, Floor: 1, Type: "scan", SSID: "Office", BSSID: "66:77:88:99:aa:bb", Security: "WPA2", ScanID: "s"},
+	}
+	assessScanSecurity(records)
+	if err := addMeasurements("test", records...); err != nil {
+		t.Fatal(err)
+	}
+
+	rogues := func() []RogueAP {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		roguesHandler(recorder, httptest.NewRequest("GET", "/api/analysis/rogues", nil))
+		if recorder.Code != 200 {
+			t.Fatalf("status %d: %s", recorder.Code, recorder.Body)
+		}
+		var result []RogueAP
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if got := rogues(); len(got) != 0 {
+		t.Fatalf("reported %+v from a pending scan", got)
+	}
+
+	mutex.Lock()
+	for i := range measurements {
+		measurements[i].Review = &Review{State: reviewApproved}
+	}
+	mutex.Unlock()
+	if got := rogues(); len(got) != 1 || got[0].BSSID != "66:77:88:99:aa:bb" {
+		t.Fatalf("reported %+v once approved, want the rogue AP", got)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const presetsFile = "presets.json"
+
+var (
+	presets     = make(map[string]Preset)
+	presetsLock sync.Mutex
+)
+
+// Preset is a named, reusable location on a floor that repeat measurements
+// can reference instead of retyping the location label.
+type Preset struct {
+	ID    string  `json:"id"`
+	Floor int     `json:"floor"`
+	Name  string  `json:"name"`
+	Lat   float64 `json:"lat"`
+	Lng   float64 `json:"lng"`
+}
+
+func loadPresets() error {
+	presetsLock.Lock()
+	defer presetsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(presetsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &presets)
+}
+
+func savePresets() error {
+	presetsLock.Lock()
+	defer presetsLock.Unlock()
+
+	data, err := json.MarshalIndent(presets, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(presetsFile), data, 0644)
+}
+
+func getPreset(id string) (Preset, bool) {
+	presetsLock.Lock()
+	defer presetsLock.Unlock()
+
+	preset, exists := presets[id]
+	return preset, exists
+}
+
+func decodePreset(w http.ResponseWriter, r *http.Request) (Preset, bool) {
+	var preset Preset
+	if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return preset, false
+	}
+
+	var err error
+	if preset.Name, err = cleanText("name", preset.Name, maxLocationLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return preset, false
+	}
+	if preset.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return preset, false
+	}
+
+	mutex.Lock()
+	_, floorExists := floors[preset.Floor]
+	mutex.Unlock()
+
+	if !floorExists {
+		http.Error(w, "floor not found", http.StatusBadRequest)
+		return preset, false
+	}
+
+	return preset, true
+}
+
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		floor, err := strconv.Atoi(r.URL.Query().Get("floor"))
+		if err != nil {
+			floor = 0
+		}
+
+		presetsLock.Lock()
+		list := []Preset{}
+		for _, preset := range presets {
+			if floor <= 0 || preset.Floor == floor {
+				list = append(list, preset)
+			}
+		}
+		presetsLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Floor != list[j].Floor {
+				return list[i].Floor < list[j].Floor
+			}
+			return list[i].Name < list[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		preset, ok := decodePreset(w, r)
+		if !ok {
+			return
+		}
+		preset.ID = generateID()
+
+		presetsLock.Lock()
+		presets[preset.ID] = preset
+		presetsLock.Unlock()
+
+		if err := savePresets(); err != nil {
+			http.Error(w, "failed to save presets", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(preset)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func presetHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	preset, exists := getPreset(id)
+	if !exists {
+		http.Error(w, "preset not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		updated, ok := decodePreset(w, r)
+		if !ok {
+			return
+		}
+		updated.ID = id
+		preset = updated
+
+		presetsLock.Lock()
+		presets[id] = preset
+		presetsLock.Unlock()
+
+		if err := savePresets(); err != nil {
+			http.Error(w, "failed to save presets", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		presetsLock.Lock()
+		delete(presets, id)
+		presetsLock.Unlock()
+
+		if err := savePresets(); err != nil {
+			http.Error(w, "failed to save presets", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preset)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	projectsDir = flag.String("data-dir", envOrDefault("HEATGEN_DATA_DIR", "data"), "directory holding one data directory per project (env HEATGEN_DATA_DIR)")
+	uploadsDir  = flag.String("uploads-dir", envOrDefault("HEATGEN_UPLOADS_DIR", "uploads"), "directory holding one directory of floor maps per project (env HEATGEN_UPLOADS_DIR)")
+	project     = flag.String("project", envOrDefault("HEATGEN_PROJECT", "default"), "project whose data the server works on (env HEATGEN_PROJECT)")
+)
+
+var projectRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// projectDataFiles are the files and directories of a project. Server-wide
+// state (profiles, thresholds, tasks and usage) stays in the working
+// directory.
+var projectDataFiles = []string{
+	measurementsFile, floorsFile, buildingsFile, zonesFile, sessionsFile,
+	snapshotsFile, obstaclesFile, pathLossFile, presetsFile, dfsEventsFile,
+	federationFile, aggregatesFile, baselinesFile, sharesFile, alertsFile,
+	apsFile,
+	attachmentsDir,
+}
+
+func validateProject() error {
+	if !projectRe.MatchString(*project) {
+		return fmt.Errorf("project %q must be 1-64 letters, digits, dashes or underscores", *project)
+	}
+	return nil
+}
+
+// projectDir is data/{project}, the directory of the project's data files.
+func projectDir() string {
+	return filepath.Join(*projectsDir, *project)
+}
+
+// projectFile returns the path of a data file of the project. Absolute
+// paths, such as an explicit -db, are kept.
+func projectFile(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(projectDir(), name)
+}
+
+// projectUploads is uploads/{project}, where the project's floor maps are
+// stored.
+func projectUploads() string {
+	return filepath.Join(*uploadsDir, *project)
+}
+
+// uploadURL is the path a floor map stored in projectUploads is served
+// under.
+func uploadURL(name string) string {
+	return "/uploads/" + *project + "/" + name
+}
+
+// uploadFile resolves the map path of a floor, as served under /uploads/,
+// to the file in the uploads directory.
+func uploadFile(mapPath string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(mapPath, *baseURL), "/uploads/")
+	return filepath.Join(*uploadsDir, filepath.FromSlash(rest))
+}
+
+// migrateFlatLayout moves the data of a server that predates projects into
+// the project directory: the data files and the database from the working
+// directory to data/{project}, and the maps from uploads to
+// uploads/{project}. It only runs while the project directory does not
+// exist, so an existing project is never touched. Everything is copied
+// first, the data files into a staging directory that becomes the project
+// directory in one rename, and the originals are only removed after that,
+// so a failure leaves the flat layout to migrate again on the next start
+// rather than half of it moved. Copying also works where the project
+// directory is on another file system, such as a bind mount.
+func migrateFlatLayout() error {
+	dir := projectDir()
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var legacy []string
+	for _, name := range projectDataFiles {
+		if _, err := os.Stat(name); err == nil {
+			legacy = append(legacy, name)
+		}
+	}
+	if !filepath.IsAbs(*databaseFile) {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if _, err := os.Stat(*databaseFile + suffix); err == nil {
+				legacy = append(legacy, *databaseFile+suffix)
+			}
+		}
+	}
+
+	var maps []string
+	entries, err := os.ReadDir(*uploadsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			maps = append(maps, entry.Name())
+		}
+	}
+
+	if len(legacy) == 0 && len(maps) == 0 {
+		return os.MkdirAll(dir, 0755)
+	}
+
+	log.Printf("Moving data into project %q", *project)
+	if len(maps) > 0 {
+		if err := os.MkdirAll(projectUploads(), 0755); err != nil {
+			return err
+		}
+	}
+	for _, name := range maps {
+		if err := copyPath(filepath.Join(*uploadsDir, name), filepath.Join(projectUploads(), name)); err != nil {
+			return fmt.Errorf("failed to copy map %s: %v", name, err)
+		}
+	}
+
+	staging := dir + ".migrating"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		if err := copyPath(name, filepath.Join(staging, name)); err != nil {
+			os.RemoveAll(staging)
+			return fmt.Errorf("failed to copy %s: %v", name, err)
+		}
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	for _, name := range legacy {
+		if err := os.RemoveAll(name); err != nil {
+			log.Printf("failed to remove %s after moving it into the project: %v", name, err)
+		}
+	}
+	for _, name := range maps {
+		if err := os.Remove(filepath.Join(*uploadsDir, name)); err != nil {
+			log.Printf("failed to remove map %s after moving it into the project: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// copyPath copies a file, or a directory with everything in it, to dst.
+func copyPath(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.CopyFS(dst, os.DirFS(src))
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// migrateMapPaths points floors whose map path still names a file directly
+// under /uploads/ at the map's place in the project's uploads directory.
+// Floors are stored as whole records, so this cannot happen while the
+// files are moved and runs after loadData.
+func migrateMapPaths() error {
+	mutex.Lock()
+	var moved []Floor
+	for id, floor := range floors {
+		name := strings.TrimPrefix(strings.TrimPrefix(floor.MapPath, *baseURL), "/uploads/")
+		if floor.MapPath == "" || strings.Contains(name, "/") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(projectUploads(), name)); err != nil {
+			continue
+		}
+		floor.MapPath = strings.TrimSuffix(floor.MapPath, "/uploads/"+name) + uploadURL(name)
+		floors[id] = floor
+		moved = append(moved, floor)
+	}
+	mutex.Unlock()
+
+	for _, floor := range moved {
+		if err := store.SaveFloor(floor); err != nil {
+			return fmt.Errorf("failed to save floor %d: %v", floor.ID, err)
+		}
+	}
+	return nil
+}
+
+const projectSettingsFile = "project.json"
+
+// ProjectSettings are the options of the project the server works on.
+type ProjectSettings struct {
+	// Name is the -project flag and ignored on input.
+	Name string `json:"name"`
+	// CRS is the reference system of projected coordinates in imports and
+	// calibrations that name none, as an EPSG code.
+	CRS string `json:"crs,omitempty"`
+	// TrustedSSIDs are the networks of the organisation. Scanned APs
+	// broadcasting one of them from a BSSID that is neither in KnownBSSIDs
+	// nor polled from an access point are flagged as rogue.
+	TrustedSSIDs []string `json:"trustedSsids,omitempty"`
+	// KnownBSSIDs are BSSIDs or BSSID prefixes, like "00:11:22:33:44", of
+	// the organisation's APs.
+	KnownBSSIDs []string `json:"knownBssids,omitempty"`
+}
+
+var (
+	projectSettings     ProjectSettings
+	projectSettingsLock sync.Mutex
+)
+
+func loadProjectSettings() error {
+	projectSettingsLock.Lock()
+	defer projectSettingsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(projectSettingsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &projectSettings)
+}
+
+func saveProjectSettings() error {
+	projectSettingsLock.Lock()
+	defer projectSettingsLock.Unlock()
+
+	data, err := json.MarshalIndent(projectSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(projectSettingsFile), data, 0644)
+}
+
+// projectCRS looks up the given reference system, or the project's when
+// code is empty.
+func projectCRS(code string) (CRS, error) {
+	if code == "" {
+		projectSettingsLock.Lock()
+		code = projectSettings.CRS
+		projectSettingsLock.Unlock()
+	}
+	if code == "" {
+		return CRS{}, fmt.Errorf("no crs given and the project has none set")
+	}
+	return lookupCRS(code)
+}
+
+// projectHandler reads (GET) or replaces (PUT) the project settings.
+func projectHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var settings ProjectSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if settings.CRS != "" {
+			crs, err := lookupCRS(settings.CRS)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			settings.CRS = crs.Code
+		}
+		for i, prefix := range settings.KnownBSSIDs {
+			if !bssidPrefixPattern.MatchString(prefix) {
+				http.Error(w, fmt.Sprintf("invalid BSSID prefix %q", prefix), http.StatusBadRequest)
+				return
+			}
+			settings.KnownBSSIDs[i] = strings.ToLower(prefix)
+		}
+
+		projectSettingsLock.Lock()
+		projectSettings = settings
+		projectSettingsLock.Unlock()
+
+		if err := saveProjectSettings(); err != nil {
+			http.Error(w, "failed to save project settings", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	projectSettingsLock.Lock()
+	settings := projectSettings
+	projectSettingsLock.Unlock()
+	settings.Name = *project
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// prometheusMetric is the only metric ingested; others are skipped.
+	prometheusMetric  = "wifi_signal_dbm"
+	maxPrometheusBody = 10 << 20
+	// maxIngestErrors caps the errors reported back to the client.
+	maxIngestErrors = 10
+)
+
+// promSeries is one time series of a remote-write request or a text
+// exposition.
+type promSeries struct {
+	Labels  map[string]string
+	Samples []promSample
+}
+
+type promSample struct {
+	Value float64
+	// Timestamp is in milliseconds since the epoch, zero when unknown.
+	Timestamp int64
+}
+
+type PrometheusIngestResult struct {
+	Accepted int      `json:"accepted"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// parseWriteRequest decodes the time series of a Prometheus remote-write
+// WriteRequest. Metadata, exemplars and histograms are ignored.
+func parseWriteRequest(data []byte) ([]promSeries, error) {
+	var series []promSeries
+	err := consumeMessage(data, func(num protowire.Number, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		s, err := parseTimeSeries(value)
+		if err != nil {
+			return err
+		}
+		series = append(series, s)
+		return nil
+	})
+	return series, err
+}
+
+func parseTimeSeries(data []byte) (promSeries, error) {
+	s := promSeries{Labels: make(map[string]string)}
+	err := consumeMessage(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			var name, labelValue string
+			err := consumeMessage(value, func(num protowire.Number, value []byte) error {
+				switch num {
+				case 1:
+					name = string(value)
+				case 2:
+					labelValue = string(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.Labels[name] = labelValue
+		case 2:
+			var sample promSample
+			for len(value) > 0 {
+				num, typ, n := protowire.ConsumeTag(value)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				value = value[n:]
+
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, n := protowire.ConsumeFixed64(value)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					sample.Value = math.Float64frombits(bits)
+					value = value[n:]
+				case num == 2 && typ == protowire.VarintType:
+					v, n := protowire.ConsumeVarint(value)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					sample.Timestamp = int64(v)
+					value = value[n:]
+				default:
+					n := protowire.ConsumeFieldValue(num, typ, value)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					value = value[n:]
+				}
+			}
+			s.Samples = append(s.Samples, sample)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// consumeMessage calls fn with every length-delimited field of a protobuf
+// message and skips fields of other wire types.
+func consumeMessage(data []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseExposition reads samples in the Prometheus text exposition format, as
+// pushed to a Pushgateway:
+//
+//	wifi_signal_dbm{floor="2",lat="512",lng="300"} -61 1760000000000
+func parseExposition(r io.Reader) ([]promSeries, error) {
+	var series []promSeries
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		s, err := parseExpositionLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		series = append(series, s)
+	}
+	return series, scanner.Err()
+}
+
+func parseExpositionLine(line string) (promSeries, error) {
+	s := promSeries{Labels: make(map[string]string)}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return s, fmt.Errorf("missing value")
+	}
+	s.Labels["__name__"] = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " \t,")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+
+			name, after, found := strings.Cut(rest, "=")
+			if !found || !strings.HasPrefix(after, `"`) {
+				return s, fmt.Errorf("malformed labels")
+			}
+
+			var value strings.Builder
+			i := 1
+			for ; i < len(after) && after[i] != '"'; i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+					if after[i] == 'n' {
+						value.WriteByte('\n')
+						continue
+					}
+				}
+				value.WriteByte(after[i])
+			}
+			if i == len(after) {
+				return s, fmt.Errorf("unterminated label value")
+			}
+
+			s.Labels[strings.TrimSpace(name)] = value.String()
+			rest = after[i+1:]
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("expected a value and an optional timestamp")
+	}
+
+	var sample promSample
+	var err error
+	if sample.Value, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return s, fmt.Errorf("invalid value %q", fields[0])
+	}
+	if len(fields) == 2 {
+		if sample.Timestamp, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return s, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+	}
+	s.Samples = []promSample{sample}
+
+	return s, nil
+}
+
+// seriesMeasurements turns the samples of a wifi_signal_dbm series into
+// measurements. The floor, lat and lng labels place them; location, ssid,
+// bssid, interface and session are copied when present.
+func seriesMeasurements(s promSeries) ([]Measurement, error) {
+	labels := s.Labels
+
+	floorID, err := strconv.Atoi(labels["floor"])
+	if err != nil {
+		return nil, fmt.Errorf("series needs a numeric floor label")
+	}
+	lat, err := strconv.ParseFloat(labels["lat"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("series needs a numeric lat label")
+	}
+	lng, err := strconv.ParseFloat(labels["lng"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("series needs a numeric lng label")
+	}
+
+	mutex.Lock()
+	_, exists := floors[floorID]
+	mutex.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("floor %d not found", floorID)
+	}
+
+	if session := labels["session"]; session != "" {
+		if _, exists := getSession(session); !exists {
+			return nil, fmt.Errorf("session %q not found", session)
+		}
+	}
+	location, err := cleanText("location", labels["location"], maxLocationLength, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Measurement
+	for _, sample := range s.Samples {
+		if math.IsNaN(sample.Value) || sample.Value > 0 || sample.Value < -120 {
+			return nil, fmt.Errorf("signal %v dBm is out of range", sample.Value)
+		}
+
+		timestamp := time.Now()
+		if sample.Timestamp != 0 {
+			timestamp = time.UnixMilli(sample.Timestamp)
+		}
+
+		records = append(records, Measurement{
+			ID:        newMeasurementID(),
+			Timestamp: timestamp,
+			Dbm:       int(math.Round(sample.Value)),
+			Lat:       lat,
+			Lng:       lng,
+			Floor:     floorID,
+			Location:  location,
+			Type:      "prometheus",
+			Class:     classMonitoring,
+			SessionID: labels["session"],
+			Interface: labels["interface"],
+			SSID:      labels["ssid"],
+			BSSID:     strings.ToLower(labels["bssid"]),
+		})
+	}
+
+	return records, nil
+}
+
+// prometheusKey identifies an ingested sample so that samples resent by a
+// retrying remote-write client are stored once.
+func prometheusKey(m Measurement) string {
+	return fmt.Sprintf("%d/%g/%g/%s/%s/%d", m.Floor, m.Lat, m.Lng, m.Interface, m.BSSID, m.Timestamp.UnixMilli())
+}
+
+// prometheusIngestHandler accepts wifi_signal_dbm samples either as a
+// snappy-compressed Prometheus remote-write request or in the text
+// exposition format. Invalid series are skipped and reported.
+func prometheusIngestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPrometheusBody))
+	if err != nil {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var series []promSeries
+	if r.Header.Get("Content-Encoding") == "snappy" || strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf") {
+		if size, err := snappy.DecodedLen(body); err != nil || size > maxPrometheusBody {
+			http.Error(w, "invalid snappy payload", http.StatusBadRequest)
+			return
+		}
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, "invalid snappy payload", http.StatusBadRequest)
+			return
+		}
+		if series, err = parseWriteRequest(data); err != nil {
+			http.Error(w, "invalid remote-write request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if series, err = parseExposition(bytes.NewReader(body)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := make(map[string]bool)
+	mutex.Lock()
+	for _, m := range measurements {
+		if m.Type == "prometheus" {
+			seen[prometheusKey(m)] = true
+		}
+	}
+	mutex.Unlock()
+
+	var result PrometheusIngestResult
+	var records []Measurement
+	for _, s := range series {
+		if s.Labels["__name__"] != prometheusMetric {
+			result.Skipped += len(s.Samples)
+			continue
+		}
+
+		converted, err := seriesMeasurements(s)
+		if err != nil {
+			result.Skipped += len(s.Samples)
+			if len(result.Errors) < maxIngestErrors {
+				result.Errors = append(result.Errors, err.Error())
+			}
+			continue
+		}
+		for _, m := range converted {
+			key := prometheusKey(m)
+			if seen[key] {
+				result.Skipped++
+				continue
+			}
+			seen[key] = true
+			records = append(records, m)
+		}
+	}
+
+	if len(records) > 0 {
+		if err := addMeasurements(auditActor(r), records...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	result.Accepted = len(records)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
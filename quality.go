@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// anomalyDeviationDb is how far a reading must be from the usual signal
+	// at its spot to be flagged.
+	anomalyDeviationDb = 15
+	// anomalyBaselineDays is the history the usual signal is taken from,
+	// and anomalyMinBaseline the readings it needs.
+	anomalyBaselineDays = 7
+	anomalyMinBaseline  = 3
+)
+
+var (
+	qualityWebhooks   = flag.String("quality-webhook", envOrDefault("HEATGEN_QUALITY_WEBHOOK", ""), "comma-separated URLs the daily data quality report is posted to as JSON, e.g. Slack or Mattermost incoming webhooks (env HEATGEN_QUALITY_WEBHOOK)")
+	qualityReportHour = flag.Int("quality-report-hour", 7, "local hour at which the report of the previous day is posted")
+	staleAfter        = flag.Duration("stale-after", 7*24*time.Hour, "age of the newest measurement after which a floor is reported as stale")
+
+	qualityClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// QualityReport summarizes the data collected during one day, so
+// continuous deployments notice broken probes and abandoned floors early.
+type QualityReport struct {
+	Date            string           `json:"date"`
+	NewMeasurements int              `json:"newMeasurements"`
+	Floors          map[int]int      `json:"floors"`
+	Probes          []ProbeQuality   `json:"probes"`
+	Anomalies       []QualityAnomaly `json:"anomalies"`
+	StaleFloors     []StaleFloor     `json:"staleFloors"`
+	// Text is a plain summary, which chat webhooks show as the message.
+	Text string `json:"text"`
+}
+
+// ProbeQuality counts the samples of one probe, a wireless interface of a
+// site. Failed samples are those where no signal could be read.
+type ProbeQuality struct {
+	Site         string  `json:"site,omitempty"`
+	Interface    string  `json:"interface"`
+	Measurements int     `json:"measurements"`
+	Failed       int     `json:"failed"`
+	FailedRate   float64 `json:"failedRate"`
+}
+
+// QualityAnomaly is a reading far off the usual signal at its spot.
+type QualityAnomaly struct {
+	MeasurementID string    `json:"measurementId"`
+	Timestamp     time.Time `json:"timestamp"`
+	Floor         int       `json:"floor"`
+	Location      string    `json:"location,omitempty"`
+	Dbm           int       `json:"dbm"`
+	UsualDbm      int       `json:"usualDbm"`
+}
+
+// StaleFloor is a floor without recent measurements. LastMeasurement is
+// nil for floors that were never measured.
+type StaleFloor struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	LastMeasurement *time.Time `json:"lastMeasurement,omitempty"`
+}
+
+// anomalySpot identifies where a reading was taken: its preset, or its
+// position rounded to the pixel.
+func anomalySpot(m Measurement) string {
+	if m.PresetID != "" {
+		return "preset:" + m.PresetID
+	}
+	return fmt.Sprintf("%d:%.0f:%.0f", m.Floor, m.Lat, m.Lng)
+}
+
+// buildQualityReport reports on the day starting at from, in local time.
+func buildQualityReport(from time.Time) QualityReport {
+	to := from.AddDate(0, 0, 1)
+	baselineFrom := from.AddDate(0, 0, -anomalyBaselineDays)
+
+	mutex.Lock()
+	ms := append([]Measurement(nil), measurements...)
+	floorList := make([]Floor, 0, len(floors))
+	for _, floor := range floors {
+		floorList = append(floorList, floor)
+	}
+	mutex.Unlock()
+
+	report := QualityReport{
+		Date:        from.Format("2006-01-02"),
+		Floors:      make(map[int]int),
+		Probes:      []ProbeQuality{},
+		Anomalies:   []QualityAnomaly{},
+		StaleFloors: []StaleFloor{},
+	}
+
+	probes := make(map[[2]string]*ProbeQuality)
+	baselines := make(map[string][]int)
+	latest := make(map[int]time.Time)
+	var day []Measurement
+	for _, m := range ms {
+		if m.Timestamp.Before(to) && m.Timestamp.After(latest[m.Floor]) {
+			latest[m.Floor] = m.Timestamp
+		}
+
+		comparable := baselineReading(m)
+		if comparable && !m.Timestamp.Before(baselineFrom) && m.Timestamp.Before(from) {
+			baselines[anomalySpot(m)] = append(baselines[anomalySpot(m)], m.Dbm)
+		}
+
+		if m.Timestamp.Before(from) || !m.Timestamp.Before(to) {
+			continue
+		}
+		report.NewMeasurements++
+		report.Floors[m.Floor]++
+
+		key := [2]string{measurementSite(m.ID), m.Interface}
+		probe, exists := probes[key]
+		if !exists {
+			probe = &ProbeQuality{Site: key[0], Interface: key[1]}
+			probes[key] = probe
+		}
+		probe.Measurements++
+		if m.Dbm == failedSampleDbm {
+			probe.Failed++
+		}
+
+		if comparable {
+			day = append(day, m)
+		}
+	}
+
+	for _, probe := range probes {
+		probe.FailedRate = math.Round(1000*float64(probe.Failed)/float64(probe.Measurements)) / 10
+		report.Probes = append(report.Probes, *probe)
+	}
+	sort.Slice(report.Probes, func(i, j int) bool {
+		a, b := report.Probes[i], report.Probes[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		return a.Interface < b.Interface
+	})
+
+	// Where the history of a spot has been pruned, readings at a named
+	// location fall back to its last weekly baseline.
+	var weekly map[baselineKey]WeeklyBaseline
+	lastWeek := weekStart(from).AddDate(0, 0, -7).Format(time.DateOnly)
+	for _, m := range day {
+		var usual int
+		if baseline := baselines[anomalySpot(m)]; len(baseline) >= anomalyMinBaseline {
+			usual = calculateMedian(baseline)
+		} else if m.Location != "" {
+			if weekly == nil {
+				weekly = make(map[baselineKey]WeeklyBaseline)
+				for _, b := range weeklyBaselines(func(_ int, location, _ string) bool { return location != "" }) {
+					if b.Week <= lastWeek && b.Readings >= anomalyMinBaseline {
+						weekly[baselineKey{floor: b.Floor, location: b.Location}] = b
+					}
+				}
+			}
+			b, found := weekly[baselineKey{floor: m.Floor, location: m.Location}]
+			if !found {
+				continue
+			}
+			usual = b.MedianDbm
+		} else {
+			continue
+		}
+		if abs(m.Dbm-usual) >= anomalyDeviationDb {
+			report.Anomalies = append(report.Anomalies, QualityAnomaly{
+				MeasurementID: m.ID,
+				Timestamp:     m.Timestamp,
+				Floor:         m.Floor,
+				Location:      m.Location,
+				Dbm:           m.Dbm,
+				UsualDbm:      usual,
+			})
+		}
+	}
+	sort.Slice(report.Anomalies, func(i, j int) bool {
+		return report.Anomalies[i].Timestamp.Before(report.Anomalies[j].Timestamp)
+	})
+
+	sort.Slice(floorList, func(i, j int) bool { return floorList[i].ID < floorList[j].ID })
+	for _, floor := range floorList {
+		last, measured := latest[floor.ID]
+		if measured && to.Sub(last) <= *staleAfter {
+			continue
+		}
+		stale := StaleFloor{ID: floor.ID, Name: floor.Name}
+		if measured {
+			stale.LastMeasurement = &last
+		}
+		report.StaleFloors = append(report.StaleFloors, stale)
+	}
+
+	report.Text = report.summary()
+	return report
+}
+
+// summary writes the report as a few lines of text.
+func (q QualityReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HeatGen data quality for %s: %d new measurements", q.Date, q.NewMeasurements)
+	if *siteID != "" {
+		fmt.Fprintf(&b, " at site %s", *siteID)
+	}
+	b.WriteString("\n")
+
+	for _, probe := range q.Probes {
+		if probe.Failed == 0 {
+			continue
+		}
+		name := probe.Interface
+		if probe.Site != "" {
+			name = probe.Site + "/" + name
+		}
+		fmt.Fprintf(&b, "- probe %s: %d of %d samples failed (%g%%)\n", name, probe.Failed, probe.Measurements, probe.FailedRate)
+	}
+	if len(q.Anomalies) > 0 {
+		fmt.Fprintf(&b, "- %d readings %d dB or more off the usual signal at their spot\n", len(q.Anomalies), anomalyDeviationDb)
+	}
+	for _, floor := range q.StaleFloors {
+		if floor.LastMeasurement == nil {
+			fmt.Fprintf(&b, "- floor %q has never been measured\n", floor.Name)
+		} else {
+			fmt.Fprintf(&b, "- floor %q was last measured %s\n", floor.Name, floor.LastMeasurement.Format("2006-01-02"))
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// postQualityReport sends the report to every configured webhook.
+func postQualityReport(report QualityReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("failed to encode the data quality report: %v", err)
+		return
+	}
+
+	for _, url := range strings.Split(*qualityWebhooks, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		resp, err := qualityClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("failed to post the data quality report to %s: %v", url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("failed to post the data quality report to %s: %s", url, resp.Status)
+		}
+	}
+}
+
+// startQualityReports posts the report of the previous day to the
+// -quality-webhook URLs every day at -quality-report-hour.
+func startQualityReports() {
+	if *qualityWebhooks == "" {
+		return
+	}
+	if *qualityReportHour < 0 || *qualityReportHour > 23 {
+		log.Fatal("-quality-report-hour must be between 0 and 23")
+	}
+
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), *qualityReportHour, 0, 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(time.Until(next))
+
+			today := time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, next.Location())
+			postQualityReport(buildQualityReport(today.AddDate(0, 0, -1)))
+		}
+	}()
+}
+
+// qualityHandler returns the data quality report of ?date (YYYY-MM-DD,
+// local time), by default of yesterday.
+func qualityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).AddDate(0, 0, -1)
+	if value := r.URL.Query().Get("date"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		from = date
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildQualityReport(from))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	storageCheckInterval = flag.Duration("storage-check", 30*time.Second, "how often the data and uploads directories are checked for being writable, 0 to only notice failed writes")
+	readOnlyQueue        = flag.Int("read-only-queue", 0, "number of measurement and floor changes held in memory while the storage is read-only, written once it is writable again; 0 rejects changes")
+)
+
+// The server switches into read-only mode when the data or uploads
+// directory cannot be written, because the disk is full or was remounted
+// read-only for example. Reads go on as before; changes are refused with a
+// 503, or with -read-only-queue, measurement and floor changes are held in
+// memory. The mode ends once a check finds the storage writable again.
+var (
+	// readOnlyReason is why the storage is not writable, "" while it is.
+	readOnlyReason string
+	readOnlySince  time.Time
+	// queuedMeasurements and queuedFloors hold the changes made in
+	// read-only mode by ID, nil for deletions.
+	queuedMeasurements = make(map[string]*Measurement)
+	queuedFloors       = make(map[int]*Floor)
+	readOnlyLock       sync.Mutex
+)
+
+// storageError reports whether err means the storage cannot be written,
+// as opposed to a failure of the data written.
+func storageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.EROFS, syscall.ENOSPC, syscall.EDQUOT, syscall.EACCES, syscall.EPERM, syscall.EIO} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var unavailable interface{ storageUnavailable() bool }
+	return errors.As(err, &unavailable) && unavailable.storageUnavailable()
+}
+
+// noteStorageError switches into read-only mode when a write failed for
+// the storage.
+func noteStorageError(err error) {
+	if storageError(err) {
+		enterReadOnly(err.Error())
+	}
+}
+
+func enterReadOnly(reason string) {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+
+	if readOnlyReason == "" {
+		readOnlySince = time.Now()
+		log.Printf("storage is not writable (%s), switching to read-only mode", reason)
+	}
+	readOnlyReason = reason
+}
+
+// readOnly returns why the server is in read-only mode, "" when it is not.
+func readOnly() string {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+	return readOnlyReason
+}
+
+// errReadOnly is returned for changes refused in read-only mode.
+type errReadOnly struct {
+	reason string
+}
+
+func (e errReadOnly) Error() string {
+	return "storage is read-only (" + e.reason + "), changes are not accepted until it is writable again"
+}
+
+// checkWritable returns errReadOnly when changes cannot be stored, not even
+// queued.
+func checkWritable() error {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+
+	if readOnlyReason == "" || len(queuedMeasurements)+len(queuedFloors) < *readOnlyQueue {
+		return nil
+	}
+	return errReadOnly{readOnlyReason}
+}
+
+// probeStorage writes and removes a small file in the data and uploads
+// directories.
+func probeStorage() error {
+	for _, dir := range []string{projectDir(), projectUploads()} {
+		file, err := os.CreateTemp(dir, ".heatgen-probe-*")
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(make([]byte, 4096))
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		os.Remove(file.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStorage probes the storage, entering read-only mode when it is not
+// writable and leaving it, with the queued changes written, when it is
+// again.
+func checkStorage() {
+	if err := probeStorage(); err != nil {
+		enterReadOnly(err.Error())
+		return
+	}
+	if readOnly() == "" {
+		return
+	}
+
+	readOnlyLock.Lock()
+	since := readOnlySince
+	queued := len(queuedFloors) + len(queuedMeasurements)
+	readOnlyLock.Unlock()
+	if queued > 0 {
+		log.Printf("writing %d changes queued in read-only mode", queued)
+	}
+
+	// The queue is written while still in read-only mode, so that changes
+	// made meanwhile are queued behind it rather than overwritten by it.
+	// The mode ends once the queue is empty.
+	for {
+		readOnlyLock.Lock()
+		floorChanges, measurementChanges := queuedFloors, queuedMeasurements
+		if len(floorChanges)+len(measurementChanges) == 0 {
+			readOnlyReason = ""
+			readOnlyLock.Unlock()
+			break
+		}
+		queuedFloors, queuedMeasurements = make(map[int]*Floor), make(map[string]*Measurement)
+		readOnlyLock.Unlock()
+
+		if err := replayQueued(floorChanges, measurementChanges); err != nil {
+			enterReadOnly(err.Error())
+			return
+		}
+	}
+
+	log.Printf("storage is writable again after %s, leaving read-only mode", time.Since(since).Round(time.Second))
+	if err := store.Flush(); err != nil {
+		log.Printf("failed to write data files: %v", err)
+	}
+}
+
+// replayQueued writes changes taken from the queue, bypassing the queueing
+// of guardedStore. When the storage fails again, the changes are queued
+// again, unless a newer change of the same record was queued meanwhile,
+// and the storage error is returned.
+func replayQueued(floorChanges map[int]*Floor, measurementChanges map[string]*Measurement) error {
+	inner := store
+	if guarded, ok := store.(guardedStore); ok {
+		inner = guarded.Store
+	}
+
+	write := func() error {
+		for id, floor := range floorChanges {
+			var err error
+			if floor == nil {
+				err = inner.DeleteFloor(id)
+			} else {
+				err = inner.SaveFloor(*floor)
+			}
+			if storageError(err) {
+				return err
+			} else if err != nil {
+				log.Printf("failed to write queued floor %d: %v", id, err)
+			}
+		}
+		for id, m := range measurementChanges {
+			var err error
+			if m == nil {
+				err = inner.DeleteMeasurement(id)
+			} else {
+				err = inner.SaveMeasurement(*m)
+			}
+			if storageError(err) {
+				return err
+			} else if err != nil {
+				log.Printf("failed to write queued measurement %s: %v", id, err)
+			}
+		}
+		return nil
+	}
+	err := write()
+	if err == nil {
+		return nil
+	}
+
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+	for id, floor := range floorChanges {
+		if _, newer := queuedFloors[id]; !newer {
+			queuedFloors[id] = floor
+		}
+	}
+	for id, m := range measurementChanges {
+		if _, newer := queuedMeasurements[id]; !newer {
+			queuedMeasurements[id] = m
+		}
+	}
+	return err
+}
+
+// startStorageCheck checks the storage at startup and every
+// -storage-check.
+func startStorageCheck() {
+	checkStorage()
+	if *storageCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*storageCheckInterval) {
+			checkStorage()
+		}
+	}()
+}
+
+// guardedStore switches into read-only mode when the store fails for the
+// storage, and holds the changes made in that mode, up to -read-only-queue,
+// until checkStorage writes them.
+type guardedStore struct {
+	Store
+}
+
+// queue holds a change in read-only mode. It reports false when the server
+// is not in read-only mode, and returns errReadOnly when the queue is full.
+func (s guardedStore) queue(add func()) (bool, error) {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+
+	if readOnlyReason == "" {
+		return false, nil
+	}
+	if len(queuedMeasurements)+len(queuedFloors) >= *readOnlyQueue {
+		return true, errReadOnly{readOnlyReason}
+	}
+	add()
+	return true, nil
+}
+
+// write runs a store call, or queues the change in read-only mode,
+// including the mode the call itself entered.
+func (s guardedStore) write(call func() error, add func()) error {
+	if queued, err := s.queue(add); queued {
+		return err
+	}
+	err := call()
+	if !storageError(err) {
+		return err
+	}
+	noteStorageError(err)
+	if _, err := s.queue(add); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s guardedStore) SaveMeasurement(m Measurement) error {
+	return s.write(func() error { return s.Store.SaveMeasurement(m) }, func() {
+		// Changes to a queued measurement replace it without taking more
+		// room.
+		queuedMeasurements[m.ID] = &m
+	})
+}
+
+func (s guardedStore) DeleteMeasurement(id string) error {
+	return s.write(func() error { return s.Store.DeleteMeasurement(id) }, func() {
+		queuedMeasurements[id] = nil
+	})
+}
+
+func (s guardedStore) SaveFloor(floor Floor) error {
+	return s.write(func() error { return s.Store.SaveFloor(floor) }, func() {
+		queuedFloors[floor.ID] = &floor
+	})
+}
+
+func (s guardedStore) DeleteFloor(id int) error {
+	return s.write(func() error { return s.Store.DeleteFloor(id) }, func() {
+		queuedFloors[id] = nil
+	})
+}
+
+// Flush is skipped in read-only mode; the changes noted meanwhile are
+// written once the storage is writable again.
+func (s guardedStore) Flush() error {
+	if readOnly() != "" {
+		return nil
+	}
+	err := s.Store.Flush()
+	noteStorageError(err)
+	return err
+}
+
+func (s guardedStore) Close() error {
+	if readOnly() != "" {
+		checkStorage()
+	}
+	readOnlyLock.Lock()
+	lost := len(queuedMeasurements) + len(queuedFloors)
+	readOnlyLock.Unlock()
+
+	err := s.Store.Close()
+	if lost > 0 && err == nil {
+		err = fmt.Errorf("%d changes queued in read-only mode were lost: %s", lost, readOnly())
+	}
+	return err
+}
+
+// queueablePath reports whether a request only changes measurements, which
+// -read-only-queue can hold.
+func queueablePath(r *http.Request) bool {
+	p := r.URL.Path
+	switch {
+	case p == "/api/add", p == "/api/ingest/prometheus", p == "/api/review", strings.HasPrefix(p, "/api/delete/"):
+		return true
+	case strings.HasPrefix(p, "/api/measurements/"):
+		// Not the attachments below a measurement, which are files.
+		return !strings.Contains(strings.TrimPrefix(p, "/api/measurements/"), "/")
+	}
+	return false
+}
+
+// readOnlyMiddleware refuses changes in read-only mode with a 503 that says
+// why, rather than letting them fail halfway. Every response carries
+// X-Read-Only meanwhile, so clients can show the mode.
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := readOnly()
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Read-Only", "true")
+		if readRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if queueablePath(r) {
+			if err := checkWritable(); err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(max(*storageCheckInterval, time.Second).Seconds())))
+		http.Error(w, errReadOnly{reason}.Error(), http.StatusServiceUnavailable)
+	})
+}
+
+// storageCheck reports read-only mode for /readyz. It is not critical:
+// the data can still be read.
+func storageCheck() HealthCheck {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+
+	check := HealthCheck{Name: "writable storage", OK: readOnlyReason == ""}
+	if !check.OK {
+		check.Detail = fmt.Sprintf("read-only since %s: %s; %d changes queued", readOnlySince.Format(time.RFC3339), readOnlyReason, len(queuedMeasurements)+len(queuedFloors))
+		check.Hint = "free up space or make the data and uploads directories writable; the server leaves read-only mode by itself"
+	}
+	return check
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// memoryStore keeps measurements in memory and fails with EROFS while
+// readOnly is set. onSaveFloor runs for every saved floor.
+type memoryStore struct {
+	measurements map[string]Measurement
+	readOnly     bool
+	onSaveFloor  func()
+}
+
+func (s *memoryStore) LoadMeasurements() ([]Measurement, error) { return nil, nil }
+func (s *memoryStore) LoadFloors() (map[int]Floor, error)       { return nil, nil }
+func (s *memoryStore) DeleteFloor(id int) error                 { return nil }
+func (s *memoryStore) Flush() error                             { return nil }
+func (s *memoryStore) Close() error                             { return nil }
+
+func (s *memoryStore) SaveMeasurement(m Measurement) error {
+	if s.readOnly {
+		return syscall.EROFS
+	}
+	s.measurements[m.ID] = m
+	return nil
+}
+
+func (s *memoryStore) SaveFloor(floor Floor) error {
+	if s.onSaveFloor != nil {
+		s.onSaveFloor()
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteMeasurement(id string) error {
+	if s.readOnly {
+		return syscall.EROFS
+	}
+	delete(s.measurements, id)
+	return nil
+}
+
+// setupReadOnly puts the server into read-only mode with a queue, over a
+// memory store and writable project directories.
+func setupReadOnly(t *testing.T) *memoryStore {
+	dir := t.TempDir()
+	for _, set := range []struct {
+		flag  *string
+		value string
+	}{{projectsDir, filepath.Join(dir, "projects")}, {uploadsDir, filepath.Join(dir, "uploads")}} {
+		old := *set.flag
+		*set.flag = set.value
+		t.Cleanup(func() { *set.flag = old })
+	}
+	for _, d := range []string{projectDir(), projectUploads()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldQueue, oldStore := *readOnlyQueue, store
+	t.Cleanup(func() {
+		*readOnlyQueue, store = oldQueue, oldStore
+		readOnlyReason = ""
+		queuedMeasurements, queuedFloors = make(map[string]*Measurement), make(map[int]*Floor)
+	})
+	*readOnlyQueue = 10
+
+	inner := &memoryStore{measurements: make(map[string]Measurement)}
+	store = guardedStore{inner}
+	enterReadOnly("test")
+	return inner
+}
+
+func TestCheckStorageKeepsNewerChanges(t *testing.T) {
+	inner := setupReadOnly(t)
+	if err := store.SaveMeasurement(Measurement{ID: "a", Dbm: -70}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveFloor(Floor{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change made while the queue is written, here before the queued
+	// measurement is, must not be overwritten by the older queued one.
+	inner.onSaveFloor = func() {
+		if err := store.SaveMeasurement(Measurement{ID: "a", Dbm: -50}); err != nil {
+			t.Error(err)
+		}
+	}
+	checkStorage()
+
+	if reason := readOnly(); reason != "" {
+		t.Fatalf("still read-only: %s", reason)
+	}
+	if got := inner.measurements["a"].Dbm; got != -50 {
+		t.Errorf("stored %d dBm, want the newer -50", got)
+	}
+}
+
+func TestCheckStorageFailsAgain(t *testing.T) {
+	inner := setupReadOnly(t)
+	if err := store.SaveMeasurement(Measurement{ID: "a", Dbm: -70}); err != nil {
+		t.Fatal(err)
+	}
+
+	inner.readOnly = true
+	checkStorage()
+	if readOnly() == "" {
+		t.Fatal("left read-only mode although the queue could not be written")
+	}
+	if queued := queuedMeasurements["a"]; queued == nil || queued.Dbm != -70 {
+		t.Fatalf("queued %v, want the unwritten change", queued)
+	}
+
+	inner.readOnly = false
+	checkStorage()
+	if reason := readOnly(); reason != "" {
+		t.Fatalf("still read-only: %s", reason)
+	}
+	if got := inner.measurements["a"].Dbm; got != -70 {
+		t.Errorf("stored %d dBm, want -70", got)
+	}
+}
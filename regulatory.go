@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type RegRule struct {
+	StartFreq    int      `json:"startFreq"`
+	EndFreq      int      `json:"endFreq"`
+	MaxBandwidth int      `json:"maxBandwidth"`
+	MaxPowerDbm  float64  `json:"maxPowerDbm"`
+	DFS          bool     `json:"dfs"`
+	Flags        []string `json:"flags,omitempty"`
+}
+
+type RegChannel struct {
+	Channel     int     `json:"channel"`
+	Freq        int     `json:"freq"`
+	MaxPowerDbm float64 `json:"maxPowerDbm"`
+	MaxWidth    int     `json:"maxWidth"`
+	DFS         bool    `json:"dfs"`
+}
+
+type RegBand struct {
+	Band        string       `json:"band"`
+	MaxPowerDbm float64      `json:"maxPowerDbm"`
+	Channels    []RegChannel `json:"channels"`
+}
+
+type RegDomain struct {
+	Country   string    `json:"country"`
+	DFSRegion string    `json:"dfsRegion"`
+	Rules     []RegRule `json:"rules"`
+	Bands     []RegBand `json:"bands"`
+}
+
+var regRuleRe = regexp.MustCompile(`^\((\d+)\s*-\s*(\d+)\s*@\s*(\d+)\),\s*\(([^,]+),\s*([\d.]+)\)(.*)$`)
+
+func getRegDomain() (*RegDomain, error) {
+	output, err := exec.Command("iw", "reg", "get").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iw reg get: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return parseRegDomain(string(output))
+}
+
+// parseRegDomain reads the first country section of `iw reg get`, which is
+// the global domain unless a self-managed phy overrides it.
+func parseRegDomain(output string) (*RegDomain, error) {
+	var domain *RegDomain
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "country ") {
+			if domain != nil {
+				break
+			}
+			country, region, _ := strings.Cut(strings.TrimPrefix(line, "country "), ":")
+			domain = &RegDomain{Country: country, DFSRegion: strings.TrimSpace(region)}
+			continue
+		}
+
+		if domain == nil {
+			continue
+		}
+
+		match := regRuleRe.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		rule := RegRule{}
+		rule.StartFreq, _ = strconv.Atoi(match[1])
+		rule.EndFreq, _ = strconv.Atoi(match[2])
+		rule.MaxBandwidth, _ = strconv.Atoi(match[3])
+		rule.MaxPowerDbm, _ = strconv.ParseFloat(match[5], 64)
+		for _, field := range strings.Split(match[6], ",") {
+			field = strings.TrimSpace(field)
+			if field == "" || strings.HasPrefix(field, "(") {
+				continue
+			}
+			if field == "DFS" {
+				rule.DFS = true
+			}
+			rule.Flags = append(rule.Flags, field)
+		}
+		domain.Rules = append(domain.Rules, rule)
+	}
+
+	if domain == nil {
+		return nil, fmt.Errorf("no regulatory domain found")
+	}
+
+	for band, freqs := range bandChannels() {
+		regBand := RegBand{Band: band}
+		for _, freq := range freqs {
+			rule := domain.ruleFor(freq)
+			if rule == nil {
+				continue
+			}
+			regBand.Channels = append(regBand.Channels, RegChannel{
+				Channel:     frequencyToChannel(freq),
+				Freq:        freq,
+				MaxPowerDbm: rule.MaxPowerDbm,
+				MaxWidth:    domain.maxWidth(band, freq),
+				DFS:         rule.DFS,
+			})
+			if rule.MaxPowerDbm > regBand.MaxPowerDbm {
+				regBand.MaxPowerDbm = rule.MaxPowerDbm
+			}
+		}
+		if len(regBand.Channels) > 0 {
+			domain.Bands = append(domain.Bands, regBand)
+		}
+	}
+	sort.Slice(domain.Bands, func(i, j int) bool {
+		return domain.Bands[i].Channels[0].Freq < domain.Bands[j].Channels[0].Freq
+	})
+
+	return domain, nil
+}
+
+// ruleFor returns the rule permitting a 20 MHz channel centered on freq.
+func (d *RegDomain) ruleFor(freq int) *RegRule {
+	for i, rule := range d.Rules {
+		if freq-10 >= rule.StartFreq && freq+10 <= rule.EndFreq {
+			return &d.Rules[i]
+		}
+	}
+	return nil
+}
+
+// maxWidth returns the widest channel containing freq whose whole block is
+// permitted by a single rule.
+func (d *RegDomain) maxWidth(band string, freq int) int {
+	for _, width := range bandWidths(band) {
+		start, end := channelBlock(freq, width)
+		for _, rule := range d.Rules {
+			if start >= rule.StartFreq && end <= rule.EndFreq && width <= rule.MaxBandwidth {
+				return width
+			}
+		}
+	}
+	return 20
+}
+
+func regulatoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain, err := getRegDomain()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(domain)
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+// regDE is `iw reg get` of a German domain, with the lower 6 GHz band.
+const regDE = `global
+country DE: DFS-ETSI
+	(2400 - 2483 @ 40), (N/A, 20), (N/A)
+	(5150 - 5250 @ 80), (N/A, 23), (N/A), NO-OUTDOOR, AUTO-BW
+	(5250 - 5350 @ 80), (N/A, 20), (0 ms), NO-OUTDOOR, DFS, AUTO-BW
+	(5470 - 5725 @ 160), (N/A, 26), (0 ms), DFS
+	(5945 - 6425 @ 320), (N/A, 23), (N/A), NO-OUTDOOR
+`
+
+func TestRegDomainMaxWidth(t *testing.T) {
+	domain, err := parseRegDomain(regDE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		freq, width int
+	}{
+		{2437, 40},
+		{5180, 80},
+		{5500, 160},
+		{5955, 320},
+		{6255, 320},
+		{6275, 160},
+		{6415, 160},
+	}
+	for _, test := range tests {
+		if width := domain.maxWidth(bandForFrequency(test.freq), test.freq); width != test.width {
+			t.Errorf("%d MHz: widest channel %d MHz, want %d", test.freq, width, test.width)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// renderSummary is written to summary.json next to the rendered images.
+type renderSummary struct {
+	Revision string              `json:"revision"`
+	Params   map[string]string   `json:"params"`
+	Floors   []renderFloorResult `json:"floors"`
+}
+
+type renderFloorResult struct {
+	ID           int         `json:"id"`
+	Name         string      `json:"name"`
+	Measurements int         `json:"measurements"`
+	Heatmap      string      `json:"heatmap"`
+	Report       string      `json:"report,omitempty"`
+	Zones        []ZoneStats `json:"zones,omitempty"`
+}
+
+// runRender implements the `render` command: it loads a data directory or
+// archive and writes a heatmap per floor to the output directory without
+// starting the server.
+func runRender(args []string) error {
+	fs := flag.NewFlagSet("render", flag.ExitOnError)
+	data := fs.String("data", ".", "data directory, or a .zip/.tar.gz archive of one")
+	projectName := fs.String("project", "default", "project to render from a data directory with projects")
+	out := fs.String("out", "heatmaps", "output directory")
+	floorList := fs.String("floors", "", "comma-separated floor IDs to render (default all)")
+	report := fs.Bool("report", true, "also write the marker report image of each floor")
+	thresholdName := fs.String("threshold", "", "threshold profile or dBm value for pass/fail coloring of the report")
+
+	params := make(map[string]*string)
+	for _, name := range []string{"opacity", "scale", "grid", "power", "min", "max", "accuracy", "method", "ssid", "bssid", "band", "mask", "maskStyle", "session", "metric", "legend", "weights"} {
+		params[name] = fs.String(name, "", "heatmap "+name+" (as the /api/heatmap query parameter)")
+	}
+	fs.Parse(args)
+
+	query := url.Values{}
+	for name, value := range params {
+		if *value != "" {
+			query.Set(name, *value)
+		}
+	}
+	heatmapParams, err := parseHeatmapParams(query)
+	if err != nil {
+		return err
+	}
+	scoreWeights, err := scoreWeightsParam(query)
+	if err != nil {
+		return err
+	}
+
+	outDir, err := filepath.Abs(*out)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+
+	dataDir := *data
+	if isArchive(dataDir) {
+		tmp, err := os.MkdirTemp("", "heatgen-render-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		if err := extractArchive(dataDir, tmp); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", dataDir, err)
+		}
+		dataDir = findDataRoot(tmp)
+	}
+
+	// Floor map paths and data files are relative to the data directory.
+	// Directories from before projects keep their data files at the top.
+	if err := os.Chdir(dataDir); err != nil {
+		return err
+	}
+	*project = *projectName
+	if _, err := os.Stat(projectDir()); err != nil {
+		*projectsDir, *project = ".", ""
+	}
+
+	if err := loadData(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var threshold *ThresholdProfile
+	if *thresholdName != "" {
+		profile, err := thresholdParam(url.Values{"threshold": {*thresholdName}})
+		if err != nil {
+			return err
+		}
+		threshold = &profile
+	}
+
+	selected := make(map[int]bool)
+	for _, field := range strings.Split(*floorList, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return fmt.Errorf("invalid floor ID %q", field)
+		}
+		selected[id] = true
+	}
+
+	mutex.Lock()
+	summary := renderSummary{Revision: dataRevision, Params: make(map[string]string)}
+	var ids []int
+	for id := range floors {
+		if len(selected) == 0 || selected[id] {
+			ids = append(ids, id)
+		}
+	}
+	mutex.Unlock()
+	sort.Ints(ids)
+
+	for name := range query {
+		summary.Params[name] = query.Get(name)
+	}
+
+	for _, id := range ids {
+		mutex.Lock()
+		floor := floors[id]
+		var filtered []Measurement
+		for _, m := range measurements {
+			if m.Floor == id {
+				filtered = append(filtered, m)
+			}
+		}
+		mutex.Unlock()
+
+		result := renderFloorResult{ID: id, Name: floor.Name, Measurements: len(filtered)}
+
+		img, err := renderHeatmap(context.Background(), floor, filtered, heatmapParams)
+		if err != nil {
+			return fmt.Errorf("floor %d: %v", id, err)
+		}
+		result.Heatmap = fmt.Sprintf("floor_%d_heatmap.png", id)
+		if err := writePNG(filepath.Join(outDir, result.Heatmap), img); err != nil {
+			return err
+		}
+
+		if *report {
+			img, err := renderReport(floor, filtered, threshold)
+			if err != nil {
+				return fmt.Errorf("floor %d: %v", id, err)
+			}
+			result.Report = fmt.Sprintf("floor_%d_report.png", id)
+			if err := writePNG(filepath.Join(outDir, result.Report), img); err != nil {
+				return err
+			}
+		}
+
+		zoneThreshold, _ := thresholdParam(url.Values{})
+		if threshold != nil {
+			zoneThreshold = *threshold
+		}
+		if heatmapParams.Metric.Name != defaultMetric {
+			log.Printf("skipping zone statistics of floor %d: %v", id, errSignalOnly)
+		} else if result.Zones, err = computeZoneStats(context.Background(), floor, filtered, heatmapParams, zoneThreshold, scoreMetric(scoreWeights)); err != nil {
+			log.Printf("skipping zone statistics of floor %d: %v", id, err)
+		}
+
+		log.Printf("rendered floor %d (%s) from %d measurements", id, floor.Name, len(filtered))
+		summary.Floors = append(summary.Floors, result)
+	}
+
+	summaryData, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(outDir, "summary.json"), summaryData, 0644)
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func isArchive(path string) bool {
+	for _, suffix := range []string{".zip", ".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(strings.ToLower(path), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// findDataRoot descends into a single top-level directory, as produced by
+// archiving a data directory by name.
+func findDataRoot(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return dir
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
+
+// extractArchive unpacks a zip or (gzipped) tar archive into dest, refusing
+// entries that would land outside of it.
+func extractArchive(path, dest string) error {
+	target := func(name string) (string, error) {
+		cleaned := filepath.Join(dest, name)
+		if !strings.HasPrefix(cleaned, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return "", fmt.Errorf("archive entry %q escapes the destination", name)
+		}
+		return cleaned, nil
+	}
+	write := func(name string, r io.Reader) error {
+		path, err := target(name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				continue
+			}
+			r, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			err = write(entry.Name, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if !strings.HasSuffix(strings.ToLower(path), ".tar") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := write(header.Name, archive); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	renderWorkers = flag.Int("render-workers", runtime.NumCPU(), "number of heatmap renders running at once")
+	renderQueue   = flag.Int("render-queue", 8, "number of heatmap renders allowed to wait for a worker")
+	renderTimeout = flag.Duration("render-timeout", 30*time.Second, "maximum time a heatmap render may queue and run")
+
+	renderSlots     chan struct{}
+	renderSlotsOnce sync.Once
+	renderMutex     sync.Mutex
+	renderWaiting   int
+)
+
+// withRenderSlot runs render in the bounded render pool. Requests beyond the
+// queue capacity are rejected with 429 and the current queue length, and
+// render gets a context that expires after -render-timeout.
+func withRenderSlot(w http.ResponseWriter, r *http.Request, render func(ctx context.Context)) {
+	renderSlotsOnce.Do(func() {
+		renderSlots = make(chan struct{}, max(*renderWorkers, 1))
+	})
+
+	renderMutex.Lock()
+	if renderWaiting >= *renderQueue+cap(renderSlots) {
+		position := renderWaiting - cap(renderSlots) + 1
+		renderMutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "5")
+		w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":         "render queue is full",
+			"queuePosition": position,
+		})
+		return
+	}
+	renderWaiting++
+	renderMutex.Unlock()
+
+	defer func() {
+		renderMutex.Lock()
+		renderWaiting--
+		renderMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(r.Context(), *renderTimeout)
+	defer cancel()
+
+	select {
+	case renderSlots <- struct{}{}:
+		defer func() { <-renderSlots }()
+	case <-ctx.Done():
+		http.Error(w, "timed out waiting for a render worker", http.StatusServiceUnavailable)
+		return
+	}
+
+	render(ctx)
+}
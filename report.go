@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const markerRadius = 8
+
+var (
+	markerOutline = color.RGBA{40, 40, 40, 255}
+	failedMarker  = color.RGBA{150, 150, 150, 255}
+	passMarker    = color.RGBA{0, 200, 0, 255}
+	failMarker    = color.RGBA{220, 0, 0, 255}
+	labelFill     = color.RGBA{220, 220, 220, 220}
+	zoneOutline   = color.RGBA{30, 60, 200, 255}
+)
+
+// renderReport draws every measurement as a marker colored by its signal,
+// labelled with its location and dBm value, over the floor map and the
+// outlines of the floor's zones. With a threshold the markers show
+// pass/fail instead and a summary is added in the top-left corner.
+func renderReport(floor Floor, ms []Measurement, threshold *ThresholdProfile) (image.Image, error) {
+	background, err := loadFloorMap(floor)
+	if err != nil {
+		return nil, err
+	}
+
+	var bounds image.Rectangle
+	if background != nil {
+		bounds = image.Rect(0, 0, background.Bounds().Dx(), background.Bounds().Dy())
+	} else {
+		width, height := canvasSize(ms)
+		bounds = image.Rect(0, 0, width, height)
+	}
+
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, image.White, image.Point{}, draw.Src)
+	if background != nil {
+		draw.Draw(canvas, bounds, background, background.Bounds().Min, draw.Over)
+	}
+
+	for _, zone := range floorZones(floor.ID) {
+		var cx, cy float64
+		for i, v := range zone.Polygon {
+			next := zone.Polygon[(i+1)%len(zone.Polygon)]
+			drawLine(canvas, int(v.Lng), bounds.Dy()-int(v.Lat), int(next.Lng), bounds.Dy()-int(next.Lat), zoneOutline)
+			cx += v.Lng
+			cy += v.Lat
+		}
+		n := float64(len(zone.Polygon))
+		drawLabel(canvas, int(cx/n), bounds.Dy()-int(cy/n), zone.Name)
+	}
+
+	// Labels go down first so that markers stay visible where labels of
+	// nearby points overlap them.
+	for _, m := range ms {
+		label := "no signal"
+		if m.Dbm != failedSampleDbm {
+			label = fmt.Sprintf("%d dBm", m.Dbm)
+		}
+		if m.Location != "" {
+			label = m.Location + ": " + label
+		}
+		drawLabel(canvas, int(m.Lng)+markerRadius+4, bounds.Dy()-int(m.Lat), label)
+	}
+
+	signal := metrics[defaultMetric]
+	scale := HeatmapParams{Scale: "default", Metric: signal, Min: signal.Min, Max: signal.Max}
+	passed := 0
+	for _, m := range ms {
+		fill := failedMarker
+		switch {
+		case threshold != nil && threshold.passes(m.Dbm):
+			fill = passMarker
+			passed++
+		case threshold != nil:
+			fill = failMarker
+		case m.Dbm != failedSampleDbm:
+			fill = scale.colorFor(float64(m.Dbm))
+		}
+		drawMarker(canvas, int(m.Lng), bounds.Dy()-int(m.Lat), fill, m.Type == "accesspoint")
+	}
+
+	if threshold != nil {
+		drawLabel(canvas, 10, 16, fmt.Sprintf("%s (%d dBm): %d of %d points pass",
+			threshold.Name, threshold.MinDbm, passed, len(ms)))
+	}
+
+	return canvas, nil
+}
+
+// drawMarker draws a circle, or a square for access points, centred on
+// (cx, cy) with a dark outline.
+func drawMarker(img *image.RGBA, cx, cy int, fill color.RGBA, square bool) {
+	for dy := -markerRadius; dy <= markerRadius; dy++ {
+		for dx := -markerRadius; dx <= markerRadius; dx++ {
+			d := dx*dx + dy*dy
+			if !square && d > markerRadius*markerRadius {
+				continue
+			}
+
+			edge := markerRadius - 2
+			c := fill
+			if square && (dx < -edge || dx > edge || dy < -edge || dy > edge) ||
+				!square && d > edge*edge {
+				c = markerOutline
+			}
+			img.SetRGBA(cx+dx, cy+dy, c)
+		}
+	}
+}
+
+// drawLine draws a two pixel wide line from (x0, y0) to (x1, y1) with
+// Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		img.SetRGBA(x0+1, y0, c)
+		img.SetRGBA(x0, y0+1, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// drawLabel writes text on a light box, vertically centred on y.
+func drawLabel(img *image.RGBA, x, y int, text string) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	box := image.Rect(x-2, y-face.Height/2-2, x+width+2, y+face.Height/2+2)
+	draw.Draw(img, box, image.NewUniform(labelFill), image.Point{}, draw.Over)
+
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: face,
+		Dot:  fixed.P(x, y+face.Ascent-face.Height/2),
+	}
+	drawer.DrawString(text)
+}
+
+const (
+	legendWidth  = 200
+	legendHeight = 12
+	legendMargin = 10
+)
+
+// drawLegend draws the color scale of the heatmap in the bottom-left
+// corner, labelled with the metric and the values at both ends.
+func drawLegend(img *image.RGBA, params HeatmapParams) {
+	bounds := img.Bounds()
+	width := min(legendWidth, bounds.Dx()-2*legendMargin)
+	if width < 2 || bounds.Dy() < 4*legendMargin+legendHeight {
+		return
+	}
+
+	face := basicfont.Face7x13
+	top := bounds.Max.Y - legendMargin - face.Height - legendHeight - 4
+	left := bounds.Min.X + legendMargin
+
+	box := image.Rect(left-4, top-face.Height-8, left+width+4, bounds.Max.Y-legendMargin+2)
+	draw.Draw(img, box, image.NewUniform(labelFill), image.Point{}, draw.Over)
+
+	for x := 0; x < width; x++ {
+		value := params.Min + (params.Max-params.Min)*float64(x)/float64(width-1)
+		bar := image.Rect(left+x, top, left+x+1, top+legendHeight)
+		draw.Draw(img, bar, image.NewUniform(params.colorFor(value)), image.Point{}, draw.Src)
+	}
+
+	metric := params.Metric
+	drawLabel(img, left, top-face.Height/2-4, fmt.Sprintf("%s (%s)", metric.Name, metric.Unit))
+	labelY := top + legendHeight + face.Height/2 + 2
+	drawLabel(img, left, labelY, metric.format(params.Min))
+	maxLabel := metric.format(params.Max)
+	drawLabel(img, left+width-font.MeasureString(face, maxLabel).Ceil(), labelY, maxLabel)
+}
+
+// floorExportHandler serves the floor map with measurement markers as PNG.
+func floorExportHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var threshold *ThresholdProfile
+	if r.URL.Query().Has("threshold") {
+		profile, err := thresholdParam(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		threshold = &profile
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID && m.approved() {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		img, err := renderReport(floor, filtered, threshold)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			http.Error(w, "failed to encode image", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=floor_%d.png", floorID))
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+)
+
+// RepositionRequest is a correction of the positions of measurements, in
+// map pixels with x to the right and y down: they are scaled and rotated
+// about Origin, then offset.
+type RepositionRequest struct {
+	OffsetX float64 `json:"offsetX"`
+	OffsetY float64 `json:"offsetY"`
+	// Rotation is in degrees, clockwise on the map.
+	Rotation float64 `json:"rotation"`
+	// Scale defaults to 1.
+	Scale float64 `json:"scale"`
+	// Origin defaults to the centroid of the measurements moved.
+	Origin *ScalePoint `json:"origin"`
+	IDs    []string    `json:"ids"`
+}
+
+// affine returns the correction as a transform of map pixels.
+func (req RepositionRequest) affine(origin ScalePoint) affineFit {
+	sin, cos := math.Sincos(req.Rotation * math.Pi / 180)
+	a, b, d, e := req.Scale*cos, -req.Scale*sin, req.Scale*sin, req.Scale*cos
+	return affineFit{
+		a, b, origin.X - a*origin.X - b*origin.Y + req.OffsetX,
+		d, e, origin.Y - d*origin.X - e*origin.Y + req.OffsetY,
+	}
+}
+
+// RepositionResult reports the measurements a correction moved, or would
+// move in a dry run. OffMap counts those it puts outside the floor map,
+// which usually means the correction is wrong.
+type RepositionResult struct {
+	Affine   affineFit `json:"affine"`
+	DryRun   bool      `json:"dryRun"`
+	Moved    int       `json:"moved"`
+	OffMap   int       `json:"offMap"`
+	NotFound []string  `json:"notFound,omitempty"`
+}
+
+// repositionHandler moves measurements of a floor that were taken against
+// a misaligned map to where they belong, without walking the survey again.
+// The query filters of the batch delete (session, location, before, after)
+// and the ids of the body select the measurements, all of the floor
+// without any; with ?dryRun=true nothing is moved. Unlike the alignment of
+// a floor, zones, presets and walls stay where they are.
+func repositionHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseFilterQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Floor = floorID
+
+	req := RepositionRequest{Scale: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := filter.setIDs(req.IDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := []float64{req.OffsetX, req.OffsetY, req.Rotation, req.Scale}
+	if req.Origin != nil {
+		values = append(values, req.Origin.X, req.Origin.Y)
+	}
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			http.Error(w, "offset, rotation, scale and origin must be finite", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Scale <= 0 {
+		http.Error(w, "scale must be positive", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if floor.MapPath == "" {
+		http.Error(w, "floor has no map to correct positions against", http.StatusConflict)
+		return
+	}
+	width, height, err := floorMapSize(floor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	result := RepositionResult{DryRun: r.URL.Query().Get("dryRun") == "true", NotFound: filter.notFound()}
+
+	// Stored coordinates count lat up from the bottom of the map.
+	toPixel := func(m Measurement) (float64, float64) { return m.Lng, float64(height) - m.Lat }
+
+	mutex.Lock()
+	var selected []int
+	var origin ScalePoint
+	for i, m := range measurements {
+		if filter.matches(m) {
+			selected = append(selected, i)
+			x, y := toPixel(m)
+			origin.X += x
+			origin.Y += y
+		}
+	}
+	if len(selected) == 0 {
+		mutex.Unlock()
+		http.Error(w, "no measurements match", http.StatusNotFound)
+		return
+	}
+	origin.X /= float64(len(selected))
+	origin.Y /= float64(len(selected))
+	if req.Origin != nil {
+		origin = *req.Origin
+	}
+	t := req.affine(origin)
+	result.Affine = t
+
+	var moved []Measurement
+	for _, i := range selected {
+		x, y := t.apply(toPixel(measurements[i]))
+		if x < 0 || y < 0 || x > float64(width) || y > float64(height) {
+			result.OffMap++
+		}
+		if !result.DryRun {
+			measurements[i].Lat, measurements[i].Lng = float64(height)-y, x
+			moved = append(moved, measurements[i])
+		}
+	}
+	result.Moved = len(selected)
+	if len(moved) > 0 {
+		updateRevision()
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	for _, record := range moved {
+		if err := store.SaveMeasurement(record); err != nil {
+			http.Error(w, fmt.Sprintf("failed to save measurement %s", record.ID), http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(moved) > 0 {
+		publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: moved}, 0)
+		auditMeasurements(auditActor(r), eventMeasurementsUpdated, "repositioned", moved)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
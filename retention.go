@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const aggregatesFile = "aggregates.json"
+
+var (
+	retainDays           = flag.Int("retain-days", 0, "days raw survey measurements are kept before pruning, 0 to keep them forever")
+	retainMonitoringDays = flag.Int("retain-monitoring-days", 0, "days raw monitoring measurements are kept before pruning, 0 for -retain-days, -1 to keep them forever")
+	retainAggregateDays  = flag.Int("retain-aggregate-days", 0, "days the daily aggregates of pruned measurements are kept, 0 to keep them forever")
+	aggregatePruned      = flag.Bool("aggregate-pruned", true, "roll pruned survey measurements up into daily aggregates per location")
+	aggregateMonitoring  = flag.Bool("aggregate-monitoring", true, "roll pruned monitoring measurements up into daily aggregates per location")
+	pruneInterval        = flag.Duration("prune-interval", 24*time.Hour, "how often measurements older than -retain-days and -retain-monitoring-days are pruned")
+)
+
+// DailyAggregate summarizes the measurements of one day, in UTC, taken at
+// one place: the same floor, location name and position, of the same type,
+// class and network. Scans are kept apart per BSSID.
+type DailyAggregate struct {
+	Date         string                 `json:"date"`
+	Class        string                 `json:"class,omitempty"`
+	Floor        int                    `json:"floor"`
+	Location     string                 `json:"location,omitempty"`
+	Lat          float64                `json:"lat"`
+	Lng          float64                `json:"lng"`
+	Type         string                 `json:"type"`
+	SSID         string                 `json:"ssid,omitempty"`
+	BSSID        string                 `json:"bssid,omitempty"`
+	Measurements int                    `json:"measurements"`
+	Failed       int                    `json:"failed"`
+	Metrics      map[string]MetricStats `json:"metrics"`
+}
+
+var (
+	aggregates     []DailyAggregate
+	aggregatesLock sync.Mutex
+
+	// pruneLock keeps pruning runs from overlapping.
+	pruneLock sync.Mutex
+)
+
+func loadAggregates() error {
+	aggregatesLock.Lock()
+	defer aggregatesLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(aggregatesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &aggregates)
+}
+
+func saveAggregates() error {
+	aggregatesLock.Lock()
+	defer aggregatesLock.Unlock()
+
+	data, err := json.MarshalIndent(aggregates, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(aggregatesFile), data, 0644)
+}
+
+// dailyAggregates groups the measurements by day and place. Positions are
+// matched to the pixel, so readings repeated at a monitoring point share
+// an aggregate.
+func dailyAggregates(ms []Measurement) []DailyAggregate {
+	type key struct {
+		date, location, typ, class, ssid, bssid string
+		floor                                   int
+		lat, lng                                float64
+	}
+	groups := make(map[key][]Measurement)
+	var order []key
+	for _, m := range ms {
+		k := key{
+			date: m.Timestamp.UTC().Format(time.DateOnly), location: m.Location,
+			typ: m.Type, class: m.Class, ssid: m.SSID, floor: m.Floor,
+			lat: math.Round(m.Lat), lng: math.Round(m.Lng),
+		}
+		if m.Type == "scan" {
+			k.bssid = m.BSSID
+		}
+		if _, seen := groups[k]; !seen {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], m)
+	}
+
+	result := make([]DailyAggregate, 0, len(order))
+	for _, k := range order {
+		group := groups[k]
+		var lat, lng float64
+		for _, m := range group {
+			lat, lng = lat+m.Lat, lng+m.Lng
+		}
+		stats := statsGroup("", group)
+		result = append(result, DailyAggregate{
+			Date: k.date, Class: k.class, Floor: k.floor, Location: k.location,
+			Lat: lat / float64(len(group)), Lng: lng / float64(len(group)),
+			Type: k.typ, SSID: k.ssid, BSSID: k.bssid,
+			Measurements: stats.Measurements, Failed: stats.Failed, Metrics: stats.Metrics,
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return result
+}
+
+// PruneResult reports what a pruning run removed, or would remove in a dry
+// run. Cutoff is the start of the first day of survey measurements kept,
+// MonitoringCutoff that of monitoring measurements; they are left out when
+// the class is kept forever.
+type PruneResult struct {
+	DryRun           bool       `json:"dryRun"`
+	Cutoff           *time.Time `json:"cutoff,omitempty"`
+	MonitoringCutoff *time.Time `json:"monitoringCutoff,omitempty"`
+	Pruned           int        `json:"pruned"`
+	Aggregated       int        `json:"aggregated"`
+	AggregatesPruned int        `json:"aggregatesPruned"`
+}
+
+// pruneCutoff is the start of the first day kept by a retention of days,
+// nil when days keeps everything.
+func pruneCutoff(now time.Time, days int) *time.Time {
+	if days <= 0 {
+		return nil
+	}
+	cutoff := now.UTC().AddDate(0, 0, -days).Truncate(24 * time.Hour)
+	return &cutoff
+}
+
+// monitoringRetention is the retention of monitoring measurements when
+// survey measurements are kept for days.
+func monitoringRetention(days int) int {
+	if monitoringDays := *effectiveSettings().RetainMonitoringDays; monitoringDays != 0 {
+		return monitoringDays
+	}
+	return days
+}
+
+// pruneMeasurements removes the survey measurements taken before the day
+// days ago began and the monitoring measurements taken before the day
+// monitoringDays ago began; 0 keeps a class. They are rolled up into daily
+// aggregates first when -aggregate-pruned or -aggregate-monitoring is set,
+// and the aggregates older than -retain-aggregate-days are removed. Whole
+// days are pruned, so a day is never split across two aggregates. The
+// weekly baselines keep the pruned readings regardless.
+func pruneMeasurements(actor string, now time.Time, days, monitoringDays int, dryRun bool) (PruneResult, error) {
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+
+	result := PruneResult{DryRun: dryRun, Cutoff: pruneCutoff(now, days), MonitoringCutoff: pruneCutoff(now, monitoringDays)}
+	cutoffs := map[string]*time.Time{classSurvey: result.Cutoff, classMonitoring: result.MonitoringCutoff}
+	aggregated := map[string]bool{classSurvey: *aggregatePruned, classMonitoring: *aggregateMonitoring}
+
+	mutex.Lock()
+	var old, rollUp []Measurement
+	for _, m := range measurements {
+		if cutoff := cutoffs[m.class()]; cutoff != nil && m.Timestamp.Before(*cutoff) {
+			old = append(old, m)
+			if aggregated[m.class()] {
+				rollUp = append(rollUp, m)
+			}
+		}
+	}
+	mutex.Unlock()
+	result.Pruned = len(old)
+
+	var rolledUp []DailyAggregate
+	if len(rollUp) > 0 {
+		rolledUp = dailyAggregates(rollUp)
+		result.Aggregated = len(rolledUp)
+	}
+
+	aggregatesLock.Lock()
+	kept := aggregates
+	if aggregateDays := *effectiveSettings().RetainAggregateDays; aggregateDays > 0 {
+		aggregateCutoff := now.UTC().AddDate(0, 0, -aggregateDays).Format(time.DateOnly)
+		kept = nil
+		for _, a := range aggregates {
+			if a.Date >= aggregateCutoff {
+				kept = append(kept, a)
+			}
+		}
+		result.AggregatesPruned = len(aggregates) - len(kept)
+	}
+	if !dryRun {
+		aggregates = append(kept, rolledUp...)
+	}
+	aggregatesLock.Unlock()
+
+	if dryRun {
+		return result, nil
+	}
+	if result.Aggregated > 0 || result.AggregatesPruned > 0 {
+		if err := saveAggregates(); err != nil {
+			return result, fmt.Errorf("failed to save aggregates: %v", err)
+		}
+	}
+	if len(old) > 0 {
+		if err := recordBaselines(old); err != nil {
+			return result, fmt.Errorf("failed to save baselines: %v", err)
+		}
+		pruned := make(map[string]bool, len(old))
+		for _, m := range old {
+			pruned[m.ID] = true
+		}
+		ids, err := deleteMeasurementsWhere(actor, "pruned", func(m Measurement) bool { return pruned[m.ID] })
+		if err != nil {
+			return result, err
+		}
+		result.Pruned = len(ids)
+	}
+	return result, nil
+}
+
+// runPrune prunes by the configured or given retention and records the run
+// in the task history and the pruned measurements in the audit log.
+func runPrune(initiator, actor string, days, monitoringDays int, dryRun bool) (PruneResult, error) {
+	task := startTask(taskPrune, initiator, nil)
+	result, err := pruneMeasurements(actor, time.Now(), days, monitoringDays, dryRun)
+	task.finishErr(err, map[string]string{
+		"pruned":     strconv.Itoa(result.Pruned),
+		"aggregated": strconv.Itoa(result.Aggregated),
+		"dryRun":     strconv.FormatBool(dryRun),
+	})
+	return result, err
+}
+
+// startPruning prunes every -prune-interval, starting now, when
+// -retain-days or -retain-monitoring-days is set. The retention is read
+// on every run, as /api/settings may change it.
+func startPruning() {
+	if *pruneInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			days := *effectiveSettings().RetainDays
+			if monitoringDays := monitoringRetention(days); days > 0 || monitoringDays > 0 {
+				result, err := runPrune("retention", "retention", days, monitoringDays, false)
+				if err != nil {
+					log.Printf("pruning measurements failed: %v", err)
+				} else if result.Pruned > 0 {
+					log.Printf("pruned %d old measurements into %d daily aggregates", result.Pruned, result.Aggregated)
+				}
+			}
+			time.Sleep(*pruneInterval)
+		}
+	}()
+}
+
+// pruneHandler runs the pruning now. ?days and ?monitoringDays override
+// -retain-days and -retain-monitoring-days, one of which has to be set
+// otherwise; with ?dryRun=true only the counts are reported.
+func pruneHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := *effectiveSettings().RetainDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days < 1 {
+			http.Error(w, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	monitoringDays := monitoringRetention(days)
+	if value := r.URL.Query().Get("monitoringDays"); value != "" {
+		var err error
+		if monitoringDays, err = strconv.Atoi(value); err != nil || monitoringDays < 1 {
+			http.Error(w, "monitoringDays must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	if days <= 0 && monitoringDays <= 0 {
+		http.Error(w, "no retention is configured (-retain-days), give days", http.StatusBadRequest)
+		return
+	}
+
+	result, err := runPrune(requestInitiator(r), auditActor(r), days, monitoringDays, r.URL.Query().Get("dryRun") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// aggregatesHandler lists the daily aggregates, filtered by ?floor,
+// ?location, ?class (all by default) and the dates ?from and ?to
+// (YYYY-MM-DD, inclusive).
+func aggregatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID := 0
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, name := range []string{"from", "to"} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected YYYY-MM-DD", name), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	location, from, to := query.Get("location"), query.Get("from"), query.Get("to")
+	class := classAll
+	if query.Has("class") {
+		var err error
+		if class, err = parseClass(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	aggregatesLock.Lock()
+	selected := []DailyAggregate{}
+	for _, a := range aggregates {
+		if (floorID == 0 || a.Floor == floorID) && (location == "" || a.Location == location) &&
+			(class == classAll || a.class() == class) &&
+			(from == "" || a.Date >= from) && (to == "" || a.Date <= to) {
+			selected = append(selected, a)
+		}
+	}
+	aggregatesLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(selected)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reviewMeasurements = flag.Bool("review", false, "hold new measurements for review: they count in reports once a reviewer approves them")
+
+// Review states. Measurements taken without -review have no review and
+// count as approved.
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+var reviewStates = map[string]bool{reviewPending: true, reviewApproved: true, reviewRejected: true}
+
+// Review records whether a measurement has been vetted, and by whom.
+type Review struct {
+	State      string     `json:"state"`
+	ReviewedBy string     `json:"reviewedBy,omitempty"`
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty"`
+	Note       string     `json:"note,omitempty"`
+}
+
+func (m Measurement) reviewState() string {
+	if m.Review == nil {
+		return reviewApproved
+	}
+	return m.Review.State
+}
+
+// approved reports whether the measurement may be used in reports.
+func (m Measurement) approved() bool {
+	return m.reviewState() == reviewApproved
+}
+
+// approvedMeasurements returns the measurements that may be used in
+// heatmaps, analyses and exports.
+func approvedMeasurements(ms []Measurement) []Measurement {
+	var result []Measurement
+	for _, m := range ms {
+		if m.approved() {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// parseReviewStates reads ?review, a comma-separated list of review
+// states. It is nil when the parameter is not given.
+func parseReviewStates(query url.Values) (map[string]bool, error) {
+	value := query.Get("review")
+	if value == "" {
+		return nil, nil
+	}
+	states := make(map[string]bool)
+	for _, state := range strings.Split(value, ",") {
+		state = strings.TrimSpace(state)
+		if !reviewStates[state] {
+			return nil, fmt.Errorf("review must be pending, approved or rejected")
+		}
+		states[state] = true
+	}
+	return states, nil
+}
+
+// holdForReview marks new measurements pending with -review. A review the
+// records carry, from an import for example, is dropped: only a reviewer
+// may approve them.
+func holdForReview(records []Measurement) {
+	if !*reviewMeasurements {
+		return
+	}
+	for i := range records {
+		records[i].Review = &Review{State: reviewPending}
+	}
+}
+
+// reopenReview sends a reviewed measurement back for review after it was
+// changed.
+func reopenReview(m *Measurement) {
+	if *reviewMeasurements && m.Review != nil && m.Review.State != reviewPending {
+		m.Review = &Review{State: reviewPending}
+	}
+}
+
+// ReviewRequest sets the review state of measurements, either those listed
+// in IDs or all pending ones of a floor and/or session.
+type ReviewRequest struct {
+	State   string   `json:"state"`
+	Note    string   `json:"note"`
+	IDs     []string `json:"ids"`
+	Floor   int      `json:"floor"`
+	Session string   `json:"session"`
+}
+
+// ReviewResult reports how many measurements a review changed. NotFound
+// lists requested IDs that did not exist.
+type ReviewResult struct {
+	Reviewed int      `json:"reviewed"`
+	NotFound []string `json:"notFound,omitempty"`
+}
+
+// reviewHandler counts the measurements in each review state (GET) and
+// approves or rejects measurements in bulk (POST), which needs a reviewer
+// key.
+func reviewHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		reviewSummaryHandler(w, r)
+		return
+	case "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !reviewStates[req.State] {
+		http.Error(w, "state must be pending, approved or rejected", http.StatusBadRequest)
+		return
+	}
+	note, err := cleanText("note", req.Note, maxDescriptionLength, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.IDs == nil && req.Floor <= 0 && req.Session == "" {
+		http.Error(w, "ids, floor or session is required", http.StatusBadRequest)
+		return
+	}
+	if req.IDs != nil && len(req.IDs) == 0 {
+		http.Error(w, "ids must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	requested := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		requested[id] = true
+	}
+	match := func(m Measurement) bool {
+		if req.IDs != nil {
+			return requested[m.ID]
+		}
+		return m.reviewState() == reviewPending && (req.Floor <= 0 || m.Floor == req.Floor) && (req.Session == "" || m.SessionID == req.Session)
+	}
+
+	review := &Review{State: req.State, Note: note}
+	if req.State != reviewPending {
+		now := time.Now()
+		review.ReviewedBy = requestUser(r)
+		review.ReviewedAt = &now
+	}
+
+	mutex.Lock()
+	var reviewed []Measurement
+	for i, m := range measurements {
+		if !match(m) {
+			continue
+		}
+		delete(requested, m.ID)
+		measurements[i].Review = review
+		reviewed = append(reviewed, measurements[i])
+	}
+	if len(reviewed) > 0 {
+		updateRevision()
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	for _, record := range reviewed {
+		if err := store.SaveMeasurement(record); err != nil {
+			http.Error(w, "failed to save measurement", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(reviewed) > 0 {
+		publish(Event{Type: eventMeasurementsUpdated, Revision: revision, Measurements: reviewed}, 0)
+		auditMeasurements(auditActor(r), eventMeasurementsUpdated, "review "+req.State, reviewed)
+	}
+
+	result := ReviewResult{Reviewed: len(reviewed)}
+	for _, id := range req.IDs {
+		if requested[id] {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// reviewSummaryHandler counts the measurements of each review state,
+// optionally of one floor and/or session. The measurements themselves are
+// listed by GET /api/measurements?review=pending.
+func reviewSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	floor := 0
+	if value := query.Get("floor"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+		floor = parsed
+	}
+	session := query.Get("session")
+
+	counts := map[string]int{reviewPending: 0, reviewApproved: 0, reviewRejected: 0}
+	mutex.Lock()
+	for _, m := range measurements {
+		if (floor == 0 || m.Floor == floor) && (session == "" || m.SessionID == session) {
+			counts[m.reviewState()]++
+		}
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  *reviewMeasurements,
+		"pending":  counts[reviewPending],
+		"approved": counts[reviewApproved],
+		"rejected": counts[reviewRejected],
+	})
+}
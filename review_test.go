@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseReviewStates(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "review=approved", want: map[string]bool{"approved": true}},
+		{query: "review=pending,+rejected", want: map[string]bool{"pending": true, "rejected": true}},
+		{query: "review=pending,lost", wantErr: true},
+		{query: "review=pending,", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		got, err := parseReviewStates(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %#v, want an error", test.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: parsed %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
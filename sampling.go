@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const profilesFile = "profiles.json"
+
+type SamplingProfile struct {
+	Samples  int `json:"samples"`
+	Interval int `json:"interval"`
+	// Discard is the number of warm-up samples taken and thrown away
+	// before the samples, as adapters often report a stale signal right
+	// after associating or waking up.
+	Discard int `json:"discard,omitempty"`
+}
+
+var samplingProfiles = map[string]SamplingProfile{
+	"quick":    {Samples: 3, Interval: 200},
+	"standard": {Samples: 5, Interval: 500},
+	"thorough": {Samples: 20, Interval: 1000},
+}
+
+var (
+	defaultProfile    = flag.String("profile", "standard", "sampling profile used when a request names none")
+	defaultSamples    = flag.Int("samples", 0, "number of samples of the default profile, 0 to keep the profile's")
+	defaultInterval   = flag.Int("interval", 0, "interval between samples of the default profile in milliseconds, 0 to keep the profile's")
+	maxSamples        = flag.Int("max-samples", 100, "maximum number of samples per measurement")
+	maxInterval       = flag.Int("max-interval", 10000, "maximum interval between samples in milliseconds")
+	maxSampleDuration = flag.Duration("max-sample-duration", 2*time.Minute, "maximum total sampling time per measurement")
+)
+
+// loadSamplingProfiles merges profiles from profiles.json over the built-in
+// ones, so operators can tune or add profiles without rebuilding.
+func loadSamplingProfiles() error {
+	data, err := os.ReadFile(profilesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var custom map[string]SamplingProfile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return err
+	}
+
+	for name, profile := range custom {
+		if profile.Samples <= 0 || profile.Interval <= 0 {
+			return fmt.Errorf("profile %q needs positive samples and interval", name)
+		}
+		if profile.Discard < 0 {
+			return fmt.Errorf("profile %q cannot discard a negative number of samples", name)
+		}
+		samplingProfiles[name] = profile
+	}
+
+	return nil
+}
+
+// applyDefaultSampling sets the samples and interval of the default profile
+// from -samples and -interval.
+func applyDefaultSampling() {
+	profile := samplingProfiles[*defaultProfile]
+	if *defaultSamples > 0 {
+		profile.Samples = *defaultSamples
+	}
+	if *defaultInterval > 0 {
+		profile.Interval = *defaultInterval
+	}
+	samplingProfiles[*defaultProfile] = profile
+}
+
+// applySamplingDefaults fills in missing sampling parameters from the named
+// profile and rejects requests that exceed the configured limits.
+func applySamplingDefaults(req *MeasurementRequest) error {
+	if req.Profile == "" {
+		req.Profile = effectiveSettings().SamplingProfile
+	}
+
+	profile, ok := samplingProfiles[req.Profile]
+	if !ok {
+		return fmt.Errorf("unknown sampling profile %q", req.Profile)
+	}
+	if req.Samples <= 0 {
+		req.Samples = profile.Samples
+	}
+	if req.Interval <= 0 {
+		req.Interval = profile.Interval
+	}
+	if req.Discard == nil {
+		req.Discard = &profile.Discard
+	}
+
+	if req.Samples > *maxSamples {
+		return fmt.Errorf("samples must be at most %d", *maxSamples)
+	}
+	if req.Interval > *maxInterval {
+		return fmt.Errorf("interval must be at most %d ms", *maxInterval)
+	}
+	if *req.Discard < 0 {
+		return fmt.Errorf("discard must not be negative")
+	}
+	if *req.Discard > *maxSamples-req.Samples {
+		return fmt.Errorf("samples and discarded samples must be at most %d together", *maxSamples)
+	}
+	if duration := time.Duration((req.Samples+*req.Discard)*req.Interval) * time.Millisecond; duration > *maxSampleDuration {
+		return fmt.Errorf("sampling would take %s, the limit is %s", duration, *maxSampleDuration)
+	}
+
+	return nil
+}
+
+// discarded returns the number of warm-up samples to throw away. Requests
+// stored before the option existed discard none.
+func (req MeasurementRequest) discarded() int {
+	if req.Discard == nil {
+		return 0
+	}
+	return *req.Discard
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"defaultProfile": effectiveSettings().SamplingProfile,
+		"profiles":       samplingProfiles,
+		"pingHost":       *pingHost,
+		"throughput":     throughputMethods(),
+		"auth":           authConfig(),
+		"limits": map[string]int64{
+			"samples":  int64(*maxSamples),
+			"interval": int64(*maxInterval),
+			"duration": maxSampleDuration.Milliseconds(),
+		},
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	scaleManual   = "manual"
+	scalePoints   = "points"
+	scaleDetected = "detected"
+
+	// defaultDoorWidth is the clear width of a standard interior door.
+	defaultDoorWidth = 0.9
+	// scaleClickError is the assumed error of a clicked point in pixels.
+	scaleClickError = 2
+	minDoorPixels   = 6
+	maxDoorPixels   = 300
+	// minDoorFraction is the smallest opening, relative to the longer side
+	// of the map, taken for a door rather than text or compression noise.
+	minDoorFraction = 0.005
+	// wallLuminance separates dark wall pixels from light floor pixels.
+	wallLuminance = 128
+)
+
+// FloorScale is the size of a floor map pixel for floors without a
+// geographic calibration. Confidence runs from 0 to 1.
+type FloorScale struct {
+	MetersPerPixel float64      `json:"metersPerPixel"`
+	Confidence     float64      `json:"confidence"`
+	Method         string       `json:"method"`
+	Points         []ScalePoint `json:"points,omitempty"`
+	Distance       float64      `json:"distance,omitempty"`
+	// Doors is the number of door openings a detected scale is based on.
+	Doors int `json:"doors,omitempty"`
+}
+
+// ScalePoint is a floor map pixel, x to the right and y down.
+type ScalePoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type ScaleRequest struct {
+	MetersPerPixel float64      `json:"metersPerPixel"`
+	Points         []ScalePoint `json:"points"`
+	Distance       float64      `json:"distance"`
+}
+
+// metersPerPixel returns the ground size of a floor map pixel from the
+// calibration, or else from the scale. It is zero when neither is known.
+func (f Floor) metersPerPixel() float64 {
+	if f.Calibration != nil {
+		return f.Calibration.metersPerPixel()
+	}
+	if f.Scale != nil {
+		return f.Scale.MetersPerPixel
+	}
+	return 0
+}
+
+// scaleFromRequest builds a scale from a manual value or from two points a
+// known distance apart. The confidence of the latter drops for short
+// segments, where a misplaced click matters more.
+func scaleFromRequest(req ScaleRequest) (*FloorScale, error) {
+	if len(req.Points) > 0 {
+		if len(req.Points) != 2 {
+			return nil, fmt.Errorf("exactly two points are required")
+		}
+		if req.Distance <= 0 {
+			return nil, fmt.Errorf("distance must be positive")
+		}
+		pixels := math.Hypot(req.Points[1].X-req.Points[0].X, req.Points[1].Y-req.Points[0].Y)
+		if pixels < 1 {
+			return nil, fmt.Errorf("the points must be apart")
+		}
+		return &FloorScale{
+			MetersPerPixel: req.Distance / pixels,
+			Confidence:     math.Round(math.Max(0, 1-scaleClickError/pixels)*100) / 100,
+			Method:         scalePoints,
+			Points:         req.Points,
+			Distance:       req.Distance,
+		}, nil
+	}
+
+	if req.MetersPerPixel <= 0 || math.IsInf(req.MetersPerPixel, 0) {
+		return nil, fmt.Errorf("metersPerPixel or two points with a distance are required")
+	}
+	return &FloorScale{MetersPerPixel: req.MetersPerPixel, Confidence: 1, Method: scaleManual}, nil
+}
+
+// wallMask marks the opaque pixels of img darker than threshold, row by
+// row.
+func wallMask(img image.Image, threshold uint32) []bool {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	wall := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luminance := (299*r + 587*g + 114*b) / 1000 >> 8
+			wall[y*width+x] = a > 0x8000 && luminance < threshold
+		}
+	}
+	return wall
+}
+
+// detectDoorWidth looks for door openings in the walls of a floor plan: runs
+// of light pixels between two dark wall runs at least as long, in rows and
+// columns where the wall is at least two pixels thick. It returns the most
+// common opening width in pixels, how many openings share it, and their
+// share of all openings found.
+func detectDoorWidth(ctx context.Context, img image.Image) (float64, int, float64, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	minGap := max(minDoorPixels, int(float64(max(width, height))*minDoorFraction))
+
+	wall := wallMask(img, wallLuminance)
+
+	var gaps []int
+	// scan walks one line of pixels; at(i) tells whether pixel i is wall and
+	// thick(i) whether the wall continues across the line at i.
+	scan := func(n int, at, thick func(i int) bool) {
+		prevEnd, prevRun := -1, 0
+		for i := 0; i < n; {
+			if !at(i) {
+				i++
+				continue
+			}
+			start := i
+			for i < n && at(i) {
+				i++
+			}
+			run := i - start
+
+			if prevEnd >= 0 {
+				gap := start - prevEnd
+				if gap >= minGap && gap <= maxDoorPixels && prevRun >= gap && run >= gap &&
+					thick(prevEnd-1) && thick(start) {
+					gaps = append(gaps, gap)
+				}
+			}
+			prevEnd, prevRun = i, run
+		}
+	}
+
+	for y := 1; y < height-1; y++ {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, 0, err
+		}
+		row := y * width
+		scan(width,
+			func(x int) bool { return wall[row+x] },
+			func(x int) bool { return wall[row-width+x] || wall[row+width+x] })
+	}
+	for x := 1; x < width-1; x++ {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, 0, err
+		}
+		scan(height,
+			func(y int) bool { return wall[y*width+x] },
+			func(y int) bool { return wall[y*width+x-1] || wall[y*width+x+1] })
+	}
+
+	if len(gaps) == 0 {
+		return 0, 0, 0, nil
+	}
+
+	// Openings within 10% of each other count as the same door width.
+	sort.Ints(gaps)
+	best, bestCount := 0, 0
+	for i, gap := range gaps {
+		count := 0
+		for _, other := range gaps[i:] {
+			if float64(other) > float64(gap)*1.1 {
+				break
+			}
+			count++
+		}
+		if count > bestCount {
+			best, bestCount = i, count
+		}
+	}
+
+	cluster := gaps[best : best+bestCount]
+	return float64(cluster[len(cluster)/2]), bestCount, float64(bestCount) / float64(len(gaps)), nil
+}
+
+// detectScale estimates the scale of a floor map from its door openings,
+// assuming they are doorWidth meters wide.
+func detectScale(ctx context.Context, floor Floor, doorWidth float64) (*FloorScale, error) {
+	img, err := loadFloorMap(floor)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("floor has no map")
+	}
+
+	pixels, count, share, err := detectDoorWidth(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	// Each opening is found once per pixel of wall thickness, so a handful
+	// of hits is a single door.
+	if count < 6 {
+		return nil, fmt.Errorf("no door openings found on the floor map")
+	}
+
+	return &FloorScale{
+		MetersPerPixel: doorWidth / pixels,
+		Confidence:     math.Round(share*math.Min(1, float64(count)/40)*100) / 100,
+		Method:         scaleDetected,
+		Doors:          count,
+	}, nil
+}
+
+// scaleHandler manages the scale of a floor. PUT stores a manual scale or
+// one derived from two points; POST detects it from the door openings of
+// the floor map and stores it unless a manual or point scale is set.
+func scaleHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	var scale *FloorScale
+	switch r.Method {
+	case "GET":
+		if floor.Scale == nil {
+			http.Error(w, "floor has no scale", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(floor.Scale)
+		return
+	case "PUT":
+		var req ScaleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if scale, err = scaleFromRequest(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "POST":
+		doorWidth := defaultDoorWidth
+		if value := r.URL.Query().Get("doorWidth"); value != "" {
+			var err error
+			if doorWidth, err = strconv.ParseFloat(value, 64); err != nil || doorWidth <= 0 {
+				http.Error(w, "doorWidth must be a positive number of meters", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var err error
+		withRenderSlot(w, r, func(ctx context.Context) {
+			scale, err = detectScale(ctx, floor, doorWidth)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if scale == nil {
+			// withRenderSlot has already answered.
+			return
+		}
+		if floor.Scale != nil && floor.Scale.Method != scaleDetected {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(scale)
+			return
+		}
+	case "DELETE":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists = floors[floorID]
+	if exists {
+		floor.Scale = scale
+		floors[floorID] = floor
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	if err := store.SaveFloor(floor); err != nil {
+		http.Error(w, "failed to save floor data", http.StatusInternalServerError)
+		return
+	}
+	publishFloor(eventFloorUpdated, floor)
+	detail := "scale set"
+	if scale == nil {
+		detail = "scale removed"
+	}
+	auditFloor(auditActor(r), eventFloorUpdated, detail, floorID)
+
+	if scale == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scale)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanResult is one BSS seen by `iw dev <iface> scan`.
+type ScanResult struct {
+	BSSID    string  `json:"bssid"`
+	SSID     string  `json:"ssid"`
+	Signal   float64 `json:"signal"`
+	Freq     int     `json:"freq"`
+	Channel  int     `json:"channel"`
+	Security string  `json:"security"`
+	// PMF is whether the BSS requires protected management frames
+	// (802.11w): required, capable or none.
+	PMF string `json:"pmf"`
+}
+
+var (
+	scanBSSRe    = regexp.MustCompile(`^BSS ([0-9a-fA-F:]{17})`)
+	scanFreqRe   = regexp.MustCompile(`^freq:\s*([\d.]+)`)
+	scanSignalRe = regexp.MustCompile(`^signal:\s*(-?[\d.]+)\s*dBm`)
+	scanAuthRe   = regexp.MustCompile(`Authentication suites:\s*(.*)$`)
+)
+
+func wifiScan(ctx context.Context, interfaceName string) ([]ScanResult, error) {
+	output, err := exec.CommandContext(ctx, "iw", "dev", interfaceName, "scan").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("scan failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return parseScan(string(output)), nil
+}
+
+// parseScan reads the BSS sections of `iw dev <iface> scan` output.
+func parseScan(output string) []ScanResult {
+	var results []ScanResult
+	var current *ScanResult
+	var privacy, rsn, wpa bool
+	var auth, pmf string
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.Security = scanSecurity(privacy, rsn, wpa, auth)
+		current.PMF = pmf
+		results = append(results, *current)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := scanBSSRe.FindStringSubmatch(line); match != nil {
+			finish()
+			current = &ScanResult{BSSID: strings.ToLower(match[1])}
+			privacy, rsn, wpa, auth, pmf = false, false, false, "", "none"
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case scanFreqRe.MatchString(trimmed):
+			freq, _ := strconv.ParseFloat(scanFreqRe.FindStringSubmatch(trimmed)[1], 64)
+			current.Freq = int(freq)
+			current.Channel = frequencyToChannel(current.Freq)
+		case scanSignalRe.MatchString(trimmed):
+			current.Signal, _ = strconv.ParseFloat(scanSignalRe.FindStringSubmatch(trimmed)[1], 64)
+		case strings.HasPrefix(trimmed, "SSID: "):
+			current.SSID = strings.TrimPrefix(trimmed, "SSID: ")
+		case strings.HasPrefix(trimmed, "capability:"):
+			privacy = strings.Contains(trimmed, "Privacy")
+		case strings.HasPrefix(trimmed, "RSN:"):
+			rsn = true
+		case strings.HasPrefix(trimmed, "WPA:"):
+			wpa = true
+		}
+		if match := scanAuthRe.FindStringSubmatch(trimmed); match != nil && rsn {
+			auth += " " + match[1]
+		}
+		// The RSN capabilities, not the BSS capability line above.
+		if rsn && strings.HasPrefix(trimmed, "* Capabilities:") {
+			switch {
+			case strings.Contains(trimmed, "MFP-required"):
+				pmf = "required"
+			case strings.Contains(trimmed, "MFP-capable"):
+				pmf = "capable"
+			}
+		}
+	}
+	finish()
+
+	return results
+}
+
+// scanSecurity summarises the advertised security of a BSS.
+func scanSecurity(privacy, rsn, wpa bool, auth string) string {
+	switch {
+	case rsn:
+		sae := strings.Contains(auth, "SAE")
+		psk := strings.Contains(auth, "PSK")
+		switch {
+		case strings.Contains(auth, "802.1X"):
+			return "WPA2-Enterprise"
+		case sae && psk:
+			return "WPA2/WPA3"
+		case sae:
+			return "WPA3"
+		case strings.Contains(auth, "OWE"):
+			return "OWE"
+		}
+		return "WPA2"
+	case wpa:
+		return "WPA"
+	case privacy:
+		return "WEP"
+	}
+	return "Open"
+}
+
+// takeScan records one measurement per BSS visible at the requested
+// position. The records share a scan ID so they can be grouped per point.
+func takeScan(ctx context.Context, req MeasurementRequest) ([]Measurement, error) {
+	results, err := wifiScan(ctx, req.Interface)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// DFS channels are annotated when the regulatory domain is available.
+	domain, _ := getRegDomain()
+
+	scanID := newMeasurementID()
+	now := time.Now()
+	lat, lng := req.coordinates()
+	records := make([]Measurement, 0, len(results))
+	for _, result := range results {
+		record := Measurement{
+			ID:        newMeasurementID(),
+			Timestamp: now,
+			Dbm:       int(math.Round(result.Signal)),
+			Lat:       lat,
+			Lng:       lng,
+			Floor:     req.Floor,
+			Location:  req.Location,
+			Type:      "scan",
+			Accuracy:  req.Accuracy,
+			Height:    req.Height,
+			PresetID:  req.PresetID,
+			SessionID: req.SessionID,
+			Interface: req.Interface,
+			Class:     req.Class,
+			SSID:      result.SSID,
+			BSSID:     result.BSSID,
+			Freq:      result.Freq,
+			Channel:   result.Channel,
+			Security:  result.Security,
+			PMF:       result.PMF,
+			ScanID:    scanID,
+		}
+		if domain != nil {
+			if rule := domain.ruleFor(result.Freq); rule != nil {
+				record.DFS = rule.DFS
+			}
+		}
+		records = append(records, record)
+	}
+	assessScanSecurity(records)
+
+	if err := addMeasurements(req.actor, records...); err != nil {
+		return records, err
+	}
+
+	return records, nil
+}
+
+// selectSignalSource picks the measurements a heatmap is drawn from. Without
+// a filter it uses the associated-link measurements and skips scan records.
+// With a BSSID it uses the scan records of that AP, and with an SSID the
+// strongest BSS of that network at each scanned point.
+func selectSignalSource(ms []Measurement, ssid, bssid string) []Measurement {
+	if ssid == "" && bssid == "" {
+		var selected []Measurement
+		for _, m := range ms {
+			if m.Type != "scan" {
+				selected = append(selected, m)
+			}
+		}
+		return selected
+	}
+
+	var selected []Measurement
+	strongest := make(map[string]int)
+	for _, m := range ms {
+		if m.Type != "scan" {
+			continue
+		}
+		if bssid != "" && !strings.EqualFold(m.BSSID, bssid) {
+			continue
+		}
+		if ssid != "" && m.SSID != ssid {
+			continue
+		}
+
+		if i, seen := strongest[m.ScanID]; seen {
+			if m.Dbm > selected[i].Dbm {
+				selected[i] = m
+			}
+			continue
+		}
+		strongest[m.ScanID] = len(selected)
+		selected = append(selected, m)
+	}
+	return selected
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const scoreMetricName = "score"
+
+// defaultScoreWeights weigh the components of the experience score.
+var defaultScoreWeights = map[string]float64{
+	"signal":     0.4,
+	"latency":    0.3,
+	"throughput": 0.3,
+}
+
+func init() {
+	metrics[scoreMetricName] = scoreMetric(defaultScoreWeights)
+}
+
+// normalizedValue rates a value of the metric from 0 (at or beyond the bad
+// end of its default range) to 1 (at or beyond the good end).
+func (m Metric) normalizedValue(value float64) float64 {
+	t := (value - m.Min) / (m.Max - m.Min)
+	if !m.HigherIsBetter {
+		t = 1 - t
+	}
+	return math.Max(0, math.Min(1, t))
+}
+
+// scoreMetric returns the experience score for the given weights: the
+// weighted mean of the normalized components, scaled to 0-100. Components a
+// measurement lacks are left out and the remaining weights rescaled, so a
+// point with only a signal reading is scored on the signal alone.
+func scoreMetric(weights map[string]float64) Metric {
+	names := make([]string, 0, len(weights))
+	for name, weight := range weights {
+		if weight > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	description := make([]string, len(names))
+	for i, name := range names {
+		description[i] = fmt.Sprintf("%s %g", name, weights[name])
+	}
+
+	return Metric{
+		Name:           scoreMetricName,
+		Unit:           "points",
+		Description:    "Experience score weighing " + strings.Join(description, ", "),
+		Min:            0,
+		Max:            100,
+		HigherIsBetter: true,
+		value: func(m Measurement) (float64, bool) {
+			var sum, total float64
+			for _, name := range names {
+				component := metrics[name]
+				value, ok := component.value(m)
+				if !ok {
+					continue
+				}
+				sum += weights[name] * component.normalizedValue(value)
+				total += weights[name]
+			}
+			if total == 0 {
+				return 0, false
+			}
+			return math.Round(sum/total*1000) / 10, true
+		},
+	}
+}
+
+// scoreWeightsParam reads ?weights=signal:0.5,latency:0.3,throughput:0.2.
+// Metrics left out get no weight; without the parameter the defaults apply.
+func scoreWeightsParam(query url.Values) (map[string]float64, error) {
+	value := query.Get("weights")
+	if value == "" {
+		return defaultScoreWeights, nil
+	}
+
+	weights := make(map[string]float64)
+	var total float64
+	for _, part := range strings.Split(value, ",") {
+		name, weightStr, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			return nil, fmt.Errorf("weights must be a list of metric:weight")
+		}
+		if _, exists := metrics[name]; !exists || name == scoreMetricName {
+			return nil, fmt.Errorf("unknown score component %q", name)
+		}
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil || !(weight >= 0) || math.IsInf(weight, 0) {
+			return nil, fmt.Errorf("invalid weight of %s", name)
+		}
+		weights[name] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one weight must be positive")
+	}
+
+	return weights, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+)
+
+const defaultCSP = "default-src 'self'; img-src 'self' data: blob:; style-src 'self' 'unsafe-inline'; connect-src 'self' ws: wss:; object-src 'none'; base-uri 'self'"
+
+var (
+	securityHeaders = flag.Bool("security-headers", true, "send Content-Security-Policy, X-Content-Type-Options, Referrer-Policy and X-Frame-Options headers")
+	contentSecurity = flag.String("csp", envOrDefault("HEATGEN_CSP", defaultCSP), "Content-Security-Policy of the responses, without frame-ancestors; empty to send none (env HEATGEN_CSP)")
+	frameAncestors  = flag.String("frame-ancestors", envOrDefault("HEATGEN_FRAME_ANCESTORS", "'none'"), "sources allowed to embed the pages in a frame, e.g. 'self' or https://intranet.example.com, added to the CSP (env HEATGEN_FRAME_ANCESTORS)")
+	referrerPolicy  = flag.String("referrer-policy", envOrDefault("HEATGEN_REFERRER_POLICY", "no-referrer"), "Referrer-Policy of the responses (env HEATGEN_REFERRER_POLICY)")
+	embedAncestors  = flag.String("embed-frame-ancestors", envOrDefault("HEATGEN_EMBED_FRAME_ANCESTORS", "*"), "sources allowed to frame the shared views under /embed/, e.g. https://wiki.example.com (env HEATGEN_EMBED_FRAME_ANCESTORS)")
+)
+
+// contentSecurityPolicy joins -csp and the frame ancestors into the policy
+// header, "" when both are empty.
+func contentSecurityPolicy(frameAncestors string) string {
+	var directives []string
+	if csp := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(*contentSecurity), ";")); csp != "" {
+		directives = append(directives, csp)
+	}
+	if ancestors := strings.TrimSpace(frameAncestors); ancestors != "" {
+		directives = append(directives, "frame-ancestors "+ancestors)
+	}
+	return strings.Join(directives, "; ")
+}
+
+// frameOptions is the X-Frame-Options equivalent of the frame ancestors
+// for browsers without CSP support, "" when it has none.
+func frameOptions(frameAncestors string) string {
+	switch strings.TrimSpace(frameAncestors) {
+	case "'none'":
+		return "DENY"
+	case "'self'":
+		return "SAMEORIGIN"
+	}
+	return ""
+}
+
+// securityHeadersMiddleware adds the security headers scanners expect to
+// every response, so deployments need no proxy in front to add them. The
+// shared views under /embed/ may be framed by -embed-frame-ancestors
+// instead of -frame-ancestors.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	if !*securityHeaders {
+		return next
+	}
+	pageCSP, pageFrame := contentSecurityPolicy(*frameAncestors), frameOptions(*frameAncestors)
+	embedCSP, embedFrame := contentSecurityPolicy(*embedAncestors), frameOptions(*embedAncestors)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		csp, frame := pageCSP, pageFrame
+		if embedPath(r.URL.Path) {
+			csp, frame = embedCSP, embedFrame
+		}
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		if csp != "" {
+			header.Set("Content-Security-Policy", csp)
+		}
+		if frame != "" {
+			header.Set("X-Frame-Options", frame)
+		}
+		if *referrerPolicy != "" {
+			header.Set("Referrer-Policy", *referrerPolicy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
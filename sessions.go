@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const sessionsFile = "sessions.json"
+
+var (
+	sessions     = make(map[string]Session)
+	sessionsLock sync.Mutex
+)
+
+// Session groups the measurements of one walk-through survey so it can be
+// listed, exported or deleted as a unit.
+type Session struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Description  string    `json:"description,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	Measurements int       `json:"measurements"`
+}
+
+func loadSessions() error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(sessionsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &sessions)
+}
+
+func saveSessions() error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(sessionsFile), data, 0644)
+}
+
+func getSession(id string) (Session, bool) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	session, exists := sessions[id]
+	return session, exists
+}
+
+// countSessionMeasurements fills in the number of measurements recorded in
+// each session.
+func countSessionMeasurements(list []Session) {
+	counts := make(map[string]int)
+	mutex.Lock()
+	for _, m := range measurements {
+		if m.SessionID != "" {
+			counts[m.SessionID]++
+		}
+	}
+	mutex.Unlock()
+
+	for i := range list {
+		list[i].Measurements = counts[list[i].ID]
+	}
+}
+
+// inSession reports whether m belongs to the session; an empty session ID
+// matches every measurement.
+func inSession(m Measurement, sessionID string) bool {
+	return sessionID == "" || m.SessionID == sessionID
+}
+
+// sessionMeasurements returns the measurements of one session, or all of
+// them for an empty session ID.
+func sessionMeasurements(ms []Measurement, sessionID string) []Measurement {
+	if sessionID == "" {
+		return ms
+	}
+
+	var selected []Measurement
+	for _, m := range ms {
+		if m.SessionID == sessionID {
+			selected = append(selected, m)
+		}
+	}
+	return selected
+}
+
+func decodeSession(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	var session Session
+	if err := json.NewDecoder(r.Body).Decode(&session); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return session, false
+	}
+
+	if err := cleanSession(&session); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return session, false
+	}
+
+	return session, true
+}
+
+// cleanSession validates the name and description of a session.
+func cleanSession(session *Session) error {
+	var err error
+	if session.Name, err = cleanText("name", session.Name, maxNameLength, false); err == nil {
+		session.Description, err = cleanText("description", session.Description, maxDescriptionLength, true)
+	}
+	if err != nil {
+		return err
+	}
+	if session.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	return nil
+}
+
+// createSession stores a new, validated session.
+func createSession(session Session) (Session, error) {
+	session.ID = generateID()
+	session.CreatedAt = time.Now()
+	session.Measurements = 0
+
+	sessionsLock.Lock()
+	sessions[session.ID] = session
+	sessionsLock.Unlock()
+
+	if err := saveSessions(); err != nil {
+		return session, fmt.Errorf("failed to save sessions")
+	}
+	return session, nil
+}
+
+// sortedSessions lists the sessions with their measurement counts, the
+// newest first.
+func sortedSessions() []Session {
+	sessionsLock.Lock()
+	list := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		list = append(list, session)
+	}
+	sessionsLock.Unlock()
+
+	countSessionMeasurements(list)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sortedSessions())
+	case "POST":
+		session, ok := decodeSession(w, r)
+		if !ok {
+			return
+		}
+		session, err := createSession(session)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(session)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// sessionHandler reads, renames or deletes a session. Deleting a session
+// also deletes every measurement recorded in it.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	session, exists := getSession(id)
+	if !exists {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		updated, ok := decodeSession(w, r)
+		if !ok {
+			return
+		}
+		session.Name = updated.Name
+		session.Description = updated.Description
+
+		sessionsLock.Lock()
+		sessions[id] = session
+		sessionsLock.Unlock()
+
+		if err := saveSessions(); err != nil {
+			http.Error(w, "failed to save sessions", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		deleted, err := deleteSessionMeasurements(auditActor(r), id)
+		if err != nil {
+			http.Error(w, "failed to delete measurements", http.StatusInternalServerError)
+			return
+		}
+
+		sessionsLock.Lock()
+		delete(sessions, id)
+		sessionsLock.Unlock()
+
+		if err := saveSessions(); err != nil {
+			http.Error(w, "failed to save sessions", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "measurements": deleted})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := []Session{session}
+	countSessionMeasurements(list)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list[0])
+}
+
+func deleteSessionMeasurements(actor, sessionID string) (int, error) {
+	ids, err := deleteMeasurementsWhere(actor, "session "+sessionID+" deleted", func(m Measurement) bool {
+		return m.SessionID == sessionID
+	})
+	return len(ids), err
+}
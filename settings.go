@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const serverSettingsFile = "settings.json"
+
+// ServerSettings are the options admins change at runtime through
+// /api/settings, stored with the project data. Options left unset follow
+// their flags.
+type ServerSettings struct {
+	// Threshold is the threshold profile of requests naming none
+	// (-threshold).
+	Threshold string `json:"threshold,omitempty"`
+	// Palette is the color scale of heatmaps naming none.
+	Palette string `json:"palette,omitempty"`
+	// Interpolation is the method of heatmaps naming none (-interpolation).
+	Interpolation string `json:"interpolation,omitempty"`
+	// SamplingProfile is the profile of measurements naming none
+	// (-profile).
+	SamplingProfile string `json:"samplingProfile,omitempty"`
+	// RetainDays, RetainMonitoringDays and RetainAggregateDays are the
+	// retention of -retain-days, -retain-monitoring-days and
+	// -retain-aggregate-days, applied from the next pruning run.
+	RetainDays           *int `json:"retainDays,omitempty"`
+	RetainMonitoringDays *int `json:"retainMonitoringDays,omitempty"`
+	RetainAggregateDays  *int `json:"retainAggregateDays,omitempty"`
+}
+
+// SettingsView is the response of /api/settings: the options set and the
+// values in effect, those of the flags included.
+type SettingsView struct {
+	Settings  ServerSettings `json:"settings"`
+	Effective ServerSettings `json:"effective"`
+}
+
+var (
+	serverSettings     ServerSettings
+	serverSettingsLock sync.Mutex
+)
+
+func loadServerSettings() error {
+	serverSettingsLock.Lock()
+	defer serverSettingsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(serverSettingsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var settings ServerSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+	// Profiles and methods may have gone from the configuration since;
+	// such options follow their flags again.
+	for _, option := range settings.options() {
+		if err := option.check(); err != nil {
+			log.Printf("ignoring a server setting: %v", err)
+			option.clear()
+		}
+	}
+	serverSettings = settings
+	return nil
+}
+
+func saveServerSettings() error {
+	serverSettingsLock.Lock()
+	defer serverSettingsLock.Unlock()
+
+	data, err := json.MarshalIndent(serverSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(serverSettingsFile), data, 0644)
+}
+
+// settingsOption is an option of the server settings: a check of its
+// value and a way to unset it.
+type settingsOption struct {
+	check func() error
+	clear func()
+}
+
+func (s *ServerSettings) options() []settingsOption {
+	return []settingsOption{
+		{func() error {
+			if _, ok := thresholdProfiles[s.Threshold]; s.Threshold != "" && !ok {
+				return fmt.Errorf("unknown threshold profile %q", s.Threshold)
+			}
+			return nil
+		}, func() { s.Threshold = "" }},
+		{func() error {
+			if _, ok := colorScales[s.Palette]; s.Palette != "" && !ok {
+				return fmt.Errorf("unknown color scale %q", s.Palette)
+			}
+			return nil
+		}, func() { s.Palette = "" }},
+		{func() error {
+			if s.Interpolation != "" && !validInterpolationMethod(s.Interpolation) {
+				return fmt.Errorf("unknown interpolation method %q", s.Interpolation)
+			}
+			return nil
+		}, func() { s.Interpolation = "" }},
+		{func() error {
+			if _, ok := samplingProfiles[s.SamplingProfile]; s.SamplingProfile != "" && !ok {
+				return fmt.Errorf("unknown sampling profile %q", s.SamplingProfile)
+			}
+			return nil
+		}, func() { s.SamplingProfile = "" }},
+		{func() error {
+			if s.RetainDays != nil && *s.RetainDays < 0 {
+				return fmt.Errorf("retainDays must not be negative")
+			}
+			return nil
+		}, func() { s.RetainDays = nil }},
+		{func() error {
+			if s.RetainMonitoringDays != nil && *s.RetainMonitoringDays < -1 {
+				return fmt.Errorf("retainMonitoringDays must be -1 or more")
+			}
+			return nil
+		}, func() { s.RetainMonitoringDays = nil }},
+		{func() error {
+			if s.RetainAggregateDays != nil && *s.RetainAggregateDays < 0 {
+				return fmt.Errorf("retainAggregateDays must not be negative")
+			}
+			return nil
+		}, func() { s.RetainAggregateDays = nil }},
+	}
+}
+
+func (s ServerSettings) validate() error {
+	for _, option := range s.options() {
+		if err := option.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effectiveSettings returns the settings in effect, every option filled
+// in from its flag when not set.
+func effectiveSettings() ServerSettings {
+	serverSettingsLock.Lock()
+	settings := serverSettings
+	serverSettingsLock.Unlock()
+
+	defaults := map[*string]string{
+		&settings.Threshold:       *defaultThreshold,
+		&settings.Palette:         "default",
+		&settings.Interpolation:   *defaultInterpolation,
+		&settings.SamplingProfile: *defaultProfile,
+	}
+	for target, value := range defaults {
+		if *target == "" {
+			*target = value
+		}
+	}
+	if settings.RetainDays == nil {
+		settings.RetainDays = retainDays
+	}
+	if settings.RetainMonitoringDays == nil {
+		settings.RetainMonitoringDays = retainMonitoringDays
+	}
+	if settings.RetainAggregateDays == nil {
+		settings.RetainAggregateDays = retainAggregateDays
+	}
+	return settings
+}
+
+// settingsHandler reads (GET) or replaces (PUT) the server settings. A PUT
+// takes effect at once, without a restart; the options it leaves out
+// return to their flags. Changing settings needs the -admin-token.
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		if !requireAdmin(w, r) {
+			return
+		}
+		var settings ServerSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		serverSettingsLock.Lock()
+		serverSettings = settings
+		serverSettingsLock.Unlock()
+
+		if err := saveServerSettings(); err != nil {
+			http.Error(w, "failed to save settings", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serverSettingsLock.Lock()
+	view := SettingsView{Settings: serverSettings}
+	serverSettingsLock.Unlock()
+	view.Effective = effectiveSettings()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
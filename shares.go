@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sharesFile = "shares.json"
+
+	defaultShareRefresh = 60
+	minShareRefresh     = 10
+)
+
+var (
+	shares     = make(map[string]Share)
+	sharesLock sync.Mutex
+)
+
+// Share grants read access to the heatmap of one floor through a token, for
+// embedding the view at /embed/{floor} into wikis and dashboards. Only the
+// SHA-256 hash of the token is stored.
+type Share struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Floor int    `json:"floor"`
+	// Query holds the heatmap parameters of the view, as the query of
+	// GET /api/heatmap, e.g. "metric=snr&threshold=voice".
+	Query string `json:"query,omitempty"`
+	// Refresh is how often the view reloads, in seconds, 60 when left out.
+	// A negative value turns reloading off and is stored as 0.
+	Refresh   int        `json:"refresh"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+}
+
+func (s Share) expired() bool {
+	return s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt)
+}
+
+// public returns the share without its token hash.
+func (s Share) public() Share {
+	s.SHA256 = ""
+	return s
+}
+
+func loadShares() error {
+	sharesLock.Lock()
+	defer sharesLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(sharesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &shares)
+}
+
+func saveShares() error {
+	sharesLock.Lock()
+	defer sharesLock.Unlock()
+
+	data, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file holds token hashes only, but is kept private like the API
+	// keys.
+	return writeFileAtomic(projectFile(sharesFile), data, 0600)
+}
+
+// sharesHandler lists the shares (GET) and creates one (POST). The token of
+// a new share is returned once and not stored.
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		floor, err := strconv.Atoi(r.URL.Query().Get("floor"))
+		if err != nil {
+			floor = 0
+		}
+
+		sharesLock.Lock()
+		list := []Share{}
+		for _, share := range shares {
+			if floor <= 0 || share.Floor == floor {
+				list = append(list, share.public())
+			}
+		}
+		sharesLock.Unlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		var share Share
+		if err := json.NewDecoder(r.Body).Decode(&share); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if share.Name, err = cleanText("name", share.Name, maxNameLength, false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if share.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		mutex.Lock()
+		_, floorExists := floors[share.Floor]
+		mutex.Unlock()
+		if !floorExists {
+			http.Error(w, "floor not found", http.StatusBadRequest)
+			return
+		}
+
+		query, err := url.ParseQuery(share.Query)
+		if err != nil {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseHeatmapParams(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if share.Refresh == 0 {
+			share.Refresh = defaultShareRefresh
+		} else if share.Refresh < 0 {
+			share.Refresh = 0
+		} else if share.Refresh < minShareRefresh {
+			share.Refresh = minShareRefresh
+		}
+		if share.ExpiresAt != nil && !share.ExpiresAt.After(time.Now()) {
+			http.Error(w, "expiresAt must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, "failed to create the token", http.StatusInternalServerError)
+			return
+		}
+		token := hex.EncodeToString(secret)
+		share.ID = generateID()
+		share.CreatedAt = time.Now()
+		share.SHA256 = hashAPIKey(token)
+
+		sharesLock.Lock()
+		shares[share.ID] = share
+		sharesLock.Unlock()
+
+		if err := saveShares(); err != nil {
+			http.Error(w, "failed to save shares", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(struct {
+			Share
+			Token    string `json:"token"`
+			EmbedURL string `json:"embedUrl"`
+		}{share.public(), token, embedURL(share.Floor, token)})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shareHandler returns (GET) or revokes (DELETE) a share.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	sharesLock.Lock()
+	share, exists := shares[id]
+	sharesLock.Unlock()
+	if !exists {
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(share.public())
+	case "DELETE":
+		sharesLock.Lock()
+		delete(shares, id)
+		sharesLock.Unlock()
+
+		if err := saveShares(); err != nil {
+			http.Error(w, "failed to save shares", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func embedPath(p string) bool {
+	return strings.HasPrefix(p, "/embed/")
+}
+
+func embedURL(floor int, token string) string {
+	return "/embed/" + strconv.Itoa(floor) + "?token=" + url.QueryEscape(token)
+}
+
+// requestShare returns the share whose token the request presents, when it
+// grants access to the floor of the path. It writes the error otherwise.
+func requestShare(w http.ResponseWriter, r *http.Request) (Share, bool) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return Share{}, false
+	}
+	floorID, err := strconv.Atoi(r.PathValue("floor"))
+	if err != nil {
+		http.Error(w, "invalid floor", http.StatusBadRequest)
+		return Share{}, false
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "token is required", http.StatusUnauthorized)
+		return Share{}, false
+	}
+
+	hash := hashAPIKey(token)
+	sharesLock.Lock()
+	var found *Share
+	for _, share := range shares {
+		if subtle.ConstantTimeCompare([]byte(share.SHA256), []byte(hash)) == 1 {
+			found = &share
+			break
+		}
+	}
+	sharesLock.Unlock()
+	if found == nil || found.Floor != floorID || found.expired() {
+		http.Error(w, "invalid or expired share token", http.StatusForbidden)
+		return Share{}, false
+	}
+	return *found, true
+}
+
+// sharedMeasurements returns the floor of a share and the measurements
+// its view shows: those that count in reports.
+func sharedMeasurements(share Share) (Floor, []Measurement, string, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	floor, exists := floors[share.Floor]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == share.Floor && m.approved() {
+			filtered = append(filtered, m)
+		}
+	}
+	return floor, filtered, dataRevision, exists
+}
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">
+{{end}}<title>{{.Title}}</title>
+<style>
+body { margin: 0; font: 13px sans-serif; color: #333; background: #fff; }
+img { display: block; max-width: 100%; height: auto; }
+p { margin: 4px 8px; }
+</style>
+</head>
+<body>
+<img src="{{.Image}}" alt="Wi-Fi coverage of {{.Title}}">
+<p>{{.Title}} · {{if .Updated}}last measurement {{.Updated}}{{else}}no measurements yet{{end}} · rendered {{.Rendered}}</p>
+</body>
+</html>
+`))
+
+// embedHandler serves the minimal page of a shared view: the heatmap with
+// its legend and when it was last measured. The page reloads itself every
+// Refresh seconds, so it stays live in a frame.
+func embedHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := requestShare(w, r)
+	if !ok {
+		return
+	}
+	floor, ms, revision, exists := sharedMeasurements(share)
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	var updated time.Time
+	for _, m := range ms {
+		if m.Timestamp.After(updated) {
+			updated = m.Timestamp
+		}
+	}
+	const layout = "2006-01-02 15:04 MST"
+	data := struct {
+		Title, Image, Updated, Rendered string
+		Refresh                         int
+	}{
+		Title:    floor.Name,
+		Image:    "/embed/" + strconv.Itoa(floor.ID) + "/heatmap.png?token=" + url.QueryEscape(r.URL.Query().Get("token")) + "&rev=" + url.QueryEscape(revision),
+		Rendered: time.Now().Format(layout),
+		Refresh:  share.Refresh,
+	}
+	if !updated.IsZero() {
+		data.Updated = updated.Local().Format(layout)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	embedPage.Execute(w, data)
+}
+
+// embedHeatmapHandler renders the heatmap of a shared view with the
+// parameters of its share.
+func embedHeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	share, ok := requestShare(w, r)
+	if !ok {
+		return
+	}
+	query, _ := url.ParseQuery(share.Query)
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	params.Legend = true
+
+	floor, ms, _, exists := sharedMeasurements(share)
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+		http.Error(w, errMaskUncalibrated.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(max(share.Refresh, minShareRefresh)))
+	writeHeatmap(w, r, floor, ms, params, "png")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long shutdown waits for requests and sampling jobs to finish before cancelling them")
+
+// shutdown stops the server: it stops accepting requests, waits for the
+// requests and sampling jobs in flight until -shutdown-timeout cancels the
+// rest, and writes the data that is only held in memory.
+func shutdown(server *http.Server) {
+	log.Println("Shutting down, waiting for requests and sampling jobs to finish...")
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	stopChanges()
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Printf("requests still running at shutdown: %v", err)
+	}
+	stopGRPC(drainCtx)
+
+	drained := make(chan struct{})
+	go func() {
+		runningJobs.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-drainCtx.Done():
+		log.Println("cancelling the sampling jobs still running")
+		cancelRunningJobs()
+		<-drained
+	}
+
+	stopMQTT()
+	stopInflux(drainCtx)
+	if err := store.Close(); err != nil {
+		log.Printf("failed to write data files: %v", err)
+	}
+	usageLock.Lock()
+	dirty := usageDirty
+	usageLock.Unlock()
+	if dirty {
+		if err := saveUsage(); err != nil {
+			log.Printf("failed to save usage statistics: %v", err)
+		}
+	}
+	flushTasks()
+}
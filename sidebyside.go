@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font/basicfont"
+)
+
+const (
+	sideBySideGap    = 20
+	sideBySideHeader = 48
+	sideBySideFooter = 70
+)
+
+// sideBySidePanel is one heatmap of a side-by-side image.
+type sideBySidePanel struct {
+	Floor        Floor
+	Side         compareSide
+	Params       HeatmapParams
+	Label        string
+	Measurements []Measurement
+}
+
+// parseSideBySidePanel reads the panel of prefix (before or after): the
+// floor from <prefix>Floor or floor, the session and time range as for
+// /api/compare, <prefix>Ssid and <prefix>Band, and the caption from
+// <prefix>Label.
+func parseSideBySidePanel(query url.Values, prefix string, params HeatmapParams) (sideBySidePanel, int, error) {
+	panel := sideBySidePanel{Params: params, Label: query.Get(prefix + "Label")}
+
+	floorValue := query.Get(prefix + "Floor")
+	if floorValue == "" {
+		floorValue = query.Get("floor")
+	}
+	floorID, err := strconv.Atoi(floorValue)
+	if err != nil {
+		return panel, 0, fmt.Errorf("floor or %sFloor is required", prefix)
+	}
+
+	if panel.Side, err = readCompareSide(query, prefix); err != nil {
+		return panel, 0, err
+	}
+	if value := query.Get(prefix + "Ssid"); value != "" {
+		panel.Params.SSID = value
+	}
+	signal, err := parseSignalFilter(url.Values{"band": {query.Get(prefix + "Band")}})
+	if err != nil {
+		return panel, 0, fmt.Errorf("%sBand: %v", prefix, err)
+	}
+	if signal.Band != "" {
+		panel.Params.Band = signal.Band
+	}
+	return panel, floorID, nil
+}
+
+// caption describes what the panel shows, unless it was given a label.
+func (p sideBySidePanel) caption() string {
+	if p.Label != "" {
+		return p.Label
+	}
+
+	parts := []string{p.Floor.Name}
+	if p.Side.Session != "" {
+		name := p.Side.Session
+		if session, exists := getSession(p.Side.Session); exists && session.Name != "" {
+			name = session.Name
+		}
+		parts = append(parts, "session "+name)
+	}
+	if !p.Side.From.IsZero() || !p.Side.To.IsZero() {
+		from, to := "", ""
+		if !p.Side.From.IsZero() {
+			from = p.Side.From.Format("2006-01-02 15:04")
+		}
+		if !p.Side.To.IsZero() {
+			to = p.Side.To.Format("2006-01-02 15:04")
+		}
+		parts = append(parts, from+" - "+to)
+	}
+	if p.Params.SSID != "" {
+		parts = append(parts, "SSID "+p.Params.SSID)
+	}
+	if p.Params.Band != "" {
+		parts = append(parts, p.Params.Band+" GHz")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summary gives the number of readings and their mean in the panel.
+func (p sideBySidePanel) summary() string {
+	var sum float64
+	var n int
+	for _, m := range p.Params.selectMeasurements(p.Measurements) {
+		if value, ok := p.Params.Metric.value(m); ok {
+			sum += value
+			n++
+		}
+	}
+	if n == 0 {
+		return "no readings"
+	}
+	return fmt.Sprintf("%d readings, mean %s", n, p.Params.Metric.format(math.Round(sum/float64(n)*10)/10))
+}
+
+// renderSideBySide renders the panels next to each other, each captioned
+// with what it shows, above a legend both share.
+func renderSideBySide(ctx context.Context, panels []sideBySidePanel, title string) (*image.RGBA, error) {
+	images := make([]image.Image, len(panels))
+	width, height := sideBySideGap, 0
+	for i, panel := range panels {
+		img, err := renderHeatmap(ctx, panel.Floor, panel.Measurements, panel.Params)
+		if err != nil {
+			return nil, err
+		}
+		images[i] = img
+		width += img.Bounds().Dx() + sideBySideGap
+		height = max(height, img.Bounds().Dy())
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, sideBySideHeader+height+sideBySideFooter))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	lineHeight := basicfont.Face7x13.Height + 6
+	x := sideBySideGap
+	for i, img := range images {
+		drawLabel(canvas, x, sideBySideHeader/2-lineHeight/2, panels[i].caption())
+		drawLabel(canvas, x, sideBySideHeader/2+lineHeight/2, panels[i].summary())
+		bounds := img.Bounds()
+		draw.Draw(canvas, bounds.Sub(bounds.Min).Add(image.Pt(x, sideBySideHeader)), img, bounds.Min, draw.Src)
+		x += bounds.Dx() + sideBySideGap
+	}
+
+	footer := canvas.SubImage(image.Rect(0, sideBySideHeader+height, width, canvas.Bounds().Dy())).(*image.RGBA)
+	drawLegend(footer, panels[0].Params)
+	note := "Generated " + time.Now().Format("2006-01-02 15:04")
+	if title != "" {
+		note = title + ", " + note
+	}
+	drawLabel(footer, legendWidth+4*legendMargin, footer.Bounds().Max.Y-sideBySideFooter/2, note)
+
+	return canvas, nil
+}
+
+// sideBySideHandler renders two heatmaps side by side in one PNG with a
+// shared legend, for change documentation. The panels are the before and
+// after sides, each selected as described at parseSideBySidePanel; the
+// heatmap query parameters, which include the color scale, apply to both.
+// title adds a line next to the legend.
+func sideBySideHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	shared := url.Values{}
+	for name, values := range query {
+		if name != "session" && name != "legend" {
+			shared[name] = values
+		}
+	}
+	params, err := parseHeatmapParams(shared)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var panels []sideBySidePanel
+	var floorIDs []int
+	for _, prefix := range []string{"before", "after"} {
+		panel, floorID, err := parseSideBySidePanel(query, prefix, params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		panels = append(panels, panel)
+		floorIDs = append(floorIDs, floorID)
+	}
+
+	mutex.Lock()
+	missing := false
+	for i := range panels {
+		floor, exists := floors[floorIDs[i]]
+		missing = missing || !exists
+		panels[i].Floor = floor
+		for _, m := range measurements {
+			if m.Floor == floorIDs[i] && panels[i].Side.matches(m) {
+				panels[i].Measurements = append(panels[i].Measurements, m)
+			}
+		}
+	}
+	mutex.Unlock()
+
+	if missing {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		img, err := renderSideBySide(ctx, panels, query.Get("title"))
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "heatmap rendering timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			http.Error(w, "failed to encode image", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", "attachment; filename=heatmap-comparison.png")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import "strings"
+
+// SignalReader reads the association of the collecting interface using
+// whatever the platform provides. Each supported OS has its own
+// implementation in a build-tagged file, which also sets
+// defaultInterfaceName.
+type SignalReader interface {
+	// ReadLink returns the current association of the interface together
+	// with the raw tool output. An error is returned when no signal could
+	// be read.
+	ReadLink(interfaceName string) (LinkInfo, string, error)
+	// ValidInterface reports whether name is a wireless interface.
+	ValidInterface(name string) bool
+	// Check probes the prerequisites of the reader for /readyz.
+	Check(interfaceName string) []HealthCheck
+}
+
+// signalReader is set by main once the flags are parsed, as the backend can
+// be chosen on the command line.
+var signalReader SignalReader
+
+// getWifiSignalDbm reads the current association of the interface through
+// the platform signal reader. The signal is in the returned LinkInfo.
+func getWifiSignalDbm(interfaceName string) (LinkInfo, string, error) {
+	return signalReader.ReadLink(interfaceName)
+}
+
+// linkCheck reports whether the interface currently has a readable signal.
+func linkCheck(interfaceName string) HealthCheck {
+	_, output, err := getWifiSignalDbm(interfaceName)
+	check := HealthCheck{Name: "link signal", OK: err == nil, Critical: true}
+	if err != nil {
+		check.Detail = strings.TrimSpace(output)
+		if check.Detail == "" {
+			check.Detail = err.Error()
+		}
+		check.Hint = "associate the interface with the surveyed network; unassociated samples are stored as -999 dBm"
+	}
+	return check
+}
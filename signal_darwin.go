@@ -0,0 +1,158 @@
+//go:build darwin
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultInterfaceName = "en0"
+
+const airportPath = "/System/Library/PrivateFrameworks/Apple80211.framework/Versions/Current/Resources/airport"
+
+// airportReader reads the link with `airport -I`, falling back to
+// system_profiler on macOS releases that no longer ship airport.
+type airportReader struct{}
+
+var profilerSignalRe = regexp.MustCompile(`Signal / Noise:\s*(-?\d+) dBm`)
+
+func newSignalReader() SignalReader {
+	return airportReader{}
+}
+
+func (airportReader) ReadLink(interfaceName string) (LinkInfo, string, error) {
+	if _, err := os.Stat(airportPath); err == nil {
+		output, err := exec.Command(airportPath, "-I").CombinedOutput()
+		if err != nil {
+			return LinkInfo{}, string(output), err
+		}
+		info, ok := parseAirportInfo(string(output))
+		if !ok {
+			return info, string(output), fmt.Errorf("signal not found")
+		}
+		return info, string(output), nil
+	}
+
+	output, err := exec.Command("system_profiler", "SPAirPortDataType").CombinedOutput()
+	if err != nil {
+		return LinkInfo{}, string(output), err
+	}
+	info, ok := parseSystemProfiler(string(output), interfaceName)
+	if !ok {
+		return info, string(output), fmt.Errorf("signal not found")
+	}
+	return info, string(output), nil
+}
+
+// parseAirportInfo reads the "key: value" lines of `airport -I`.
+func parseAirportInfo(output string) (LinkInfo, bool) {
+	var info LinkInfo
+	found := false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(key) {
+		case "agrCtlRSSI":
+			info.Signal, _ = strconv.Atoi(value)
+			found = true
+		case "SSID":
+			info.SSID = value
+		case "BSSID":
+			info.BSSID = normalizeBSSID(value)
+			info.Connected = true
+		case "channel":
+			channel, _, _ := strings.Cut(value, ",")
+			info.Channel, _ = strconv.Atoi(channel)
+			info.Freq = channelToFrequency(info.Channel, "")
+			info.Band = bandForFrequency(info.Freq)
+		case "lastTxRate":
+			info.TxBitrate, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+
+	return info, found
+}
+
+// parseSystemProfiler reads the current network of the interface from
+// `system_profiler SPAirPortDataType`. The BSSID is not reported there.
+func parseSystemProfiler(output, interfaceName string) (LinkInfo, bool) {
+	var info LinkInfo
+	inInterface, inCurrent, found := false, false, false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasSuffix(trimmed, ":") && strings.HasPrefix(trimmed, "en"):
+			inInterface = strings.TrimSuffix(trimmed, ":") == interfaceName
+			inCurrent = false
+		case !inInterface:
+		case trimmed == "Current Network Information:":
+			inCurrent = true
+		case inCurrent && strings.HasSuffix(trimmed, ":") && info.SSID == "":
+			info.SSID = strings.TrimSuffix(trimmed, ":")
+			info.Connected = true
+		case inCurrent && strings.HasPrefix(trimmed, "Channel:"):
+			fields := strings.Fields(strings.TrimPrefix(trimmed, "Channel:"))
+			if len(fields) > 0 {
+				info.Channel, _ = strconv.Atoi(fields[0])
+				band := ""
+				if strings.Contains(trimmed, "6GHz") {
+					band = "6"
+				}
+				info.Freq = channelToFrequency(info.Channel, band)
+				info.Band = bandForFrequency(info.Freq)
+			}
+		case inCurrent && strings.HasPrefix(trimmed, "Transmit Rate:"):
+			info.TxBitrate, _ = strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(trimmed, "Transmit Rate:")), 64)
+		case inCurrent && profilerSignalRe.MatchString(trimmed):
+			info.Signal, _ = strconv.Atoi(profilerSignalRe.FindStringSubmatch(trimmed)[1])
+			found = true
+		case inCurrent && strings.HasSuffix(trimmed, ":") && strings.Contains(trimmed, "Other Local Wi-Fi Networks"):
+			inCurrent = false
+		}
+	}
+
+	return info, found
+}
+
+// normalizeBSSID pads the octets airport prints without leading zeros.
+func normalizeBSSID(value string) string {
+	octets := strings.Split(strings.ToLower(value), ":")
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+	return strings.Join(octets, ":")
+}
+
+func (airportReader) ValidInterface(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+func (r airportReader) Check(interfaceName string) []HealthCheck {
+	ifaceCheck := HealthCheck{Name: "wireless interface", Critical: true, Detail: interfaceName, OK: r.ValidInterface(interfaceName)}
+	if !ifaceCheck.OK {
+		ifaceCheck.Hint = "interface does not exist; the built-in Wi-Fi is usually en0 (networksetup -listallhardwareports)"
+		return []HealthCheck{ifaceCheck}
+	}
+
+	return []HealthCheck{ifaceCheck, linkCheck(interfaceName)}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const defaultInterfaceName = "wlp0s20f3"
+
+var signalBackend = flag.String("signal-backend", "auto", "how the link is read on Linux: nl80211, iw, or auto (nl80211 when available)")
+
+// iwReader reads the link through `iw dev <iface> link`.
+type iwReader struct{}
+
+func newSignalReader() SignalReader {
+	switch *signalBackend {
+	case "iw":
+		return iwReader{}
+	case "nl80211":
+		reader, err := newNL80211Reader()
+		if err != nil {
+			log.Fatal("Failed to open nl80211: ", err)
+		}
+		return reader
+	}
+
+	reader, err := newNL80211Reader()
+	if err != nil {
+		log.Printf("nl80211 unavailable (%v), reading the link with iw", err)
+		return iwReader{}
+	}
+	return reader
+}
+
+func (iwReader) ReadLink(interfaceName string) (LinkInfo, string, error) {
+	cmd := exec.Command("iw", "dev", interfaceName, "link")
+	output, err := cmd.CombinedOutput()
+	info := parseLinkInfo(string(output))
+	if err != nil {
+		return info, string(output), err
+	}
+
+	if !linkSignalRe.Match(output) {
+		return info, string(output), fmt.Errorf("signal not found")
+	}
+
+	return info, string(output), nil
+}
+
+func (iwReader) ValidInterface(name string) bool {
+	return isWirelessInterface(name)
+}
+
+func (iwReader) Check(interfaceName string) []HealthCheck {
+	var checks []HealthCheck
+
+	iwPath, err := exec.LookPath("iw")
+	iwCheck := HealthCheck{Name: "iw binary", OK: err == nil, Critical: true, Detail: iwPath}
+	if err != nil {
+		iwCheck.Detail = err.Error()
+		iwCheck.Hint = "install the iw package (apt install iw / dnf install iw)"
+	}
+	checks = append(checks, iwCheck)
+
+	ifaceCheck := wirelessInterfaceCheck(interfaceName)
+	checks = append(checks, ifaceCheck)
+
+	if iwCheck.OK && ifaceCheck.OK {
+		checks = append(checks, linkCheck(interfaceName))
+	}
+
+	return append(checks, scanPermissionCheck())
+}
+
+func isWirelessInterface(name string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", name, "phy80211"))
+	return err == nil
+}
+
+func wirelessInterfaceCheck(interfaceName string) HealthCheck {
+	check := HealthCheck{Name: "wireless interface", Critical: true, Detail: interfaceName}
+	if _, err := os.Stat(filepath.Join("/sys/class/net", interfaceName)); err != nil {
+		check.Hint = "interface does not exist; list wireless interfaces with `iw dev`"
+	} else if !isWirelessInterface(interfaceName) {
+		check.Hint = "interface exists but is not a wireless (nl80211) device"
+	} else {
+		check.OK = true
+	}
+	return check
+}
+
+// scanPermissionCheck reports whether scans can be triggered. Scans and the
+// regulatory domain are read with iw regardless of the signal backend.
+func scanPermissionCheck() HealthCheck {
+	check := HealthCheck{Name: "scan permission", OK: os.Geteuid() == 0 || hasCapability(capNetAdmin)}
+	if !check.OK {
+		check.Hint = "run as root or grant CAP_NET_ADMIN (setcap cap_net_admin+ep) to trigger scans"
+	}
+	return check
+}
@@ -0,0 +1,34 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const defaultInterfaceName = "wlan0"
+
+// unsupportedReader is used on platforms without a signal reader.
+type unsupportedReader struct{}
+
+func newSignalReader() SignalReader {
+	return unsupportedReader{}
+}
+
+func (unsupportedReader) ReadLink(string) (LinkInfo, string, error) {
+	return LinkInfo{}, "", fmt.Errorf("reading the Wi-Fi signal is not supported on %s", runtime.GOOS)
+}
+
+func (unsupportedReader) ValidInterface(string) bool {
+	return false
+}
+
+func (unsupportedReader) Check(string) []HealthCheck {
+	return []HealthCheck{{
+		Name:     "signal reader",
+		Critical: true,
+		Detail:   runtime.GOOS,
+		Hint:     "no signal reader is available for this platform; use Linux, macOS or Windows",
+	}}
+}
@@ -0,0 +1,107 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const defaultInterfaceName = "Wi-Fi"
+
+// netshReader reads the link with `netsh wlan show interfaces`.
+type netshReader struct{}
+
+func newSignalReader() SignalReader {
+	return netshReader{}
+}
+
+func (netshReader) ReadLink(interfaceName string) (LinkInfo, string, error) {
+	output, err := exec.Command("netsh", "wlan", "show", "interfaces").CombinedOutput()
+	if err != nil {
+		return LinkInfo{}, string(output), err
+	}
+
+	info, ok := parseNetshInterfaces(string(output), interfaceName)
+	if !ok {
+		return info, string(output), fmt.Errorf("signal not found")
+	}
+	return info, string(output), nil
+}
+
+// parseNetshInterfaces reads the section of the named interface. Windows 11
+// reports the RSSI directly; older releases only give a signal quality in
+// percent, which is converted with the usual dBm = quality/2 - 100.
+func parseNetshInterfaces(output, interfaceName string) (LinkInfo, bool) {
+	var info LinkInfo
+	inInterface, found, haveRSSI := false, false, false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "Name" {
+			inInterface = strings.EqualFold(value, interfaceName)
+			continue
+		}
+		if !inInterface {
+			continue
+		}
+
+		switch key {
+		case "State":
+			info.Connected = value == "connected"
+		case "SSID":
+			info.SSID = value
+		case "BSSID", "AP BSSID":
+			info.BSSID = strings.ToLower(value)
+		case "Channel":
+			info.Channel, _ = strconv.Atoi(value)
+		case "Band":
+			info.Band = strings.TrimSuffix(value, " GHz")
+		case "Receive rate (Mbps)":
+			info.RxBitrate, _ = strconv.ParseFloat(value, 64)
+		case "Transmit rate (Mbps)":
+			info.TxBitrate, _ = strconv.ParseFloat(value, 64)
+		case "Rssi":
+			info.Signal, _ = strconv.Atoi(value)
+			found, haveRSSI = true, true
+		case "Signal":
+			quality, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err == nil && !haveRSSI {
+				info.Signal = quality/2 - 100
+				found = true
+			}
+		}
+	}
+
+	info.Freq = channelToFrequency(info.Channel, info.Band)
+	if info.Band == "" {
+		info.Band = bandForFrequency(info.Freq)
+	}
+
+	return info, found && info.Connected
+}
+
+func (netshReader) ValidInterface(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+func (r netshReader) Check(interfaceName string) []HealthCheck {
+	ifaceCheck := HealthCheck{Name: "wireless interface", Critical: true, Detail: interfaceName, OK: r.ValidInterface(interfaceName)}
+	if !ifaceCheck.OK {
+		ifaceCheck.Hint = "interface does not exist; list wireless interfaces with `netsh wlan show interfaces`"
+		return []HealthCheck{ifaceCheck}
+	}
+
+	return []HealthCheck{ifaceCheck, linkCheck(interfaceName)}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// siteSeparator joins the site ID and the random part of a measurement ID.
+// generateID never produces it, so the site can be recovered from an ID.
+const siteSeparator = "_"
+
+var (
+	siteID = flag.String("site-id", envOrDefault("HEATGEN_SITE_ID", ""), "identifier of this server prefixed to measurement IDs, so data merged from several sites never collides (env HEATGEN_SITE_ID)")
+
+	siteIDRe = regexp.MustCompile(`^[A-Za-z0-9-]{1,32}$`)
+)
+
+func validateSiteID() error {
+	if *siteID != "" && !siteIDRe.MatchString(*siteID) {
+		return fmt.Errorf("site ID %q must be 1-32 letters, digits or dashes", *siteID)
+	}
+	return nil
+}
+
+// newMeasurementID returns a measurement ID in the namespace of this site.
+// Scan and track IDs use it too, as they group measurements.
+func newMeasurementID() string {
+	if *siteID == "" {
+		return generateID()
+	}
+	return *siteID + siteSeparator + generateID()
+}
+
+// measurementSite returns the site a measurement ID was created on, or ""
+// for IDs from servers without a site ID.
+func measurementSite(id string) string {
+	site, _, found := strings.Cut(id, siteSeparator)
+	if !found {
+		return ""
+	}
+	return site
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultSLACoverage = 95
+	maxSLARegions      = 20
+)
+
+// Vertex is a polygon corner in floor coordinates (CRS.Simple, like
+// measurements).
+type Vertex struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// SLARule requires that the signal meets Threshold over at least Coverage
+// percent of the floor, or of Region when one is given. Zone names a saved
+// zone to use as the region.
+type SLARule struct {
+	Name      string   `json:"name,omitempty"`
+	Threshold string   `json:"threshold"`
+	Coverage  float64  `json:"coverage,omitempty"`
+	Region    []Vertex `json:"region,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+}
+
+type SLARuleResult struct {
+	Name             string  `json:"name,omitempty"`
+	MinDbm           int     `json:"minDbm"`
+	RequiredCoverage float64 `json:"requiredCoverage"`
+	Coverage         float64 `json:"coverage"`
+	AreaPixels       float64 `json:"areaPixels"`
+	AreaSquareMeters float64 `json:"areaSquareMeters,omitempty"`
+	Pass             bool    `json:"pass"`
+	// Unevaluated marks a rule whose area holds no grid node, being
+	// smaller than the grid step or outside the floor. It does not pass.
+	Unevaluated         bool        `json:"unevaluated,omitempty"`
+	FailingRegions      []SLARegion `json:"failingRegions"`
+	TotalFailingRegions int         `json:"totalFailingRegions"`
+}
+
+// SLARegion is a connected area below the rule's threshold.
+type SLARegion struct {
+	MinLat           float64 `json:"minLat"`
+	MinLng           float64 `json:"minLng"`
+	MaxLat           float64 `json:"maxLat"`
+	MaxLng           float64 `json:"maxLng"`
+	Lat              float64 `json:"lat"`
+	Lng              float64 `json:"lng"`
+	AreaPixels       float64 `json:"areaPixels"`
+	AreaSquareMeters float64 `json:"areaSquareMeters,omitempty"`
+	MeanDbm          float64 `json:"meanDbm"`
+	WorstDbm         float64 `json:"worstDbm"`
+	// Outline traces the outer boundary of the region's grid cells.
+	Outline []Vertex `json:"outline"`
+}
+
+type SLAResult struct {
+	Floor    int             `json:"floor"`
+	Revision string          `json:"revision"`
+	Pass     bool            `json:"pass"`
+	Rules    []SLARuleResult `json:"rules"`
+}
+
+// polygonContains reports whether the point lies inside the polygon, by ray
+// casting.
+func polygonContains(polygon []Vertex, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lng < (b.Lng-a.Lng)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// resolveSLARules validates the rules and replaces zone references by their
+// polygons.
+func resolveSLARules(rules []SLARule, floorID int) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("at least one rule is required")
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Zone != "" {
+			zone, exists := getZone(rule.Zone)
+			if !exists || zone.Floor != floorID {
+				return fmt.Errorf("rule %d: zone %q not found on this floor", i+1, rule.Zone)
+			}
+			rule.Region = zone.Polygon
+			if rule.Name == "" {
+				rule.Name = zone.Name
+			}
+		}
+		if rule.Coverage < 0 || rule.Coverage > 100 {
+			return fmt.Errorf("rule %d: coverage must be between 0 and 100 percent", i+1)
+		}
+		if len(rule.Region) > 0 && len(rule.Region) < 3 {
+			return fmt.Errorf("rule %d: region needs at least 3 vertices", i+1)
+		}
+		if _, err := thresholdParam(url.Values{"threshold": {rule.Threshold}}); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// evaluateSLA checks every rule against the interpolated grid. Each grid
+// node inside the floor stands for one cell of the grid; a rule whose area
+// holds none is marked unevaluated.
+func evaluateSLA(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, rules []SLARule) ([]SLARuleResult, error) {
+	bounds, _, err := floorBounds(floor, ms)
+	if err != nil {
+		return nil, err
+	}
+
+	grid, err := interpolateGrid(ctx, bounds, ms, params)
+	if err != nil {
+		return nil, err
+	}
+	if grid.Values == nil {
+		return nil, fmt.Errorf("floor has no measurements to evaluate")
+	}
+
+	metersPerPixel := floor.metersPerPixel()
+
+	results := make([]SLARuleResult, 0, len(rules))
+	for _, rule := range rules {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		profile, _ := thresholdParam(url.Values{"threshold": {rule.Threshold}})
+		result := SLARuleResult{
+			Name:             rule.Name,
+			MinDbm:           profile.MinDbm,
+			RequiredCoverage: rule.Coverage,
+			FailingRegions:   []SLARegion{},
+		}
+		if result.RequiredCoverage == 0 {
+			result.RequiredCoverage = defaultSLACoverage
+		}
+
+		// failing marks grid nodes inside the rule's area that miss the
+		// threshold; nodes outside the area stay unmarked.
+		failing := make([]bool, len(grid.Values))
+		var total, passed int
+		for row := 0; row < grid.Rows; row++ {
+			for col := 0; col < grid.Cols; col++ {
+				x, y := col*grid.Step, row*grid.Step
+				if x >= bounds.Dx() || y >= bounds.Dy() {
+					continue
+				}
+				if len(rule.Region) > 0 && !polygonContains(rule.Region, float64(bounds.Dy()-y), float64(x)) {
+					continue
+				}
+
+				total++
+				if grid.Values[row*grid.Cols+col] >= float64(profile.MinDbm) {
+					passed++
+				} else {
+					failing[row*grid.Cols+col] = true
+				}
+			}
+		}
+		if total == 0 {
+			result.Unevaluated = true
+			results = append(results, result)
+			continue
+		}
+
+		result.Coverage = math.Round(float64(passed)/float64(total)*1000) / 10
+		result.AreaPixels = float64(total * grid.Step * grid.Step)
+		if metersPerPixel > 0 {
+			result.AreaSquareMeters = math.Round(result.AreaPixels*metersPerPixel*metersPerPixel*10) / 10
+		}
+		result.Pass = result.Coverage >= result.RequiredCoverage
+
+		regions := failingRegions(grid, failing, metersPerPixel)
+		result.TotalFailingRegions = len(regions)
+		if len(regions) > maxSLARegions {
+			regions = regions[:maxSLARegions]
+		}
+		result.FailingRegions = append(result.FailingRegions, regions...)
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// evaluated returns an error for a rule that could not be evaluated, for
+// callers that evaluate a single rule.
+func (r SLARuleResult) evaluated() error {
+	if !r.Unevaluated {
+		return nil
+	}
+	if r.Name == "" {
+		return fmt.Errorf("the area covers no grid node of the floor, use a finer grid")
+	}
+	return fmt.Errorf("rule %q covers no grid node of the floor, use a finer grid", r.Name)
+}
+
+// failingRegions groups 4-connected failing grid nodes into regions, largest
+// first.
+func failingRegions(grid *signalGrid, failing []bool, metersPerPixel float64) []SLARegion {
+	height := float64(grid.Bounds.Dy())
+	cellArea := float64(grid.Step * grid.Step)
+	seen := make([]bool, len(failing))
+
+	var regions []SLARegion
+	for start := range failing {
+		if !failing[start] || seen[start] {
+			continue
+		}
+
+		region := SLARegion{MinLat: math.Inf(1), MinLng: math.Inf(1), MaxLat: math.Inf(-1), MaxLng: math.Inf(-1), WorstDbm: math.Inf(1)}
+		var cells int
+		var nodes []int
+		stack := []int{start}
+		seen[start] = true
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			row, col := node/grid.Cols, node%grid.Cols
+			lat, lng := height-float64(row*grid.Step), float64(col*grid.Step)
+			value := grid.Values[node]
+
+			cells++
+			nodes = append(nodes, node)
+			region.MinLat, region.MaxLat = math.Min(region.MinLat, lat), math.Max(region.MaxLat, lat)
+			region.MinLng, region.MaxLng = math.Min(region.MinLng, lng), math.Max(region.MaxLng, lng)
+			region.Lat += lat
+			region.Lng += lng
+			region.MeanDbm += value
+			region.WorstDbm = math.Min(region.WorstDbm, value)
+
+			for _, next := range [][2]int{{row - 1, col}, {row + 1, col}, {row, col - 1}, {row, col + 1}} {
+				if next[0] < 0 || next[0] >= grid.Rows || next[1] < 0 || next[1] >= grid.Cols {
+					continue
+				}
+				n := next[0]*grid.Cols + next[1]
+				if failing[n] && !seen[n] {
+					seen[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+
+		region.Lat = math.Round(region.Lat/float64(cells)*10) / 10
+		region.Lng = math.Round(region.Lng/float64(cells)*10) / 10
+		region.MeanDbm = math.Round(region.MeanDbm/float64(cells)*10) / 10
+		region.WorstDbm = math.Round(region.WorstDbm*10) / 10
+		region.AreaPixels = float64(cells) * cellArea
+		if metersPerPixel > 0 {
+			region.AreaSquareMeters = math.Round(region.AreaPixels*metersPerPixel*metersPerPixel*10) / 10
+		}
+		region.Outline = traceOutline(grid, nodes)
+		regions = append(regions, region)
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].AreaPixels > regions[j].AreaPixels
+	})
+	return regions
+}
+
+// traceOutline returns the outer boundary of a connected set of grid nodes,
+// each covering a square cell of one grid step around it. The cell edges
+// that border on cells outside the set are chained into loops and the
+// largest loop is returned, clipped to the floor.
+func traceOutline(grid *signalGrid, nodes []int) []Vertex {
+	inSet := make(map[int]bool, len(nodes))
+	for _, node := range nodes {
+		inSet[node] = true
+	}
+	member := func(row, col int) bool {
+		return row >= 0 && col >= 0 && row < grid.Rows && col < grid.Cols && inSet[row*grid.Cols+col]
+	}
+
+	// Corners are numbered on a (Rows+1) x (Cols+1) lattice, corner (r, c)
+	// being the top-left corner of cell (r, c). Edges run clockwise.
+	type corner struct{ row, col int }
+	edges := make(map[corner][]corner)
+	for _, node := range nodes {
+		row, col := node/grid.Cols, node%grid.Cols
+		if !member(row-1, col) {
+			edges[corner{row, col}] = append(edges[corner{row, col}], corner{row, col + 1})
+		}
+		if !member(row, col+1) {
+			edges[corner{row, col + 1}] = append(edges[corner{row, col + 1}], corner{row + 1, col + 1})
+		}
+		if !member(row+1, col) {
+			edges[corner{row + 1, col + 1}] = append(edges[corner{row + 1, col + 1}], corner{row + 1, col})
+		}
+		if !member(row, col-1) {
+			edges[corner{row + 1, col}] = append(edges[corner{row + 1, col}], corner{row, col})
+		}
+	}
+
+	var best []corner
+	var bestArea float64
+	for len(edges) > 0 {
+		var start corner
+		for start = range edges {
+			break
+		}
+
+		loop := []corner{start}
+		for current := start; ; {
+			next := edges[current]
+			if len(next) == 0 {
+				break
+			}
+			edges[current] = next[1:]
+			if len(edges[current]) == 0 {
+				delete(edges, current)
+			}
+			current = next[0]
+			if current == start {
+				break
+			}
+			loop = append(loop, current)
+		}
+
+		var area float64
+		for i := range loop {
+			a, b := loop[i], loop[(i+1)%len(loop)]
+			area += float64(a.col*b.row - b.col*a.row)
+		}
+		if math.Abs(area) > bestArea {
+			best, bestArea = loop, math.Abs(area)
+		}
+	}
+
+	width, height := float64(grid.Bounds.Dx()), float64(grid.Bounds.Dy())
+	half := float64(grid.Step) / 2
+	var outline []Vertex
+	for i, c := range best {
+		prev, next := best[(i+len(best)-1)%len(best)], best[(i+1)%len(best)]
+		if (prev.row == c.row && c.row == next.row) || (prev.col == c.col && c.col == next.col) {
+			continue
+		}
+
+		x := math.Max(0, math.Min(width, float64(c.col*grid.Step)-half))
+		y := math.Max(0, math.Min(height, float64(c.row*grid.Step)-half))
+		outline = append(outline, Vertex{Lat: height - y, Lng: x})
+	}
+	return outline
+}
+
+// slaHandler evaluates coverage rules against the current data of a floor.
+// GET evaluates a single floor-wide rule from the threshold and coverage
+// query parameters; POST takes {"rules": [...]}. Heatmap query parameters
+// select the measurements and the interpolation.
+func slaHandler(w http.ResponseWriter, r *http.Request, floorID int) {
+	query := r.URL.Query()
+
+	var rules []SLARule
+	switch r.Method {
+	case "GET":
+		rule := SLARule{Threshold: query.Get("threshold")}
+		if value := query.Get("coverage"); value != "" {
+			coverage, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				http.Error(w, "invalid coverage", http.StatusBadRequest)
+				return
+			}
+			rule.Coverage = coverage
+		}
+		rules = []SLARule{rule}
+	case "POST":
+		var req struct {
+			Rules []SLARule `json:"rules"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules = req.Rules
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := resolveSLARules(rules, floorID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		results, err := evaluateSLA(ctx, floor, filtered, params, rules)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "SLA evaluation timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := SLAResult{Floor: floorID, Revision: revision, Pass: true, Rules: results}
+		for _, rule := range results {
+			result.Pass = result.Pass && rule.Pass
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
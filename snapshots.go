@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const snapshotsFile = "snapshots.json"
+
+var (
+	snapshots     = make(map[string]Snapshot)
+	snapshotsLock sync.Mutex
+)
+
+// Snapshot freezes the measurements of a floor together with the heatmap
+// parameters, so the same heatmap can be reproduced after the data changes.
+// Params hold every parameter resolved when the snapshot was taken, the
+// server defaults included, and FloorPlan the floor as it was then, with
+// its own copy of the map.
+type Snapshot struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Floor        int               `json:"floor"`
+	FloorPlan    *Floor            `json:"floorPlan,omitempty"`
+	Params       map[string]string `json:"params,omitempty"`
+	Revision     string            `json:"revision"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	Measurements []Measurement     `json:"measurements,omitempty"`
+}
+
+// resolveSnapshotParams validates the heatmap parameters of a snapshot and
+// adds those that default to the server settings or built-in values, so a
+// change of the settings doesn't change how the snapshot renders.
+func resolveSnapshotParams(given map[string]string) (map[string]string, error) {
+	query := url.Values{}
+	for key, value := range given {
+		query.Set(key, value)
+	}
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make(map[string]string, len(given))
+	for key, value := range given {
+		resolved[key] = value
+	}
+	if resolved["metric"] == "" {
+		resolved["metric"] = defaultMetric
+	}
+	formatFloat := func(value float64) string { return strconv.FormatFloat(value, 'g', -1, 64) }
+	resolved["method"], resolved["scale"], resolved["maskStyle"] = params.Method, params.Scale, params.MaskStyle
+	resolved["grid"] = strconv.Itoa(params.Grid)
+	resolved["min"], resolved["max"] = formatFloat(params.Min), formatFloat(params.Max)
+	resolved["opacity"], resolved["power"] = formatFloat(params.Opacity), formatFloat(params.Power)
+	return resolved, nil
+}
+
+// snapshotMapFile is the name of the copy of the floor map kept for a
+// snapshot.
+func snapshotMapFile(id, mapPath string) string {
+	return fmt.Sprintf("snapshot_%s_map%s", id, path.Ext(mapPath))
+}
+
+// copySnapshotMap copies the map of floor for the snapshot id, since the
+// floor's own file is replaced by a new upload and removed with the floor.
+// It returns the floor pointing at the copy.
+func copySnapshotMap(id string, floor Floor) (Floor, error) {
+	if floor.MapPath == "" {
+		return floor, nil
+	}
+	data, err := os.ReadFile(uploadFile(floor.MapPath))
+	if err != nil {
+		return floor, err
+	}
+	name := snapshotMapFile(id, floor.MapPath)
+	if err := writeFileAtomic(filepath.Join(projectUploads(), name), data, 0644); err != nil {
+		return floor, err
+	}
+	floor.MapPath = uploadURL(name)
+	return floor, nil
+}
+
+func loadSnapshots() error {
+	snapshotsLock.Lock()
+	defer snapshotsLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(snapshotsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &snapshots)
+}
+
+func saveSnapshots() error {
+	snapshotsLock.Lock()
+	defer snapshotsLock.Unlock()
+
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(snapshotsFile), data, 0644)
+}
+
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		snapshotsLock.Lock()
+		list := []Snapshot{}
+		for _, s := range snapshots {
+			s.Measurements = nil
+			list = append(list, s)
+		}
+		snapshotsLock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		var req struct {
+			Name   string            `json:"name"`
+			Floor  int               `json:"floor"`
+			Params map[string]string `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if req.Name, err = cleanText("name", req.Name, maxNameLength, false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		params, err := resolveSnapshotParams(req.Params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snapshot := Snapshot{
+			ID:        generateID(),
+			Name:      req.Name,
+			Floor:     req.Floor,
+			Params:    params,
+			CreatedAt: time.Now(),
+		}
+
+		mutex.Lock()
+		floor, floorExists := floors[req.Floor]
+		snapshot.Revision = dataRevision
+		for _, m := range measurements {
+			if req.Floor <= 0 || m.Floor == req.Floor {
+				snapshot.Measurements = append(snapshot.Measurements, m)
+			}
+		}
+		mutex.Unlock()
+
+		if floorExists {
+			if floor.Calibration != nil {
+				calibration := *floor.Calibration
+				floor.Calibration = &calibration
+			}
+			if floor.Scale != nil {
+				scale := *floor.Scale
+				floor.Scale = &scale
+			}
+			if floor, err = copySnapshotMap(snapshot.ID, floor); err != nil {
+				log.Printf("failed to copy the map of floor %d for snapshot %s: %v", floor.ID, snapshot.ID, err)
+				http.Error(w, "failed to copy the floor map", http.StatusInternalServerError)
+				return
+			}
+			snapshot.FloorPlan = &floor
+		}
+
+		snapshotsLock.Lock()
+		snapshots[snapshot.ID] = snapshot
+		snapshotsLock.Unlock()
+
+		if err := saveSnapshots(); err != nil {
+			http.Error(w, "failed to save snapshot", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snapshot)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	snapshotsLock.Lock()
+	snapshot, exists := snapshots[id]
+	snapshotsLock.Unlock()
+
+	if !exists {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshot)
+	case "DELETE":
+		snapshotsLock.Lock()
+		delete(snapshots, id)
+		snapshotsLock.Unlock()
+
+		if err := saveSnapshots(); err != nil {
+			http.Error(w, "failed to save snapshots", http.StatusInternalServerError)
+			return
+		}
+		if snapshot.FloorPlan != nil && snapshot.FloorPlan.MapPath != "" {
+			if err := os.Remove(uploadFile(snapshot.FloorPlan.MapPath)); err != nil && !os.IsNotExist(err) {
+				log.Printf("failed to delete the map of snapshot %s: %v", id, err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshotImageHandler renders a snapshot from its frozen measurements,
+// parameters and floor, so later data changes don't affect the result.
+// Snapshots taken before the floor was stored with them use the current
+// floor.
+func snapshotImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshotsLock.Lock()
+	snapshot, exists := snapshots[r.PathValue("id")]
+	snapshotsLock.Unlock()
+
+	if !exists {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	query := url.Values{}
+	for key, value := range snapshot.Params {
+		query.Set(key, value)
+	}
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var floor Floor
+	if snapshot.FloorPlan != nil {
+		floor = *snapshot.FloorPlan
+	} else {
+		mutex.Lock()
+		floor, exists = floors[snapshot.Floor]
+		mutex.Unlock()
+
+		if !exists {
+			floor = Floor{ID: snapshot.Floor}
+		}
+	}
+
+	writeHeatmap(w, r, floor, snapshot.Measurements, params, "png")
+}
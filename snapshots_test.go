@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestResolveSnapshotParams checks that a snapshot keeps the parameters it
+// was taken with, and renders the same after the server settings change.
+func TestResolveSnapshotParams(t *testing.T) {
+	setDefaults := func(palette, interpolation string) {
+		serverSettingsLock.Lock()
+		serverSettings.Palette, serverSettings.Interpolation = palette, interpolation
+		serverSettingsLock.Unlock()
+	}
+	serverSettingsLock.Lock()
+	old := serverSettings
+	serverSettingsLock.Unlock()
+	setDefaults("viridis", "idw")
+	t.Cleanup(func() {
+		serverSettingsLock.Lock()
+		serverSettings = old
+		serverSettingsLock.Unlock()
+	})
+
+	tests := []struct {
+		given   map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			given: nil,
+			want: map[string]string{
+				"metric": "signal", "method": "idw", "scale": "viridis", "grid": "10",
+				"min": "-90", "max": "-30", "opacity": "0.6", "power": "2", "maskStyle": "fade",
+			},
+		},
+		{
+			given: map[string]string{"scale": "grayscale", "min": "-85.5", "grid": "5", "ssid": "Office"},
+			want: map[string]string{
+				"metric": "signal", "method": "idw", "scale": "grayscale", "grid": "5",
+				"min": "-85.5", "max": "-30", "opacity": "0.6", "power": "2", "maskStyle": "fade",
+				"ssid": "Office",
+			},
+		},
+		{given: map[string]string{"scale": "plasma"}, wantErr: true},
+		{given: map[string]string{"min": "-20"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := resolveSnapshotParams(test.given)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: resolved %v, want an error", test.given, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.given, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: resolved %v, want %v", test.given, got, test.want)
+		}
+
+		setDefaults("default", "kriging")
+		again, err := resolveSnapshotParams(got)
+		setDefaults("viridis", "idw")
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("%v: resolved %v after the settings changed, want %v", test.given, again, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Signal sources are the radios measurements are taken of. Wi-Fi
+// measurements store no source.
+const (
+	sourceWiFi     = "wifi"
+	sourceCellular = "cellular"
+	sourceBLE      = "ble"
+	// sourceAll selects every source in queries.
+	sourceAll = "all"
+)
+
+// SignalSource takes the measurements of one radio. Wi-Fi is sampled
+// through the platform SignalReader; the other sources have their own
+// readers, see cellular.go and ble.go.
+type SignalSource interface {
+	// Prepare checks a measurement request for the source and fills in
+	// its defaults, such as the device read.
+	Prepare(req *MeasurementRequest) error
+	// Measure takes and saves the measurements of a request. progress is
+	// called after every sample of sources that take several.
+	Measure(ctx context.Context, req MeasurementRequest, progress func(taken int)) ([]Measurement, error)
+	// Check probes the prerequisites of the source for /readyz.
+	Check() []HealthCheck
+}
+
+var signalSources = map[string]SignalSource{
+	sourceWiFi:     wifiSource{},
+	sourceCellular: cellularSource{},
+	sourceBLE:      bleSource{},
+}
+
+func (m Measurement) source() string {
+	if m.Source == "" {
+		return sourceWiFi
+	}
+	return m.Source
+}
+
+func (req MeasurementRequest) source() string {
+	if req.Source == "" {
+		return sourceWiFi
+	}
+	return req.Source
+}
+
+// minSourceDbm is the weakest signal a source reports: cellular RSRP goes
+// down to -157 dBm on 5G, well below what Wi-Fi and BLE radios read.
+func minSourceDbm(source string) int {
+	if source == sourceCellular {
+		return -157
+	}
+	return -120
+}
+
+// measurementSource checks the source given for new measurements and
+// returns the one to store.
+func measurementSource(source string) (string, error) {
+	if source == "" || source == sourceWiFi {
+		return "", nil
+	}
+	if _, known := signalSources[source]; !known {
+		return "", fmt.Errorf("source must be wifi, cellular or ble")
+	}
+	return source, nil
+}
+
+// parseSource reads ?source of queries. Listings and heatmaps show Wi-Fi
+// unless another source or all is asked for, since the signal of other
+// radios is not comparable.
+func parseSource(query url.Values) (string, error) {
+	switch source := query.Get("source"); source {
+	case "":
+		return sourceWiFi, nil
+	case sourceAll:
+		return source, nil
+	default:
+		if _, known := signalSources[source]; known {
+			return source, nil
+		}
+	}
+	return "", fmt.Errorf("source must be wifi, cellular, ble or all")
+}
+
+// inSource reports whether a measurement is of the source; the empty
+// source, like all, matches every measurement.
+func inSource(m Measurement, source string) bool {
+	return source == "" || source == sourceAll || m.source() == source
+}
+
+// sourceMeasurements returns the measurements of a source.
+func sourceMeasurements(ms []Measurement, source string) []Measurement {
+	if source == "" || source == sourceAll {
+		return ms
+	}
+	var result []Measurement
+	for _, m := range ms {
+		if inSource(m, source) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// sourceChecks probes the sources other than Wi-Fi, whose checks are
+// never critical as most setups survey Wi-Fi alone.
+func sourceChecks() []HealthCheck {
+	var checks []HealthCheck
+	for _, name := range []string{sourceCellular, sourceBLE} {
+		checks = append(checks, signalSources[name].Check()...)
+	}
+	return checks
+}
+
+// checkWiFiOnly refuses the extras of a request that only Wi-Fi
+// measurements support.
+func checkWiFiOnly(req MeasurementRequest) error {
+	var extras []string
+	if req.Pcap > 0 {
+		extras = append(extras, "pcap")
+	}
+	if req.KeepRaw {
+		extras = append(extras, "raw dumps")
+	}
+	if req.Pings > 0 {
+		extras = append(extras, "pings")
+	}
+	if req.Throughput != "" {
+		extras = append(extras, "throughput tests")
+	}
+	if len(extras) > 0 {
+		return fmt.Errorf("%s are only supported for wifi measurements", strings.Join(extras, " and "))
+	}
+	return nil
+}
+
+// wifiSource samples the associated link of the wireless interface, or
+// scans for every BSS with type scan.
+type wifiSource struct{}
+
+func (wifiSource) Prepare(req *MeasurementRequest) error {
+	if req.Interface == "" {
+		req.Interface = *wifiInterface
+	} else if !validInterface(req.Interface) {
+		return fmt.Errorf("unknown wireless interface %q", req.Interface)
+	}
+	return nil
+}
+
+func (wifiSource) Measure(ctx context.Context, req MeasurementRequest, progress func(taken int)) ([]Measurement, error) {
+	if req.Type == "scan" {
+		return takeScan(ctx, req)
+	}
+	record, err := takeMeasurement(ctx, req, progress)
+	if err != nil {
+		return nil, err
+	}
+	return []Measurement{record}, nil
+}
+
+func (wifiSource) Check() []HealthCheck {
+	return checkSignalBackend(*wifiInterface)
+}
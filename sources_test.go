@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "", want: sourceWiFi},
+		{query: "source=wifi", want: sourceWiFi},
+		{query: "source=cellular", want: sourceCellular},
+		{query: "source=ble", want: sourceBLE},
+		{query: "source=all", want: sourceAll},
+		{query: "source=lora", wantErr: true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		got, err := parseSource(query)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: parsed %#v, want an error", test.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: parsed %#v, want %#v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	fftSampleHT20   = 1
+	fftSampleAth10k = 3
+)
+
+type SpectrumBin struct {
+	Freq    int     `json:"freq"`
+	AvgDbm  float64 `json:"avgDbm"`
+	MaxDbm  float64 `json:"maxDbm"`
+	Samples int     `json:"samples"`
+}
+
+// spectralScan triggers an ath9k/ath10k spectral scan on the given interface
+// and returns the FFT samples summarised into 1 MHz bins.
+func spectralScan(interfaceName string) ([]SpectrumBin, error) {
+	phy, err := os.Readlink(filepath.Join("/sys/class/net", interfaceName, "phy80211"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve phy of %s: %v", interfaceName, err)
+	}
+
+	var debugDir, mode string
+	for driver, driverMode := range map[string]string{"ath9k": "manual", "ath10k": "background"} {
+		dir := filepath.Join("/sys/kernel/debug/ieee80211", filepath.Base(phy), driver)
+		if _, err := os.Stat(filepath.Join(dir, "spectral_scan_ctl")); err == nil {
+			debugDir, mode = dir, driverMode
+			break
+		}
+	}
+	if debugDir == "" {
+		return nil, fmt.Errorf("%s does not support spectral scan (ath9k/ath10k with debugfs required)", interfaceName)
+	}
+
+	ctl := filepath.Join(debugDir, "spectral_scan_ctl")
+	for _, cmd := range []string{mode, "trigger"} {
+		if err := os.WriteFile(ctl, []byte(cmd), 0644); err != nil {
+			return nil, fmt.Errorf("failed to configure spectral scan: %v", err)
+		}
+	}
+	defer os.WriteFile(ctl, []byte("disable"), 0644)
+
+	if output, err := exec.Command("iw", "dev", interfaceName, "scan").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("scan failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	data, err := os.ReadFile(filepath.Join(debugDir, "spectral_scan0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spectral samples: %v", err)
+	}
+
+	return summarizeSpectrum(data), nil
+}
+
+func summarizeSpectrum(data []byte) []SpectrumBin {
+	type accumulator struct {
+		sumMw float64
+		max   float64
+		count int
+	}
+	bins := make(map[int]*accumulator)
+
+	add := func(freq, dbm float64) {
+		key := int(math.Round(freq))
+		acc, ok := bins[key]
+		if !ok {
+			acc = &accumulator{max: math.Inf(-1)}
+			bins[key] = acc
+		}
+		acc.sumMw += math.Pow(10, dbm/10)
+		acc.max = math.Max(acc.max, dbm)
+		acc.count++
+	}
+
+	for len(data) >= 3 {
+		sampleType := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			break
+		}
+		sample := data[3 : 3+length]
+		data = data[3+length:]
+
+		switch {
+		case sampleType == fftSampleHT20 && length == 73:
+			maxExp := uint(sample[0])
+			freq := float64(binary.BigEndian.Uint16(sample[1:3]))
+			rssi := float64(int8(sample[3]))
+			noise := float64(int8(sample[4]))
+			values := sample[17:73]
+			for i, dbm := range fftPowers(values, maxExp, noise+rssi) {
+				add(freq-(22.0*56/64.0)/2+22.0*(float64(i)+0.5)/64.0, dbm)
+			}
+		case sampleType == fftSampleAth10k && length > 26:
+			width := float64(sample[0])
+			freq := float64(binary.BigEndian.Uint16(sample[1:3]))
+			noise := float64(int16(binary.BigEndian.Uint16(sample[5:7])))
+			rssi := float64(sample[22])
+			maxExp := uint(sample[25])
+			values := sample[26:]
+			for i, dbm := range fftPowers(values, maxExp, noise+rssi) {
+				add(freq-width/2+width*(float64(i)+0.5)/float64(len(values)), dbm)
+			}
+		}
+	}
+
+	var spectrum []SpectrumBin
+	for freq, acc := range bins {
+		spectrum = append(spectrum, SpectrumBin{
+			Freq:    freq,
+			AvgDbm:  math.Round(10*math.Log10(acc.sumMw/float64(acc.count))*10) / 10,
+			MaxDbm:  math.Round(acc.max*10) / 10,
+			Samples: acc.count,
+		})
+	}
+	sort.Slice(spectrum, func(i, j int) bool { return spectrum[i].Freq < spectrum[j].Freq })
+
+	return spectrum
+}
+
+// fftPowers converts raw FFT magnitudes into per-bin power in dBm, scaled
+// against the total power reported for the sample.
+func fftPowers(values []byte, maxExp uint, total float64) []float64 {
+	var squareSum float64
+	for _, v := range values {
+		magnitude := float64(int(v) << maxExp)
+		squareSum += magnitude * magnitude
+	}
+	if squareSum == 0 {
+		return nil
+	}
+
+	powers := make([]float64, len(values))
+	for i, v := range values {
+		magnitude := float64(int(v) << maxExp)
+		if magnitude == 0 {
+			magnitude = 1
+		}
+		powers[i] = total + 20*math.Log10(magnitude) - 10*math.Log10(squareSum)
+	}
+
+	return powers
+}
+
+func peakSpectrumDbm(spectrum []SpectrumBin) int {
+	if len(spectrum) == 0 {
+		return -999
+	}
+
+	peak := math.Inf(-1)
+	for _, bin := range spectrum {
+		peak = math.Max(peak, bin.MaxDbm)
+	}
+
+	return int(math.Round(peak))
+}
@@ -0,0 +1,173 @@
+//go:build sqlite
+
+package main
+
+/*
+#cgo LDFLAGS: -lsqlite3
+#include <sqlite3.h>
+#include <stdlib.h>
+
+static int bind_text(sqlite3_stmt *stmt, int i, const char *value, int n) {
+	return sqlite3_bind_text(stmt, i, value, n, SQLITE_TRANSIENT);
+}
+
+static int bind_blob(sqlite3_stmt *stmt, int i, const void *value, int n) {
+	return sqlite3_bind_blob(stmt, i, value, n, SQLITE_TRANSIENT);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// sqliteDB is a minimal binding to the system SQLite library, covering the
+// statements the store needs: execution with bound parameters and row
+// iteration over text and integer columns.
+type sqliteDB struct {
+	db *C.sqlite3
+}
+
+// sqliteBlob is bound as a BLOB parameter; plain []byte is bound as text.
+type sqliteBlob []byte
+
+func openSQLite(path string) (*sqliteDB, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	var db *C.sqlite3
+	if rc := C.sqlite3_open_v2(cPath, &db, C.SQLITE_OPEN_READWRITE|C.SQLITE_OPEN_CREATE|C.SQLITE_OPEN_FULLMUTEX, nil); rc != C.SQLITE_OK {
+		err := fmt.Errorf("sqlite open %s: %s", path, C.GoString(C.sqlite3_errstr(rc)))
+		C.sqlite3_close_v2(db)
+		return nil, err
+	}
+	C.sqlite3_busy_timeout(db, 5000)
+
+	return &sqliteDB{db: db}, nil
+}
+
+func (s *sqliteDB) Close() error {
+	if rc := C.sqlite3_close_v2(s.db); rc != C.SQLITE_OK {
+		return s.error(rc)
+	}
+	return nil
+}
+
+func (s *sqliteDB) error(rc C.int) error {
+	return sqliteError{Code: int(rc), Message: C.GoString(C.sqlite3_errmsg(s.db))}
+}
+
+// sqliteError is a failed SQLite call with its result code.
+type sqliteError struct {
+	Code    int
+	Message string
+}
+
+func (e sqliteError) Error() string {
+	return fmt.Sprintf("sqlite: %s (%d)", e.Message, e.Code)
+}
+
+// storageUnavailable reports whether the database could not be written
+// because of its file or disk, see readonly.go.
+func (e sqliteError) storageUnavailable() bool {
+	switch e.Code & 0xff {
+	case C.SQLITE_PERM, C.SQLITE_READONLY, C.SQLITE_IOERR, C.SQLITE_FULL, C.SQLITE_CANTOPEN:
+		return true
+	}
+	return false
+}
+
+func (s *sqliteDB) prepare(query string, args ...interface{}) (*C.sqlite3_stmt, error) {
+	cQuery := C.CString(query)
+	defer C.free(unsafe.Pointer(cQuery))
+
+	var stmt *C.sqlite3_stmt
+	if rc := C.sqlite3_prepare_v2(s.db, cQuery, -1, &stmt, nil); rc != C.SQLITE_OK {
+		return nil, s.error(rc)
+	}
+
+	for i, arg := range args {
+		var rc C.int
+		switch v := arg.(type) {
+		case string:
+			cValue := C.CString(v)
+			rc = C.bind_text(stmt, C.int(i+1), cValue, C.int(len(v)))
+			C.free(unsafe.Pointer(cValue))
+		case []byte:
+			cValue := C.CString(string(v))
+			rc = C.bind_text(stmt, C.int(i+1), cValue, C.int(len(v)))
+			C.free(unsafe.Pointer(cValue))
+		case sqliteBlob:
+			cValue := C.CBytes(v)
+			rc = C.bind_blob(stmt, C.int(i+1), cValue, C.int(len(v)))
+			C.free(cValue)
+		case int:
+			rc = C.sqlite3_bind_int64(stmt, C.int(i+1), C.sqlite3_int64(v))
+		case int64:
+			rc = C.sqlite3_bind_int64(stmt, C.int(i+1), C.sqlite3_int64(v))
+		case float64:
+			rc = C.sqlite3_bind_double(stmt, C.int(i+1), C.double(v))
+		case nil:
+			rc = C.sqlite3_bind_null(stmt, C.int(i+1))
+		default:
+			C.sqlite3_finalize(stmt)
+			return nil, fmt.Errorf("sqlite: unsupported parameter type %T", arg)
+		}
+		if rc != C.SQLITE_OK {
+			C.sqlite3_finalize(stmt)
+			return nil, s.error(rc)
+		}
+	}
+
+	return stmt, nil
+}
+
+// Exec runs a statement that returns no rows.
+func (s *sqliteDB) Exec(query string, args ...interface{}) error {
+	stmt, err := s.prepare(query, args...)
+	if err != nil {
+		return err
+	}
+	defer C.sqlite3_finalize(stmt)
+
+	for {
+		switch rc := C.sqlite3_step(stmt); rc {
+		case C.SQLITE_DONE:
+			return nil
+		case C.SQLITE_ROW:
+		default:
+			return s.error(rc)
+		}
+	}
+}
+
+// Query calls fn with the text of each column for every result row.
+func (s *sqliteDB) Query(query string, fn func(columns []string) error, args ...interface{}) error {
+	stmt, err := s.prepare(query, args...)
+	if err != nil {
+		return err
+	}
+	defer C.sqlite3_finalize(stmt)
+
+	count := int(C.sqlite3_column_count(stmt))
+	for {
+		switch rc := C.sqlite3_step(stmt); rc {
+		case C.SQLITE_DONE:
+			return nil
+		case C.SQLITE_ROW:
+			columns := make([]string, count)
+			for i := range columns {
+				text := C.sqlite3_column_text(stmt, C.int(i))
+				if text != nil {
+					columns[i] = C.GoStringN((*C.char)(unsafe.Pointer(text)), C.sqlite3_column_bytes(stmt, C.int(i)))
+				}
+			}
+			if err := fn(columns); err != nil {
+				return err
+			}
+		default:
+			return s.error(rc)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// statsGroupings are the ways /api/stats can group measurements.
+var statsGroupings = map[string]func(m Measurement) string{
+	"location": func(m Measurement) string { return m.Location },
+	"floor":    func(m Measurement) string { return strconv.Itoa(m.Floor) },
+	"ssid":     func(m Measurement) string { return m.SSID },
+}
+
+// MetricStats summarizes the values of one metric. Percentiles are
+// interpolated between the nearest values.
+type MetricStats struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P10    float64 `json:"p10"`
+	P25    float64 `json:"p25"`
+	P75    float64 `json:"p75"`
+	P90    float64 `json:"p90"`
+}
+
+// StatsGroup holds the statistics of every metric measured in a group.
+// Failed counts the samples where no signal could be read.
+type StatsGroup struct {
+	Key          string                 `json:"key"`
+	Name         string                 `json:"name,omitempty"`
+	Measurements int                    `json:"measurements"`
+	Failed       int                    `json:"failed"`
+	Metrics      map[string]MetricStats `json:"metrics"`
+}
+
+// HistogramBucket counts the values from From up to, but excluding, To.
+type HistogramBucket struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+}
+
+// percentile returns the p-th percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (rank-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func metricStats(values []float64) MetricStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	return MetricStats{
+		Count:  len(sorted),
+		Min:    sorted[0],
+		Max:    sorted[len(sorted)-1],
+		Mean:   round1(sum / float64(len(sorted))),
+		Median: round1(percentile(sorted, 50)),
+		P10:    round1(percentile(sorted, 10)),
+		P25:    round1(percentile(sorted, 25)),
+		P75:    round1(percentile(sorted, 75)),
+		P90:    round1(percentile(sorted, 90)),
+	}
+}
+
+// statsGroup summarizes the measurements of one group.
+func statsGroup(key string, ms []Measurement) StatsGroup {
+	group := StatsGroup{Key: key, Measurements: len(ms), Metrics: make(map[string]MetricStats)}
+	for _, m := range ms {
+		if m.Dbm == failedSampleDbm {
+			group.Failed++
+		}
+	}
+	for name, metric := range metrics {
+		var values []float64
+		for _, m := range ms {
+			if value, ok := metric.value(m); ok {
+				values = append(values, value)
+			}
+		}
+		if len(values) > 0 {
+			group.Metrics[name] = metricStats(values)
+		}
+	}
+	return group
+}
+
+// maxHistogramBuckets bounds the buckets a histogram may have, as their
+// width comes from the client.
+const maxHistogramBuckets = 1000
+
+// histogram buckets the values of the metric by width, from the bucket
+// holding the lowest value to the one holding the highest.
+func histogram(ms []Measurement, metric Metric, width float64) ([]HistogramBucket, error) {
+	var values []float64
+	for _, m := range ms {
+		if value, ok := metric.value(m); ok {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return []HistogramBucket{}, nil
+	}
+	sort.Float64s(values)
+
+	first := math.Floor(values[0] / width)
+	span := math.Floor(values[len(values)-1]/width) - first + 1
+	if !(span <= maxHistogramBuckets) {
+		return nil, fmt.Errorf("bucket is too small for the range of values, at most %d buckets are made", maxHistogramBuckets)
+	}
+	n := int(span)
+	buckets := make([]HistogramBucket, n)
+	for i := range buckets {
+		buckets[i].From = (first + float64(i)) * width
+		buckets[i].To = buckets[i].From + width
+	}
+	for _, v := range values {
+		i := min(int(math.Floor(v/width)-first), n-1)
+		buckets[i].Count++
+	}
+	return buckets, nil
+}
+
+// statsHandler returns count, min, max, mean, median and percentiles of
+// every metric, overall and per ?groupBy (location, floor or ssid), with a
+// histogram of ?metric (signal by default) in buckets of ?bucket units.
+// Measurements are filtered like /api/measurements; scan records, one per
+// access point in range, are only included with ?scans=true.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID := 0
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	groupBy := query.Get("groupBy")
+	groupKey, known := statsGroupings[groupBy]
+	if groupBy != "" && !known {
+		http.Error(w, "groupBy must be location, floor or ssid", http.StatusBadRequest)
+		return
+	}
+
+	name := defaultMetric
+	if value := query.Get("metric"); value != "" {
+		name = value
+	}
+	metric, err := lookupMetric(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	width := (metric.Max - metric.Min) / 12
+	if value := query.Get("bucket"); value != "" {
+		width, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(width > 0) || math.IsInf(width, 0) {
+			http.Error(w, "bucket must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	session := query.Get("session")
+	buildingFloorIDs, err := buildingFloors(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	height, err := parseHeightRange(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	signal, err := parseSignalFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scans := query.Get("scans") == "true"
+
+	mutex.Lock()
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.approved() && (m.Type != "scan" || scans) && (floorID <= 0 || m.Floor == floorID) && inSession(m, session) && (buildingFloorIDs == nil || buildingFloorIDs[m.Floor]) && height.match(m) && signal.match(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	_, floorExists := floors[floorID]
+	floorNames := make(map[string]string, len(floors))
+	for id, floor := range floors {
+		floorNames[strconv.Itoa(id)] = floor.Name
+	}
+	mutex.Unlock()
+
+	if floorID > 0 && !floorExists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	buckets, err := histogram(filtered, metric, width)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groups := []StatsGroup{}
+	if groupKey != nil {
+		members := make(map[string][]Measurement)
+		for _, m := range filtered {
+			members[groupKey(m)] = append(members[groupKey(m)], m)
+		}
+		for key, ms := range members {
+			group := statsGroup(key, ms)
+			if groupBy == "floor" {
+				group.Name = floorNames[key]
+			}
+			groups = append(groups, group)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if groupBy == "floor" {
+				a, _ := strconv.Atoi(groups[i].Key)
+				b, _ := strconv.Atoi(groups[j].Key)
+				return a < b
+			}
+			return groups[i].Key < groups[j].Key
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groupBy":   groupBy,
+		"overall":   statsGroup("", filtered),
+		"groups":    groups,
+		"metric":    metric.Name,
+		"unit":      metric.Unit,
+		"bucket":    width,
+		"histogram": buckets,
+	})
+}
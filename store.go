@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	storeBackend  = flag.String("store", "", "storage backend: sqlite or json, by default sqlite when the project has a database and json otherwise")
+	databaseFile  = flag.String("db", "heatmap.db", "SQLite database file, relative to the project directory")
+	flushInterval = flag.Duration("flush-interval", 5*time.Second, "how often the json store writes changed measurements and floors, 0 to write on every change")
+
+	store Store
+
+	// newSQLiteStore is set when the binary is built with -tags sqlite,
+	// which links the system SQLite library through cgo.
+	newSQLiteStore func(path string) (Store, error)
+)
+
+// Store persists measurements and floors. The in-memory slices guarded by
+// mutex remain the working set; the store is told of every change and must
+// be called without holding mutex. Flush writes changes the store has only
+// noted, and Close flushes too.
+type Store interface {
+	LoadMeasurements() ([]Measurement, error)
+	LoadFloors() (map[int]Floor, error)
+	SaveMeasurement(m Measurement) error
+	DeleteMeasurement(id string) error
+	SaveFloor(floor Floor) error
+	DeleteFloor(id int) error
+	Flush() error
+	Close() error
+}
+
+func openStore() (Store, error) {
+	backend := *storeBackend
+	if backend == "" {
+		backend = "json"
+		if _, err := os.Stat(projectFile(*databaseFile)); err == nil {
+			backend = "sqlite"
+		}
+	}
+
+	switch backend {
+	case "json":
+		return jsonStore{}, nil
+	case "sqlite":
+		if newSQLiteStore == nil {
+			return nil, fmt.Errorf("the sqlite store requires a build with -tags sqlite")
+		}
+		return newSQLiteStore(projectFile(*databaseFile))
+	}
+
+	return nil, fmt.Errorf("unknown store backend %q", *storeBackend)
+}
+
+// jsonStore keeps the original layout of one JSON file per collection.
+// Rewriting a whole file is slow for large surveys, so changes only mark
+// the file dirty and it is written every -flush-interval.
+type jsonStore struct{}
+
+// measurementsDirty and floorsDirty are guarded by mutex.
+var measurementsDirty, floorsDirty bool
+
+func (jsonStore) LoadMeasurements() ([]Measurement, error) {
+	var loaded []Measurement
+	return loaded, readJSONFile(projectFile(measurementsFile), &loaded)
+}
+
+func (jsonStore) LoadFloors() (map[int]Floor, error) {
+	loaded := make(map[int]Floor)
+	return loaded, readJSONFile(projectFile(floorsFile), &loaded)
+}
+
+func (jsonStore) SaveMeasurement(Measurement) error {
+	return markDirty(&measurementsDirty, writeMeasurementsFile)
+}
+
+func (jsonStore) DeleteMeasurement(string) error {
+	return markDirty(&measurementsDirty, writeMeasurementsFile)
+}
+
+func (jsonStore) SaveFloor(Floor) error {
+	return markDirty(&floorsDirty, writeFloorsFile)
+}
+
+func (jsonStore) DeleteFloor(int) error {
+	return markDirty(&floorsDirty, writeFloorsFile)
+}
+
+func (jsonStore) Flush() error {
+	mutex.Lock()
+	dirtyMeasurements, dirtyFloors := measurementsDirty, floorsDirty
+	measurementsDirty, floorsDirty = false, false
+	mutex.Unlock()
+
+	if dirtyMeasurements {
+		if err := writeMeasurementsFile(); err != nil {
+			markDirty(&measurementsDirty, nil)
+			return err
+		}
+	}
+	if dirtyFloors {
+		if err := writeFloorsFile(); err != nil {
+			markDirty(&floorsDirty, nil)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s jsonStore) Close() error {
+	return s.Flush()
+}
+
+// markDirty notes that a file has to be written on the next flush, or
+// writes it right away when flushing is turned off.
+func markDirty(dirty *bool, write func() error) error {
+	if *flushInterval <= 0 && write != nil {
+		return write()
+	}
+	mutex.Lock()
+	*dirty = true
+	mutex.Unlock()
+	return nil
+}
+
+// startStoreFlush flushes the store every -flush-interval.
+func startStoreFlush() {
+	if *flushInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*flushInterval) {
+			if err := store.Flush(); err != nil {
+				log.Printf("failed to write data files: %v", err)
+			}
+		}
+	}()
+}
+
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func writeMeasurementsFile() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	data, err := json.MarshalIndent(measurements, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(measurementsFile), data, 0644)
+}
+
+func writeFloorsFile() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	data, err := json.MarshalIndent(floors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(floorsFile), data, 0644)
+}
+
+// writeFileAtomic replaces the file at path through a temporary file in the
+// same directory, so a crash while writing leaves the old file or the new
+// one, never a truncated one. Failing for the storage switches the server
+// into read-only mode.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	defer func() { noteStorageError(err) }()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
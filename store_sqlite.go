@@ -0,0 +1,174 @@
+//go:build sqlite
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+func init() {
+	newSQLiteStore = openSQLiteStore
+}
+
+// sqliteStore keeps every measurement and floor as a JSON document in its
+// own row, with the columns used for filtering extracted alongside.
+type sqliteStore struct {
+	db *sqliteDB
+}
+
+var sqliteSchema = []string{
+	"PRAGMA journal_mode=WAL",
+	"PRAGMA synchronous=NORMAL",
+	`CREATE TABLE IF NOT EXISTS measurements (
+		id        TEXT PRIMARY KEY,
+		floor     INTEGER NOT NULL,
+		timestamp TEXT NOT NULL,
+		data      TEXT NOT NULL
+	)`,
+	"CREATE INDEX IF NOT EXISTS measurements_floor ON measurements (floor)",
+	`CREATE TABLE IF NOT EXISTS floors (
+		id   INTEGER PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS meta (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+}
+
+func openSQLiteStore(path string) (Store, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqliteStore{db: db}
+	for _, stmt := range sqliteSchema {
+		if err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := s.importJSON(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to import JSON data: %v", err)
+	}
+
+	return s, nil
+}
+
+// importJSON copies measurements.json and floors.json into the database the
+// first time it is opened. The files are left in place as a backup.
+func (s *sqliteStore) importJSON() error {
+	imported := false
+	if err := s.db.Query("SELECT value FROM meta WHERE key = 'json_imported'", func([]string) error {
+		imported = true
+		return nil
+	}); err != nil || imported {
+		return err
+	}
+
+	legacy := jsonStore{}
+	legacyMeasurements, err := legacy.LoadMeasurements()
+	if err != nil {
+		return err
+	}
+	legacyFloors, err := legacy.LoadFloors()
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Exec("BEGIN"); err != nil {
+		return err
+	}
+	for _, m := range legacyMeasurements {
+		if err := s.SaveMeasurement(m); err != nil {
+			s.db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	for _, floor := range legacyFloors {
+		if err := s.SaveFloor(floor); err != nil {
+			s.db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	if err := s.db.Exec("INSERT INTO meta (key, value) VALUES ('json_imported', datetime('now'))"); err != nil {
+		s.db.Exec("ROLLBACK")
+		return err
+	}
+	if err := s.db.Exec("COMMIT"); err != nil {
+		return err
+	}
+
+	if len(legacyMeasurements) > 0 || len(legacyFloors) > 0 {
+		log.Printf("imported %d measurements and %d floors from JSON files", len(legacyMeasurements), len(legacyFloors))
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) LoadMeasurements() ([]Measurement, error) {
+	var loaded []Measurement
+	err := s.db.Query("SELECT data FROM measurements ORDER BY timestamp, rowid", func(columns []string) error {
+		var m Measurement
+		if err := json.Unmarshal([]byte(columns[0]), &m); err != nil {
+			return err
+		}
+		loaded = append(loaded, m)
+		return nil
+	})
+	return loaded, err
+}
+
+func (s *sqliteStore) LoadFloors() (map[int]Floor, error) {
+	loaded := make(map[int]Floor)
+	err := s.db.Query("SELECT data FROM floors", func(columns []string) error {
+		var floor Floor
+		if err := json.Unmarshal([]byte(columns[0]), &floor); err != nil {
+			return err
+		}
+		loaded[floor.ID] = floor
+		return nil
+	})
+	return loaded, err
+}
+
+func (s *sqliteStore) SaveMeasurement(m Measurement) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Exec("INSERT OR REPLACE INTO measurements (id, floor, timestamp, data) VALUES (?, ?, ?, ?)",
+		m.ID, m.Floor, m.Timestamp.UTC().Format("2006-01-02T15:04:05.000000000Z"), data)
+}
+
+func (s *sqliteStore) DeleteMeasurement(id string) error {
+	return s.db.Exec("DELETE FROM measurements WHERE id = ?", id)
+}
+
+func (s *sqliteStore) SaveFloor(floor Floor) error {
+	data, err := json.Marshal(floor)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Exec("INSERT OR REPLACE INTO floors (id, data) VALUES (?, ?)", floor.ID, data)
+}
+
+func (s *sqliteStore) DeleteFloor(id int) error {
+	return s.db.Exec("DELETE FROM floors WHERE id = ?", id)
+}
+
+// Flush has nothing to do, every change is written in its own statement.
+func (s *sqliteStore) Flush() error {
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
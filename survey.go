@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ChannelSurvey is the survey of one channel from
+// `iw dev <iface> survey dump`. The times are cumulative counters of the
+// driver, in milliseconds; Noise is 0 when the driver reports none.
+type ChannelSurvey struct {
+	Freq     int
+	InUse    bool
+	Noise    int
+	ActiveMs int64
+	BusyMs   int64
+}
+
+var (
+	surveyFreqRe   = regexp.MustCompile(`^frequency:\s*(\d+) MHz`)
+	surveyNoiseRe  = regexp.MustCompile(`^noise:\s*(-?\d+) dBm`)
+	surveyActiveRe = regexp.MustCompile(`^channel active time:\s*(\d+) ms`)
+	surveyBusyRe   = regexp.MustCompile(`^channel busy time:\s*(\d+) ms`)
+)
+
+// parseSurvey reads the channel sections of `iw dev <iface> survey dump`.
+func parseSurvey(output string) []ChannelSurvey {
+	var surveys []ChannelSurvey
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "Survey data from") {
+			surveys = append(surveys, ChannelSurvey{})
+			continue
+		}
+		if len(surveys) == 0 {
+			continue
+		}
+		current := &surveys[len(surveys)-1]
+
+		if match := surveyFreqRe.FindStringSubmatch(line); match != nil {
+			current.Freq, _ = strconv.Atoi(match[1])
+			current.InUse = strings.Contains(line, "[in use]")
+		} else if match := surveyNoiseRe.FindStringSubmatch(line); match != nil {
+			current.Noise, _ = strconv.Atoi(match[1])
+		} else if match := surveyActiveRe.FindStringSubmatch(line); match != nil {
+			current.ActiveMs, _ = strconv.ParseInt(match[1], 10, 64)
+		} else if match := surveyBusyRe.FindStringSubmatch(line); match != nil {
+			current.BusyMs, _ = strconv.ParseInt(match[1], 10, 64)
+		}
+	}
+	return surveys
+}
+
+// readChannelSurvey returns the survey of the channel the interface
+// operates on.
+func readChannelSurvey(interfaceName string) (ChannelSurvey, error) {
+	output, err := exec.Command("iw", "dev", interfaceName, "survey", "dump").CombinedOutput()
+	if err != nil {
+		return ChannelSurvey{}, fmt.Errorf("survey failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	for _, survey := range parseSurvey(string(output)) {
+		if survey.InUse {
+			return survey, nil
+		}
+	}
+	return ChannelSurvey{}, fmt.Errorf("no channel in use")
+}
+
+// surveyRecorder collects the channel surveys taken with the samples of a
+// measurement.
+type surveyRecorder struct {
+	first, last *ChannelSurvey
+	noise       []int
+	failed      bool
+}
+
+// sample adds a survey of the interface. Once a survey fails, for instance
+// because the driver does not support it, the rest are skipped.
+func (s *surveyRecorder) sample(interfaceName string) {
+	if s.failed {
+		return
+	}
+	survey, err := readChannelSurvey(interfaceName)
+	if err != nil {
+		s.failed = true
+		return
+	}
+
+	// A channel switch restarts the counters that matter.
+	if s.first == nil || s.first.Freq != survey.Freq {
+		s.first, s.noise = &survey, nil
+	}
+	s.last = &survey
+	if survey.Noise != 0 {
+		s.noise = append(s.noise, survey.Noise)
+	}
+}
+
+// apply stores the median noise floor, the SNR of dbm and the share of
+// time the channel was busy while sampling. The busy share comes from the
+// counters of the first and last survey, or of the last alone when they
+// did not advance.
+func (s *surveyRecorder) apply(m *Measurement) {
+	if s.last == nil {
+		return
+	}
+
+	if len(s.noise) > 0 {
+		sort.Ints(s.noise)
+		noise := float64(s.noise[len(s.noise)/2])
+		m.NoiseDbm = &noise
+		if m.Dbm != failedSampleDbm {
+			snr := float64(m.Dbm) - noise
+			m.SNRDb = &snr
+		}
+	}
+
+	active, busy := s.last.ActiveMs-s.first.ActiveMs, s.last.BusyMs-s.first.BusyMs
+	if active <= 0 || busy < 0 {
+		active, busy = s.last.ActiveMs, s.last.BusyMs
+	}
+	if active > 0 {
+		percent := min(100, 100*float64(busy)/float64(active))
+		m.BusyPercent = &percent
+	}
+}
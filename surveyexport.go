@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Surveys are exported for the tools consultants work in: an Ekahau project
+// (.esx) and a NetSpot-style bundle of the map and a CSV of the points. Both
+// hold the floor map, its scale and the approved survey measurements that
+// name a BSSID, positioned in map pixels.
+
+// surveyExport is the floor and the data an export is written from.
+type surveyExport struct {
+	Floor        Floor
+	Map          []byte
+	MapFormat    string
+	Width        int
+	Height       int
+	Measurements []Measurement
+}
+
+// surveyPoint is a place the signal was taken at, with every BSSID heard
+// there: a scan, or a single link measurement.
+type surveyPoint struct {
+	X, Y  float64
+	Time  time.Time
+	Heard []Measurement
+}
+
+// loadSurveyExport gathers what the export of a floor needs. It writes the
+// error and returns false when the floor cannot be exported.
+func loadSurveyExport(w http.ResponseWriter, r *http.Request, floorID int) (surveyExport, bool) {
+	var export surveyExport
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return export, false
+	}
+	session := r.URL.Query().Get("session")
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	for _, m := range measurements {
+		if m.Floor == floorID && m.approved() && inClass(m, classSurvey) && inSession(m, session) &&
+			m.BSSID != "" && m.Dbm != failedSampleDbm {
+			export.Measurements = append(export.Measurements, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return export, false
+	}
+	if floor.MapPath == "" {
+		http.Error(w, "floor has no map", http.StatusBadRequest)
+		return export, false
+	}
+	data, err := os.ReadFile(uploadFile(floor.MapPath))
+	if err != nil {
+		http.Error(w, "failed to read the floor map", http.StatusInternalServerError)
+		return export, false
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "failed to decode the floor map", http.StatusInternalServerError)
+		return export, false
+	}
+
+	export.Floor, export.Map, export.MapFormat = floor, data, format
+	export.Width, export.Height = config.Width, config.Height
+	return export, true
+}
+
+// points groups the measurements into survey points, oldest first.
+func (e surveyExport) points() []surveyPoint {
+	index := make(map[string]int)
+	var points []surveyPoint
+	for _, m := range e.Measurements {
+		key := m.ID
+		if m.ScanID != "" {
+			key = "scan:" + m.ScanID
+		}
+		i, exists := index[key]
+		if !exists {
+			i = len(points)
+			index[key] = i
+			points = append(points, surveyPoint{X: m.Lng, Y: float64(e.Height) - m.Lat, Time: m.Timestamp})
+		}
+		points[i].Heard = append(points[i].Heard, m)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// writeEkahauProject writes an Ekahau project archive. Ekahau does not
+// publish the format; the files follow the layout of the JSON documents in
+// .esx projects: the project, the floor plan with its image and scale, the
+// access points measured by BSSID and a passive survey of the points.
+func writeEkahauProject(w *zip.Writer, e surveyExport) error {
+	now := time.Now().UTC()
+	floorPlanID, imageID, surveyID := newUUID(), newUUID(), newUUID()
+
+	type signal struct {
+		AccessPointMeasurementID string `json:"accessPointMeasurementId"`
+		SignalStrength           int    `json:"signalStrength"`
+	}
+	type point struct {
+		Location struct {
+			X float64 `json:"x"`
+			Y float64 `json:"y"`
+		} `json:"location"`
+		Time    int64    `json:"time"`
+		Signals []signal `json:"signals"`
+	}
+	type apMeasurement struct {
+		ID        string `json:"id"`
+		MAC       string `json:"mac"`
+		SSID      string `json:"ssid"`
+		Channel   int    `json:"channel,omitempty"`
+		Frequency int    `json:"frequency,omitempty"`
+	}
+	type accessPoint struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Mine   bool   `json:"mine"`
+		Status string `json:"status"`
+	}
+	type measuredRadio struct {
+		ID                        string   `json:"id"`
+		AccessPointID             string   `json:"accessPointId"`
+		AccessPointMeasurementIDs []string `json:"accessPointMeasurementIds"`
+	}
+
+	// Every BSSID is an access point with one radio, measured once per SSID
+	// and channel it was heard on.
+	measurementIDs := make(map[string]string)
+	apMeasurements := []apMeasurement{}
+	radios := make(map[string]*measuredRadio)
+	accessPoints := []accessPoint{}
+	var radioOrder []string
+	for _, m := range e.Measurements {
+		bssid := strings.ToLower(m.BSSID)
+		key := bssid + "|" + m.SSID + "|" + strconv.Itoa(m.Channel)
+		if _, exists := measurementIDs[key]; exists {
+			continue
+		}
+		id := newUUID()
+		measurementIDs[key] = id
+		apMeasurements = append(apMeasurements, apMeasurement{ID: id, MAC: bssid, SSID: m.SSID, Channel: m.Channel, Frequency: m.Freq})
+
+		radio := radios[bssid]
+		if radio == nil {
+			ap := accessPoint{ID: newUUID(), Name: bssid, Mine: true, Status: "CREATED"}
+			accessPoints = append(accessPoints, ap)
+			radio = &measuredRadio{ID: newUUID(), AccessPointID: ap.ID}
+			radios[bssid] = radio
+			radioOrder = append(radioOrder, bssid)
+		}
+		radio.AccessPointMeasurementIDs = append(radio.AccessPointMeasurementIDs, id)
+	}
+	measuredRadios := []measuredRadio{}
+	for _, bssid := range radioOrder {
+		measuredRadios = append(measuredRadios, *radios[bssid])
+	}
+
+	points := []point{}
+	for _, p := range e.points() {
+		var out point
+		out.Location.X, out.Location.Y = p.X, p.Y
+		out.Time = p.Time.UnixMilli()
+		for _, m := range p.Heard {
+			key := strings.ToLower(m.BSSID) + "|" + m.SSID + "|" + strconv.Itoa(m.Channel)
+			out.Signals = append(out.Signals, signal{AccessPointMeasurementID: measurementIDs[key], SignalStrength: m.Dbm})
+		}
+		points = append(points, out)
+	}
+
+	floorPlan := map[string]interface{}{
+		"id":            floorPlanID,
+		"name":          e.Floor.Name,
+		"width":         e.Width,
+		"height":        e.Height,
+		"imageId":       imageID,
+		"bitmapImageId": imageID,
+		"status":        "CREATED",
+	}
+	if mpp := e.Floor.metersPerPixel(); mpp > 0 {
+		floorPlan["metersPerUnit"] = mpp
+	}
+
+	documents := []struct {
+		name string
+		data interface{}
+	}{
+		{"project.json", map[string]interface{}{"project": map[string]interface{}{
+			"id":          newUUID(),
+			"name":        e.Floor.Name,
+			"title":       e.Floor.Name,
+			"description": "Exported from HeatGen " + version,
+			"createdAt":   now.Format(time.RFC3339),
+			"modifiedAt":  now.Format(time.RFC3339),
+			"status":      "CREATED",
+		}}},
+		{"floorPlans.json", map[string]interface{}{"floorPlans": []interface{}{floorPlan}}},
+		{"images.json", map[string]interface{}{"images": []interface{}{map[string]interface{}{
+			"id":               imageID,
+			"imageFormat":      strings.ToUpper(e.MapFormat),
+			"resolutionWidth":  e.Width,
+			"resolutionHeight": e.Height,
+			"status":           "CREATED",
+		}}}},
+		{"accessPoints.json", map[string]interface{}{"accessPoints": accessPoints}},
+		{"accessPointMeasurements.json", map[string]interface{}{"accessPointMeasurements": apMeasurements}},
+		{"measuredRadios.json", map[string]interface{}{"measuredRadios": measuredRadios}},
+		{"surveys.json", map[string]interface{}{"surveys": []interface{}{map[string]interface{}{
+			"id":          surveyID,
+			"name":        e.Floor.Name + " survey",
+			"floorPlanId": floorPlanID,
+			"surveyType":  "PASSIVE",
+			"status":      "CREATED",
+		}}}},
+		{"survey-" + surveyID + ".json", map[string]interface{}{"surveyPoints": points}},
+	}
+	for _, document := range documents {
+		data, err := json.MarshalIndent(document.data, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeZipFile(w, document.name, data, now); err != nil {
+			return err
+		}
+	}
+	return writeZipFile(w, "image-"+imageID, e.Map, now)
+}
+
+var netSpotHeader = []string{"Zone", "Point", "X", "Y", "X (m)", "Y (m)", "Time", "SSID", "BSSID", "Channel", "Frequency (MHz)", "Signal (dBm)", "Noise (dBm)", "SNR (dB)", "Security", "Location"}
+
+// writeNetSpotExport writes the floor map and a CSV of the survey points
+// with one row per BSSID heard, positioned in map pixels and, when the
+// floor is scaled, meters from the top left corner.
+func writeNetSpotExport(w *zip.Writer, e surveyExport) error {
+	now := time.Now().UTC()
+	mpp := e.Floor.metersPerPixel()
+	meters := func(v float64) string {
+		if mpp == 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v*mpp, 'f', 2, 64)
+	}
+	optional := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', 1, 64)
+	}
+
+	var buf bytes.Buffer
+	csvWriter := csv.NewWriter(&buf)
+	csvWriter.Write(netSpotHeader)
+	for i, p := range e.points() {
+		for _, m := range p.Heard {
+			csvWriter.Write([]string{
+				csvText(e.Floor.Name),
+				strconv.Itoa(i + 1),
+				strconv.FormatFloat(p.X, 'f', 1, 64),
+				strconv.FormatFloat(p.Y, 'f', 1, 64),
+				meters(p.X),
+				meters(p.Y),
+				m.Timestamp.Format(time.RFC3339),
+				csvText(m.SSID),
+				strings.ToLower(m.BSSID),
+				strconv.Itoa(m.Channel),
+				strconv.Itoa(m.Freq),
+				strconv.Itoa(m.Dbm),
+				optional(m.NoiseDbm),
+				optional(m.SNRDb),
+				csvText(m.Security),
+				csvText(m.Location),
+			})
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	if err := writeZipFile(w, "survey.csv", buf.Bytes(), now); err != nil {
+		return err
+	}
+	return writeZipFile(w, "map."+e.MapFormat, e.Map, now)
+}
+
+func writeZipFile(w *zip.Writer, name string, data []byte, modified time.Time) error {
+	file, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+// surveyExportHandler serves the survey of a floor as an Ekahau project
+// (export.esx) or a NetSpot bundle (export.netspot), optionally of one
+// ?session.
+func surveyExportHandler(w http.ResponseWriter, r *http.Request, floorID int, format string) {
+	export, ok := loadSurveyExport(w, r, floorID)
+	if !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	write, filename := writeEkahauProject, fmt.Sprintf("floor_%d.esx", floorID)
+	if format == "netspot" {
+		write, filename = writeNetSpotExport, fmt.Sprintf("floor_%d_netspot.zip", floorID)
+	}
+	if err := write(archive, export); err != nil {
+		http.Error(w, "failed to write export", http.StatusInternalServerError)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		http.Error(w, "failed to write export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Write(buf.Bytes())
+}
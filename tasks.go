@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tasksFile = "tasks.json"
+
+const (
+	taskMeasurement = "measurement"
+	taskScan        = "scan"
+	taskImport      = "import"
+	taskExport      = "export"
+	taskRender      = "render"
+	taskPrune       = "prune"
+)
+
+// taskInterrupted marks tasks that were running when the server stopped.
+const taskInterrupted = "interrupted"
+
+// tasksFlushInterval batches the writes of tasks.json, as a heatmap request
+// finishes a render task every time.
+const tasksFlushInterval = 10 * time.Second
+
+var (
+	taskHistory    = flag.Int("task-history", 1000, "number of finished tasks kept in tasks.json")
+	trustedProxies = flag.String("trusted-proxies", "", "comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header names the client")
+
+	// proxyNets are the parsed -trusted-proxies.
+	proxyNets []netip.Prefix
+)
+
+// Task is the history entry of a sampling job, import, export, render or
+// pruning run. Params holds what is needed to retry it, where that is
+// possible.
+type Task struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Status     string            `json:"status"`
+	Initiator  string            `json:"initiator"`
+	Summary    map[string]string `json:"summary,omitempty"`
+	Params     json.RawMessage   `json:"params,omitempty"`
+	JobID      string            `json:"jobId,omitempty"`
+	RetryOf    string            `json:"retryOf,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+	DurationMs int64             `json:"durationMs,omitempty"`
+}
+
+var (
+	tasks      []*Task
+	tasksDirty bool
+	tasksLock  sync.Mutex
+)
+
+func loadTasks() error {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	data, err := os.ReadFile(tasksFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if task.Status == jobRunning {
+			task.Status = taskInterrupted
+		}
+	}
+	return nil
+}
+
+// saveTasks writes the history, dropping the oldest finished tasks beyond
+// -task-history.
+func saveTasks() error {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	finished := 0
+	for i := len(tasks) - 1; i >= 0; i-- {
+		if tasks[i].FinishedAt == nil {
+			continue
+		}
+		if finished++; finished > *taskHistory {
+			tasks = append(tasks[:i], tasks[i+1:]...)
+		}
+	}
+
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(tasksFile, data, 0644); err != nil {
+		return err
+	}
+	tasksDirty = false
+	return nil
+}
+
+// flushTasks saves the history if a task finished since the last save.
+func flushTasks() {
+	tasksLock.Lock()
+	dirty := tasksDirty
+	tasksLock.Unlock()
+
+	if dirty {
+		if err := saveTasks(); err != nil {
+			log.Printf("failed to save task history: %v", err)
+		}
+	}
+}
+
+// startTasksFlush saves the history every tasksFlushInterval.
+func startTasksFlush() {
+	go func() {
+		for range time.Tick(tasksFlushInterval) {
+			flushTasks()
+		}
+	}()
+}
+
+// parseTrustedProxies reads -trusted-proxies.
+func parseTrustedProxies() error {
+	proxyNets = nil
+	for _, value := range strings.Split(*trustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return fmt.Errorf("trusted proxy %q is neither an address nor a CIDR range", value)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxyNets = append(proxyNets, prefix.Masked())
+	}
+	return nil
+}
+
+func trustedProxy(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range proxyNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestInitiator names who started a task: the client address. Requests
+// from one of the -trusted-proxies are named by the X-Forwarded-For hop
+// before the last trusted proxy instead; the header of other clients is
+// ignored, as anyone can send it.
+func requestInitiator(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// startTask records the start of a task. params is stored for retries and
+// may be nil.
+func startTask(kind, initiator string, params interface{}) *Task {
+	task := &Task{
+		ID:        generateID(),
+		Kind:      kind,
+		Status:    jobRunning,
+		Initiator: initiator,
+		StartedAt: time.Now(),
+	}
+	if params != nil {
+		task.Params, _ = json.Marshal(params)
+	}
+
+	tasksLock.Lock()
+	tasks = append(tasks, task)
+	tasksLock.Unlock()
+
+	return task
+}
+
+// finish records the outcome of the task with a summary of what it did.
+// The history is saved by startTasksFlush and at shutdown.
+func (t *Task) finish(status string, err error, summary map[string]string) {
+	now := time.Now()
+
+	tasksLock.Lock()
+	t.Status = status
+	if err != nil {
+		t.Error = err.Error()
+	}
+	t.Summary = summary
+	t.FinishedAt = &now
+	t.DurationMs = now.Sub(t.StartedAt).Milliseconds()
+	tasksDirty = true
+	tasksLock.Unlock()
+}
+
+// finishErr finishes the task as done or failed depending on err.
+func (t *Task) finishErr(err error, summary map[string]string) {
+	status := jobDone
+	if err != nil {
+		status = jobFailed
+	}
+	t.finish(status, err, summary)
+}
+
+// taskRecorder captures the status and error message of a response.
+type taskRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (rec *taskRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *taskRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 400 && len(rec.body) < 512 {
+		rec.body = append(rec.body, data[:min(len(data), 512-len(rec.body))]...)
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+// withTask records every request to next as a task of the given kind. The
+// query parameters become the summary, and error responses fail the task.
+func withTask(kind string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next(w, r)
+			return
+		}
+
+		task := startTask(kind, requestInitiator(r), nil)
+		rec := &taskRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		summary := map[string]string{"path": r.URL.Path}
+		for name := range r.URL.Query() {
+			summary[name] = r.URL.Query().Get(name)
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		summary["status"] = strconv.Itoa(rec.status)
+
+		var err error
+		if rec.status >= 400 {
+			err = errors.New(strings.TrimSpace(string(rec.body)))
+		}
+		task.finishErr(err, summary)
+	}
+}
+
+func findTask(id string) (Task, bool) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	for _, task := range tasks {
+		if task.ID == id {
+			return *task, true
+		}
+	}
+	return Task{}, false
+}
+
+// tasksHandler lists the task history newest first, optionally filtered by
+// kind and status and limited with ?limit.
+func tasksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tasksLock.Lock()
+	list := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		if kind := query.Get("kind"); kind != "" && task.Kind != kind {
+			continue
+		}
+		if status := query.Get("status"); status != "" && task.Status != status {
+			continue
+		}
+		list = append(list, *task)
+	}
+	tasksLock.Unlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].StartedAt.After(list[j].StartedAt)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, exists := findTask(r.PathValue("id"))
+	if !exists {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// taskRetryHandler starts a failed, cancelled or interrupted sampling task
+// again with its original request. Imports, exports and renders are
+// answered to their client directly and cannot be retried.
+func taskRetryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, exists := findTask(r.PathValue("id"))
+	if !exists {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if task.Kind != taskMeasurement && task.Kind != taskScan {
+		http.Error(w, task.Kind+" tasks cannot be retried", http.StatusConflict)
+		return
+	}
+	if task.Status == jobRunning || task.Status == jobDone {
+		http.Error(w, "only failed, cancelled or interrupted tasks can be retried", http.StatusConflict)
+		return
+	}
+
+	var req MeasurementRequest
+	if err := json.Unmarshal(task.Params, &req); err != nil {
+		http.Error(w, "task has no stored request", http.StatusConflict)
+		return
+	}
+
+	req.actor = auditActor(r)
+	job := startMeasurementJob(req, requestInitiator(r), task.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
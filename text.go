@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Length limits of free text fields, in characters.
+const (
+	maxNameLength        = 100
+	maxLocationLength    = 200
+	maxDescriptionLength = 2000
+)
+
+// normalizeText brings free text from clients into one canonical form:
+// invalid UTF-8 is replaced, the text is NFC normalized so that equal
+// labels compare equal, control characters are removed and surrounding
+// space is trimmed. Single-line text gets its line breaks and tabs turned
+// into spaces; multi-line text keeps its line breaks as \n.
+func normalizeText(s string, multiline bool) string {
+	s = norm.NFC.String(strings.ToValidUTF8(s, string(utf8.RuneError)))
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r == '\n' && multiline:
+			b.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteRune(' ')
+		case unicode.IsControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// cleanText normalizes a text field and checks its length.
+func cleanText(field, s string, limit int, multiline bool) (string, error) {
+	s = normalizeText(s, multiline)
+	if n := utf8.RuneCountInString(s); n > limit {
+		return s, fmt.Errorf("%s is %d characters long, the limit is %d", field, n, limit)
+	}
+	return s, nil
+}
+
+// csvFormulaPrefixes start text that spreadsheets evaluate as a formula. A
+// leading tab or carriage return can hide one of the others.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvText protects a free text cell from being run as a formula when the
+// export is opened in a spreadsheet, by prefixing an apostrophe. Import
+// removes it again with csvUntext.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune(csvFormulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func csvUntext(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCSVText(t *testing.T) {
+	tests := []struct {
+		text, cell string
+	}{
+		{"", ""},
+		{"Office", "Office"},
+		{"=1+1", "'=1+1"},
+		{"+420 123", "'+420 123"},
+		{"-5 dBm", "'-5 dBm"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1+1", "'\t=1+1"},
+		{"\r=1+1", "'\r=1+1"},
+		{"'quoted", "'quoted"},
+	}
+	for _, test := range tests {
+		if got := csvText(test.text); got != test.cell {
+			t.Errorf("csvText(%q) = %q, want %q", test.text, got, test.cell)
+		}
+		if got := csvUntext(test.cell); got != test.text {
+			t.Errorf("csvUntext(%q) = %q, want %q", test.cell, got, test.text)
+		}
+	}
+}
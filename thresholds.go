@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const thresholdsFile = "thresholds.json"
+
+// ThresholdProfile is the minimum signal a use case needs. Points at or
+// above MinDbm pass.
+type ThresholdProfile struct {
+	Name        string `json:"name"`
+	MinDbm      int    `json:"minDbm"`
+	Description string `json:"description,omitempty"`
+}
+
+var thresholdProfiles = map[string]ThresholdProfile{
+	"voip": {Name: "voip", MinDbm: -65, Description: "voice and video calls"},
+	"web":  {Name: "web", MinDbm: -75, Description: "web browsing and email"},
+	"iot":  {Name: "iot", MinDbm: -85, Description: "low-rate IoT devices"},
+}
+
+var defaultThreshold = flag.String("threshold", "web", "threshold profile used when a request names none")
+
+// loadThresholdProfiles merges profiles from thresholds.json over the
+// built-in ones.
+func loadThresholdProfiles() error {
+	data, err := os.ReadFile(thresholdsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var custom map[string]ThresholdProfile
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return err
+	}
+
+	for name, profile := range custom {
+		if profile.MinDbm >= 0 || profile.MinDbm < -120 {
+			return fmt.Errorf("threshold profile %q needs minDbm between -120 and 0", name)
+		}
+		profile.Name = name
+		thresholdProfiles[name] = profile
+	}
+
+	return nil
+}
+
+// thresholdParam resolves the "threshold" query parameter, which is either a
+// profile name or a dBm value, falling back to the default profile.
+func thresholdParam(query url.Values) (ThresholdProfile, error) {
+	name := query.Get("threshold")
+	if name == "" {
+		name = effectiveSettings().Threshold
+	}
+
+	if profile, ok := thresholdProfiles[name]; ok {
+		return profile, nil
+	}
+
+	if dbm, err := strconv.Atoi(name); err == nil && dbm < 0 && dbm >= -120 {
+		return ThresholdProfile{Name: "custom", MinDbm: dbm}, nil
+	}
+
+	return ThresholdProfile{}, fmt.Errorf("unknown threshold profile %q", name)
+}
+
+// passes reports whether a measured signal meets the profile. Failed samples
+// never pass.
+func (p ThresholdProfile) passes(dbm int) bool {
+	return dbm != failedSampleDbm && dbm >= p.MinDbm
+}
+
+func thresholdsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles := make([]ThresholdProfile, 0, len(thresholdProfiles))
+	for _, profile := range thresholdProfiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].MinDbm > profiles[j].MinDbm
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default":  effectiveSettings().Threshold,
+		"profiles": profiles,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const maxThroughputSeconds = 30
+
+var (
+	iperf3Server        = flag.String("iperf3-server", envOrDefault("HEATGEN_IPERF3_SERVER", ""), "iperf3 server, host or host:port, used by measurements with throughput iperf3 (env HEATGEN_IPERF3_SERVER)")
+	throughputURL       = flag.String("throughput-url", envOrDefault("HEATGEN_THROUGHPUT_URL", ""), "URL of a large file downloaded by measurements with throughput http (env HEATGEN_THROUGHPUT_URL)")
+	throughputUploadURL = flag.String("throughput-upload-url", envOrDefault("HEATGEN_THROUGHPUT_UPLOAD_URL", ""), "URL that accepts a large POST, uploaded to by measurements with throughput http (env HEATGEN_THROUGHPUT_UPLOAD_URL)")
+	throughputSeconds   = flag.Int("throughput-seconds", 5, "duration of a throughput test in seconds")
+
+	// throughputClient takes bodies as they come over the wire: a
+	// compressed download would otherwise be timed by its inflated size.
+	throughputClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:              http.ProxyFromEnvironment,
+			DisableCompression: true,
+		},
+	}
+)
+
+// throughputMethods are the throughput tests a measurement can ask for,
+// by whether the server is configured for them.
+func throughputMethods() map[string]bool {
+	return map[string]bool{"iperf3": *iperf3Server != "", "http": *throughputURL != "" || *throughputUploadURL != ""}
+}
+
+// applyThroughputDefaults checks the throughput test a measurement asks
+// for.
+func applyThroughputDefaults(req *MeasurementRequest) error {
+	if req.Throughput == "" {
+		return nil
+	}
+	configured, known := throughputMethods()[req.Throughput]
+	if !known {
+		return fmt.Errorf("throughput must be iperf3 or http")
+	}
+	if !configured {
+		return fmt.Errorf("throughput %s is not configured, see -iperf3-server, -throughput-url and -throughput-upload-url", req.Throughput)
+	}
+	if req.Type == "scan" || req.Type == "spectral" {
+		return fmt.Errorf("throughput tests are not supported for %s measurements", req.Type)
+	}
+	if *throughputSeconds < 1 || *throughputSeconds > maxThroughputSeconds {
+		return fmt.Errorf("-throughput-seconds must be between 1 and %d", maxThroughputSeconds)
+	}
+	return nil
+}
+
+// throughputResult holds the rates a throughput test measured in Mbps,
+// nil for a direction it did not test.
+type throughputResult struct {
+	Download, Upload *float64
+}
+
+// runThroughput runs the test: iperf3 measures the download rate, http the
+// download rate from -throughput-url and the upload rate to
+// -throughput-upload-url, one after the other, of those configured.
+func runThroughput(ctx context.Context, method string) (throughputResult, error) {
+	var result throughputResult
+	duration := time.Duration(*throughputSeconds) * time.Second
+	if method == "iperf3" {
+		rate, err := runIperf3(ctx, *iperf3Server, duration)
+		if err != nil {
+			return result, err
+		}
+		result.Download = &rate
+		return result, nil
+	}
+
+	if *throughputURL != "" {
+		rate, err := runHTTPDownload(ctx, *throughputURL, duration)
+		if err != nil {
+			return result, err
+		}
+		result.Download = &rate
+	}
+	if *throughputUploadURL != "" {
+		rate, err := runHTTPUpload(ctx, *throughputUploadURL, duration)
+		if err != nil {
+			return result, err
+		}
+		result.Upload = &rate
+	}
+	return result, nil
+}
+
+// iperf3Result is the part of iperf3's JSON output the rate is read from.
+type iperf3Result struct {
+	End struct {
+		SumReceived struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// runIperf3 measures the download rate from an iperf3 server, which sends
+// in reverse mode (-R) while this side receives.
+func runIperf3(ctx context.Context, server string, duration time.Duration) (float64, error) {
+	args := []string{"-c", server}
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		args = []string{"-c", host, "-p", port}
+	}
+	args = append(args, "-R", "-J", "-t", strconv.Itoa(int(duration.Seconds())))
+
+	ctx, cancel := context.WithTimeout(ctx, duration+10*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "iperf3", args...).Output()
+	var result iperf3Result
+	if jsonErr := json.Unmarshal(output, &result); jsonErr != nil {
+		if err == nil {
+			err = jsonErr
+		}
+		return 0, fmt.Errorf("iperf3: %v", err)
+	}
+	if result.Error != "" {
+		return 0, fmt.Errorf("iperf3: %s", result.Error)
+	}
+	return result.End.SumReceived.BitsPerSecond / 1e6, nil
+}
+
+// runHTTPDownload downloads the URL for at most duration and returns the
+// rate reached. Whether the file ends first or the time runs out, the
+// rate is taken from the bytes received after the response started.
+func runHTTPDownload(ctx context.Context, url string, duration time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := throughputClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download answered %s", resp.Status)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return 0, err
+	}
+	if n == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("nothing was downloaded")
+	}
+	return float64(n) * 8 / elapsed.Seconds() / 1e6, nil
+}
+
+// uploadBody streams incompressible data until its deadline, counting what
+// the transport read.
+type uploadBody struct {
+	data     []byte
+	deadline time.Time
+	sent     int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if !time.Now().Before(b.deadline) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.sent += int64(n)
+	return n, nil
+}
+
+// runHTTPUpload posts data to the URL for duration and returns the rate
+// the body was sent at.
+func runHTTPUpload(ctx context.Context, url string, duration time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration+10*time.Second)
+	defer cancel()
+
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	start := time.Now()
+	body := &uploadBody{data: data, deadline: start.Add(duration)}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := throughputClient.Do(req)
+	elapsed := min(time.Since(start), duration)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("upload answered %s", resp.Status)
+	}
+	if body.sent == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("nothing was uploaded")
+	}
+	return float64(body.sent) * 8 / elapsed.Seconds() / 1e6, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunHTTPUpload(t *testing.T) {
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Add(n)
+	}))
+	defer server.Close()
+
+	rate, err := runHTTPUpload(context.Background(), server.URL, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Load() == 0 {
+		t.Fatal("nothing reached the server")
+	}
+	if want := float64(received.Load()) * 8 / 0.2 / 1e6; rate < want*0.5 || rate > want*2 {
+		t.Errorf("rate %.1f Mbps, want about %.1f", rate, want)
+	}
+}
+
+func TestRunHTTPUploadRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer server.Close()
+
+	if _, err := runHTTPUpload(context.Background(), server.URL, 100*time.Millisecond); err == nil {
+		t.Error("a rejected upload reported a rate")
+	}
+}
+
+func TestRunHTTPDownloadUncompressed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if encoding := r.Header.Get("Accept-Encoding"); encoding != "" {
+			t.Errorf("download asked for %q", encoding)
+		}
+		io.WriteString(w, strings.Repeat("x", 1<<20))
+	}))
+	defer server.Close()
+
+	rate, err := runHTTPDownload(context.Background(), server.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate <= 0 {
+		t.Errorf("rate %g Mbps, want a positive one", rate)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTicketLimit = 5
+	// ticketImageMargin is the floor shown around a problem area in the
+	// ticket image, in pixels.
+	ticketImageMargin = 60
+)
+
+var (
+	ticketWebhooks = flag.String("ticket-webhook", envOrDefault("HEATGEN_TICKET_WEBHOOK", ""), "comma-separated URLs weak-spot tickets are posted to, one request per ticket (env HEATGEN_TICKET_WEBHOOK)")
+
+	ticketClient = &http.Client{Timeout: 30 * time.Second}
+
+	ticketOutline = color.RGBA{R: 200, A: 255}
+)
+
+// Ticket is a weak spot of a floor written up for remediation: a dead zone
+// below the threshold, or a zone that misses its coverage requirement.
+// Image is a PNG of the heatmap around the area, base64 encoded.
+type Ticket struct {
+	Kind        string     `json:"kind"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Severity    string     `json:"severity"`
+	Floor       int        `json:"floor"`
+	FloorName   string     `json:"floorName"`
+	Zone        string     `json:"zone,omitempty"`
+	Lat         float64    `json:"lat"`
+	Lng         float64    `json:"lng"`
+	Region      *SLARegion `json:"region,omitempty"`
+	Revision    string     `json:"revision"`
+	Image       string     `json:"image"`
+}
+
+// Ticket kinds.
+const (
+	ticketDeadZone = "deadZone"
+	ticketSLA      = "sla"
+)
+
+// ticketImage crops the heatmap around the outline, which is drawn on it.
+func ticketImage(heatmap image.Image, outline []Vertex) (string, error) {
+	bounds := heatmap.Bounds()
+	height := float64(bounds.Dy())
+
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, v := range outline {
+		x, y := v.Lng, height-v.Lat
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	crop := image.Rect(int(minX)-ticketImageMargin, int(minY)-ticketImageMargin, int(maxX)+ticketImageMargin, int(maxY)+ticketImageMargin).Intersect(bounds)
+	if crop.Empty() {
+		crop = bounds
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(img, img.Bounds(), heatmap, crop.Min, draw.Src)
+	for i := range outline {
+		a, b := outline[i], outline[(i+1)%len(outline)]
+		drawLine(img,
+			int(a.Lng)-crop.Min.X, int(height-a.Lat)-crop.Min.Y,
+			int(b.Lng)-crop.Min.X, int(height-b.Lat)-crop.Min.Y,
+			ticketOutline)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// regionArea describes the size of a region, in square meters on floors
+// with a scale.
+func regionArea(region SLARegion) string {
+	if region.AreaSquareMeters > 0 {
+		return fmt.Sprintf("%g m²", region.AreaSquareMeters)
+	}
+	return fmt.Sprintf("%g px²", region.AreaPixels)
+}
+
+// buildTickets writes up the limit largest dead zones of the floor below
+// the threshold and every zone that misses its coverage requirement. Zones
+// without their own threshold are held to the given one.
+func buildTickets(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, threshold ThresholdProfile, limit int, revision string) ([]Ticket, error) {
+	zoneList := floorZones(floor.ID)
+	rules := []SLARule{{Threshold: strconv.Itoa(threshold.MinDbm)}}
+	for _, zone := range zoneList {
+		rule := SLARule{Name: zone.Name, Threshold: zone.Threshold, Coverage: zone.Coverage, Region: zone.Polygon}
+		if rule.Threshold == "" {
+			rule.Threshold = strconv.Itoa(threshold.MinDbm)
+		}
+		rules = append(rules, rule)
+	}
+
+	results, err := evaluateSLA(ctx, floor, ms, params, rules)
+	if err != nil {
+		return nil, err
+	}
+	heatmap, err := renderHeatmap(ctx, floor, ms, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tickets := []Ticket{}
+	floorWide := results[0]
+	for _, region := range floorWide.FailingRegions[:min(limit, len(floorWide.FailingRegions))] {
+		ticket := Ticket{
+			Kind:     ticketDeadZone,
+			Title:    fmt.Sprintf("Weak Wi-Fi coverage on %s", floor.Name),
+			Severity: "medium",
+			Floor:    floor.ID,
+			Lat:      region.Lat,
+			Lng:      region.Lng,
+			Region:   &region,
+		}
+		if region.WorstDbm < float64(floorWide.MinDbm-10) {
+			ticket.Severity = "high"
+		}
+		ticket.Description = fmt.Sprintf("An area of %s around (%.0f, %.0f) on floor %s is below %d dBm: %g dBm on average, %g dBm at worst.",
+			regionArea(region), region.Lat, region.Lng, floor.Name, floorWide.MinDbm, region.MeanDbm, region.WorstDbm)
+		if ticket.Image, err = ticketImage(heatmap, region.Outline); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	for i, zone := range zoneList {
+		result := results[i+1]
+		if result.Pass || result.Unevaluated {
+			continue
+		}
+		lat, lng := polygonCentroid(zone.Polygon)
+		ticket := Ticket{
+			Kind:     ticketSLA,
+			Title:    fmt.Sprintf("Wi-Fi coverage requirement missed in %s", zone.Name),
+			Severity: "medium",
+			Floor:    floor.ID,
+			Zone:     zone.Name,
+			Lat:      lat,
+			Lng:      lng,
+		}
+		if result.Coverage < result.RequiredCoverage-10 {
+			ticket.Severity = "high"
+		}
+		ticket.Description = fmt.Sprintf("Zone %s on floor %s has %g%% of its area at or above %d dBm, %g%% is required. It has %d areas below the threshold.",
+			zone.Name, floor.Name, result.Coverage, result.MinDbm, result.RequiredCoverage, result.TotalFailingRegions)
+		if ticket.Image, err = ticketImage(heatmap, zone.Polygon); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	for i := range tickets {
+		tickets[i].FloorName = floor.Name
+		tickets[i].Revision = revision
+	}
+	return tickets, nil
+}
+
+// polygonCentroid returns the mean of the polygon's vertices.
+func polygonCentroid(polygon []Vertex) (float64, float64) {
+	var lat, lng float64
+	for _, v := range polygon {
+		lat += v.Lat
+		lng += v.Lng
+	}
+	n := float64(len(polygon))
+	return lat / n, lng / n
+}
+
+// ticketPayload formats the ticket for the issue tracker. Jira and
+// ServiceNow take attachments in a separate upload, so the image travels
+// beside the fields for the receiving integration to attach.
+func ticketPayload(ticket Ticket, format, jiraProject string) interface{} {
+	attachment := map[string]string{
+		"filename":    fmt.Sprintf("heatgen-floor-%d-%.0f-%.0f.png", ticket.Floor, ticket.Lat, ticket.Lng),
+		"contentType": "image/png",
+		"data":        ticket.Image,
+	}
+
+	switch format {
+	case "jira":
+		priority := "Medium"
+		if ticket.Severity == "high" {
+			priority = "High"
+		}
+		return map[string]interface{}{
+			"fields": map[string]interface{}{
+				"project":     map[string]string{"key": jiraProject},
+				"issuetype":   map[string]string{"name": "Task"},
+				"summary":     ticket.Title,
+				"description": ticket.Description,
+				"priority":    map[string]string{"name": priority},
+				"labels":      []string{"wifi", "heatgen", ticket.Kind},
+			},
+			"attachments": []map[string]string{attachment},
+		}
+	case "servicenow":
+		impact := "3"
+		if ticket.Severity == "high" {
+			impact = "2"
+		}
+		return map[string]interface{}{
+			"short_description": ticket.Title,
+			"description":       ticket.Description,
+			"category":          "network",
+			"subcategory":       "wireless",
+			"impact":            impact,
+			"urgency":           impact,
+			"attachments":       []map[string]string{attachment},
+		}
+	}
+	return ticket
+}
+
+// postTickets sends each payload to every -ticket-webhook URL and returns
+// the number of successful deliveries and the failures.
+func postTickets(payloads []interface{}) (int, []string) {
+	delivered := 0
+	failures := []string{}
+	for _, url := range strings.Split(*ticketWebhooks, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		for _, payload := range payloads {
+			body, err := json.Marshal(payload)
+			if err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			resp, err := ticketClient.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", url, err))
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				failures = append(failures, fmt.Sprintf("%s: %s", url, resp.Status))
+				continue
+			}
+			delivered++
+		}
+	}
+	return delivered, failures
+}
+
+// ticketsHandler turns the weak spots of a floor into ticket payloads.
+// format is generic (default), jira, which needs jiraProject, or
+// servicenow; limit caps the dead zones (default 5). GET returns the
+// payloads, POST sends them to the -ticket-webhook URLs. The threshold and
+// heatmap query parameters are used as for coverage analysis.
+func ticketsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "generic"
+	}
+	if format != "generic" && format != "jira" && format != "servicenow" {
+		http.Error(w, "format must be generic, jira or servicenow", http.StatusBadRequest)
+		return
+	}
+	jiraProject := query.Get("jiraProject")
+	if format == "jira" && jiraProject == "" {
+		http.Error(w, "jiraProject is required for jira tickets", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultTicketLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 0 || limit > maxSLARegions {
+			http.Error(w, fmt.Sprintf("limit must be between 0 and %d", maxSLARegions), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Method == "POST" && *ticketWebhooks == "" {
+		http.Error(w, "no ticket webhook is configured, see -ticket-webhook", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	revision := dataRevision
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		tickets, err := buildTickets(ctx, floor, filtered, params, threshold, limit, revision)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "ticket export timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		payloads := make([]interface{}, len(tickets))
+		for i, ticket := range tickets {
+			payloads[i] = ticketPayload(ticket, format, jiraProject)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"floor":    floorID,
+				"revision": revision,
+				"format":   format,
+				"tickets":  payloads,
+			})
+			return
+		}
+
+		delivered, failures := postTickets(payloads)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tickets":   len(payloads),
+			"delivered": delivered,
+			"failures":  failures,
+		})
+	})
+}
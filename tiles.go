@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// minPixelTileZoom and maxPixelTileZoom bound the zoom levels of floor
+	// tiles; level 0 shows the floor map at its own resolution.
+	minPixelTileZoom = -10
+	maxPixelTileZoom = 8
+)
+
+// renderTile colors one tile of the heatmap. Tiles follow the pixel grid of
+// Leaflet's CRS.Simple, in which the frontend places the floor map with its
+// bottom-left corner at the origin: at zoom z a map pixel covers 2^z tile
+// pixels and rows grow southwards, so the map lies in negative rows. Pixels
+// off the map or without data are transparent.
+func (t *heatmapGrid) renderTile(params HeatmapParams, zoom, tx, ty int) *image.NRGBA {
+	tile := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	if t.grid.Values == nil {
+		return tile
+	}
+
+	scale := math.Exp2(float64(zoom))
+	alpha := params.Opacity * 255
+	var maskPixels float64
+	if t.distances != nil {
+		maskPixels = t.maskPixels(params)
+	}
+	for py := 0; py < tileSize; py++ {
+		y := int(math.Floor(float64(t.height) + (float64(ty*tileSize+py)+0.5)/scale))
+		if y < 0 || y >= t.height {
+			continue
+		}
+		for px := 0; px < tileSize; px++ {
+			x := int(math.Floor((float64(tx*tileSize+px) + 0.5) / scale))
+			if x < 0 || x >= t.width {
+				continue
+			}
+
+			a := alpha
+			if t.distances != nil {
+				a *= params.maskFactor(x, y, t.grid.at(t.distances, x, y), maskPixels)
+			}
+			c := params.colorFor(t.grid.at(t.grid.Values, x, y))
+			tile.SetNRGBA(px, py, color.NRGBA{R: c.R, G: c.G, B: c.B, A: uint8(a)})
+		}
+	}
+	return tile
+}
+
+// tileInFloor reports whether the tile overlaps the floor map.
+func (t *heatmapGrid) tileInFloor(zoom, tx, ty int) bool {
+	span := tileSize / math.Exp2(float64(zoom))
+	left, top := float64(tx)*span, float64(t.height)+float64(ty)*span
+	return left < float64(t.width) && left+span > 0 && top < float64(t.height) && top+span > 0
+}
+
+// tile returns the tile encoded in format, kept with the grid until a
+// change of the grid reaches it.
+func (t *heatmapGrid) tile(params HeatmapParams, format string, zoom, tx, ty int) ([]byte, error) {
+	key := fmt.Sprintf("%d/%d/%d.%s?%s", zoom, tx, ty, format, params.renderKey())
+
+	t.lock.Lock()
+	cached, exists := t.tiles[key]
+	t.lock.Unlock()
+	if exists {
+		return cached.data, nil
+	}
+
+	var buf bytes.Buffer
+	if err := imageEncoders[format].encode(&buf, t.renderTile(params, zoom, tx, ty)); err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	if len(t.tiles) >= maxCachedTiles {
+		for _, tile := range t.tiles {
+			t.rendered -= len(tile.data)
+		}
+		clear(t.tiles)
+	}
+	t.tiles[key] = &cachedTile{zoom: zoom, x: tx, y: ty, data: buf.Bytes()}
+	t.rendered += buf.Len()
+	t.lock.Unlock()
+	trimHeatmapGrids(t)
+	return buf.Bytes(), nil
+}
+
+// tileHandler serves /api/tiles/{floor}/{z}/{x}/{y}.png, or .webp, the
+// heatmap of a floor as transparent slippy map tiles to lay over the floor
+// map with a Leaflet tile layer. The heatmap query parameters apply. The
+// interpolated heatmap and its tiles are kept in memory, so a tile costs
+// its coloring once, and tiles carry the revision of the floor's heatmap
+// as ETag for the browser to revalidate.
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	floorID, err := strconv.Atoi(r.PathValue("floor"))
+	if err != nil {
+		http.Error(w, "invalid floor ID", http.StatusBadRequest)
+		return
+	}
+	zoom, err := strconv.Atoi(r.PathValue("z"))
+	if err != nil || zoom < minPixelTileZoom || zoom > maxPixelTileZoom {
+		http.Error(w, fmt.Sprintf("zoom must be between %d and %d", minPixelTileZoom, maxPixelTileZoom), http.StatusBadRequest)
+		return
+	}
+	tx, errX := strconv.Atoi(r.PathValue("x"))
+	y, format, _ := strings.Cut(r.PathValue("y"), ".")
+	ty, errY := strconv.Atoi(y)
+	encoder, known := imageEncoders[format]
+	if errX != nil || errY != nil || !known {
+		http.Error(w, "tiles are addressed as {z}/{x}/{y}.png or {z}/{x}/{y}.webp", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+	if params.MaskDistance > 0 && floor.metersPerPixel() == 0 {
+		http.Error(w, errMaskUncalibrated.Error(), http.StatusBadRequest)
+		return
+	}
+
+	width, height, err := heatmapBounds(floor, filtered)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := newHeatmapRequest(floor, filtered, params, width, height)
+
+	etag := req.etag("tile." + format)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		grid, err := cachedHeatmapGrid(ctx, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "tile rendering timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !grid.tileInFloor(zoom, tx, ty) {
+			http.Error(w, "tile outside the floor", http.StatusNotFound)
+			return
+		}
+
+		data, err := grid.tile(params, format, zoom, tx, ty)
+		if err != nil {
+			http.Error(w, "failed to encode tile", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", encoder.contentType)
+		w.Write(data)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	// Time zones are looked up in the binary's own copy of the database,
+	// so ?tz works on hosts and containers without one.
+	_ "time/tzdata"
+)
+
+// timeFormats are the named layouts of ?timeFormat. Beside them, unix
+// writes seconds since the epoch, and a Go reference layout, e.g.
+// "02 Jan 2006 15:04", can be given.
+var timeFormats = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"datetime": time.DateTime,
+	"us":       "01/02/2006 3:04:05 PM",
+	"uk":       "02/01/2006 15:04:05",
+	"eu":       "02.01.2006 15:04:05",
+}
+
+// timeStyle is how exports and reports write timestamps: in the time zone
+// of ?tz and with the layout of ?timeFormat. Without them timestamps are
+// written as the export always did, so the files can be imported again.
+type timeStyle struct {
+	location *time.Location
+	layout   string
+	unix     bool
+}
+
+// parseTimeStyle reads ?tz, an IANA time zone such as Europe/Prague, UTC
+// or local for the server's, and ?timeFormat.
+func parseTimeStyle(query url.Values) (timeStyle, error) {
+	var style timeStyle
+	if tz := query.Get("tz"); tz != "" {
+		if strings.EqualFold(tz, "local") {
+			tz = "Local"
+		}
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return style, fmt.Errorf("unknown time zone %q", tz)
+		}
+		style.location = location
+	}
+
+	if format := query.Get("timeFormat"); format != "" {
+		layout, named := timeFormats[strings.ToLower(format)]
+		switch {
+		case strings.EqualFold(format, "unix"):
+			style.unix = true
+		case named:
+			style.layout = layout
+		// A layout without any element formats as itself.
+		case time.Unix(0, 0).Format(format) != format:
+			style.layout = format
+		default:
+			return style, fmt.Errorf("timeFormat must be rfc3339, datetime, us, uk, eu, unix or a Go time layout")
+		}
+	}
+	return style, nil
+}
+
+// format writes t in the style, with fallback as the layout when none was
+// asked for.
+func (s timeStyle) format(t time.Time, fallback string) string {
+	if s.unix {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+	if s.layout != "" {
+		return t.Format(s.layout)
+	}
+	return t.Format(fallback)
+}
+
+// filters records the style in export metadata.
+func (s timeStyle) filters(filters map[string]string) {
+	if s.location != nil {
+		filters["tz"] = s.location.String()
+	}
+	switch {
+	case s.unix:
+		filters["timeFormat"] = "unix"
+	case s.layout != "":
+		filters["timeFormat"] = s.layout
+	}
+}
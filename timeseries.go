@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeSeriesBucket holds the statistics of the readings taken from Start
+// up to End.
+type TimeSeriesBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	MetricStats
+}
+
+// parseBucket reads a bucket size as a Go duration, e.g. 15m or 1h, or as
+// a number of days, e.g. 1d or 7d.
+func parseBucket(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid bucket %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	bucket, err := time.ParseDuration(value)
+	if err != nil || bucket < time.Minute {
+		return 0, fmt.Errorf("bucket must be a duration of at least 1m, e.g. 1h or 1d")
+	}
+	return bucket, nil
+}
+
+// locationBaselines returns the weekly signal baselines of a location for
+// the weeks overlapping from to to, either of which may be zero.
+func locationBaselines(location string, floorID int, from, to time.Time) []WeeklyBaseline {
+	baselines := weeklyBaselines(func(floor int, l, _ string) bool {
+		return l == location && (floorID <= 0 || floor == floorID)
+	})
+	selected := baselines[:0]
+	for _, b := range baselines {
+		week, _ := time.Parse(time.DateOnly, b.Week)
+		if (from.IsZero() || week.AddDate(0, 0, 7).After(from)) && (to.IsZero() || week.Before(to)) {
+			selected = append(selected, b)
+		}
+	}
+	return selected
+}
+
+// timeSeriesHandler aggregates a metric (signal by default) of repeated
+// measurements over time, for desks that are measured again and again. The
+// place is a named ?location, or a circle of ?radius around ?lat/?lng on
+// ?floor, in meters on floors with a scale and in pixels on others.
+// Readings are grouped into buckets of ?bucket (1h by default), aligned to
+// UTC, between ?from and ?to (RFC 3339, both optional); empty buckets are
+// left out. Session, band and SSID filters apply as for /api/measurements.
+// The signal of a named location comes with its weekly baselines, which
+// reach back beyond the retention of the raw measurements.
+func timeSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	location := query.Get("location")
+	floorID := 0
+	if value := query.Get("floor"); value != "" {
+		var err error
+		if floorID, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var lat, lng, radius float64
+	byRadius := location == ""
+	if byRadius {
+		var latErr, lngErr, radiusErr error
+		lat, latErr = strconv.ParseFloat(query.Get("lat"), 64)
+		lng, lngErr = strconv.ParseFloat(query.Get("lng"), 64)
+		radius, radiusErr = strconv.ParseFloat(query.Get("radius"), 64)
+		if latErr != nil || lngErr != nil || radiusErr != nil || floorID <= 0 {
+			http.Error(w, "location, or floor, lat, lng and radius are required", http.StatusBadRequest)
+			return
+		}
+		if !(radius > 0) {
+			http.Error(w, "radius must be positive", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var from, to time.Time
+	for name, target := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected an RFC 3339 time", name), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	bucket := time.Hour
+	if value := query.Get("bucket"); value != "" {
+		var err error
+		if bucket, err = parseBucket(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	name := defaultMetric
+	if value := query.Get("metric"); value != "" {
+		name = value
+	}
+	metric, err := lookupMetric(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := query.Get("session")
+	signal, err := parseSignalFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, floorExists := floors[floorID]
+	var selected []Measurement
+	for _, m := range measurements {
+		if !m.approved() || m.Type == "scan" || (floorID > 0 && m.Floor != floorID) || !inSession(m, session) || !signal.match(m) {
+			continue
+		}
+		if (!from.IsZero() && m.Timestamp.Before(from)) || (!to.IsZero() && !m.Timestamp.Before(to)) {
+			continue
+		}
+		if !byRadius && m.Location != location {
+			continue
+		}
+		selected = append(selected, m)
+	}
+	mutex.Unlock()
+
+	if floorID > 0 && !floorExists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	unit := "px"
+	if byRadius {
+		pixels := radius
+		if metersPerPixel := floor.metersPerPixel(); metersPerPixel > 0 {
+			pixels, unit = radius/metersPerPixel, "m"
+		}
+		inside := selected[:0]
+		for _, m := range selected {
+			if math.Hypot(m.Lat-lat, m.Lng-lng) <= pixels {
+				inside = append(inside, m)
+			}
+		}
+		selected = inside
+	}
+
+	values := make(map[time.Time][]float64)
+	for _, m := range selected {
+		if value, ok := metric.value(m); ok {
+			start := m.Timestamp.UTC().Truncate(bucket)
+			values[start] = append(values[start], value)
+		}
+	}
+
+	buckets := make([]TimeSeriesBucket, 0, len(values))
+	for start, v := range values {
+		buckets = append(buckets, TimeSeriesBucket{Start: start, End: start.Add(bucket), MetricStats: metricStats(v)})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+
+	response := map[string]interface{}{
+		"metric":  metric.Name,
+		"unit":    metric.Unit,
+		"bucket":  bucket.String(),
+		"buckets": buckets,
+	}
+	if byRadius {
+		response["floor"], response["lat"], response["lng"] = floorID, lat, lng
+		response["radius"], response["radiusUnit"] = radius, unit
+	} else {
+		response["location"] = location
+		if metric.Name == "signal" {
+			response["baselines"] = locationBaselines(location, floorID, from, to)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrackInterval = 1000
+	minTrackInterval     = 200
+	// maxTrackSamples stops a forgotten track from growing without bound.
+	maxTrackSamples = 100000
+)
+
+// Track is a walk survey: the signal is sampled in the background while the
+// client streams its position. Positions of the samples are interpolated
+// between the waypoints when the track stops.
+type Track struct {
+	ID        string     `json:"id"`
+	Floor     int        `json:"floor"`
+	SessionID string     `json:"sessionId,omitempty"`
+	Interface string     `json:"interface"`
+	Interval  int        `json:"interval"`
+	Height    *float64   `json:"height,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	Samples   int        `json:"samples"`
+	Waypoints []Waypoint `json:"waypoints"`
+	// CurrentPosition adds a waypoint from the position provider with
+	// every sample, besides those the client sends.
+	CurrentPosition bool `json:"currentPosition,omitempty"`
+
+	samples []trackSample
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Waypoint is a position reported by the client. Timestamp defaults to the
+// time the server received it.
+type Waypoint struct {
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type trackSample struct {
+	Time time.Time
+	Link LinkInfo
+	Dbm  int
+}
+
+type TrackRequest struct {
+	Floor     int      `json:"floor"`
+	SessionID string   `json:"sessionId"`
+	Interface string   `json:"interface"`
+	Interval  int      `json:"interval"`
+	Height    *float64 `json:"height"`
+	// CurrentPosition takes the waypoints from the position provider.
+	CurrentPosition bool `json:"currentPosition"`
+}
+
+type TrackResult struct {
+	Track
+	Measurements int `json:"measurements"`
+	// Dropped counts samples taken before the first or after the last
+	// waypoint, whose position is unknown.
+	Dropped int `json:"dropped"`
+}
+
+var (
+	activeTrack *Track
+	trackLock   sync.Mutex
+)
+
+// snapshot returns a copy of the track that is safe to encode without
+// holding trackLock.
+func (t *Track) snapshot() Track {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+
+	copied := *t
+	copied.Waypoints = append([]Waypoint{}, t.Waypoints...)
+	return copied
+}
+
+// sampleTrack reads the signal every interval until ctx is cancelled.
+// Failed reads are kept as failed samples, as point measurements do.
+func sampleTrack(ctx context.Context, t *Track) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(time.Duration(t.Interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		info, _, err := getWifiSignalDbm(t.Interface)
+		sample := trackSample{Time: time.Now(), Link: info, Dbm: info.Signal}
+		if err != nil {
+			sample = trackSample{Time: sample.Time, Dbm: failedSampleDbm}
+		}
+
+		var waypoint *Waypoint
+		if t.CurrentPosition {
+			// The position is the latest fix, where the sample was taken.
+			// Positions on other floors, or none at all, leave a gap the
+			// samples are dropped from.
+			if position, err := positionProvider.Position(); err == nil && position.Floor == t.Floor {
+				waypoint = &Waypoint{Lat: position.Lat, Lng: position.Lng, Timestamp: sample.Time}
+			}
+		}
+
+		trackLock.Lock()
+		t.samples = append(t.samples, sample)
+		t.Samples = len(t.samples)
+		if waypoint != nil {
+			t.Waypoints = append(t.Waypoints, *waypoint)
+		}
+		full := t.Samples >= maxTrackSamples
+		trackLock.Unlock()
+
+		if full {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// interpolatePosition places t on the straight line between the waypoints
+// around it. It reports false outside the waypoints' time span.
+func interpolatePosition(waypoints []Waypoint, t time.Time) (float64, float64, bool) {
+	i := sort.Search(len(waypoints), func(i int) bool {
+		return !waypoints[i].Timestamp.Before(t)
+	})
+	if i == len(waypoints) {
+		return 0, 0, false
+	}
+
+	next := waypoints[i]
+	if next.Timestamp.Equal(t) {
+		return next.Lat, next.Lng, true
+	}
+	if i == 0 {
+		return 0, 0, false
+	}
+
+	prev := waypoints[i-1]
+	span := next.Timestamp.Sub(prev.Timestamp)
+	fraction := float64(t.Sub(prev.Timestamp)) / float64(span)
+	return prev.Lat + (next.Lat-prev.Lat)*fraction,
+		prev.Lng + (next.Lng-prev.Lng)*fraction, true
+}
+
+// trackMeasurements converts the samples of a finished track into
+// measurements and returns how many samples had no position.
+func trackMeasurements(t *Track) ([]Measurement, int) {
+	waypoints := append([]Waypoint{}, t.Waypoints...)
+	sort.SliceStable(waypoints, func(i, j int) bool {
+		return waypoints[i].Timestamp.Before(waypoints[j].Timestamp)
+	})
+
+	var records []Measurement
+	dropped := 0
+	for _, sample := range t.samples {
+		lat, lng, ok := interpolatePosition(waypoints, sample.Time)
+		if !ok {
+			dropped++
+			continue
+		}
+
+		records = append(records, Measurement{
+			ID:        newMeasurementID(),
+			Timestamp: sample.Time,
+			Dbm:       sample.Dbm,
+			Lat:       lat,
+			Lng:       lng,
+			Floor:     t.Floor,
+			Type:      "track",
+			SessionID: t.SessionID,
+			Interface: t.Interface,
+			SSID:      sample.Link.SSID,
+			BSSID:     sample.Link.BSSID,
+			Freq:      sample.Link.Freq,
+			Channel:   sample.Link.Channel,
+			TxBitrate: sample.Link.TxBitrate,
+			TrackID:   t.ID,
+			Height:    t.Height,
+		})
+	}
+
+	return records, dropped
+}
+
+// trackHandler returns the active track, or 404 when none is recording.
+func trackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trackLock.Lock()
+	t := activeTrack
+	trackLock.Unlock()
+
+	if t == nil {
+		http.Error(w, "no track is recording", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.snapshot())
+}
+
+func trackStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TrackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	_, exists := floors[req.Floor]
+	mutex.Unlock()
+	if !exists {
+		http.Error(w, "floor not found", http.StatusBadRequest)
+		return
+	}
+
+	if req.SessionID != "" {
+		if _, exists := getSession(req.SessionID); !exists {
+			http.Error(w, "session not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Interface == "" {
+		req.Interface = *wifiInterface
+	} else if !validInterface(req.Interface) {
+		http.Error(w, fmt.Sprintf("unknown wireless interface %q", req.Interface), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateHeight(req.Height); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPosition {
+		if _, err := positionProvider.Position(); errors.Is(err, errNoPositionProvider) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Interval == 0 {
+		req.Interval = defaultTrackInterval
+	}
+	if req.Interval < minTrackInterval {
+		http.Error(w, fmt.Sprintf("interval must be at least %d ms", minTrackInterval), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Track{
+		ID:              newMeasurementID(),
+		Floor:           req.Floor,
+		SessionID:       req.SessionID,
+		Interface:       req.Interface,
+		Interval:        req.Interval,
+		Height:          req.Height,
+		StartedAt:       time.Now(),
+		Waypoints:       []Waypoint{},
+		CurrentPosition: req.CurrentPosition,
+		cancel:          cancel,
+		done:            make(chan struct{}),
+	}
+
+	trackLock.Lock()
+	if activeTrack != nil {
+		trackLock.Unlock()
+		cancel()
+		http.Error(w, "a track is already recording", http.StatusConflict)
+		return
+	}
+	activeTrack = t
+	trackLock.Unlock()
+
+	go sampleTrack(ctx, t)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t.snapshot())
+}
+
+// trackPositionHandler adds waypoints to the active track. The body is a
+// stream of JSON waypoints, e.g. newline-delimited, which is read as the
+// client sends it, so one long request can carry a whole walk.
+func trackPositionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trackLock.Lock()
+	t := activeTrack
+	trackLock.Unlock()
+
+	if t == nil {
+		http.Error(w, "no track is recording", http.StatusConflict)
+		return
+	}
+
+	added := 0
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var waypoint Waypoint
+		err := decoder.Decode(&waypoint)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if waypoint.Timestamp.IsZero() {
+			waypoint.Timestamp = time.Now()
+		}
+
+		trackLock.Lock()
+		stopped := activeTrack != t
+		if !stopped {
+			t.Waypoints = append(t.Waypoints, waypoint)
+		}
+		trackLock.Unlock()
+
+		if stopped {
+			http.Error(w, "the track was stopped", http.StatusConflict)
+			return
+		}
+		added++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"added": added})
+}
+
+// trackStopHandler ends the active track and saves its samples as
+// measurements.
+func trackStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	trackLock.Lock()
+	t := activeTrack
+	activeTrack = nil
+	trackLock.Unlock()
+
+	if t == nil {
+		http.Error(w, "no track is recording", http.StatusConflict)
+		return
+	}
+
+	t.cancel()
+	<-t.done
+
+	records, dropped := trackMeasurements(t)
+	if len(records) > 0 {
+		if err := addMeasurements(auditActor(r), records...); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrackResult{
+		Track:        t.snapshot(),
+		Measurements: len(records),
+		Dropped:      dropped,
+	})
+}
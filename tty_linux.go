@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syscallNoCTTY keeps an opened tty from becoming the controlling terminal
+// of the server.
+const syscallNoCTTY = unix.O_NOCTTY
+
+// setRawTTY turns off the line discipline of a serial port, whose echo
+// would send the answers of a modem back to it.
+func setRawTTY(port *os.File) error {
+	termios, err := unix.IoctlGetTermios(int(port.Fd()), unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8 | unix.CLOCAL | unix.CREAD
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(int(port.Fd()), unix.TCSETS, termios)
+}
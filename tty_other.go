@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+const syscallNoCTTY = 0
+
+func setRawTTY(port *os.File) error {
+	return errors.New("AT command ports are only supported on Linux, use ModemManager")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// uiFiles is the built frontend, copied into ui/ by `npm run build:embed`
+// in wifi-heatmap-frontend before the binary is built.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+var serveUI = flag.Bool("ui", true, "serve the embedded web UI at /")
+
+const uiNotBuilt = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>HeatGen</title></head>
+<body>
+<h1>HeatGen</h1>
+<p>The web UI is not built into this binary. Run <code>npm run build:embed</code>
+in wifi-heatmap-frontend and build the server again.</p>
+<p>The API is available under <code>/api/</code>.</p>
+</body>
+</html>
+`
+
+// uiPath reports whether the path belongs to the UI rather than to the
+// API, the uploaded maps or the shared views.
+func uiPath(p string) bool {
+	return !strings.HasPrefix(p, "/api/") && !strings.HasPrefix(p, "/uploads/") && !embedPath(p) && p != "/readyz"
+}
+
+// uiHandler serves the embedded frontend. Paths that are not files get
+// index.html, so the app can handle them. The hashed assets under static/
+// never change and may be cached for good; index.html is revalidated so a
+// new binary takes effect on reload.
+func uiHandler() http.Handler {
+	files, _ := fs.Sub(uiFiles, "ui")
+	_, err := fs.Stat(files, "index.html")
+	built := err == nil
+	fileServer := http.FileServerFS(files)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !uiPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !built {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(uiNotBuilt))
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		info, err := fs.Stat(files, name)
+		file := name != "" && err == nil && !info.IsDir() && name != "README.md"
+		switch {
+		case strings.HasPrefix(name, "static/") && !file:
+			// Assets of another build; the app itself would not help.
+			http.NotFound(w, r)
+		case !file:
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFileFS(w, r, files, "index.html")
+		case strings.HasPrefix(name, "static/"):
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			fileServer.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Cache-Control", "no-cache")
+			fileServer.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usageFile          = "usage.json"
+	usageFlushInterval = time.Minute
+	// unmatchedEndpoint collects requests no route matched, so probing
+	// random paths cannot grow the statistics without bound.
+	unmatchedEndpoint = "unmatched"
+	// otherClients collects the clients beyond maxUsageClients, as
+	// addresses and keys are up to clients too.
+	otherClients      = "other"
+	maxUsageClients   = 1000
+	maxUsageEndpoints = 500
+)
+
+var adminToken = flag.String("admin-token", envOrDefault("HEATGEN_ADMIN_TOKEN", ""), "token required by the admin endpoints; they are open when empty")
+
+// UsageCounter accumulates the requests of one endpoint or client.
+type UsageCounter struct {
+	Requests   int64     `json:"requests"`
+	Errors     int64     `json:"errors"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"durationMs"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+func (c *UsageCounter) add(status int, bytes int64, duration time.Duration, now time.Time) {
+	c.Requests++
+	if status >= 400 {
+		c.Errors++
+	}
+	c.Bytes += bytes
+	c.DurationMs += duration.Milliseconds()
+	c.LastSeen = now
+}
+
+// ClientUsage is the usage of one client, in total and per endpoint.
+type ClientUsage struct {
+	UsageCounter
+	Endpoints map[string]*UsageCounter `json:"endpoints"`
+}
+
+// UsageStats counts requests per endpoint, named by method and route
+// pattern, and per client, named by its hashed X-API-Key or else its
+// address. It is kept in usage.json across restarts.
+type UsageStats struct {
+	Since     time.Time                `json:"since"`
+	Endpoints map[string]*UsageCounter `json:"endpoints"`
+	Clients   map[string]*ClientUsage  `json:"clients"`
+}
+
+func newUsageStats() UsageStats {
+	return UsageStats{
+		Since:     time.Now(),
+		Endpoints: make(map[string]*UsageCounter),
+		Clients:   make(map[string]*ClientUsage),
+	}
+}
+
+var (
+	usage      = newUsageStats()
+	usageDirty bool
+	usageLock  sync.Mutex
+)
+
+func loadUsage() error {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	data, err := os.ReadFile(usageFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	loaded := newUsageStats()
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	usage = loaded
+	return nil
+}
+
+func saveUsage() error {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(usageFile, data, 0644); err != nil {
+		return err
+	}
+	usageDirty = false
+	return nil
+}
+
+// startUsageFlush writes the statistics every minute when they changed.
+func startUsageFlush() {
+	go func() {
+		for range time.Tick(usageFlushInterval) {
+			usageLock.Lock()
+			dirty := usageDirty
+			usageLock.Unlock()
+
+			if dirty {
+				if err := saveUsage(); err != nil {
+					log.Printf("failed to save usage statistics: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// usageClient names the client of a request. API keys are hashed so that
+// usage.json and the admin endpoint do not reveal them.
+func usageClient(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:6])
+	}
+	return requestInitiator(r)
+}
+
+func recordUsage(endpoint, client string, status int, bytes int64, duration time.Duration) {
+	now := time.Now()
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	if _, exists := usage.Endpoints[endpoint]; !exists && len(usage.Endpoints) >= maxUsageEndpoints {
+		endpoint = unmatchedEndpoint
+	}
+	if _, exists := usage.Clients[client]; !exists && len(usage.Clients) >= maxUsageClients {
+		client = otherClients
+	}
+
+	counter, exists := usage.Endpoints[endpoint]
+	if !exists {
+		counter = &UsageCounter{}
+		usage.Endpoints[endpoint] = counter
+	}
+	counter.add(status, bytes, duration, now)
+
+	clientUsage, exists := usage.Clients[client]
+	if !exists {
+		clientUsage = &ClientUsage{Endpoints: make(map[string]*UsageCounter)}
+		usage.Clients[client] = clientUsage
+	}
+	clientUsage.add(status, bytes, duration, now)
+	counter, exists = clientUsage.Endpoints[endpoint]
+	if !exists {
+		counter = &UsageCounter{}
+		clientUsage.Endpoints[endpoint] = counter
+	}
+	counter.add(status, bytes, duration, now)
+
+	usageDirty = true
+}
+
+// usageRecorder captures the status and size of a response. It passes
+// hijacking and flushing through for the WebSocket and streaming
+// endpoints.
+type usageRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *usageRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *usageRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(data)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *usageRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *usageRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// usageMiddleware counts every request to the router. The endpoint is
+// the route pattern the router matched, so path parameters such as IDs do
+// not split the counts; requests with a method of their own are counted
+// as unmatched.
+func usageMiddleware(router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &usageRecorder{ResponseWriter: w}
+		router.ServeHTTP(rec, r)
+
+		endpoint := unmatchedEndpoint
+		if r.Pattern != "" && usageMethods[r.Method] {
+			endpoint = r.Method + " " + r.Pattern
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		recordUsage(endpoint, usageClient(r), rec.status, rec.bytes, time.Since(start))
+	})
+}
+
+// usageMethods are the methods counted per endpoint.
+var usageMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true}
+
+// requireAdmin checks the -admin-token bearer token and answers the
+// request itself when it is missing or wrong. The token is compared in
+// constant time.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if *adminToken == "" {
+		return true
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// usageHandler returns the usage statistics (GET) or resets them (DELETE).
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		usageLock.Lock()
+		data, err := json.Marshal(usage)
+		usageLock.Unlock()
+
+		if err != nil {
+			http.Error(w, "failed to encode usage statistics", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case "DELETE":
+		usageLock.Lock()
+		usage = newUsageStats()
+		usageLock.Unlock()
+
+		if err := saveUsage(); err != nil {
+			http.Error(w, "failed to save usage statistics", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// This file encodes lossless WebP (VP8L) images for heatmaps and tiles.
+// Heatmaps are smooth color ramps over large transparent or uniform areas,
+// which the predictor transform turns into runs of small residuals that
+// backward references and prefix codes compress well. The bitstream is
+// described at https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification.
+
+const (
+	webpMaxSize = 1 << 14
+	// webpPredictorBits is the log2 size of the blocks sharing a predictor.
+	webpPredictorBits = 5
+	webpMaxLength     = 4096
+	// webpHashBits sizes the table of earlier positions searched for
+	// backward references.
+	webpHashBits   = 16
+	webpChainDepth = 16
+	webpMinMatch   = 3
+	// webpCacheBits sizes the color cache, which codes a recently seen
+	// pixel by its index, a single green symbol.
+	webpCacheBits = 10
+	// webpMaxDistance is the farthest reference the 40 distance codes
+	// reach.
+	webpMaxDistance = 1<<20 - 120
+
+	webpLiteralCodes  = 256
+	webpLengthCodes   = 24
+	webpDistanceCodes = 40
+
+	webpTransformPredictor     = 0
+	webpTransformSubtractGreen = 2
+)
+
+// webpPredictors are the predictor modes tried for every block: L, T,
+// Average2(L, T), Select and ClampAddSubtractFull. Together they cover
+// flat areas and gradients in either direction.
+var webpPredictors = []int{1, 2, 7, 11, 12}
+
+// webpCodeLengthOrder is the order the code lengths of the code length
+// code are written in.
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// bitWriter writes the least significant bits first, as VP8L reads them.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+func (b *bitWriter) write(value uint32, bits uint) {
+	b.acc |= uint64(value) << b.bits
+	b.bits += bits
+	for b.bits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.bits -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.bits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.bits = 0, 0
+	}
+	return b.buf
+}
+
+// encodeWebP writes img as a lossless WebP image.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > webpMaxSize || height > webpMaxSize {
+		return errors.New("webp images must be between 1 and 16384 pixels wide and high")
+	}
+
+	argb := make([]uint32, width*height)
+	opaque := true
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			argb[y*width+x] = uint32(c.A)<<24 | uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+			opaque = opaque && c.A == 0xff
+		}
+	}
+
+	var b bitWriter
+	b.write(0x2f, 8)
+	b.write(uint32(width-1), 14)
+	b.write(uint32(height-1), 14)
+	if opaque {
+		b.write(0, 1)
+	} else {
+		b.write(1, 1)
+	}
+	b.write(0, 3)
+
+	b.write(1, 1)
+	b.write(webpTransformSubtractGreen, 2)
+	for i, p := range argb {
+		green := p >> 8 & 0xff
+		argb[i] = p&0xff00ff00 | (p>>16-green)&0xff<<16 | (p-green)&0xff
+	}
+
+	b.write(1, 1)
+	b.write(webpTransformPredictor, 2)
+	b.write(webpPredictorBits-2, 3)
+	modes, residuals := predict(argb, width, height)
+	writeEntropyImage(&b, modes, webpTiles(width), false)
+
+	b.write(0, 1)
+	writeEntropyImage(&b, residuals, width, true)
+
+	data := b.bytes()
+	chunk := len(data)
+	if chunk%2 == 1 {
+		data = append(data, 0)
+	}
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(chunk))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// webpTiles is the number of predictor blocks across size pixels.
+func webpTiles(size int) int {
+	return (size + 1<<webpPredictorBits - 1) >> webpPredictorBits
+}
+
+// predict chooses the predictor of every block, the one with the smallest
+// residuals, and returns the block modes as an image and the residuals.
+func predict(argb []uint32, width, height int) ([]uint32, []uint32) {
+	tilesX, tilesY := webpTiles(width), webpTiles(height)
+	modes := make([]uint32, tilesX*tilesY)
+	residuals := make([]uint32, len(argb))
+
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			x0, y0 := tx<<webpPredictorBits, ty<<webpPredictorBits
+			x1, y1 := min(x0+1<<webpPredictorBits, width), min(y0+1<<webpPredictorBits, height)
+
+			best, bestCost := webpPredictors[0], -1
+			for _, mode := range webpPredictors {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(subPixels(argb[y*width+x], predictPixel(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesX+tx] = 0xff000000 | uint32(best)<<8
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					residuals[y*width+x] = subPixels(argb[y*width+x], predictPixel(argb, width, x, y, best))
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// residualCost estimates the bits of a residual by the size of its
+// channels taken as signed bytes.
+func residualCost(p uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(p >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// predictPixel predicts the pixel at x, y with mode, the first row from
+// the left and the first column from the top as the decoder does.
+func predictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+
+	l, t, tl := argb[i-1], argb[i-width], argb[i-width-1]
+	// The pixel top right of the last column is the first of the row,
+	// next to it in memory.
+	tr := argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		if channelDistance(tl, t) < channelDistance(tl, l) {
+			return l
+		}
+		return t
+	case 12:
+		return mapChannels(l, t, tl, func(a, b, c int) int { return a + b - c })
+	case 13:
+		avg := average2(l, t)
+		return mapChannels(avg, tl, 0, func(a, b, _ int) int { return a + (a-b)/2 })
+	}
+	return 0xff000000
+}
+
+func average2(a, b uint32) uint32 {
+	return mapChannels(a, b, 0, func(a, b, _ int) int { return (a + b) / 2 })
+}
+
+// channelDistance is the sum of the absolute channel differences.
+func channelDistance(a, b uint32) int {
+	d := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) - int(b>>shift&0xff)
+		if v < 0 {
+			v = -v
+		}
+		d += v
+	}
+	return d
+}
+
+// mapChannels applies f to the channels of a, b and c, clamping the
+// results to bytes.
+func mapChannels(a, b, c uint32, f func(a, b, c int) int) uint32 {
+	var p uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := f(int(a>>shift&0xff), int(b>>shift&0xff), int(c>>shift&0xff))
+		p |= uint32(min(max(v, 0), 255)) << shift
+	}
+	return p
+}
+
+// subPixels subtracts b from a channel by channel, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	var p uint32
+	for shift := 0; shift < 32; shift += 8 {
+		p |= (a>>shift - b>>shift) & 0xff << shift
+	}
+	return p
+}
+
+// webpToken is a literal pixel, or a backward reference when length is
+// above zero. A cached literal is coded by its color cache index.
+type webpToken struct {
+	pixel    uint32
+	cached   bool
+	length   int
+	distance int
+}
+
+// backwardReferences splits the pixels into literals and copies of
+// earlier pixels: the previous pixel, the one above, or one of the last
+// webpChainDepth positions the same pixel pair was seen at, whichever
+// repeats longest.
+func backwardReferences(argb []uint32, width int) []webpToken {
+	var tokens []webpToken
+	var head [1 << webpHashBits]int32
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(argb))
+	hash := func(i int) int {
+		return int((argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1) >> (32 - webpHashBits))
+	}
+	matchLength := func(i, distance int) int {
+		n := 0
+		for i+n < len(argb) && n < webpMaxLength && argb[i+n] == argb[i+n-distance] {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(argb); {
+		bestLength, bestDistance := 0, 0
+		try := func(distance int) {
+			if distance < 1 || distance > i || distance > webpMaxDistance {
+				return
+			}
+			if n := matchLength(i, distance); n > bestLength {
+				bestLength, bestDistance = n, distance
+			}
+		}
+		// The neighbours go first: their distance codes are the shortest.
+		try(1)
+		try(width)
+		if i+1 < len(argb) {
+			for j, depth := head[hash(i)], 0; j >= 0 && depth < webpChainDepth && bestLength < webpMaxLength; j, depth = chain[j], depth+1 {
+				try(i - int(j))
+			}
+		}
+
+		if bestLength < webpMinMatch {
+			bestLength = 1
+			tokens = append(tokens, webpToken{pixel: argb[i]})
+		} else {
+			tokens = append(tokens, webpToken{length: bestLength, distance: bestDistance})
+		}
+		for end := i + bestLength; i < end; i++ {
+			if i+1 < len(argb) {
+				h := hash(i)
+				chain[i], head[h] = head[h], int32(i)
+			}
+		}
+	}
+	return tokens
+}
+
+// distanceCode maps a distance to its code: the two nearest neighbours
+// have short codes of their own, every other distance is offset by the
+// 120 codes of the neighbourhood.
+func distanceCode(distance, width int) int {
+	switch distance {
+	case width:
+		return 1
+	case 1:
+		return 2
+	}
+	return distance + 120
+}
+
+// prefixCode splits a length or distance code into its prefix symbol and
+// the extra bits that follow it.
+func prefixCode(value int) (symbol, extraBits, extra int) {
+	value--
+	if value < 4 {
+		return value, 0, 0
+	}
+	high := 31
+	for value>>high == 0 {
+		high--
+	}
+	second := value >> (high - 1) & 1
+	extraBits = high - 1
+	return 2*high + second, extraBits, value & (1<<extraBits - 1)
+}
+
+// prefixTree is a canonical prefix code by its code lengths. A code of a
+// single symbol takes no bits.
+type prefixTree struct {
+	lengths []int
+	codes   []uint32
+	single  bool
+}
+
+func newPrefixTree(counts []int, maxLength int) prefixTree {
+	lengths := codeLengths(counts, maxLength)
+	t := prefixTree{lengths: lengths, codes: make([]uint32, len(lengths))}
+
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	t.single = used <= 1
+
+	var next [16]uint32
+	var perLength [16]int
+	for _, l := range lengths {
+		perLength[l]++
+	}
+	perLength[0] = 0
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + uint32(perLength[l-1])) << 1
+		next[l] = code
+	}
+	for symbol, l := range lengths {
+		if l > 0 {
+			t.codes[symbol] = next[l]
+			next[l]++
+		}
+	}
+	return t
+}
+
+// writeSymbol writes the code of symbol, most significant bit first.
+func (t prefixTree) writeSymbol(b *bitWriter, symbol int) {
+	if t.single {
+		return
+	}
+	l := t.lengths[symbol]
+	code := t.codes[symbol]
+	var reversed uint32
+	for i := 0; i < l; i++ {
+		reversed = reversed<<1 | code>>i&1
+	}
+	b.write(reversed, uint(l))
+}
+
+// codeLengths builds the lengths of a Huffman code for the symbol counts,
+// flattening the counts until no code is longer than maxLength. Unused
+// symbols get no code; a single used symbol gets length 1.
+func codeLengths(counts []int, maxLength int) []int {
+	lengths := make([]int, len(counts))
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	switch len(symbols) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+
+	weights := make([]int, len(counts))
+	copy(weights, counts)
+	for {
+		type node struct {
+			weight      int
+			left, right int
+		}
+		nodes := make([]node, 0, 2*len(symbols))
+		for _, symbol := range symbols {
+			nodes = append(nodes, node{weight: weights[symbol], left: -1, right: symbol})
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+		// Leaves come sorted, and the joined nodes are made in order of
+		// weight, so the two lightest are always at the front of one of
+		// the two queues.
+		leaves, joined := 0, len(symbols)
+		lightest := func() int {
+			if leaves < len(symbols) && (joined == len(nodes) || nodes[leaves].weight <= nodes[joined].weight) {
+				leaves++
+				return leaves - 1
+			}
+			joined++
+			return joined - 1
+		}
+		for len(nodes) < 2*len(symbols)-1 {
+			a, b := lightest(), lightest()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+		}
+
+		depths := make([]int, len(nodes))
+		deepest := 0
+		for n := len(nodes) - 1; n >= 0; n-- {
+			if nodes[n].left < 0 {
+				lengths[nodes[n].right] = depths[n]
+				deepest = max(deepest, depths[n])
+				continue
+			}
+			depths[nodes[n].left] = depths[n] + 1
+			depths[nodes[n].right] = depths[n] + 1
+		}
+		if deepest <= maxLength {
+			return lengths
+		}
+		for _, symbol := range symbols {
+			weights[symbol] = (weights[symbol] + 1) / 2
+		}
+	}
+}
+
+// writePrefixTree writes the code lengths of t, as a simple code when it
+// has a single symbol that fits in eight bits.
+func writePrefixTree(b *bitWriter, t prefixTree) {
+	used := -1
+	for symbol, l := range t.lengths {
+		if l > 0 {
+			used = symbol
+		}
+	}
+	if t.single && used < 256 {
+		used = max(used, 0)
+		b.write(1, 1)
+		b.write(0, 1)
+		if used < 2 {
+			b.write(0, 1)
+			b.write(uint32(used), 1)
+		} else {
+			b.write(1, 1)
+			b.write(uint32(used), 8)
+		}
+		return
+	}
+
+	// The lengths are run-length coded: 16 repeats the previous length 3
+	// to 6 times, 17 and 18 write 3 to 10 and 11 to 138 zeros.
+	type run struct{ symbol, extraBits, extra int }
+	var runs []run
+	for i := 0; i < len(t.lengths); {
+		l := t.lengths[i]
+		n := 1
+		for i+n < len(t.lengths) && t.lengths[i+n] == l {
+			n++
+		}
+		i += n
+		if l == 0 {
+			for n >= 11 {
+				r := min(n, 138)
+				runs = append(runs, run{18, 7, r - 11})
+				n -= r
+			}
+			if n >= 3 {
+				runs = append(runs, run{17, 3, n - 3})
+				n = 0
+			}
+		} else {
+			runs = append(runs, run{l, 0, 0})
+			n--
+			for n >= 3 {
+				r := min(n, 6)
+				runs = append(runs, run{16, 2, r - 3})
+				n -= r
+			}
+		}
+		for ; n > 0; n-- {
+			runs = append(runs, run{l, 0, 0})
+		}
+	}
+
+	counts := make([]int, 19)
+	for _, r := range runs {
+		counts[r.symbol]++
+	}
+	lengthTree := newPrefixTree(counts, 7)
+	written := 4
+	for i, symbol := range webpCodeLengthOrder {
+		if lengthTree.lengths[symbol] > 0 {
+			written = max(written, i+1)
+		}
+	}
+
+	b.write(0, 1)
+	b.write(uint32(written-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:written] {
+		b.write(uint32(lengthTree.lengths[symbol]), 3)
+	}
+	b.write(0, 1)
+	for _, r := range runs {
+		lengthTree.writeSymbol(b, r.symbol)
+		b.write(uint32(r.extra), uint(r.extraBits))
+	}
+}
+
+// writeEntropyImage writes pixels as an entropy-coded image with one set
+// of prefix codes. Literals seen recently are coded by their index in the
+// color cache, which the decoder fills with every pixel as it goes.
+func writeEntropyImage(b *bitWriter, argb []uint32, width int, topLevel bool) {
+	tokens := backwardReferences(argb, width)
+
+	var cache [1 << webpCacheBits]uint32
+	cacheIndex := func(p uint32) int {
+		return int(p * 0x1e35a7bd >> (32 - webpCacheBits))
+	}
+	p := 0
+	for i, t := range tokens {
+		if t.length > 0 {
+			for end := p + t.length; p < end; p++ {
+				cache[cacheIndex(argb[p])] = argb[p]
+			}
+			continue
+		}
+		index := cacheIndex(t.pixel)
+		if cache[index] == t.pixel {
+			tokens[i].cached = true
+		}
+		cache[index] = t.pixel
+		p++
+	}
+
+	green := make([]int, webpLiteralCodes+webpLengthCodes+1<<webpCacheBits)
+	red := make([]int, webpLiteralCodes)
+	blue := make([]int, webpLiteralCodes)
+	alpha := make([]int, webpLiteralCodes)
+	distance := make([]int, webpDistanceCodes)
+	for _, t := range tokens {
+		switch {
+		case t.cached:
+			green[webpLiteralCodes+webpLengthCodes+cacheIndex(t.pixel)]++
+		case t.length == 0:
+			green[t.pixel>>8&0xff]++
+			red[t.pixel>>16&0xff]++
+			blue[t.pixel&0xff]++
+			alpha[t.pixel>>24]++
+		default:
+			symbol, _, _ := prefixCode(t.length)
+			green[webpLiteralCodes+symbol]++
+			symbol, _, _ = prefixCode(distanceCode(t.distance, width))
+			distance[symbol]++
+		}
+	}
+
+	b.write(1, 1)
+	b.write(webpCacheBits, 4)
+	if topLevel {
+		b.write(0, 1)
+	}
+	trees := [5]prefixTree{
+		newPrefixTree(green, 15),
+		newPrefixTree(red, 15),
+		newPrefixTree(blue, 15),
+		newPrefixTree(alpha, 15),
+		newPrefixTree(distance, 15),
+	}
+	for _, t := range trees {
+		writePrefixTree(b, t)
+	}
+
+	for _, t := range tokens {
+		switch {
+		case t.cached:
+			trees[0].writeSymbol(b, webpLiteralCodes+webpLengthCodes+cacheIndex(t.pixel))
+		case t.length == 0:
+			trees[0].writeSymbol(b, int(t.pixel>>8&0xff))
+			trees[1].writeSymbol(b, int(t.pixel>>16&0xff))
+			trees[2].writeSymbol(b, int(t.pixel&0xff))
+			trees[3].writeSymbol(b, int(t.pixel>>24))
+		default:
+			symbol, extraBits, extra := prefixCode(t.length)
+			trees[0].writeSymbol(b, webpLiteralCodes+symbol)
+			b.write(uint32(extra), uint(extraBits))
+			symbol, extraBits, extra = prefixCode(distanceCode(t.distance, width))
+			trees[4].writeSymbol(b, symbol)
+			b.write(uint32(extra), uint(extraBits))
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// webpTestImage fills an image of the given size from pixel.
+func webpTestImage(width, height int, pixel func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, pixel(x, y))
+		}
+	}
+	return img
+}
+
+// comparePixels fails the test at the first pixel of decoded that differs
+// from img.
+func comparePixels(t *testing.T, decoded image.Image, img *image.NRGBA) {
+	t.Helper()
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("bounds %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			if want := img.NRGBAAt(x, y); got != want {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name          string
+		width, height int
+		pixel         func(x, y int) color.NRGBA
+	}{
+		{"single pixel", 1, 1, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 40} }},
+		{"transparent", 40, 30, func(x, y int) color.NRGBA { return color.NRGBA{} }},
+		{"opaque", 33, 17, func(x, y int) color.NRGBA { return color.NRGBA{200, 100, 50, 255} }},
+		{"column", 1, 70, func(x, y int) color.NRGBA { return color.NRGBA{uint8(y), 0, uint8(3 * y), 255} }},
+		{"row", 70, 1, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(x * x), 0, uint8(x)} }},
+		{"gradient", 130, 90, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 2), uint8(y * 3), uint8(x + y), uint8(128 + x/2)}
+		}},
+		{"heatmap", 200, 150, func(x, y int) color.NRGBA {
+			if (x-100)*(x-100)+(y-75)*(y-75) > 60*60 {
+				return color.NRGBA{}
+			}
+			v := (x + y) * 255 / 350
+			return color.NRGBA{uint8(255 - v), uint8(v), uint8(v / 2), 160}
+		}},
+		{"noise", 64, 48, func(x, y int) color.NRGBA {
+			v := random.Uint32()
+			return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), uint8(v >> 24)}
+		}},
+		{"stripes", 300, 40, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x % 7 * 30), uint8(y % 5 * 40), 0, 255}
+		}},
+		// A run longer than the longest backward reference.
+		{"long run", 5000, 2, func(x, y int) color.NRGBA { return color.NRGBA{0, 0, 200, 128} }},
+		// The last rows repeat the first ones, close to the farthest
+		// distance a reference reaches.
+		{"far repeat", 1024, 1030, func(x, y int) color.NRGBA {
+			y %= 1020
+			if y >= 10 {
+				return color.NRGBA{}
+			}
+			v := uint32(x*2654435761) ^ uint32(y*40503)
+			return color.NRGBA{uint8(v), uint8(v >> 8), uint8(v >> 16), 255}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img := webpTestImage(test.width, test.height, test.pixel)
+			var buf bytes.Buffer
+			if err := encodeWebP(&buf, img); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			comparePixels(t, decoded, img)
+		})
+	}
+}
+
+// TestEncodeWebPContainer checks the RIFF container and the VP8L header
+// against the bitstream specification, which the decoder is lenient about.
+func TestEncodeWebPContainer(t *testing.T) {
+	tests := []struct {
+		width, height int
+		alpha         uint8
+	}{
+		{1, 1, 255},
+		{77, 3, 255},
+		{3, 77, 10},
+		{256, 256, 0},
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("%dx%d alpha %d", test.width, test.height, test.alpha)
+		img := webpTestImage(test.width, test.height, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), 7, test.alpha} })
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, img); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		data := buf.Bytes()
+
+		if len(data) < 25 || string(data[:4]) != "RIFF" || string(data[8:16]) != "WEBPVP8L" {
+			t.Fatalf("%s: no RIFF WEBP file with a VP8L chunk: % x", name, data[:min(len(data), 16)])
+		}
+		if size := binary.LittleEndian.Uint32(data[4:]); int(size) != len(data)-8 {
+			t.Errorf("%s: RIFF size %d, file is %d bytes", name, size, len(data))
+		}
+		chunk := binary.LittleEndian.Uint32(data[16:])
+		if padded := int(chunk + chunk&1); padded != len(data)-20 {
+			t.Errorf("%s: VP8L chunk of %d bytes in %d bytes of payload", name, chunk, len(data)-20)
+		}
+
+		if data[20] != 0x2f {
+			t.Errorf("%s: VP8L signature %#x", name, data[20])
+		}
+		header := binary.LittleEndian.Uint32(data[21:])
+		width, height := int(header&0x3fff)+1, int(header>>14&0x3fff)+1
+		alpha, version := header>>28&1, header>>29
+		if width != test.width || height != test.height {
+			t.Errorf("%s: header gives %dx%d", name, width, height)
+		}
+		wantAlpha := uint32(1)
+		if test.alpha == 255 {
+			wantAlpha = 0
+		}
+		if alpha != wantAlpha {
+			t.Errorf("%s: alpha hint %d, want %d", name, alpha, wantAlpha)
+		}
+		if version != 0 {
+			t.Errorf("%s: version %d, want 0", name, version)
+		}
+	}
+}
+
+// TestEncodeWebPLibwebp decodes with dwebp of libwebp, the reference
+// implementation, when it is installed.
+func TestEncodeWebPLibwebp(t *testing.T) {
+	dwebp, err := exec.LookPath("dwebp")
+	if err != nil {
+		t.Skip("dwebp of libwebp is not installed")
+	}
+
+	random := rand.New(rand.NewSource(2))
+	img := webpTestImage(301, 203, func(x, y int) color.NRGBA {
+		if random.Intn(10) == 0 {
+			return color.NRGBA{uint8(random.Uint32()), uint8(x), uint8(y), uint8(random.Uint32())}
+		}
+		return color.NRGBA{uint8(x), uint8(y), uint8(x + y), uint8(255 - x/2)}
+	})
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "image.webp"), filepath.Join(dir, "image.pam")
+	if err := os.WriteFile(input, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(dwebp, input, "-pam", "-o", output).CombinedOutput(); err != nil {
+		t.Fatalf("dwebp: %v: %s", err, out)
+	}
+	decoded, err := readPAM(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comparePixels(t, decoded, img)
+}
+
+// readPAM reads the RGB_ALPHA PAM files dwebp writes.
+func readPAM(name string) (*image.NRGBA, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var width, height int
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading the PAM header: %v", err)
+		}
+		if line == "ENDHDR\n" {
+			break
+		}
+		fmt.Sscanf(line, "WIDTH %d", &width)
+		fmt.Sscanf(line, "HEIGHT %d", &height)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if _, err := io.ReadFull(reader, img.Pix); err != nil {
+		return nil, fmt.Errorf("reading the PAM pixels: %v", err)
+	}
+	return img, nil
+}
+
+func TestEncodeWebPSize(t *testing.T) {
+	if err := encodeWebP(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, webpMaxSize+1, 1))); err == nil {
+		t.Error("an image wider than WebP allows was encoded")
+	}
+}
+
+func TestCodeLengthsLimit(t *testing.T) {
+	// Fibonacci counts make the deepest Huffman trees.
+	counts := make([]int, 40)
+	a, b := 1, 1
+	for i := range counts {
+		counts[i] = a
+		a, b = b, a+b
+	}
+	lengths := codeLengths(counts, 15)
+
+	kraft := 0.0
+	for _, l := range lengths {
+		if l < 1 || l > 15 {
+			t.Fatalf("code length %d outside 1 to 15", l)
+		}
+		kraft += 1 / float64(int(1)<<l)
+	}
+	if kraft > 1 {
+		t.Errorf("the code lengths are not a prefix code, Kraft sum %g", kraft)
+	}
+}
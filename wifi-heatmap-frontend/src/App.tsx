@@ -6,6 +6,12 @@ import 'leaflet.heat';
 import { saveAs } from 'file-saver';
 import './App.css';
 
+// The API is served from the same origin as the UI, by the server that
+// embeds it or, with `npm start`, through the development proxy. Set
+// REACT_APP_API_URL to use a server elsewhere.
+const API_URL = process.env.REACT_APP_API_URL || '';
+const WS_URL = (API_URL || window.location.origin).replace(/^http/, 'ws');
+
 interface Measurement {
   id: string;
   timestamp: string;
@@ -15,12 +21,20 @@ interface Measurement {
   floor: number;
   location: string;
   type: string;
+  ssid?: string;
+  bssid?: string;
+  freq?: number;
+  channel?: number;
+  txBitrate?: number;
+  roamed?: boolean;
 }
 
 interface Floor {
   id: number;
   name: string;
   mapPath: string;
+  mapWidth?: number;
+  mapHeight?: number;
 }
 
 const HeatmapLayer: React.FC<{ measurements: Measurement[] }> = ({ measurements }) => {
@@ -62,10 +76,34 @@ const App: React.FC = () => {
     fetchFloors();
   }, [currentFloor]);
 
+  // Live updates, so measurements taken or deleted elsewhere show up
+  // without reloading.
+  useEffect(() => {
+    const socket = new WebSocket(`${WS_URL}/api/ws?floor=${currentFloor}`);
+    socket.onmessage = (message) => {
+      const event = JSON.parse(message.data);
+      if (event.type === 'measurements.added') {
+        setMeasurements(prev => [
+          ...prev,
+          ...(event.measurements as Measurement[]).filter(m => !prev.some(p => p.id === m.id)),
+        ]);
+      } else if (event.type === 'measurements.deleted') {
+        setMeasurements(prev => prev.filter(m => !event.ids.includes(m.id)));
+      } else if (event.type === 'measurements.updated') {
+        const updated = event.measurements as Measurement[];
+        setMeasurements(prev => [
+          ...prev.filter(m => !updated.some(u => u.id === m.id)),
+          ...updated.filter(u => u.floor === currentFloor),
+        ]);
+      }
+    };
+    return () => socket.close();
+  }, [currentFloor]);
+
   const fetchMeasurements = async () => {
     setIsLoading(true);
     try {
-      const response = await fetch(`http://localhost:8080/api/measurements?floor=${currentFloor}`);
+      const response = await fetch(`${API_URL}/api/measurements?floor=${currentFloor}`);
       if (!response.ok) {
         throw new Error('Failed to fetch measurements');
       }
@@ -81,7 +119,7 @@ const App: React.FC = () => {
 
   const fetchFloors = async () => {
     try {
-      const response = await fetch('http://localhost:8080/api/floors');
+      const response = await fetch(`${API_URL}/api/floors`);
       if (!response.ok) {
         throw new Error('Failed to fetch floors');
       }
@@ -98,12 +136,14 @@ const App: React.FC = () => {
 
   const handleExport = async () => {
     try {
-      const response = await fetch(`http://localhost:8080/api/export?floor=${currentFloor}`);
+      const response = await fetch(`${API_URL}/api/export?floor=${currentFloor}`);
       if (!response.ok) {
         throw new Error('Export failed');
       }
       const blob = await response.blob();
-      saveAs(blob, `wifi_heatmap_floor_${currentFloor}.csv`);
+      const disposition = response.headers.get('Content-Disposition') || '';
+      const match = disposition.match(/filename="?([^";]+)"?/);
+      saveAs(blob, match ? match[1] : `wifi_floor${currentFloor}.csv`);
     } catch (error) {
       console.error('Export failed:', error);
       alert('Export failed: ' + (error as Error).message);
@@ -210,7 +250,7 @@ const App: React.FC = () => {
     }
 
     try {
-      const response = await fetch('http://localhost:8080/api/floors/add', {
+      const response = await fetch(`${API_URL}/api/floors/add`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -245,7 +285,7 @@ const App: React.FC = () => {
 
     try {
       setIsLoading(true);
-      const response = await fetch(`http://localhost:8080/api/floors/upload-map/${currentFloor}`, {
+      const response = await fetch(`${API_URL}/api/floors/upload-map/${currentFloor}`, {
         method: 'POST',
         body: formData,
       });
@@ -258,19 +298,15 @@ const App: React.FC = () => {
 
       await fetchFloors();
 
-      const img = new Image();
-      img.onload = () => {
-        const newBounds: L.LatLngBoundsExpression = [
-          [0, 0],
-          [img.height, img.width]
-        ];
-        setMapBounds(newBounds);
-        if (mapRef.current) {
-          mapRef.current.fitBounds(newBounds);
-          mapRef.current.invalidateSize();
-        }
-      };
-      img.src = `http://localhost:8080${result.path}`;
+      const newBounds: L.LatLngBoundsExpression = [
+        [0, 0],
+        [result.height, result.width]
+      ];
+      setMapBounds(newBounds);
+      if (mapRef.current) {
+        mapRef.current.fitBounds(newBounds);
+        mapRef.current.invalidateSize();
+      }
 
       alert('Map uploaded successfully!');
     } catch (error) {
@@ -286,7 +322,7 @@ const App: React.FC = () => {
     const location = locationName.trim() || (measurementType === 'location' ? 'Location Point' : 'Access Point');
 
     try {
-      const response = await fetch('http://localhost:8080/api/add', {
+      const response = await fetch(`${API_URL}/api/add`, {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -304,8 +340,22 @@ const App: React.FC = () => {
         throw new Error('Failed to add measurement');
       }
 
-      const newMeasurement = await response.json();
-      setMeasurements(prev => [...prev, newMeasurement]);
+      let job = await response.json();
+      while (job.status === 'running') {
+        await new Promise(resolve => setTimeout(resolve, 500));
+        const jobResponse = await fetch(`${API_URL}/api/jobs/${job.id}`);
+        if (!jobResponse.ok) {
+          throw new Error('Failed to check measurement progress');
+        }
+        job = await jobResponse.json();
+      }
+
+      if (job.status !== 'done') {
+        throw new Error(job.error || `measurement ${job.status}`);
+      }
+
+      const newMeasurements: Measurement[] = job.measurements || [job.measurement];
+      setMeasurements(prev => [...prev, ...newMeasurements.filter(m => !prev.some(p => p.id === m.id))]);
       setLocationName('');
     } catch (error) {
       alert('Failed to add measurement: ' + (error as Error).message);
@@ -318,7 +368,7 @@ const App: React.FC = () => {
     }
 
     try {
-      const response = await fetch(`http://localhost:8080/api/delete/${id}`, {
+      const response = await fetch(`${API_URL}/api/delete/${id}`, {
         method: 'DELETE'
       });
 
@@ -363,7 +413,7 @@ const App: React.FC = () => {
                     />
                 )}
 
-                <HeatmapLayer measurements={measurements} />
+                <HeatmapLayer measurements={measurements.filter(m => m.type !== 'scan')} />
 
                 <MapClickHandler onMapClick={handleAddMeasurement} />
 
@@ -399,6 +449,10 @@ const App: React.FC = () => {
                           <strong>{m.location}</strong>
                           <p>Type: {m.type === 'location' ? 'Location' : 'Access Point'}</p>
                           <p>Signal: {m.dbm} dBm</p>
+                          {m.bssid && (
+                              <p>AP: {m.ssid} ({m.bssid}){m.roamed ? ' – roamed while sampling' : ''}</p>
+                          )}
+                          {m.channel ? <p>Channel: {m.channel} ({m.freq} MHz){m.txBitrate ? `, ${m.txBitrate} MBit/s` : ''}</p> : null}
                           <p>Time: {new Date(m.timestamp).toLocaleString()}</p>
                           <button
                               onClick={() => handleDeleteMeasurement(m.id)}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultStreamInterval = 500
+
+type LinkInfo struct {
+	Connected bool    `json:"connected"`
+	SSID      string  `json:"ssid,omitempty"`
+	BSSID     string  `json:"bssid,omitempty"`
+	Freq      int     `json:"freq,omitempty"`
+	Channel   int     `json:"channel,omitempty"`
+	Band      string  `json:"band,omitempty"`
+	Signal    int     `json:"signal,omitempty"`
+	TxBitrate float64 `json:"txBitrate,omitempty"`
+	RxBitrate float64 `json:"rxBitrate,omitempty"`
+}
+
+var (
+	linkBSSIDRe     = regexp.MustCompile(`Connected to ([0-9a-fA-F:]{17})`)
+	linkSSIDRe      = regexp.MustCompile(`(?m)^\s*SSID:\s*(.*)$`)
+	linkFreqRe      = regexp.MustCompile(`freq:\s*(\d+)`)
+	linkSignalRe    = regexp.MustCompile(`signal:\s*(-?\d+)\s*dBm`)
+	linkTxBitrateRe = regexp.MustCompile(`tx bitrate:\s*([\d.]+)\s*MBit/s`)
+	linkRxBitrateRe = regexp.MustCompile(`rx bitrate:\s*([\d.]+)\s*MBit/s`)
+)
+
+// parseLinkInfo extracts the association details from `iw dev <iface> link`.
+func parseLinkInfo(output string) LinkInfo {
+	var info LinkInfo
+	if match := linkBSSIDRe.FindStringSubmatch(output); match != nil {
+		info.Connected = true
+		info.BSSID = strings.ToLower(match[1])
+	}
+	if match := linkSSIDRe.FindStringSubmatch(output); match != nil {
+		info.SSID = strings.TrimSpace(match[1])
+	}
+	if match := linkFreqRe.FindStringSubmatch(output); match != nil {
+		info.Freq, _ = strconv.Atoi(match[1])
+		info.Channel = frequencyToChannel(info.Freq)
+		info.Band = bandForFrequency(info.Freq)
+	}
+	if match := linkSignalRe.FindStringSubmatch(output); match != nil {
+		info.Signal, _ = strconv.Atoi(match[1])
+	}
+	if match := linkTxBitrateRe.FindStringSubmatch(output); match != nil {
+		info.TxBitrate, _ = strconv.ParseFloat(match[1], 64)
+	}
+	if match := linkRxBitrateRe.FindStringSubmatch(output); match != nil {
+		info.RxBitrate, _ = strconv.ParseFloat(match[1], 64)
+	}
+	return info
+}
+
+// wifiStatusHandler reports the current association of the collector
+// without storing a measurement.
+func wifiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	iface, err := interfaceParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, output, err := getWifiSignalDbm(iface)
+	if err != nil && info.Connected {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !info.Connected && strings.TrimSpace(output) != "Not connected." {
+		detail := strings.TrimSpace(output)
+		if detail == "" && err != nil {
+			detail = err.Error()
+		}
+		http.Error(w, "failed to read link status: "+detail, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// wifiStreamHandler streams the live link signal as server-sent events every
+// interval milliseconds until the client disconnects. Nothing is stored.
+func wifiStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	iface, err := interfaceParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	interval := defaultStreamInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 100 || parsed > 10000 {
+			http.Error(w, "interval must be between 100 and 10000 ms", http.StatusBadRequest)
+			return
+		}
+		interval = parsed
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		info, _, err := getWifiSignalDbm(iface)
+		signal := info.Signal
+		if err != nil {
+			signal = failedSampleDbm
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{
+			"timestamp": time.Now(),
+			"dbm":       signal,
+			"bssid":     info.BSSID,
+			"freq":      info.Freq,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	// wsSendBuffer is how many events a client may lag behind before it is
+	// disconnected.
+	wsSendBuffer = 64
+)
+
+const (
+	eventMeasurementsAdded   = "measurements.added"
+	eventMeasurementsDeleted = "measurements.deleted"
+	eventMeasurementsUpdated = "measurements.updated"
+	eventFloorCreated        = "floor.created"
+	eventFloorUpdated        = "floor.updated"
+	eventFloorDeleted        = "floor.deleted"
+	eventJob                 = "job"
+)
+
+// Event is pushed to WebSocket clients as JSON.
+type Event struct {
+	Type         string        `json:"type"`
+	Revision     string        `json:"revision,omitempty"`
+	Measurements []Measurement `json:"measurements,omitempty"`
+	IDs          []string      `json:"ids,omitempty"`
+	Floor        *Floor        `json:"floor,omitempty"`
+	Job          *Job          `json:"job,omitempty"`
+}
+
+type wsClient struct {
+	send chan []byte
+	// floor limits added measurements to one floor, 0 for all.
+	floor int
+}
+
+var (
+	wsClients = make(map[*wsClient]bool)
+	wsLock    sync.Mutex
+
+	wsUpgrader = websocket.Upgrader{
+		// Browsers are held to -cors-origins, as for the rest of the API.
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || allowedOrigin(origin) != ""
+		},
+	}
+)
+
+// publish sends the event to every client, or only to those following
+// floor when it is not 0. Clients that cannot keep up are dropped.
+// Measurement and floor events are also recorded for /api/changes.
+func publish(event Event, floor int) {
+	if event.Type != eventJob {
+		recordChange(event, floor)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("failed to encode %s event: %v", event.Type, err)
+		return
+	}
+
+	wsLock.Lock()
+	defer wsLock.Unlock()
+
+	for client := range wsClients {
+		if floor != 0 && client.floor != 0 && client.floor != floor {
+			continue
+		}
+		select {
+		case client.send <- data:
+		default:
+			delete(wsClients, client)
+			close(client.send)
+		}
+	}
+}
+
+// publishAdded announces new measurements, grouped by floor.
+func publishAdded(records []Measurement, revision string) {
+	byFloor := make(map[int][]Measurement)
+	for _, record := range records {
+		byFloor[record.Floor] = append(byFloor[record.Floor], record)
+	}
+	for floor, list := range byFloor {
+		publish(Event{Type: eventMeasurementsAdded, Revision: revision, Measurements: list}, floor)
+	}
+}
+
+func publishDeleted(ids []string, revision string) {
+	if len(ids) > 0 {
+		publish(Event{Type: eventMeasurementsDeleted, Revision: revision, IDs: ids}, 0)
+	}
+}
+
+// publishFloor announces a created, updated or deleted floor. Updated
+// floors are sent whole.
+func publishFloor(eventType string, floor Floor) {
+	publish(Event{Type: eventType, Floor: &floor}, 0)
+}
+
+func publishJob(job *Job) {
+	snapshot := job.snapshot()
+	publish(Event{Type: eventJob, Job: &snapshot}, 0)
+}
+
+// wsHandler streams events to the client: added, updated and deleted
+// measurements and floors and the progress of sampling jobs. The optional floor query
+// parameter limits added measurements to one floor.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	var floor int
+	if value := r.URL.Query().Get("floor"); value != "" {
+		var err error
+		if floor, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid floor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		return
+	}
+
+	client := &wsClient{send: make(chan []byte, wsSendBuffer), floor: floor}
+	wsLock.Lock()
+	wsClients[client] = true
+	wsLock.Unlock()
+
+	// The reader only notices the client going away; incoming messages are
+	// ignored.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		wsLock.Lock()
+		if wsClients[client] {
+			delete(wsClients, client)
+			close(client.send)
+		}
+		wsLock.Unlock()
+		conn.Close()
+	}()
+
+	mutex.Lock()
+	hello, _ := json.Marshal(Event{Type: "ready", Revision: dataRevision})
+	mutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data, ok := <-client.send:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(wsWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
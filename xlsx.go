@@ -0,0 +1,502 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Styles of the cells, indices into cellXfs of xlsxStyles.
+const (
+	xlsxStyleDefault = iota
+	xlsxStyleHeader
+	xlsxStyleTime
+	xlsxStyleDecimal
+	xlsxStyleCoordinate
+	xlsxStylePercent
+)
+
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts count="4"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="0.0"/><numFmt numFmtId="166" formatCode="0.000000"/><numFmt numFmtId="167" formatCode="0.0%"/></numFmts>
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill><fill><patternFill patternType="solid"><fgColor rgb="FFD9E1F2"/></patternFill></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="6"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="2" borderId="0" xfId="0" applyFont="1" applyFill="1"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="166" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="167" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>
+<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>
+</styleSheet>`
+
+// xlsxCell is a cell of a sheet: text, a number or, when neither is set,
+// empty.
+type xlsxCell struct {
+	text     string
+	number   float64
+	isNumber bool
+	style    int
+}
+
+func xlsxText(text string) xlsxCell {
+	return xlsxCell{text: text}
+}
+
+func xlsxNumber(value float64, style int) xlsxCell {
+	return xlsxCell{number: value, isNumber: true, style: style}
+}
+
+func xlsxOptional(value *float64) xlsxCell {
+	if value == nil {
+		return xlsxCell{}
+	}
+	return xlsxNumber(*value, xlsxStyleDecimal)
+}
+
+// xlsxColumn is a column of the floor sheets.
+type xlsxColumn struct {
+	header string
+	width  float64
+	cell   func(m Measurement) xlsxCell
+}
+
+// xlsxSheet is a worksheet being written.
+type xlsxSheet struct {
+	name   string
+	widths []float64
+	rows   [][]xlsxCell
+	// colorScale colors the numbers of a column, by its letter, on the
+	// stops of a color scale from min to max.
+	colorScale         string
+	scaleMin, scaleMax float64
+	scaleStops         []color.RGBA
+	// chart is the drawing of the sheet, if any.
+	chart []byte
+	// chartRow is the row the chart is anchored at.
+	chartRow int
+}
+
+// xlsxColumnName returns the letters of a 0-based column index.
+func xlsxColumnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxEscape escapes text for XML, dropping the control characters it
+// cannot hold.
+func xlsxEscape(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, text)
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// xlsxSerial converts a time to an Excel date serial, the days since
+// 1899-12-30, of its wall clock in loc.
+func xlsxSerial(t time.Time, loc *time.Location) float64 {
+	t = t.In(loc)
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return wall.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)).Hours() / 24
+}
+
+// xlsxSheetName makes a valid and unique sheet name: at most 31
+// characters, none of []:*?/\.
+func xlsxSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return ' '
+		}
+		return r
+	}, name)
+	runes := []rune(strings.TrimSpace(name))
+	if len(runes) > 31 {
+		runes = runes[:31]
+	}
+	name = string(runes)
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		base := []rune(string(runes))
+		if len(base)+len(suffix) > 31 {
+			base = base[:31-len(suffix)]
+		}
+		name = string(base) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+// xlsxSheetRef quotes a sheet name for references from formulas and
+// charts.
+func xlsxSheetRef(name string) string {
+	return "'" + strings.ReplaceAll(name, "'", "''") + "'"
+}
+
+// filterRange is the range of the autofilter of the sheet, empty when it
+// has none.
+func (s *xlsxSheet) filterRange() string {
+	if s.colorScale == "" || len(s.rows) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("$A$1:$%s$%d", xlsxColumnName(len(s.widths)-1), len(s.rows))
+}
+
+func (s *xlsxSheet) xml() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">`)
+	// The header row stays in view while scrolling.
+	b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	b.WriteString("<cols>")
+	for i, width := range s.widths {
+		fmt.Fprintf(&b, `<col min="%d" max="%d" width="%g" customWidth="1"/>`, i+1, i+1, width)
+	}
+	b.WriteString("</cols><sheetData>")
+	for r, row := range s.rows {
+		if len(row) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := xlsxColumnName(c) + strconv.Itoa(r+1)
+			switch {
+			case cell.isNumber:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, cell.style, strconv.FormatFloat(cell.number, 'f', -1, 64))
+			case cell.text != "":
+				fmt.Fprintf(&b, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, cell.style, xlsxEscape(cell.text))
+			}
+		}
+		b.WriteString("</row>")
+	}
+	b.WriteString("</sheetData>")
+	if filter := s.filterRange(); filter != "" {
+		fmt.Fprintf(&b, `<autoFilter ref="%s"/>`, strings.ReplaceAll(filter, "$", ""))
+		// Spreadsheets take up to three stops: the ends and the middle.
+		stops := []color.RGBA{s.scaleStops[0], s.scaleStops[len(s.scaleStops)-1]}
+		values := []float64{s.scaleMin, s.scaleMax}
+		if len(s.scaleStops) > 2 {
+			stops = []color.RGBA{s.scaleStops[0], s.scaleStops[len(s.scaleStops)/2], s.scaleStops[len(s.scaleStops)-1]}
+			values = []float64{s.scaleMin, (s.scaleMin + s.scaleMax) / 2, s.scaleMax}
+		}
+		fmt.Fprintf(&b, `<conditionalFormatting sqref="%[1]s2:%[1]s%[2]d"><cfRule type="colorScale" priority="1"><colorScale>`, s.colorScale, len(s.rows))
+		for _, value := range values {
+			fmt.Fprintf(&b, `<cfvo type="num" val="%s"/>`, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+		for _, c := range stops {
+			fmt.Fprintf(&b, `<color rgb="FF%02X%02X%02X"/>`, c.R, c.G, c.B)
+		}
+		b.WriteString("</colorScale></cfRule></conditionalFormatting>")
+	}
+	b.WriteString(`<pageMargins left="0.7" right="0.7" top="0.75" bottom="0.75" header="0.3" footer="0.3"/>`)
+	if s.chart != nil {
+		b.WriteString(`<drawing r:id="rId1"/>`)
+	}
+	b.WriteString("</worksheet>")
+	return b.Bytes()
+}
+
+// xlsxFloorColumns are the columns of the floor sheets. Failed samples
+// leave the signal empty, so they do not skew the color scale and the
+// statistics of spreadsheets.
+func xlsxFloorColumns(loc *time.Location) []xlsxColumn {
+	return []xlsxColumn{
+		{"ID", 12, func(m Measurement) xlsxCell { return xlsxText(m.ID) }},
+		{"Time (" + loc.String() + ")", 20, func(m Measurement) xlsxCell {
+			return xlsxNumber(xlsxSerial(m.Timestamp, loc), xlsxStyleTime)
+		}},
+		{"Signal (dBm)", 13, func(m Measurement) xlsxCell {
+			if m.Dbm == failedSampleDbm {
+				return xlsxCell{}
+			}
+			return xlsxNumber(float64(m.Dbm), xlsxStyleDefault)
+		}},
+		{"Location", 20, func(m Measurement) xlsxCell { return xlsxText(m.Location) }},
+		{"Type", 10, func(m Measurement) xlsxCell { return xlsxText(m.Type) }},
+		{"Source", 9, func(m Measurement) xlsxCell { return xlsxText(m.source()) }},
+		{"Class", 11, func(m Measurement) xlsxCell { return xlsxText(m.class()) }},
+		{"Lat", 12, func(m Measurement) xlsxCell { return xlsxNumber(m.Lat, xlsxStyleCoordinate) }},
+		{"Lng", 12, func(m Measurement) xlsxCell { return xlsxNumber(m.Lng, xlsxStyleCoordinate) }},
+		{"SSID", 18, func(m Measurement) xlsxCell { return xlsxText(m.SSID) }},
+		{"BSSID", 18, func(m Measurement) xlsxCell { return xlsxText(m.BSSID) }},
+		{"Channel", 9, func(m Measurement) xlsxCell {
+			if m.Channel == 0 {
+				return xlsxCell{}
+			}
+			return xlsxNumber(float64(m.Channel), xlsxStyleDefault)
+		}},
+		{"Frequency (MHz)", 15, func(m Measurement) xlsxCell {
+			if m.Freq == 0 {
+				return xlsxCell{}
+			}
+			return xlsxNumber(float64(m.Freq), xlsxStyleDefault)
+		}},
+		{"Tx bitrate (Mbit/s)", 18, func(m Measurement) xlsxCell {
+			if m.TxBitrate == 0 {
+				return xlsxCell{}
+			}
+			return xlsxNumber(m.TxBitrate, xlsxStyleDecimal)
+		}},
+		{"Noise (dBm)", 12, func(m Measurement) xlsxCell { return xlsxOptional(m.NoiseDbm) }},
+		{"SNR (dB)", 10, func(m Measurement) xlsxCell { return xlsxOptional(m.SNRDb) }},
+		{"Latency (ms)", 12, func(m Measurement) xlsxCell { return xlsxOptional(m.LatencyMs) }},
+		{"Jitter (ms)", 11, func(m Measurement) xlsxCell { return xlsxOptional(m.JitterMs) }},
+		{"Loss (%)", 10, func(m Measurement) xlsxCell { return xlsxOptional(m.LossPercent) }},
+		{"Throughput (Mbit/s)", 19, func(m Measurement) xlsxCell { return xlsxOptional(m.ThroughputMbps) }},
+		{"Upload (Mbit/s)", 15, func(m Measurement) xlsxCell { return xlsxOptional(m.UploadMbps) }},
+		{"Height (m)", 11, func(m Measurement) xlsxCell { return xlsxOptional(m.Height) }},
+		{"Session", 12, func(m Measurement) xlsxCell { return xlsxText(m.SessionID) }},
+	}
+}
+
+// xlsxChart is a column chart of the median signal per floor, from the
+// Floor and Median columns of the summary sheet with rows floor rows. The
+// values are cached in the chart for viewers that do not recalculate.
+func xlsxChart(sheet string, rows int, names []string, medians []float64) []byte {
+	sheet = xlsxEscape(xlsxSheetRef(sheet))
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<c:chartSpace xmlns:c="http://schemas.openxmlformats.org/drawingml/2006/chart" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><c:chart>`)
+	b.WriteString(`<c:title><c:tx><c:rich><a:bodyPr/><a:p><a:r><a:t>Median signal per floor (dBm)</a:t></a:r></a:p></c:rich></c:tx><c:overlay val="0"/></c:title><c:autoTitleDeleted val="0"/>`)
+	b.WriteString(`<c:plotArea><c:layout/><c:barChart><c:barDir val="col"/><c:grouping val="clustered"/><c:varyColors val="0"/><c:ser><c:idx val="0"/><c:order val="0"/>`)
+	fmt.Fprintf(&b, `<c:tx><c:v>Median (dBm)</c:v></c:tx><c:invertIfNegative val="0"/>`)
+	fmt.Fprintf(&b, `<c:cat><c:strRef><c:f>%s!$B$2:$B$%d</c:f><c:strCache><c:ptCount val="%d"/>`, sheet, rows+1, len(names))
+	for i, name := range names {
+		fmt.Fprintf(&b, `<c:pt idx="%d"><c:v>%s</c:v></c:pt>`, i, xlsxEscape(name))
+	}
+	fmt.Fprintf(&b, `</c:strCache></c:strRef></c:cat><c:val><c:numRef><c:f>%s!$G$2:$G$%d</c:f><c:numCache><c:formatCode>General</c:formatCode><c:ptCount val="%d"/>`, sheet, rows+1, len(medians))
+	for i, median := range medians {
+		fmt.Fprintf(&b, `<c:pt idx="%d"><c:v>%s</c:v></c:pt>`, i, strconv.FormatFloat(median, 'f', -1, 64))
+	}
+	b.WriteString(`</c:numCache></c:numRef></c:val></c:ser><c:axId val="1"/><c:axId val="2"/></c:barChart>`)
+	b.WriteString(`<c:catAx><c:axId val="1"/><c:scaling><c:orientation val="minMax"/></c:scaling><c:delete val="0"/><c:axPos val="b"/><c:tickLblPos val="low"/><c:crossAx val="2"/><c:crosses val="autoZero"/></c:catAx>`)
+	b.WriteString(`<c:valAx><c:axId val="2"/><c:scaling><c:orientation val="minMax"/></c:scaling><c:delete val="0"/><c:axPos val="l"/><c:majorGridlines/><c:numFmt formatCode="0" sourceLinked="0"/><c:tickLblPos val="nextTo"/><c:crossAx val="1"/><c:crosses val="autoZero"/></c:valAx>`)
+	b.WriteString(`</c:plotArea><c:plotVisOnly val="1"/></c:chart></c:chartSpace>`)
+	return b.Bytes()
+}
+
+// xlsxDrawing anchors the chart below row from, across the summary
+// columns.
+func xlsxDrawing(from int) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<xdr:wsDr xmlns:xdr="http://schemas.openxmlformats.org/drawingml/2006/spreadsheetDrawing" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main"><xdr:twoCellAnchor><xdr:from><xdr:col>0</xdr:col><xdr:colOff>0</xdr:colOff><xdr:row>%d</xdr:row><xdr:rowOff>0</xdr:rowOff></xdr:from><xdr:to><xdr:col>9</xdr:col><xdr:colOff>0</xdr:colOff><xdr:row>%d</xdr:row><xdr:rowOff>0</xdr:rowOff></xdr:to><xdr:graphicFrame macro=""><xdr:nvGraphicFramePr><xdr:cNvPr id="2" name="Chart 1"/><xdr:cNvGraphicFramePr/></xdr:nvGraphicFramePr><xdr:xfrm><a:off x="0" y="0"/><a:ext cx="0" cy="0"/></xdr:xfrm><a:graphic><a:graphicData uri="http://schemas.openxmlformats.org/drawingml/2006/chart"><c:chart xmlns:c="http://schemas.openxmlformats.org/drawingml/2006/chart" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" r:id="rId1"/></a:graphicData></a:graphic></xdr:graphicFrame><xdr:clientData/></xdr:twoCellAnchor></xdr:wsDr>`, from, from+20))
+}
+
+// writeMeasurementsXLSX writes the measurements as a workbook for people
+// who read surveys in a spreadsheet: a summary sheet with the signal
+// statistics of every floor, a chart of them and the export metadata,
+// then one sheet per floor with a column per field, the signal colored on
+// the heatmap palette. Times are dates in the time zone of the style, UTC
+// by default.
+func writeMeasurementsXLSX(w io.Writer, ms []Measurement, meta *ExportMetadata, style timeStyle) error {
+	loc := style.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	settings := effectiveSettings()
+	threshold := thresholdProfiles[settings.Threshold]
+	signal := metrics[defaultMetric]
+
+	byFloor := make(map[int][]Measurement)
+	for _, m := range ms {
+		byFloor[m.Floor] = append(byFloor[m.Floor], m)
+	}
+	floorIDs := make([]int, 0, len(byFloor))
+	for id := range byFloor {
+		floorIDs = append(floorIDs, id)
+	}
+	sort.Ints(floorIDs)
+
+	used := map[string]bool{}
+	summary := &xlsxSheet{
+		name:   xlsxSheetName("Summary", used),
+		widths: []float64{8, 24, 14, 9, 11, 11, 13, 11, 11, 20},
+		rows: [][]xlsxCell{{
+			{text: "Floor ID", style: xlsxStyleHeader}, {text: "Floor", style: xlsxStyleHeader},
+			{text: "Measurements", style: xlsxStyleHeader}, {text: "Failed", style: xlsxStyleHeader},
+			{text: "Min (dBm)", style: xlsxStyleHeader}, {text: "P10 (dBm)", style: xlsxStyleHeader},
+			{text: "Median (dBm)", style: xlsxStyleHeader}, {text: "Mean (dBm)", style: xlsxStyleHeader},
+			{text: "Max (dBm)", style: xlsxStyleHeader},
+			{text: fmt.Sprintf("At least %d dBm", threshold.MinDbm), style: xlsxStyleHeader},
+		}},
+	}
+	sheets := []*xlsxSheet{summary}
+	var chartNames []string
+	var chartMedians []float64
+
+	columns := xlsxFloorColumns(loc)
+	for _, id := range floorIDs {
+		mutex.Lock()
+		floor := floors[id]
+		mutex.Unlock()
+		name := floor.Name
+		if name == "" {
+			name = fmt.Sprintf("Floor %d", id)
+		}
+
+		group := statsGroup(strconv.Itoa(id), byFloor[id])
+		row := []xlsxCell{xlsxNumber(float64(id), xlsxStyleDefault), xlsxText(name),
+			xlsxNumber(float64(group.Measurements), xlsxStyleDefault), xlsxNumber(float64(group.Failed), xlsxStyleDefault)}
+		if stats, ok := group.Metrics[defaultMetric]; ok {
+			passed := 0
+			for _, m := range byFloor[id] {
+				if threshold.passes(m.Dbm) {
+					passed++
+				}
+			}
+			row = append(row, xlsxNumber(stats.Min, xlsxStyleDefault), xlsxNumber(stats.P10, xlsxStyleDecimal),
+				xlsxNumber(stats.Median, xlsxStyleDecimal), xlsxNumber(stats.Mean, xlsxStyleDecimal),
+				xlsxNumber(stats.Max, xlsxStyleDefault), xlsxNumber(float64(passed)/float64(group.Measurements), xlsxStylePercent))
+			chartNames = append(chartNames, name)
+			chartMedians = append(chartMedians, stats.Median)
+		}
+		summary.rows = append(summary.rows, row)
+
+		sheet := &xlsxSheet{
+			name:       xlsxSheetName(fmt.Sprintf("%d %s", id, name), used),
+			colorScale: "C",
+			scaleMin:   signal.Min,
+			scaleMax:   signal.Max,
+			scaleStops: colorScales[settings.Palette],
+		}
+		header := make([]xlsxCell, len(columns))
+		for i, column := range columns {
+			header[i] = xlsxCell{text: column.header, style: xlsxStyleHeader}
+			sheet.widths = append(sheet.widths, column.width)
+		}
+		sheet.rows = append(sheet.rows, header)
+		for _, m := range byFloor[id] {
+			cells := make([]xlsxCell, len(columns))
+			for i, column := range columns {
+				cells[i] = column.cell(m)
+			}
+			sheet.rows = append(sheet.rows, cells)
+		}
+		sheets = append(sheets, sheet)
+	}
+
+	// The chart only plots floors with a signal, which head the summary
+	// when every floor has one; otherwise its ranges would skip rows.
+	if len(chartNames) > 0 && len(chartNames) == len(floorIDs) {
+		summary.chart = xlsxChart(summary.name, len(floorIDs), chartNames, chartMedians)
+		summary.chartRow = len(summary.rows) + 1
+	}
+
+	if meta != nil {
+		filters, _ := json.Marshal(meta.Filters)
+		info := [][2]string{
+			{"Exported", style.format(meta.ExportedAt, time.RFC3339)},
+			{"Filters", string(filters)},
+			{"Server version", meta.ServerVersion},
+			{"Data revision", meta.DataRevision},
+		}
+		if meta.SiteID != "" {
+			info = append(info, [2]string{"Site", meta.SiteID})
+		}
+		// Below the chart, which spans 20 rows.
+		for len(summary.rows) < summary.chartRow+21 && summary.chart != nil {
+			summary.rows = append(summary.rows, nil)
+		}
+		summary.rows = append(summary.rows, nil)
+		for _, item := range info {
+			summary.rows = append(summary.rows, []xlsxCell{{text: item[0], style: xlsxStyleHeader}, xlsxText(item[1])})
+		}
+	}
+
+	archive := zip.NewWriter(w)
+	modified := time.Now()
+	if meta != nil {
+		modified = meta.ExportedAt
+	}
+	add := func(name string, data []byte) error {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		return err
+	}
+
+	var contentTypes, workbook, workbookRels strings.Builder
+	contentTypes.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+
+	for i, sheet := range sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(sheet.name), n, n)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", n), sheet.xml()); err != nil {
+			return err
+		}
+		if sheet.chart == nil {
+			continue
+		}
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/drawings/drawing%d.xml" ContentType="application/vnd.openxmlformats-officedocument.drawing+xml"/><Override PartName="/xl/charts/chart%d.xml" ContentType="application/vnd.openxmlformats-officedocument.drawingml.chart+xml"/>`, n, n)
+		parts := map[string]string{
+			fmt.Sprintf("xl/worksheets/_rels/sheet%d.xml.rels", n): fmt.Sprintf(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/drawing" Target="../drawings/drawing%d.xml"/>`, n),
+			fmt.Sprintf("xl/drawings/_rels/drawing%d.xml.rels", n): fmt.Sprintf(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/chart" Target="../charts/chart%d.xml"/>`, n),
+		}
+		for name, relationship := range parts {
+			rels := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + relationship + `</Relationships>`
+			if err := add(name, []byte(rels)); err != nil {
+				return err
+			}
+		}
+		if err := add(fmt.Sprintf("xl/drawings/drawing%d.xml", n), xlsxDrawing(sheet.chartRow)); err != nil {
+			return err
+		}
+		if err := add(fmt.Sprintf("xl/charts/chart%d.xml", n), sheet.chart); err != nil {
+			return err
+		}
+	}
+	contentTypes.WriteString("</Types>")
+	workbook.WriteString("</sheets>")
+	// Spreadsheets keep the range of an autofilter in a hidden name.
+	var names strings.Builder
+	for i, sheet := range sheets {
+		if filter := sheet.filterRange(); filter != "" {
+			fmt.Fprintf(&names, `<definedName name="_xlnm._FilterDatabase" localSheetId="%d" hidden="1">%s!%s</definedName>`, i, xlsxEscape(xlsxSheetRef(sheet.name)), filter)
+		}
+	}
+	if names.Len() > 0 {
+		workbook.WriteString("<definedNames>" + names.String() + "</definedNames>")
+	}
+	workbook.WriteString("</workbook>")
+	workbookRels.WriteString("</Relationships>")
+
+	rootRels := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	parts := []struct {
+		name string
+		data string
+	}{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.String()},
+		{"xl/styles.xml", xlsxStyles},
+	}
+	for _, part := range parts {
+		if err := add(part.name, []byte(part.data)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const zonesFile = "zones.json"
+
+var (
+	zones     = make(map[string]Zone)
+	zonesLock sync.Mutex
+)
+
+// Zone is a named polygonal area of a floor, such as an open office or a
+// meeting room. Threshold and Coverage optionally set the zone's own
+// coverage requirement, used instead of the requested threshold.
+type Zone struct {
+	ID        string   `json:"id"`
+	Floor     int      `json:"floor"`
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind,omitempty"`
+	Polygon   []Vertex `json:"polygon"`
+	Threshold string   `json:"threshold,omitempty"`
+	Coverage  float64  `json:"coverage,omitempty"`
+}
+
+// ZoneStats summarises the measurements inside a zone and its interpolated
+// coverage against the zone's requirement.
+type ZoneStats struct {
+	Zone         Zone     `json:"zone"`
+	Measurements int      `json:"measurements"`
+	Failed       int      `json:"failed"`
+	MinDbm       *int     `json:"minDbm,omitempty"`
+	MaxDbm       *int     `json:"maxDbm,omitempty"`
+	MeanDbm      *float64 `json:"meanDbm,omitempty"`
+	MedianDbm    *int     `json:"medianDbm,omitempty"`
+	// Score is the mean experience score of the measurements in the zone.
+	Score            *float64 `json:"score,omitempty"`
+	AreaPixels       float64  `json:"areaPixels"`
+	AreaSquareMeters float64  `json:"areaSquareMeters,omitempty"`
+	Threshold        int      `json:"threshold"`
+	RequiredCoverage float64  `json:"requiredCoverage"`
+	Coverage         float64  `json:"coverage"`
+	Pass             bool     `json:"pass"`
+	// Unevaluated marks a zone smaller than the grid step, whose coverage
+	// could not be computed.
+	Unevaluated bool `json:"unevaluated,omitempty"`
+}
+
+func loadZones() error {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	data, err := os.ReadFile(projectFile(zonesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, &zones)
+}
+
+func saveZones() error {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	data, err := json.MarshalIndent(zones, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(projectFile(zonesFile), data, 0644)
+}
+
+func getZone(id string) (Zone, bool) {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	zone, exists := zones[id]
+	return zone, exists
+}
+
+// floorZones returns the zones of a floor sorted by name.
+func floorZones(floorID int) []Zone {
+	zonesLock.Lock()
+	list := []Zone{}
+	for _, zone := range zones {
+		if floorID <= 0 || zone.Floor == floorID {
+			list = append(list, zone)
+		}
+	}
+	zonesLock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Floor != list[j].Floor {
+			return list[i].Floor < list[j].Floor
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// polygonArea returns the area enclosed by the polygon, by the shoelace
+// formula.
+func polygonArea(polygon []Vertex) float64 {
+	var area float64
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		area += polygon[j].Lng*polygon[i].Lat - polygon[i].Lng*polygon[j].Lat
+	}
+	return math.Abs(area) / 2
+}
+
+func decodeZone(w http.ResponseWriter, r *http.Request) (Zone, bool) {
+	var zone Zone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return zone, false
+	}
+
+	var err error
+	if zone.Name, err = cleanText("name", zone.Name, maxNameLength, false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return zone, false
+	}
+	if zone.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return zone, false
+	}
+	if len(zone.Polygon) < 3 {
+		http.Error(w, "polygon needs at least 3 vertices", http.StatusBadRequest)
+		return zone, false
+	}
+	if zone.Coverage < 0 || zone.Coverage > 100 {
+		http.Error(w, "coverage must be between 0 and 100 percent", http.StatusBadRequest)
+		return zone, false
+	}
+	if zone.Threshold != "" {
+		if _, err := thresholdParam(url.Values{"threshold": {zone.Threshold}}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return zone, false
+		}
+	}
+
+	mutex.Lock()
+	_, floorExists := floors[zone.Floor]
+	mutex.Unlock()
+
+	if !floorExists {
+		http.Error(w, "floor not found", http.StatusBadRequest)
+		return zone, false
+	}
+
+	return zone, true
+}
+
+func zonesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		floor, err := strconv.Atoi(r.URL.Query().Get("floor"))
+		if err != nil {
+			floor = 0
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(floorZones(floor))
+	case "POST":
+		zone, ok := decodeZone(w, r)
+		if !ok {
+			return
+		}
+		zone.ID = generateID()
+
+		zonesLock.Lock()
+		zones[zone.ID] = zone
+		zonesLock.Unlock()
+
+		if err := saveZones(); err != nil {
+			http.Error(w, "failed to save zones", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(zone)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func zoneHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	zone, exists := getZone(id)
+	if !exists {
+		http.Error(w, "zone not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		updated, ok := decodeZone(w, r)
+		if !ok {
+			return
+		}
+		updated.ID = id
+		zone = updated
+
+		zonesLock.Lock()
+		zones[id] = zone
+		zonesLock.Unlock()
+
+		if err := saveZones(); err != nil {
+			http.Error(w, "failed to save zones", http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		zonesLock.Lock()
+		delete(zones, id)
+		zonesLock.Unlock()
+
+		if err := saveZones(); err != nil {
+			http.Error(w, "failed to save zones", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+// computeZoneStats evaluates every zone of a floor. Zones without their own
+// requirement are held to the given threshold profile.
+func computeZoneStats(ctx context.Context, floor Floor, ms []Measurement, params HeatmapParams, threshold ThresholdProfile, score Metric) ([]ZoneStats, error) {
+	list := floorZones(floor.ID)
+	if len(list) == 0 {
+		return []ZoneStats{}, nil
+	}
+
+	rules := make([]SLARule, len(list))
+	for i, zone := range list {
+		rules[i] = SLARule{Name: zone.Name, Threshold: zone.Threshold, Coverage: zone.Coverage, Region: zone.Polygon}
+		if rules[i].Threshold == "" {
+			rules[i].Threshold = strconv.Itoa(threshold.MinDbm)
+		}
+	}
+
+	coverage, err := evaluateSLA(ctx, floor, ms, params, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	metersPerPixel := floor.metersPerPixel()
+
+	samples := params.selectMeasurements(ms)
+	stats := make([]ZoneStats, len(list))
+	for i, zone := range list {
+		s := ZoneStats{
+			Zone:             zone,
+			AreaPixels:       math.Round(polygonArea(zone.Polygon)),
+			Threshold:        coverage[i].MinDbm,
+			RequiredCoverage: coverage[i].RequiredCoverage,
+			Coverage:         coverage[i].Coverage,
+			Pass:             coverage[i].Pass,
+			Unevaluated:      coverage[i].Unevaluated,
+		}
+		if metersPerPixel > 0 {
+			s.AreaSquareMeters = math.Round(s.AreaPixels*metersPerPixel*metersPerPixel*10) / 10
+		}
+
+		var values []int
+		var scoreSum float64
+		var scored int
+		for _, m := range samples {
+			if !polygonContains(zone.Polygon, m.Lat, m.Lng) {
+				continue
+			}
+			s.Measurements++
+			if value, ok := score.value(m); ok {
+				scoreSum += value
+				scored++
+			}
+			if m.Dbm == failedSampleDbm {
+				s.Failed++
+				continue
+			}
+			values = append(values, m.Dbm)
+		}
+
+		if len(values) > 0 {
+			minDbm, maxDbm, sum := values[0], values[0], 0
+			for _, v := range values {
+				minDbm, maxDbm, sum = min(minDbm, v), max(maxDbm, v), sum+v
+			}
+			mean := math.Round(float64(sum)/float64(len(values))*10) / 10
+			median := calculateMedian(values)
+			s.MinDbm, s.MaxDbm, s.MeanDbm, s.MedianDbm = &minDbm, &maxDbm, &mean, &median
+		}
+		if scored > 0 {
+			mean := math.Round(scoreSum/float64(scored)*10) / 10
+			s.Score = &mean
+		}
+
+		stats[i] = s
+	}
+
+	return stats, nil
+}
+
+// zoneStatsHandler returns per-zone statistics of a floor. The threshold
+// parameter applies to zones without their own requirement; heatmap query
+// parameters select the measurements and the interpolation.
+func zoneStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	floorID, err := strconv.Atoi(query.Get("floor"))
+	if err != nil {
+		http.Error(w, "floor is required", http.StatusBadRequest)
+		return
+	}
+
+	threshold, err := thresholdParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	weights, err := scoreWeightsParam(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseHeatmapParams(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Metric.Name != defaultMetric {
+		http.Error(w, errSignalOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	floor, exists := floors[floorID]
+	var filtered []Measurement
+	for _, m := range measurements {
+		if m.Floor == floorID {
+			filtered = append(filtered, m)
+		}
+	}
+	mutex.Unlock()
+
+	if !exists {
+		http.Error(w, "floor not found", http.StatusNotFound)
+		return
+	}
+
+	withRenderSlot(w, r, func(ctx context.Context) {
+		stats, err := computeZoneStats(ctx, floor, filtered, params, threshold, scoreMetric(weights))
+		if err != nil {
+			if ctx.Err() != nil {
+				http.Error(w, "zone evaluation timed out", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, fmt.Sprintf("failed to evaluate zones: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}